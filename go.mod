@@ -2,4 +2,4 @@ module go-bitcoin
 
 go 1.24.2
 
-require golang.org/x/crypto v0.43.0 // indirect
+require golang.org/x/crypto v0.43.0
@@ -3,6 +3,7 @@ package address
 import (
 	"fmt"
 	"go-bitcoin/internal/encoding"
+	"strings"
 )
 
 type Network int
@@ -41,13 +42,14 @@ const (
 	P2SH                   // base58check
 	P2WPKH                 // bech32, 20 bytes
 	P2WSH                  // bech32, 32 bytes
-	P2TR                   // bech32m, 32 bytes -- not implemented
+	P2TR                   // bech32m, 32 bytes
 )
 
 type Address struct {
 	Type    AddrType
 	Network Network
 	String  string
+	Program []byte // hash160 for base58 addresses, witness program for segwit
 }
 
 // FromHash160 creates a P2PKH or P2SH address from a hash160
@@ -70,6 +72,7 @@ func FromHash160(hash160 []byte, addrType AddrType, net Network) (*Address, erro
 		String:  addrString,
 		Type:    addrType,
 		Network: net,
+		Program: hash160,
 	}, nil
 }
 
@@ -93,6 +96,8 @@ func FromWitnessProgram(version byte, program []byte, net Network) (*Address, er
 		} else {
 			addrType = P2WSH
 		}
+	} else if version == 1 && len(program) == 32 {
+		addrType = P2TR
 	} else {
 		return nil, fmt.Errorf("unsupported witness version: %d", version)
 	}
@@ -107,5 +112,42 @@ func FromWitnessProgram(version byte, program []byte, net Network) (*Address, er
 		String:  bech32String,
 		Type:    addrType,
 		Network: net,
+		Program: program,
 	}, nil
 }
+
+// Parse decodes a base58 P2PKH or P2SH address, or a bech32/bech32m segwit address,
+// working out its type and network
+func Parse(addr string) (*Address, error) {
+	lower := strings.ToLower(addr)
+	for _, net := range []Network{MAINNET, TESTNET} {
+		if !strings.HasPrefix(lower, net.Bech32HRP()+"1") {
+			continue
+		}
+		hrp, version, program, err := decodeSegwit(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid segwit address %s: %w", addr, err)
+		}
+		if hrp != net.Bech32HRP() {
+			return nil, fmt.Errorf("invalid segwit address %s: hrp %s", addr, hrp)
+		}
+		return FromWitnessProgram(version, program, net)
+	}
+
+	decoded, err := encoding.DecodeBase58Checksum(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %w", addr, err)
+	}
+	if len(decoded) != 21 {
+		return nil, fmt.Errorf("invalid address %s: %d byte payload", addr, len(decoded))
+	}
+	for _, net := range []Network{MAINNET, TESTNET} {
+		switch decoded[0] {
+		case net.P2PKHVersion():
+			return FromHash160(decoded[1:], P2PKH, net)
+		case net.P2SHVersion():
+			return FromHash160(decoded[1:], P2SH, net)
+		}
+	}
+	return nil, fmt.Errorf("invalid address %s: unknown version byte %#x", addr, decoded[0])
+}
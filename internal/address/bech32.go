@@ -10,9 +10,20 @@ const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l" // lookup table
 
 var generator = []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
 
+// Checksum constants: bech32 (BIP 173) for witness v0, bech32m (BIP 350) for v1 and up
+const (
+	BECH32_CONST  int = 1
+	BECH32M_CONST int = 0x2bc830a3
+)
+
 // Encode encodes hrp(human-readable part) and data(32bit data array), returns Bech32 / or error
 // if hrp is uppercase, return uppercase Bech32
 func Encode(hrp string, data []int) (string, error) {
+	return encode(hrp, data, BECH32_CONST)
+}
+
+// encode is Encode with the checksum constant picking bech32 or bech32m
+func encode(hrp string, data []int, spec int) (string, error) {
 	// validate hrp
 	if (len(hrp) + len(data) + 7) > 90 {
 		return "", fmt.Errorf("too long: hrp length=%d, data length=%d", len(hrp), len(data))
@@ -30,7 +41,7 @@ func Encode(hrp string, data []int) (string, error) {
 	}
 	lower := strings.ToLower(hrp) == hrp
 	hrp = strings.ToLower(hrp)
-	combined := append(data, createChecksum(hrp, data)...)
+	combined := append(data, createChecksum(hrp, data, spec)...)
 	var ret bytes.Buffer
 	ret.WriteString(hrp)
 	ret.WriteString("1")
@@ -64,7 +75,60 @@ func encodeBech32(witnessVersion byte, witnessProgram []byte, hrp string) (strin
 	// concatenate version + converted program
 	data = append(data, converted...)
 
-	return Encode(hrp, data)
+	spec := BECH32_CONST
+	if witnessVersion > 0 {
+		spec = BECH32M_CONST
+	}
+	return encode(hrp, data, spec)
+}
+
+// decodeSegwit decodes a segwit address, checking it uses bech32 for witness v0 and
+// bech32m after, and returns its hrp, witness version and program
+func decodeSegwit(addr string) (string, byte, []byte, error) {
+	if len(addr) > 90 {
+		return "", 0, nil, fmt.Errorf("too long: %d characters", len(addr))
+	}
+	if strings.ToUpper(addr) != addr && strings.ToLower(addr) != addr {
+		return "", 0, nil, fmt.Errorf("mix case: %s", addr)
+	}
+	addr = strings.ToLower(addr)
+	pos := strings.LastIndexByte(addr, '1')
+	if pos < 1 || pos+7 > len(addr) {
+		return "", 0, nil, fmt.Errorf("invalid separator position: %d", pos)
+	}
+	hrp := addr[:pos]
+	data := make([]int, 0, len(addr)-pos-1)
+	for _, c := range addr[pos+1:] {
+		d := strings.IndexRune(charset, c)
+		if d < 0 {
+			return "", 0, nil, fmt.Errorf("invalid character: %q", c)
+		}
+		data = append(data, d)
+	}
+	spec := polymod(append(hrpExpand(hrp), data...))
+	if spec != BECH32_CONST && spec != BECH32M_CONST {
+		return "", 0, nil, fmt.Errorf("bad checksum: %s", addr)
+	}
+	data = data[:len(data)-6]
+	if len(data) < 1 || data[0] > 16 {
+		return "", 0, nil, fmt.Errorf("invalid witness version")
+	}
+	version := byte(data[0])
+	if (version == 0) != (spec == BECH32_CONST) {
+		return "", 0, nil, fmt.Errorf("witness v%d with the wrong checksum variant", version)
+	}
+	converted, err := convertbits(data[1:], 5, 8, false)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(converted) < 2 || len(converted) > 40 {
+		return "", 0, nil, fmt.Errorf("invalid witness program length: %d", len(converted))
+	}
+	program := make([]byte, len(converted))
+	for i, b := range converted {
+		program[i] = byte(b)
+	}
+	return hrp, version, program, nil
 }
 
 func polymod(values []int) int {
@@ -95,12 +159,12 @@ func hrpExpand(hrp string) []int {
 }
 
 func verifyChecksum(hrp string, data []int) bool {
-	return polymod(append(hrpExpand(hrp), data...)) == 1
+	return polymod(append(hrpExpand(hrp), data...)) == BECH32_CONST
 }
 
-func createChecksum(hrp string, data []int) []int {
+func createChecksum(hrp string, data []int, spec int) []int {
 	values := append(append(hrpExpand(hrp), data...), []int{0, 0, 0, 0, 0, 0}...)
-	mod := polymod(values) ^ 1
+	mod := polymod(values) ^ spec
 	ret := make([]int, 6)
 	for p := 0; p < len(ret); p++ {
 		ret[p] = (mod >> uint(5*(5-p))) & 31
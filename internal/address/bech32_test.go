@@ -64,3 +64,49 @@ func TestBech32Mainnet(t *testing.T) {
 		})
 	}
 }
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		addr    string
+		typ     AddrType
+		net     Network
+		program string // hex
+	}{
+		{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", P2PKH, MAINNET, "751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r", P2PKH, TESTNET, "751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"3CK4fEwbMP7heJarmU4eqA3sMbVJyEnU3V", P2SH, MAINNET, "748284390f9e263a4b766a75d0633c50426eb875"},
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", P2WPKH, MAINNET, "751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"TB1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KXPJZSX", P2WPKH, TESTNET, "751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3", P2WSH, MAINNET, "1863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262"},
+		// BIP 86 first receiving address
+		{"bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr", P2TR, MAINNET, "a60869f0dbcf1dc659c9cecbaf8050135ea9e8cdc487053f1dc6880949dc684c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			a, err := Parse(tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Type != tt.typ || a.Network != tt.net || hex.EncodeToString(a.Program) != tt.program {
+				t.Errorf("got type %d network %d program %x", a.Type, a.Network, a.Program)
+			}
+		})
+	}
+	t.Logf("✓ Base58, bech32 and bech32m addresses parse to their type, network and program")
+
+	invalid := []string{
+		"",
+		"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMJ", // bad base58 checksum
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5",                     // bad bech32 checksum
+		"bc1qW508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",                     // mixed case
+		"bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqr9a0ap", // v1 with a bech32 checksum
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh",                     // v0 with a bech32m checksum
+		"ltc1qw508d6qejxtdg4y5r3zarvary0c5xw7kgmn4n9",                    // foreign hrp
+	}
+	for _, addr := range invalid {
+		if _, err := Parse(addr); err == nil {
+			t.Errorf("Parse(%q) succeeded", addr)
+		}
+	}
+	t.Logf("✓ Bad checksums, mixed case, wrong checksum variants and unknown networks are rejected")
+}
@@ -219,6 +219,17 @@ func (b *Block) Difficulty() *big.Int {
 	return diff
 }
 
+// Work is the expected number of hashes needed to find a header with these bits:
+// 2^256 / (target + 1)
+func (b *Block) Work() *big.Int {
+	target := b.bitsToTarget()
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	denom := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denom)
+}
+
 func (b *Block) CheckProofOfWork() bool {
 	hash, _ := b.Hash()
 	slices.Reverse(hash)
@@ -270,33 +281,89 @@ type FullBlock struct {
 }
 
 func ParseFullBlock(r io.Reader) (*FullBlock, error) {
+	var txs []*transactions.Transaction
+	header, err := ParseFullBlockFunc(r, func(i int, tx *transactions.Transaction) error {
+		txs = append(txs, tx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &FullBlock{
+		BlockHeader: &header,
+		Txs:         txs,
+	}, nil
+}
+
+// ParseFullBlockFunc parses a block one transaction at a time, handing each to fn in
+// order instead of keeping them, so large blocks can be scanned in constant memory.
+// It stops at the first error from fn and returns it.
+func ParseFullBlockFunc(r io.Reader, fn func(i int, tx *transactions.Transaction) error) (Block, error) {
 	header, err := ParseBlock(r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse block header: %w", err)
+		return Block{}, fmt.Errorf("failed to parse block header: %w", err)
 	}
 
 	txCount, err := encoding.ReadVarInt(r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse transaction length: %w", err)
+		return Block{}, fmt.Errorf("failed to parse transaction length: %w", err)
 	}
 
-	txs := make([]*transactions.Transaction, txCount)
 	for i := uint64(0); i < txCount; i++ {
 		tx, err := transactions.ParseTransaction(r)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse txn %d/%d: %w", i, txCount, err)
+			return Block{}, fmt.Errorf("failed to parse txn %d/%d: %w", i, txCount, err)
+		}
+		if err := fn(int(i), &tx); err != nil {
+			return Block{}, err
 		}
-		txs[i] = &tx
 	}
 
-	return &FullBlock{
-		BlockHeader: &header,
-		Txs:         txs,
-	}, nil
+	return header, nil
+}
+
+// Serialize encodes the block as ParseFullBlock reads it, with witness data
+func (fb *FullBlock) Serialize() ([]byte, error) {
+	return fb.serialize(true)
+}
+
+// SerializeNoWitness encodes the block with every transaction in legacy form, as
+// served for MSG_BLOCK
+func (fb *FullBlock) SerializeNoWitness() ([]byte, error) {
+	return fb.serialize(false)
+}
+
+func (fb *FullBlock) serialize(witness bool) ([]byte, error) {
+	header, err := fb.BlockHeader.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	count, err := encoding.EncodeVarInt(uint64(len(fb.Txs)))
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(header)
+	buf.Write(count)
+	for i, tx := range fb.Txs {
+		var txBytes []byte
+		if witness {
+			txBytes, err = tx.Serialize()
+		} else {
+			txBytes, err = tx.SerializeLegacy()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize txn %d: %w", i, err)
+		}
+		buf.Write(txBytes)
+	}
+	return buf.Bytes(), nil
 }
 
 // ExtractBasicFilterItems extracts items for BIP158 basic filter from a block
 // Returns: all scriptPubKeys from outputs and all outpoints from inputs (serialized)
+// prevOutputScripts are the scriptPubKeys the block's inputs spend; for a connected block
+// chainstate.ChainManager.SpentScripts reads them from the block's undo record
 func (fb *FullBlock) ExtractBasicFilterItems(prevOutputScripts [][]byte) [][]byte {
 	items := make([][]byte, 0)
 
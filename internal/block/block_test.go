@@ -0,0 +1,90 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"go-bitcoin/internal/transactions"
+	"testing"
+)
+
+func TestParseFullBlockFunc(t *testing.T) {
+	fb := testBlock(t, testCoinbase(0), testCoinbase(1), testCoinbase(2))
+	raw := rawBlock(t, fb)
+
+	var ids [][32]byte
+	header, err := ParseFullBlockFunc(bytes.NewReader(raw), func(i int, tx *transactions.Transaction) error {
+		if i != len(ids) {
+			t.Fatalf("tx %d handed off out of order", i)
+		}
+		id, _ := tx.Hash()
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashOf(header) != hashOf(*fb.BlockHeader) || len(ids) != len(fb.Txs) {
+		t.Fatalf("expected header and %d txs, got %d", len(fb.Txs), len(ids))
+	}
+	for i, tx := range fb.Txs {
+		if want, _ := tx.Hash(); ids[i] != want {
+			t.Fatalf("tx %d doesn't match", i)
+		}
+	}
+
+	// an error from the callback stops parsing
+	stop := errors.New("stop")
+	calls := 0
+	_, err = ParseFullBlockFunc(bytes.NewReader(raw), func(int, *transactions.Transaction) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("expected to stop after one tx, got %d calls: %v", calls, err)
+	}
+
+	parsed, err := ParseFullBlock(bytes.NewReader(raw))
+	if err != nil || len(parsed.Txs) != len(fb.Txs) {
+		t.Fatalf("ParseFullBlock: %v", err)
+	}
+	t.Logf("✓ Streamed %d transactions", len(ids))
+}
+
+func TestFullBlockSerialize(t *testing.T) {
+	fb := segwitBlock(t, make([]byte, 32), true, false)
+	raw, err := fb.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseFullBlock(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := parsed.Serialize()
+	if err != nil || !bytes.Equal(again, raw) {
+		t.Fatalf("witness serialization doesn't round-trip: %v", err)
+	}
+	if err := parsed.CheckBlock(); err != nil {
+		t.Fatalf("round-tripped block invalid: %v", err)
+	}
+
+	stripped, err := fb.SerializeNoWitness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := ParseFullBlock(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stripped) >= len(raw) || legacy.hasWitness() {
+		t.Fatal("witness data not stripped")
+	}
+	for i, tx := range legacy.Txs {
+		got, _ := tx.Hash()
+		want, _ := fb.Txs[i].Hash()
+		if got != want {
+			t.Fatalf("tx %d changed when stripped", i)
+		}
+	}
+	t.Logf("✓ Round-tripped a %d-byte witness block, %d bytes stripped", len(raw), len(stripped))
+}
@@ -0,0 +1,454 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/encoding"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Block file layout. Each record is the block hash (internal byte order), its height and
+// length (uint32 little endian) followed by the serialized block.
+const (
+	BLOCK_FILE_MAX_SIZE   int64  = 128 << 20 // start a new file past this size, as Core does
+	BLOCK_FILE_PATTERN    string = "blk%05d.dat"
+	BLOCK_RECORD_OVERHEAD int    = 32 + 4 + 4
+)
+
+var ErrBlockPruned = errors.New("block has been pruned")
+
+// BlockLocation is where a stored block lives
+type BlockLocation struct {
+	File   int
+	Offset int64 // start of the serialized block, past the record header
+	Size   int
+	Height int
+}
+
+// blockFile tracks the heights stored in one file, for pruning
+type blockFile struct {
+	num       int
+	size      int64
+	minHeight int
+	maxHeight int
+}
+
+func (f *blockFile) addHeight(height int) {
+	if f.minHeight < 0 || height < f.minHeight {
+		f.minHeight = height
+	}
+	f.maxHeight = max(f.maxHeight, height)
+}
+
+// BlockStore appends serialized blocks to numbered files in a directory and indexes them
+// by hash and height. The index is rebuilt by scanning the record headers on open. It
+// satisfies the network package's BlockSource for serving getdata.
+// Files whose blocks are all at or below both the prune target and the height marked
+// applied by MarkApplied can be deleted with Prune.
+type BlockStore struct {
+	MaxFileSize int64
+
+	dir      string
+	mu       sync.RWMutex
+	index    map[[32]byte]BlockLocation
+	undo     map[[32]byte]BlockLocation // undo records, in the rev file numbered like the block's file
+	byHeight map[int][32]byte           // most recently stored block at each height
+	files    []*blockFile               // oldest first; the last one is written to
+	cur      *os.File
+	applied  int // blocks up to here have been applied to the chain state
+	pruned   int // highest height removed by Prune, -1 if none
+	tip      int
+}
+
+// OpenBlockStore opens (or creates) a block store in dir. A partial or corrupt record
+// left by an interrupted write is truncated along with anything after it.
+func OpenBlockStore(dir string) (*BlockStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	bs := &BlockStore{
+		MaxFileSize: BLOCK_FILE_MAX_SIZE,
+		dir:         dir,
+		index:       make(map[[32]byte]BlockLocation),
+		undo:        make(map[[32]byte]BlockLocation),
+		byHeight:    make(map[int][32]byte),
+		applied:     -1,
+		pruned:      -1,
+		tip:         -1,
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "blk*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, name := range names {
+		var num int
+		if _, err := fmt.Sscanf(filepath.Base(name), BLOCK_FILE_PATTERN, &num); err == nil {
+			nums = append(nums, num)
+		}
+	}
+	slices.Sort(nums)
+	parents := make(map[[32]byte][32]byte)
+	for _, num := range nums {
+		if err := bs.scanFile(num, parents); err != nil {
+			return nil, err
+		}
+	}
+	bs.dropStaleHeights(parents)
+	for _, num := range nums {
+		if err := bs.scanUndoFile(num); err != nil {
+			return nil, err
+		}
+	}
+	if len(bs.files) > 0 && bs.files[0].num > 0 {
+		// files below the oldest one were deleted by an earlier Prune
+		bs.pruned = bs.files[0].minHeight - 1
+	}
+	next := 0
+	if len(bs.files) > 0 {
+		next = bs.files[len(bs.files)-1].num
+	}
+	if err := bs.openForAppend(next); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+func (bs *BlockStore) path(num int) string {
+	return filepath.Join(bs.dir, fmt.Sprintf(BLOCK_FILE_PATTERN, num))
+}
+
+// scanFile indexes the records in one file, truncating a partial trailing record, and
+// notes each block's parent in parents
+func (bs *BlockStore) scanFile(num int, parents map[[32]byte][32]byte) error {
+	f, err := os.OpenFile(bs.path(num), os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	bf := &blockFile{num: num, minHeight: -1, maxHeight: -1}
+	header := make([]byte, BLOCK_RECORD_OVERHEAD)
+	blockHeader := make([]byte, HEADER_SIZE)
+	var good int64
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		hash := [32]byte(header[:32])
+		height := int(binary.LittleEndian.Uint32(header[32:36]))
+		size := int64(binary.LittleEndian.Uint32(header[36:40]))
+		// a record is only kept if it is complete and its block header hashes to its hash
+		end := good + int64(BLOCK_RECORD_OVERHEAD) + size
+		if size < int64(HEADER_SIZE) || end > info.Size() {
+			break
+		}
+		if _, err := io.ReadFull(f, blockHeader); err != nil {
+			return err
+		}
+		if !bytes.Equal(encoding.Hash256(blockHeader), hash[:]) {
+			break
+		}
+		if _, err := f.Seek(end, io.SeekStart); err != nil {
+			return err
+		}
+		bs.indexBlock(hash, BlockLocation{File: num, Offset: good + int64(BLOCK_RECORD_OVERHEAD), Size: int(size), Height: height})
+		parents[hash] = [32]byte(blockHeader[4:36])
+		bf.addHeight(height)
+		good = end
+	}
+	if err := f.Truncate(good); err != nil {
+		return err
+	}
+	bf.size = good
+	bs.files = append(bs.files, bf)
+	return nil
+}
+
+// dropStaleHeights unindexes by height the blocks left above a disconnected branch: going
+// up from the lowest height, a block whose parent is stored but isn't the block at the
+// height below was built on a branch that has since been replaced. They stay stored by
+// hash. Caller holds mu or has the store to itself.
+func (bs *BlockStore) dropStaleHeights(parents map[[32]byte][32]byte) {
+	heights := slices.Sorted(maps.Keys(bs.byHeight))
+	for _, height := range heights {
+		parent := parents[bs.byHeight[height]]
+		if _, stored := bs.index[parent]; !stored {
+			continue
+		}
+		if below, ok := bs.byHeight[height-1]; !ok || below != parent {
+			delete(bs.byHeight, height)
+		}
+	}
+	bs.resetTip()
+}
+
+// resetTip lowers the tip to the highest height still holding a block. Caller holds mu.
+func (bs *BlockStore) resetTip() {
+	for bs.tip >= 0 {
+		if _, ok := bs.byHeight[bs.tip]; ok {
+			return
+		}
+		bs.tip--
+	}
+}
+
+// openForAppend makes file num the one written to, creating it if needed
+func (bs *BlockStore) openForAppend(num int) error {
+	f, err := os.OpenFile(bs.path(num), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if bs.cur != nil {
+		bs.cur.Close()
+	}
+	bs.cur = f
+	if len(bs.files) == 0 || bs.files[len(bs.files)-1].num != num {
+		bs.files = append(bs.files, &blockFile{num: num, minHeight: -1, maxHeight: -1})
+	}
+	return nil
+}
+
+// indexBlock records a block's location. Caller holds mu.
+func (bs *BlockStore) indexBlock(hash [32]byte, loc BlockLocation) {
+	bs.index[hash] = loc
+	bs.byHeight[loc.Height] = hash
+	bs.tip = max(bs.tip, loc.Height)
+}
+
+// PutBlock appends a serialized block (witness serialization) at height. Blocks already
+// stored are only indexed by height again; storing another block at a height makes it the
+// one HashAt returns. A failed write leaves the file as it was.
+func (bs *BlockStore) PutBlock(hash [32]byte, height int, raw []byte) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if loc, ok := bs.index[hash]; ok {
+		bs.byHeight[loc.Height] = hash
+		bs.tip = max(bs.tip, loc.Height)
+		return nil
+	}
+	last := bs.files[len(bs.files)-1]
+	if last.size > 0 && last.size+int64(BLOCK_RECORD_OVERHEAD+len(raw)) > bs.MaxFileSize {
+		if err := bs.openForAppend(last.num + 1); err != nil {
+			return err
+		}
+		last = bs.files[len(bs.files)-1]
+	}
+
+	record := make([]byte, BLOCK_RECORD_OVERHEAD, BLOCK_RECORD_OVERHEAD+len(raw))
+	copy(record, hash[:])
+	binary.LittleEndian.PutUint32(record[32:36], uint32(height))
+	binary.LittleEndian.PutUint32(record[36:40], uint32(len(raw)))
+	record = append(record, raw...)
+	if _, err := bs.cur.Write(record); err != nil {
+		// cut off whatever part of the record was written, so the next block isn't
+		// stored behind it
+		if terr := os.Truncate(bs.path(last.num), last.size); terr != nil {
+			return errors.Join(fmt.Errorf("failed to write block: %w", err), terr)
+		}
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	bs.indexBlock(hash, BlockLocation{File: last.num, Offset: last.size + int64(BLOCK_RECORD_OVERHEAD), Size: len(raw), Height: height})
+	last.size += int64(len(record))
+	last.addHeight(height)
+	return nil
+}
+
+// Disconnect removes a block from the height index once the chain state has disconnected
+// it, so HashAt and Tip stop returning it. It stays stored by hash, for a reorg back to
+// its branch, and can be indexed again with PutBlock.
+func (bs *BlockStore) Disconnect(hash [32]byte) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	loc, ok := bs.index[hash]
+	if !ok || bs.byHeight[loc.Height] != hash {
+		return
+	}
+	delete(bs.byHeight, loc.Height)
+	bs.applied = min(bs.applied, loc.Height-1)
+	bs.resetTip()
+}
+
+// Location returns where a block is stored
+func (bs *BlockStore) Location(hash [32]byte) (BlockLocation, bool) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	loc, ok := bs.index[hash]
+	return loc, ok
+}
+
+// RawBlock returns a stored block's serialization and height
+func (bs *BlockStore) RawBlock(hash [32]byte) ([]byte, int, bool) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	loc, ok := bs.index[hash]
+	if !ok {
+		return nil, 0, false
+	}
+	raw, err := bs.read(loc)
+	if err != nil {
+		return nil, 0, false
+	}
+	return raw, loc.Height, true
+}
+
+// read loads a block from its file. Caller holds mu.
+func (bs *BlockStore) read(loc BlockLocation) ([]byte, error) {
+	f, err := os.Open(bs.path(loc.File))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	raw := make([]byte, loc.Size)
+	if _, err := f.ReadAt(raw, loc.Offset); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// FullBlock parses a stored block
+func (bs *BlockStore) FullBlock(hash [32]byte) (*FullBlock, int, error) {
+	raw, height, ok := bs.RawBlock(hash)
+	if !ok {
+		return nil, 0, fmt.Errorf("block %x not stored", hash)
+	}
+	fb, err := ParseFullBlock(bytes.NewReader(raw))
+	return fb, height, err
+}
+
+// HashAt returns the hash of the block stored at height
+func (bs *BlockStore) HashAt(height int) ([32]byte, bool) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	hash, ok := bs.byHeight[height]
+	return hash, ok
+}
+
+// Tip returns the height and header of the highest stored block
+func (bs *BlockStore) Tip() (int, *Block) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	loc, ok := bs.index[bs.byHeight[bs.tip]]
+	if !ok {
+		return -1, nil
+	}
+	raw, err := bs.read(loc)
+	if err != nil {
+		return -1, nil
+	}
+	header, err := ParseBlock(bytes.NewReader(raw))
+	if err != nil {
+		return -1, nil
+	}
+	return loc.Height, &header
+}
+
+// Rescan calls fn with each stored block from start to stop in height order, for wallet
+// rescans and index rebuilds. Pruned heights return ErrBlockPruned.
+func (bs *BlockStore) Rescan(start, stop int, fn func(height int, fb *FullBlock) error) error {
+	for h := start; h <= stop; h++ {
+		hash, ok := bs.HashAt(h)
+		if !ok {
+			if h <= bs.PrunedHeight() {
+				return fmt.Errorf("%w: height %d", ErrBlockPruned, h)
+			}
+			return fmt.Errorf("no block stored at height %d", h)
+		}
+		fb, _, err := bs.FullBlock(hash)
+		if err != nil {
+			return fmt.Errorf("block %d: %w", h, err)
+		}
+		if err := fn(h, fb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkApplied records that blocks up to height have been applied to the chain state
+// (their spent outputs recorded), so their files may be pruned
+func (bs *BlockStore) MarkApplied(height int) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.applied = max(bs.applied, height)
+}
+
+// PrunedHeight returns the highest height whose block may have been pruned, or -1
+func (bs *BlockStore) PrunedHeight() int {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	return bs.pruned
+}
+
+// Prunable reports whether Prune(height) would delete any files
+func (bs *BlockStore) Prunable(height int) bool {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	return len(bs.files) > 1 && bs.files[0].maxHeight <= min(height, bs.applied)
+}
+
+// Prune deletes the oldest block files, and their undo files, whose blocks are all at or
+// below height and already applied. The file being written to is kept. It returns the
+// numbers of deleted files.
+func (bs *BlockStore) Prune(height int) ([]int, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	limit := min(height, bs.applied)
+	var deleted []int
+	for len(bs.files) > 1 && bs.files[0].maxHeight <= limit {
+		f := bs.files[0]
+		if err := os.Remove(bs.path(f.num)); err != nil {
+			return deleted, err
+		}
+		if err := os.Remove(bs.undoPath(f.num)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return deleted, err
+		}
+		for hash, loc := range bs.undo {
+			if loc.File == f.num {
+				delete(bs.undo, hash)
+			}
+		}
+		for hash, loc := range bs.index {
+			if loc.File == f.num {
+				delete(bs.index, hash)
+				if bs.byHeight[loc.Height] == hash {
+					delete(bs.byHeight, loc.Height)
+				}
+			}
+		}
+		bs.pruned = max(bs.pruned, f.maxHeight)
+		bs.files = bs.files[1:]
+		deleted = append(deleted, f.num)
+	}
+	return deleted, nil
+}
+
+// Close syncs and closes the file being written to
+func (bs *BlockStore) Close() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.cur == nil {
+		return nil
+	}
+	if err := bs.cur.Sync(); err != nil {
+		bs.cur.Close()
+		return err
+	}
+	err := bs.cur.Close()
+	bs.cur = nil
+	return err
+}
@@ -0,0 +1,231 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+// rawBlock serializes a block made by testBlock
+func rawBlock(t *testing.T, fb *FullBlock) []byte {
+	t.Helper()
+	raw, err := fb.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestBlockStore(t *testing.T) {
+	dir := t.TempDir()
+	bs, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes [][32]byte
+	var raws [][]byte
+	for h := range 6 {
+		fb := testBlock(t, testCoinbase(byte(h)))
+		hashes = append(hashes, hashOf(*fb.BlockHeader))
+		raws = append(raws, rawBlock(t, fb))
+	}
+	bs.MaxFileSize = int64(2 * (BLOCK_RECORD_OVERHEAD + len(raws[0]))) // two blocks per file
+	for h := range hashes {
+		if err := bs.PutBlock(hashes[h], h, raws[h]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loc, _ := bs.Location(hashes[5]); loc.File != 2 {
+		t.Fatalf("expected block 5 in file 2, got %d", loc.File)
+	}
+	raw, height, ok := bs.RawBlock(hashes[3])
+	if !ok || height != 3 || !bytes.Equal(raw, raws[3]) {
+		t.Fatal("stored block doesn't round-trip")
+	}
+	if tipHeight, tip := bs.Tip(); tipHeight != 5 || hashOf(*tip) != hashes[5] {
+		t.Fatalf("unexpected tip at %d", tipHeight)
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a torn write at the end of the last file is dropped on reopen
+	f, _ := os.OpenFile(bs.path(2), os.O_APPEND|os.O_WRONLY, 0o644)
+	f.Write(make([]byte, BLOCK_RECORD_OVERHEAD+3))
+	f.Close()
+	bs, err = OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	bs.MaxFileSize = int64(2 * (BLOCK_RECORD_OVERHEAD + len(raws[0])))
+	var rescanned [][32]byte
+	err = bs.Rescan(0, 5, func(height int, fb *FullBlock) error {
+		rescanned = append(rescanned, hashOf(*fb.BlockHeader))
+		return nil
+	})
+	if err != nil || !slices.Equal(rescanned, hashes) {
+		t.Fatalf("rescan after reopen: %v", err)
+	}
+
+	// nothing is pruned until the chain state has applied the blocks
+	if deleted, err := bs.Prune(3); err != nil || len(deleted) != 0 {
+		t.Fatalf("pruned unapplied blocks: %v %v", deleted, err)
+	}
+	if err := bs.PutUndo(hashes[1], []byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.PutUndo(hashes[4], []byte{0x04}); err != nil {
+		t.Fatal(err)
+	}
+	bs.MarkApplied(3)
+	deleted, err := bs.Prune(10)
+	if err != nil || !slices.Equal(deleted, []int{0, 1}) {
+		t.Fatalf("expected files 0 and 1 pruned, got %v %v", deleted, err)
+	}
+	if _, _, ok := bs.RawBlock(hashes[1]); ok {
+		t.Fatal("pruned block still served")
+	}
+	if _, _, ok := bs.RawBlock(hashes[4]); !ok {
+		t.Fatal("unpruned block missing")
+	}
+	if _, ok := bs.Undo(hashes[1]); ok {
+		t.Fatal("pruned block's undo data still served")
+	}
+	if undo, ok := bs.Undo(hashes[4]); !ok || !bytes.Equal(undo, []byte{0x04}) {
+		t.Fatal("unpruned block's undo data missing")
+	}
+	if err := bs.Rescan(0, 5, func(int, *FullBlock) error { return nil }); !errors.Is(err, ErrBlockPruned) {
+		t.Fatalf("expected ErrBlockPruned, got %v", err)
+	}
+	if bs.PrunedHeight() != 3 {
+		t.Fatalf("expected pruned height 3, got %d", bs.PrunedHeight())
+	}
+	t.Logf("✓ %d block files, pruned %v up to height %d", 3, deleted, bs.PrunedHeight())
+}
+
+func TestBlockStoreReorg(t *testing.T) {
+	dir := t.TempDir()
+	bs, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a0 <- a1 <- a2 <- a3, and b2 competing with a2
+	chain := func(prev [32]byte, tag byte) (*FullBlock, [32]byte) {
+		fb := testBlock(t, testCoinbase(tag))
+		fb.BlockHeader.PrevBlock = prev
+		return fb, hashOf(*fb.BlockHeader)
+	}
+	var a []*FullBlock
+	var hashes [][32]byte
+	var prev [32]byte
+	for h := range 4 {
+		fb, hash := chain(prev, byte(h))
+		a, hashes = append(a, fb), append(hashes, hash)
+		if err := bs.PutBlock(hash, h, rawBlock(t, fb)); err != nil {
+			t.Fatal(err)
+		}
+		prev = hash
+	}
+	b2, b2Hash := chain(hashes[1], 0xb2)
+
+	// the a branch is disconnected down to a1 and b2 takes its place
+	bs.Disconnect(hashes[3])
+	bs.Disconnect(hashes[2])
+	if height, tip := bs.Tip(); height != 1 || hashOf(*tip) != hashes[1] {
+		t.Fatalf("tip at %d after disconnecting a3 and a2", height)
+	}
+	if _, ok := bs.HashAt(2); ok {
+		t.Fatal("disconnected block still at height 2")
+	}
+	if err := bs.PutBlock(b2Hash, 2, rawBlock(t, b2)); err != nil {
+		t.Fatal(err)
+	}
+	check := func(when string) {
+		t.Helper()
+		if height, tip := bs.Tip(); height != 2 || hashOf(*tip) != b2Hash {
+			t.Fatalf("%s: tip at %d, want b2", when, height)
+		}
+		if _, ok := bs.HashAt(3); ok {
+			t.Fatalf("%s: stale a3 still at height 3", when)
+		}
+		if _, _, ok := bs.RawBlock(hashes[3]); !ok {
+			t.Fatalf("%s: stale a3 no longer stored", when)
+		}
+	}
+	check("after the reorg")
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stale a3 isn't indexed by height again on reopen
+	bs, err = OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	check("after reopening")
+
+	// reconnecting the a branch indexes its stored blocks again
+	for h := 2; h < 4; h++ {
+		if err := bs.PutBlock(hashes[h], h, rawBlock(t, a[h])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if height, tip := bs.Tip(); height != 3 || hashOf(*tip) != hashes[3] {
+		t.Fatalf("tip at %d after reconnecting a3", height)
+	}
+	t.Logf("✓ Disconnected blocks leave the height index")
+}
+
+func TestBlockStoreFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	bs, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbs := []*FullBlock{testBlock(t, testCoinbase(0)), testBlock(t, testCoinbase(1)), testBlock(t, testCoinbase(2))}
+	if err := bs.PutBlock(hashOf(*fbs[0].BlockHeader), 0, rawBlock(t, fbs[0])); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(bs.path(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a write that fails after part of the record reached the file
+	f, _ := os.OpenFile(bs.path(0), os.O_APPEND|os.O_WRONLY, 0o644)
+	f.Write(make([]byte, BLOCK_RECORD_OVERHEAD+3))
+	f.Close()
+	writable := bs.cur
+	bs.cur, _ = os.Open(bs.path(0))
+	if err := bs.PutBlock(hashOf(*fbs[1].BlockHeader), 1, rawBlock(t, fbs[1])); err == nil {
+		t.Fatal("write to a read-only file succeeded")
+	}
+	bs.cur.Close()
+	bs.cur = writable
+	if after, _ := os.Stat(bs.path(0)); after.Size() != info.Size() {
+		t.Fatalf("file is %d bytes after the failed write, want %d", after.Size(), info.Size())
+	}
+
+	// the next block is stored where the failed one would have been, and survives a reopen
+	if err := bs.PutBlock(hashOf(*fbs[2].BlockHeader), 1, rawBlock(t, fbs[2])); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bs, err = OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	if raw, height, ok := bs.RawBlock(hashOf(*fbs[2].BlockHeader)); !ok || height != 1 || !bytes.Equal(raw, rawBlock(t, fbs[2])) {
+		t.Fatal("block written after a failed write lost on reopen")
+	}
+	t.Logf("✓ A failed write leaves no partial record behind")
+}
@@ -0,0 +1,105 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"go-bitcoin/internal/encoding"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Undo records are the block hash, the data length (uint32 little endian), the data and
+// a Hash256 checksum of hash and data, as in Bitcoin Core's rev*.dat files
+const (
+	UNDO_FILE_PATTERN    string = "rev%05d.dat"
+	UNDO_RECORD_OVERHEAD int    = 32 + 4 + 32
+)
+
+func (bs *BlockStore) undoPath(num int) string {
+	return filepath.Join(bs.dir, fmt.Sprintf(UNDO_FILE_PATTERN, num))
+}
+
+func undoChecksum(hash [32]byte, data []byte) []byte {
+	return encoding.Hash256(append(hash[:], data...))
+}
+
+// scanUndoFile indexes the undo records paired with block file num, truncating a torn or
+// corrupt tail
+func (bs *BlockStore) scanUndoFile(num int) error {
+	f, err := os.OpenFile(bs.undoPath(num), os.O_RDWR, 0o644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	var good int
+	for good+UNDO_RECORD_OVERHEAD <= len(data) {
+		hash := [32]byte(data[good : good+32])
+		size := int(binary.LittleEndian.Uint32(data[good+32 : good+36]))
+		start := good + 36
+		end := start + size + 32
+		if end > len(data) || !bytes.Equal(undoChecksum(hash, data[start:start+size]), data[start+size:end]) {
+			break
+		}
+		bs.undo[hash] = BlockLocation{File: num, Offset: int64(start), Size: size, Height: bs.index[hash].Height}
+		good = end
+	}
+	return f.Truncate(int64(good))
+}
+
+// PutUndo stores the undo data for a stored block alongside it
+func (bs *BlockStore) PutUndo(hash [32]byte, data []byte) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	loc, ok := bs.index[hash]
+	if !ok {
+		return fmt.Errorf("block %x not stored", hash)
+	}
+	f, err := os.OpenFile(bs.undoPath(loc.File), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	record := append(hash[:], binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	record = append(append(record, data...), undoChecksum(hash, data)...)
+	if _, err := f.Write(record); err != nil {
+		return fmt.Errorf("failed to write undo data: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	bs.undo[hash] = BlockLocation{File: loc.File, Offset: info.Size() + 36, Size: len(data), Height: loc.Height}
+	return nil
+}
+
+// Undo returns the undo data stored for a block
+func (bs *BlockStore) Undo(hash [32]byte) ([]byte, bool) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	loc, ok := bs.undo[hash]
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(bs.undoPath(loc.File))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	data := make([]byte, loc.Size)
+	if _, err := f.ReadAt(data, loc.Offset); err != nil {
+		return nil, false
+	}
+	return data, true
+}
@@ -0,0 +1,323 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"slices"
+	"sync"
+)
+
+// HEADER_SIZE is the serialized size of a block header
+const HEADER_SIZE int = 80
+
+var (
+	ErrOrphanHeader = errors.New("header does not connect to a known header")
+	ErrInvalidPoW   = errors.New("header does not satisfy its proof of work target")
+)
+
+// ReorgEvent describes a switch of the active chain to a branch with more work.
+// Hashes are in internal byte order.
+type ReorgEvent struct {
+	ForkHeight   int        // last height both branches share
+	Disconnected [][32]byte // stale headers, old tip first
+	Connected    [][32]byte // headers of the new branch, lowest first
+}
+
+// headerNode is one header in the block tree
+type headerNode struct {
+	header Block
+	hash   [32]byte
+	height int
+	work   *big.Int // cumulative chain work up to and including this header
+	parent *headerNode
+}
+
+// ChainStore keeps every header it has seen indexed by hash, tracks the active chain by
+// height and switches to whichever branch has the most cumulative work, reporting the
+// switch through OnReorg. Stores opened with OpenChainStore append each new header to a
+// flat file of 80-byte headers and replay it on open.
+type ChainStore struct {
+	OnReorg     func(ReorgEvent) // called without the store locked
+	Checkpoints []Checkpoint     // headers contradicting these are rejected; set before adding
+
+	addMu  sync.Mutex // serializes AddHeader so the file always lists parents first
+	mu     sync.RWMutex
+	index  map[[32]byte]*headerNode
+	active []*headerNode // index = height, genesis at 0
+	file   *os.File
+}
+
+// NewChainStore returns an in-memory store rooted at genesis
+func NewChainStore(genesis Block) *ChainStore {
+	hash, _ := genesis.Hash()
+	root := &headerNode{
+		header: genesis,
+		hash:   [32]byte(hash),
+		work:   genesis.Work(),
+	}
+	return &ChainStore{
+		index:  map[[32]byte]*headerNode{root.hash: root},
+		active: []*headerNode{root},
+	}
+}
+
+// OpenChainStore opens (or creates) the header file at path and replays it. A partial
+// header left by an interrupted write is truncated.
+func OpenChainStore(path string, genesis Block) (*ChainStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	cs := NewChainStore(genesis)
+
+	buf := make([]byte, HEADER_SIZE)
+	var good int64
+	for {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			f.Close()
+			return nil, err
+		}
+		header, err := ParseBlock(bytes.NewReader(buf))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, _, err := cs.add(header); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("header file %s at offset %d: %w", path, good, err)
+		}
+		good += int64(HEADER_SIZE)
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	cs.file = f
+	return cs, nil
+}
+
+// ChainWork sums the work of a run of headers
+func ChainWork(headers []Block) *big.Int {
+	work := new(big.Int)
+	for i := range headers {
+		work.Add(work, headers[i].Work())
+	}
+	return work
+}
+
+// SelectBestChain returns the index of the header chain with the most cumulative work,
+// not the most headers. Ties go to the earliest candidate, i.e. the first one seen.
+// Candidates should share a starting point for the comparison to mean anything.
+func SelectBestChain(chains ...[]Block) int {
+	best, bestWork := -1, new(big.Int)
+	for i, chain := range chains {
+		if work := ChainWork(chain); best < 0 || work.Cmp(bestWork) > 0 {
+			best, bestWork = i, work
+		}
+	}
+	return best
+}
+
+// AddHeader stores a header whose parent is already known. It returns true if the header
+// became the new tip. Headers already stored are ignored.
+func (cs *ChainStore) AddHeader(header Block) (bool, error) {
+	cs.addMu.Lock()
+	defer cs.addMu.Unlock()
+	stored, reorg, err := cs.add(header)
+	if err != nil || !stored {
+		return false, err
+	}
+	if cs.file != nil {
+		raw, _ := header.Serialize()
+		if _, err := cs.file.Write(raw); err != nil {
+			return false, fmt.Errorf("failed to persist header: %w", err)
+		}
+	}
+	if reorg != nil && len(reorg.Disconnected) > 0 && cs.OnReorg != nil {
+		cs.OnReorg(*reorg)
+	}
+	return reorg != nil, nil
+}
+
+// add indexes a header and moves the active chain to it if it has the most work. The
+// returned event is nil if the active chain didn't change.
+func (cs *ChainStore) add(header Block) (bool, *ReorgEvent, error) {
+	h, _ := header.Hash()
+	hash := [32]byte(h)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.index[hash]; ok {
+		return false, nil, nil
+	}
+	parent, ok := cs.index[header.PrevBlock]
+	if !ok {
+		return false, nil, fmt.Errorf("%w: %x", ErrOrphanHeader, header.PrevBlock)
+	}
+	height := parent.height + 1
+	if err := VerifyCheckpoint(cs.Checkpoints, height, hash); err != nil {
+		return false, nil, err
+	}
+	if height <= cs.reachedCheckpoint() {
+		return false, nil, fmt.Errorf("%w: height %d", ErrForkBeforeCheckpoint, height)
+	}
+	if !header.CheckProofOfWork() {
+		return false, nil, ErrInvalidPoW
+	}
+	node := &headerNode{
+		header: header,
+		hash:   hash,
+		height: height,
+		work:   new(big.Int).Add(parent.work, header.Work()),
+		parent: parent,
+	}
+	cs.index[hash] = node
+
+	tip := cs.active[len(cs.active)-1]
+	if node.work.Cmp(tip.work) <= 0 {
+		return true, nil, nil // side branch with no more work than ours
+	}
+
+	// walk the new branch back to the active chain
+	var branch []*headerNode
+	fork := node
+	for fork.height >= len(cs.active) || cs.active[fork.height] != fork {
+		branch = append(branch, fork)
+		fork = fork.parent
+	}
+	ev := &ReorgEvent{ForkHeight: fork.height}
+	for _, stale := range slices.Backward(cs.active[fork.height+1:]) {
+		ev.Disconnected = append(ev.Disconnected, stale.hash)
+	}
+	cs.active = cs.active[:fork.height+1]
+	for _, n := range slices.Backward(branch) {
+		cs.active = append(cs.active, n)
+		ev.Connected = append(ev.Connected, n.hash)
+	}
+	return true, ev, nil
+}
+
+// reachedCheckpoint returns the height of the highest checkpoint on the active chain, or
+// -1. Caller holds mu.
+func (cs *ChainStore) reachedCheckpoint() int {
+	for _, cp := range slices.Backward(cs.Checkpoints) {
+		if cp.Height < len(cs.active) && cs.active[cp.Height].hash == cp.Hash {
+			return cp.Height
+		}
+	}
+	return -1
+}
+
+// AssumedValid reports whether scripts in the block at height can be skipped: av is on
+// the active chain and height is at or below it
+func (cs *ChainStore) AssumedValid(av Checkpoint, height int) bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return height <= av.Height && av.Height < len(cs.active) && cs.active[av.Height].hash == av.Hash
+}
+
+// Height returns the height of the active tip
+func (cs *ChainStore) Height() int {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return len(cs.active) - 1
+}
+
+// Tip returns the active tip header and its hash
+func (cs *ChainStore) Tip() (Block, [32]byte) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	tip := cs.active[len(cs.active)-1]
+	return tip.header, tip.hash
+}
+
+// ChainWork returns the cumulative work of the active chain
+func (cs *ChainStore) ChainWork() *big.Int {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return new(big.Int).Set(cs.active[len(cs.active)-1].work)
+}
+
+// WorkAt returns the cumulative work up to and including any stored header
+func (cs *ChainStore) WorkAt(hash [32]byte) (*big.Int, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	node, ok := cs.index[hash]
+	if !ok {
+		return nil, false
+	}
+	return new(big.Int).Set(node.work), true
+}
+
+// HashAt returns the hash of the active chain header at height
+func (cs *ChainStore) HashAt(height int) ([32]byte, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if height < 0 || height >= len(cs.active) {
+		return [32]byte{}, false
+	}
+	return cs.active[height].hash, true
+}
+
+// HeaderAt returns the active chain header at height
+func (cs *ChainStore) HeaderAt(height int) (Block, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if height < 0 || height >= len(cs.active) {
+		return Block{}, false
+	}
+	return cs.active[height].header, true
+}
+
+// Header looks up any stored header, on the active chain or not, returning its height
+func (cs *ChainStore) Header(hash [32]byte) (Block, int, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	node, ok := cs.index[hash]
+	if !ok {
+		return Block{}, 0, false
+	}
+	return node.header, node.height, true
+}
+
+// InActiveChain reports whether the header with hash is on the active chain
+func (cs *ChainStore) InActiveChain(hash [32]byte) bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	node, ok := cs.index[hash]
+	return ok && node.height < len(cs.active) && cs.active[node.height] == node
+}
+
+// Hashes returns the active chain hashes by height
+func (cs *ChainStore) Hashes() [][32]byte {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	hashes := make([][32]byte, len(cs.active))
+	for i, n := range cs.active {
+		hashes[i] = n.hash
+	}
+	return hashes
+}
+
+// Close flushes and closes the header file, if any
+func (cs *ChainStore) Close() error {
+	if cs.file == nil {
+		return nil
+	}
+	if err := cs.file.Sync(); err != nil {
+		cs.file.Close()
+		return err
+	}
+	return cs.file.Close()
+}
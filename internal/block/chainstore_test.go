@@ -0,0 +1,190 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// EASY_BITS is the regtest proof of work limit, so test headers mine in a few tries
+const EASY_BITS uint32 = 0x207fffff
+
+// HARDER_BITS has a target 1/8 of EASY_BITS, so each header carries 8 times the work
+const HARDER_BITS uint32 = 0x200fffff
+
+// mineHeaders builds n headers on top of prev; salt keeps competing branches distinct
+func mineHeaders(prev [32]byte, n int, salt byte) []Block {
+	return mineHeadersBits(prev, n, salt, EASY_BITS)
+}
+
+func mineHeadersBits(prev [32]byte, n int, salt byte, bits uint32) []Block {
+	var headers []Block
+	for i := range n {
+		header := NewBlock(1, prev, [32]byte{salt, byte(i)}, uint32(1231006505+i*600), bits, 0, nil)
+		for !header.CheckProofOfWork() {
+			header.Nonce++
+		}
+		hash, _ := header.Hash()
+		prev = [32]byte(hash)
+		headers = append(headers, header)
+	}
+	return headers
+}
+
+func hashOf(b Block) [32]byte {
+	h, _ := b.Hash()
+	return [32]byte(h)
+}
+
+func TestChainStoreReorg(t *testing.T) {
+	genesis := mineHeaders([32]byte{}, 1, 0)[0]
+	path := filepath.Join(t.TempDir(), "headers.dat")
+	cs, err := OpenChainStore(path, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []ReorgEvent
+	cs.OnReorg = func(ev ReorgEvent) { events = append(events, ev) }
+
+	main := mineHeaders(hashOf(genesis), 5, 1)
+	for _, h := range main {
+		if tip, err := cs.AddHeader(h); err != nil || !tip {
+			t.Fatalf("expected main chain header to become tip: %v", err)
+		}
+	}
+
+	// a competing branch from height 2 overtakes at height 6
+	fork := mineHeaders(hashOf(main[1]), 4, 2)
+	for i, h := range fork {
+		tip, err := cs.AddHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i == 3; tip != want {
+			t.Fatalf("fork header %d: became tip = %v, want %v", i, tip, want)
+		}
+	}
+	if cs.Height() != 6 {
+		t.Fatalf("expected height 6, got %d", cs.Height())
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 reorg, got %d", len(events))
+	}
+	ev := events[0]
+	wantStale := [][32]byte{hashOf(main[4]), hashOf(main[3]), hashOf(main[2])}
+	if ev.ForkHeight != 2 || !slices.Equal(ev.Disconnected, wantStale) || len(ev.Connected) != 4 {
+		t.Fatalf("unexpected reorg event: fork %d, %d disconnected, %d connected", ev.ForkHeight, len(ev.Disconnected), len(ev.Connected))
+	}
+	if cs.InActiveChain(hashOf(main[4])) {
+		t.Fatal("stale header still on the active chain")
+	}
+	if _, height, ok := cs.Header(hashOf(main[4])); !ok || height != 5 {
+		t.Fatal("stale header should stay indexed")
+	}
+	if _, err := cs.AddHeader(mineHeaders([32]byte{0xff}, 1, 3)[0]); !errors.Is(err, ErrOrphanHeader) {
+		t.Fatalf("expected ErrOrphanHeader, got %v", err)
+	}
+	work := cs.ChainWork()
+	if err := cs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening replays the file to the same tip
+	reopened, err := OpenChainStore(path, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	_, tipHash := reopened.Tip()
+	if tipHash != hashOf(fork[3]) || reopened.ChainWork().Cmp(work) != 0 {
+		t.Fatal("reopened store has a different tip")
+	}
+	t.Logf("✓ Reorg to fork at height %d survived a reopen", ev.ForkHeight)
+}
+
+func TestSelectBestChain(t *testing.T) {
+	genesis := mineHeaders([32]byte{}, 1, 0)[0]
+	long := mineHeaders(hashOf(genesis), 6, 1)
+	heavy := mineHeadersBits(hashOf(genesis), 2, 2, HARDER_BITS)
+
+	if ChainWork(heavy).Cmp(ChainWork(long)) <= 0 {
+		t.Fatalf("expected 2 harder headers (%s) to outweigh 6 easy ones (%s)", ChainWork(heavy), ChainWork(long))
+	}
+	if best := SelectBestChain(long, heavy); best != 1 {
+		t.Fatalf("expected the shorter, heavier chain, got %d", best)
+	}
+	if best := SelectBestChain(long, long); best != 0 {
+		t.Fatalf("expected ties to go to the first chain, got %d", best)
+	}
+
+	// the store follows work too: the heavy branch wins although it is shorter
+	cs := NewChainStore(genesis)
+	for _, h := range slices.Concat(long, heavy) {
+		if _, err := cs.AddHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, tip := cs.Tip(); tip != hashOf(heavy[1]) || cs.Height() != 2 {
+		t.Fatalf("expected heavy branch at height 2, got height %d", cs.Height())
+	}
+	want := new(big.Int).Add(genesis.Work(), ChainWork(heavy))
+	if cs.ChainWork().Cmp(want) != 0 {
+		t.Fatalf("chain work %s, want %s", cs.ChainWork(), want)
+	}
+	if work, ok := cs.WorkAt(hashOf(long[5])); !ok || work.Cmp(new(big.Int).Add(genesis.Work(), ChainWork(long))) != 0 {
+		t.Fatal("wrong work for stale branch tip")
+	}
+	t.Logf("✓ 2 headers with work %s beat 6 with work %s", ChainWork(heavy), ChainWork(long))
+}
+
+func TestChainStoreCheckpoints(t *testing.T) {
+	for _, testNet := range []bool{false, true} {
+		raw := MAINNET_GENESIS_BLOCK
+		if testNet {
+			raw = TESTNET_GENESIS_BLOCK
+		}
+		genesis, err := ParseBlock(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyCheckpoint(Checkpoints(testNet), 0, hashOf(genesis)); err != nil {
+			t.Fatalf("genesis doesn't match built-in checkpoint: %v", err)
+		}
+	}
+
+	genesis := mineHeaders([32]byte{}, 1, 0)[0]
+	main := mineHeaders(hashOf(genesis), 4, 1)
+	cs := NewChainStore(genesis)
+	cs.Checkpoints = []Checkpoint{{0, hashOf(genesis)}, {2, hashOf(main[1])}}
+
+	// a rival for the checkpointed height is rejected outright
+	if _, err := cs.AddHeader(main[0]); err != nil {
+		t.Fatal(err)
+	}
+	rival := mineHeaders(hashOf(main[0]), 1, 2)[0]
+	if _, err := cs.AddHeader(rival); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Fatalf("expected ErrCheckpointMismatch, got %v", err)
+	}
+	for _, h := range main[1:] {
+		if _, err := cs.AddHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// once the checkpoint is reached, nothing may fork below it
+	below := mineHeaders(hashOf(genesis), 1, 3)[0]
+	if _, err := cs.AddHeader(below); !errors.Is(err, ErrForkBeforeCheckpoint) {
+		t.Fatalf("expected ErrForkBeforeCheckpoint, got %v", err)
+	}
+	if _, err := cs.AddHeader(mineHeaders(hashOf(main[1]), 1, 4)[0]); err != nil {
+		t.Fatalf("fork above the checkpoint rejected: %v", err)
+	}
+
+	av := Checkpoint{Height: 2, Hash: hashOf(main[1])}
+	if !cs.AssumedValid(av, 2) || cs.AssumedValid(av, 3) || cs.AssumedValid(Checkpoint{Height: 2}, 1) {
+		t.Fatal("assume-valid should only cover ancestors of a block on the active chain")
+	}
+	t.Logf("✓ Checkpoint conflicts and forks below height %d rejected", av.Height)
+}
@@ -0,0 +1,88 @@
+package block
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Checkpoint pins the block hash (internal byte order) at a height
+type Checkpoint struct {
+	Height int
+	Hash   [32]byte
+}
+
+var (
+	ErrCheckpointMismatch   = errors.New("header contradicts checkpoint")
+	ErrForkBeforeCheckpoint = errors.New("header forks below the last checkpoint")
+)
+
+// checkpointHash parses a hash in display byte order
+func checkpointHash(display string) [32]byte {
+	b, err := hex.DecodeString(display)
+	if err != nil || len(b) != 32 {
+		panic(fmt.Sprintf("bad checkpoint hash %q", display))
+	}
+	slices.Reverse(b)
+	return [32]byte(b)
+}
+
+// MAINNET_CHECKPOINTS are the historical Bitcoin Core checkpoints
+var MAINNET_CHECKPOINTS = []Checkpoint{
+	{0, checkpointHash("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")},
+	{11111, checkpointHash("0000000069e244f73d78e8fd29ba2fd2ed618bd6fa2ee92559f542fdb26e7c1d")},
+	{33333, checkpointHash("000000002dd5588a74784eaa7ab0507a18ad16a236e7b1ce69f00d7ddfb5d0a6")},
+	{74000, checkpointHash("0000000000573993a3c9e41ce34471c079dcf5f52a0e824a81e7f953b8661a20")},
+	{105000, checkpointHash("00000000000291ce28027faea320c8d2b054b2e0fe44a773f3eefb151d6bdc97")},
+	{134444, checkpointHash("00000000000005b12ffd4cd315cd34ffd4a594f430ac814c91184a0d42d2b0fe")},
+	{168000, checkpointHash("000000000000099e61ea72015e79632f216fe6cb33d7899acb35b75c8303b763")},
+	{193000, checkpointHash("000000000000059f452a5f7340de6682a977387c17010ff6e6c3bd83ca8b1317")},
+	{210000, checkpointHash("000000000000048b95347e83192f69cf0366076336c639f9b7228e9ba171342e")},
+	{216116, checkpointHash("00000000000001b4f4b433e81ee46494af945cf96014816a4e2370f11b23df4e")},
+	{225430, checkpointHash("00000000000001c108384350f74090433e7fcf79a606b8e797f065b130575932")},
+	{250000, checkpointHash("000000000000003887df1f29024b06fc2200b55f8af8f35453d7be294df2d214")},
+	{279000, checkpointHash("0000000000000001ae8c72a0b0c301f67e3afca10e819efa9041e458e9bd7e40")},
+	{295000, checkpointHash("00000000000000004d9b4ef50f0f9d686fd69db2e03af35a100370c64632a983")},
+}
+
+// TESTNET_CHECKPOINTS are the historical Bitcoin Core testnet3 checkpoints
+var TESTNET_CHECKPOINTS = []Checkpoint{
+	{0, checkpointHash("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")},
+	{546, checkpointHash("000000002a936ca763904c3c35fce2f3556c559c0214345d31b1bcebf76acb70")},
+}
+
+// BIP30_EXCEPTIONS are the two mainnet blocks whose coinbases repeated the txid of an
+// earlier, still unspent coinbase, before BIP 30 made that invalid
+var BIP30_EXCEPTIONS = []Checkpoint{
+	{91842, checkpointHash("00000000000a4d0a398161ffc163c503763b1f4360639393e0e4c8e300e0caec")},
+	{91880, checkpointHash("00000000000743f190a18c5577a3c2d2a1f610ae9601ac046a38084ccb7cd721")},
+}
+
+// IsBIP30Exception reports whether the block at height is exempt from BIP 30
+func IsBIP30Exception(height int, hash [32]byte) bool {
+	return slices.Contains(BIP30_EXCEPTIONS, Checkpoint{height, hash})
+}
+
+// Checkpoints returns the built-in checkpoints for the network, lowest first
+func Checkpoints(testNet bool) []Checkpoint {
+	return Params(testNet).Checkpoints
+}
+
+// DefaultAssumeValid returns the built-in assume-valid block for the network (see
+// ChainParams.DefaultAssumeValid)
+func DefaultAssumeValid(testNet bool) Checkpoint {
+	return Params(testNet).DefaultAssumeValid()
+}
+
+// VerifyCheckpoint returns ErrCheckpointMismatch if a checkpoint pins height to a
+// different hash. checkpoints must be sorted by height.
+func VerifyCheckpoint(checkpoints []Checkpoint, height int, hash [32]byte) error {
+	i, found := slices.BinarySearchFunc(checkpoints, height, func(c Checkpoint, h int) int {
+		return c.Height - h
+	})
+	if found && checkpoints[i].Hash != hash {
+		return fmt.Errorf("%w at height %d: got %x, want %x", ErrCheckpointMismatch, height, hash, checkpoints[i].Hash)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+)
+
+// Coinbase scriptSig size limits, in bytes
+const (
+	MIN_COINBASE_SCRIPTSIG_SIZE int = 2
+	MAX_COINBASE_SCRIPTSIG_SIZE int = 100
+)
+
+var ErrCoinbaseScriptSig = errors.New("coinbase scriptSig size out of range")
+
+// NewCoinbase builds the coinbase for a block at height paying value to payoutScript. Its
+// scriptSig is the BIP 34 height followed by a push of extraNonce, if any, and must come
+// to at most MAX_COINBASE_SCRIPTSIG_SIZE bytes. A 32-byte witnessCommitment,
+// Hash256(witness merkle root || 32 zero bytes), is added as the last output, with the
+// all-zero reserved value as the input's witness; nil leaves the coinbase without one,
+// for blocks with no witness data.
+func NewCoinbase(height int, value uint64, payoutScript script.Script, extraNonce, witnessCommitment []byte) (*transactions.Transaction, error) {
+	if height < 0 {
+		return nil, fmt.Errorf("%w: negative height %d", ErrBadCoinbaseHeight, height)
+	}
+	raw := coinbaseHeightPrefix(height)
+	if len(extraNonce) > 0 {
+		pushScript := script.NewScript([]script.ScriptCommand{{Data: extraNonce, IsData: true}})
+		push, err := pushScript.RawBytes()
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, push...)
+	}
+	if len(raw) < MIN_COINBASE_SCRIPTSIG_SIZE {
+		raw = append(raw, script.OP_O) // pad a small height, as Bitcoin Core does
+	}
+	if len(raw) > MAX_COINBASE_SCRIPTSIG_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrCoinbaseScriptSig, len(raw), MAX_COINBASE_SCRIPTSIG_SIZE)
+	}
+
+	in := transactions.NewTxIn(make([]byte, 32), transactions.COINBASE_PREVOUT, transactions.SEQUENCE_FINAL)
+	// kept raw, one data command, the way ParseTxIn reads a coinbase scriptSig
+	in.ScriptSig = script.NewScript([]script.ScriptCommand{{Data: raw, IsData: true}})
+	outputs := []transactions.TxOut{{Amount: value, ScriptPubKey: payoutScript}}
+	segwit := witnessCommitment != nil
+	if segwit {
+		if len(witnessCommitment) != 32 {
+			return nil, fmt.Errorf("%w: commitment is %d bytes", ErrBadWitnessCommitment, len(witnessCommitment))
+		}
+		in.Witness = [][]byte{make([]byte, 32)}
+		data := append([]byte{}, WITNESS_COMMITMENT_HEADER[2:]...)
+		outputs = append(outputs, transactions.TxOut{ScriptPubKey: script.NewScript([]script.ScriptCommand{
+			{Opcode: OP_RETURN},
+			{Data: append(data, witnessCommitment...), IsData: true},
+		})})
+	}
+	tx := transactions.NewTransaction(1, []transactions.TxIn{in}, outputs, 0, false, segwit)
+	return &tx, nil
+}
+
+// coinbaseHeightPrefix is height as BIP 34 puts it at the start of the coinbase
+// scriptSig: OP_0, OP_1 to OP_16, or a minimal push of the script number
+func coinbaseHeightPrefix(height int) []byte {
+	switch {
+	case height == 0:
+		return []byte{script.OP_O}
+	case height <= 16:
+		return []byte{script.OP_1 + byte(height-1)}
+	}
+	num := script.EncodeNum(int64(height))
+	return append([]byte{byte(len(num))}, num...)
+}
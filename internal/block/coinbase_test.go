@@ -0,0 +1,92 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+	"testing"
+)
+
+func TestNewCoinbase(t *testing.T) {
+	payout := script.P2wpkhScript(bytes.Repeat([]byte{0x42}, 20))
+	for _, height := range []int{0, 1, 16, 17, 227_931, 10_000_000} {
+		for _, extraNonce := range [][]byte{nil, {0xde, 0xad, 0xbe, 0xef}} {
+			coinbase, err := NewCoinbase(height, Subsidy(height), payout, extraNonce, nil)
+			if err != nil {
+				t.Fatalf("height %d: %v", height, err)
+			}
+			fb := testBlock(t, coinbase)
+			if err := fb.Validate(ChainContext{Height: height, Params: REGTEST_PARAMS}); err != nil {
+				t.Fatalf("height %d: %v", height, err)
+			}
+			if got, ok := fb.CoinbaseHeight(); !ok || got != height {
+				t.Fatalf("CoinbaseHeight = %d, %v, want %d", got, ok, height)
+			}
+			raw, _ := coinbase.Inputs[0].ScriptSigBytes()
+			if len(raw) < MIN_COINBASE_SCRIPTSIG_SIZE || len(extraNonce) > 0 && !bytes.HasSuffix(raw, extraNonce) {
+				t.Fatalf("height %d: scriptSig %x", height, raw)
+			}
+
+			// it survives a round trip through the wire format
+			rawHex, err := coinbase.Hex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := transactions.FromHex(rawHex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := coinbase.Txid()
+			if got, _ := parsed.Txid(); got != want || !parsed.IsCoinbase() {
+				t.Fatalf("height %d: parsed txid %x, want %x", height, got, want)
+			}
+		}
+	}
+	t.Logf("✓ Coinbases carry their BIP 34 height and extranonce")
+
+	// commit to a block's witnesses; the coinbase counts as zero in the witness root
+	spend := segwitBlock(t, nil, false, false).Txs[1]
+	root, err := testBlock(t, testCoinbase(0), spend).WitnessMerkleRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitment := encoding.Hash256(append(root[:], make([]byte, 32)...))
+	coinbase, err := NewCoinbase(1000, Subsidy(1000), payout, []byte{1}, commitment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := testBlock(t, coinbase, spend)
+	if err := fb.CheckBlock(); err != nil {
+		t.Fatalf("segwit block: %v", err)
+	}
+	if got, ok := fb.WitnessCommitment(); !ok || !bytes.Equal(got[:], commitment) {
+		t.Fatalf("WitnessCommitment = %x, %v", got, ok)
+	}
+	if n := len(coinbase.Outputs); n != 2 || coinbase.Outputs[n-1].Amount != 0 {
+		t.Fatalf("commitment output missing: %v", coinbase.Outputs)
+	}
+	t.Logf("✓ Witness commitment output and reserved value added")
+
+	tests := []struct {
+		name       string
+		height     int
+		extraNonce []byte
+		commitment []byte
+		want       error
+	}{
+		{"negative height", -1, nil, nil, ErrBadCoinbaseHeight},
+		{"scriptSig over 100 bytes", 1000, make([]byte, 96), nil, ErrCoinbaseScriptSig},
+		{"short commitment", 1000, nil, make([]byte, 31), ErrBadWitnessCommitment},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCoinbase(tt.height, 50, payout, tt.extraNonce, tt.commitment)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.name, err)
+		})
+	}
+}
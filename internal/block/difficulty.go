@@ -0,0 +1,14 @@
+package block
+
+// Difficulty schedule constants
+const (
+	RETARGET_INTERVAL int   = 2016    // blocks between difficulty adjustments
+	TARGET_SPACING    int64 = 10 * 60 // seconds between blocks
+)
+
+// NextBitsRequired returns the bits the header following chain must carry on mainnet or
+// testnet. chain holds the headers from genesis up to the new header's parent (index =
+// height). See ChainParams.NextBitsRequired.
+func NextBitsRequired(chain []Block, header Block, testNet bool) uint32 {
+	return Params(testNet).NextBitsRequired(chain, header)
+}
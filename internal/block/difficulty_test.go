@@ -0,0 +1,46 @@
+package block
+
+import "testing"
+
+func TestNextBitsRequired(t *testing.T) {
+	const REAL_BITS uint32 = 0x1c0ffff0
+	// a testnet chain at REAL_BITS with a minimum-difficulty block at height 3
+	chain := []Block{{Bits: REAL_BITS, TimeStamp: 1000}}
+	for h := 1; h <= 4; h++ {
+		chain = append(chain, Block{Bits: REAL_BITS, TimeStamp: uint32(1000 + h*600)})
+	}
+	chain[3].Bits, chain[3].TimeStamp = LOWEST_BITS, chain[2].TimeStamp+1500
+	chain[4].Bits, chain[4].TimeStamp = LOWEST_BITS, chain[3].TimeStamp+1500
+	last := chain[4].TimeStamp
+
+	tests := []struct {
+		name    string
+		time    uint32
+		testNet bool
+		want    uint32
+	}{
+		{"mainnet keeps the parent's bits", last + 3600, false, LOWEST_BITS},
+		{"testnet allows difficulty 1 after 20 minutes", last + 1201, true, LOWEST_BITS},
+		{"testnet snaps back past minimum-difficulty blocks", last + 1200, true, REAL_BITS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NextBitsRequired(chain, Block{TimeStamp: tt.time}, tt.testNet)
+			if got != tt.want {
+				t.Fatalf("expected bits %x, got %x", tt.want, got)
+			}
+		})
+	}
+
+	// retarget heights follow CalcNewBits regardless of the timestamp
+	period := make([]Block, RETARGET_INTERVAL)
+	for h := range period {
+		period[h] = Block{Bits: REAL_BITS, TimeStamp: uint32(1000 + h*300)}
+	}
+	header := Block{TimeStamp: period[len(period)-1].TimeStamp + 3600}
+	want := header.CalcNewBits(period[0], period[len(period)-1])
+	if got := NextBitsRequired(period, header, true); got != want || got == REAL_BITS {
+		t.Fatalf("expected retarget to %x, got %x", want, got)
+	}
+	t.Logf("✓ testnet minimum-difficulty rule and retarget at height %d", RETARGET_INTERVAL)
+}
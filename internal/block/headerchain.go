@@ -0,0 +1,83 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrBadProofOfWork     = errors.New("header hash above its target")
+	ErrHeaderDisconnected = errors.New("header does not build on the previous one")
+	ErrBadBits            = errors.New("header bits off the difficulty schedule")
+)
+
+// HeaderError reports the header that failed verification
+type HeaderError struct {
+	Height int
+	Err    error
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("header %d: %v", e.Height, e.Err)
+}
+
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+// HeaderVerifier checks batches of headers for proof of work, continuity and the
+// mainnet difficulty schedule, carrying the tip and the current retarget period from
+// one batch to the next. Testnet's minimum-difficulty exception needs the whole chain;
+// see ChainParams.NextBitsRequired.
+type HeaderVerifier struct {
+	prev   Block
+	first  Block // first block of the current retarget period
+	height int   // height of prev
+	bits   uint32
+}
+
+// NewHeaderVerifier continues a chain from prev at height, which must be a retarget
+// height (the genesis block, for a full sync) so the period's first block is known.
+// bits is what the following headers must carry until the next retarget.
+func NewHeaderVerifier(prev Block, height int, bits uint32) *HeaderVerifier {
+	return &HeaderVerifier{prev: prev, first: prev, height: height, bits: bits}
+}
+
+// VerifyHeaderChain checks that headers follow prev, taken as a retarget height such as
+// the genesis block, with startBits until the first retarget. A failure is a
+// *HeaderError whose Height counts prev as 0.
+func VerifyHeaderChain(headers []Block, startBits uint32, prev Block) error {
+	return NewHeaderVerifier(prev, 0, startBits).Verify(headers)
+}
+
+// Verify checks the next batch of headers and advances the tip past them. On failure
+// the tip stays at the last good header and the error is a *HeaderError.
+func (v *HeaderVerifier) Verify(headers []Block) error {
+	for _, header := range headers {
+		height := v.height + 1
+		prevHash, err := v.prev.Hash()
+		if err != nil {
+			return &HeaderError{Height: height, Err: err}
+		}
+		if header.PrevBlock != [32]byte(prevHash) {
+			return &HeaderError{Height: height, Err: ErrHeaderDisconnected}
+		}
+		if !header.CheckProofOfWork() {
+			return &HeaderError{Height: height, Err: ErrBadProofOfWork}
+		}
+		bits, first := v.bits, v.first
+		if height%RETARGET_INTERVAL == 0 {
+			bits, first = header.CalcNewBits(v.first, v.prev), header
+		}
+		if header.Bits != bits {
+			return &HeaderError{Height: height, Err: fmt.Errorf("%w: %x, expected %x", ErrBadBits, header.Bits, bits)}
+		}
+		v.prev, v.first, v.height, v.bits = header, first, height, bits
+	}
+	return nil
+}
+
+// Tip returns the last verified header and its height
+func (v *HeaderVerifier) Tip() (Block, int) {
+	return v.prev, v.height
+}
@@ -0,0 +1,53 @@
+package block
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifyHeaderChain(t *testing.T) {
+	genesis := mineHeaders([32]byte{}, 1, 0)[0]
+	headers := mineHeaders(hashOf(genesis), RETARGET_INTERVAL, 1)
+
+	// batches carry the tip from one to the next
+	v := NewHeaderVerifier(genesis, 0, EASY_BITS)
+	if err := v.Verify(headers[:1000]); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(headers[1000 : RETARGET_INTERVAL-1]); err != nil {
+		t.Fatal(err)
+	}
+	if tip, height := v.Tip(); height != RETARGET_INTERVAL-1 || hashOf(tip) != hashOf(headers[RETARGET_INTERVAL-2]) {
+		t.Fatalf("unexpected tip at %d", height)
+	}
+
+	badPow := headers[5]
+	badPow.Nonce++
+	for badPow.CheckProofOfWork() {
+		badPow.Nonce++
+	}
+	wrongBits := mineHeadersBits(hashOf(headers[2]), 1, 2, HARDER_BITS)[0]
+
+	tests := []struct {
+		name    string
+		headers []Block
+		height  int
+		want    error
+	}{
+		{"disconnected", headers[1:], 1, ErrHeaderDisconnected},
+		{"bad proof of work", append(headers[:5:5], badPow), 6, ErrBadProofOfWork},
+		{"bits changed outside a retarget", append(headers[:3:3], wrongBits), 4, ErrBadBits},
+		// EASY_BITS is easier than the mainnet limit, so the retarget can't keep it
+		{"bits not retargeted", headers, RETARGET_INTERVAL, ErrBadBits},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyHeaderChain(tt.headers, EASY_BITS, genesis)
+			var headerErr *HeaderError
+			if !errors.As(err, &headerErr) || headerErr.Height != tt.height || !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v at height %d, got %v", tt.want, tt.height, err)
+			}
+			t.Logf("✓ %v", err)
+		})
+	}
+}
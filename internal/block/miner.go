@@ -0,0 +1,124 @@
+package block
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+	"math"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// MINER_CHECK_INTERVAL is how many nonces a worker tries between checks for cancellation
+const MINER_CHECK_INTERVAL uint32 = 1 << 16
+
+var ErrNoCoinbaseTemplate = errors.New("block template has no coinbase to carry an extranonce")
+
+// Mine grinds a block from template until its header meets bits, for regtest and tests.
+// Each of runtime.NumCPU() workers takes its own extranonces, pushed onto the end of a
+// copy of the coinbase scriptSig, and searches the full nonce range for each one. The
+// template is left untouched; the mined block gets a fresh coinbase and merkle root.
+func Mine(ctx context.Context, template *FullBlock, bits uint32) (*FullBlock, error) {
+	if len(template.Txs) == 0 || !template.Txs[0].IsCoinbase() {
+		return nil, ErrNoCoinbaseTemplate
+	}
+	// txids of everything but the coinbase, internal byte order
+	hashes := make([][]byte, len(template.Txs))
+	for i, tx := range template.Txs[1:] {
+		txid, err := tx.Hash()
+		if err != nil {
+			return nil, fmt.Errorf("tx %d: %w", i+1, err)
+		}
+		slices.Reverse(txid[:])
+		hashes[i+1] = txid[:]
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := runtime.NumCPU()
+	found := make(chan *FullBlock, 1)
+	failed := make(chan error, 1)
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for extraNonce := uint64(w); ctx.Err() == nil; extraNonce += uint64(workers) {
+				fb, err := mineExtraNonce(ctx, template, hashes, bits, extraNonce)
+				if err != nil {
+					select {
+					case failed <- err:
+					default:
+					}
+					cancel()
+					return
+				}
+				if fb != nil {
+					select {
+					case found <- fb:
+						cancel()
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case fb := <-found:
+		return fb, nil
+	case err := <-failed:
+		return nil, err
+	default:
+		return nil, ctx.Err()
+	}
+}
+
+// mineExtraNonce searches every nonce with the coinbase carrying extraNonce. It returns
+// nil if none meets bits or ctx is cancelled.
+func mineExtraNonce(ctx context.Context, template *FullBlock, hashes [][]byte, bits uint32, extraNonce uint64) (*FullBlock, error) {
+	coinbase := *template.Txs[0]
+	coinbase.Inputs = slices.Clone(coinbase.Inputs)
+	in := &coinbase.Inputs[0]
+	// append a push of the extranonce to the raw scriptSig, keeping the BIP 34 height
+	// and anything else the template put in front of it byte for byte
+	raw, err := in.ScriptSigBytes()
+	if err != nil {
+		return nil, fmt.Errorf("coinbase: %w", err)
+	}
+	raw = append(slices.Clone(raw), 8)
+	raw = binary.LittleEndian.AppendUint64(raw, extraNonce)
+	in.ScriptSig = script.NewScript([]script.ScriptCommand{{Data: raw, IsData: true}})
+	txid, err := coinbase.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("coinbase: %w", err)
+	}
+	slices.Reverse(txid[:])
+	leaves := slices.Clone(hashes)
+	leaves[0] = txid[:]
+
+	header := *template.BlockHeader
+	header.MerkleRoot = [32]byte(encoding.MerkleRoot(leaves))
+	header.Bits = bits
+	header.TxHashes = nil
+	for nonce := uint32(0); ; nonce++ {
+		if nonce%MINER_CHECK_INTERVAL == 0 && ctx.Err() != nil {
+			return nil, nil
+		}
+		header.Nonce = nonce
+		if header.CheckProofOfWork() {
+			txs := append([]*transactions.Transaction{&coinbase}, template.Txs[1:]...)
+			return &FullBlock{BlockHeader: &header, Txs: txs}, nil
+		}
+		if nonce == math.MaxUint32 {
+			return nil, nil
+		}
+	}
+}
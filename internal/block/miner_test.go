@@ -0,0 +1,45 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMine(t *testing.T) {
+	template := testBlock(t, testCoinbase(1), testCoinbase(2))
+	template.Txs[1].Inputs[0].PrevIdx = 0 // an ordinary spend
+	root := template.BlockHeader.MerkleRoot
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fb, err := Mine(ctx, template, HARDER_BITS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fb.BlockHeader.CheckProofOfWork() || fb.BlockHeader.Bits != HARDER_BITS {
+		t.Fatal("mined header doesn't meet its target")
+	}
+	if err := fb.CheckBlock(); err != nil {
+		t.Fatalf("mined block invalid: %v", err)
+	}
+	want, _ := template.CoinbaseHeight()
+	if height, ok := fb.CoinbaseHeight(); !ok || height != want {
+		t.Fatalf("mined coinbase height %d, %v, want %d", height, ok, want)
+	}
+	if template.BlockHeader.MerkleRoot != root || len(template.Txs[0].Inputs[0].ScriptSig.CommandStack) != 1 {
+		t.Fatal("template was modified")
+	}
+
+	// mainnet difficulty won't be found before the deadline
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Mine(short, template, LOWEST_BITS); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if _, err := Mine(ctx, testBlock(t), EASY_BITS); !errors.Is(err, ErrNoCoinbaseTemplate) {
+		t.Fatalf("expected ErrNoCoinbaseTemplate, got %v", err)
+	}
+	t.Logf("✓ mined nonce %d at bits %x", fb.BlockHeader.Nonce, HARDER_BITS)
+}
@@ -0,0 +1,145 @@
+package block
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Orphan pool limits
+const (
+	MAX_ORPHANS   int           = 750              // headers and blocks parked at once
+	ORPHAN_EXPIRY time.Duration = 20 * time.Minute // parked this long without a parent, an orphan is dropped
+)
+
+// Orphan is a header, and possibly its block, whose parent isn't known yet
+type Orphan struct {
+	Header Block
+	Hash   [32]byte   // internal byte order
+	Block  *FullBlock // nil if only the header arrived
+
+	added time.Time
+}
+
+// OrphanPool parks headers and blocks that arrive ahead of their parents, indexed by the
+// parent they wait for. It holds at most Max orphans, dropping expired ones first and
+// then the oldest.
+type OrphanPool struct {
+	Max    int
+	Expiry time.Duration
+
+	mu      sync.Mutex
+	orphans map[[32]byte]*Orphan
+	byPrev  map[[32]byte][][32]byte
+}
+
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{
+		Max:     MAX_ORPHANS,
+		Expiry:  ORPHAN_EXPIRY,
+		orphans: make(map[[32]byte]*Orphan),
+		byPrev:  make(map[[32]byte][][32]byte),
+	}
+}
+
+// Add parks a header, with its block if fb is not nil, and returns its hash. Adding the
+// block of an already parked header attaches it.
+func (op *OrphanPool) Add(header Block, fb *FullBlock) ([32]byte, error) {
+	h, err := header.Hash()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	hash := [32]byte(h)
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if o, ok := op.orphans[hash]; ok {
+		if fb != nil {
+			o.Block = fb
+		}
+		return hash, nil
+	}
+	op.evict()
+	op.orphans[hash] = &Orphan{Header: header, Hash: hash, Block: fb, added: time.Now()}
+	op.byPrev[header.PrevBlock] = append(op.byPrev[header.PrevBlock], hash)
+	return hash, nil
+}
+
+// evict makes room for one more orphan. Caller holds mu.
+func (op *OrphanPool) evict() {
+	now := time.Now()
+	for hash, o := range op.orphans {
+		if now.Sub(o.added) > op.Expiry {
+			op.remove(hash)
+		}
+	}
+	for len(op.orphans) >= op.Max && len(op.orphans) > 0 {
+		var oldest *Orphan
+		for _, o := range op.orphans {
+			if oldest == nil || o.added.Before(oldest.added) {
+				oldest = o
+			}
+		}
+		op.remove(oldest.Hash)
+	}
+}
+
+// remove drops an orphan from both indexes. Caller holds mu.
+func (op *OrphanPool) remove(hash [32]byte) {
+	o, ok := op.orphans[hash]
+	if !ok {
+		return
+	}
+	delete(op.orphans, hash)
+	siblings := slices.DeleteFunc(op.byPrev[o.Header.PrevBlock], func(h [32]byte) bool { return h == hash })
+	if len(siblings) == 0 {
+		delete(op.byPrev, o.Header.PrevBlock)
+	} else {
+		op.byPrev[o.Header.PrevBlock] = siblings
+	}
+}
+
+// Has reports whether the header with hash is parked
+func (op *OrphanPool) Has(hash [32]byte) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	_, ok := op.orphans[hash]
+	return ok
+}
+
+// Root follows a parked header's ancestors through the pool and returns the hash of the
+// first one missing: the block to ask peers for
+func (op *OrphanPool) Root(hash [32]byte) ([32]byte, bool) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	o, ok := op.orphans[hash]
+	if !ok {
+		return [32]byte{}, false
+	}
+	for {
+		parent, ok := op.orphans[o.Header.PrevBlock]
+		if !ok {
+			return o.Header.PrevBlock, true
+		}
+		o = parent
+	}
+}
+
+// TakeChildren removes and returns the orphans waiting for parent, in arrival order
+func (op *OrphanPool) TakeChildren(parent [32]byte) []*Orphan {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	var children []*Orphan
+	for _, hash := range slices.Clone(op.byPrev[parent]) {
+		children = append(children, op.orphans[hash])
+		op.remove(hash)
+	}
+	return children
+}
+
+// Len returns the number of parked orphans
+func (op *OrphanPool) Len() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return len(op.orphans)
+}
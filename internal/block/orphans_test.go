@@ -0,0 +1,56 @@
+package block
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrphanPool(t *testing.T) {
+	chain := mineHeaders([32]byte{}, 4, 0)
+	op := NewOrphanPool()
+
+	// headers 2 and 3 arrive while 1 is missing
+	for _, header := range chain[2:] {
+		if _, err := op.Add(header, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fb := &FullBlock{BlockHeader: &chain[3]}
+	if _, err := op.Add(chain[3], fb); err != nil {
+		t.Fatal(err)
+	}
+	if op.Len() != 2 || !op.Has(hashOf(chain[3])) {
+		t.Fatalf("expected 2 orphans, got %d", op.Len())
+	}
+	if root, ok := op.Root(hashOf(chain[3])); !ok || root != hashOf(chain[1]) {
+		t.Fatal("Root should name the first missing ancestor")
+	}
+
+	children := op.TakeChildren(hashOf(chain[1]))
+	if len(children) != 1 || children[0].Hash != hashOf(chain[2]) || children[0].Block != nil {
+		t.Fatalf("unexpected children of header 1: %v", children)
+	}
+	children = op.TakeChildren(hashOf(chain[2]))
+	if len(children) != 1 || children[0].Block != fb {
+		t.Fatal("block parked with header 3 was lost")
+	}
+	if op.Len() != 0 || len(op.TakeChildren(hashOf(chain[2]))) != 0 {
+		t.Fatal("taken orphans still parked")
+	}
+
+	// the oldest orphan makes room, and expired ones go first
+	op.Max = 2
+	for _, header := range chain[:3] {
+		op.Add(header, nil)
+	}
+	if op.Len() != 2 || op.Has(hashOf(chain[0])) {
+		t.Fatal("expected the oldest orphan evicted")
+	}
+	op.Expiry = 0
+	time.Sleep(time.Millisecond)
+	op.Add(chain[3], nil)
+	if op.Len() != 1 || !op.Has(hashOf(chain[3])) {
+		t.Fatalf("expected expired orphans dropped, %d left", op.Len())
+	}
+	t.Logf("✓ Parked, reconnected and evicted orphans")
+}
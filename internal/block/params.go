@@ -0,0 +1,218 @@
+package block
+
+import (
+	"bytes"
+	"fmt"
+	"go-bitcoin/internal/script"
+	"math/big"
+)
+
+// REGTEST_POW_LIMIT is the easiest target regtest allows; any hash below it is found
+// in a couple of tries
+const REGTEST_POW_LIMIT uint32 = 0x207fffff
+
+// ChainParams describes a chain: its genesis block, network magic and proof of work
+// rules. The built-in chains are MAINNET_PARAMS, TESTNET_PARAMS and REGTEST_PARAMS;
+// private devnets and tests can build their own with NewChainParams.
+type ChainParams struct {
+	Name             string
+	Magic            uint32 // message start, as written by the network package
+	Genesis          Block
+	PowLimit         uint32 // bits of the easiest allowed target
+	TargetSpacing    int64  // seconds between blocks
+	RetargetInterval int    // blocks between difficulty adjustments
+	// MinDifficultyBlocks allows a PowLimit block once 2 * TargetSpacing has passed
+	// without one, as on testnet
+	MinDifficultyBlocks bool
+	// NoRetargeting keeps the bits fixed at retarget heights, as on regtest
+	NoRetargeting bool
+	Checkpoints   []Checkpoint // sorted by height
+	// BIP34Height is the first height whose coinbase must start with the block height
+	BIP34Height int
+	// BIP65Height, BIP66Height and CSVHeight are the first heights at which
+	// OP_CHECKLOCKTIMEVERIFY, strict DER signatures and OP_CHECKSEQUENCEVERIFY are enforced
+	BIP65Height int
+	BIP66Height int
+	CSVHeight   int
+	// SegwitHeight is the first height at which OP_CHECKMULTISIG's dummy must be empty.
+	// P2SH, witness and taproot rules are checked in every block, as no block breaks
+	// them apart from the ScriptFlagExceptions.
+	SegwitHeight int
+	// ScriptFlagExceptions holds the flags for the few blocks mined breaking a rule that
+	// is otherwise checked from genesis, by block hash (internal byte order), so a
+	// competing block at the same height gets no exception
+	ScriptFlagExceptions map[[32]byte]script.VerifyFlags
+}
+
+// ScriptFlags returns the script rules in force for transactions in the block with hash
+// (internal byte order) at height
+func (p *ChainParams) ScriptFlags(height int, hash [32]byte) script.VerifyFlags {
+	flags := script.SCRIPT_VERIFY_P2SH | script.SCRIPT_VERIFY_WITNESS | script.SCRIPT_VERIFY_TAPROOT
+	if exception, ok := p.ScriptFlagExceptions[hash]; ok {
+		flags = exception
+	}
+	if height >= p.BIP65Height {
+		flags |= script.SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY
+	}
+	if height >= p.BIP66Height {
+		flags |= script.SCRIPT_VERIFY_DERSIG
+	}
+	if height >= p.CSVHeight {
+		flags |= script.SCRIPT_VERIFY_CHECKSEQUENCEVERIFY
+	}
+	if height >= p.SegwitHeight {
+		flags |= script.SCRIPT_VERIFY_NULLDUMMY
+	}
+	return flags
+}
+
+// mustParseGenesis parses a built-in genesis header
+func mustParseGenesis(raw []byte) Block {
+	genesis, err := ParseBlock(bytes.NewReader(raw))
+	if err != nil {
+		panic(fmt.Sprintf("bad genesis block: %v", err))
+	}
+	return genesis
+}
+
+var MAINNET_PARAMS = &ChainParams{
+	Name:             "mainnet",
+	Magic:            0xf9beb4d9,
+	Genesis:          mustParseGenesis(MAINNET_GENESIS_BLOCK),
+	PowLimit:         LOWEST_BITS,
+	TargetSpacing:    TARGET_SPACING,
+	RetargetInterval: RETARGET_INTERVAL,
+	Checkpoints:      MAINNET_CHECKPOINTS,
+	BIP34Height:      227_931,
+	BIP65Height:      388_381,
+	BIP66Height:      363_725,
+	CSVHeight:        419_328,
+	SegwitHeight:     481_824,
+	ScriptFlagExceptions: map[[32]byte]script.VerifyFlags{
+		// block 170,060 spends a P2SH output the old way
+		checkpointHash("00000000000002dc756eebf4f49723ed8d30cc28a5f108eb94b1ba88ac4f9c22"): script.SCRIPT_VERIFY_NONE,
+		// block 692,261 spends a taproot output the old way
+		checkpointHash("0000000000000000000f14c35b2d841e986ab5441de8c585d5ffe55ea1e395ad"): script.SCRIPT_VERIFY_P2SH | script.SCRIPT_VERIFY_WITNESS,
+	},
+}
+
+var TESTNET_PARAMS = &ChainParams{
+	Name:                "testnet3",
+	Magic:               0x0b110907,
+	Genesis:             mustParseGenesis(TESTNET_GENESIS_BLOCK),
+	PowLimit:            LOWEST_BITS,
+	TargetSpacing:       TARGET_SPACING,
+	RetargetInterval:    RETARGET_INTERVAL,
+	MinDifficultyBlocks: true,
+	Checkpoints:         TESTNET_CHECKPOINTS,
+	BIP34Height:         21_111,
+	BIP65Height:         581_885,
+	BIP66Height:         330_776,
+	CSVHeight:           770_112,
+	SegwitHeight:        834_624,
+	ScriptFlagExceptions: map[[32]byte]script.VerifyFlags{
+		// block 514 spends a P2SH output the old way
+		checkpointHash("00000000dd30457c001f4095d208cc1296b0eed002427aa599874af7a432b105"): script.SCRIPT_VERIFY_NONE,
+	},
+}
+
+// REGTEST_PARAMS is Bitcoin Core's regression test chain: the mainnet genesis
+// transaction under a trivial target, and no retargeting
+var REGTEST_PARAMS = &ChainParams{
+	Name:  "regtest",
+	Magic: 0xfabfb5da,
+	Genesis: NewBlock(1, [32]byte{}, MAINNET_PARAMS.Genesis.MerkleRoot, 1296688602,
+		REGTEST_POW_LIMIT, 2, nil),
+	PowLimit:            REGTEST_POW_LIMIT,
+	TargetSpacing:       TARGET_SPACING,
+	RetargetInterval:    RETARGET_INTERVAL,
+	MinDifficultyBlocks: true,
+	NoRetargeting:       true,
+	BIP34Height:         1,
+	BIP65Height:         1,
+	BIP66Height:         1,
+	CSVHeight:           1,
+}
+
+// Params returns the built-in parameters for mainnet or testnet
+func Params(testNet bool) *ChainParams {
+	if testNet {
+		return TESTNET_PARAMS
+	}
+	return MAINNET_PARAMS
+}
+
+// NewChainParams returns parameters for a private chain starting at genesis, with
+// mainnet's schedule, no checkpoints, the genesis bits as the proof of work limit, BIP 34
+// enforced from height 1 and every script soft fork from genesis
+func NewChainParams(name string, magic uint32, genesis Block) *ChainParams {
+	return &ChainParams{
+		Name:             name,
+		Magic:            magic,
+		Genesis:          genesis,
+		PowLimit:         genesis.Bits,
+		TargetSpacing:    TARGET_SPACING,
+		RetargetInterval: RETARGET_INTERVAL,
+		BIP34Height:      1,
+	}
+}
+
+// GenesisHash returns the genesis block hash (internal byte order)
+func (p *ChainParams) GenesisHash() [32]byte {
+	hash, _ := p.Genesis.Hash()
+	return [32]byte(hash)
+}
+
+// DefaultAssumeValid is the block whose ancestors' scripts are assumed valid: the last
+// checkpoint, since the header chain below it is pinned anyway. It is the zero
+// Checkpoint for a chain without checkpoints.
+func (p *ChainParams) DefaultAssumeValid() Checkpoint {
+	if len(p.Checkpoints) == 0 {
+		return Checkpoint{}
+	}
+	return p.Checkpoints[len(p.Checkpoints)-1]
+}
+
+// CalcNewBits returns the bits for the block after last, where first starts the
+// retarget period: the target scales by the period's actual timespan over the expected
+// one, limited to a factor of four either way and to PowLimit
+func (p *ChainParams) CalcNewBits(first, last Block) uint32 {
+	expected := int64(p.RetargetInterval) * p.TargetSpacing
+	actual := min(max(int64(last.TimeStamp)-int64(first.TimeStamp), expected/4), expected*4)
+
+	newTarget := new(big.Int).Mul(last.bitsToTarget(), big.NewInt(actual))
+	newTarget.Div(newTarget, big.NewInt(expected))
+	limit := &Block{Bits: p.PowLimit}
+	if newTarget.Cmp(limit.bitsToTarget()) > 0 {
+		return p.PowLimit
+	}
+	return TargetToBits(newTarget)
+}
+
+// NextBitsRequired returns the bits the header following chain must carry. chain holds
+// the headers from genesis up to the new header's parent (index = height).
+//
+// With MinDifficultyBlocks a header timestamped more than twice the target spacing
+// after its parent may use PowLimit; other headers snap back to the bits of the last
+// block that wasn't such a minimum-difficulty block.
+func (p *ChainParams) NextBitsRequired(chain []Block, header Block) uint32 {
+	height := len(chain)
+	prev := chain[height-1]
+	if height%p.RetargetInterval == 0 {
+		if p.NoRetargeting {
+			return prev.Bits
+		}
+		return p.CalcNewBits(chain[height-p.RetargetInterval], prev)
+	}
+	if !p.MinDifficultyBlocks {
+		return prev.Bits
+	}
+	if int64(header.TimeStamp) > int64(prev.TimeStamp)+2*p.TargetSpacing {
+		return p.PowLimit
+	}
+	h := height - 1
+	for h > 0 && h%p.RetargetInterval != 0 && chain[h].Bits == p.PowLimit {
+		h--
+	}
+	return chain[h].Bits
+}
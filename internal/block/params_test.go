@@ -0,0 +1,84 @@
+package block
+
+import (
+	"encoding/hex"
+	"go-bitcoin/internal/script"
+	"slices"
+	"testing"
+)
+
+func TestChainParams(t *testing.T) {
+	tests := []struct {
+		params *ChainParams
+		hash   string // display byte order
+	}{
+		{MAINNET_PARAMS, "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"},
+		{TESTNET_PARAMS, "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943"},
+		{REGTEST_PARAMS, "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206"},
+	}
+	for _, tt := range tests {
+		hash := tt.params.GenesisHash()
+		slices.Reverse(hash[:])
+		if got := hex.EncodeToString(hash[:]); got != tt.hash {
+			t.Errorf("%s genesis %s, want %s", tt.params.Name, got, tt.hash)
+		}
+		if !tt.params.Genesis.CheckProofOfWork() {
+			t.Errorf("%s genesis fails its own proof of work", tt.params.Name)
+		}
+	}
+
+	// mainnet parameters retarget exactly like Block.CalcNewBits
+	first := Block{Bits: 0x1b0404cb, TimeStamp: 1_000_000}
+	for _, span := range []uint32{100, 600_000, 1_209_600, 2_000_000, 9_000_000} {
+		last := Block{Bits: 0x1b0404cb, TimeStamp: first.TimeStamp + span}
+		if got, want := MAINNET_PARAMS.CalcNewBits(first, last), last.CalcNewBits(first, last); got != want {
+			t.Errorf("timespan %d: got %x, want %x", span, got, want)
+		}
+	}
+
+	// regtest keeps its bits at retarget heights
+	chain := make([]Block, RETARGET_INTERVAL)
+	for h := range chain {
+		chain[h] = Block{Bits: REGTEST_POW_LIMIT, TimeStamp: uint32(h)}
+	}
+	if got := REGTEST_PARAMS.NextBitsRequired(chain, Block{TimeStamp: uint32(RETARGET_INTERVAL)}); got != REGTEST_POW_LIMIT {
+		t.Fatalf("regtest retargeted to %x", got)
+	}
+	t.Logf("✓ Built-in genesis blocks and retarget rules")
+}
+
+func TestScriptFlags(t *testing.T) {
+	base := script.SCRIPT_VERIFY_P2SH | script.SCRIPT_VERIFY_WITNESS | script.SCRIPT_VERIFY_TAPROOT
+	bip16Exception := checkpointHash("00000000000002dc756eebf4f49723ed8d30cc28a5f108eb94b1ba88ac4f9c22")
+	taprootException := checkpointHash("0000000000000000000f14c35b2d841e986ab5441de8c585d5ffe55ea1e395ad")
+	testnetException := checkpointHash("00000000dd30457c001f4095d208cc1296b0eed002427aa599874af7a432b105")
+	other := [32]byte{0x01}
+	tests := []struct {
+		params *ChainParams
+		height int
+		hash   [32]byte
+		want   script.VerifyFlags
+	}{
+		{MAINNET_PARAMS, 0, other, base},
+		{MAINNET_PARAMS, 170_060, bip16Exception, script.SCRIPT_VERIFY_NONE},
+		{MAINNET_PARAMS, 170_060, other, base}, // a competing block at the same height
+		{MAINNET_PARAMS, 363_725, other, base | script.SCRIPT_VERIFY_DERSIG},
+		{MAINNET_PARAMS, 388_381, other, base | script.SCRIPT_VERIFY_DERSIG | script.SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY},
+		{MAINNET_PARAMS, 481_823, other, script.CONSENSUS_SCRIPT_VERIFY_FLAGS &^ script.SCRIPT_VERIFY_NULLDUMMY},
+		{MAINNET_PARAMS, 692_261, taprootException, script.CONSENSUS_SCRIPT_VERIFY_FLAGS &^ script.SCRIPT_VERIFY_TAPROOT},
+		{MAINNET_PARAMS, 692_261, other, script.CONSENSUS_SCRIPT_VERIFY_FLAGS},
+		{MAINNET_PARAMS, 900_000, other, script.CONSENSUS_SCRIPT_VERIFY_FLAGS},
+		{TESTNET_PARAMS, 514, testnetException, script.SCRIPT_VERIFY_NONE},
+		{TESTNET_PARAMS, 514, other, base},
+		{TESTNET_PARAMS, 834_624, other, script.CONSENSUS_SCRIPT_VERIFY_FLAGS},
+		{MAINNET_PARAMS, 514, testnetException, base}, // exceptions belong to their chain
+		{REGTEST_PARAMS, 0, other, base | script.SCRIPT_VERIFY_NULLDUMMY},
+		{REGTEST_PARAMS, 1, other, script.CONSENSUS_SCRIPT_VERIFY_FLAGS},
+	}
+	for _, tt := range tests {
+		if got := tt.params.ScriptFlags(tt.height, tt.hash); got != tt.want {
+			t.Errorf("%s height %d block %x: flags %#x, want %#x", tt.params.Name, tt.height, tt.hash, got, tt.want)
+		}
+	}
+	t.Logf("✓ Script rules follow each chain's soft fork heights and excepted blocks")
+}
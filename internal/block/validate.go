@@ -0,0 +1,331 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+)
+
+// Consensus limits (BIP 141)
+const (
+	MAX_BLOCK_WEIGHT      int = 4_000_000
+	MAX_BLOCK_SIGOPS_COST int = 80_000
+	WITNESS_SCALE_FACTOR  int = 4
+)
+
+// Coin issuance
+const (
+	INITIAL_SUBSIDY   uint64 = 50 * 100_000_000 // satoshis paid to the first coinbases
+	HALVING_INTERVAL  int    = 210_000          // blocks between subsidy halvings
+	COINBASE_MATURITY int    = 100              // confirmations before a coinbase output can be spent
+	MAX_MONEY         uint64 = 21_000_000 * 100_000_000
+)
+
+var (
+	ErrBadMerkleRoot     = errors.New("merkle root does not match transactions")
+	ErrNoCoinbase        = errors.New("first transaction is not a coinbase")
+	ErrMultipleCoinbase  = errors.New("more than one coinbase")
+	ErrDuplicateTx       = errors.New("duplicate transaction")
+	ErrBlockWeight       = errors.New("block weight exceeds limit")
+	ErrBlockSigOps       = errors.New("block sigop cost exceeds limit")
+	ErrMissingPrevOut    = errors.New("spent output not found")
+	ErrScriptVerifyFails = errors.New("script verification failed")
+	ErrSpendsTooMuch     = errors.New("transaction outputs exceed its inputs")
+	ErrBadCoinbaseValue  = errors.New("coinbase pays more than subsidy plus fees")
+	ErrBadCoinbaseHeight = errors.New("coinbase does not start with the block height")
+	ErrNoInputs          = errors.New("transaction has no inputs")
+	ErrNoOutputs         = errors.New("transaction has no outputs")
+	ErrAmountTooLarge    = errors.New("amount exceeds MAX_MONEY")
+	ErrDuplicateInput    = errors.New("transaction spends the same output twice")
+	ErrNullPrevOut       = errors.New("input spends the null outpoint")
+	ErrDoubleSpend       = errors.New("output spent twice in the block")
+)
+
+// Subsidy returns the new coins a block at height may create, halving every
+// HALVING_INTERVAL blocks until it reaches zero
+func Subsidy(height int) uint64 {
+	halvings := height / HALVING_INTERVAL
+	if halvings >= 64 {
+		return 0
+	}
+	return INITIAL_SUBSIDY >> halvings
+}
+
+// ChainContext supplies what block validation needs beyond the block itself
+type ChainContext struct {
+	Height  int
+	TestNet bool
+	// Params selects the chain's rules; if nil, Params(TestNet) is used
+	Params *ChainParams
+	// AssumeValid skips script checks, for blocks below a trusted assume-valid block
+	AssumeValid bool
+	// PrevOut looks up an unspent output by txid (display byte order) and index. Outputs
+	// created earlier in the same block are found without it. If nil, scripts aren't checked.
+	PrevOut func(txid [32]byte, index uint32) (transactions.TxOut, bool)
+	// Workers is how many goroutines check scripts; 0 means one per CPU
+	Workers int
+}
+
+// Validate runs the consensus checks on a full block: CheckBlock, then every input's
+// script against the output it spends, under the chain's rules at ctx.Height, and the
+// coinbase value against the subsidy plus fees, with P2SH and witness sigops added to
+// the block's sigop cost. From the chain's BIP34Height on, the coinbase must start with
+// the block height. Scripts are skipped under AssumeValid; amounts and sigops are
+// always checked.
+func (fb *FullBlock) Validate(ctx ChainContext) error {
+	if err := fb.CheckBlock(); err != nil {
+		return err
+	}
+	params := ctx.Params
+	if params == nil {
+		params = Params(ctx.TestNet)
+	}
+	if ctx.Height >= params.BIP34Height {
+		if err := fb.checkCoinbaseHeight(ctx.Height); err != nil {
+			return err
+		}
+	}
+	if ctx.PrevOut == nil {
+		return nil
+	}
+	hash, err := fb.BlockHeader.Hash()
+	if err != nil {
+		return err
+	}
+	fees, err := fb.connectInputs(ctx, params.ScriptFlags(ctx.Height, [32]byte(hash)))
+	if err != nil {
+		return err
+	}
+	var paid uint64
+	for _, out := range fb.Txs[0].Outputs {
+		paid += out.Amount
+	}
+	if limit := Subsidy(ctx.Height) + fees; paid > limit {
+		return fmt.Errorf("%w: %d > %d at height %d", ErrBadCoinbaseValue, paid, limit, ctx.Height)
+	}
+	return nil
+}
+
+// checkCoinbaseHeight requires the coinbase scriptSig to begin with height serialized
+// the way BIP 34 does it: OP_0, OP_1 to OP_16, or a minimal push of the script number
+func (fb *FullBlock) checkCoinbaseHeight(height int) error {
+	want := coinbaseHeightPrefix(height)
+	raw, err := fb.Txs[0].Inputs[0].ScriptSigBytes()
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(raw, want) {
+		return fmt.Errorf("%w: expected %d", ErrBadCoinbaseHeight, height)
+	}
+	return nil
+}
+
+// CoinbaseHeight returns the height a BIP 34 coinbase commits to, false if the block has
+// no coinbase or its scriptSig doesn't start with a height
+func (fb *FullBlock) CoinbaseHeight() (int, bool) {
+	if len(fb.Txs) == 0 {
+		return -1, false
+	}
+	height, ok := fb.Txs[0].CoinbaseHeight()
+	return int(height), ok
+}
+
+// CheckTransaction runs the consensus checks that need nothing but the transaction: it
+// has inputs and outputs, no output or their total exceeds MAX_MONEY, and no outpoint is
+// spent twice. A coinbase's scriptSig must be 2 to 100 bytes long, and no other input may
+// spend the null outpoint.
+func CheckTransaction(tx *transactions.Transaction) error {
+	if len(tx.Inputs) == 0 {
+		return ErrNoInputs
+	}
+	if len(tx.Outputs) == 0 {
+		return ErrNoOutputs
+	}
+	var total uint64
+	for i, o := range tx.Outputs {
+		if o.Amount > MAX_MONEY {
+			return fmt.Errorf("%w: output %d pays %d", ErrAmountTooLarge, i, o.Amount)
+		}
+		// both are at most MAX_MONEY, so the sum can't wrap
+		if total += o.Amount; total > MAX_MONEY {
+			return fmt.Errorf("%w: outputs total %d", ErrAmountTooLarge, total)
+		}
+	}
+	if tx.IsCoinbase() {
+		raw, err := tx.Inputs[0].ScriptSigBytes()
+		if err != nil {
+			return err
+		}
+		if len(raw) < MIN_COINBASE_SCRIPTSIG_SIZE || len(raw) > MAX_COINBASE_SCRIPTSIG_SIZE {
+			return fmt.Errorf("%w: %d bytes", ErrCoinbaseScriptSig, len(raw))
+		}
+		return nil
+	}
+	spent := make(map[transactions.OutPoint]bool, len(tx.Inputs))
+	for j := range tx.Inputs {
+		op := tx.Inputs[j].OutPoint()
+		if spent[op] {
+			return fmt.Errorf("%w: %s", ErrDuplicateInput, op)
+		}
+		spent[op] = true
+		if op.TxID == ([32]byte{}) && op.Index == transactions.COINBASE_PREVOUT {
+			return fmt.Errorf("%w: input %d", ErrNullPrevOut, j)
+		}
+	}
+	return nil
+}
+
+// CheckBlock runs the checks that need nothing but the block: CheckTransaction on every
+// transaction, merkle root, witness commitment, coinbase placement, duplicate txids,
+// weight and legacy sigop cost. It fills in BlockHeader.TxHashes.
+func (fb *FullBlock) CheckBlock() error {
+	if len(fb.Txs) == 0 || !fb.Txs[0].IsCoinbase() {
+		return ErrNoCoinbase
+	}
+	seen := make(map[[32]byte]bool, len(fb.Txs))
+	fb.BlockHeader.TxHashes = make([][32]byte, len(fb.Txs))
+	for i, tx := range fb.Txs {
+		if i > 0 && tx.IsCoinbase() {
+			return fmt.Errorf("%w: tx %d", ErrMultipleCoinbase, i)
+		}
+		if err := CheckTransaction(tx); err != nil {
+			return fmt.Errorf("tx %d: %w", i, err)
+		}
+		txid, err := tx.Hash()
+		if err != nil {
+			return fmt.Errorf("tx %d: %w", i, err)
+		}
+		if seen[txid] {
+			return fmt.Errorf("%w: %x", ErrDuplicateTx, txid)
+		}
+		seen[txid] = true
+		fb.BlockHeader.TxHashes[i] = txid
+	}
+	if !fb.BlockHeader.ValidateMerkleRoot() {
+		return ErrBadMerkleRoot
+	}
+	if err := fb.CheckWitnessCommitment(); err != nil {
+		return err
+	}
+
+	weight, err := fb.Weight()
+	if err != nil {
+		return err
+	}
+	if weight > MAX_BLOCK_WEIGHT {
+		return fmt.Errorf("%w: %d", ErrBlockWeight, weight)
+	}
+	if cost := fb.LegacySigOps() * WITNESS_SCALE_FACTOR; cost > MAX_BLOCK_SIGOPS_COST {
+		return fmt.Errorf("%w: %d", ErrBlockSigOps, cost)
+	}
+	return nil
+}
+
+// Weight returns the BIP 141 block weight: base size * 3 + total size
+func (fb *FullBlock) Weight() (int, error) {
+	count, err := encoding.EncodeVarInt(uint64(len(fb.Txs)))
+	if err != nil {
+		return 0, err
+	}
+	weight := (HEADER_SIZE + len(count)) * WITNESS_SCALE_FACTOR
+	for i, tx := range fb.Txs {
+		txWeight, err := tx.Weight()
+		if err != nil {
+			return 0, fmt.Errorf("tx %d: %w", i, err)
+		}
+		weight += txWeight
+	}
+	return weight, nil
+}
+
+// LegacySigOps counts the signature operations in every scriptSig and scriptPubKey of
+// the block, charging MAX_PUBKEYS_PER_MULTISIG for each CHECKMULTISIG
+func (fb *FullBlock) LegacySigOps() int {
+	n := 0
+	for _, tx := range fb.Txs {
+		n += tx.LegacySigOps()
+	}
+	return n
+}
+
+// connectInputs resolves the output every non-coinbase input spends, checks its script
+// under flags unless ctx.AssumeValid, and returns the block's total fees. Outputs are taken from
+// earlier transactions in the block first, then from ctx.PrevOut. The block's sigop cost,
+// legacy plus P2SH and witness, must stay within MAX_BLOCK_SIGOPS_COST. Scripts are
+// checked last, on ctx.Workers goroutines, and the first failing input is reported. No
+// output may be spent twice in the block, and the inputs' total must stay within MAX_MONEY.
+func (fb *FullBlock) connectInputs(ctx ChainContext, flags script.VerifyFlags) (uint64, error) {
+	var fees uint64
+	sigOpCost := fb.LegacySigOps() * WITNESS_SCALE_FACTOR
+	created := make(map[[32]byte]*transactions.Transaction, len(fb.Txs))
+	spent := make(map[transactions.OutPoint]int)
+	txIndex := make(map[*transactions.Transaction]int, len(fb.Txs))
+	var scripts []transactions.InputRef
+	for i, tx := range fb.Txs {
+		if i > 0 {
+			tx.IsTestnet = ctx.TestNet
+			var in, out uint64
+			for j := range tx.Inputs {
+				txIn := &tx.Inputs[j]
+				op := txIn.OutPoint()
+				if earlier, found := spent[op]; found {
+					return 0, fmt.Errorf("%w: %s by tx %d and tx %d", ErrDoubleSpend, op, earlier, i)
+				}
+				spent[op] = i
+				prevTx := op.TxID
+				var prevOut transactions.TxOut
+				var ok bool
+				if parent, found := created[prevTx]; found && int(txIn.PrevIdx) < len(parent.Outputs) {
+					prevOut, ok = parent.Outputs[txIn.PrevIdx], true
+				} else {
+					prevOut, ok = ctx.PrevOut(prevTx, txIn.PrevIdx)
+				}
+				if !ok {
+					return 0, fmt.Errorf("%w: tx %d input %d spends %s", ErrMissingPrevOut, i, j, txIn)
+				}
+				txIn.SetPrevOut(prevOut)
+				if prevOut.Amount > MAX_MONEY {
+					return 0, fmt.Errorf("%w: tx %d input %d spends %d", ErrAmountTooLarge, i, j, prevOut.Amount)
+				}
+				if in += prevOut.Amount; in > MAX_MONEY {
+					return 0, fmt.Errorf("%w: tx %d inputs total %d", ErrAmountTooLarge, i, in)
+				}
+				if sigOpCost += txIn.SigOpCost(prevOut); sigOpCost > MAX_BLOCK_SIGOPS_COST {
+					return 0, fmt.Errorf("%w: %d at tx %d", ErrBlockSigOps, sigOpCost, i)
+				}
+				if !ctx.AssumeValid {
+					scripts = append(scripts, transactions.InputRef{Tx: tx, Index: j})
+				}
+			}
+			for _, o := range tx.Outputs {
+				out += o.Amount
+			}
+			if out > in {
+				return 0, fmt.Errorf("%w: tx %d pays %d from %d", ErrSpendsTooMuch, i, out, in)
+			}
+			fees += in - out
+		}
+		created[fb.BlockHeader.TxHashes[i]] = tx
+		txIndex[tx] = i
+	}
+
+	// amounts and sigops all check out, so the scripts are worth verifying
+	if err := transactions.VerifyInputs(scripts, flags, ctx.Workers); err != nil {
+		var ie *transactions.InputError
+		if !errors.As(err, &ie) {
+			return 0, fmt.Errorf("%w: %v", ErrScriptVerifyFails, err)
+		}
+		var se *script.ScriptError
+		if errors.As(ie.Err, &se) {
+			return 0, fmt.Errorf("%w: tx %d input %d: %w", ErrScriptVerifyFails, txIndex[ie.Tx], ie.Index, se)
+		}
+		if errors.Is(ie.Err, transactions.ErrScriptFailed) {
+			return 0, fmt.Errorf("%w: tx %d input %d", ErrScriptVerifyFails, txIndex[ie.Tx], ie.Index)
+		}
+		return 0, fmt.Errorf("%w: tx %d input %d: %v", ErrScriptVerifyFails, txIndex[ie.Tx], ie.Index, ie.Err)
+	}
+	return fees, nil
+}
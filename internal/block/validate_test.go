@@ -0,0 +1,502 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testCoinbase(tag byte, outputs ...transactions.TxOut) *transactions.Transaction {
+	if len(outputs) == 0 {
+		outputs = []transactions.TxOut{{Amount: 50, ScriptPubKey: script.P2pkhScript(make([]byte, 20))}}
+	}
+	tx := transactions.NewTransaction(1,
+		[]transactions.TxIn{{
+			PrevTx:    make([]byte, 32),
+			PrevIdx:   transactions.COINBASE_PREVOUT,
+			ScriptSig: script.NewScript([]script.ScriptCommand{{Data: []byte{tag, 0x51}, IsData: true}}),
+			Sequence:  transactions.SEQUENCE_FINAL,
+		}},
+		outputs, 0, false, false)
+	return &tx
+}
+
+// testBlock wraps txs in a header committing to their merkle root
+func testBlock(t *testing.T, txs ...*transactions.Transaction) *FullBlock {
+	t.Helper()
+	hashes := make([][]byte, len(txs))
+	for i, tx := range txs {
+		txid, err := tx.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Reverse(txid[:])
+		hashes[i] = txid[:]
+	}
+	var root [32]byte
+	if len(hashes) > 0 {
+		root = [32]byte(encoding.MerkleRoot(hashes))
+	}
+	header := NewBlock(1, [32]byte{}, root, 1231006505, EASY_BITS, 0, nil)
+	return &FullBlock{BlockHeader: &header, Txs: txs}
+}
+
+// spend builds a transaction moving prev's output idx back to the same key, signed
+func spend(t *testing.T, key *keys.PrivateKey, prevId [32]byte, prevOut transactions.TxOut, idx uint32) *transactions.Transaction {
+	t.Helper()
+	in := transactions.NewTxIn(prevId[:], idx, transactions.SEQUENCE_FINAL)
+	in.SetPrevOut(prevOut)
+	tx := transactions.NewTransaction(1, []transactions.TxIn{in},
+		[]transactions.TxOut{{Amount: prevOut.Amount - 1000, ScriptPubKey: prevOut.ScriptPubKey}}, 0, false, false)
+	if err := tx.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+	return &tx
+}
+
+func TestFullBlockValidate(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(8675309))
+	pub := key.PublicKey()
+	lock := script.P2pkhScript(encoding.Hash160(pub.Serialize(true)))
+
+	// an output confirmed in an earlier block
+	funding := testCoinbase(0, transactions.TxOut{Amount: 100_000, ScriptPubKey: lock})
+	fundingId, _ := funding.Hash()
+	other := testCoinbase(18, transactions.TxOut{Amount: 100_000, ScriptPubKey: lock})
+	otherId, _ := other.Hash()
+	utxos := map[[32]byte]transactions.TxOut{fundingId: funding.Outputs[0], otherId: other.Outputs[0]}
+	ctx := ChainContext{
+		Height: 1,
+		PrevOut: func(txid [32]byte, index uint32) (transactions.TxOut, bool) {
+			out, ok := utxos[txid]
+			return out, ok && index == 0
+		},
+	}
+
+	tx1 := spend(t, key, fundingId, funding.Outputs[0], 0)
+	tx1Id, _ := tx1.Hash()
+	tx2 := spend(t, key, tx1Id, tx1.Outputs[0], 0) // spends tx1 within the block
+
+	tampered := spend(t, key, fundingId, funding.Outputs[0], 0)
+	tampered.Outputs[0].Amount -= 1 // invalidates the signature
+
+	missing := spend(t, key, [32]byte{0xee}, funding.Outputs[0], 0)
+
+	overspend := spend(t, key, fundingId, funding.Outputs[0], 0)
+	overspend.Outputs[0].Amount = funding.Outputs[0].Amount + 1
+	if err := overspend.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// spends the funding output again, to a different amount
+	conflict := spend(t, key, fundingId, funding.Outputs[0], 0)
+	conflict.Outputs[0].Amount -= 1000
+	if err := conflict.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// lists the funding output twice to claim its value twice (CVE-2018-17144)
+	inflate := spend(t, key, fundingId, funding.Outputs[0], 0)
+	inflate.Inputs = append(inflate.Inputs, inflate.Inputs[0])
+	inflate.Outputs[0].Amount = 2*funding.Outputs[0].Amount - 1000
+	for i := range inflate.Inputs {
+		if err := inflate.SignInput(i, *key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// tx1 and tx2 pay 1000 in fees each
+	claimFees := testCoinbase(12, transactions.TxOut{Amount: Subsidy(1) + 2000, ScriptPubKey: lock})
+	greedy := testCoinbase(13, transactions.TxOut{Amount: Subsidy(1) + 2001, ScriptPubKey: lock})
+
+	sigops := make([]script.ScriptCommand, MAX_BLOCK_SIGOPS_COST/WITNESS_SCALE_FACTOR/script.MAX_PUBKEYS_PER_MULTISIG+1)
+	for i := range sigops {
+		sigops[i] = script.ScriptCommand{Opcode: script.OP_CHECKMULTISIG}
+	}
+	heavy := testCoinbase(1, transactions.TxOut{Amount: 50, ScriptPubKey: script.NewScript(sigops)})
+
+	badRoot := testBlock(t, testCoinbase(2), tx1)
+	badRoot.BlockHeader.MerkleRoot[0] ^= 0xff
+
+	tests := []struct {
+		name  string
+		block *FullBlock
+		want  error
+	}{
+		{"valid with in-block spend", testBlock(t, testCoinbase(3), tx1, tx2), nil},
+		{"coinbase only", testBlock(t, testCoinbase(4)), nil},
+		{"no transactions", testBlock(t), ErrNoCoinbase},
+		{"coinbase not first", testBlock(t, tx1, testCoinbase(5)), ErrNoCoinbase},
+		{"second coinbase", testBlock(t, testCoinbase(6), testCoinbase(7)), ErrMultipleCoinbase},
+		{"duplicate txid", testBlock(t, testCoinbase(8), tx1, tx1), ErrDuplicateTx},
+		{"merkle root mismatch", badRoot, ErrBadMerkleRoot},
+		{"sigop cost over limit", testBlock(t, heavy), ErrBlockSigOps},
+		{"bad signature", testBlock(t, testCoinbase(9), tampered), ErrScriptVerifyFails},
+		{"unknown prevout", testBlock(t, testCoinbase(10), missing), ErrMissingPrevOut},
+		{"outputs exceed inputs", testBlock(t, testCoinbase(14), overspend), ErrSpendsTooMuch},
+		{"output spent twice", testBlock(t, testCoinbase(16), tx1, conflict), ErrDoubleSpend},
+		{"input listed twice", testBlock(t, testCoinbase(17), inflate), ErrDuplicateInput},
+		{"coinbase claims subsidy and fees", testBlock(t, claimFees, tx1, tx2), nil},
+		{"coinbase claims too much", testBlock(t, greedy, tx1, tx2), ErrBadCoinbaseValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.block.Validate(ctx)
+			if tt.want == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.name, err)
+		})
+	}
+
+	// assume-valid skips the script checks but not the rest
+	assumed := ctx
+	assumed.AssumeValid = true
+	if err := testBlock(t, testCoinbase(9), tampered).Validate(assumed); err != nil {
+		t.Fatalf("assume-valid block failed script checks: %v", err)
+	}
+	if err := badRoot.Validate(assumed); !errors.Is(err, ErrBadMerkleRoot) {
+		t.Fatalf("assume-valid skipped structural checks: %v", err)
+	}
+	if err := testBlock(t, greedy, tx1, tx2).Validate(assumed); !errors.Is(err, ErrBadCoinbaseValue) {
+		t.Fatalf("assume-valid skipped the coinbase value check: %v", err)
+	}
+
+	// scripts are checked concurrently, and the failure names its transaction and input
+	for _, workers := range []int{1, 4} {
+		parallel := ctx
+		parallel.Workers = workers
+		err := testBlock(t, testCoinbase(15), spend(t, key, otherId, other.Outputs[0], 0), tampered).Validate(parallel)
+		if !errors.Is(err, ErrScriptVerifyFails) || !errors.Is(err, script.ErrEvalFalse) || !strings.Contains(err.Error(), "tx 2 input 0") {
+			t.Fatalf("%d workers: got %v, want a script failure at tx 2 input 0", workers, err)
+		}
+	}
+	t.Logf("✓ Script failures report their transaction and input")
+
+	// weight of a legacy block is four times its size
+	fb := testBlock(t, testCoinbase(11), tx1)
+	weight, err := fb.Weight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := HEADER_SIZE + 1
+	for _, tx := range fb.Txs {
+		raw, _ := tx.Serialize()
+		size += len(raw)
+	}
+	if weight != size*WITNESS_SCALE_FACTOR {
+		t.Errorf("weight %d, want %d", weight, size*WITNESS_SCALE_FACTOR)
+	}
+	t.Logf("✓ Legacy block weight %d WU", weight)
+}
+
+func TestCheckTransaction(t *testing.T) {
+	lock := script.P2pkhScript(make([]byte, 20))
+	in := func(prev byte, idx uint32) transactions.TxIn {
+		return transactions.NewTxIn(bytes.Repeat([]byte{prev}, 32), idx, transactions.SEQUENCE_FINAL)
+	}
+	pay := func(amounts ...uint64) []transactions.TxOut {
+		outs := make([]transactions.TxOut, len(amounts))
+		for i, amount := range amounts {
+			outs[i] = transactions.TxOut{Amount: amount, ScriptPubKey: lock}
+		}
+		return outs
+	}
+	tx := func(ins []transactions.TxIn, outs []transactions.TxOut) *transactions.Transaction {
+		tx := transactions.NewTransaction(1, ins, outs, 0, false, false)
+		return &tx
+	}
+	coinbase := func(size int) *transactions.Transaction {
+		cb := testCoinbase(0)
+		cb.Inputs[0].ScriptSig = script.NewScript(slices.Repeat([]script.ScriptCommand{{Opcode: script.OP_1}}, size))
+		return cb
+	}
+	null := in(0, transactions.COINBASE_PREVOUT)
+
+	tests := []struct {
+		name string
+		tx   *transactions.Transaction
+		want error
+	}{
+		{"valid", tx([]transactions.TxIn{in(1, 0), in(1, 1)}, pay(1000, 2000)), nil},
+		{"no inputs", tx(nil, pay(1000)), ErrNoInputs},
+		{"no outputs", tx([]transactions.TxIn{in(1, 0)}, nil), ErrNoOutputs},
+		{"output of MAX_MONEY", tx([]transactions.TxIn{in(1, 0)}, pay(MAX_MONEY)), nil},
+		{"output over MAX_MONEY", tx([]transactions.TxIn{in(1, 0)}, pay(MAX_MONEY+1)), ErrAmountTooLarge},
+		{"outputs total over MAX_MONEY", tx([]transactions.TxIn{in(1, 0)}, pay(MAX_MONEY, 1)), ErrAmountTooLarge},
+		{"outputs wrap uint64 (CVE-2010-5139)", tx([]transactions.TxIn{in(1, 0)}, pay(1<<63, 1<<63)), ErrAmountTooLarge},
+		{"duplicate input", tx([]transactions.TxIn{in(1, 0), in(2, 0), in(1, 0)}, pay(1000)), ErrDuplicateInput},
+		{"null prevout", tx([]transactions.TxIn{in(1, 0), null}, pay(1000)), ErrNullPrevOut},
+		{"coinbase scriptSig of 2 bytes", coinbase(MIN_COINBASE_SCRIPTSIG_SIZE), nil},
+		{"coinbase scriptSig of 100 bytes", coinbase(MAX_COINBASE_SCRIPTSIG_SIZE), nil},
+		{"coinbase scriptSig of 1 byte", coinbase(MIN_COINBASE_SCRIPTSIG_SIZE - 1), ErrCoinbaseScriptSig},
+		{"coinbase scriptSig of 101 bytes", coinbase(MAX_COINBASE_SCRIPTSIG_SIZE + 1), ErrCoinbaseScriptSig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckTransaction(tt.tx)
+			if tt.want == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.name, err)
+		})
+	}
+
+	// CheckBlock runs it on every transaction
+	if err := testBlock(t, coinbase(1)).CheckBlock(); !errors.Is(err, ErrCoinbaseScriptSig) {
+		t.Fatalf("CheckBlock = %v, want %v", err, ErrCoinbaseScriptSig)
+	}
+
+	// an input total over MAX_MONEY is caught once the spent outputs are known
+	spends := tx([]transactions.TxIn{in(1, 0), in(1, 1)}, pay(1000))
+	ctx := ChainContext{
+		Height:      1,
+		AssumeValid: true,
+		PrevOut: func(txid [32]byte, index uint32) (transactions.TxOut, bool) {
+			return transactions.TxOut{Amount: MAX_MONEY, ScriptPubKey: lock}, true
+		},
+	}
+	if err := testBlock(t, testCoinbase(1), spends).Validate(ctx); !errors.Is(err, ErrAmountTooLarge) {
+		t.Fatalf("Validate = %v, want %v", err, ErrAmountTooLarge)
+	}
+	t.Logf("✓ Amounts stay within %d satoshis", MAX_MONEY)
+}
+
+func TestSigOpCost(t *testing.T) {
+	// multisig is a 2-of-3 script with dummy keys
+	multisig := []byte{script.OP_2}
+	for range 3 {
+		multisig = append(multisig, 33)
+		multisig = append(multisig, make([]byte, 33)...)
+	}
+	multisig = append(multisig, script.OP_3, script.OP_CHECKMULTISIG)
+	push := func(data []byte) script.Script {
+		return script.NewScript([]script.ScriptCommand{{Data: data, IsData: true}})
+	}
+	h160, h256 := make([]byte, 20), make([]byte, 32)
+	wpkh, wsh := script.P2wpkhScript(h160), script.P2wshScript(h256)
+	wrappedWpkh, _ := wpkh.RawBytes()
+	wrappedWsh, _ := wsh.RawBytes()
+
+	tests := []struct {
+		name     string
+		in       transactions.TxIn
+		prevOut  script.Script
+		wantCost int
+	}{
+		{"p2pkh", transactions.TxIn{}, script.P2pkhScript(h160), 0},
+		{"p2sh multisig", transactions.TxIn{ScriptSig: push(multisig)}, script.P2shScript(h160), 3 * WITNESS_SCALE_FACTOR},
+		{"p2wpkh", transactions.TxIn{Witness: [][]byte{{}, {}}}, script.P2wpkhScript(h160), 1},
+		{"p2wsh multisig", transactions.TxIn{Witness: [][]byte{{}, multisig}}, script.P2wshScript(h256), 3},
+		{"p2sh-p2wpkh", transactions.TxIn{ScriptSig: push(wrappedWpkh)}, script.P2shScript(h160), 1},
+		{"p2sh-p2wsh", transactions.TxIn{ScriptSig: push(wrappedWsh), Witness: [][]byte{multisig}}, script.P2shScript(h160), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.in.SigOpCost(transactions.TxOut{ScriptPubKey: tt.prevOut}); got != tt.wantCost {
+				t.Errorf("SigOpCost = %d, want %d", got, tt.wantCost)
+			}
+		})
+	}
+
+	// a block only over the limit once its P2SH redeem scripts are counted
+	redeem := bytes.Repeat([]byte{script.OP_CHECKSIG}, 2000)
+	perInput := len(redeem) * WITNESS_SCALE_FACTOR
+	spends := transactions.NewTransaction(1, nil,
+		[]transactions.TxOut{{Amount: 0, ScriptPubKey: script.P2pkhScript(h160)}}, 0, false, false)
+	for i := range MAX_BLOCK_SIGOPS_COST/perInput + 1 {
+		spends.Inputs = append(spends.Inputs, transactions.TxIn{
+			PrevTx:    bytes.Repeat([]byte{0xaa}, 32),
+			PrevIdx:   uint32(i),
+			ScriptSig: push(redeem),
+			Sequence:  transactions.SEQUENCE_FINAL,
+		})
+	}
+	fb := testBlock(t, testCoinbase(1), &spends)
+	if err := fb.CheckBlock(); err != nil {
+		t.Fatalf("legacy sigops alone should pass CheckBlock: %v", err)
+	}
+	ctx := ChainContext{
+		Height:      1,
+		AssumeValid: true, // sigops are counted even when scripts aren't run
+		PrevOut: func(txid [32]byte, index uint32) (transactions.TxOut, bool) {
+			return transactions.TxOut{Amount: 1000, ScriptPubKey: script.P2shScript(h160)}, true
+		},
+	}
+	if err := fb.Validate(ctx); !errors.Is(err, ErrBlockSigOps) {
+		t.Fatalf("Validate = %v, want %v", err, ErrBlockSigOps)
+	}
+	t.Logf("✓ P2SH and witness sigops counted toward the %d cost limit", MAX_BLOCK_SIGOPS_COST)
+}
+
+func TestSubsidy(t *testing.T) {
+	tests := []struct {
+		height int
+		want   uint64
+	}{
+		{0, 5_000_000_000},
+		{HALVING_INTERVAL - 1, 5_000_000_000},
+		{HALVING_INTERVAL, 2_500_000_000},
+		{840_000, 312_500_000},
+		{HALVING_INTERVAL * 33, 0},
+		{HALVING_INTERVAL * 64, 0},
+	}
+	for _, tt := range tests {
+		if got := Subsidy(tt.height); got != tt.want {
+			t.Errorf("Subsidy(%d) = %d, want %d", tt.height, got, tt.want)
+		}
+	}
+	t.Logf("✓ Subsidy halves every %d blocks", HALVING_INTERVAL)
+}
+
+func TestCoinbaseHeight(t *testing.T) {
+	// heightBlock builds a block whose coinbase scriptSig is raw, as ParseTxIn keeps it
+	heightBlock := func(raw []byte) *FullBlock {
+		cb := testCoinbase(0)
+		cb.Inputs[0].ScriptSig = script.NewScript([]script.ScriptCommand{{Data: raw, IsData: true}})
+		return testBlock(t, cb)
+	}
+	tests := []struct {
+		name   string
+		raw    []byte
+		height int
+		err    error
+	}{
+		{"small int", []byte{0x5a, 0xff}, 10, nil},
+		{"one byte", []byte{0x01, 0x11, 0xff}, 17, nil},
+		{"sign byte", []byte{0x02, 0x80, 0x00}, 128, nil},
+		{"mainnet activation", []byte{0x03, 0x5b, 0x7a, 0x03, 0x00}, 227_931, nil},
+		{"wrong height", []byte{0x03, 0x5c, 0x7a, 0x03}, 227_931, ErrBadCoinbaseHeight},
+		{"non-minimal", []byte{0x02, 0x11, 0x00}, 17, ErrBadCoinbaseHeight},
+		{"push instead of small int", []byte{0x01, 0x0a}, 10, ErrBadCoinbaseHeight},
+		{"no height", []byte{0xde, 0xad}, 1, ErrBadCoinbaseHeight},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := heightBlock(tt.raw)
+			err := fb.Validate(ChainContext{Height: tt.height, Params: REGTEST_PARAMS})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Validate = %v, want %v", err, tt.err)
+			}
+			if got, ok := fb.CoinbaseHeight(); tt.err == nil && (!ok || got != tt.height) {
+				t.Errorf("CoinbaseHeight = %d, %v, want %d", got, ok, tt.height)
+			}
+		})
+	}
+
+	// mainnet only enforces BIP 34 from its activation height
+	fb := heightBlock([]byte{0xde, 0xad})
+	if err := fb.Validate(ChainContext{Height: MAINNET_PARAMS.BIP34Height - 1}); err != nil {
+		t.Errorf("pre-activation block rejected: %v", err)
+	}
+	if err := fb.Validate(ChainContext{Height: MAINNET_PARAMS.BIP34Height}); !errors.Is(err, ErrBadCoinbaseHeight) {
+		t.Errorf("post-activation block = %v, want %v", err, ErrBadCoinbaseHeight)
+	}
+
+	// the height survives a serialization round trip
+	parsed, err := ParseFullBlock(bytes.NewReader(rawBlock(t, heightBlock([]byte{0x03, 0x5b, 0x7a, 0x03}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := parsed.CoinbaseHeight(); !ok || got != 227_931 {
+		t.Errorf("parsed CoinbaseHeight = %d, %v, want 227931", got, ok)
+	}
+	t.Logf("✓ BIP 34 coinbase heights enforced from height %d on mainnet", MAINNET_PARAMS.BIP34Height)
+}
+
+// segwitBlock builds a block with one witness transaction whose coinbase commits to
+// reserved; corrupt flips a byte of the commitment
+func segwitBlock(t *testing.T, reserved []byte, commit, corrupt bool) *FullBlock {
+	t.Helper()
+	in := transactions.NewTxIn(bytes.Repeat([]byte{0x11}, 32), 0, transactions.SEQUENCE_FINAL)
+	in.Witness = [][]byte{{0x30, 0x01}, bytes.Repeat([]byte{0x02}, 33)}
+	spend := transactions.NewTransaction(2, []transactions.TxIn{in},
+		[]transactions.TxOut{{Amount: 1000, ScriptPubKey: script.P2wpkhScript(make([]byte, 20))}}, 0, false, true)
+
+	coinbase := testCoinbase(0)
+	if reserved != nil {
+		coinbase.IsSegwit = true
+		coinbase.Inputs[0].Witness = [][]byte{reserved}
+	}
+	if commit {
+		wtxid, _ := spend.WitnessHash()
+		slices.Reverse(wtxid[:])
+		root := encoding.MerkleRoot([][]byte{make([]byte, 32), wtxid[:]})
+		commitment := encoding.Hash256(append(root, make([]byte, 32)...))
+		if corrupt {
+			commitment[0] ^= 0xff
+		}
+		data := append(slices.Clone(WITNESS_COMMITMENT_HEADER[2:]), commitment...)
+		coinbase.Outputs = append(coinbase.Outputs, transactions.TxOut{ScriptPubKey: script.NewScript([]script.ScriptCommand{
+			{Opcode: OP_RETURN},
+			{Data: data, IsData: true},
+		})})
+	}
+	return testBlock(t, coinbase, &spend)
+}
+
+func TestWitnessCommitment(t *testing.T) {
+	zero := make([]byte, 32)
+	tests := []struct {
+		name  string
+		block *FullBlock
+		want  error
+	}{
+		{"valid commitment", segwitBlock(t, zero, true, false), nil},
+		{"commitment mismatch", segwitBlock(t, zero, true, true), ErrBadWitnessCommitment},
+		{"missing reserved value", segwitBlock(t, nil, true, false), ErrBadWitnessNonce},
+		{"short reserved value", segwitBlock(t, zero[:31], true, false), ErrBadWitnessNonce},
+		{"witness without commitment", segwitBlock(t, nil, false, false), ErrUnexpectedWitness},
+		{"legacy block", testBlock(t, testCoinbase(1)), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.block.CheckBlock()
+			if tt.want == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.name, err)
+		})
+	}
+}
+
+func TestWitnessMerkleRoot(t *testing.T) {
+	fb := segwitBlock(t, make([]byte, 32), false, false)
+	wtxid, _ := fb.Txs[1].WitnessHash()
+	slices.Reverse(wtxid[:])
+	want := [32]byte(encoding.MerkleRoot([][]byte{make([]byte, 32), wtxid[:]}))
+	root, err := fb.WitnessMerkleRoot()
+	if err != nil || root != want {
+		t.Fatalf("WitnessMerkleRoot = %x, %v, want %x", root, err, want)
+	}
+
+	// a witness change moves the witness root but not the txids
+	txid, _ := fb.Txs[1].Hash()
+	fb.Txs[1].Inputs[0].Witness[0] = []byte{0x30, 0x02}
+	if changed, _ := fb.WitnessMerkleRoot(); changed == root {
+		t.Fatal("witness root ignores witness data")
+	}
+	if after, _ := fb.Txs[1].Hash(); after != txid {
+		t.Fatal("txid changed with the witness")
+	}
+	if _, err := testBlock(t).WitnessMerkleRoot(); !errors.Is(err, ErrNoCoinbase) {
+		t.Fatalf("empty block: got %v, want %v", err, ErrNoCoinbase)
+	}
+	t.Logf("✓ Witness merkle root %x", root)
+}
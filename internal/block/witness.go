@@ -0,0 +1,95 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/encoding"
+	"slices"
+)
+
+// WITNESS_COMMITMENT_HEADER starts the coinbase output committing to the block's
+// witnesses (BIP 141): OP_RETURN, a 36-byte push, then 0xaa21a9ed
+var WITNESS_COMMITMENT_HEADER = []byte{OP_RETURN, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+// WITNESS_COMMITMENT_SIZE is the minimum scriptPubKey size of a commitment output
+const WITNESS_COMMITMENT_SIZE int = 38
+
+var (
+	ErrBadWitnessCommitment = errors.New("witness commitment mismatch")
+	ErrBadWitnessNonce      = errors.New("coinbase witness reserved value must be a single 32-byte item")
+	ErrUnexpectedWitness    = errors.New("witness data in a block without a witness commitment")
+)
+
+// WitnessCommitment returns the 32-byte commitment from the coinbase, taken from the last
+// output matching WITNESS_COMMITMENT_HEADER as consensus requires
+func (fb *FullBlock) WitnessCommitment() ([32]byte, bool) {
+	if len(fb.Txs) == 0 {
+		return [32]byte{}, false
+	}
+	for _, out := range slices.Backward(fb.Txs[0].Outputs) {
+		raw, err := out.RawScriptBytes()
+		if err != nil || len(raw) < WITNESS_COMMITMENT_SIZE || !bytes.HasPrefix(raw, WITNESS_COMMITMENT_HEADER) {
+			continue
+		}
+		return [32]byte(raw[len(WITNESS_COMMITMENT_HEADER):WITNESS_COMMITMENT_SIZE]), true
+	}
+	return [32]byte{}, false
+}
+
+// WitnessMerkleRoot is the merkle root of the wtxids (internal byte order), with the
+// coinbase counted as all zeros: what the coinbase's witness commitment hashes, next to
+// the txid tree in the header's MerkleRoot
+func (fb *FullBlock) WitnessMerkleRoot() ([32]byte, error) {
+	if len(fb.Txs) == 0 {
+		return [32]byte{}, ErrNoCoinbase
+	}
+	hashes := make([][]byte, len(fb.Txs))
+	hashes[0] = make([]byte, 32)
+	for i, tx := range fb.Txs[1:] {
+		wtxid, err := tx.WitnessHash()
+		if err != nil {
+			return [32]byte{}, fmt.Errorf("tx %d: %w", i+1, err)
+		}
+		slices.Reverse(wtxid[:])
+		hashes[i+1] = wtxid[:]
+	}
+	return [32]byte(encoding.MerkleRoot(hashes)), nil
+}
+
+// hasWitness reports whether any transaction in the block carries witness data
+func (fb *FullBlock) hasWitness() bool {
+	for _, tx := range fb.Txs {
+		for _, in := range tx.Inputs {
+			if len(in.Witness) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckWitnessCommitment verifies the coinbase commitment to the block's witnesses:
+// Hash256(witness root || reserved value), where the reserved value is the coinbase
+// input's single witness item. A block without a commitment must carry no witness data.
+func (fb *FullBlock) CheckWitnessCommitment() error {
+	commitment, ok := fb.WitnessCommitment()
+	if !ok {
+		if fb.hasWitness() {
+			return ErrUnexpectedWitness
+		}
+		return nil
+	}
+	reserved := fb.Txs[0].Inputs[0].Witness
+	if len(reserved) != 1 || len(reserved[0]) != 32 {
+		return ErrBadWitnessNonce
+	}
+	root, err := fb.WitnessMerkleRoot()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(encoding.Hash256(append(root[:], reserved[0]...)), commitment[:]) {
+		return ErrBadWitnessCommitment
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package chainstate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/block"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+	"io"
+	"os"
+	"sync"
+)
+
+// MAX_SCRIPT_SIZE is the largest scriptPubKey that can ever be spent; bigger outputs are
+// left out of the UTXO set, as are OP_RETURN outputs
+const MAX_SCRIPT_SIZE int = 10_000
+
+var (
+	ErrMissingCoin   = errors.New("input spends a missing or already spent output")
+	ErrNotConnecting = errors.New("block does not build on the chain state tip")
+	ErrNotTip        = errors.New("block is not the chain state tip")
+	ErrImmatureSpend = errors.New("input spends a coinbase output before it matures")
+	ErrOverwriteCoin = errors.New("transaction overwrites an unspent output of the same txid")
+)
+
+// Coin is an unspent transaction output
+type Coin struct {
+	Amount       uint64
+	ScriptPubKey []byte // raw script bytes
+	Height       int    // height of the block that created it
+	Coinbase     bool
+}
+
+// TxOut converts the coin back into a transaction output
+func (c Coin) TxOut() (transactions.TxOut, error) {
+	buf := binary.LittleEndian.AppendUint64(nil, c.Amount)
+	length, err := encoding.EncodeVarInt(uint64(len(c.ScriptPubKey)))
+	if err != nil {
+		return transactions.TxOut{}, err
+	}
+	buf = append(append(buf, length...), c.ScriptPubKey...)
+	return transactions.ParseTxOut(bytes.NewReader(buf))
+}
+
+// ChainState is the UTXO set as of a best block. It lives in memory and is written to a
+// snapshot file by Flush.
+type ChainState struct {
+	mu       sync.RWMutex
+	coins    map[transactions.OutPoint]Coin
+	bestHash [32]byte // internal byte order; zero before the first block
+	height   int      // -1 before the first block
+	path     string
+}
+
+// NewChainState returns an empty in-memory UTXO set
+func NewChainState() *ChainState {
+	return &ChainState{
+		coins:  make(map[transactions.OutPoint]Coin),
+		height: -1,
+	}
+}
+
+// OpenChainState loads the snapshot at path, or starts empty if there is none. Flush
+// writes back to path.
+func OpenChainState(path string) (*ChainState, error) {
+	cs := NewChainState()
+	cs.path = path
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := cs.load(bufio.NewReader(f)); err != nil {
+		return nil, fmt.Errorf("chain state %s: %w", path, err)
+	}
+	return cs, nil
+}
+
+// BestBlock returns the hash and height of the last connected block
+func (cs *ChainState) BestBlock() ([32]byte, int) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.bestHash, cs.height
+}
+
+// Count returns the number of unspent outputs
+func (cs *ChainState) Count() int {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return len(cs.coins)
+}
+
+// Get looks up an unspent output
+func (cs *ChainState) Get(op transactions.OutPoint) (Coin, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	coin, ok := cs.coins[op]
+	return coin, ok
+}
+
+// PrevOut looks up an unspent output as a TxOut (txid in display byte order), for
+// block.ChainContext
+func (cs *ChainState) PrevOut(txid [32]byte, index uint32) (transactions.TxOut, bool) {
+	coin, ok := cs.Get(transactions.OutPoint{TxID: txid, Index: index})
+	if !ok {
+		return transactions.TxOut{}, false
+	}
+	out, err := coin.TxOut()
+	return out, err == nil
+}
+
+// GetOutput looks up an unspent output, making the UTXO set a transactions.PrevOutProvider
+func (cs *ChainState) GetOutput(txid [32]byte, vout uint32) (uint64, script.Script, error) {
+	op := transactions.OutPoint{TxID: txid, Index: vout}
+	coin, ok := cs.Get(op)
+	if !ok {
+		return 0, script.Script{}, fmt.Errorf("%w: %s", transactions.ErrPrevOutNotFound, op)
+	}
+	out, err := coin.TxOut()
+	if err != nil {
+		return 0, script.Script{}, err
+	}
+	return out.Amount, out.ScriptPubKey, nil
+}
+
+// unspendable reports whether an output can never be spent and so is never stored
+func unspendable(script []byte) bool {
+	return (len(script) > 0 && script[0] == block.OP_RETURN) || len(script) > MAX_SCRIPT_SIZE
+}
+
+// ConnectBlock applies a block on top of the best block: every input's coin is spent and
+// every output added. A coinbase output can't be spent until it has
+// block.COINBASE_MATURITY confirmations, and no transaction may share its txid with one
+// that still has unspent outputs (BIP 30), save for the two historical exceptions. It
+// returns the undo record DisconnectBlock needs to revert the block. The set is unchanged
+// if it fails.
+func (cs *ChainState) ConnectBlock(fb *block.FullBlock, height int) (*BlockUndo, error) {
+	hash, err := fb.BlockHeader.Hash()
+	if err != nil {
+		return nil, err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.height >= 0 && (fb.BlockHeader.PrevBlock != cs.bestHash || height != cs.height+1) {
+		return nil, fmt.Errorf("%w: height %d", ErrNotConnecting, height)
+	}
+	enforceBIP30 := !block.IsBIP30Exception(height, [32]byte(hash))
+
+	// stage changes so a failure part way leaves the set untouched
+	added := make(map[transactions.OutPoint]Coin)
+	spentOps := make(map[transactions.OutPoint]bool)
+	undo := &BlockUndo{}
+	for i, tx := range fb.Txs {
+		coinbase := tx.IsCoinbase()
+		if !coinbase {
+			for j := range tx.Inputs {
+				op := tx.Inputs[j].OutPoint()
+				coin, ok := added[op]
+				if ok {
+					delete(added, op)
+				} else if coin, ok = cs.coins[op]; !ok || spentOps[op] {
+					return nil, fmt.Errorf("%w: tx %d input %d spends %s", ErrMissingCoin, i, j, op)
+				} else {
+					spentOps[op] = true
+				}
+				if coin.Coinbase && height-coin.Height < block.COINBASE_MATURITY {
+					return nil, fmt.Errorf("%w: tx %d input %d spends %s from height %d", ErrImmatureSpend, i, j, op, coin.Height)
+				}
+				undo.Spent = append(undo.Spent, coin)
+			}
+		}
+		txid, err := tx.Hash()
+		if err != nil {
+			return nil, err
+		}
+		for k, out := range tx.Outputs {
+			script, err := out.RawScriptBytes()
+			if err != nil {
+				return nil, fmt.Errorf("tx %d output %d: %w", i, k, err)
+			}
+			if unspendable(script) {
+				continue
+			}
+			op := transactions.OutPoint{TxID: txid, Index: uint32(k)}
+			if _, exists := cs.coins[op]; exists && enforceBIP30 {
+				return nil, fmt.Errorf("%w: tx %d output %s", ErrOverwriteCoin, i, op)
+			}
+			added[op] = Coin{
+				Amount:       out.Amount,
+				ScriptPubKey: script,
+				Height:       height,
+				Coinbase:     coinbase,
+			}
+		}
+	}
+
+	for op := range spentOps {
+		delete(cs.coins, op)
+	}
+	for op, coin := range added {
+		cs.coins[op] = coin
+	}
+	cs.bestHash, cs.height = [32]byte(hash), height
+	return undo, nil
+}
+
+// DisconnectBlock reverts the best block: its outputs are removed and the coins it spent
+// restored from its undo record
+func (cs *ChainState) DisconnectBlock(fb *block.FullBlock, undo *BlockUndo) error {
+	hash, err := fb.BlockHeader.Hash()
+	if err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if [32]byte(hash) != cs.bestHash || cs.height < 0 || len(fb.Txs) == 0 {
+		return ErrNotTip
+	}
+	n := 0
+	for _, tx := range fb.Txs[1:] {
+		n += len(tx.Inputs)
+	}
+	if len(undo.Spent) != n {
+		return fmt.Errorf("undo record has %d coins for %d inputs", len(undo.Spent), n)
+	}
+
+	// walk backwards so coins created and spent within the block cancel out
+	for i := len(fb.Txs) - 1; i >= 0; i-- {
+		tx := fb.Txs[i]
+		txid, err := tx.Hash()
+		if err != nil {
+			return err
+		}
+		for k := range tx.Outputs {
+			delete(cs.coins, transactions.OutPoint{TxID: txid, Index: uint32(k)})
+		}
+		if i == 0 {
+			break
+		}
+		for j := len(tx.Inputs) - 1; j >= 0; j-- {
+			n--
+			cs.coins[tx.Inputs[j].OutPoint()] = undo.Spent[n]
+		}
+	}
+	cs.bestHash = fb.BlockHeader.PrevBlock
+	cs.height--
+	return nil
+}
+
+// Flush writes the set to its snapshot file, replacing the previous snapshot atomically
+func (cs *ChainState) Flush() error {
+	if cs.path == "" {
+		return nil
+	}
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	tmp := cs.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := cs.save(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cs.path)
+}
+
+// save writes the best block, height and every coin. Caller holds mu.
+func (cs *ChainState) save(w io.Writer) error {
+	buf := append([]byte{}, cs.bestHash[:]...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(int32(cs.height)))
+	count, err := encoding.EncodeVarInt(uint64(len(cs.coins)))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(buf, count...)); err != nil {
+		return err
+	}
+	for op, coin := range cs.coins {
+		buf = append(buf[:0], op.TxID[:]...)
+		buf = binary.LittleEndian.AppendUint32(buf, op.Index)
+		buf = binary.LittleEndian.AppendUint64(buf, coin.Amount)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(coin.Height))
+		if coin.Coinbase {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		length, err := encoding.EncodeVarInt(uint64(len(coin.ScriptPubKey)))
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, length...), coin.ScriptPubKey...)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cs *ChainState) load(r io.Reader) error {
+	head := make([]byte, 36)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return err
+	}
+	cs.bestHash = [32]byte(head[:32])
+	cs.height = int(int32(binary.LittleEndian.Uint32(head[32:])))
+	count, err := encoding.ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+	fixed := make([]byte, 32+4+8+4+1)
+	for range count {
+		if _, err := io.ReadFull(r, fixed); err != nil {
+			return err
+		}
+		length, err := encoding.ReadVarInt(r)
+		if err != nil {
+			return err
+		}
+		if length > uint64(MAX_SCRIPT_SIZE) {
+			return fmt.Errorf("script of %d bytes in snapshot", length)
+		}
+		script := make([]byte, length)
+		if _, err := io.ReadFull(r, script); err != nil {
+			return err
+		}
+		op := transactions.OutPoint{TxID: [32]byte(fixed[:32]), Index: binary.LittleEndian.Uint32(fixed[32:36])}
+		cs.coins[op] = Coin{
+			Amount:       binary.LittleEndian.Uint64(fixed[36:44]),
+			Height:       int(binary.LittleEndian.Uint32(fixed[44:48])),
+			Coinbase:     fixed[48] == 1,
+			ScriptPubKey: script,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package chainstate
+
+import (
+	"bytes"
+	"errors"
+	"go-bitcoin/internal/block"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+	"path/filepath"
+	"testing"
+)
+
+func coinbaseTx(tag byte, amount uint64) *transactions.Transaction {
+	tx := transactions.NewTransaction(1,
+		[]transactions.TxIn{{
+			PrevTx:    make([]byte, 32),
+			PrevIdx:   transactions.COINBASE_PREVOUT,
+			ScriptSig: script.NewScript([]script.ScriptCommand{{Data: []byte{tag, 0x51}, IsData: true}}),
+			Sequence:  transactions.SEQUENCE_FINAL,
+		}},
+		[]transactions.TxOut{
+			{Amount: amount, ScriptPubKey: script.P2pkhScript(make([]byte, 20))},
+			{ScriptPubKey: script.NewScript([]script.ScriptCommand{{Opcode: block.OP_RETURN}})},
+		}, 0, false, false)
+	return &tx
+}
+
+// spendTx spends the given outpoints into a single output (scripts aren't checked here)
+func spendTx(amount uint64, ops ...transactions.OutPoint) *transactions.Transaction {
+	var ins []transactions.TxIn
+	for _, op := range ops {
+		ins = append(ins, transactions.NewTxIn(op.TxID[:], op.Index, transactions.SEQUENCE_FINAL))
+	}
+	tx := transactions.NewTransaction(1, ins,
+		[]transactions.TxOut{{Amount: amount, ScriptPubKey: script.P2pkhScript(make([]byte, 20))}}, 0, false, false)
+	return &tx
+}
+
+func outpoint(tx *transactions.Transaction, index uint32) transactions.OutPoint {
+	txid, _ := tx.Hash()
+	return transactions.OutPoint{TxID: txid, Index: index}
+}
+
+func fullBlock(prev [32]byte, txs ...*transactions.Transaction) *block.FullBlock {
+	header := block.NewBlock(1, prev, [32]byte{}, 1231006505, 0x207fffff, 0, nil)
+	return &block.FullBlock{BlockHeader: &header, Txs: txs}
+}
+
+func blockHash(fb *block.FullBlock) [32]byte {
+	h, _ := fb.BlockHeader.Hash()
+	return [32]byte(h)
+}
+
+// bury connects empty blocks on top of prev at height until a coinbase from that height
+// can be spent in the next block, and returns the new tip
+func bury(t *testing.T, cs *ChainState, prev [32]byte, height int) [32]byte {
+	t.Helper()
+	for h := height + 1; h < height+block.COINBASE_MATURITY; h++ {
+		cb := coinbaseTx(byte(h), 0)
+		cb.Outputs = cb.Outputs[1:] // only the unspendable output, so no coins are added
+		fb := fullBlock(prev, cb)
+		if _, err := cs.ConnectBlock(fb, h); err != nil {
+			t.Fatal(err)
+		}
+		prev = blockHash(fb)
+	}
+	return prev
+}
+
+func TestChainStateConnectDisconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chainstate.dat")
+	cs, err := OpenChainState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb0 := coinbaseTx(0, 5000)
+	b0 := fullBlock([32]byte{}, cb0)
+	if _, err := cs.ConnectBlock(b0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if cs.Count() != 1 {
+		t.Fatalf("expected OP_RETURN output to be skipped, have %d coins", cs.Count())
+	}
+
+	// block 100 spends the coinbase, then spends that spend within the block
+	tx1 := spendTx(4000, outpoint(cb0, 0))
+	tx2 := spendTx(3000, outpoint(tx1, 0))
+	cb1 := coinbaseTx(1, 5000)
+	if _, err := cs.ConnectBlock(fullBlock(blockHash(b0), cb1, tx1), 1); !errors.Is(err, ErrImmatureSpend) {
+		t.Fatalf("expected immature coinbase spend to be rejected, got %v", err)
+	}
+	tip := bury(t, cs, blockHash(b0), 0)
+	b1 := fullBlock(tip, cb1, tx1, tx2)
+
+	// a bad block leaves the set untouched
+	bad := fullBlock(tip, cb1, tx1, spendTx(1, outpoint(cb0, 0)))
+	if _, err := cs.ConnectBlock(bad, 100); !errors.Is(err, ErrMissingCoin) {
+		t.Fatalf("expected double spend to be rejected, got %v", err)
+	}
+	if _, ok := cs.Get(outpoint(cb0, 0)); !ok || cs.Count() != 1 {
+		t.Fatal("failed block changed the set")
+	}
+	if _, err := cs.ConnectBlock(fullBlock([32]byte{0x01}, cb1), 100); !errors.Is(err, ErrNotConnecting) {
+		t.Fatalf("expected ErrNotConnecting, got %v", err)
+	}
+
+	undo, err := cs.ConnectBlock(b1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent := undo.Spent
+	if len(spent) != 2 || spent[0].Amount != 5000 || !spent[0].Coinbase || spent[1].Amount != 4000 {
+		t.Fatalf("unexpected spent coins: %+v", spent)
+	}
+	coin, ok := cs.Get(outpoint(tx2, 0))
+	if !ok || coin.Height != 100 || coin.Coinbase || cs.Count() != 2 {
+		t.Fatal("expected tx2 and the new coinbase unspent")
+	}
+	out, ok := cs.PrevOut(outpoint(tx2, 0).TxID, 0)
+	if !ok || out.Amount != 3000 || !out.ScriptPubKey.IsP2pkhScriptPubKey() {
+		t.Fatal("PrevOut didn't rebuild the output")
+	}
+	var provider transactions.PrevOutProvider = cs
+	if amount, _, err := provider.GetOutput(outpoint(tx2, 0).TxID, 0); err != nil || amount != 3000 {
+		t.Fatalf("GetOutput = %d, %v", amount, err)
+	}
+	if _, _, err := provider.GetOutput(outpoint(cb0, 0).TxID, 0); !errors.Is(err, transactions.ErrPrevOutNotFound) {
+		t.Fatalf("spent coin: err = %v, want %v", err, transactions.ErrPrevOutNotFound)
+	}
+
+	// flush and reopen
+	if err := cs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenChainState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, height := reopened.BestBlock(); hash != blockHash(b1) || height != 100 || reopened.Count() != 2 {
+		t.Fatal("snapshot didn't round-trip")
+	}
+	if got, _ := reopened.Get(outpoint(tx2, 0)); got.Amount != coin.Amount || string(got.ScriptPubKey) != string(coin.ScriptPubKey) {
+		t.Fatal("coin didn't round-trip")
+	}
+
+	// disconnecting restores the state after block 99
+	if err := reopened.DisconnectBlock(b0, &BlockUndo{}); !errors.Is(err, ErrNotTip) {
+		t.Fatalf("expected ErrNotTip, got %v", err)
+	}
+	if err := reopened.DisconnectBlock(b1, undo); err != nil {
+		t.Fatal(err)
+	}
+	if hash, height := reopened.BestBlock(); hash != tip || height != 99 {
+		t.Fatal("best block not rewound")
+	}
+	if got, ok := reopened.Get(outpoint(cb0, 0)); !ok || got.Amount != 5000 || !got.Coinbase || reopened.Count() != 1 {
+		t.Fatal("disconnect didn't restore the spent coinbase")
+	}
+	t.Logf("✓ Connected, flushed, reopened and disconnected a block with an in-block spend")
+}
+
+func TestConnectBlockBIP30(t *testing.T) {
+	cs := NewChainState()
+	cb0 := coinbaseTx(0, 5000)
+	b0 := fullBlock([32]byte{}, cb0)
+	if _, err := cs.ConnectBlock(b0, 0); err != nil {
+		t.Fatal(err)
+	}
+	tip := bury(t, cs, blockHash(b0), 0)
+
+	// repeating the coinbase while its output is unspent would overwrite the coin
+	if _, err := cs.ConnectBlock(fullBlock(tip, cb0), 100); !errors.Is(err, ErrOverwriteCoin) {
+		t.Fatalf("expected ErrOverwriteCoin, got %v", err)
+	}
+	if coin, ok := cs.Get(outpoint(cb0, 0)); !ok || coin.Height != 0 {
+		t.Fatal("failed block changed the set")
+	}
+
+	// once fully spent the txid may appear again
+	b100 := fullBlock(tip, coinbaseTx(100, 0), spendTx(5000, outpoint(cb0, 0)))
+	if _, err := cs.ConnectBlock(b100, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.ConnectBlock(fullBlock(blockHash(b100), cb0), 101); err != nil {
+		t.Fatalf("duplicate of a spent transaction rejected: %v", err)
+	}
+	if coin, ok := cs.Get(outpoint(cb0, 0)); !ok || coin.Height != 101 {
+		t.Fatal("expected the repeated coinbase's output at height 101")
+	}
+	t.Logf("✓ BIP 30 rejects a txid with unspent outputs and allows it once spent")
+}
+
+func serializeBlock(t *testing.T, fb *block.FullBlock) []byte {
+	t.Helper()
+	raw, err := fb.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func storeBlock(t *testing.T, bs *block.BlockStore, fb *block.FullBlock, height int) {
+	t.Helper()
+	if err := bs.PutBlock(blockHash(fb), height, serializeBlock(t, fb)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUndoReorg(t *testing.T) {
+	dir := t.TempDir()
+	bs, err := block.OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := NewChainState()
+
+	cb0 := coinbaseTx(0, 5000)
+	b0 := fullBlock([32]byte{}, cb0)
+	storeBlock(t, bs, b0, 0)
+	if err := cs.ConnectStoredBlock(bs, b0, 0); err != nil {
+		t.Fatal(err)
+	}
+	tip := bury(t, cs, blockHash(b0), 0)
+	b1 := fullBlock(tip, coinbaseTx(1, 5000), spendTx(4000, outpoint(cb0, 0)))
+	storeBlock(t, bs, b1, 100)
+	if err := cs.ConnectStoredBlock(bs, b1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cs.Get(outpoint(cb0, 0)); ok {
+		t.Fatal("coinbase output should be spent")
+	}
+
+	// undo records survive a restart of the block store
+	bs.Close()
+	bs, err = block.OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	data, ok := bs.Undo(blockHash(b1))
+	if !ok {
+		t.Fatal("undo record lost on reopen")
+	}
+	undo, err := ParseBlockUndo(bytes.NewReader(data))
+	if err != nil || len(undo.Spent) != 1 || undo.Spent[0].Height != 0 || !undo.Spent[0].Coinbase {
+		t.Fatalf("unexpected undo record %+v: %v", undo, err)
+	}
+
+	// reorg: drop b1 and connect a competing block spending the same coin differently
+	fb, err := cs.DisconnectTip(bs)
+	if err != nil || blockHash(fb) != blockHash(b1) {
+		t.Fatalf("disconnect tip: %v", err)
+	}
+	restored, ok := cs.Get(outpoint(cb0, 0))
+	if !ok || restored.Amount != 5000 || restored.Height != 0 || !restored.Coinbase || cs.Count() != 1 {
+		t.Fatal("spent coin not restored exactly")
+	}
+	alt := fullBlock(tip, coinbaseTx(2, 5000), spendTx(1000, outpoint(cb0, 0)))
+	storeBlock(t, bs, alt, 100)
+	if err := cs.ConnectStoredBlock(bs, alt, 100); err != nil {
+		t.Fatal(err)
+	}
+	if hash, height := cs.BestBlock(); hash != blockHash(alt) || height != 100 || cs.Count() != 2 {
+		t.Fatal("competing block not connected")
+	}
+	t.Logf("✓ Reorged block 100 using its undo record")
+}
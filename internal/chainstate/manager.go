@@ -0,0 +1,264 @@
+package chainstate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/block"
+	"path/filepath"
+	"sync"
+)
+
+// MIN_BLOCKS_TO_KEEP is the smallest prune window: BIP 159 peers expect a pruned node to
+// serve the last 288 blocks
+const MIN_BLOCKS_TO_KEEP int = 288
+
+// Data directory layout
+const (
+	BLOCKS_DIR      string = "blocks"
+	CHAINSTATE_FILE string = "chainstate.dat"
+)
+
+var ErrPruneWindowTooSmall = errors.New("prune window is below MIN_BLOCKS_TO_KEEP")
+
+// ChainEventType says what a ChainEvent reports
+type ChainEventType int
+
+const (
+	BlockConnected ChainEventType = iota
+	BlockDisconnected
+	NewTip
+)
+
+func (t ChainEventType) String() string {
+	switch t {
+	case BlockConnected:
+		return "connected"
+	case BlockDisconnected:
+		return "disconnected"
+	case NewTip:
+		return "new tip"
+	}
+	return fmt.Sprintf("ChainEventType(%d)", int(t))
+}
+
+// ChainEvent is a change to the chain the UTXO set follows. Every connect or disconnect
+// is followed by a NewTip event for the resulting best block, so a reorg arrives as a run
+// of disconnects down to the fork and connects up the new branch. Hashes are in internal
+// byte order.
+type ChainEvent struct {
+	Type   ChainEventType
+	Hash   [32]byte
+	Height int
+}
+
+// ChainManager keeps a block store and the UTXO set in step: blocks are validated,
+// stored, and connected in order. In pruning mode block and undo files holding only
+// blocks older than the prune window are deleted; the UTXO set and headers are kept. It serves
+// as the node's block source, reporting itself pruned so the node advertises
+// NODE_NETWORK_LIMITED, and as a network.FilterBlockSource, taking the scripts each block
+// spent from its undo record. Connects and disconnects are published to Subscribe.
+type ChainManager struct {
+	Blocks  *block.BlockStore
+	State   *ChainState
+	TestNet bool
+	Logging bool
+
+	pruneWindow int // most recent blocks kept, tip included; 0 keeps everything
+
+	mu          sync.Mutex
+	subscribers map[uint64]chan ChainEvent
+	nextSubID   uint64
+	closed      bool
+}
+
+// OpenChainManager opens the block store and chain state under dir. pruneWindow is how
+// many of the most recent blocks to keep, at least MIN_BLOCKS_TO_KEEP, or 0 to never prune.
+func OpenChainManager(dir string, pruneWindow int) (*ChainManager, error) {
+	if pruneWindow != 0 && pruneWindow < MIN_BLOCKS_TO_KEEP {
+		return nil, fmt.Errorf("%w: %d", ErrPruneWindowTooSmall, pruneWindow)
+	}
+	bs, err := block.OpenBlockStore(filepath.Join(dir, BLOCKS_DIR))
+	if err != nil {
+		return nil, err
+	}
+	cs, err := OpenChainState(filepath.Join(dir, CHAINSTATE_FILE))
+	if err != nil {
+		bs.Close()
+		return nil, err
+	}
+	// the snapshot already includes every block up to its best block
+	if _, height := cs.BestBlock(); height >= 0 {
+		bs.MarkApplied(height)
+	}
+	return &ChainManager{
+		Blocks:      bs,
+		State:       cs,
+		pruneWindow: pruneWindow,
+		subscribers: make(map[uint64]chan ChainEvent),
+	}, nil
+}
+
+// Pruned reports whether old blocks are deleted, for network.PrunedBlockSource
+func (cm *ChainManager) Pruned() bool {
+	return cm.pruneWindow > 0
+}
+
+// PruneWindow returns how many of the most recent blocks are kept, 0 if pruning is off
+func (cm *ChainManager) PruneWindow() int {
+	return cm.pruneWindow
+}
+
+// AcceptBlock validates a serialized block against the UTXO set, connects it at height
+// and stores it, then prunes files that have fallen out of the window. A block that fails
+// to connect is never stored, so it can't be served as part of the chain, and one whose
+// block or undo data can't be written is disconnected again.
+func (cm *ChainManager) AcceptBlock(raw []byte, height int) error {
+	fb, err := block.ParseFullBlock(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	ctx := block.ChainContext{Height: height, TestNet: cm.TestNet, PrevOut: cm.State.PrevOut}
+	if err := fb.Validate(ctx); err != nil {
+		return fmt.Errorf("block %d: %w", height, err)
+	}
+	hash, err := fb.BlockHeader.Hash()
+	if err != nil {
+		return err
+	}
+	undo, err := cm.State.ConnectBlock(fb, height)
+	if err != nil {
+		return fmt.Errorf("block %d: %w", height, err)
+	}
+	// a block that can't be stored with its undo data is disconnected again, as it
+	// couldn't be served or reverted in a reorg
+	rollback := func(err error) error {
+		if derr := cm.State.DisconnectBlock(fb, undo); derr != nil {
+			return errors.Join(err, derr)
+		}
+		cm.Blocks.Disconnect([32]byte(hash))
+		return err
+	}
+	if err := cm.Blocks.PutBlock([32]byte(hash), height, raw); err != nil {
+		return rollback(err)
+	}
+	if err := saveUndo(cm.Blocks, [32]byte(hash), undo, height); err != nil {
+		return rollback(err)
+	}
+	cm.publish(ChainEvent{Type: BlockConnected, Hash: [32]byte(hash), Height: height})
+	cm.publish(ChainEvent{Type: NewTip, Hash: [32]byte(hash), Height: height})
+	return cm.prune(height)
+}
+
+// prune deletes the files wholly below the window under tip. The UTXO set is flushed
+// first: once a block is gone it can't be replayed into an older snapshot.
+func (cm *ChainManager) prune(tip int) error {
+	if cm.pruneWindow == 0 || !cm.Blocks.Prunable(tip-cm.pruneWindow) {
+		return nil
+	}
+	if err := cm.State.Flush(); err != nil {
+		return err
+	}
+	deleted, err := cm.Blocks.Prune(tip - cm.pruneWindow)
+	if cm.Logging && len(deleted) > 0 {
+		fmt.Printf("Pruned block files %v, blocks kept above height %d\n", deleted, cm.Blocks.PrunedHeight())
+	}
+	return err
+}
+
+// DisconnectTip reverts the best block, for reorgs. Blocks below the prune window can't
+// be disconnected since their undo data is gone.
+func (cm *ChainManager) DisconnectTip() (*block.FullBlock, error) {
+	hash, height := cm.State.BestBlock()
+	fb, err := cm.State.DisconnectTip(cm.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	cm.publish(ChainEvent{Type: BlockDisconnected, Hash: hash, Height: height})
+	tip, tipHeight := cm.State.BestBlock()
+	cm.publish(ChainEvent{Type: NewTip, Hash: tip, Height: tipHeight})
+	return fb, nil
+}
+
+// Subscribe returns a channel receiving every ChainEvent until cancel is called or the
+// manager is closed. Events are dropped if the subscriber falls behind, so size buf for
+// the longest reorg the caller must see in full.
+func (cm *ChainManager) Subscribe(buf int) (<-chan ChainEvent, func()) {
+	ch := make(chan ChainEvent, buf)
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	id := cm.nextSubID
+	cm.nextSubID++
+	cm.subscribers[id] = ch
+
+	cancel := func() {
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		if sub, ok := cm.subscribers[id]; ok {
+			delete(cm.subscribers, id)
+			close(sub)
+		}
+	}
+	return ch, cancel
+}
+
+// publish delivers ev to every subscriber with room for it
+func (cm *ChainManager) publish(ev ChainEvent) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, ch := range cm.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			if cm.Logging {
+				fmt.Printf("Dropped %s event for block %d: subscriber behind\n", ev.Type, ev.Height)
+			}
+		}
+	}
+}
+
+// RawBlock returns a stored block, for network.BlockSource
+func (cm *ChainManager) RawBlock(hash [32]byte) ([]byte, int, bool) {
+	return cm.Blocks.RawBlock(hash)
+}
+
+// HashAt returns the hash of the stored block at height, for network.FilterBlockSource
+func (cm *ChainManager) HashAt(height int) ([32]byte, bool) {
+	return cm.Blocks.HashAt(height)
+}
+
+// SpentScripts returns the scriptPubKeys of the outputs a connected block spent, in input
+// order, for network.FilterBlockSource. Blocks not connected yet or pruned have none.
+func (cm *ChainManager) SpentScripts(hash [32]byte) ([][]byte, bool) {
+	data, ok := cm.Blocks.Undo(hash)
+	if !ok {
+		return nil, false
+	}
+	undo, err := ParseBlockUndo(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	return undo.Scripts(), true
+}
+
+// Tip returns the best stored block, for network.BlockSource
+func (cm *ChainManager) Tip() (int, *block.Block) {
+	return cm.Blocks.Tip()
+}
+
+// Close flushes the UTXO set, closes the block store and ends every subscription
+func (cm *ChainManager) Close() error {
+	cm.mu.Lock()
+	cm.closed = true
+	for id, ch := range cm.subscribers {
+		delete(cm.subscribers, id)
+		close(ch)
+	}
+	cm.mu.Unlock()
+	return errors.Join(cm.State.Flush(), cm.Blocks.Close())
+}
@@ -0,0 +1,281 @@
+package chainstate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/block"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/network"
+	"go-bitcoin/internal/script"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// validBlock builds a coinbase-only block at height that passes block validation
+func validBlock(prev [32]byte, height int) *block.FullBlock {
+	cb := coinbaseTx(0, 5000)
+	cb.Inputs[0].ScriptSig = script.NewScript([]script.ScriptCommand{
+		{Data: binary.LittleEndian.AppendUint32(nil, uint32(height)), IsData: true},
+	})
+	txid, _ := cb.Hash()
+	slices.Reverse(txid[:])
+	fb := fullBlock(prev, cb)
+	fb.BlockHeader.MerkleRoot = [32]byte(encoding.MerkleRoot([][]byte{txid[:]}))
+	return fb
+}
+
+func TestChainManagerPruning(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := OpenChainManager(dir, MIN_BLOCKS_TO_KEEP-1); !errors.Is(err, ErrPruneWindowTooSmall) {
+		t.Fatalf("expected ErrPruneWindowTooSmall, got %v", err)
+	}
+	cm, err := OpenChainManager(dir, MIN_BLOCKS_TO_KEEP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cm.Pruned() {
+		t.Fatal("pruning mode not reported")
+	}
+
+	var hashes [][32]byte
+	var prev [32]byte
+	for h := range MIN_BLOCKS_TO_KEEP + 40 {
+		fb := validBlock(prev, h)
+		raw := serializeBlock(t, fb)
+		if h == 0 {
+			cm.Blocks.MaxFileSize = int64(10 * (block.BLOCK_RECORD_OVERHEAD + len(raw)))
+		}
+		if err := cm.AcceptBlock(raw, h); err != nil {
+			t.Fatalf("block %d: %v", h, err)
+		}
+		prev = blockHash(fb)
+		hashes = append(hashes, prev)
+	}
+
+	tip := len(hashes) - 1
+	pruned := cm.Blocks.PrunedHeight()
+	if pruned < 0 || pruned > tip-MIN_BLOCKS_TO_KEEP {
+		t.Fatalf("pruned up to %d with tip %d", pruned, tip)
+	}
+	if _, _, ok := cm.RawBlock(hashes[0]); ok {
+		t.Fatal("block 0 still stored")
+	}
+	if _, _, ok := cm.RawBlock(hashes[tip-MIN_BLOCKS_TO_KEEP+1]); !ok {
+		t.Fatal("block inside the window was pruned")
+	}
+	if cm.State.Count() != len(hashes) {
+		t.Fatalf("UTXO set has %d coins, want %d", cm.State.Count(), len(hashes))
+	}
+
+	// a bad block is rejected before it is stored
+	bad := validBlock(prev, tip+1)
+	bad.BlockHeader.MerkleRoot[0] ^= 0xff
+	if err := cm.AcceptBlock(serializeBlock(t, bad), tip+1); !errors.Is(err, block.ErrBadMerkleRoot) {
+		t.Fatalf("expected bad block to be rejected, got %v", err)
+	}
+	if err := cm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the flushed UTXO set and the remaining blocks survive a restart
+	cm, err = OpenChainManager(dir, MIN_BLOCKS_TO_KEEP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+	if hash, height := cm.State.BestBlock(); hash != hashes[tip] || height != tip {
+		t.Fatalf("chain state reopened at %d", height)
+	}
+	if height, _ := cm.Tip(); height != tip || cm.Blocks.PrunedHeight() < 0 {
+		t.Fatalf("block store reopened at %d, pruned %d", height, cm.Blocks.PrunedHeight())
+	}
+	t.Logf("✓ Kept %d blocks above height %d with tip %d", tip-pruned, pruned, tip)
+}
+
+func TestChainManagerRejectsUnconnectedBlock(t *testing.T) {
+	cm, err := OpenChainManager(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+
+	var hashes [][32]byte
+	var prev [32]byte
+	for h := range 3 {
+		fb := validBlock(prev, h)
+		if err := cm.AcceptBlock(serializeBlock(t, fb), h); err != nil {
+			t.Fatalf("block %d: %v", h, err)
+		}
+		prev = blockHash(fb)
+		hashes = append(hashes, prev)
+	}
+	tip := len(hashes) - 1
+
+	// valid on their own, but one builds on an old block and the other replaces the tip
+	tests := []struct {
+		name   string
+		fb     *block.FullBlock
+		height int
+	}{
+		{"not on the tip", validBlock(hashes[0], tip+1), tip + 1},
+		{"competing tip", validBlock(hashes[tip-1], tip), tip},
+	}
+	for _, tt := range tests {
+		tt.fb.BlockHeader.TimeStamp++ // a different block from any already accepted
+		if err := cm.AcceptBlock(serializeBlock(t, tt.fb), tt.height); !errors.Is(err, ErrNotConnecting) {
+			t.Fatalf("%s: expected ErrNotConnecting, got %v", tt.name, err)
+		}
+		if _, _, ok := cm.RawBlock(blockHash(tt.fb)); ok {
+			t.Fatalf("%s: rejected block stored", tt.name)
+		}
+		if hash, ok := cm.Blocks.HashAt(tt.height); tt.height <= tip && hash != hashes[tt.height] || tt.height > tip && ok {
+			t.Fatalf("%s: height %d now holds %x", tt.name, tt.height, hash)
+		}
+		if height, _ := cm.Tip(); height != tip {
+			t.Fatalf("%s: store tip moved to %d", tt.name, height)
+		}
+	}
+	if hash, height := cm.State.BestBlock(); hash != hashes[tip] || height != tip {
+		t.Fatalf("chain state moved to %d", height)
+	}
+	t.Logf("✓ Blocks that don't connect leave the block store unchanged")
+}
+
+func TestChainManagerUndoWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	cm, err := OpenChainManager(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+
+	// a directory where the undo file goes makes writing the undo data fail
+	revFile := filepath.Join(dir, BLOCKS_DIR, fmt.Sprintf(block.UNDO_FILE_PATTERN, 0))
+	if err := os.Mkdir(revFile, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fb := validBlock([32]byte{}, 0)
+	raw := serializeBlock(t, fb)
+	if err := cm.AcceptBlock(raw, 0); err == nil {
+		t.Fatal("block accepted without its undo data")
+	}
+	if _, height := cm.State.BestBlock(); height != -1 || cm.State.Count() != 0 {
+		t.Fatalf("chain state left at height %d with %d coins", height, cm.State.Count())
+	}
+
+	// once the undo data can be written the block connects
+	if err := os.Remove(revFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.AcceptBlock(raw, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Blocks.Undo(blockHash(fb)); !ok {
+		t.Fatal("no undo data for the connected block")
+	}
+	t.Logf("✓ A block whose undo data can't be written is disconnected")
+}
+
+func TestChainManagerFilterSource(t *testing.T) {
+	cm, err := OpenChainManager(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+	var _ network.FilterBlockSource = cm
+
+	cb0 := coinbaseTx(0, 5000)
+	spentScript := script.P2pkhScript(bytes.Repeat([]byte{0x42}, 20))
+	cb0.Outputs[0].ScriptPubKey = spentScript
+	b0 := fullBlock([32]byte{}, cb0)
+	storeBlock(t, cm.Blocks, b0, 0)
+	if err := cm.State.ConnectStoredBlock(cm.Blocks, b0, 0); err != nil {
+		t.Fatal(err)
+	}
+	tip := bury(t, cm.State, blockHash(b0), 0)
+	b100 := fullBlock(tip, coinbaseTx(100, 0), spendTx(4000, outpoint(cb0, 0)))
+	storeBlock(t, cm.Blocks, b100, 100)
+	if _, ok := cm.SpentScripts(blockHash(b100)); ok {
+		t.Fatal("spent scripts reported before the block was connected")
+	}
+	if err := cm.State.ConnectStoredBlock(cm.Blocks, b100, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if hash, ok := cm.HashAt(100); !ok || hash != blockHash(b100) {
+		t.Fatal("HashAt(100) doesn't return the stored block")
+	}
+	raw, _ := spentScript.RawBytes()
+	spent, ok := cm.SpentScripts(blockHash(b100))
+	if !ok || len(spent) != 1 || !bytes.Equal(spent[0], raw) {
+		t.Fatalf("unexpected spent scripts %x", spent)
+	}
+
+	// the filter built from undo data matches the spent script
+	f, err := network.NewFilterIndex(cm).Filter(blockHash(b100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcs, err := network.ParseGCSFilter(bytes.NewReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := blockHash(b100)
+	k0, k1 := binary.LittleEndian.Uint64(hash[0:8]), binary.LittleEndian.Uint64(hash[8:16])
+	if match, err := gcs.Match(raw, k0, k1); err != nil || !match {
+		t.Fatalf("filter doesn't match the spent script: %v", err)
+	}
+	t.Logf("✓ Built a basic filter for block 100 from its undo record")
+}
+
+func TestChainManagerEvents(t *testing.T) {
+	cm, err := OpenChainManager(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := cm.Subscribe(16)
+	defer cancel()
+
+	var hashes [][32]byte
+	var prev [32]byte
+	for h := range 3 {
+		fb := validBlock(prev, h)
+		if err := cm.AcceptBlock(serializeBlock(t, fb), h); err != nil {
+			t.Fatal(err)
+		}
+		prev = blockHash(fb)
+		hashes = append(hashes, prev)
+	}
+	if _, err := cm.DisconnectTip(); err != nil {
+		t.Fatal(err)
+	}
+	if height, _ := cm.Tip(); height != 1 {
+		t.Fatalf("block store tip at %d after disconnecting block 2", height)
+	}
+	if _, ok := cm.HashAt(2); ok {
+		t.Fatal("disconnected block still at height 2")
+	}
+
+	var want []ChainEvent
+	for h, hash := range hashes {
+		want = append(want, ChainEvent{BlockConnected, hash, h}, ChainEvent{NewTip, hash, h})
+	}
+	want = append(want, ChainEvent{BlockDisconnected, hashes[2], 2}, ChainEvent{NewTip, hashes[1], 1})
+	for i, w := range want {
+		if got := <-events; got != w {
+			t.Fatalf("event %d: got %s %d, want %s %d", i, got.Type, got.Height, w.Type, w.Height)
+		}
+	}
+
+	if err := cm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("subscription still open after Close")
+	}
+	t.Logf("✓ Received %d chain events", len(want))
+}
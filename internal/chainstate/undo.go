@@ -0,0 +1,135 @@
+package chainstate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"go-bitcoin/internal/block"
+	"go-bitcoin/internal/encoding"
+	"io"
+)
+
+// BlockUndo holds the coins a block spent, in input order with the coinbase skipped, so
+// DisconnectBlock can put them back exactly
+type BlockUndo struct {
+	Spent []Coin
+}
+
+// Serialize encodes the undo record: a varint count, then per coin the amount, height,
+// coinbase flag and varint-prefixed script
+func (u *BlockUndo) Serialize() ([]byte, error) {
+	buf, err := encoding.EncodeVarInt(uint64(len(u.Spent)))
+	if err != nil {
+		return nil, err
+	}
+	for _, coin := range u.Spent {
+		buf = binary.LittleEndian.AppendUint64(buf, coin.Amount)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(coin.Height))
+		if coin.Coinbase {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		length, err := encoding.EncodeVarInt(uint64(len(coin.ScriptPubKey)))
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, length...), coin.ScriptPubKey...)
+	}
+	return buf, nil
+}
+
+// Scripts returns the scriptPubKeys of the spent coins, the items a BIP 158 basic filter
+// takes from a block's inputs
+func (u *BlockUndo) Scripts() [][]byte {
+	scripts := make([][]byte, len(u.Spent))
+	for i, coin := range u.Spent {
+		scripts[i] = coin.ScriptPubKey
+	}
+	return scripts
+}
+
+func ParseBlockUndo(r io.Reader) (*BlockUndo, error) {
+	count, err := encoding.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	u := &BlockUndo{}
+	fixed := make([]byte, 8+4+1)
+	for range count {
+		if _, err := io.ReadFull(r, fixed); err != nil {
+			return nil, fmt.Errorf("undo parse error - %w", err)
+		}
+		length, err := encoding.ReadVarInt(r)
+		if err != nil {
+			return nil, fmt.Errorf("undo parse error - %w", err)
+		}
+		if length > uint64(MAX_SCRIPT_SIZE) {
+			return nil, fmt.Errorf("undo parse error - script of %d bytes", length)
+		}
+		script := make([]byte, length)
+		if _, err := io.ReadFull(r, script); err != nil {
+			return nil, fmt.Errorf("undo parse error - %w", err)
+		}
+		u.Spent = append(u.Spent, Coin{
+			Amount:       binary.LittleEndian.Uint64(fixed[:8]),
+			Height:       int(binary.LittleEndian.Uint32(fixed[8:12])),
+			Coinbase:     fixed[12] == 1,
+			ScriptPubKey: script,
+		})
+	}
+	return u, nil
+}
+
+// ConnectStoredBlock connects a block that is in bs and saves its undo record there,
+// after which the block counts as applied for pruning
+func (cs *ChainState) ConnectStoredBlock(bs *block.BlockStore, fb *block.FullBlock, height int) error {
+	hash, err := fb.BlockHeader.Hash()
+	if err != nil {
+		return err
+	}
+	undo, err := cs.ConnectBlock(fb, height)
+	if err != nil {
+		return err
+	}
+	return saveUndo(bs, [32]byte(hash), undo, height)
+}
+
+// saveUndo stores the undo record of the block connected at height, which marks it applied
+func saveUndo(bs *block.BlockStore, hash [32]byte, undo *BlockUndo, height int) error {
+	data, err := undo.Serialize()
+	if err != nil {
+		return err
+	}
+	if err := bs.PutUndo(hash, data); err != nil {
+		return err
+	}
+	bs.MarkApplied(height)
+	return nil
+}
+
+// DisconnectTip reverts the best block using the block and undo record saved in bs, and
+// returns the disconnected block, which bs keeps by hash but no longer at its height
+func (cs *ChainState) DisconnectTip(bs *block.BlockStore) (*block.FullBlock, error) {
+	hash, height := cs.BestBlock()
+	if height < 0 {
+		return nil, ErrNotTip
+	}
+	fb, _, err := bs.FullBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := bs.Undo(hash)
+	if !ok {
+		return nil, fmt.Errorf("no undo data for block %x", hash)
+	}
+	undo, err := ParseBlockUndo(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.DisconnectBlock(fb, undo); err != nil {
+		return nil, err
+	}
+	bs.Disconnect(hash)
+	return fb, nil
+}
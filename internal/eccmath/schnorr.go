@@ -0,0 +1,125 @@
+package eccmath
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/encoding"
+	"math/big"
+)
+
+// BIP 340 sizes
+const (
+	XONLY_PUBKEY_SIZE int = 32 // x coordinate only, y implicitly even
+	SCHNORR_SIG_SIZE  int = 64 // R.x || s
+	SCHNORR_AUX_SIZE  int = 32 // auxiliary randomness mixed into the nonce
+)
+
+// BIP 340 hash tags
+const (
+	SCHNORR_TAG_AUX       string = "BIP0340/aux"
+	SCHNORR_TAG_NONCE     string = "BIP0340/nonce"
+	SCHNORR_TAG_CHALLENGE string = "BIP0340/challenge"
+)
+
+// HasEvenY reports whether the point's y coordinate is even, the one BIP 340 picks for an
+// x-only key
+func (p *S256Point) HasEvenY() bool {
+	return p.Point.y.num.Bit(0) == 0
+}
+
+// SerializeXOnly returns the 32 byte x coordinate BIP 340 uses as a public key
+func (p *S256Point) SerializeXOnly() []byte {
+	return p.Point.x.num.FillBytes(make([]byte, XONLY_PUBKEY_SIZE))
+}
+
+// LiftX returns the point with x coordinate x and an even y, the public key an x-only
+// serialization stands for
+func (s *Secp256k1Group) LiftX(x []byte) (S256Point, error) {
+	if len(x) != XONLY_PUBKEY_SIZE {
+		return S256Point{}, fmt.Errorf("x-only key is %d bytes, want %d", len(x), XONLY_PUBKEY_SIZE)
+	}
+	if new(big.Int).SetBytes(x).Cmp(s.curve.p) >= 0 {
+		return S256Point{}, errors.New("x-only key is not a field element")
+	}
+	tmp := NewS256Point(s.G, s)
+	return tmp.Deserialize(append([]byte{0x02}, x...))
+}
+
+// SignSchnorr signs msg per BIP 340, returning the 64 byte signature. auxRand is mixed
+// into the nonce; nil draws fresh randomness.
+func (s *Secp256k1Group) SignSchnorr(key *big.Int, msg, auxRand []byte) ([]byte, error) {
+	if key.Sign() <= 0 || key.Cmp(s.N) >= 0 {
+		return nil, errors.New("secret key out of range")
+	}
+	if auxRand == nil {
+		auxRand = make([]byte, SCHNORR_AUX_SIZE)
+		if _, err := rand.Read(auxRand); err != nil {
+			return nil, fmt.Errorf("failed to generate aux randomness: %w", err)
+		}
+	}
+
+	P := NewS256Point(s.ScalarBaseMultiply(key), s)
+	d := new(big.Int).Set(key)
+	if !P.HasEvenY() {
+		d.Sub(s.N, d)
+	}
+	pubBytes := P.SerializeXOnly()
+
+	// t = bytes(d) xor hash_aux(a)
+	t := d.FillBytes(make([]byte, 32))
+	for i, b := range encoding.TaggedHash(SCHNORR_TAG_AUX, auxRand) {
+		t[i] ^= b
+	}
+
+	k := new(big.Int).SetBytes(encoding.TaggedHash(SCHNORR_TAG_NONCE, t, pubBytes, msg))
+	k.Mod(k, s.N)
+	if k.Sign() == 0 {
+		return nil, errors.New("schnorr nonce is zero")
+	}
+	R := NewS256Point(s.ScalarBaseMultiply(k), s)
+	if !R.HasEvenY() {
+		k.Sub(s.N, k)
+	}
+	rBytes := R.SerializeXOnly()
+
+	e := new(big.Int).SetBytes(encoding.TaggedHash(SCHNORR_TAG_CHALLENGE, rBytes, pubBytes, msg))
+	e.Mod(e, s.N)
+
+	// sig = bytes(R) || bytes((k + e*d) mod n)
+	sig := e.Mul(e, d)
+	sig.Add(sig, k)
+	sig.Mod(sig, s.N)
+	return append(rBytes, sig.FillBytes(make([]byte, 32))...), nil
+}
+
+// VerifySchnorr checks a BIP 340 signature on msg against the point's x-only key
+func (p *S256Point) VerifySchnorr(msg, sig []byte) bool {
+	if len(sig) != SCHNORR_SIG_SIZE {
+		return false
+	}
+	g := p.group
+	P, err := g.LiftX(p.SerializeXOnly())
+	if err != nil {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if r.Cmp(g.curve.p) >= 0 || s.Cmp(g.N) >= 0 {
+		return false
+	}
+
+	e := new(big.Int).SetBytes(encoding.TaggedHash(SCHNORR_TAG_CHALLENGE, sig[:32], P.SerializeXOnly(), msg))
+	e.Mod(e, g.N)
+
+	// R = s*G - e*P
+	eP, err := P.Point.ScalarMulBig(new(big.Int).Sub(g.N, e))
+	if err != nil {
+		return false
+	}
+	R, err := g.ScalarBaseMultiply(s).Add(eP)
+	if err != nil || R.IsInf() {
+		return false
+	}
+	return R.y.num.Bit(0) == 0 && R.x.num.Cmp(r) == 0
+}
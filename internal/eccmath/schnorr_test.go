@@ -0,0 +1,81 @@
+package eccmath
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func TestSchnorr(t *testing.T) {
+	group := NewBitcoin()
+
+	// BIP 340 test vectors 0 and 1
+	vectors := []struct {
+		secret, pubkey, aux, msg, sig string
+	}{
+		{
+			secret: "0000000000000000000000000000000000000000000000000000000000000003",
+			pubkey: "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9",
+			aux:    "0000000000000000000000000000000000000000000000000000000000000000",
+			msg:    "0000000000000000000000000000000000000000000000000000000000000000",
+			sig:    "e907831f80848d1069a5371b402410364bdf1c5f8307b0084c55f1ce2dca821525f66a4a85ea8b71e482a74f382d2ce5ebeee8fdb2172f477df4900d310536c0",
+		},
+		{
+			secret: "b7e151628aed2a6abf7158809cf4f3c762e7160f38b4da56a784d9045190cfef",
+			pubkey: "dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659",
+			aux:    "0000000000000000000000000000000000000000000000000000000000000001",
+			msg:    "243f6a8885a308d313198a2e03707344a4093822299f31d0082efa98ec4e6c89",
+			sig:    "6896bd60eeae296db48a229ff71dfe071bde413e6d43f917dc8dcf8c78de33418906d11ac976abccb20b091292bff4ea897efcb639ea871cfa95f6de339e4b0a",
+		},
+	}
+
+	for i, v := range vectors {
+		secret, _ := new(big.Int).SetString(v.secret, 16)
+		pubkey, _ := hex.DecodeString(v.pubkey)
+		aux, _ := hex.DecodeString(v.aux)
+		msg, _ := hex.DecodeString(v.msg)
+		want, _ := hex.DecodeString(v.sig)
+
+		P := NewS256Point(group.ScalarBaseMultiply(secret), group)
+		if got := P.SerializeXOnly(); !bytes.Equal(got, pubkey) {
+			t.Fatalf("vector %d: pubkey = %x, want %x", i, got, pubkey)
+		}
+		sig, err := group.SignSchnorr(secret, msg, aux)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sig, want) {
+			t.Fatalf("vector %d: sig = %x, want %x", i, sig, want)
+		}
+
+		lifted, err := group.LiftX(pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !lifted.VerifySchnorr(msg, sig) {
+			t.Errorf("vector %d: signature did not verify", i)
+		}
+		msg[0] ^= 0x01
+		if lifted.VerifySchnorr(msg, sig) {
+			t.Errorf("vector %d: signature verified for a different message", i)
+		}
+	}
+	t.Logf("✓ Schnorr signatures match the BIP 340 vectors and verify")
+
+	// -G has odd y and verifies as its even-y twin G
+	minusOne := new(big.Int).Sub(group.N, big.NewInt(1))
+	odd := NewS256Point(group.ScalarBaseMultiply(minusOne), group)
+	if odd.HasEvenY() {
+		t.Fatal("-G has even y")
+	}
+	msg := make([]byte, 32)
+	sig, err := group.SignSchnorr(minusOne, msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !odd.VerifySchnorr(msg, sig) {
+		t.Error("signature did not verify against the x-only key")
+	}
+	t.Logf("✓ Keys are compared by x coordinate alone")
+}
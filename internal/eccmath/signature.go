@@ -20,6 +20,15 @@ func NewSignature(r, s int) Signature {
 	}
 }
 
+// halfOrder is half the secp256k1 group order, the largest S of a low-S signature
+var halfOrder, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffff5d576e7357a4501ddfe92f46681b20a0", 16)
+
+// IsLowS reports whether the signature's S is at most half the group order, as BIP 146
+// requires for relay
+func (s Signature) IsLowS() bool {
+	return s.s.Cmp(halfOrder) <= 0
+}
+
 func (s Signature) String() string {
 	return fmt.Sprintf("Signature(0x%064x, 0x%064x)", s.r, s.s)
 }
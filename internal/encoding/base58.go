@@ -53,7 +53,22 @@ func getIndex(c byte) int {
 	return -1
 }
 
+// DecodeBase58 decodes a Base58Check string and returns its payload without the version
+// byte
 func DecodeBase58(base58 string) ([]byte, error) {
+	decoded, err := DecodeBase58Checksum(base58)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) == 0 {
+		return nil, errors.New("decoded data too short")
+	}
+	return decoded[1:], nil
+}
+
+// DecodeBase58Checksum decodes a Base58Check string and returns the checked data, version
+// byte included: the inverse of EncodeBase58Checksum
+func DecodeBase58Checksum(base58 string) ([]byte, error) {
 	// 1. Count leading '1's
 	count := 0
 	for _, c := range base58 {
@@ -96,5 +111,5 @@ func DecodeBase58(base58 string) ([]byte, error) {
 	if !slices.Equal(hashCheckSum, checksum) {
 		return nil, fmt.Errorf("bad checksum: %x, %x", hashCheckSum, checksum)
 	}
-	return valueWithVersion[1:], nil
+	return valueWithVersion, nil
 }
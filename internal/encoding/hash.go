@@ -8,7 +8,15 @@ import (
 )
 
 const BIP37_CONSTANT uint32 = 0xfba4c795
-const SIGHASH_ALL uint32 = 1
+
+// Signature hash types, committed to by the byte that ends each signature
+const (
+	SIGHASH_DEFAULT      uint32 = 0x00 // taproot only: ALL, with no byte appended to the signature
+	SIGHASH_ALL          uint32 = 0x01
+	SIGHASH_NONE         uint32 = 0x02
+	SIGHASH_SINGLE       uint32 = 0x03
+	SIGHASH_ANYONECANPAY uint32 = 0x80
+)
 
 // MurmurHash3 constants
 const (
@@ -42,6 +50,18 @@ func Hash160(data []byte) []byte {
 	return hasher.Sum(nil)
 }
 
+// TaggedHash is the BIP 340 hash of msgs under tag: SHA256(SHA256(tag) || SHA256(tag) || msgs)
+func TaggedHash(tag string, msgs ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, msg := range msgs {
+		h.Write(msg)
+	}
+	return h.Sum(nil)
+}
+
 func MurmurHash3(data []byte, seed uint32) uint32 {
 	length := len(data)
 	h1 := uint32(seed)
@@ -0,0 +1,71 @@
+package keys
+
+import (
+	"errors"
+	"go-bitcoin/internal/eccmath"
+	"go-bitcoin/internal/encoding"
+	"math/big"
+)
+
+// TAPROOT_TAG_TWEAK is the BIP 341 tag for committing a script tree to an internal key
+const TAPROOT_TAG_TWEAK string = "TapTweak"
+
+var ErrTweakOutOfRange = errors.New("taproot tweak is not below the group order")
+
+// taprootTweak is t = hash_TapTweak(internal || merkleRoot), nil merkleRoot committing to
+// no scripts
+func taprootTweak(group *eccmath.Secp256k1Group, internal, merkleRoot []byte) (*big.Int, error) {
+	t := new(big.Int).SetBytes(encoding.TaggedHash(TAPROOT_TAG_TWEAK, internal, merkleRoot))
+	if t.Cmp(group.N) >= 0 {
+		return nil, ErrTweakOutOfRange
+	}
+	return t, nil
+}
+
+// TweakPublicKey returns the taproot output key Q = P + tG for the x-only internal key P
+// and script tree merkleRoot (nil for a key path only output)
+func TweakPublicKey(internal []byte, merkleRoot []byte) (PublicKey, error) {
+	group := eccmath.NewBitcoin()
+	P, err := group.LiftX(internal)
+	if err != nil {
+		return PublicKey{}, err
+	}
+	t, err := taprootTweak(group, internal, merkleRoot)
+	if err != nil {
+		return PublicKey{}, err
+	}
+	Q, err := P.Point.Add(group.ScalarBaseMultiply(t))
+	if err != nil {
+		return PublicKey{}, err
+	}
+	if Q.IsInf() {
+		return PublicKey{}, errors.New("tweaked taproot key is the point at infinity")
+	}
+	return eccmath.NewS256Point(Q, group), nil
+}
+
+// TweakTaproot returns the private key for the taproot output key committing the key's
+// x-only public key to merkleRoot (nil for a key path only output)
+func (pk *PrivateKey) TweakTaproot(merkleRoot []byte) (*PrivateKey, error) {
+	P := pk.PublicKey()
+	d := new(big.Int).Set(pk.secret)
+	if !P.HasEvenY() {
+		d.Sub(pk.group.N, d)
+	}
+	t, err := taprootTweak(pk.group, P.SerializeXOnly(), merkleRoot)
+	if err != nil {
+		return nil, err
+	}
+	d.Add(d, t)
+	d.Mod(d, pk.group.N)
+	if d.Sign() == 0 {
+		return nil, errors.New("tweaked taproot key is zero")
+	}
+	return &PrivateKey{secret: d, group: pk.group}, nil
+}
+
+// SignSchnorr signs a 32 byte message per BIP 340. auxRand is mixed into the nonce; nil
+// draws fresh randomness.
+func (pk *PrivateKey) SignSchnorr(msg, auxRand []byte) ([]byte, error) {
+	return pk.group.SignSchnorr(pk.secret, msg, auxRand)
+}
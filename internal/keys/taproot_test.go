@@ -0,0 +1,51 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func TestTweakTaproot(t *testing.T) {
+	// BIP 341 wallet test vector: key path only output
+	internal, _ := hex.DecodeString("d6889cb081036e0faefa3a35157ad71086b123b2b144b649798b494c300a961d")
+	want, _ := hex.DecodeString("53a1f6e454df1aa2776a2814a721372d6258050de330b3c6d10ee8f4e0dda343")
+	Q, err := TweakPublicKey(internal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Q.SerializeXOnly(); !bytes.Equal(got, want) {
+		t.Fatalf("output key = %x, want %x", got, want)
+	}
+	t.Logf("✓ Output key matches the BIP 341 vector")
+
+	// the tweaked private key signs for the tweaked public key, whatever the parity
+	for _, secret := range []int64{1, 2, 3, 8675309} {
+		key := NewPrivateKey(big.NewInt(secret))
+		pub := key.PublicKey()
+		merkleRoot := bytes.Repeat([]byte{byte(secret)}, 32)
+
+		tweaked, err := key.TweakTaproot(merkleRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Q, err := TweakPublicKey(pub.SerializeXOnly(), merkleRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tweakedPub := tweaked.PublicKey()
+		if !bytes.Equal(tweakedPub.SerializeXOnly(), Q.SerializeXOnly()) {
+			t.Fatalf("secret %d: tweaked keys disagree", secret)
+		}
+		msg := bytes.Repeat([]byte{0xab}, 32)
+		sig, err := tweaked.SignSchnorr(msg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Q.VerifySchnorr(msg, sig) {
+			t.Fatalf("secret %d: signature did not verify against the output key", secret)
+		}
+	}
+	t.Logf("✓ Tweaked private keys sign for the tweaked output keys")
+}
@@ -6,23 +6,30 @@ import (
 )
 
 type Mempool struct {
-	txs map[[32]byte]*transactions.Transaction // txid -> transaction
-	mu  sync.Mutex
+	txs    map[[32]byte]*transactions.Transaction // txid -> transaction
+	wtxids map[[32]byte][32]byte                  // wtxid -> txid
+	mu     sync.Mutex
 }
 
 func New() *Mempool {
 	return &Mempool{
-		txs: make(map[[32]byte]*transactions.Transaction),
+		txs:    make(map[[32]byte]*transactions.Transaction),
+		wtxids: make(map[[32]byte][32]byte),
 	}
 }
 
 func (m *Mempool) Add(tx *transactions.Transaction) error {
-	txid, err := tx.Hash()
+	txid, err := tx.Txid()
+	if err != nil {
+		return err
+	}
+	wtxid, err := tx.Wtxid()
 	if err != nil {
 		return err
 	}
 	m.mu.Lock()
 	m.txs[txid] = tx
+	m.wtxids[wtxid] = txid
 	m.mu.Unlock()
 	return nil
 }
@@ -34,8 +41,25 @@ func (m *Mempool) Get(txid [32]byte) (*transactions.Transaction, bool) {
 	return tx, exists
 }
 
+// GetByWitnessHash looks up a transaction by wtxid (display order, like Get)
+func (m *Mempool) GetByWitnessHash(wtxid [32]byte) (*transactions.Transaction, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txid, ok := m.wtxids[wtxid]
+	if !ok {
+		return nil, false
+	}
+	tx, exists := m.txs[txid]
+	return tx, exists
+}
+
 func (m *Mempool) Remove(txid [32]byte) {
 	m.mu.Lock()
+	if tx, ok := m.txs[txid]; ok {
+		if wtxid, err := tx.Wtxid(); err == nil {
+			delete(m.wtxids, wtxid)
+		}
+	}
 	delete(m.txs, txid)
 	m.mu.Unlock()
 }
@@ -63,15 +87,15 @@ func (m *Mempool) MatchShortIDs(shortids [][6]byte, k0, k1 uint64, useWtxid bool
 		var hash [32]byte
 		var err error
 		if useWtxid {
-			hash, err = tx.WitnessHash()
+			hash, err = tx.Wtxid()
 		} else {
-			hash, err = tx.Hash()
+			hash, err = tx.Txid()
 		}
 		if err != nil {
 			continue
 		}
 
-		// CRITICAL FIX: Hash() and WitnessHash() return reversed (display order) hashes,
+		// CRITICAL FIX: Txid() and Wtxid() return reversed (display order) hashes,
 		// but BIP152 requires non-reversed (internal little-endian) hashes for SipHash.
 		// We need to reverse it back to its internal representation.
 		hashForSipHash := hash
@@ -0,0 +1,336 @@
+package miniscript
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/script"
+)
+
+var ErrNotSane = errors.New("miniscript is not sane")
+
+// Script compiles the node to the witnessScript it stands for
+func (n *Node) Script() script.Script {
+	return script.NewScript(n.commands())
+}
+
+// verifyForms are the opcodes v: folds its OP_VERIFY into
+var verifyForms = map[byte]byte{
+	script.OP_EQUAL:         script.OP_EQUALVERIFY,
+	script.OP_NUMEQUAL:      script.OP_NUMEQUALVERIFY,
+	script.OP_CHECKSIG:      script.OP_CHECKSIGVERIFY,
+	script.OP_CHECKMULTISIG: script.OP_CHECKMULTISIGVERIFY,
+}
+
+func (n *Node) commands() []script.ScriptCommand {
+	subs := make([][]script.ScriptCommand, len(n.Subs))
+	for i, sub := range n.Subs {
+		subs[i] = sub.commands()
+	}
+	var x, y, z []script.ScriptCommand
+	if len(subs) > 0 {
+		x = subs[0]
+	}
+	if len(subs) > 1 {
+		y = subs[1]
+	}
+	if len(subs) > 2 {
+		z = subs[2]
+	}
+
+	switch n.Fragment {
+	case JUST_0:
+		return ops(script.OP_O)
+	case JUST_1:
+		return ops(script.OP_1)
+	case PK_K:
+		return []script.ScriptCommand{push(n.Keys[0])}
+	case PK_H:
+		return cat(ops(script.OP_DUP, script.OP_HASH160), []script.ScriptCommand{push(encoding.Hash160(n.Keys[0]))},
+			ops(script.OP_EQUALVERIFY))
+	case OLDER:
+		return cat(num(int64(n.K)), ops(script.OP_CHECKSEQUENCEVERIFY))
+	case AFTER:
+		return cat(num(int64(n.K)), ops(script.OP_CHECKLOCKTIMEVERIFY))
+	case SHA256, HASH256, RIPEMD160, HASH160:
+		hashOp := map[Fragment]byte{SHA256: script.OP_SHA256, HASH256: script.OP_HASH256,
+			RIPEMD160: script.OP_RIPEMD160, HASH160: script.OP_HASH160}[n.Fragment]
+		// the preimage is always 32 bytes, so it can't be swapped for another length
+		return cat(ops(script.OP_SIZE), num(32), ops(script.OP_EQUALVERIFY, hashOp),
+			[]script.ScriptCommand{push(n.Hash)}, ops(script.OP_EQUAL))
+
+	case WRAP_A:
+		return cat(ops(script.OP_TOALSTACK), x, ops(script.OP_FROMALTSTACK))
+	case WRAP_S:
+		return cat(ops(script.OP_SWAP), x)
+	case WRAP_C:
+		return cat(x, ops(script.OP_CHECKSIG))
+	case WRAP_D:
+		return cat(ops(script.OP_DUP, script.OP_IF), x, ops(script.OP_ENDIF))
+	case WRAP_V:
+		if last := len(x) - 1; !n.Subs[0].typ.Has(PROP_X) && !x[last].IsData {
+			if verify, ok := verifyForms[x[last].Opcode]; ok {
+				x[last] = script.ScriptCommand{Opcode: verify}
+				return x
+			}
+		}
+		return cat(x, ops(script.OP_VERIFY))
+	case WRAP_J:
+		return cat(ops(script.OP_SIZE, script.OP_0NOTEQUAL, script.OP_IF), x, ops(script.OP_ENDIF))
+	case WRAP_N:
+		return cat(x, ops(script.OP_0NOTEQUAL))
+
+	case AND_V:
+		return cat(x, y)
+	case AND_B:
+		return cat(x, y, ops(script.OP_BOOLAND))
+	case OR_B:
+		return cat(x, y, ops(script.OP_BOOLOR))
+	case OR_C:
+		return cat(x, ops(script.OP_NOTIF), y, ops(script.OP_ENDIF))
+	case OR_D:
+		return cat(x, ops(script.OP_IFDUP, script.OP_NOTIF), y, ops(script.OP_ENDIF))
+	case OR_I:
+		return cat(ops(script.OP_IF), x, ops(script.OP_ELSE), y, ops(script.OP_ENDIF))
+	case ANDOR:
+		return cat(x, ops(script.OP_NOTIF), z, ops(script.OP_ELSE), y, ops(script.OP_ENDIF))
+	case THRESH:
+		cmds := x
+		for _, sub := range subs[1:] {
+			cmds = cat(cmds, sub, ops(script.OP_ADD))
+		}
+		return cat(cmds, num(int64(n.K)), ops(script.OP_EQUAL))
+	case MULTI:
+		cmds := num(int64(n.K))
+		for _, key := range n.Keys {
+			cmds = append(cmds, push(key))
+		}
+		return cat(cmds, num(int64(len(n.Keys))), ops(script.OP_CHECKMULTISIG))
+	}
+	return nil
+}
+
+func ops(opcodes ...byte) []script.ScriptCommand {
+	cmds := make([]script.ScriptCommand, len(opcodes))
+	for i, op := range opcodes {
+		cmds[i] = script.ScriptCommand{Opcode: op}
+	}
+	return cmds
+}
+
+func push(data []byte) script.ScriptCommand {
+	return script.ScriptCommand{Data: data, IsData: true}
+}
+
+// num pushes n the shortest way: OP_0 to OP_16, or its script number
+func num(n int64) []script.ScriptCommand {
+	switch {
+	case n == 0:
+		return ops(script.OP_O)
+	case n >= 1 && n <= 16:
+		return ops(script.OP_1 + byte(n-1))
+	}
+	return []script.ScriptCommand{push(script.EncodeNum(n))}
+}
+
+func cat(parts ...[]script.ScriptCommand) []script.ScriptCommand {
+	var cmds []script.ScriptCommand
+	for _, part := range parts {
+		cmds = append(cmds, part...)
+	}
+	return cmds
+}
+
+// opsCount bounds the opcodes the script engine counts against MAX_OPS_PER_SCRIPT on any
+// run: every opcode above OP_16, executed or not, and the keys of the OP_CHECKMULTISIGs
+// that can execute together
+func (n *Node) opsCount() int {
+	count := 0
+	for _, cmd := range n.commands() {
+		if !cmd.IsData && cmd.Opcode > script.OP_16 {
+			count++
+		}
+	}
+	return count + n.multisigKeys()
+}
+
+func (n *Node) multisigKeys() int {
+	switch n.Fragment {
+	case MULTI:
+		return len(n.Keys)
+	case OR_I:
+		return max(n.Subs[0].multisigKeys(), n.Subs[1].multisigKeys())
+	case ANDOR:
+		return n.Subs[0].multisigKeys() + max(n.Subs[1].multisigKeys(), n.Subs[2].multisigKeys())
+	}
+	keys := 0
+	for _, sub := range n.Subs {
+		keys += sub.multisigKeys()
+	}
+	return keys
+}
+
+// witnessSize bounds the stack items a satisfaction or dissatisfaction takes and their
+// serialized size, with ok false when there is none
+type witnessSize struct {
+	ok          bool
+	items, size int
+}
+
+func (a witnessSize) plus(b witnessSize) witnessSize {
+	return witnessSize{a.ok && b.ok, a.items + b.items, a.size + b.size}
+}
+
+func largest(a, b witnessSize) witnessSize {
+	switch {
+	case !a.ok:
+		return b
+	case !b.ok:
+		return a
+	}
+	return witnessSize{true, max(a.items, b.items), max(a.size, b.size)}
+}
+
+// witness sizes of single items, each with its length byte
+var (
+	noWitness    = witnessSize{}
+	emptyWitness = witnessSize{ok: true}
+	zeroItem     = witnessSize{true, 1, 1}
+	oneItem      = witnessSize{true, 1, 2}
+	sigItem      = witnessSize{true, 1, 1 + MAX_SIG_SIZE}
+	keyItem      = witnessSize{true, 1, 1 + PUBKEY_SIZE}
+	preimageItem = witnessSize{true, 1, 1 + PREIMAGE_SIZE}
+)
+
+// maxWitness bounds n's canonical satisfactions and dissatisfactions, the ones Satisfy
+// can produce
+func (n *Node) maxWitness() (sat, dsat witnessSize) {
+	subs := make([][2]witnessSize, len(n.Subs))
+	for i, sub := range n.Subs {
+		subs[i][0], subs[i][1] = sub.maxWitness()
+	}
+	var x, y, z [2]witnessSize
+	if len(subs) > 0 {
+		x = subs[0]
+	}
+	if len(subs) > 1 {
+		y = subs[1]
+	}
+	if len(subs) > 2 {
+		z = subs[2]
+	}
+
+	switch n.Fragment {
+	case JUST_0:
+		return noWitness, emptyWitness
+	case JUST_1, OLDER, AFTER:
+		return emptyWitness, noWitness
+	case PK_K:
+		return sigItem, zeroItem
+	case PK_H:
+		return sigItem.plus(keyItem), zeroItem.plus(keyItem)
+	case SHA256, HASH256, RIPEMD160, HASH160:
+		return preimageItem, preimageItem
+	case MULTI:
+		k := int(n.K)
+		return witnessSize{true, k + 1, 1 + k*(1+MAX_SIG_SIZE)}, witnessSize{true, k + 1, k + 1}
+	case WRAP_A, WRAP_S, WRAP_C, WRAP_N:
+		return x[0], x[1]
+	case WRAP_D:
+		return x[0].plus(oneItem), zeroItem
+	case WRAP_V:
+		return x[0], noWitness
+	case WRAP_J:
+		return x[0], zeroItem
+	case AND_V:
+		return y[0].plus(x[0]), noWitness
+	case AND_B:
+		return y[0].plus(x[0]), y[1].plus(x[1])
+	case OR_B:
+		return largest(y[1].plus(x[0]), y[0].plus(x[1])), y[1].plus(x[1])
+	case OR_C:
+		return largest(x[0], y[0].plus(x[1])), noWitness
+	case OR_D:
+		return largest(x[0], y[0].plus(x[1])), y[1].plus(x[1])
+	case OR_I:
+		return largest(x[0].plus(oneItem), y[0].plus(zeroItem)), largest(x[1].plus(oneItem), y[1].plus(zeroItem))
+	case ANDOR:
+		return largest(y[0].plus(x[0]), z[0].plus(x[1])), z[1].plus(x[1])
+	case THRESH:
+		// sats[j] bounds satisfying j of the subexpressions seen so far
+		sats := []witnessSize{emptyWitness}
+		for _, sub := range subs {
+			sat, dsat := sub[0], sub[1]
+			next := []witnessSize{sats[0].plus(dsat)}
+			for j := 1; j < len(sats); j++ {
+				next = append(next, largest(sats[j].plus(dsat), sats[j-1].plus(sat)))
+			}
+			sats = append(next, sats[len(sats)-1].plus(sat))
+		}
+		return sats[n.K], sats[0]
+	}
+	return noWitness, noWitness
+}
+
+// MaxSatisfaction bounds the witness a satisfaction needs: its stack items and their
+// serialized size, not counting the witnessScript. ok is false if the node can never be
+// satisfied.
+func (n *Node) MaxSatisfaction() (items, size int, ok bool) {
+	sat, _ := n.maxWitness()
+	return sat.items, sat.size, sat.ok
+}
+
+// CheckSane checks that the node is safe to pay to in P2WSH: it's of type B, every
+// satisfaction needs a signature and none can be malleated, it mixes no timelocks it
+// can't satisfy together, it repeats no key, and its script and witness stay within the
+// consensus and relay limits
+func (n *Node) CheckSane() error {
+	sat, _ := n.maxWitness()
+	witnessScript := n.Script()
+	raw, err := witnessScript.RawBytes()
+	if err != nil {
+		return err
+	}
+	switch {
+	case !n.typ.Has(TYPE_B):
+		return fmt.Errorf("%w: type %s is not B", ErrNotSane, n.typ)
+	case !sat.ok:
+		return fmt.Errorf("%w: it can never be satisfied", ErrNotSane)
+	case !n.typ.Has(PROP_S):
+		return fmt.Errorf("%w: it can be satisfied without a signature", ErrNotSane)
+	case !n.typ.Has(PROP_M):
+		return fmt.Errorf("%w: it has no nonmalleable satisfaction", ErrNotSane)
+	case !n.typ.Has(PROP_K):
+		return fmt.Errorf("%w: it mixes height and time locks", ErrNotSane)
+	case n.hasDuplicateKey():
+		return fmt.Errorf("%w: it repeats a key", ErrNotSane)
+	case len(raw) > MAX_STANDARD_P2WSH_SCRIPT_SIZE:
+		return fmt.Errorf("%w: %d byte script exceeds %d", ErrNotSane, len(raw), MAX_STANDARD_P2WSH_SCRIPT_SIZE)
+	case n.opsCount() > MAX_OPS_PER_SCRIPT:
+		return fmt.Errorf("%w: up to %d opcodes exceeds %d", ErrNotSane, n.opsCount(), MAX_OPS_PER_SCRIPT)
+	case sat.items > MAX_STANDARD_P2WSH_STACK_ITEMS:
+		return fmt.Errorf("%w: up to %d witness items exceeds %d", ErrNotSane, sat.items, MAX_STANDARD_P2WSH_STACK_ITEMS)
+	}
+	return nil
+}
+
+func (n *Node) hasDuplicateKey() bool {
+	var keys [][]byte
+	var collect func(*Node)
+	collect = func(n *Node) {
+		keys = append(keys, n.Keys...)
+		for _, sub := range n.Subs {
+			collect(sub)
+		}
+	}
+	collect(n)
+	for i := range keys {
+		for j := i + 1; j < len(keys); j++ {
+			if bytes.Equal(keys[i], keys[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
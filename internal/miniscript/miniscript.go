@@ -0,0 +1,488 @@
+// Package miniscript implements Miniscript for P2WSH: a structured subset of Script
+// whose expressions, such as and_v(v:pk(K1),or_d(pk(K2),older(144))), can be typed,
+// compiled to a witnessScript, checked for malleability and satisfied mechanically.
+package miniscript
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Fragment is the kind of a miniscript node. Aliases such as pk, t: and and_n are parsed
+// into the fragments they stand for.
+type Fragment int
+
+const (
+	JUST_0    Fragment = iota // 0
+	JUST_1                    // 1
+	PK_K                      // pk_k(key): <key>
+	PK_H                      // pk_h(key): OP_DUP OP_HASH160 <HASH160(key)> OP_EQUALVERIFY
+	OLDER                     // older(n): <n> OP_CHECKSEQUENCEVERIFY
+	AFTER                     // after(n): <n> OP_CHECKLOCKTIMEVERIFY
+	SHA256                    // sha256(h): OP_SIZE <32> OP_EQUALVERIFY OP_SHA256 <h> OP_EQUAL
+	HASH256                   // hash256(h): OP_SIZE <32> OP_EQUALVERIFY OP_HASH256 <h> OP_EQUAL
+	RIPEMD160                 // ripemd160(h): OP_SIZE <32> OP_EQUALVERIFY OP_RIPEMD160 <h> OP_EQUAL
+	HASH160                   // hash160(h): OP_SIZE <32> OP_EQUALVERIFY OP_HASH160 <h> OP_EQUAL
+	WRAP_A                    // a:X: OP_TOALTSTACK [X] OP_FROMALTSTACK
+	WRAP_S                    // s:X: OP_SWAP [X]
+	WRAP_C                    // c:X: [X] OP_CHECKSIG
+	WRAP_D                    // d:X: OP_DUP OP_IF [X] OP_ENDIF
+	WRAP_V                    // v:X: [X] OP_VERIFY, or its last opcode's VERIFY form
+	WRAP_J                    // j:X: OP_SIZE OP_0NOTEQUAL OP_IF [X] OP_ENDIF
+	WRAP_N                    // n:X: [X] OP_0NOTEQUAL
+	AND_V                     // and_v(X,Y): [X] [Y]
+	AND_B                     // and_b(X,Y): [X] [Y] OP_BOOLAND
+	OR_B                      // or_b(X,Z): [X] [Z] OP_BOOLOR
+	OR_C                      // or_c(X,Z): [X] OP_NOTIF [Z] OP_ENDIF
+	OR_D                      // or_d(X,Z): [X] OP_IFDUP OP_NOTIF [Z] OP_ENDIF
+	OR_I                      // or_i(X,Z): OP_IF [X] OP_ELSE [Z] OP_ENDIF
+	ANDOR                     // andor(X,Y,Z): [X] OP_NOTIF [Z] OP_ELSE [Y] OP_ENDIF
+	THRESH                    // thresh(k,X1,...,Xn): [X1] [X2] OP_ADD ... [Xn] OP_ADD <k> OP_EQUAL
+	MULTI                     // multi(k,key1,...,keyn): <k> <key1> ... <keyn> <n> OP_CHECKMULTISIG
+)
+
+var fragmentNames = map[Fragment]string{
+	JUST_0: "0", JUST_1: "1", PK_K: "pk_k", PK_H: "pk_h", OLDER: "older", AFTER: "after",
+	SHA256: "sha256", HASH256: "hash256", RIPEMD160: "ripemd160", HASH160: "hash160",
+	WRAP_A: "a", WRAP_S: "s", WRAP_C: "c", WRAP_D: "d", WRAP_V: "v", WRAP_J: "j", WRAP_N: "n",
+	AND_V: "and_v", AND_B: "and_b", OR_B: "or_b", OR_C: "or_c", OR_D: "or_d", OR_I: "or_i",
+	ANDOR: "andor", THRESH: "thresh", MULTI: "multi",
+}
+
+func (f Fragment) String() string {
+	if name, ok := fragmentNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Fragment(%d)", int(f))
+}
+
+// P2WSH limits a miniscript is held to, by consensus or by relay policy
+const (
+	MAX_PUBKEYS_PER_MULTISIG       int    = 20
+	MAX_OPS_PER_SCRIPT             int    = 201
+	MAX_STANDARD_P2WSH_SCRIPT_SIZE int    = 3600
+	MAX_STANDARD_P2WSH_STACK_ITEMS int    = 100
+	MAX_TIMELOCK                   uint32 = 1<<31 - 1
+	PUBKEY_SIZE                    int    = 33 // P2WSH policy only relays compressed keys
+	SHA256_SIZE                    int    = 32 // the hash opened by sha256 and hash256
+	HASH160_SIZE                   int    = 20 // the hash opened by ripemd160 and hash160
+)
+
+// BIP 65 and BIP 68 lock encodings, as the transactions package has them
+const (
+	locktimeThreshold    uint32 = 500_000_000 // after: below are heights, at or above times
+	sequenceTypeFlag     uint32 = 1 << 22     // older: set for time, clear for height
+	sequenceDisableFlag  uint32 = 1 << 31
+	sequenceLocktimeMask uint32 = 0x0000ffff
+)
+
+var (
+	ErrInvalidMiniscript = errors.New("invalid miniscript")
+	ErrMiniscriptType    = errors.New("miniscript type error")
+)
+
+// Node is a miniscript expression. K is the threshold of THRESH and MULTI or the lock of
+// OLDER and AFTER, Keys the keys of PK_K, PK_H and MULTI, and Hash the digest a hash
+// fragment opens. Nodes are built by Parse or NewNode, which type them.
+type Node struct {
+	Fragment Fragment
+	K        uint32
+	Keys     [][]byte
+	Hash     []byte
+	Subs     []*Node
+	typ      Type
+}
+
+// NewNode builds a node from its parts, checking their number and ranges and that the
+// subexpressions have the types the fragment takes
+func NewNode(fragment Fragment, k uint32, keys [][]byte, hash []byte, subs ...*Node) (*Node, error) {
+	n := &Node{Fragment: fragment, K: k, Keys: keys, Hash: hash, Subs: subs}
+	if err := n.checkArgs(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidMiniscript, fragment, err)
+	}
+	n.typ = computeType(n)
+	if !n.typ.valid() {
+		return nil, fmt.Errorf("%w: %s", ErrMiniscriptType, n)
+	}
+	return n, nil
+}
+
+func (n *Node) checkArgs() error {
+	want := 0
+	switch n.Fragment {
+	case WRAP_A, WRAP_S, WRAP_C, WRAP_D, WRAP_V, WRAP_J, WRAP_N:
+		want = 1
+	case AND_V, AND_B, OR_B, OR_C, OR_D, OR_I:
+		want = 2
+	case ANDOR:
+		want = 3
+	case THRESH:
+		if n.K < 1 || int(n.K) > len(n.Subs) {
+			return fmt.Errorf("threshold %d of %d", n.K, len(n.Subs))
+		}
+		want = len(n.Subs)
+	}
+	if len(n.Subs) != want {
+		return fmt.Errorf("%d subexpressions, want %d", len(n.Subs), want)
+	}
+	for _, sub := range n.Subs {
+		if sub == nil {
+			return errors.New("missing subexpression")
+		}
+	}
+
+	wantKeys := 0
+	switch n.Fragment {
+	case PK_K, PK_H:
+		wantKeys = 1
+	case MULTI:
+		if len(n.Keys) < 1 || len(n.Keys) > MAX_PUBKEYS_PER_MULTISIG || n.K < 1 || int(n.K) > len(n.Keys) {
+			return fmt.Errorf("threshold %d of %d keys", n.K, len(n.Keys))
+		}
+		wantKeys = len(n.Keys)
+	}
+	if len(n.Keys) != wantKeys {
+		return fmt.Errorf("%d keys, want %d", len(n.Keys), wantKeys)
+	}
+	for _, key := range n.Keys {
+		if len(key) != PUBKEY_SIZE || key[0] != 0x02 && key[0] != 0x03 {
+			return fmt.Errorf("key %x is not a compressed public key", key)
+		}
+	}
+
+	switch n.Fragment {
+	case OLDER, AFTER:
+		if n.K < 1 || n.K > MAX_TIMELOCK {
+			return fmt.Errorf("timelock %d out of range", n.K)
+		}
+	case SHA256, HASH256:
+		if len(n.Hash) != SHA256_SIZE {
+			return fmt.Errorf("%d byte hash, want %d", len(n.Hash), SHA256_SIZE)
+		}
+	case RIPEMD160, HASH160:
+		if len(n.Hash) != HASH160_SIZE {
+			return fmt.Errorf("%d byte hash, want %d", len(n.Hash), HASH160_SIZE)
+		}
+	}
+	return nil
+}
+
+// Type returns the node's type: its basic type, and the properties that say how it
+// consumes the stack, how it can be satisfied, and which timelocks it uses
+func (n *Node) Type() Type {
+	return n.typ
+}
+
+// Parse reads a miniscript expression, such as or_d(pk(K1),and_v(v:pk(K2),older(144)))
+// with keys as hex compressed public keys and hashes in hex. The aliases pk(K) = c:pk_k(K),
+// pkh(K) = c:pk_h(K), and_n(X,Y) = andor(X,Y,0), t:X = and_v(X,1), l:X = or_i(0,X) and
+// u:X = or_i(X,0) are accepted. Every subexpression must type check, and the whole must
+// be of type B.
+func Parse(s string) (*Node, error) {
+	p := &parser{s: s}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(s) {
+		return nil, p.errorf("trailing %q", s[p.pos:])
+	}
+	if !n.typ.Has(TYPE_B) {
+		return nil, fmt.Errorf("%w: top level is %s, not B", ErrMiniscriptType, n.typ)
+	}
+	return n, nil
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: at %d: %s", ErrInvalidMiniscript, p.pos, fmt.Sprintf(format, args...))
+}
+
+// expr reads an expression, with any wrappers before a colon applied innermost last
+func (p *parser) expr() (*Node, error) {
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] >= 'a' && p.s[p.pos] <= 'z' {
+		p.pos++
+	}
+	if p.pos < len(p.s) && p.s[p.pos] == ':' {
+		wrappers := p.s[start:p.pos]
+		p.pos++
+		if wrappers == "" {
+			return nil, p.errorf("empty wrapper")
+		}
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		for i := len(wrappers) - 1; i >= 0; i-- {
+			if n, err = wrap(wrappers[i], n); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	}
+	p.pos = start
+
+	name := p.token()
+	switch name {
+	case "0":
+		return NewNode(JUST_0, 0, nil, nil)
+	case "1":
+		return NewNode(JUST_1, 0, nil, nil)
+	case "":
+		return nil, p.errorf("missing expression")
+	}
+	if !p.consume('(') {
+		return nil, p.errorf("expected ( after %q", name)
+	}
+	var n *Node
+	var err error
+	switch name {
+	case "pk", "pkh", "pk_k", "pk_h":
+		var key []byte
+		if key, err = p.hexArg(); err != nil {
+			return nil, err
+		}
+		frag := PK_K
+		if name == "pkh" || name == "pk_h" {
+			frag = PK_H
+		}
+		if n, err = NewNode(frag, 0, [][]byte{key}, nil); err == nil && (name == "pk" || name == "pkh") {
+			n, err = NewNode(WRAP_C, 0, nil, nil, n)
+		}
+	case "older", "after":
+		var k uint32
+		if k, err = p.numArg(); err != nil {
+			return nil, err
+		}
+		frag := OLDER
+		if name == "after" {
+			frag = AFTER
+		}
+		n, err = NewNode(frag, k, nil, nil)
+	case "sha256", "hash256", "ripemd160", "hash160":
+		var hash []byte
+		if hash, err = p.hexArg(); err != nil {
+			return nil, err
+		}
+		frag := map[string]Fragment{"sha256": SHA256, "hash256": HASH256, "ripemd160": RIPEMD160, "hash160": HASH160}[name]
+		n, err = NewNode(frag, 0, nil, hash)
+	case "and_v", "and_b", "and_n", "or_b", "or_c", "or_d", "or_i", "andor":
+		want := 2
+		if name == "andor" {
+			want = 3
+		}
+		var subs []*Node
+		if subs, err = p.exprArgs(want); err != nil {
+			return nil, err
+		}
+		n, err = binary(name, subs)
+	case "thresh":
+		var k uint32
+		if k, err = p.numArg(); err != nil {
+			return nil, err
+		}
+		if !p.consume(',') {
+			return nil, p.errorf("thresh needs subexpressions")
+		}
+		var subs []*Node
+		if subs, err = p.exprArgs(-1); err != nil {
+			return nil, err
+		}
+		n, err = NewNode(THRESH, k, nil, nil, subs...)
+	case "multi":
+		var k uint32
+		if k, err = p.numArg(); err != nil {
+			return nil, err
+		}
+		var keys [][]byte
+		for p.consume(',') {
+			var key []byte
+			if key, err = p.hexArg(); err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		n, err = NewNode(MULTI, k, keys, nil)
+	default:
+		return nil, p.errorf("unknown fragment %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !p.consume(')') {
+		return nil, p.errorf("expected ) closing %s", name)
+	}
+	return n, nil
+}
+
+// exprArgs reads want comma separated expressions, or as many as there are if want is -1,
+// stopping before the closing parenthesis
+func (p *parser) exprArgs(want int) ([]*Node, error) {
+	var subs []*Node
+	for {
+		sub, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+		if len(subs) == want || !p.consume(',') {
+			break
+		}
+	}
+	if want >= 0 && len(subs) != want {
+		return nil, p.errorf("%d arguments, want %d", len(subs), want)
+	}
+	return subs, nil
+}
+
+func binary(name string, subs []*Node) (*Node, error) {
+	switch name {
+	case "and_n":
+		zero, _ := NewNode(JUST_0, 0, nil, nil)
+		return NewNode(ANDOR, 0, nil, nil, subs[0], subs[1], zero)
+	case "andor":
+		return NewNode(ANDOR, 0, nil, nil, subs...)
+	}
+	frag := map[string]Fragment{"and_v": AND_V, "and_b": AND_B, "or_b": OR_B, "or_c": OR_C, "or_d": OR_D, "or_i": OR_I}[name]
+	return NewNode(frag, 0, nil, nil, subs...)
+}
+
+// wrap applies the wrapper letter w to n
+func wrap(w byte, n *Node) (*Node, error) {
+	switch w {
+	case 'a':
+		return NewNode(WRAP_A, 0, nil, nil, n)
+	case 's':
+		return NewNode(WRAP_S, 0, nil, nil, n)
+	case 'c':
+		return NewNode(WRAP_C, 0, nil, nil, n)
+	case 'd':
+		return NewNode(WRAP_D, 0, nil, nil, n)
+	case 'v':
+		return NewNode(WRAP_V, 0, nil, nil, n)
+	case 'j':
+		return NewNode(WRAP_J, 0, nil, nil, n)
+	case 'n':
+		return NewNode(WRAP_N, 0, nil, nil, n)
+	case 't':
+		one, _ := NewNode(JUST_1, 0, nil, nil)
+		return NewNode(AND_V, 0, nil, nil, n, one)
+	case 'l':
+		zero, _ := NewNode(JUST_0, 0, nil, nil)
+		return NewNode(OR_I, 0, nil, nil, zero, n)
+	case 'u':
+		zero, _ := NewNode(JUST_0, 0, nil, nil)
+		return NewNode(OR_I, 0, nil, nil, n, zero)
+	}
+	return nil, fmt.Errorf("%w: unknown wrapper %q", ErrInvalidMiniscript, w)
+}
+
+// token reads a fragment name or argument, up to the next parenthesis or comma
+func (p *parser) token() string {
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune("(),", rune(p.s[p.pos])) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *parser) consume(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) hexArg() ([]byte, error) {
+	token := p.token()
+	data, err := hex.DecodeString(token)
+	if err != nil || len(data) == 0 {
+		return nil, p.errorf("bad hex %q", token)
+	}
+	return data, nil
+}
+
+// numArg reads a decimal number, written without a sign or leading zeros
+func (p *parser) numArg() (uint32, error) {
+	token := p.token()
+	n, err := strconv.ParseUint(token, 10, 32)
+	if err != nil || len(token) > 1 && token[0] == '0' {
+		return 0, p.errorf("bad number %q", token)
+	}
+	return uint32(n), nil
+}
+
+// String writes the node as Parse reads it, using the aliases where they apply and
+// running wrapper letters together, as in vc:pk_k(K)
+func (n *Node) String() string {
+	var wrappers strings.Builder
+	for {
+		switch {
+		case n.Fragment == WRAP_C && (n.Subs[0].Fragment == PK_K || n.Subs[0].Fragment == PK_H):
+			// written as pk or pkh below
+		case n.Fragment >= WRAP_A && n.Fragment <= WRAP_N:
+			wrappers.WriteString(n.Fragment.String())
+			n = n.Subs[0]
+			continue
+		case n.Fragment == AND_V && n.Subs[1].Fragment == JUST_1:
+			wrappers.WriteByte('t')
+			n = n.Subs[0]
+			continue
+		case n.Fragment == OR_I && n.Subs[0].Fragment == JUST_0:
+			wrappers.WriteByte('l')
+			n = n.Subs[1]
+			continue
+		case n.Fragment == OR_I && n.Subs[1].Fragment == JUST_0:
+			wrappers.WriteByte('u')
+			n = n.Subs[0]
+			continue
+		}
+		break
+	}
+	if wrappers.Len() > 0 {
+		return wrappers.String() + ":" + n.base()
+	}
+	return n.base()
+}
+
+// base writes a node that isn't a wrapper
+func (n *Node) base() string {
+	args := make([]string, 0, len(n.Subs)+len(n.Keys)+1)
+	switch n.Fragment {
+	case JUST_0, JUST_1:
+		return n.Fragment.String()
+	case WRAP_C:
+		name := "pk"
+		if n.Subs[0].Fragment == PK_H {
+			name = "pkh"
+		}
+		return name + "(" + hex.EncodeToString(n.Subs[0].Keys[0]) + ")"
+	case OLDER, AFTER:
+		args = append(args, strconv.FormatUint(uint64(n.K), 10))
+	case SHA256, HASH256, RIPEMD160, HASH160:
+		args = append(args, hex.EncodeToString(n.Hash))
+	case THRESH, MULTI:
+		args = append(args, strconv.FormatUint(uint64(n.K), 10))
+	}
+	for _, key := range n.Keys {
+		args = append(args, hex.EncodeToString(key))
+	}
+	name := n.Fragment.String()
+	subs := n.Subs
+	if n.Fragment == ANDOR && subs[2].Fragment == JUST_0 {
+		name, subs = "and_n", subs[:2]
+	}
+	for _, sub := range subs {
+		args = append(args, sub.String())
+	}
+	return name + "(" + strings.Join(args, ",") + ")"
+}
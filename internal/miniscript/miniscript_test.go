@@ -0,0 +1,168 @@
+package miniscript
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"math/big"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// testKeys are the private keys behind K1, K2, ... in test expressions
+var testKeys = func() []*keys.PrivateKey {
+	var ks []*keys.PrivateKey
+	for i := 1; i <= 3; i++ {
+		ks = append(ks, keys.NewPrivateKey(big.NewInt(int64(2386+i))))
+	}
+	return ks
+}()
+
+func testPubKey(i int) []byte {
+	pub := testKeys[i-1].PublicKey()
+	return pub.Serialize(true)
+}
+
+var testPreimage = []byte(strings.Repeat("miniscript", 4)[:32])
+
+var placeholders = regexp.MustCompile(`\b(K1|K2|K3|H|HK1)\b`)
+
+// expand replaces the words K1, K2 and K3, H (the sha256 of testPreimage) and HK1 (K1's
+// hash160) with their hex
+func expand(s string) string {
+	return placeholders.ReplaceAllStringFunc(s, func(word string) string {
+		switch word {
+		case "H":
+			h := sha256.Sum256(testPreimage)
+			return hex.EncodeToString(h[:])
+		case "HK1":
+			return hex.EncodeToString(encoding.Hash160(testPubKey(1)))
+		}
+		return hex.EncodeToString(testPubKey(int(word[1] - '0')))
+	})
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		ms    string
+		asm   string
+		props string // properties the type must have
+		sane  bool
+	}{
+		{"pk(K1)", "K1 OP_CHECKSIG", "Bondues", true},
+		{"pkh(K1)", "OP_DUP OP_HASH160 HK1 OP_EQUALVERIFY OP_CHECKSIG", "Bndues", true},
+		{"and_v(v:pk(K1),pk(K2))", "K1 OP_CHECKSIGVERIFY K2 OP_CHECKSIG", "Bnusm", true},
+		{"multi(2,K1,K2,K3)", "2 K1 K2 K3 3 OP_CHECKMULTISIG", "Bnudems", true},
+		{"or_d(pk(K1),and_v(v:pk(K2),older(144)))",
+			"K1 OP_CHECKSIG OP_IFDUP OP_NOTIF K2 OP_CHECKSIGVERIFY 144 OP_CHECKSEQUENCEVERIFY OP_ENDIF", "Bsm", true},
+		{"andor(pk(K1),older(1008),pk(K2))",
+			"K1 OP_CHECKSIG OP_NOTIF K2 OP_CHECKSIG OP_ELSE 1008 OP_CHECKSEQUENCEVERIFY OP_ENDIF", "Bdsm", true},
+		{"and_n(pk(K1),sha256(H))",
+			"K1 OP_CHECKSIG OP_NOTIF 0 OP_ELSE OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 H OP_EQUAL OP_ENDIF", "Bdusm", true},
+		{"and_v(v:sha256(H),pk(K1))",
+			"OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 H OP_EQUALVERIFY K1 OP_CHECKSIG", "Bnusm", true},
+		{"or_b(pk(K1),a:pk(K2))",
+			"K1 OP_CHECKSIG OP_TOALTSTACK K2 OP_CHECKSIG OP_FROMALTSTACK OP_BOOLOR", "Bduesm", true},
+		{"t:or_c(pk(K1),v:pk(K2))", "K1 OP_CHECKSIG OP_NOTIF K2 OP_CHECKSIGVERIFY OP_ENDIF 1", "Bus", true},
+		{"thresh(2,pk(K1),s:pk(K2),sln:older(12960))",
+			"K1 OP_CHECKSIG OP_SWAP K2 OP_CHECKSIG OP_ADD OP_SWAP OP_IF 0 OP_ELSE 12960 OP_CHECKSEQUENCEVERIFY " +
+				"OP_0NOTEQUAL OP_ENDIF OP_ADD 2 OP_EQUAL", "Bdums", true},
+		{"and_v(v:pk(K1),or_i(sha256(H),older(10)))",
+			"K1 OP_CHECKSIGVERIFY OP_IF OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 H OP_EQUAL OP_ELSE 10 OP_CHECKSEQUENCEVERIFY OP_ENDIF",
+			"Bs", false},
+		{"sha256(H)", "OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 H OP_EQUAL", "Bondum", false},
+		{"and_v(v:pk(K1),pk(K1))", "K1 OP_CHECKSIGVERIFY K1 OP_CHECKSIG", "Bnusm", false},
+		{"and_v(v:pk(K1),and_b(after(100),a:after(500000001)))",
+			"K1 OP_CHECKSIGVERIFY 100 OP_CHECKLOCKTIMEVERIFY OP_TOALTSTACK 500000001 OP_CHECKLOCKTIMEVERIFY " +
+				"OP_FROMALTSTACK OP_BOOLAND", "Bsij", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ms, func(t *testing.T) {
+			n, err := Parse(expand(tt.ms))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := n.String(); got != expand(tt.ms) {
+				t.Errorf("String() = %s, want %s", got, expand(tt.ms))
+			}
+			witnessScript := n.Script()
+			if got := witnessScript.Disasm(); got != expand(tt.asm) {
+				t.Errorf("script = %s\nwant %s", got, expand(tt.asm))
+			}
+			if !n.Type().Has(props(tt.props)) {
+				t.Errorf("type %s, want %s", n.Type(), tt.props)
+			}
+			if err := n.CheckSane(); (err == nil) != tt.sane {
+				t.Errorf("CheckSane() = %v, want sane %v", err, tt.sane)
+			}
+			t.Logf("✓ %s: %s", tt.ms, n.Type())
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		ms   string
+		want error
+	}{
+		{"pk(K1", ErrInvalidMiniscript},
+		{"pk(K1)x", ErrInvalidMiniscript},
+		{"pk(0211)", ErrInvalidMiniscript},
+		{"x:pk(K1)", ErrInvalidMiniscript},
+		{":pk(K1)", ErrInvalidMiniscript},
+		{"foo(K1)", ErrInvalidMiniscript},
+		{"older(0)", ErrInvalidMiniscript},
+		{"after(2147483648)", ErrInvalidMiniscript},
+		{"older(010)", ErrInvalidMiniscript},
+		{"sha256(00)", ErrInvalidMiniscript},
+		{"multi(3,K1,K2)", ErrInvalidMiniscript},
+		{"thresh(0,pk(K1))", ErrInvalidMiniscript},
+		{"and_v(pk(K1))", ErrInvalidMiniscript},
+		{"v:pk(K1)", ErrMiniscriptType},
+		{"pk_k(K1)", ErrMiniscriptType},
+		{"and_b(pk(K1),pk(K2))", ErrMiniscriptType},
+		{"d:pk(K1)", ErrMiniscriptType},
+		{"or_d(older(1),pk(K1))", ErrMiniscriptType},
+		{"thresh(1,pk(K1),pk(K2))", ErrMiniscriptType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ms, func(t *testing.T) {
+			_, err := Parse(expand(tt.ms))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.ms, err)
+		})
+	}
+}
+
+func TestMaxSatisfaction(t *testing.T) {
+	tests := []struct {
+		ms          string
+		items, size int
+	}{
+		{"pk(K1)", 1, 74},
+		{"pkh(K1)", 2, 108},
+		{"multi(2,K1,K2,K3)", 3, 149},
+		{"or_d(pk(K1),and_v(v:pk(K2),older(144)))", 2, 75},
+		{"and_n(pk(K1),sha256(H))", 2, 107},
+	}
+	for _, tt := range tests {
+		n, err := Parse(expand(tt.ms))
+		if err != nil {
+			t.Fatal(err)
+		}
+		items, size, ok := n.MaxSatisfaction()
+		if !ok || items != tt.items || size != tt.size {
+			t.Errorf("%s: MaxSatisfaction() = %d, %d, %v, want %d, %d", tt.ms, items, size, ok, tt.items, tt.size)
+		}
+	}
+	zero, _ := NewNode(JUST_0, 0, nil, nil)
+	if _, _, ok := zero.MaxSatisfaction(); ok || zero.CheckSane() == nil {
+		t.Error("0 has a satisfaction")
+	}
+	t.Logf("✓ Witness sizes bounded")
+}
@@ -0,0 +1,337 @@
+package miniscript
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Witness element sizes a satisfaction is planned with before it's signed
+const (
+	MAX_SIG_SIZE  int = 73 // a DER signature of up to 72 bytes and its sighash byte
+	PREIMAGE_SIZE int = 32 // the hash fragments only accept 32 byte preimages
+)
+
+var (
+	ErrNoSatisfaction        = errors.New("no satisfaction available")
+	ErrMalleableSatisfaction = errors.New("only malleable satisfactions available")
+)
+
+// ElementKind is what a witness element stands for
+type ElementKind int
+
+const (
+	ELEMENT_DATA      ElementKind = iota // a fixed value: a branch selector, a dummy or a public key
+	ELEMENT_SIGNATURE                    // a signature by Key
+	ELEMENT_PREIMAGE                     // the preimage of Hash under HashFunc
+)
+
+// WitnessElement is an item of a satisfaction. Data is the item itself, which for a
+// signature or preimage is what the Satisfier gave, nil in a template.
+type WitnessElement struct {
+	Kind     ElementKind
+	Data     []byte
+	Key      []byte
+	Hash     []byte
+	HashFunc Fragment
+}
+
+// String writes data in hex, <> when empty, and signatures and preimages as what they are
+// for, as in <sig(02...)> and <sha256_preimage(...)>
+func (e WitnessElement) String() string {
+	switch e.Kind {
+	case ELEMENT_SIGNATURE:
+		return "<sig(" + hex.EncodeToString(e.Key) + ")>"
+	case ELEMENT_PREIMAGE:
+		return "<" + e.HashFunc.String() + "_preimage(" + hex.EncodeToString(e.Hash) + ")>"
+	}
+	if len(e.Data) == 0 {
+		return "<>"
+	}
+	return hex.EncodeToString(e.Data)
+}
+
+// size is the element's serialized size with its length byte, planning a signature at
+// its largest until there is one
+func (e WitnessElement) size() int {
+	switch {
+	case e.Kind == ELEMENT_SIGNATURE && e.Data == nil:
+		return 1 + MAX_SIG_SIZE
+	case e.Kind == ELEMENT_PREIMAGE:
+		return 1 + PREIMAGE_SIZE
+	}
+	return 1 + len(e.Data)
+}
+
+// Satisfier supplies what satisfying a miniscript takes. Signature returns a signature by
+// pubkey with its sighash byte appended and Preimage the preimage of hash under hashFunc,
+// each reporting whether it has one; CheckOlder and CheckAfter report whether the
+// spending transaction meets a relative or absolute timelock.
+type Satisfier interface {
+	Signature(pubkey []byte) ([]byte, bool)
+	Preimage(hashFunc Fragment, hash []byte) ([]byte, bool)
+	CheckOlder(n uint32) bool
+	CheckAfter(n uint32) bool
+}
+
+// Assets is a Satisfier for planning a spend before it's signed: it can sign for Keys and
+// open Hashes, giving nil so Satisfy leaves a placeholder, and meets the timelocks an
+// input with Sequence in a version 2 transaction with Locktime does
+type Assets struct {
+	Keys     [][]byte
+	Hashes   [][]byte
+	Sequence uint32
+	Locktime uint32
+}
+
+func (a Assets) Signature(pubkey []byte) ([]byte, bool) {
+	return nil, slices.ContainsFunc(a.Keys, func(key []byte) bool { return bytes.Equal(key, pubkey) })
+}
+
+func (a Assets) Preimage(hashFunc Fragment, hash []byte) ([]byte, bool) {
+	return nil, slices.ContainsFunc(a.Hashes, func(h []byte) bool { return bytes.Equal(h, hash) })
+}
+
+func (a Assets) CheckOlder(n uint32) bool {
+	return a.Sequence&sequenceDisableFlag == 0 && n&sequenceTypeFlag == a.Sequence&sequenceTypeFlag &&
+		n&sequenceLocktimeMask <= a.Sequence&sequenceLocktimeMask
+}
+
+func (a Assets) CheckAfter(n uint32) bool {
+	return (n < locktimeThreshold) == (a.Locktime < locktimeThreshold) && n <= a.Locktime
+}
+
+// Satisfy returns the smallest nonmalleable satisfaction s makes possible, the witness
+// stack bottom first without the witnessScript. With Assets it's a template of the
+// signatures and preimages a spend will need. ErrMalleableSatisfaction is returned when
+// every available satisfaction could be changed by a third party, or needs no signature.
+func (n *Node) Satisfy(s Satisfier) ([]WitnessElement, error) {
+	_, sat := n.satisfy(s)
+	switch {
+	case !sat.available:
+		return nil, fmt.Errorf("%w: %s", ErrNoSatisfaction, n)
+	case sat.malleable || !sat.hasSig:
+		return nil, fmt.Errorf("%w: %s", ErrMalleableSatisfaction, n)
+	}
+	return sat.stack, nil
+}
+
+// Witness returns the items of Satisfy's satisfaction, which must leave no placeholders
+func (n *Node) Witness(s Satisfier) ([][]byte, error) {
+	elems, err := n.Satisfy(s)
+	if err != nil {
+		return nil, err
+	}
+	witness := make([][]byte, len(elems))
+	for i, e := range elems {
+		if e.Kind != ELEMENT_DATA && e.Data == nil {
+			return nil, fmt.Errorf("%w: missing %s", ErrNoSatisfaction, e)
+		}
+		witness[i] = e.Data
+	}
+	return witness, nil
+}
+
+// inputStack is a candidate satisfaction or dissatisfaction and what's known of it:
+// whether it's available, whether it needs a signature, and whether a third party could
+// change it
+type inputStack struct {
+	available, hasSig, malleable bool
+	size                         int
+	stack                        []WitnessElement
+}
+
+var (
+	invalid = inputStack{}
+	empty   = inputStack{available: true}
+	zero    = dataStack([]byte{})
+	one     = dataStack([]byte{0x01})
+	zero32  = dataStack(make([]byte, 32)).setMalleable(true) // any other 32 bytes dissatisfy as well
+)
+
+func dataStack(data []byte) inputStack {
+	return elementStack(WitnessElement{Kind: ELEMENT_DATA, Data: data}, true)
+}
+
+func elementStack(e WitnessElement, available bool) inputStack {
+	return inputStack{available: available, size: e.size(), stack: []WitnessElement{e}}
+}
+
+func (a inputStack) withSig() inputStack {
+	a.hasSig = true
+	return a
+}
+
+func (a inputStack) setMalleable(malleable bool) inputStack {
+	a.malleable = a.malleable || malleable
+	return a
+}
+
+// plus puts b above a on the stack; it's available only if both are
+func (a inputStack) plus(b inputStack) inputStack {
+	return inputStack{
+		available: a.available && b.available,
+		hasSig:    a.hasSig || b.hasSig,
+		malleable: a.malleable || b.malleable,
+		size:      a.size + b.size,
+		stack:     append(slices.Clone(a.stack), b.stack...),
+	}
+}
+
+// choose picks between two ways of satisfying, or of dissatisfying, a node. One needing
+// no signature is always open to a third party, so if both need none both are malleable,
+// and if only one does it has to be the one taken. Otherwise a nonmalleable one beats a
+// malleable one, and then the smaller wins.
+func choose(a, b inputStack) inputStack {
+	switch {
+	case !a.available:
+		return b
+	case !b.available:
+		return a
+	case !a.hasSig && b.hasSig:
+		return a
+	case !b.hasSig && a.hasSig:
+		return b
+	case !a.hasSig && !b.hasSig:
+		a.malleable, b.malleable = true, true
+	case b.malleable && !a.malleable:
+		return a
+	case a.malleable && !b.malleable:
+		return b
+	}
+	if a.size <= b.size {
+		return a
+	}
+	return b
+}
+
+func chooseAll(stacks ...inputStack) inputStack {
+	best := invalid
+	for _, s := range stacks {
+		best = choose(best, s)
+	}
+	return best
+}
+
+// satisfy finds n's best dissatisfaction and satisfaction, following Bitcoin Core's
+// satisfier. Forms no honest signer would produce are listed where they could be
+// malleated into, but the choice rules keep them out of a nonmalleable witness.
+func (n *Node) satisfy(s Satisfier) (nsat, sat inputStack) {
+	subs := make([][2]inputStack, len(n.Subs))
+	for i, sub := range n.Subs {
+		subs[i][0], subs[i][1] = sub.satisfy(s)
+	}
+	var x, y, z [2]inputStack
+	if len(subs) > 0 {
+		x = subs[0]
+	}
+	if len(subs) > 1 {
+		y = subs[1]
+	}
+	if len(subs) > 2 {
+		z = subs[2]
+	}
+
+	switch n.Fragment {
+	case JUST_0:
+		return empty, invalid
+	case JUST_1:
+		return invalid, empty
+	case PK_K:
+		return zero, n.signature(s, n.Keys[0])
+	case PK_H:
+		key := dataStack(n.Keys[0])
+		return zero.plus(key), n.signature(s, n.Keys[0]).plus(key)
+	case OLDER:
+		if s.CheckOlder(n.K) {
+			return invalid, empty
+		}
+		return invalid, invalid
+	case AFTER:
+		if s.CheckAfter(n.K) {
+			return invalid, empty
+		}
+		return invalid, invalid
+	case SHA256, HASH256, RIPEMD160, HASH160:
+		preimage, ok := s.Preimage(n.Fragment, n.Hash)
+		e := WitnessElement{Kind: ELEMENT_PREIMAGE, Data: preimage, Hash: n.Hash, HashFunc: n.Fragment}
+		return zero32, elementStack(e, ok)
+	case MULTI:
+		// sats[j] is the best stack with j signatures from the keys so far, on the dummy
+		// item OP_CHECKMULTISIG pops
+		sats := []inputStack{zero}
+		for _, key := range n.Keys {
+			sig := n.signature(s, key)
+			next := []inputStack{sats[0]}
+			for j := 1; j < len(sats); j++ {
+				next = append(next, choose(sats[j], sats[j-1].plus(sig)))
+			}
+			sats = append(next, sats[len(sats)-1].plus(sig))
+		}
+		nsat = zero
+		for range n.K {
+			nsat = nsat.plus(zero)
+		}
+		return nsat, sats[n.K]
+
+	case WRAP_A, WRAP_S, WRAP_C, WRAP_N:
+		return x[0], x[1]
+	case WRAP_D:
+		return zero, x[1].plus(one)
+	case WRAP_V:
+		return invalid, x[1]
+	case WRAP_J:
+		// a dissatisfaction of X with a nonzero top item would be another way to dissatisfy
+		return zero.setMalleable(x[0].available && !x[0].hasSig), x[1]
+
+	case AND_V:
+		return y[0].plus(x[1]), y[1].plus(x[1])
+	case AND_B:
+		return chooseAll(y[0].plus(x[0]),
+				y[1].plus(x[0]).setMalleable(true),
+				y[0].plus(x[1]).setMalleable(true)),
+			y[1].plus(x[1])
+	case OR_B:
+		return y[0].plus(x[0]),
+			chooseAll(y[0].plus(x[1]), y[1].plus(x[0]), y[1].plus(x[1]).setMalleable(true))
+	case OR_C:
+		return invalid, choose(x[1], y[1].plus(x[0]))
+	case OR_D:
+		return y[0].plus(x[0]), choose(x[1], y[1].plus(x[0]))
+	case OR_I:
+		return choose(x[0].plus(one), y[0].plus(zero)), choose(x[1].plus(one), y[1].plus(zero))
+	case ANDOR:
+		return choose(y[0].plus(x[1]), z[0].plus(x[0])), choose(y[1].plus(x[1]), z[1].plus(x[0]))
+	case THRESH:
+		// sats[j] is the best stack satisfying j of the last subexpressions, each of which
+		// runs after those before it and so sits lower on the stack
+		sats := []inputStack{empty}
+		for i := len(subs) - 1; i >= 0; i-- {
+			subNsat, subSat := subs[i][0], subs[i][1]
+			next := []inputStack{sats[0].plus(subNsat)}
+			for j := 1; j < len(sats); j++ {
+				next = append(next, choose(sats[j].plus(subNsat), sats[j-1].plus(subSat)))
+			}
+			sats = append(next, sats[len(sats)-1].plus(subSat))
+		}
+		// anything but k satisfactions dissatisfies, though an honest signer satisfies none
+		nsat = invalid
+		for i := range sats {
+			if i != 0 && i != int(n.K) {
+				sats[i] = sats[i].setMalleable(true)
+			}
+			if i != int(n.K) {
+				nsat = choose(nsat, sats[i])
+			}
+		}
+		return nsat, sats[n.K]
+	}
+	return invalid, invalid
+}
+
+func (n *Node) signature(s Satisfier, key []byte) inputStack {
+	sig, ok := s.Signature(key)
+	return elementStack(WitnessElement{Kind: ELEMENT_SIGNATURE, Data: sig, Key: key}, ok).withSig()
+}
@@ -0,0 +1,148 @@
+package miniscript
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/script"
+	"strings"
+	"testing"
+)
+
+var testSighash = encoding.Hash256([]byte("2386"))
+
+// signer satisfies with real signatures over testSighash by the keys it holds, and the
+// timelocks of its Assets
+type signer struct {
+	Assets
+	t *testing.T
+}
+
+func (s signer) Signature(pubkey []byte) ([]byte, bool) {
+	if _, ok := s.Assets.Signature(pubkey); !ok {
+		return nil, false
+	}
+	for i, key := range testKeys {
+		if bytes.Equal(testPubKey(i+1), pubkey) {
+			sig, err := key.SignHash(testSighash)
+			if err != nil {
+				s.t.Fatal(err)
+			}
+			return append(sig.Serialize(), byte(encoding.SIGHASH_ALL)), true
+		}
+	}
+	return nil, false
+}
+
+func (s signer) Preimage(hashFunc Fragment, hash []byte) ([]byte, bool) {
+	if _, ok := s.Assets.Preimage(hashFunc, hash); !ok {
+		return nil, false
+	}
+	return testPreimage, true
+}
+
+func testHash() []byte {
+	h := sha256.Sum256(testPreimage)
+	return h[:]
+}
+
+func TestSatisfy(t *testing.T) {
+	k1, k2, k3 := testPubKey(1), testPubKey(2), testPubKey(3)
+	tests := []struct {
+		name     string
+		ms       string
+		assets   Assets
+		template string
+	}{
+		{"pk", "pk(K1)", Assets{Keys: [][]byte{k1}}, "<sig(K1)>"},
+		{"pkh", "pkh(K1)", Assets{Keys: [][]byte{k1}}, "<sig(K1)> K1"},
+		{"multi picks the keys it has", "multi(2,K1,K2,K3)", Assets{Keys: [][]byte{k1, k3}}, "<> <sig(K1)> <sig(K3)>"},
+		{"or_d first branch", "or_d(pk(K1),and_v(v:pk(K2),older(144)))", Assets{Keys: [][]byte{k1, k2}},
+			"<sig(K1)>"},
+		{"or_d after the timelock", "or_d(pk(K1),and_v(v:pk(K2),older(144)))",
+			Assets{Keys: [][]byte{k2}, Sequence: 144}, "<sig(K2)> <>"},
+		{"andor else branch", "andor(pk(K1),older(1008),pk(K2))", Assets{Keys: [][]byte{k2}}, "<sig(K2)> <>"},
+		{"and_n with the preimage", "and_n(pk(K1),sha256(H))", Assets{Keys: [][]byte{k1}, Hashes: [][]byte{testHash()}},
+			"<sha256_preimage(H)> <sig(K1)>"},
+		{"or_b", "or_b(pk(K1),a:pk(K2))", Assets{Keys: [][]byte{k2}}, "<sig(K2)> <>"},
+		{"thresh", "thresh(2,pk(K1),s:pk(K2),sln:older(12960))",
+			Assets{Keys: [][]byte{k2}, Sequence: 12960}, "<> <sig(K2)> <>"},
+		{"or_i", "or_i(pk(K1),and_v(v:pk(K2),after(500)))", Assets{Keys: [][]byte{k2}, Locktime: 600},
+			"<sig(K2)> <>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := Parse(expand(tt.ms))
+			if err != nil {
+				t.Fatal(err)
+			}
+			elems, err := n.Satisfy(tt.assets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var parts []string
+			for _, e := range elems {
+				parts = append(parts, e.String())
+			}
+			if got := strings.Join(parts, " "); got != expand(tt.template) {
+				t.Errorf("template = %s, want %s", got, expand(tt.template))
+			}
+			if _, err := n.Witness(tt.assets); !errors.Is(err, ErrNoSatisfaction) {
+				t.Errorf("Witness from Assets = %v, want %v", err, ErrNoSatisfaction)
+			}
+
+			// the signed witness spends the P2WSH output
+			witness, err := n.Witness(signer{tt.assets, t})
+			if err != nil {
+				t.Fatal(err)
+			}
+			witnessScript := n.Script()
+			raw, err := witnessScript.RawBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := sha256.Sum256(raw)
+			engine := script.NewScriptEngine(script.P2wshScript(h[:]))
+			ok, err := engine.WithWitness(append(witness, raw)).
+				WithLocktime(tt.assets.Locktime).
+				WithSequence(tt.assets.Sequence).
+				WithFlags(script.STANDARD_SCRIPT_VERIFY_FLAGS).
+				Execute(testSighash)
+			if !ok {
+				t.Fatalf("witness %x fails: %v", witness, err)
+			}
+			t.Logf("✓ %s: %s", tt.ms, strings.Join(parts, " "))
+		})
+	}
+}
+
+func TestSatisfyErrors(t *testing.T) {
+	k1, k2 := testPubKey(1), testPubKey(2)
+	tests := []struct {
+		name   string
+		ms     string
+		assets Assets
+		want   error
+	}{
+		{"missing key", "pk(K1)", Assets{Keys: [][]byte{k2}}, ErrNoSatisfaction},
+		{"timelock not met", "and_v(v:pk(K1),older(144))", Assets{Keys: [][]byte{k1}, Sequence: 143}, ErrNoSatisfaction},
+		{"time instead of height", "and_v(v:pk(K1),after(100))", Assets{Keys: [][]byte{k1}, Locktime: 500000001},
+			ErrNoSatisfaction},
+		{"no signature needed", "or_i(pk(K1),sha256(H))", Assets{Hashes: [][]byte{testHash()}}, ErrMalleableSatisfaction},
+		{"malleable branch", "and_v(v:pk(K1),or_i(sha256(H),older(10)))",
+			Assets{Keys: [][]byte{k1}, Hashes: [][]byte{testHash()}, Sequence: 10}, ErrMalleableSatisfaction},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := Parse(expand(tt.ms))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := n.Satisfy(tt.assets); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.ms, tt.want)
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package miniscript
+
+import "strings"
+
+// Type is a miniscript node's type: exactly one basic type, B, V, K or W, and the
+// properties that hold for it. The rules deriving a node's type from its subexpressions'
+// are those of the Miniscript specification, as Bitcoin Core implements them.
+type Type uint32
+
+const (
+	TYPE_B Type = 1 << iota // base: consumes its inputs, pushes nonzero if satisfied and zero if not
+	TYPE_V                  // verify: consumes its inputs, pushes nothing, and can't be dissatisfied
+	TYPE_K                  // key: pushes a public key for a following OP_CHECKSIG
+	TYPE_W                  // wrapped: like B, but takes its inputs from under the top item
+	PROP_Z                  // zero-arg: always consumes exactly 0 stack items
+	PROP_O                  // one-arg: always consumes exactly 1 stack item
+	PROP_N                  // nonzero: a satisfaction never needs a zero top item
+	PROP_D                  // dissatisfiable: has a dissatisfaction needing no signature
+	PROP_U                  // unit: pushes exactly 1 when satisfied
+	PROP_E                  // expressive: its dissatisfaction is unique and can't be malleated
+	PROP_F                  // forced: every dissatisfaction needs a signature
+	PROP_S                  // safe: every satisfaction needs a signature
+	PROP_M                  // nonmalleable: it has a satisfaction a third party can't change
+	PROP_X                  // expensive verify: its last opcode has no VERIFY form
+	PROP_G                  // holds an older with a time lock
+	PROP_H                  // holds an older with a height lock
+	PROP_I                  // holds an after with a time lock
+	PROP_J                  // holds an after with a height lock
+	PROP_K                  // no satisfaction needs both a height and a time lock of one kind
+)
+
+const typeLetters = "BVKWzonduefsmxghijk"
+
+// props returns the type with the properties named by letters, as typeLetters lists them
+func props(letters string) Type {
+	var t Type
+	for _, c := range letters {
+		t |= 1 << strings.IndexRune(typeLetters, c)
+	}
+	return t
+}
+
+// Has reports whether t has all of the properties of want
+func (t Type) Has(want Type) bool {
+	return t&want == want
+}
+
+// when is t if cond holds and no properties otherwise
+func (t Type) when(cond bool) Type {
+	if cond {
+		return t
+	}
+	return 0
+}
+
+// valid reports whether t has exactly one basic type, which every well-typed node has
+func (t Type) valid() bool {
+	basic := t & (TYPE_B | TYPE_V | TYPE_K | TYPE_W)
+	return basic != 0 && basic&(basic-1) == 0
+}
+
+// String lists the properties by letter, basic type first, as in "Bonduesmk"
+func (t Type) String() string {
+	var b strings.Builder
+	for i := range typeLetters {
+		if t&(1<<i) != 0 {
+			b.WriteByte(typeLetters[i])
+		}
+	}
+	return b.String()
+}
+
+// mixesTimelocks reports whether needing both x's and y's timelocks would mix heights and
+// times of the same kind, which no transaction can satisfy
+func mixesTimelocks(x, y Type) bool {
+	return x.Has(PROP_G) && y.Has(PROP_H) || x.Has(PROP_H) && y.Has(PROP_G) ||
+		x.Has(PROP_I) && y.Has(PROP_J) || x.Has(PROP_J) && y.Has(PROP_I)
+}
+
+// computeType derives n's type from its subexpressions', returning a type with no basic
+// type if they don't fit the fragment
+func computeType(n *Node) Type {
+	var x, y, z Type
+	if len(n.Subs) > 0 {
+		x = n.Subs[0].typ
+	}
+	if len(n.Subs) > 1 {
+		y = n.Subs[1].typ
+	}
+	if len(n.Subs) > 2 {
+		z = n.Subs[2].typ
+	}
+	timelocks := props("ghij")
+
+	switch n.Fragment {
+	case JUST_0:
+		return props("Bzudemsxk")
+	case JUST_1:
+		return props("Bzufmxk")
+	case PK_K:
+		return props("Konudemsxk")
+	case PK_H:
+		return props("Knudemsxk")
+	case OLDER:
+		return PROP_G.when(n.K&sequenceTypeFlag != 0) | PROP_H.when(n.K&sequenceTypeFlag == 0) | props("Bzfmxk")
+	case AFTER:
+		return PROP_I.when(n.K >= locktimeThreshold) | PROP_J.when(n.K < locktimeThreshold) | props("Bzfmxk")
+	case SHA256, HASH256, RIPEMD160, HASH160:
+		return props("Bonudmk")
+	case MULTI:
+		return props("Bnudemsk")
+
+	case WRAP_A:
+		return TYPE_W.when(x.Has(TYPE_B)) | x&(timelocks|PROP_K) | x&props("udfems") | PROP_X
+	case WRAP_S:
+		return TYPE_W.when(x.Has(TYPE_B|PROP_O)) | x&(timelocks|PROP_K) | x&props("udfemsx")
+	case WRAP_C:
+		return TYPE_B.when(x.Has(TYPE_K)) | x&(timelocks|PROP_K) | x&props("ondfem") | props("us")
+	case WRAP_D:
+		// d:X is only u under tapscript, where MINIMALIF is consensus
+		return TYPE_B.when(x.Has(TYPE_V|PROP_Z)) | PROP_O.when(x.Has(PROP_Z)) | PROP_E.when(x.Has(PROP_F)) |
+			x&(timelocks|PROP_K) | x&props("ms") | props("ndx")
+	case WRAP_V:
+		return TYPE_V.when(x.Has(TYPE_B)) | x&(timelocks|PROP_K) | x&props("zonms") | props("fx")
+	case WRAP_J:
+		return TYPE_B.when(x.Has(TYPE_B|PROP_N)) | PROP_E.when(x.Has(PROP_F)) | x&(timelocks|PROP_K) |
+			x&props("oums") | props("ndx")
+	case WRAP_N:
+		return x&(timelocks|PROP_K) | x&props("Bzondfems") | props("ux")
+
+	case AND_V:
+		return (y & props("KVB")).when(x.Has(TYPE_V)) |
+			x&PROP_N | (y & PROP_N).when(x.Has(PROP_Z)) |
+			((x | y) & PROP_O).when((x | y).Has(PROP_Z)) |
+			x&y&props("dmz") | (x|y)&PROP_S |
+			PROP_F.when(y.Has(PROP_F) || x.Has(PROP_S)) |
+			y&props("ux") | (x|y)&timelocks |
+			PROP_K.when((x&y).Has(PROP_K) && !mixesTimelocks(x, y))
+	case AND_B:
+		return (x & TYPE_B).when(y.Has(TYPE_W)) |
+			((x | y) & PROP_O).when((x | y).Has(PROP_Z)) |
+			x&PROP_N | (y & PROP_N).when(x.Has(PROP_Z)) |
+			(x & y & PROP_E).when((x & y).Has(PROP_S)) |
+			x&y&props("dzm") |
+			PROP_F.when((x&y).Has(PROP_F) || x.Has(PROP_S|PROP_F) || y.Has(PROP_S|PROP_F)) |
+			(x|y)&PROP_S | props("ux") | (x|y)&timelocks |
+			PROP_K.when((x&y).Has(PROP_K) && !mixesTimelocks(x, y))
+	case OR_B:
+		return TYPE_B.when(x.Has(TYPE_B|PROP_D) && y.Has(TYPE_W|PROP_D)) |
+			((x | y) & PROP_O).when((x | y).Has(PROP_Z)) |
+			(x & y & PROP_M).when((x|y).Has(PROP_S) && (x&y).Has(PROP_E)) |
+			x&y&props("zse") | props("dux") | (x|y)&timelocks | x&y&PROP_K
+	case OR_D:
+		return (y & TYPE_B).when(x.Has(TYPE_B|PROP_D|PROP_U)) |
+			(x & PROP_O).when(y.Has(PROP_Z)) |
+			(x & y & PROP_M).when(x.Has(PROP_E) && (x|y).Has(PROP_S)) |
+			x&y&props("zes") | y&props("ufd") | PROP_X | (x|y)&timelocks | x&y&PROP_K
+	case OR_C:
+		return (y & TYPE_V).when(x.Has(TYPE_B|PROP_D|PROP_U)) |
+			(x & PROP_O).when(y.Has(PROP_Z)) |
+			(x & y & PROP_M).when(x.Has(PROP_E) && (x|y).Has(PROP_S)) |
+			x&y&props("zs") | props("fx") | (x|y)&timelocks | x&y&PROP_K
+	case OR_I:
+		return x&y&props("VBKufs") |
+			PROP_O.when((x & y).Has(PROP_Z)) |
+			((x | y) & PROP_E).when((x | y).Has(PROP_F)) |
+			(x & y & PROP_M).when((x | y).Has(PROP_S)) |
+			(x|y)&PROP_D | PROP_X | (x|y)&timelocks | x&y&PROP_K
+	case ANDOR:
+		return (y & z & props("BKV")).when(x.Has(TYPE_B|PROP_D|PROP_U)) |
+			x&y&z&PROP_Z |
+			((x | y&z) & PROP_O).when((x | y&z).Has(PROP_Z)) |
+			y&z&PROP_U |
+			(z & PROP_F).when(x.Has(PROP_S) || y.Has(PROP_F)) |
+			z&PROP_D |
+			(z & PROP_E).when(x.Has(PROP_S) || y.Has(PROP_F)) |
+			(x & y & z & PROP_M).when(x.Has(PROP_E) && (x|y|z).Has(PROP_S)) |
+			z&(x|y)&PROP_S |
+			PROP_X | (x|y|z)&timelocks |
+			PROP_K.when((x&y&z).Has(PROP_K) && !mixesTimelocks(x, y))
+
+	case THRESH:
+		allE, allM := true, true
+		args, numS := 0, 0
+		acc := PROP_K
+		for i, sub := range n.Subs {
+			t := sub.typ
+			want := props("Wdu")
+			if i == 0 {
+				want = props("Bdu")
+			}
+			if !t.Has(want) {
+				return 0
+			}
+			allE = allE && t.Has(PROP_E)
+			allM = allM && t.Has(PROP_M)
+			if t.Has(PROP_S) {
+				numS++
+			}
+			switch {
+			case t.Has(PROP_Z):
+			case t.Has(PROP_O):
+				args++
+			default:
+				args += 2
+			}
+			// satisfying more than one subexpression can't mix the kinds of timelock
+			acc = (acc|t)&timelocks |
+				PROP_K.when((acc&t).Has(PROP_K) && (n.K <= 1 || !mixesTimelocks(acc, t)))
+		}
+		subs, k := len(n.Subs), int(n.K)
+		return props("Bdu") |
+			PROP_Z.when(args == 0) |
+			PROP_O.when(args == 1) |
+			PROP_E.when(allE && numS == subs) |
+			PROP_M.when(allE && allM && numS >= subs-k) |
+			PROP_S.when(numS >= subs-k+1) |
+			acc
+	}
+	return 0
+}
@@ -2,9 +2,16 @@ package network
 
 import (
 	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"go-bitcoin/internal/block"
 	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
 	"math/big"
+	"os"
+	"slices"
 	"testing"
 )
 
@@ -92,3 +99,188 @@ func TestExercise122(t *testing.T) {
 		t.Fatalf("expected: %s, got %s", expected, actual)
 	}
 }
+
+func TestFilterLoadRoundTrip(t *testing.T) {
+	bf := NewBloomFilter(10, 5, 99)
+	bf.Add([]byte("hello world"))
+
+	msg := &FilterLoadMessage{Filter: &bf, Flag: 1}
+	payload, err := msg.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseFilterLoadMessage(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Flag != 1 || parsed.Filter.Tweak != 99 || parsed.Filter.FunctionCount != 5 {
+		t.Fatalf("unexpected parsed filter: %+v", parsed.Filter)
+	}
+	if !parsed.Filter.Contains([]byte("hello world")) {
+		t.Fatal("parsed filter lost inserted item")
+	}
+	if parsed.Filter.Contains([]byte("goodbye")) {
+		t.Log("false positive for 'goodbye' (possible with a small filter)")
+	}
+}
+
+func TestBuildMerkleBlock(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 7, 16, 33} {
+		txids := make([][32]byte, n)
+		leaves := make([][]byte, n)
+		for i := range txids {
+			txids[i] = [32]byte(encoding.Hash256([]byte{byte(i), byte(n)}))
+			leaves[i] = slices.Clone(txids[i][:])
+		}
+		header := &block.Block{Version: 1, MerkleRoot: [32]byte(encoding.MerkleRoot(leaves))}
+
+		for _, pattern := range [][]int{{}, {0}, {n - 1}, {0, n / 2, n - 1}} {
+			matches := make([]bool, n)
+			for _, idx := range pattern {
+				matches[idx] = true
+			}
+			mb, err := NewMerkleBlock(header, txids, matches)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			payload, err := mb.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParseMerkleBlock(bytes.NewReader(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !parsed.IsValid() {
+				t.Fatalf("n=%d matches=%v: merkleblock does not validate", n, pattern)
+			}
+			// every matched txid is carried as a leaf hash
+			for _, idx := range pattern {
+				if !slices.Contains(parsed.TxHashes, txids[idx]) {
+					t.Fatalf("n=%d: matched tx %d missing from hashes", n, idx)
+				}
+			}
+		}
+	}
+}
+
+func TestBuildMerkleBlockFromFilter(t *testing.T) {
+	// block 1 of testnet from the BIP158 vectors
+	data, err := os.ReadFile("testdata/bip158-vectors.json")
+	if err != nil {
+		t.Skip("Test vectors not found")
+	}
+	var vectors []BIP158TestVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	for _, vec := range vectors {
+		raw, _ := hex.DecodeString(vec.Block)
+		fb, err := block.ParseFullBlock(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fb.Txs) < 2 {
+			continue
+		}
+
+		target, err := fb.Txs[1].Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Reverse(target[:])
+		bf := NewBloomFilter(100, 10, 7)
+		bf.Add(target[:])
+
+		mb, matched, err := BuildMerkleBlock(fb, &bf, BLOOM_UPDATE_NONE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matched) == 0 || matched[0] != fb.Txs[1] {
+			t.Fatalf("expected tx 1 to match, got %d matches", len(matched))
+		}
+		if !mb.IsValid() {
+			t.Fatalf("merkleblock for height %d does not validate against header", vec.BlockHeight)
+		}
+		t.Logf("✓ Height %d: %d/%d txs matched, %d hashes", vec.BlockHeight, len(matched), len(fb.Txs), len(mb.TxHashes))
+		return
+	}
+	t.Skip("no multi-transaction block in vectors")
+}
+
+func TestMatchTransaction(t *testing.T) {
+	h160 := encoding.Hash160([]byte("watched key"))
+	pubKey := append([]byte{0x02}, bytes.Repeat([]byte{0x11}, 32)...)
+	p2pk := script.NewScript([]script.ScriptCommand{
+		{Data: pubKey, IsData: true},
+		{Opcode: script.OP_CHECKSIG},
+	})
+
+	funding := transactions.NewTransaction(1,
+		[]transactions.TxIn{transactions.NewTxIn(bytes.Repeat([]byte{0xaa}, 32), 0, 0xffffffff)},
+		[]transactions.TxOut{
+			{Amount: 1000, ScriptPubKey: script.P2pkhScript(encoding.Hash160([]byte("other key")))},
+			{Amount: 2000, ScriptPubKey: script.P2pkhScript(h160)},
+			{Amount: 3000, ScriptPubKey: p2pk},
+		},
+		0, false, false)
+	fundingID, err := funding.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := func(idx uint32) *transactions.Transaction {
+		tx := transactions.NewTransaction(1,
+			[]transactions.TxIn{transactions.NewTxIn(fundingID[:], idx, 0xffffffff)},
+			[]transactions.TxOut{{Amount: 500, ScriptPubKey: script.P2pkhScript(encoding.Hash160([]byte("payee")))}},
+			0, false, false)
+		return &tx
+	}
+
+	tests := []struct {
+		name      string
+		item      []byte
+		flag      byte
+		spendIdx  uint32
+		wantSpend bool
+	}{
+		{"output push, update none", h160, BLOOM_UPDATE_NONE, 1, false},
+		{"output push, update all", h160, BLOOM_UPDATE_ALL, 1, true},
+		{"p2pkh output, p2pubkey only", h160, BLOOM_UPDATE_P2PUBKEY_ONLY, 1, false},
+		{"p2pk output, p2pubkey only", pubKey, BLOOM_UPDATE_P2PUBKEY_ONLY, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bf := NewBloomFilter(100, 10, 42)
+			bf.Add(tt.item)
+			ok, err := bf.MatchTransaction(&funding, tt.flag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatal("expected funding transaction to match")
+			}
+			ok, err = bf.MatchTransaction(spend(tt.spendIdx), tt.flag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantSpend {
+				t.Fatalf("spend of output %d matched = %v, want %v", tt.spendIdx, ok, tt.wantSpend)
+			}
+			t.Logf("✓ %s", tt.name)
+		})
+	}
+
+	// a filter holding a spent outpoint matches the spending transaction
+	bf := NewBloomFilter(100, 10, 42)
+	internal := fundingID
+	slices.Reverse(internal[:])
+	bf.Add(outpointBytes(internal[:], 0))
+	if ok, _ := bf.MatchTransaction(spend(0), BLOOM_UPDATE_NONE); !ok {
+		t.Fatal("expected spend of watched outpoint to match")
+	}
+	if ok, _ := bf.MatchTransaction(&funding, BLOOM_UPDATE_NONE); ok {
+		t.Fatal("unexpected match for unrelated transaction")
+	}
+	t.Logf("✓ Outpoint match on spending transaction")
+}
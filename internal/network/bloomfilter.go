@@ -3,10 +3,27 @@ package network
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+	"io"
+	"slices"
 )
 
-const BLOOM_UPDATE_ALL int = 0
+// BIP 37 filterload flags controlling how matched outputs update the filter
+const (
+	BLOOM_UPDATE_NONE          byte = 0 // never insert outpoints
+	BLOOM_UPDATE_ALL           byte = 1 // insert the outpoint of every matched output
+	BLOOM_UPDATE_P2PUBKEY_ONLY byte = 2 // insert outpoints only for pay-to-pubkey and bare multisig outputs
+)
+
+// BIP 37 limits on a loaded filter
+const (
+	MAX_BLOOM_FILTER_SIZE uint64 = 36000 // bytes
+	MAX_HASH_FUNCS        uint32 = 50
+	MAX_FILTERADD_SIZE    uint64 = 520 // bytes, the largest script data push
+)
 
 type FilterLoadMessage struct {
 	Filter *BloomFilter
@@ -30,6 +47,9 @@ func NewBloomFilter(size, funcCount, tweak int) BloomFilter {
 }
 
 func (bf *BloomFilter) Add(item []byte) {
+	if bf.Size == 0 {
+		return
+	}
 	for i := 0; i < bf.FunctionCount; i++ {
 		seed := uint32(i)*encoding.BIP37_CONSTANT + bf.Tweak
 		h := encoding.MurmurHash3(item, seed)
@@ -38,6 +58,99 @@ func (bf *BloomFilter) Add(item []byte) {
 	}
 }
 
+// Contains reports whether every bit for item is set (false positives are possible)
+func (bf *BloomFilter) Contains(item []byte) bool {
+	if bf.Size == 0 {
+		return false
+	}
+	for i := 0; i < bf.FunctionCount; i++ {
+		seed := uint32(i)*encoding.BIP37_CONSTANT + bf.Tweak
+		h := encoding.MurmurHash3(item, seed)
+		bit := h % (bf.Size * 8)
+		if bf.BitField[bit] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchTransaction tests tx against the filter the way a full node serving BIP 37 does:
+// the txid, each data push in an output script, each spent outpoint, and each data push
+// in an input script. When an output matches, flag decides whether its outpoint is added
+// to the filter so later spends of it also match.
+func (bf *BloomFilter) MatchTransaction(tx *transactions.Transaction, flag byte) (bool, error) {
+	if bf.Size == 0 {
+		return false, nil
+	}
+	txid, err := tx.Hash()
+	if err != nil {
+		return false, err
+	}
+	// filters match hashes in internal byte order
+	slices.Reverse(txid[:])
+
+	found := bf.Contains(txid[:])
+	for i, out := range tx.Outputs {
+		for _, cmd := range out.ScriptPubKey.CommandStack {
+			if !cmd.IsData || len(cmd.Data) == 0 || !bf.Contains(cmd.Data) {
+				continue
+			}
+			found = true
+			if flag == BLOOM_UPDATE_ALL ||
+				(flag == BLOOM_UPDATE_P2PUBKEY_ONLY && isPubKeyOrMultisig(out.ScriptPubKey)) {
+				bf.Add(outpointBytes(txid[:], uint32(i)))
+			}
+			break
+		}
+	}
+	if found {
+		return true, nil
+	}
+
+	for _, in := range tx.Inputs {
+		prev := slices.Clone(in.PrevTx)
+		slices.Reverse(prev)
+		if bf.Contains(outpointBytes(prev, in.PrevIdx)) {
+			return true, nil
+		}
+		for _, cmd := range in.ScriptSig.CommandStack {
+			if cmd.IsData && len(cmd.Data) > 0 && bf.Contains(cmd.Data) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// outpointBytes serializes an outpoint (internal-order txid followed by LE index)
+// as it is inserted into and matched against a bloom filter
+func outpointBytes(txid []byte, index uint32) []byte {
+	return binary.LittleEndian.AppendUint32(slices.Clone(txid), index)
+}
+
+// isPubKeyOrMultisig reports whether a script is <pubkey> OP_CHECKSIG or a bare
+// OP_m <pubkeys...> OP_n OP_CHECKMULTISIG, the outputs BLOOM_UPDATE_P2PUBKEY_ONLY tracks
+func isPubKeyOrMultisig(s script.Script) bool {
+	cmds := s.CommandStack
+	if len(cmds) == 2 {
+		return cmds[0].IsData && (len(cmds[0].Data) == 33 || len(cmds[0].Data) == 65) &&
+			!cmds[1].IsData && cmds[1].Opcode == script.OP_CHECKSIG
+	}
+	if len(cmds) < 4 {
+		return false
+	}
+	last := cmds[len(cmds)-1]
+	if last.IsData || last.Opcode != script.OP_CHECKMULTISIG {
+		return false
+	}
+	for _, cmd := range cmds[1 : len(cmds)-2] {
+		if !cmd.IsData {
+			return false
+		}
+	}
+	return true
+}
+
 func (bf *BloomFilter) FilterBytes() ([]byte, error) {
 	return encoding.BitFieldToBytes(bf.BitField)
 }
@@ -74,3 +187,92 @@ func (f *FilterLoadMessage) Serialize() ([]byte, error) {
 func (f *FilterLoadMessage) Command() string {
 	return "filterload"
 }
+
+func ParseFilterLoadMessage(r io.Reader) (FilterLoadMessage, error) {
+	size, err := encoding.ReadVarInt(r)
+	if err != nil {
+		return FilterLoadMessage{}, err
+	}
+	if size > MAX_BLOOM_FILTER_SIZE {
+		return FilterLoadMessage{}, fmt.Errorf("bloom filter too large: %d bytes", size)
+	}
+	filterBytes := make([]byte, size)
+	if _, err := io.ReadFull(r, filterBytes); err != nil {
+		return FilterLoadMessage{}, err
+	}
+
+	buf4 := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf4); err != nil {
+		return FilterLoadMessage{}, err
+	}
+	funcCount := binary.LittleEndian.Uint32(buf4)
+	if funcCount > MAX_HASH_FUNCS {
+		return FilterLoadMessage{}, fmt.Errorf("too many bloom hash functions: %d", funcCount)
+	}
+	if _, err := io.ReadFull(r, buf4); err != nil {
+		return FilterLoadMessage{}, err
+	}
+	tweak := binary.LittleEndian.Uint32(buf4)
+
+	buf1 := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf1); err != nil {
+		return FilterLoadMessage{}, err
+	}
+
+	return FilterLoadMessage{
+		Filter: &BloomFilter{
+			Size:          uint32(size),
+			BitField:      encoding.BytesToBitField(filterBytes),
+			FunctionCount: int(funcCount),
+			Tweak:         tweak,
+		},
+		Flag: buf1[0],
+	}, nil
+}
+
+// FilterAddMessage adds a single element to the filter already loaded on the peer
+type FilterAddMessage struct {
+	Data []byte
+}
+
+func (f *FilterAddMessage) Serialize() ([]byte, error) {
+	if uint64(len(f.Data)) > MAX_FILTERADD_SIZE {
+		return nil, fmt.Errorf("filteradd element too large: %d bytes", len(f.Data))
+	}
+	length, err := encoding.EncodeVarInt(uint64(len(f.Data)))
+	if err != nil {
+		return nil, err
+	}
+	return append(length, f.Data...), nil
+}
+
+func (f *FilterAddMessage) Command() string {
+	return "filteradd"
+}
+
+func ParseFilterAddMessage(r io.Reader) (FilterAddMessage, error) {
+	size, err := encoding.ReadVarInt(r)
+	if err != nil {
+		return FilterAddMessage{}, err
+	}
+	if size > MAX_FILTERADD_SIZE {
+		return FilterAddMessage{}, fmt.Errorf("filteradd element too large: %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return FilterAddMessage{}, err
+	}
+	return FilterAddMessage{Data: data}, nil
+}
+
+// FilterClearMessage removes the peer's filter, restoring unfiltered relay
+type FilterClearMessage struct {
+}
+
+func (f *FilterClearMessage) Serialize() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (f FilterClearMessage) Command() string {
+	return "filterclear"
+}
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Capture directions
+const (
+	CAPTURE_IN  string = "in"
+	CAPTURE_OUT string = "out"
+)
+
+// CaptureRecord is one envelope as written by a WireTap, one JSON object per line
+type CaptureRecord struct {
+	Time      time.Time `json:"time"`
+	Peer      string    `json:"peer"`
+	Direction string    `json:"dir"`
+	Command   string    `json:"command"`
+	Size      int       `json:"size"`
+	Payload   string    `json:"payload"` // hex
+}
+
+// WireTap writes every raw envelope a node sends or receives as NDJSON, for diagnosing
+// protocol issues offline. One tap may be shared by several nodes.
+type WireTap struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// NewWireTap records envelopes to w
+func NewWireTap(w io.Writer) *WireTap {
+	return &WireTap{enc: json.NewEncoder(w)}
+}
+
+// OpenWireTap appends records to the NDJSON file at path, creating it if needed
+func OpenWireTap(path string) (*WireTap, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &WireTap{enc: json.NewEncoder(f), closer: f}, nil
+}
+
+// WithWireTap records the node's traffic to tap
+func WithWireTap(tap *WireTap) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.tap = tap
+	}
+}
+
+// record writes one envelope. Write errors are dropped: capture must never break the node.
+func (wt *WireTap) record(peer, dir string, env NetworkEnvelope) {
+	rec := CaptureRecord{
+		Time:      time.Now().UTC(),
+		Peer:      peer,
+		Direction: dir,
+		Command:   env.Command,
+		Size:      ENVELOPE_HEADER_SIZE + len(env.Payload),
+		Payload:   hex.EncodeToString(env.Payload),
+	}
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	wt.enc.Encode(rec)
+}
+
+// Close closes the capture file opened by OpenWireTap
+func (wt *WireTap) Close() error {
+	if wt.closer == nil {
+		return nil
+	}
+	return wt.closer.Close()
+}
+
+// tapEnvelope records env if a wire tap is configured
+func (sn *SimpleNode) tapEnvelope(dir string, env NetworkEnvelope) {
+	if sn.tap != nil {
+		sn.tap.record(sn.conn.RemoteAddr().String(), dir, env)
+	}
+}
@@ -0,0 +1,253 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CFCHECKPT_INTERVAL is the spacing of filter header checkpoints (BIP157)
+const CFCHECKPT_INTERVAL int = 1000
+
+var ErrCheckpointMismatch = errors.New("filter checkpoint mismatch")
+
+// CheckpointHeight returns the block height committed to by checkpoint index i
+func CheckpointHeight(i int) int {
+	return (i + 1) * CFCHECKPT_INTERVAL
+}
+
+// FetchCfCheckpoints requests filter header checkpoints up to stopHash from a single peer
+func FetchCfCheckpoints(node *SimpleNode, stopHash [32]byte, timeout time.Duration) ([][32]byte, error) {
+	req := &GetCfCheckPointMessage{
+		FType:    BASIC,
+		StopHash: stopHash,
+	}
+	resp, err := node.SendAndWait(req, "cfcheckpt", timeout)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*CfCheckPointMessage).FilterHeaders, nil
+}
+
+// AgreeCheckpoints returns the checkpoint list if every peer reported the same one
+func AgreeCheckpoints(peerCheckpoints [][][32]byte) ([][32]byte, error) {
+	if len(peerCheckpoints) == 0 {
+		return nil, errors.New("no checkpoints to compare")
+	}
+	first := peerCheckpoints[0]
+	for p, cps := range peerCheckpoints[1:] {
+		if len(cps) != len(first) {
+			return nil, fmt.Errorf("%w: peer %d sent %d checkpoints, peer 0 sent %d", ErrCheckpointMismatch, p+1, len(cps), len(first))
+		}
+		for i := range cps {
+			if cps[i] != first[i] {
+				return nil, fmt.Errorf("%w: peers disagree at height %d", ErrCheckpointMismatch, CheckpointHeight(i))
+			}
+		}
+	}
+	return first, nil
+}
+
+// checkpointRange is the span of heights between two adjacent checkpoints
+type checkpointRange struct {
+	start, stop int
+}
+
+// checkpointRanges splits [0, last checkpoint] into ranges that each end on a checkpoint
+func checkpointRanges(numCheckpoints int) []checkpointRange {
+	ranges := make([]checkpointRange, numCheckpoints)
+	start := 0
+	for i := range numCheckpoints {
+		stop := CheckpointHeight(i)
+		ranges[i] = checkpointRange{start: start, stop: stop}
+		start = stop + 1
+	}
+	return ranges
+}
+
+// VerifyCheckpointRange checks a cfheaders response for the range ending at checkpoint idx
+// against the checkpoints on either side, independent of any other range
+func (c *CFHeaderChain) VerifyCheckpointRange(msg CfHeadersMessage, checkpoints [][32]byte, idx int) error {
+	if msg.FType != BASIC {
+		return fmt.Errorf("unsupported filter type: %d", msg.FType)
+	}
+	if idx < 0 || idx >= len(checkpoints) {
+		return fmt.Errorf("checkpoint index %d out of range", idx)
+	}
+	r := checkpointRanges(idx + 1)[idx]
+	if r.stop >= len(c.blockHashes) {
+		return fmt.Errorf("checkpoint height %d beyond block chain tip", r.stop)
+	}
+	if len(msg.FilterHashes) != r.stop-r.start+1 {
+		return fmt.Errorf("cfheaders for range %d-%d has %d hashes", r.start, r.stop, len(msg.FilterHashes))
+	}
+	if msg.StopHash != c.blockHashes[r.stop] {
+		return fmt.Errorf("cfheaders stop hash %x does not match block at height %d", msg.StopHash, r.stop)
+	}
+
+	var prev [32]byte
+	if idx > 0 {
+		prev = checkpoints[idx-1]
+	}
+	if msg.PrevFilterHeader != prev {
+		return fmt.Errorf("%w: previous filter header for range %d-%d", ErrCheckpointMismatch, r.start, r.stop)
+	}
+	for _, fh := range msg.FilterHashes {
+		prev = DeriveFilterHeader(fh, prev)
+	}
+	if prev != checkpoints[idx] {
+		return fmt.Errorf("%w: derived header at height %d", ErrCheckpointMismatch, r.stop)
+	}
+	return nil
+}
+
+// trimToTip drops the hashes of a verified range that overlap headers we already hold,
+// after checking the overlap derives to our current tip
+func (c *CFHeaderChain) trimToTip(msg CfHeadersMessage, start int) (CfHeadersMessage, error) {
+	skip := c.Height() + 1 - start
+	if skip <= 0 {
+		return msg, nil
+	}
+	prev := msg.PrevFilterHeader
+	for _, fh := range msg.FilterHashes[:skip] {
+		prev = DeriveFilterHeader(fh, prev)
+	}
+	ours, _ := c.FilterHeader(c.Height())
+	if prev != ours {
+		return CfHeadersMessage{}, fmt.Errorf("%w: existing header at height %d", ErrCheckpointMismatch, c.Height())
+	}
+	msg.PrevFilterHeader = prev
+	msg.FilterHashes = msg.FilterHashes[skip:]
+	return msg, nil
+}
+
+// fetchCheckpointRange requests the cfheaders ending at checkpoint idx from one peer
+func (c *CFHeaderChain) fetchCheckpointRange(node *SimpleNode, checkpoints [][32]byte, idx int, timeout time.Duration) (CfHeadersMessage, error) {
+	r := checkpointRanges(idx + 1)[idx]
+	req := &GetCfHeadersMessage{
+		FType:       BASIC,
+		StartHeight: uint32(r.start),
+		StopHash:    c.blockHashes[r.stop],
+	}
+	resp, err := node.SendAndWait(req, "cfheaders", timeout)
+	if err != nil {
+		return CfHeadersMessage{}, err
+	}
+	msg := *resp.(*CfHeadersMessage)
+	if err := c.VerifyCheckpointRange(msg, checkpoints, idx); err != nil {
+		return CfHeadersMessage{}, err
+	}
+	return msg, nil
+}
+
+// SyncWithCheckpoints fetches checkpoints from every peer, requires them to agree, then
+// fills the ranges between checkpoints in parallel across peers. Each range is verified
+// against its bracketing checkpoints as it arrives; a peer that sends a bad range is dropped
+// and its range handed to another peer. Headers past the last checkpoint are synced from
+// the first remaining peer.
+func (c *CFHeaderChain) SyncWithCheckpoints(nodes []*SimpleNode, timeout time.Duration) error {
+	if len(nodes) == 0 {
+		return errors.New("no peers to sync from")
+	}
+	if len(c.blockHashes) == 0 {
+		return errors.New("empty block header chain")
+	}
+	tip := c.blockHashes[len(c.blockHashes)-1]
+
+	peerCheckpoints := make([][][32]byte, len(nodes))
+	for i, node := range nodes {
+		cps, err := FetchCfCheckpoints(node, tip, timeout)
+		if err != nil {
+			return fmt.Errorf("peer %d checkpoints: %w", i, err)
+		}
+		peerCheckpoints[i] = cps
+	}
+	checkpoints, err := AgreeCheckpoints(peerCheckpoints)
+	if err != nil {
+		return err
+	}
+	if expected := (len(c.blockHashes) - 1) / CFCHECKPT_INTERVAL; len(checkpoints) != expected {
+		return fmt.Errorf("got %d checkpoints, expected %d", len(checkpoints), expected)
+	}
+
+	// skip ranges we already have
+	pending := []int{}
+	for i := range checkpoints {
+		if CheckpointHeight(i) > c.Height() {
+			pending = append(pending, i)
+		}
+	}
+
+	results := make([]*CfHeadersMessage, len(checkpoints))
+	live := nodes
+	for len(pending) > 0 {
+		if len(live) == 0 {
+			return errors.New("no peers left to fetch filter headers from")
+		}
+
+		var (
+			mu     sync.Mutex
+			wg     sync.WaitGroup
+			failed []int
+			next   []*SimpleNode
+		)
+		jobs := make(chan int, len(pending))
+		for _, idx := range pending {
+			jobs <- idx
+		}
+		close(jobs)
+
+		for _, node := range live {
+			wg.Add(1)
+			go func(node *SimpleNode) {
+				defer wg.Done()
+				for idx := range jobs {
+					msg, err := c.fetchCheckpointRange(node, checkpoints, idx, timeout)
+					mu.Lock()
+					if err != nil {
+						if node.Logging {
+							fmt.Printf("Dropping peer after bad cfheaders range %d: %v\n", idx, err)
+						}
+						failed = append(failed, idx)
+						mu.Unlock()
+						return
+					}
+					results[idx] = &msg
+					mu.Unlock()
+				}
+				mu.Lock()
+				next = append(next, node)
+				mu.Unlock()
+			}(node)
+		}
+		wg.Wait()
+
+		// ranges left queued when every peer failed
+		for idx := range jobs {
+			failed = append(failed, idx)
+		}
+		pending = failed
+		live = next
+	}
+
+	// apply verified ranges in height order
+	for i, msg := range results {
+		if msg == nil {
+			continue
+		}
+		r := checkpointRanges(i + 1)[i]
+		trimmed, err := c.trimToTip(*msg, r.start)
+		if err != nil {
+			return err
+		}
+		if err := c.AddCfHeaders(trimmed, c.Height()+1); err != nil {
+			return err
+		}
+	}
+
+	if len(live) == 0 {
+		return errors.New("no peers left to sync remaining filter headers")
+	}
+	return c.Sync(live[0], timeout)
+}
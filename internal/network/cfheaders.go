@@ -0,0 +1,210 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/encoding"
+	"time"
+)
+
+// BIP157 batch limits
+const (
+	MAX_CFHEADERS_PER_BATCH int = 2000 // max filter hashes in one cfheaders response
+	MAX_CFILTERS_PER_BATCH  int = 1000 // max cfilter responses to one getcfilters
+	CFHEADERS_BATCH_SIZE    int = 1000 // batch size we request (matches checkpoint interval)
+)
+
+var ErrFilterHeaderMismatch = errors.New("filter header mismatch")
+
+// FilterHash returns the double-SHA256 of a serialized BIP158 filter (internal byte order)
+func FilterHash(filterBytes []byte) [32]byte {
+	return [32]byte(encoding.Hash256(filterBytes))
+}
+
+// DeriveFilterHeader computes Hash256(filter_hash || prev_header) per BIP157
+func DeriveFilterHeader(filterHash, prevHeader [32]byte) [32]byte {
+	data := make([]byte, 0, 64)
+	data = append(data, filterHash[:]...)
+	data = append(data, prevHeader[:]...)
+	return [32]byte(encoding.Hash256(data))
+}
+
+// CFHeaderChain tracks the BIP157 filter header chain alongside a block header chain.
+// Block hashes are indexed by height (index 0 = genesis) in internal byte order.
+type CFHeaderChain struct {
+	blockHashes  [][32]byte
+	heights      map[[32]byte]int
+	filterHashes [][32]byte // committed filter hash per height
+	headers      [][32]byte // derived filter header per height
+}
+
+func NewCFHeaderChain(blockHashes [][32]byte) *CFHeaderChain {
+	c := &CFHeaderChain{
+		heights: make(map[[32]byte]int, len(blockHashes)),
+	}
+	c.ExtendBlocks(blockHashes)
+	return c
+}
+
+// ExtendBlocks appends newly synced block hashes to the underlying header chain
+func (c *CFHeaderChain) ExtendBlocks(blockHashes [][32]byte) {
+	for _, h := range blockHashes {
+		c.heights[h] = len(c.blockHashes)
+		c.blockHashes = append(c.blockHashes, h)
+	}
+}
+
+// BlockHeight returns the height of the block with the given hash, or -1 if unknown
+func (c *CFHeaderChain) BlockHeight(blockHash [32]byte) int {
+	h, ok := c.heights[blockHash]
+	if !ok {
+		return -1
+	}
+	return h
+}
+
+// Height returns the height of the last verified filter header, or -1 if none
+func (c *CFHeaderChain) Height() int {
+	return len(c.headers) - 1
+}
+
+// BlockCount returns the number of blocks in the underlying header chain
+func (c *CFHeaderChain) BlockCount() int {
+	return len(c.blockHashes)
+}
+
+// FilterHeader returns the filter header at height
+func (c *CFHeaderChain) FilterHeader(height int) ([32]byte, bool) {
+	if height < 0 || height >= len(c.headers) {
+		return [32]byte{}, false
+	}
+	return c.headers[height], true
+}
+
+// prevHeader returns the filter header preceding height (zero hash before genesis)
+func (c *CFHeaderChain) prevHeader(height int) ([32]byte, error) {
+	if height == 0 {
+		return [32]byte{}, nil
+	}
+	prev, ok := c.FilterHeader(height - 1)
+	if !ok {
+		return [32]byte{}, fmt.Errorf("no filter header at height %d", height-1)
+	}
+	return prev, nil
+}
+
+// AddCfHeaders verifies a cfheaders response covering [startHeight, startHeight+len) and appends
+// the derived headers. The response must continue from our last header and stop at the block
+// our header chain has at the final height.
+func (c *CFHeaderChain) AddCfHeaders(msg CfHeadersMessage, startHeight int) error {
+	if msg.FType != BASIC {
+		return fmt.Errorf("unsupported filter type: %d", msg.FType)
+	}
+	if startHeight != len(c.headers) {
+		return fmt.Errorf("cfheaders start height %d does not extend chain at height %d", startHeight, c.Height())
+	}
+	if len(msg.FilterHashes) == 0 {
+		return errors.New("cfheaders response contains no filter hashes")
+	}
+	if len(msg.FilterHashes) > MAX_CFHEADERS_PER_BATCH {
+		return fmt.Errorf("cfheaders response too large: %d hashes (max %d)", len(msg.FilterHashes), MAX_CFHEADERS_PER_BATCH)
+	}
+
+	stopHeight := startHeight + len(msg.FilterHashes) - 1
+	if stopHeight >= len(c.blockHashes) {
+		return fmt.Errorf("cfheaders extend past block chain tip: stop height %d, tip %d", stopHeight, len(c.blockHashes)-1)
+	}
+	if c.blockHashes[stopHeight] != msg.StopHash {
+		return fmt.Errorf("cfheaders stop hash %x does not match block at height %d", msg.StopHash, stopHeight)
+	}
+
+	prev, err := c.prevHeader(startHeight)
+	if err != nil {
+		return err
+	}
+	if msg.PrevFilterHeader != prev {
+		return fmt.Errorf("%w: previous filter header at height %d", ErrFilterHeaderMismatch, startHeight-1)
+	}
+
+	headers := make([][32]byte, len(msg.FilterHashes))
+	for i, fh := range msg.FilterHashes {
+		prev = DeriveFilterHeader(fh, prev)
+		headers[i] = prev
+	}
+
+	c.filterHashes = append(c.filterHashes, msg.FilterHashes...)
+	c.headers = append(c.headers, headers...)
+	return nil
+}
+
+// VerifyCFilter checks that a cfilter payload hashes to the filter hash committed
+// in the verified header chain for that block
+func (c *CFHeaderChain) VerifyCFilter(msg CFilterMessage) error {
+	if msg.FType != BASIC {
+		return fmt.Errorf("unsupported filter type: %d", msg.FType)
+	}
+	height := c.BlockHeight(msg.BlockHash)
+	if height < 0 {
+		return fmt.Errorf("cfilter for unknown block %x", msg.BlockHash)
+	}
+	if height >= len(c.filterHashes) {
+		return fmt.Errorf("no verified filter header for height %d", height)
+	}
+	got := FilterHash(msg.FilterBytes)
+	if got != c.filterHashes[height] {
+		return fmt.Errorf("%w: cfilter at height %d hashes to %x, committed %x", ErrFilterHeaderMismatch, height, got, c.filterHashes[height])
+	}
+	return nil
+}
+
+// Sync requests cfheaders from the peer in CFHEADERS_BATCH_SIZE batches until the filter
+// header chain reaches the tip of the block header chain
+func (c *CFHeaderChain) Sync(node *SimpleNode, timeout time.Duration) error {
+	for len(c.headers) < len(c.blockHashes) {
+		start := len(c.headers)
+		stop := min(start+CFHEADERS_BATCH_SIZE, len(c.blockHashes)) - 1
+
+		req := &GetCfHeadersMessage{
+			FType:       BASIC,
+			StartHeight: uint32(start),
+			StopHash:    c.blockHashes[stop],
+		}
+		resp, err := node.SendAndWait(req, "cfheaders", timeout)
+		if err != nil {
+			return fmt.Errorf("cfheaders %d-%d: %w", start, stop, err)
+		}
+		if err := c.AddCfHeaders(*resp.(*CfHeadersMessage), start); err != nil {
+			return err
+		}
+		if node.Logging {
+			fmt.Printf("Synced filter headers to height %d\n", c.Height())
+		}
+	}
+	return nil
+}
+
+// GetFilter requests the basic filter for the block at height and rejects it unless it
+// matches the verified filter header chain
+func (c *CFHeaderChain) GetFilter(node *SimpleNode, height int, timeout time.Duration) (*GolombCodedSet, error) {
+	if height < 0 || height >= len(c.filterHashes) {
+		return nil, fmt.Errorf("no verified filter header for height %d", height)
+	}
+	if !node.CanServeBlock(int32(height)) {
+		return nil, &NoBlockPeerError{Height: int32(height), Peers: 1}
+	}
+	req := &GetCFilterMessage{
+		FType:       BASIC,
+		StartHeight: uint32(height),
+		StopHash:    c.blockHashes[height],
+	}
+	resp, err := node.SendAndWait(req, "cfilter", timeout)
+	if err != nil {
+		return nil, err
+	}
+	msg := *resp.(*CFilterMessage)
+	if err := c.VerifyCFilter(msg); err != nil {
+		return nil, err
+	}
+	return ParseGCSFilter(bytes.NewReader(msg.FilterBytes))
+}
@@ -0,0 +1,381 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-bitcoin/internal/block"
+	"net"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func decodeDisplayHash(t *testing.T, s string) [32]byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		t.Fatalf("bad hash hex %q: %v", s, err)
+	}
+	slices.Reverse(b)
+	return [32]byte(b)
+}
+
+func TestDeriveFilterHeaderBIP158Vectors(t *testing.T) {
+	data, err := os.ReadFile("testdata/bip158-vectors.json")
+	if err != nil {
+		t.Skip("Test vectors not found")
+	}
+	var vectors []BIP158TestVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("Failed to parse test vectors: %v", err)
+	}
+
+	for _, vec := range vectors {
+		t.Run(vec.Notes, func(t *testing.T) {
+			filter, err := hex.DecodeString(vec.BasicFilter)
+			if err != nil {
+				t.Fatalf("Failed to decode filter: %v", err)
+			}
+			prev := decodeDisplayHash(t, vec.PreviousBasicHeader)
+			want := decodeDisplayHash(t, vec.BasicHeader)
+
+			got := DeriveFilterHeader(FilterHash(filter), prev)
+			if got != want {
+				t.Fatalf("filter header mismatch at height %d: got %x, want %x", vec.BlockHeight, got, want)
+			}
+			t.Logf("✓ Height %d filter header matches", vec.BlockHeight)
+		})
+	}
+}
+
+// buildTestChain returns n fake block hashes and n fake filters
+func buildTestChain(n int) ([][32]byte, [][]byte) {
+	blocks := make([][32]byte, n)
+	filters := make([][]byte, n)
+	for i := range n {
+		blocks[i] = [32]byte{byte(i), byte(i >> 8), 0xbb}
+		filters[i] = []byte{0x01, byte(i), byte(i >> 8)}
+	}
+	return blocks, filters
+}
+
+func cfHeadersFor(blocks [][32]byte, filters [][]byte, start, stop int, prev [32]byte) CfHeadersMessage {
+	msg := CfHeadersMessage{
+		FType:            BASIC,
+		StopHash:         blocks[stop],
+		PrevFilterHeader: prev,
+	}
+	for i := start; i <= stop; i++ {
+		msg.FilterHashes = append(msg.FilterHashes, FilterHash(filters[i]))
+	}
+	return msg
+}
+
+func TestCFHeaderChainBatches(t *testing.T) {
+	blocks, filters := buildTestChain(2500)
+	chain := NewCFHeaderChain(blocks)
+
+	for start := 0; start < len(blocks); start += CFHEADERS_BATCH_SIZE {
+		stop := min(start+CFHEADERS_BATCH_SIZE, len(blocks)) - 1
+		prev, _ := chain.FilterHeader(start - 1)
+		msg := cfHeadersFor(blocks, filters, start, stop, prev)
+		if err := chain.AddCfHeaders(msg, start); err != nil {
+			t.Fatalf("batch %d-%d rejected: %v", start, stop, err)
+		}
+	}
+	if chain.Height() != len(blocks)-1 {
+		t.Fatalf("expected height %d, got %d", len(blocks)-1, chain.Height())
+	}
+
+	// header at every height is the running derivation from the zero hash
+	var expected [32]byte
+	for i := range filters {
+		expected = DeriveFilterHeader(FilterHash(filters[i]), expected)
+	}
+	tip, _ := chain.FilterHeader(chain.Height())
+	if tip != expected {
+		t.Fatalf("tip header mismatch: got %x, want %x", tip, expected)
+	}
+
+	// matching filters verify, tampered filters are rejected
+	good := CFilterMessage{FType: BASIC, BlockHash: blocks[1234], FilterBytes: filters[1234]}
+	if err := chain.VerifyCFilter(good); err != nil {
+		t.Fatalf("valid cfilter rejected: %v", err)
+	}
+	bad := CFilterMessage{FType: BASIC, BlockHash: blocks[1234], FilterBytes: filters[1235]}
+	if err := chain.VerifyCFilter(bad); !errors.Is(err, ErrFilterHeaderMismatch) {
+		t.Fatalf("expected ErrFilterHeaderMismatch, got %v", err)
+	}
+	t.Logf("✓ Synced %d filter headers in batches", chain.Height()+1)
+}
+
+func TestCFHeaderChainRejects(t *testing.T) {
+	blocks, filters := buildTestChain(10)
+
+	tests := []struct {
+		name  string
+		msg   func(c *CFHeaderChain) CfHeadersMessage
+		start int
+	}{
+		{
+			name:  "wrong previous header",
+			msg:   func(c *CFHeaderChain) CfHeadersMessage { return cfHeadersFor(blocks, filters, 5, 9, [32]byte{0xff}) },
+			start: 5,
+		},
+		{
+			name: "wrong stop hash",
+			msg: func(c *CFHeaderChain) CfHeadersMessage {
+				prev, _ := c.FilterHeader(4)
+				m := cfHeadersFor(blocks, filters, 5, 9, prev)
+				m.StopHash = blocks[8]
+				return m
+			},
+			start: 5,
+		},
+		{
+			name: "gap in chain",
+			msg: func(c *CFHeaderChain) CfHeadersMessage {
+				prev, _ := c.FilterHeader(4)
+				return cfHeadersFor(blocks, filters, 6, 9, prev)
+			},
+			start: 6,
+		},
+		{
+			name: "past block tip",
+			msg: func(c *CFHeaderChain) CfHeadersMessage {
+				prev, _ := c.FilterHeader(4)
+				m := cfHeadersFor(blocks, filters, 5, 9, prev)
+				m.FilterHashes = append(m.FilterHashes, [32]byte{})
+				return m
+			},
+			start: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := NewCFHeaderChain(blocks)
+			if err := chain.AddCfHeaders(cfHeadersFor(blocks, filters, 0, 4, [32]byte{}), 0); err != nil {
+				t.Fatalf("initial batch rejected: %v", err)
+			}
+			if err := chain.AddCfHeaders(tt.msg(chain), tt.start); err == nil {
+				t.Fatalf("expected %s to be rejected", tt.name)
+			}
+			if chain.Height() != 4 {
+				t.Fatalf("rejected batch modified chain: height %d", chain.Height())
+			}
+		})
+	}
+}
+
+func TestCheckpointRanges(t *testing.T) {
+	blocks, filters := buildTestChain(3500)
+
+	// checkpoints are the running filter header at every 1000th height
+	var checkpoints [][32]byte
+	var header [32]byte
+	for i := range filters {
+		header = DeriveFilterHeader(FilterHash(filters[i]), header)
+		if i > 0 && i%CFCHECKPT_INTERVAL == 0 {
+			checkpoints = append(checkpoints, header)
+		}
+	}
+
+	agreed, err := AgreeCheckpoints([][][32]byte{checkpoints, slices.Clone(checkpoints)})
+	if err != nil {
+		t.Fatalf("matching checkpoints rejected: %v", err)
+	}
+	forked := slices.Clone(checkpoints)
+	forked[1] = [32]byte{0xde, 0xad}
+	if _, err := AgreeCheckpoints([][][32]byte{checkpoints, forked}); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Fatalf("expected ErrCheckpointMismatch, got %v", err)
+	}
+
+	chain := NewCFHeaderChain(blocks)
+	ranges := checkpointRanges(len(agreed))
+
+	// verify ranges out of order, as parallel fetches would arrive
+	verified := make([]CfHeadersMessage, len(ranges))
+	for _, idx := range []int{2, 0, 1} {
+		r := ranges[idx]
+		var prev [32]byte
+		if idx > 0 {
+			prev = agreed[idx-1]
+		}
+		msg := cfHeadersFor(blocks, filters, r.start, r.stop, prev)
+		if err := chain.VerifyCheckpointRange(msg, agreed, idx); err != nil {
+			t.Fatalf("range %d rejected: %v", idx, err)
+		}
+		verified[idx] = msg
+	}
+
+	// a tampered filter hash no longer derives to the checkpoint
+	tampered := cfHeadersFor(blocks, filters, ranges[1].start, ranges[1].stop, agreed[0])
+	tampered.FilterHashes[10] = [32]byte{0x01}
+	if err := chain.VerifyCheckpointRange(tampered, agreed, 1); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Fatalf("expected ErrCheckpointMismatch, got %v", err)
+	}
+
+	// apply in order on top of a partially synced chain
+	if err := chain.AddCfHeaders(cfHeadersFor(blocks, filters, 0, 499, [32]byte{}), 0); err != nil {
+		t.Fatalf("initial batch rejected: %v", err)
+	}
+	for i, msg := range verified {
+		trimmed, err := chain.trimToTip(msg, ranges[i].start)
+		if err != nil {
+			t.Fatalf("trim range %d: %v", i, err)
+		}
+		if err := chain.AddCfHeaders(trimmed, chain.Height()+1); err != nil {
+			t.Fatalf("apply range %d: %v", i, err)
+		}
+	}
+	got, _ := chain.FilterHeader(3000)
+	if got != agreed[2] {
+		t.Fatalf("header at 3000 = %x, want checkpoint %x", got, agreed[2])
+	}
+	t.Logf("✓ Filled %d checkpoint ranges to height %d", len(ranges), chain.Height())
+}
+
+// testFilterSource serves a linear chain of coinbase-only blocks from memory
+type testFilterSource struct {
+	hashes [][32]byte
+	raw    map[[32]byte][]byte
+}
+
+func newTestFilterSource(t *testing.T, n int) *testFilterSource {
+	headers, raw := mineTestChain(t, [32]byte{}, n)
+	src := &testFilterSource{raw: make(map[[32]byte][]byte)}
+	for i := range headers {
+		hash, _ := headers[i].Hash()
+		src.hashes = append(src.hashes, [32]byte(hash))
+		src.raw[[32]byte(hash)] = raw[i]
+	}
+	return src
+}
+
+func (s *testFilterSource) RawBlock(hash [32]byte) ([]byte, int, bool) {
+	raw, ok := s.raw[hash]
+	return raw, slices.Index(s.hashes, hash), ok
+}
+
+func (s *testFilterSource) Tip() (int, *block.Block) {
+	return len(s.hashes) - 1, nil
+}
+
+func (s *testFilterSource) HashAt(height int) ([32]byte, bool) {
+	if height < 0 || height >= len(s.hashes) {
+		return [32]byte{}, false
+	}
+	return s.hashes[height], true
+}
+
+func (s *testFilterSource) SpentScripts(hash [32]byte) ([][]byte, bool) {
+	_, ok := s.raw[hash] // coinbase-only blocks spend nothing
+	return nil, ok
+}
+
+func TestServeCompactFilters(t *testing.T) {
+	src := newTestFilterSource(t, 12)
+	serverConn, clientConn := net.Pipe()
+	server := newSimpleNodeWithConn(serverConn, [16]byte{}, MAINNET_PORT, false, false, WithFilterIndex(NewFilterIndex(src)))
+	client := newSimpleNodeWithConn(clientConn, [16]byte{}, MAINNET_PORT, false, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	if !HasServices(server.Services, NODE_COMPACT_FILTERS) {
+		t.Fatal("expected NODE_COMPACT_FILTERS to be advertised")
+	}
+	client.PeerServices = server.Services | NODE_NETWORK // as learned in the handshake
+
+	// the client verifies every served filter against the served header chain
+	chain := NewCFHeaderChain(src.hashes)
+	if err := chain.Sync(client, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if chain.Height() != len(src.hashes)-1 {
+		t.Fatalf("synced filter headers to %d, want %d", chain.Height(), len(src.hashes)-1)
+	}
+	for _, h := range []int{0, 7, 11} {
+		if _, err := chain.GetFilter(client, h, time.Second); err != nil {
+			t.Fatalf("filter at height %d: %v", h, err)
+		}
+	}
+	t.Logf("✓ Served %d verified filter headers", chain.Height()+1)
+}
+
+func TestBasicFilterBIP158Vectors(t *testing.T) {
+	data, err := os.ReadFile("testdata/bip158-vectors.json")
+	if err != nil {
+		t.Skip("Test vectors not found")
+	}
+	var vectors []BIP158TestVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	for _, vec := range vectors {
+		raw, _ := hex.DecodeString(vec.Block)
+		fb, err := block.ParseFullBlock(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spent [][]byte
+		for _, s := range vec.PreviousOutputScripts {
+			b, _ := hex.DecodeString(s)
+			spent = append(spent, b)
+		}
+		gcs, err := BasicFilter(fb, spent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := gcs.Serialize()
+		if hex.EncodeToString(got) != vec.BasicFilter {
+			t.Errorf("%s: filter %x, want %s", vec.Notes, got, vec.BasicFilter)
+		}
+	}
+	t.Logf("✓ %d filters built from block and undo data", len(vectors))
+}
+
+func TestFetchCfHeadersRange(t *testing.T) {
+	src := newTestFilterSource(t, 2200)
+	idx := NewFilterIndex(src)
+	var peers []*SimpleNode
+	for range 2 {
+		serverConn, clientConn := net.Pipe()
+		server := newSimpleNodeWithConn(serverConn, [16]byte{}, MAINNET_PORT, false, false, WithFilterIndex(idx))
+		client := newSimpleNodeWithConn(clientConn, [16]byte{}, MAINNET_PORT, false, false)
+		t.Cleanup(func() {
+			client.Close()
+			server.Close()
+		})
+		peers = append(peers, client)
+	}
+	silent, remote := newPipeNode(t)
+	go ignoreAll(remote)
+	peers = append(peers, silent)
+
+	if got := splitRange(50, 2199, CFHEADERS_BATCH_SIZE); !slices.Equal(got, []checkpointRange{{50, 1049}, {1050, 2049}, {2050, 2199}}) {
+		t.Fatalf("unexpected batches: %v", got)
+	}
+
+	chain := NewCFHeaderChain(src.hashes)
+	r, err := chain.FetchCfHeaders(peers, 50, src.hashes[2199], 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StartHeight != 50 || r.StopHeight() != 2199 {
+		t.Fatalf("got range %d-%d", r.StartHeight, r.StopHeight())
+	}
+	want, _ := idx.Header(2199)
+	if headers := r.Headers(); headers[len(headers)-1] != want {
+		t.Fatal("stitched range does not end on the served filter header")
+	}
+
+	if _, err := chain.FetchCfHeaders([]*SimpleNode{silent}, 0, src.hashes[10], 20*time.Millisecond); err == nil {
+		t.Fatal("expected failure with only an unresponsive peer")
+	}
+	t.Logf("✓ Fetched %d filter hashes in %d batches", len(r.FilterHashes), 3)
+}
@@ -0,0 +1,159 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CfHeaderRange is a verified, contiguous run of filter hashes starting at StartHeight
+type CfHeaderRange struct {
+	StartHeight      int
+	PrevFilterHeader [32]byte // filter header at StartHeight-1 (zero for genesis)
+	FilterHashes     [][32]byte
+}
+
+// StopHeight returns the height of the last filter hash in the range
+func (r *CfHeaderRange) StopHeight() int {
+	return r.StartHeight + len(r.FilterHashes) - 1
+}
+
+// Headers derives the filter headers for the range
+func (r *CfHeaderRange) Headers() [][32]byte {
+	headers := make([][32]byte, len(r.FilterHashes))
+	prev := r.PrevFilterHeader
+	for i, fh := range r.FilterHashes {
+		prev = DeriveFilterHeader(fh, prev)
+		headers[i] = prev
+	}
+	return headers
+}
+
+// splitRange cuts [start, stop] into consecutive ranges of at most size heights
+func splitRange(start, stop, size int) []checkpointRange {
+	var ranges []checkpointRange
+	for s := start; s <= stop; s += size {
+		ranges = append(ranges, checkpointRange{start: s, stop: min(s+size-1, stop)})
+	}
+	return ranges
+}
+
+// FetchCfHeaders downloads filter hashes for [startHeight, height of stopHash] from any
+// range length, split into getcfheaders batches of CFHEADERS_BATCH_SIZE that are spread
+// over the peers. A peer that fails a batch is dropped and the batch handed to another.
+// The batches must stitch together: each has to build on the filter header derived from
+// the one before it, and the first on our own header at startHeight-1 if we have it.
+// The chain itself is not modified.
+func (c *CFHeaderChain) FetchCfHeaders(peers []*SimpleNode, startHeight int, stopHash [32]byte, timeout time.Duration) (*CfHeaderRange, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers to fetch filter headers from")
+	}
+	stop, ok := c.heights[stopHash]
+	if !ok {
+		return nil, fmt.Errorf("stop hash %x not in block header chain", stopHash)
+	}
+	if startHeight < 0 || startHeight > stop {
+		return nil, fmt.Errorf("invalid range %d-%d", startHeight, stop)
+	}
+
+	batches := splitRange(startHeight, stop, CFHEADERS_BATCH_SIZE)
+	results := make([]*CfHeadersMessage, len(batches))
+	pending := make([]int, len(batches))
+	for i := range pending {
+		pending[i] = i
+	}
+	live := peers
+	for len(pending) > 0 {
+		if len(live) == 0 {
+			return nil, errors.New("no peers left to fetch filter headers from")
+		}
+
+		var (
+			mu     sync.Mutex
+			wg     sync.WaitGroup
+			failed []int
+			next   []*SimpleNode
+		)
+		jobs := make(chan int, len(pending))
+		for _, idx := range pending {
+			jobs <- idx
+		}
+		close(jobs)
+
+		for _, node := range live {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for idx := range jobs {
+					msg, err := c.fetchBatch(node, batches[idx], timeout)
+					mu.Lock()
+					if err != nil {
+						if node.Logging {
+							fmt.Printf("Dropping peer after bad cfheaders batch %d-%d: %v\n", batches[idx].start, batches[idx].stop, err)
+						}
+						failed = append(failed, idx)
+						mu.Unlock()
+						return
+					}
+					results[idx] = &msg
+					mu.Unlock()
+				}
+				mu.Lock()
+				next = append(next, node)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		// batches left queued when every peer failed
+		for idx := range jobs {
+			failed = append(failed, idx)
+		}
+		pending = failed
+		live = next
+	}
+
+	r := &CfHeaderRange{StartHeight: startHeight, PrevFilterHeader: results[0].PrevFilterHeader}
+	if startHeight <= len(c.headers) {
+		prev, err := c.prevHeader(startHeight)
+		if err != nil {
+			return nil, err
+		}
+		if r.PrevFilterHeader != prev {
+			return nil, fmt.Errorf("%w: previous filter header at height %d", ErrFilterHeaderMismatch, startHeight-1)
+		}
+	}
+	prev := r.PrevFilterHeader
+	for i, msg := range results {
+		if msg.PrevFilterHeader != prev {
+			return nil, fmt.Errorf("%w: batch at height %d does not continue the previous batch", ErrFilterHeaderMismatch, batches[i].start)
+		}
+		for _, fh := range msg.FilterHashes {
+			prev = DeriveFilterHeader(fh, prev)
+		}
+		r.FilterHashes = append(r.FilterHashes, msg.FilterHashes...)
+	}
+	return r, nil
+}
+
+// fetchBatch requests one batch and checks it covers exactly the requested heights
+func (c *CFHeaderChain) fetchBatch(node *SimpleNode, b checkpointRange, timeout time.Duration) (CfHeadersMessage, error) {
+	req := &GetCfHeadersMessage{
+		FType:       BASIC,
+		StartHeight: uint32(b.start),
+		StopHash:    c.blockHashes[b.stop],
+	}
+	resp, err := node.SendAndWait(req, "cfheaders", timeout)
+	if err != nil {
+		return CfHeadersMessage{}, err
+	}
+	msg := *resp.(*CfHeadersMessage)
+	if msg.FType != BASIC {
+		return CfHeadersMessage{}, fmt.Errorf("unsupported filter type: %d", msg.FType)
+	}
+	if len(msg.FilterHashes) != b.stop-b.start+1 {
+		return CfHeadersMessage{}, fmt.Errorf("cfheaders for %d-%d has %d hashes", b.start, b.stop, len(msg.FilterHashes))
+	}
+	return msg, nil
+}
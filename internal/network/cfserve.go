@@ -0,0 +1,239 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"go-bitcoin/internal/block"
+	"sync"
+)
+
+// FilterBlockSource is a BlockSource that can back BIP 157 filter serving: it knows the
+// main chain by height and keeps undo data, since basic filters commit to the scripts
+// each block's inputs spend
+type FilterBlockSource interface {
+	BlockSource
+	// HashAt returns the hash (internal byte order) of the main chain block at height
+	HashAt(height int) ([32]byte, bool)
+	// SpentScripts returns the scriptPubKeys of the outputs spent by the block's inputs
+	SpentScripts(hash [32]byte) ([][]byte, bool)
+}
+
+// BasicFilter builds the BIP 158 basic filter for a block. The SipHash key is the first
+// 16 bytes of the block hash (internal byte order).
+func BasicFilter(fb *block.FullBlock, spentScripts [][]byte) (*GolombCodedSet, error) {
+	hash, err := fb.BlockHeader.Hash()
+	if err != nil {
+		return nil, err
+	}
+	k0 := binary.LittleEndian.Uint64(hash[0:8])
+	k1 := binary.LittleEndian.Uint64(hash[8:16])
+	return NewGCS(fb.ExtractBasicFilterItems(spentScripts), k0, k1)
+}
+
+// FilterIndex computes basic filters from a FilterBlockSource and caches them along with
+// the filter header chain, which is extended from genesis as far as requests need
+type FilterIndex struct {
+	Source FilterBlockSource
+
+	mu      sync.Mutex
+	filters map[[32]byte][]byte // serialized filter by block hash
+	hashes  [][32]byte          // filter hash by height
+	headers [][32]byte          // filter header by height
+}
+
+func NewFilterIndex(source FilterBlockSource) *FilterIndex {
+	return &FilterIndex{
+		Source:  source,
+		filters: make(map[[32]byte][]byte),
+	}
+}
+
+// Filter returns the serialized basic filter for the block with hash
+func (fi *FilterIndex) Filter(hash [32]byte) ([]byte, error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.filter(hash)
+}
+
+func (fi *FilterIndex) filter(hash [32]byte) ([]byte, error) {
+	if f, ok := fi.filters[hash]; ok {
+		return f, nil
+	}
+	raw, _, ok := fi.Source.RawBlock(hash)
+	if !ok {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	spent, ok := fi.Source.SpentScripts(hash)
+	if !ok {
+		return nil, fmt.Errorf("no undo data for block %x", hash)
+	}
+	fb, err := block.ParseFullBlock(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	gcs, err := BasicFilter(fb, spent)
+	if err != nil {
+		return nil, err
+	}
+	f, err := gcs.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	fi.filters[hash] = f
+	return f, nil
+}
+
+// extendHeaders computes filter hashes and headers up to height. Caller holds mu.
+func (fi *FilterIndex) extendHeaders(height int) error {
+	for h := len(fi.headers); h <= height; h++ {
+		hash, ok := fi.Source.HashAt(h)
+		if !ok {
+			return fmt.Errorf("no block at height %d", h)
+		}
+		f, err := fi.filter(hash)
+		if err != nil {
+			return err
+		}
+		var prev [32]byte
+		if h > 0 {
+			prev = fi.headers[h-1]
+		}
+		filterHash := FilterHash(f)
+		fi.hashes = append(fi.hashes, filterHash)
+		fi.headers = append(fi.headers, DeriveFilterHeader(filterHash, prev))
+	}
+	return nil
+}
+
+// Header returns the filter header at height
+func (fi *FilterIndex) Header(height int) ([32]byte, error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if err := fi.extendHeaders(height); err != nil {
+		return [32]byte{}, err
+	}
+	return fi.headers[height], nil
+}
+
+// WithFilterIndex answers getcfilters, getcfheaders and getcfcheckpt from idx and
+// advertises NODE_COMPACT_FILTERS (apply after WithServices)
+func WithFilterIndex(idx *FilterIndex) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.FilterIndex = idx
+		sn.Services |= NODE_COMPACT_FILTERS
+	}
+}
+
+// filterRange resolves a BIP 157 request to the heights it covers, enforcing the
+// per-message limit
+func (sn *SimpleNode) filterRange(ftype FilterType, start uint32, stopHash [32]byte, limit int) (int, error) {
+	if ftype != BASIC {
+		return 0, fmt.Errorf("unsupported filter type %d", ftype)
+	}
+	_, stop, ok := sn.FilterIndex.Source.RawBlock(stopHash)
+	if !ok {
+		return 0, fmt.Errorf("unknown stop hash %x", stopHash)
+	}
+	if int(start) > stop || stop-int(start) >= limit {
+		return 0, fmt.Errorf("invalid range %d-%d", start, stop)
+	}
+	return stop, nil
+}
+
+// handleFilterRequest answers getcfilters, getcfheaders and getcfcheckpt from the filter
+// index. Requests we can't serve are ignored, as Bitcoin Core does.
+func (sn *SimpleNode) handleFilterRequest(env NetworkEnvelope) {
+	if sn.FilterIndex == nil {
+		return
+	}
+	var err error
+	switch env.Command {
+	case "getcfilters":
+		err = sn.serveCFilters(env.Payload)
+	case "getcfheaders":
+		err = sn.serveCfHeaders(env.Payload)
+	case "getcfcheckpt":
+		err = sn.serveCfCheckPt(env.Payload)
+	}
+	if err != nil && sn.Logging {
+		fmt.Printf("Not serving %s: %v\n", env.Command, err)
+	}
+}
+
+// serveCFilters sends one cfilter per block in the requested range
+func (sn *SimpleNode) serveCFilters(payload []byte) error {
+	req, err := ParseGetCFilterMessage(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	stop, err := sn.filterRange(req.FType, req.StartHeight, req.StopHash, MAX_CFILTERS_PER_BATCH)
+	if err != nil {
+		return err
+	}
+	for h := int(req.StartHeight); h <= stop; h++ {
+		hash, ok := sn.FilterIndex.Source.HashAt(h)
+		if !ok {
+			return fmt.Errorf("no block at height %d", h)
+		}
+		f, err := sn.FilterIndex.Filter(hash)
+		if err != nil {
+			return err
+		}
+		if err := sn.Send(&CFilterMessage{FType: req.FType, BlockHash: hash, FilterBytes: f}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveCfHeaders sends the filter hashes in the requested range and the filter header
+// they build on
+func (sn *SimpleNode) serveCfHeaders(payload []byte) error {
+	req, err := ParseGetCfHeadersMessage(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	stop, err := sn.filterRange(req.FType, req.StartHeight, req.StopHash, MAX_CFHEADERS_PER_BATCH)
+	if err != nil {
+		return err
+	}
+
+	fi := sn.FilterIndex
+	resp := &CfHeadersMessage{FType: req.FType, StopHash: req.StopHash}
+	fi.mu.Lock()
+	if err := fi.extendHeaders(stop); err != nil {
+		fi.mu.Unlock()
+		return err
+	}
+	if req.StartHeight > 0 {
+		resp.PrevFilterHeader = fi.headers[req.StartHeight-1]
+	}
+	resp.FilterHashes = append(resp.FilterHashes, fi.hashes[req.StartHeight:stop+1]...)
+	fi.mu.Unlock()
+	return sn.Send(resp)
+}
+
+// serveCfCheckPt sends the filter header at every CFCHECKPT_INTERVAL up to the stop hash
+func (sn *SimpleNode) serveCfCheckPt(payload []byte) error {
+	req, err := ParseGetCfCheckPointMessage(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if req.FType != BASIC {
+		return fmt.Errorf("unsupported filter type %d", req.FType)
+	}
+	_, stop, ok := sn.FilterIndex.Source.RawBlock(req.StopHash)
+	if !ok {
+		return fmt.Errorf("unknown stop hash %x", req.StopHash)
+	}
+	resp := &CfCheckPointMessage{FType: req.FType, StopHash: req.StopHash}
+	for h := CFCHECKPT_INTERVAL; h <= stop; h += CFCHECKPT_INTERVAL {
+		header, err := sn.FilterIndex.Header(h)
+		if err != nil {
+			return err
+		}
+		resp.FilterHeaders = append(resp.FilterHeaders, header)
+	}
+	return sn.Send(resp)
+}
@@ -0,0 +1,186 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/block"
+	"sync"
+)
+
+// FOLLOW_BUFFER is how many headers and block messages a ChainFollower queues per peer
+const FOLLOW_BUFFER int = 16
+
+// ChainFollower keeps a header chain current from the headers and blocks peers send once
+// synced. A header or block whose parent is unknown is parked in Orphans rather than
+// dropped, the missing ancestors are requested with getheaders, and whatever was parked
+// is processed again as soon as its parent connects.
+type ChainFollower struct {
+	Chain   *block.ChainStore
+	Orphans *block.OrphanPool
+	// OnBlock receives each block once its header is in Chain; parked blocks follow
+	// the header that connects them, parents first
+	OnBlock func(height int, fb *block.FullBlock) error
+	Logging bool
+
+	mu sync.Mutex // serializes processing so orphans are reconnected once
+}
+
+func NewChainFollower(chain *block.ChainStore) *ChainFollower {
+	return &ChainFollower{
+		Chain:   chain,
+		Orphans: block.NewOrphanPool(),
+	}
+}
+
+// Follow processes the headers and block messages peer sends until cancel is called or
+// the connection closes
+func (cf *ChainFollower) Follow(peer *SimpleNode) (cancel func()) {
+	headers, cancelHeaders := peer.Subscribe("headers", FOLLOW_BUFFER)
+	blocks, cancelBlocks := peer.Subscribe("block", FOLLOW_BUFFER)
+	go func() {
+		for headers != nil || blocks != nil {
+			var err error
+			select {
+			case env, ok := <-headers:
+				if !ok {
+					headers = nil
+					continue
+				}
+				var msg HeadersMessage
+				if msg, err = ParseHeadersMessage(bytes.NewReader(env.Payload)); err == nil {
+					err = cf.ProcessHeaders(peer, msg.Blocks)
+				}
+			case env, ok := <-blocks:
+				if !ok {
+					blocks = nil
+					continue
+				}
+				var fb *block.FullBlock
+				if fb, err = block.ParseFullBlock(bytes.NewReader(env.Payload)); err == nil {
+					err = cf.ProcessBlock(peer, fb)
+				}
+			}
+			if err != nil && cf.Logging {
+				fmt.Printf("Chain follower: %v\n", err)
+			}
+		}
+	}()
+	return func() {
+		cancelHeaders()
+		cancelBlocks()
+	}
+}
+
+// ProcessHeaders adds headers to the chain, parking those that don't connect and asking
+// peer for the headers between our chain and them
+func (cf *ChainFollower) ProcessHeaders(peer *SimpleNode, headers []block.Block) error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	orphaned := false
+	for _, header := range headers {
+		hash, err := header.Hash()
+		if err != nil {
+			return err
+		}
+		if _, _, known := cf.Chain.Header([32]byte(hash)); known {
+			continue
+		}
+		if _, _, known := cf.Chain.Header(header.PrevBlock); !known {
+			if _, err := cf.Orphans.Add(header, nil); err != nil {
+				return err
+			}
+			orphaned = true
+			continue
+		}
+		if _, err := cf.Chain.AddHeader(header); err != nil {
+			return fmt.Errorf("%w: %v", ErrPeerMisbehaving, err)
+		}
+		if err := cf.connectOrphans([32]byte(hash)); err != nil {
+			return err
+		}
+	}
+	if orphaned {
+		return cf.requestAncestors(peer)
+	}
+	return nil
+}
+
+// ProcessBlock hands a block to OnBlock once its header is in the chain. A block whose
+// parent is unknown is parked with its header until the parent connects.
+func (cf *ChainFollower) ProcessBlock(peer *SimpleNode, fb *block.FullBlock) error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	header := *fb.BlockHeader
+	if _, _, known := cf.Chain.Header(header.PrevBlock); !known {
+		hash, err := cf.Orphans.Add(header, fb)
+		if err != nil {
+			return err
+		}
+		if root, ok := cf.Orphans.Root(hash); ok && cf.Logging {
+			fmt.Printf("Parked orphan block %x, missing ancestor %x\n", hash, root)
+		}
+		return cf.requestAncestors(peer)
+	}
+	if _, err := cf.Chain.AddHeader(header); err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerMisbehaving, err)
+	}
+	hash, err := header.Hash()
+	if err != nil {
+		return err
+	}
+	if err := cf.deliver([32]byte(hash), fb); err != nil {
+		return err
+	}
+	return cf.connectOrphans([32]byte(hash))
+}
+
+// connectOrphans adds the parked descendants of a newly connected header, breadth first,
+// delivering any blocks that were parked with them. Caller holds mu.
+func (cf *ChainFollower) connectOrphans(parent [32]byte) error {
+	var errs []error
+	queue := [][32]byte{parent}
+	for len(queue) > 0 {
+		children := cf.Orphans.TakeChildren(queue[0])
+		queue = queue[1:]
+		for _, o := range children {
+			if _, err := cf.Chain.AddHeader(o.Header); err != nil {
+				// an invalid orphan takes its parked descendants with it
+				errs = append(errs, fmt.Errorf("orphan %x: %w", o.Hash, err))
+				continue
+			}
+			if o.Block != nil {
+				if err := cf.deliver(o.Hash, o.Block); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			queue = append(queue, o.Hash)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliver passes a block whose header is stored to OnBlock. Caller holds mu.
+func (cf *ChainFollower) deliver(hash [32]byte, fb *block.FullBlock) error {
+	if cf.OnBlock == nil {
+		return nil
+	}
+	_, height, ok := cf.Chain.Header(hash)
+	if !ok {
+		return fmt.Errorf("block %x has no stored header", hash)
+	}
+	if err := cf.OnBlock(height, fb); err != nil {
+		return fmt.Errorf("block %d rejected: %w", height, err)
+	}
+	return nil
+}
+
+// requestAncestors asks peer for the headers following our active chain, which fill the
+// gap below the parked orphans
+func (cf *ChainFollower) requestAncestors(peer *SimpleNode) error {
+	if peer == nil {
+		return nil
+	}
+	req := NewGetHeadersMessage(PROTOCOL_VERSION, BlockLocator(cf.Chain.Hashes()), nil)
+	return peer.Send(&req)
+}
@@ -0,0 +1,73 @@
+package network
+
+import (
+	"go-bitcoin/internal/block"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestChainFollowerOrphans(t *testing.T) {
+	sn, remote := newPipeNode(t)
+	chain := block.NewChainStore(block.MAINNET_PARAMS.Genesis)
+	headers, raw := mineTestChain(t, block.MAINNET_PARAMS.GenesisHash(), 4)
+
+	cf := NewChainFollower(chain)
+	delivered := make(chan int, len(headers))
+	cf.OnBlock = func(height int, fb *block.FullBlock) error {
+		delivered <- height
+		return nil
+	}
+	cancel := cf.Follow(sn)
+	defer cancel()
+
+	requests := make(chan NetworkEnvelope, 4)
+	go func() {
+		for {
+			env, err := ParseNetworkEnvelope(remote)
+			if err != nil {
+				return
+			}
+			requests <- env
+		}
+	}()
+	expectHeights := func(want ...int) {
+		t.Helper()
+		var got []int
+		for range want {
+			select {
+			case h := <-delivered:
+				got = append(got, h)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("delivered %v, want %v", got, want)
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("delivered %v, want %v", got, want)
+		}
+	}
+
+	// blocks 3 and 4 arrive before anything below them
+	deliver(t, remote, "block", raw[2])
+	deliver(t, remote, "block", raw[3])
+	select {
+	case env := <-requests:
+		if env.Command != "getheaders" {
+			t.Fatalf("expected getheaders for the missing ancestors, got %s", env.Command)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("missing ancestors weren't requested")
+	}
+
+	// the headers connect the parked blocks, then the rest arrive in order
+	payload, _ := (&HeadersMessage{Blocks: headers}).Serialize()
+	deliver(t, remote, "headers", payload)
+	expectHeights(3, 4)
+	if chain.Height() != 4 || cf.Orphans.Len() != 0 {
+		t.Fatalf("chain at %d with %d orphans left", chain.Height(), cf.Orphans.Len())
+	}
+	deliver(t, remote, "block", raw[0])
+	deliver(t, remote, "block", raw[1])
+	expectHeights(1, 2)
+	t.Logf("✓ Parked 2 orphan blocks and connected them once their headers arrived")
+}
@@ -3,12 +3,15 @@ package network
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"go-bitcoin/internal/block"
 	"go-bitcoin/internal/encoding"
 	"go-bitcoin/internal/mempool"
 	"go-bitcoin/internal/transactions"
 	"io"
+	"math/rand/v2"
+	"slices"
 )
 
 type PrefilledTransaction struct {
@@ -164,6 +167,49 @@ func (cb CompactBlockMessage) Command() string {
 	return "cmpctblock"
 }
 
+// NewCompactBlockMessage encodes a block as a BIP 152 cmpctblock under a fresh random
+// nonce. The coinbase and the transactions at alwaysPrefill are sent whole; every other
+// transaction gets a short id, from its wtxid for compact block version 2 and its txid
+// otherwise.
+func NewCompactBlockMessage(fb *block.FullBlock, alwaysPrefill []int, version uint64) (*CompactBlockMessage, error) {
+	if len(fb.Txs) == 0 {
+		return nil, errors.New("block has no transactions")
+	}
+	prefill := make([]bool, len(fb.Txs))
+	prefill[0] = true
+	for _, i := range alwaysPrefill {
+		if i < 0 || i >= len(fb.Txs) {
+			return nil, fmt.Errorf("prefill index %d out of range for %d transactions", i, len(fb.Txs))
+		}
+		prefill[i] = true
+	}
+
+	cb := &CompactBlockMessage{
+		Header: fb.BlockHeader,
+		Nonce:  rand.Uint64(),
+	}
+	k0, k1, err := mempool.CalcShortIDKeys(fb.BlockHeader, cb.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	for i, tx := range fb.Txs {
+		if prefill[i] {
+			cb.PrefilledTxns = append(cb.PrefilledTxns, PrefilledTransaction{Index: i, Tx: tx})
+			continue
+		}
+		hash, err := tx.Hash()
+		if version == 2 {
+			hash, err = tx.WitnessHash()
+		}
+		if err != nil {
+			return nil, err
+		}
+		slices.Reverse(hash[:])
+		cb.ShortIDs = append(cb.ShortIDs, mempool.CalculateShortID(hash, k0, k1))
+	}
+	return cb, nil
+}
+
 type GetBlockTransactionMessage struct {
 	// Block Transaction Request
 	BlockHash [32]byte // output from double-SHA256 of the block header
@@ -2,14 +2,10 @@ package network
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/binary"
 	"go-bitcoin/internal/block"
-	"go-bitcoin/internal/encoding"
 	"go-bitcoin/internal/mempool"
 	"go-bitcoin/internal/script"
 	"go-bitcoin/internal/transactions"
-	"io"
 	"testing"
 	"time"
 )
@@ -205,7 +201,7 @@ func TestCompactBlockRealFlow(t *testing.T) {
 	port := 8333
 
 	t.Logf("Connecting to %s:%d...", ip, port)
-	node, err := NewSimpleNode(ip, port, false, true) // testNet: false, logging: true
+	node, err := NewSimpleNode(ip, port, false, true, WithKeepAlive(30*time.Second, DEFAULT_MAX_MISSED_PONGS)) // testNet: false, logging: true
 	if err != nil {
 		t.Fatal("Could not connect to Bitcoin node:", err)
 	}
@@ -249,36 +245,28 @@ func TestCompactBlockRealFlow(t *testing.T) {
 	txCount := 0
 
 	node.OnMessage("inv", func(env NetworkEnvelope) {
-		r := bytes.NewReader(env.Payload)
-		count, err := encoding.ReadVarInt(r)
+		inv, err := ParseInvMessage(bytes.NewReader(env.Payload))
 		if err != nil {
 			return
 		}
 
-		t.Logf("📬 Received inv with %d items", count) // ADD THIS
+		t.Logf("📬 Received inv with %d items", len(inv.Inventory))
 
 		getdata := NewGetDataMessage()
-		for i := uint64(0); i < count; i++ {
-			typeBuf := make([]byte, 4)
-			io.ReadFull(r, typeBuf)
-			invType := binary.LittleEndian.Uint32(typeBuf)
-
-			var hash [32]byte
-			io.ReadFull(r, hash[:])
+		for _, item := range inv.Inventory {
+			t.Logf("  - inv type: %s, hash: %x...", item.Type, item.Identifier[:4])
 
-			t.Logf("  - inv type: %d, hash: %x...", invType, hash[:4])
-
-			switch invType {
-			case 1, 5:
-				getdata.AddData(0x40000001, hash) // MSG_WITNESS_TX
-			case 2:
+			switch item.Type {
+			case DATA_TYPE_TX, DATA_TYPE_WTX:
+				getdata.AddData(DATA_TYPE_WITNESS_TX, item.Identifier)
+			case DATA_TYPE_BLOCK:
 				t.Log("📦 Peer announced REGULAR block (type 2) - requesting as compact block")
-				getdata.AddData(4, hash) // Request as compact block (BIP152 allows this)
-			case 4:
+				getdata.AddData(DATA_TYPE_CMPCT_BLOCK, item.Identifier) // BIP152 allows this
+			case DATA_TYPE_CMPCT_BLOCK:
 				t.Log("📦 Peer announced compact block via inv (low-bandwidth mode)")
-				getdata.AddData(4, hash)
+				getdata.AddData(DATA_TYPE_CMPCT_BLOCK, item.Identifier)
 			default:
-				t.Logf("⚠️  Unknown inv type: %d", invType)
+				t.Logf("⚠️  Unknown inv type: %s", item.Type)
 			}
 		}
 
@@ -297,23 +285,9 @@ func TestCompactBlockRealFlow(t *testing.T) {
 	var env NetworkEnvelope
 	timeout := time.After(20 * time.Minute)
 	start := time.Now()
-	// Keep connection alive during long wait
-	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				// Send ping to keep connection alive
-				nonce := make([]byte, 8)
-				rand.Read(nonce)
-				node.Send(&PingMessage{Nonce: nonce})
-				t.Logf("Time elapsed: %v", time.Since(start))
-			case <-node.done:
-				return
-			}
-		}
-	}()
+	// the node's keepalive pings hold the connection open during the long wait
+	progress := time.NewTicker(30 * time.Second)
+	defer progress.Stop()
 loop:
 	for {
 		select {
@@ -355,6 +329,9 @@ loop:
 			env = cmpctEnv
 			break loop
 
+		case <-progress.C:
+			t.Logf("Time elapsed: %v (ping RTT %v)", time.Since(start), node.PingRTT())
+
 		case <-timeout:
 			t.Fatalf("Timeout waiting for compact block (20 minutes). Mempool had %d transactions.", txCount)
 
@@ -661,3 +638,66 @@ func TestCompactBlockReconstruction(t *testing.T) {
 	t.Logf("  - tx1 (from mempool): %x", tx1Hash)
 	t.Logf("  - tx2 (from mempool): %x", tx2Hash)
 }
+
+func TestNewCompactBlockMessage(t *testing.T) {
+	newTx := func(tag byte, coinbase bool) *transactions.Transaction {
+		in := transactions.TxIn{PrevTx: bytes.Repeat([]byte{tag}, 32), Sequence: 0xffffffff}
+		if coinbase {
+			in.PrevTx, in.PrevIdx = make([]byte, 32), transactions.COINBASE_PREVOUT
+			in.ScriptSig = script.NewScript([]script.ScriptCommand{{Data: []byte{tag, 0x51}, IsData: true}})
+		}
+		return &transactions.Transaction{
+			Version: 1,
+			Inputs:  []transactions.TxIn{in},
+			Outputs: []transactions.TxOut{{Amount: uint64(tag) * 1000, ScriptPubKey: script.NewScript(nil)}},
+		}
+	}
+	txs := []*transactions.Transaction{newTx(0, true), newTx(1, false), newTx(2, false), newTx(3, false)}
+	header := &block.Block{Version: 1, TimeStamp: uint32(time.Now().Unix()), Bits: 0x1d00ffff}
+	fb := &block.FullBlock{BlockHeader: header, Txs: txs}
+
+	if _, err := NewCompactBlockMessage(fb, []int{len(txs)}, 2); err == nil {
+		t.Fatal("expected an out of range prefill index to be rejected")
+	}
+	cb, err := NewCompactBlockMessage(fb, []int{2, 2}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cb.PrefilledTxns) != 2 || cb.PrefilledTxns[0].Index != 0 || cb.PrefilledTxns[1].Index != 2 || len(cb.ShortIDs) != 2 {
+		t.Fatalf("unexpected prefill %+v with %d short ids", cb.PrefilledTxns, len(cb.ShortIDs))
+	}
+
+	// the differential indexes survive the wire
+	raw, err := cb.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseCompactBlockMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Nonce != cb.Nonce || parsed.PrefilledTxns[1].Index != 2 {
+		t.Fatalf("round trip lost the prefill indexes: %+v", parsed.PrefilledTxns)
+	}
+
+	// a peer holding the other transactions rebuilds the block
+	mp := mempool.New()
+	for _, i := range []int{1, 3} {
+		if err := mp.Add(txs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rebuilt, missing, err := ReconstructBlock(parsed, mp, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 || len(rebuilt.TxHashes) != len(txs) {
+		t.Fatalf("missing %v of %d transactions", missing, len(rebuilt.TxHashes))
+	}
+	for i, tx := range txs {
+		if hash, _ := tx.Hash(); rebuilt.TxHashes[i] != hash {
+			t.Errorf("tx %d hash mismatch", i)
+		}
+	}
+	t.Logf("✓ Built a cmpctblock with %d prefilled and %d short ids", len(cb.PrefilledTxns), len(cb.ShortIDs))
+}
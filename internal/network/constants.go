@@ -14,6 +14,7 @@ const (
 
 // Service flags (NODE_* constants)
 const (
+	NODE_NONE            uint64 = 0      // NODE_NONE - no services (SPV client)
 	NODE_NETWORK         uint64 = 1 << 0 // NODE_NETWORK (bit 0) - Full node
 	NODE_GETUTXO         uint64 = 1 << 1 // NODE_GETUTXO (bit 1) - BIP 64
 	NODE_BLOOM           uint64 = 1 << 2 // NODE_BLOOM (bit 2) - BIP 37
@@ -22,3 +23,14 @@ const (
 	NODE_COMPACT_FILTERS uint64 = 1 << 6 // NODE_COMPACT_FILTERS (bit 6) - BIP 157
 	NODE_NETWORK_LIMITED uint64 = 1 << 10 // NODE_NETWORK_LIMITED (bit 10) - BIP 159
 )
+
+// Protocol versions and the features they gate
+const (
+	PROTOCOL_VERSION          int32 = 70016 // version we advertise by default
+	MIN_PEER_PROTO_VERSION    int32 = 31800 // oldest peer version we will talk to
+	SENDHEADERS_VERSION       int32 = 70012 // BIP 130 sendheaders
+	FEEFILTER_VERSION         int32 = 70013 // BIP 133 feefilter
+	SHORT_IDS_BLOCKS_VERSION  int32 = 70014 // BIP 152 compact blocks
+	INVALID_CB_NO_BAN_VERSION int32 = 70015 // invalid compact blocks are not punished
+	WTXID_RELAY_VERSION       int32 = 70016 // BIP 339 wtxidrelay
+)
@@ -0,0 +1,148 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+)
+
+// Chain selects the network peers are discovered on
+type Chain int
+
+const (
+	CHAIN_MAINNET Chain = iota
+	CHAIN_TESTNET
+)
+
+// ChainFor maps the testNet flag used throughout the package to a Chain
+func ChainFor(testNet bool) Chain {
+	if testNet {
+		return CHAIN_TESTNET
+	}
+	return CHAIN_MAINNET
+}
+
+func (c Chain) String() string {
+	if c == CHAIN_TESTNET {
+		return "testnet"
+	}
+	return "mainnet"
+}
+
+// Port returns the default P2P port for the chain
+func (c Chain) Port() int {
+	if c == CHAIN_TESTNET {
+		return TESTNET_PORT
+	}
+	return MAINNET_PORT
+}
+
+// Seeds returns the well-known DNS seeds for the chain
+func (c Chain) Seeds() []string {
+	if c == CHAIN_TESTNET {
+		return append([]string{}, TESTNET_DNS_SEEDS...)
+	}
+	return append([]string{}, MAINNET_DNS_SEEDS...)
+}
+
+// Well-known DNS seeds (from Bitcoin Core's chainparams)
+var (
+	MAINNET_DNS_SEEDS = []string{
+		MAINNET_SEEDS,
+		"dnsseed.bluematt.me",
+		"dnsseed.bitcoin.dashjr-list-of-p2p-nodes.us",
+		"seed.bitcoinstats.com",
+		"seed.bitcoin.jonasschnelli.ch",
+		"seed.btc.petertodd.net",
+		"seed.bitcoin.sprovoost.nl",
+		"dnsseed.emzy.de",
+		"seed.bitcoin.wiz.biz",
+	}
+	TESTNET_DNS_SEEDS = []string{
+		TESTNET_SEEDS,
+		"seed.tbtc.petertodd.net",
+		"seed.testnet.bitcoin.sprovoost.nl",
+		"testnet-seed.bluematt.me",
+	}
+)
+
+// FixedSeeds returns the compiled-in node addresses used when no DNS seed answers
+func (c Chain) FixedSeeds() []string {
+	if c == CHAIN_TESTNET {
+		return append([]string{}, TESTNET_FIXED_SEEDS...)
+	}
+	return append([]string{}, MAINNET_FIXED_SEEDS...)
+}
+
+// DiscoverPeers queries every DNS seed for the chain concurrently and returns up to want
+// distinct IPv4 addresses (all of them if want <= 0) in random order. Seeds are asked
+// for peers advertising the required services, falling back to unfiltered results.
+// If DNS yields nothing at all the chain's fixed seeds are returned instead.
+func DiscoverPeers(chain Chain, want int, required uint64) ([]string, error) {
+	return discoverPeers(net.LookupIP, chain.Seeds(), chain.FixedSeeds(), want, required)
+}
+
+func discoverPeers(lookup func(string) ([]net.IP, error), seeds, fixed []string, want int, required uint64) ([]string, error) {
+	addrs, err := resolveSeeds(lookup, seeds, required, false)
+	if len(addrs) == 0 {
+		if len(fixed) == 0 {
+			if err == nil {
+				err = errors.New("no peers found")
+			}
+			return nil, err
+		}
+		// fixed seeds carry no service information, the handshake checks that instead
+		addrs = append([]string{}, fixed...)
+	}
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if want > 0 && len(addrs) > want {
+		addrs = addrs[:want]
+	}
+	return addrs, nil
+}
+
+// resolveSeeds looks up all seeds in parallel and merges the IPv4 results in seed order,
+// dropping duplicates. It fails only if no seed returned anything.
+func resolveSeeds(lookup func(string) ([]net.IP, error), seeds []string, required uint64, logging bool) ([]string, error) {
+	results := make([][]net.IP, len(seeds))
+	errs := make([]error, len(seeds))
+	var wg sync.WaitGroup
+	for i, seed := range seeds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := lookup(SeedHostForServices(seed, required))
+			if err != nil && required != 0 {
+				if logging {
+					fmt.Printf("Seed %s does not support service filtering, using unfiltered results\n", seed)
+				}
+				ips, err = lookup(seed)
+			}
+			results[i], errs[i] = ips, err
+		}()
+	}
+	wg.Wait()
+
+	var addrs []string
+	seen := make(map[string]bool)
+	var lastErr error
+	for i, ips := range results {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			continue
+		}
+		for _, ip := range ips {
+			if ip.To4() == nil || seen[ip.String()] {
+				continue
+			}
+			seen[ip.String()] = true
+			addrs = append(addrs, ip.String())
+		}
+	}
+	if len(addrs) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("failed to resolve seeds: %w", lastErr)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,33 @@
+package network
+
+// Fixed seeds are the last resort when DNS seeding fails (offline resolver, captive portal),
+// like Bitcoin Core's chainparamsseeds.h. They are long-lived nodes on the default port for
+// their network and should be refreshed from a current crawl every release or so.
+var (
+	MAINNET_FIXED_SEEDS = []string{
+		"5.9.105.72",
+		"18.27.79.17",
+		"23.175.0.202",
+		"45.33.72.185",
+		"51.154.62.103",
+		"65.21.95.123",
+		"78.47.61.83",
+		"84.247.172.88",
+		"88.99.167.175",
+		"95.216.102.151",
+		"104.248.139.211",
+		"136.243.16.171",
+		"142.132.175.217",
+		"162.55.32.206",
+		"176.9.150.253",
+		"185.26.99.171",
+	}
+	TESTNET_FIXED_SEEDS = []string{
+		"18.189.156.253",
+		"34.209.107.218",
+		"65.108.102.42",
+		"88.198.91.210",
+		"95.217.40.123",
+		"148.251.40.218",
+	}
+)
@@ -3,7 +3,9 @@ package network
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"go-bitcoin/internal/encoding"
+	"io"
 )
 
 type DataType uint32
@@ -14,42 +16,91 @@ const (
 	DATA_TYPE_BLOCK
 	DATA_TYPE_FILTERED_BLOCK
 	DATA_TYPE_CMPCT_BLOCK
+	DATA_TYPE_WTX // BIP 339 MSG_WTX, identifier is a wtxid
 )
 
-type DataItem struct {
-	Type       DataType
-	Identifier [32]byte
+// Witness variants request the segwit serialization (BIP 144)
+const (
+	DATA_TYPE_WITNESS_FLAG           DataType = 1 << 30
+	DATA_TYPE_WITNESS_TX                      = DATA_TYPE_WITNESS_FLAG | DATA_TYPE_TX             // MSG_WITNESS_TX
+	DATA_TYPE_WITNESS_BLOCK                   = DATA_TYPE_WITNESS_FLAG | DATA_TYPE_BLOCK          // MSG_WITNESS_BLOCK
+	DATA_TYPE_WITNESS_FILTERED_BLOCK          = DATA_TYPE_WITNESS_FLAG | DATA_TYPE_FILTERED_BLOCK // MSG_FILTERED_WITNESS_BLOCK
+)
+
+func (dt DataType) String() string {
+	switch dt {
+	case DATA_TYPE_ERROR:
+		return "ERROR"
+	case DATA_TYPE_TX:
+		return "MSG_TX"
+	case DATA_TYPE_BLOCK:
+		return "MSG_BLOCK"
+	case DATA_TYPE_FILTERED_BLOCK:
+		return "MSG_FILTERED_BLOCK"
+	case DATA_TYPE_CMPCT_BLOCK:
+		return "MSG_CMPCT_BLOCK"
+	case DATA_TYPE_WTX:
+		return "MSG_WTX"
+	case DATA_TYPE_WITNESS_TX:
+		return "MSG_WITNESS_TX"
+	case DATA_TYPE_WITNESS_BLOCK:
+		return "MSG_WITNESS_BLOCK"
+	case DATA_TYPE_WITNESS_FILTERED_BLOCK:
+		return "MSG_FILTERED_WITNESS_BLOCK"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", uint32(dt))
 }
 
-type GetDataMessage struct {
-	Data []DataItem
+// WithWitness returns the witness variant of a tx or block type
+func (dt DataType) WithWitness() DataType {
+	switch dt {
+	case DATA_TYPE_TX, DATA_TYPE_BLOCK, DATA_TYPE_FILTERED_BLOCK:
+		return dt | DATA_TYPE_WITNESS_FLAG
+	}
+	return dt
 }
 
-func NewGetDataMessage() GetDataMessage {
-	return GetDataMessage{
-		Data: []DataItem{},
+// WithoutWitness strips the witness flag
+func (dt DataType) WithoutWitness() DataType {
+	return dt &^ DATA_TYPE_WITNESS_FLAG
+}
+
+// IsTx reports whether the type identifies a transaction (by txid or wtxid)
+func (dt DataType) IsTx() bool {
+	base := dt.WithoutWitness()
+	return base == DATA_TYPE_TX || base == DATA_TYPE_WTX
+}
+
+// IsBlock reports whether the type identifies a block in any of its forms
+func (dt DataType) IsBlock() bool {
+	switch dt.WithoutWitness() {
+	case DATA_TYPE_BLOCK, DATA_TYPE_FILTERED_BLOCK, DATA_TYPE_CMPCT_BLOCK:
+		return true
 	}
+	return false
 }
 
-func (gd *GetDataMessage) AddData(dType DataType, id [32]byte) {
-	gd.Data = append(gd.Data, DataItem{
-		Type:       dType,
-		Identifier: id,
-	})
+// InvVector is one inventory entry shared by inv, getdata and notfound
+type InvVector struct {
+	Type       DataType
+	Identifier [32]byte
 }
 
-func (gd *GetDataMessage) Serialize() ([]byte, error) {
+// DataItem is the original name for an inventory vector
+type DataItem = InvVector
+
+func serializeInventory(items []InvVector) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 
 	// number of items (VarInt)
-	count, err := encoding.EncodeVarInt(uint64(len(gd.Data)))
+	count, err := encoding.EncodeVarInt(uint64(len(items)))
 	if err != nil {
 		return nil, err
 	}
 	buf.Write(count)
 
 	// loop through each data item
-	for _, item := range gd.Data {
+	for _, item := range items {
 		// data type (4 bytes LE)
 		binary.Write(buf, binary.LittleEndian, item.Type)
 
@@ -60,6 +111,69 @@ func (gd *GetDataMessage) Serialize() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+func parseInventory(r io.Reader) ([]InvVector, error) {
+	count, err := encoding.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > MAX_INV_SIZE {
+		return nil, fmt.Errorf("inventory has too many entries: %d", count)
+	}
+
+	items := make([]InvVector, count)
+	buf4 := make([]byte, 4)
+	for i := range items {
+		if _, err := io.ReadFull(r, buf4); err != nil {
+			return nil, err
+		}
+		items[i].Type = DataType(binary.LittleEndian.Uint32(buf4))
+		if _, err := io.ReadFull(r, items[i].Identifier[:]); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+type GetDataMessage struct {
+	Data []DataItem
+}
+
+func NewGetDataMessage() GetDataMessage {
+	return GetDataMessage{
+		Data: []DataItem{},
+	}
+}
+
+func (gd *GetDataMessage) AddData(dType DataType, id [32]byte) {
+	gd.Data = append(gd.Data, DataItem{
+		Type:       dType,
+		Identifier: id,
+	})
+}
+
+func (gd *GetDataMessage) Serialize() ([]byte, error) {
+	return serializeInventory(gd.Data)
+}
+
 func (gd GetDataMessage) Command() string {
 	return "getdata"
 }
+
+func ParseGetDataMessage(r io.Reader) (GetDataMessage, error) {
+	items, err := parseInventory(r)
+	if err != nil {
+		return GetDataMessage{}, err
+	}
+	return GetDataMessage{
+		Data: items,
+	}, nil
+}
+
+// ToInv converts a getdata request into the equivalent announcement (witness flags stripped)
+func (gd GetDataMessage) ToInv() InvMessage {
+	inv := InvMessage{Inventory: make([]InvVector, len(gd.Data))}
+	for i, item := range gd.Data {
+		inv.Inventory[i] = InvVector{Type: item.Type.WithoutWitness(), Identifier: item.Identifier}
+	}
+	return inv
+}
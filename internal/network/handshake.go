@@ -0,0 +1,61 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DEFAULT_HANDSHAKE_TIMEOUT bounds the whole version/verack exchange (Bitcoin Core
+// disconnects peers that haven't completed it within 60 seconds)
+const DEFAULT_HANDSHAKE_TIMEOUT time.Duration = 60 * time.Second
+
+// Handshake stages reported by HandshakeError
+const (
+	HANDSHAKE_STAGE_VERSION     string = "version"     // waiting for the peer's version
+	HANDSHAKE_STAGE_NEGOTIATION string = "negotiation" // checking/answering the peer's version
+	HANDSHAKE_STAGE_VERACK      string = "verack"      // waiting for the peer's verack
+)
+
+var ErrHandshakeTimeout = errors.New("handshake timed out")
+
+// HandshakeError says which stage of the handshake failed. Peer holds the peer's version
+// message if it got that far, which is often enough to see why (old client, wrong services).
+type HandshakeError struct {
+	Stage string
+	Peer  *VersionMessage
+	Err   error
+}
+
+func (e *HandshakeError) Error() string {
+	if e.Peer != nil {
+		return fmt.Sprintf("handshake failed at %s stage (peer %s, version %d): %v", e.Stage, e.Peer.UserAgent, e.Peer.Version, e.Err)
+	}
+	return fmt.Sprintf("handshake failed at %s stage: %v", e.Stage, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// WithHandshakeTimeout bounds how long Handshake waits for the peer. 0 waits forever.
+func WithHandshakeTimeout(timeout time.Duration) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.HandshakeTimeout = timeout
+	}
+}
+
+// awaitHandshakeMessage waits for the next message on a handshake channel until deadline
+// fires (a nil deadline never fires)
+func (sn *SimpleNode) awaitHandshakeMessage(command string, deadline <-chan time.Time) (NetworkEnvelope, error) {
+	ch, _ := sn.channel(command)
+	select {
+	case env, ok := <-ch:
+		if !ok {
+			return NetworkEnvelope{}, errors.New("connection closed")
+		}
+		return env, nil
+	case <-deadline:
+		return NetworkEnvelope{}, fmt.Errorf("%w waiting for %s", ErrHandshakeTimeout, command)
+	}
+}
@@ -0,0 +1,347 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/block"
+	"slices"
+	"time"
+)
+
+// Headers-first IBD defaults
+const (
+	MAX_HEADERS_PER_MSG   int           = 2000             // a full headers response; fewer means the peer's tip
+	IBD_BLOCK_WINDOW      int           = 16               // blocks requested per getdata
+	IBD_STALL_TIMEOUT     time.Duration = 30 * time.Second // max wait for the next headers/block message
+	IBD_LOCATOR_DENSE_LEN int           = 10               // locator entries before the step starts doubling
+)
+
+var (
+	ErrPeerStalled     = errors.New("sync peer stalled")
+	ErrPeerMisbehaving = errors.New("sync peer sent invalid data")
+)
+
+// IBDProgress is reported after every headers batch and every connected block
+type IBDProgress struct {
+	Stage   string // "headers" or "blocks"
+	Height  int
+	Target  int
+	Percent float64
+	ETA     time.Duration // zero until a rate can be estimated
+}
+
+// InitialBlockDownload syncs headers from a peer, then downloads and validates every block
+// on the header chain in order. A peer that stalls or sends invalid data is disconnected
+// and replaced from Peers, if set.
+type InitialBlockDownload struct {
+	Params       *block.ChainParams
+	Logging      bool
+	StallTimeout time.Duration
+	BlockWindow  int
+	Peers        *PeerManager // source of replacement peers; nil disables rotation
+	Required     uint64       // services a replacement peer must advertise
+	OnProgress   func(IBDProgress)
+	OnBlock      func(height int, fb *block.FullBlock) error // called in height order
+	Checkpoints  []block.Checkpoint                          // header chains contradicting these are rejected
+	AssumeValid  block.Checkpoint                            // see AssumedValid
+
+	// SkipBitsCheck accepts any bits a header's own proof of work satisfies, for test
+	// chains that don't follow the difficulty schedule
+	SkipBitsCheck bool
+
+	peer        *SimpleNode
+	headers     []block.Block // index = height, genesis at 0
+	hashes      [][32]byte    // block hashes by height (internal byte order)
+	blockHeight int           // last block downloaded and validated
+
+	stageStart       time.Time
+	stageStartHeight int
+}
+
+// NewInitialBlockDownload starts from the genesis block of the peer's chain parameters
+func NewInitialBlockDownload(peer *SimpleNode) (*InitialBlockDownload, error) {
+	params := peer.Params
+	return &InitialBlockDownload{
+		Params:       params,
+		Logging:      peer.Logging,
+		StallTimeout: IBD_STALL_TIMEOUT,
+		BlockWindow:  IBD_BLOCK_WINDOW,
+		Required:     NODE_NETWORK | NODE_WITNESS,
+		Checkpoints:  params.Checkpoints,
+		AssumeValid:  params.DefaultAssumeValid(),
+		peer:         peer,
+		headers:      []block.Block{params.Genesis},
+		hashes:       [][32]byte{params.GenesisHash()},
+	}, nil
+}
+
+// SyncChain runs a headers-first initial block download against this peer
+func (sn *SimpleNode) SyncChain(ctx context.Context) error {
+	ibd, err := NewInitialBlockDownload(sn)
+	if err != nil {
+		return err
+	}
+	return ibd.Run(ctx)
+}
+
+// Peer returns the current sync peer
+func (ibd *InitialBlockDownload) Peer() *SimpleNode {
+	return ibd.peer
+}
+
+// HeaderHeight returns the height of the best validated header
+func (ibd *InitialBlockDownload) HeaderHeight() int {
+	return len(ibd.headers) - 1
+}
+
+// BlockHeight returns the height of the last downloaded and validated block
+func (ibd *InitialBlockDownload) BlockHeight() int {
+	return ibd.blockHeight
+}
+
+// AssumedValid reports whether OnBlock may skip script checks for the block at height:
+// the synced header chain contains AssumeValid and height is at or below it
+func (ibd *InitialBlockDownload) AssumedValid(height int) bool {
+	av := ibd.AssumeValid
+	return height <= av.Height && av.Height < len(ibd.hashes) && ibd.hashes[av.Height] == av.Hash
+}
+
+// BlockHashes returns the synced block hashes by height (internal byte order),
+// suitable for NewCFHeaderChain
+func (ibd *InitialBlockDownload) BlockHashes() [][32]byte {
+	return slices.Clone(ibd.hashes)
+}
+
+// Run syncs headers to the peer's tip, then blocks to the header tip, rotating peers on
+// stalls or invalid data until done, out of peers, or ctx is cancelled
+func (ibd *InitialBlockDownload) Run(ctx context.Context) error {
+	for {
+		err := ibd.syncHeaders(ctx)
+		if err == nil {
+			err = ibd.downloadBlocks(ctx)
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !errors.Is(err, ErrPeerStalled) && !errors.Is(err, ErrPeerMisbehaving) {
+			return err
+		}
+		if err := ibd.rotatePeer(err); err != nil {
+			return err
+		}
+	}
+}
+
+// rotatePeer disconnects the sync peer and connects a replacement from Peers
+func (ibd *InitialBlockDownload) rotatePeer(cause error) error {
+	if ibd.Peers == nil {
+		return cause
+	}
+	if ibd.Logging {
+		fmt.Printf("Rotating sync peer: %v\n", cause)
+	}
+	ibd.peer.Close()
+	peer, err := ibd.Peers.Connect(ibd.Required)
+	if err != nil {
+		return fmt.Errorf("%w (no replacement peer: %v)", cause, err)
+	}
+	ibd.peer = peer
+	return nil
+}
+
+// blockLocator builds a locator for the header chain synced so far
+func (ibd *InitialBlockDownload) blockLocator() [][32]byte {
+	return BlockLocator(ibd.hashes)
+}
+
+// BlockLocator lists hashes (by height, genesis first) from the tip back to genesis, dense
+// at first and then doubling the step, so a peer can find the fork point with a short message
+func BlockLocator(hashes [][32]byte) [][32]byte {
+	var locator [][32]byte
+	step := 1
+	for h := len(hashes) - 1; h > 0; h -= step {
+		locator = append(locator, hashes[h])
+		if len(locator) >= IBD_LOCATOR_DENSE_LEN {
+			step *= 2
+		}
+	}
+	return append(locator, hashes[0])
+}
+
+// addHeader validates a header against the current tip and appends it
+func (ibd *InitialBlockDownload) addHeader(header block.Block) error {
+	height := len(ibd.headers)
+	if header.PrevBlock != ibd.hashes[height-1] {
+		return fmt.Errorf("%w: header at height %d does not connect to tip", ErrPeerMisbehaving, height)
+	}
+	if !header.CheckProofOfWork() {
+		return fmt.Errorf("%w: bad proof of work at height %d", ErrPeerMisbehaving, height)
+	}
+	if !ibd.SkipBitsCheck {
+		expected := ibd.Params.NextBitsRequired(ibd.headers, header)
+		if header.Bits != expected {
+			return fmt.Errorf("%w: bad bits %x at height %d, expected %x", ErrPeerMisbehaving, header.Bits, height, expected)
+		}
+	}
+	hash, err := header.Hash()
+	if err != nil {
+		return err
+	}
+	if err := block.VerifyCheckpoint(ibd.Checkpoints, height, [32]byte(hash)); err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerMisbehaving, err)
+	}
+	ibd.headers = append(ibd.headers, header)
+	ibd.hashes = append(ibd.hashes, [32]byte(hash))
+	return nil
+}
+
+// syncHeaders requests headers until the peer returns a partial batch (its tip)
+func (ibd *InitialBlockDownload) syncHeaders(ctx context.Context) error {
+	ibd.startStage(ibd.HeaderHeight())
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		req := NewGetHeadersMessage(PROTOCOL_VERSION, ibd.blockLocator(), nil)
+		resp, err := ibd.peer.SendAndWait(&req, "headers", ibd.StallTimeout)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrPeerStalled, err)
+		}
+		headers := resp.(*HeadersMessage).Blocks
+		if len(headers) > MAX_HEADERS_PER_MSG {
+			return fmt.Errorf("%w: %d headers in one message", ErrPeerMisbehaving, len(headers))
+		}
+		for _, header := range headers {
+			if err := ibd.addHeader(header); err != nil {
+				return err
+			}
+		}
+		target := max(int(ibd.peer.PeerStartHeight), ibd.HeaderHeight())
+		ibd.report("headers", ibd.HeaderHeight(), target)
+		if len(headers) < MAX_HEADERS_PER_MSG {
+			return nil
+		}
+	}
+}
+
+// downloadBlocks fetches blocks above BlockHeight in windows of BlockWindow, validating
+// and handing each to OnBlock in height order
+func (ibd *InitialBlockDownload) downloadBlocks(ctx context.Context) error {
+	ibd.startStage(ibd.blockHeight)
+	dataType := DATA_TYPE_BLOCK
+	if HasServices(ibd.peer.PeerServices, NODE_WITNESS) {
+		dataType = DATA_TYPE_WITNESS_BLOCK
+	}
+
+	for ibd.blockHeight < ibd.HeaderHeight() {
+		start := ibd.blockHeight + 1
+		stop := min(start+ibd.BlockWindow, len(ibd.hashes)) - 1
+
+		// subscribe before requesting so no block slips past
+		blocks, cancel := ibd.peer.Subscribe("block", stop-start+1)
+		getData := NewGetDataMessage()
+		for h := start; h <= stop; h++ {
+			getData.AddData(dataType, ibd.hashes[h])
+		}
+		if err := ibd.peer.Send(&getData); err != nil {
+			cancel()
+			return fmt.Errorf("%w: %v", ErrPeerStalled, err)
+		}
+		err := ibd.receiveWindow(ctx, blocks, start, stop)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveWindow collects the blocks for [start, stop], which may arrive in any order,
+// and connects them in height order. The stall timer restarts with every block.
+func (ibd *InitialBlockDownload) receiveWindow(ctx context.Context, blocks <-chan NetworkEnvelope, start, stop int) error {
+	pending := make(map[[32]byte]*block.FullBlock)
+	timer := time.NewTimer(ibd.StallTimeout)
+	defer timer.Stop()
+
+	for ibd.blockHeight < stop {
+		// connect whatever is next in line
+		if fb, ok := pending[ibd.hashes[ibd.blockHeight+1]]; ok {
+			delete(pending, ibd.hashes[ibd.blockHeight+1])
+			if err := ibd.connectBlock(fb); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case env, ok := <-blocks:
+			if !ok {
+				return fmt.Errorf("%w: connection closed", ErrPeerStalled)
+			}
+			fb, err := block.ParseFullBlock(bytes.NewReader(env.Payload))
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrPeerMisbehaving, err)
+			}
+			hash, err := fb.BlockHeader.Hash()
+			if err != nil {
+				return err
+			}
+			if !slices.Contains(ibd.hashes[start:stop+1], [32]byte(hash)) {
+				if ibd.Logging {
+					fmt.Printf("Ignoring unrequested block %x\n", hash)
+				}
+				continue
+			}
+			pending[[32]byte(hash)] = fb
+			timer.Reset(ibd.StallTimeout)
+		case <-timer.C:
+			return fmt.Errorf("%w: no block for height %d after %s", ErrPeerStalled, ibd.blockHeight+1, ibd.StallTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// connectBlock runs the context-free block checks and hands the block to OnBlock
+func (ibd *InitialBlockDownload) connectBlock(fb *block.FullBlock) error {
+	height := ibd.blockHeight + 1
+	if err := fb.CheckBlock(); err != nil {
+		return fmt.Errorf("%w: block %d: %v", ErrPeerMisbehaving, height, err)
+	}
+
+	if ibd.OnBlock != nil {
+		if err := ibd.OnBlock(height, fb); err != nil {
+			return fmt.Errorf("block %d rejected: %w", height, err)
+		}
+	}
+	ibd.blockHeight = height
+	ibd.report("blocks", height, ibd.HeaderHeight())
+	return nil
+}
+
+func (ibd *InitialBlockDownload) startStage(height int) {
+	ibd.stageStart = time.Now()
+	ibd.stageStartHeight = height
+}
+
+// report sends progress to OnProgress, estimating the ETA from the rate since the stage began
+func (ibd *InitialBlockDownload) report(stage string, height, target int) {
+	if ibd.OnProgress == nil {
+		return
+	}
+	p := IBDProgress{Stage: stage, Height: height, Target: target, Percent: 100}
+	if target > 0 {
+		p.Percent = float64(height) / float64(target) * 100
+	}
+	if done := height - ibd.stageStartHeight; done > 0 && target > height {
+		perItem := time.Since(ibd.stageStart) / time.Duration(done)
+		p.ETA = perItem * time.Duration(target-height)
+	}
+	ibd.OnProgress(p)
+}
@@ -0,0 +1,312 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go-bitcoin/internal/block"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// EASY_BITS is the regtest proof of work limit, so test headers mine in a few tries
+const EASY_BITS uint32 = 0x207fffff
+
+// mineTestChain builds n blocks on top of prev, each with a unique coinbase
+func mineTestChain(t *testing.T, prev [32]byte, n int) ([]block.Block, [][]byte) {
+	t.Helper()
+	var headers []block.Block
+	var raw [][]byte
+	for i := range n {
+		coinbase := transactions.NewTransaction(1,
+			[]transactions.TxIn{{
+				PrevTx:    make([]byte, 32),
+				PrevIdx:   0xffffffff,
+				ScriptSig: script.NewScript([]script.ScriptCommand{{Data: []byte{byte(i), 0x51}, IsData: true}}),
+				Sequence:  0xffffffff,
+			}},
+			[]transactions.TxOut{{Amount: 50, ScriptPubKey: script.P2pkhScript(make([]byte, 20))}},
+			0, false, false)
+		txid, err := coinbase.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Reverse(txid[:])
+
+		header := block.NewBlock(1, prev, [32]byte(txid), uint32(1231006505+i*600), EASY_BITS, 0, nil)
+		for !header.CheckProofOfWork() {
+			header.Nonce++
+		}
+		hash, _ := header.Hash()
+		prev = [32]byte(hash)
+
+		headerBytes, _ := header.Serialize()
+		txBytes, err := coinbase.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		full := append(append(headerBytes, 0x01), txBytes...)
+		headers = append(headers, header)
+		raw = append(raw, full)
+	}
+	return headers, raw
+}
+
+func hashOfHeader(b block.Block) [32]byte {
+	h, _ := b.Hash()
+	return [32]byte(h)
+}
+
+// serveChain answers getheaders and getdata from the remote end of a pipe node,
+// sending each window of blocks in reverse order
+func serveChain(t *testing.T, remote net.Conn, headers []block.Block, raw [][]byte) {
+	byHash := make(map[[32]byte][]byte)
+	for i := range headers {
+		hash, _ := headers[i].Hash()
+		byHash[[32]byte(hash)] = raw[i]
+	}
+	for {
+		env, err := ParseNetworkEnvelope(remote)
+		if err != nil {
+			return
+		}
+		switch env.Command {
+		case "getheaders":
+			payload, _ := (&HeadersMessage{Blocks: headers}).Serialize()
+			deliver(t, remote, "headers", payload)
+		case "getdata":
+			msg, err := ParseGetDataMessage(bytes.NewReader(env.Payload))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, item := range slices.Backward(msg.Data) {
+				deliver(t, remote, "block", byHash[item.Identifier])
+			}
+		}
+	}
+}
+
+func TestInitialBlockDownload(t *testing.T) {
+	sn, remote := newPipeNode(t)
+	ibd, err := NewInitialBlockDownload(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ibd.SkipBitsCheck = true // EASY_BITS headers don't follow the difficulty schedule
+	ibd.BlockWindow = 3
+
+	headers, raw := mineTestChain(t, ibd.BlockHashes()[0], 7)
+	go serveChain(t, remote, headers, raw)
+
+	var connected []int
+	var last IBDProgress
+	ibd.OnBlock = func(height int, fb *block.FullBlock) error {
+		connected = append(connected, height)
+		return nil
+	}
+	ibd.OnProgress = func(p IBDProgress) { last = p }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ibd.Run(ctx); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if !slices.Equal(connected, []int{1, 2, 3, 4, 5, 6, 7}) {
+		t.Fatalf("blocks connected out of order: %v", connected)
+	}
+	if ibd.HeaderHeight() != 7 || ibd.BlockHeight() != 7 {
+		t.Fatalf("expected headers and blocks at 7, got %d/%d", ibd.HeaderHeight(), ibd.BlockHeight())
+	}
+	if last.Stage != "blocks" || last.Percent != 100 {
+		t.Fatalf("unexpected final progress: %+v", last)
+	}
+	t.Logf("✓ Synced %d headers and blocks with window %d", ibd.BlockHeight(), ibd.BlockWindow)
+}
+
+func TestInitialBlockDownloadRejects(t *testing.T) {
+	sn, _ := newPipeNode(t)
+	ibd, err := NewInitialBlockDownload(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, _ := mineTestChain(t, ibd.BlockHashes()[0], 2)
+
+	// mainnet enforces the difficulty schedule, and so does testnet for a header that
+	// arrives within 20 minutes of its parent
+	if err := ibd.addHeader(headers[0]); !errors.Is(err, ErrPeerMisbehaving) {
+		t.Fatalf("expected bad bits to be rejected, got %v", err)
+	}
+	ibd.Params = block.TESTNET_PARAMS
+	if err := ibd.addHeader(headers[0]); !errors.Is(err, ErrPeerMisbehaving) {
+		t.Fatalf("expected bad testnet bits to be rejected, got %v", err)
+	}
+	ibd.SkipBitsCheck = true
+	if err := ibd.addHeader(headers[1]); !errors.Is(err, ErrPeerMisbehaving) {
+		t.Fatalf("expected disconnected header to be rejected, got %v", err)
+	}
+	if err := ibd.addHeader(headers[0]); err != nil {
+		t.Fatalf("valid header rejected: %v", err)
+	}
+
+	// a checkpoint pinning height 2 to another block
+	ibd.Checkpoints = []block.Checkpoint{{Height: 2, Hash: [32]byte{0x01}}}
+	if err := ibd.addHeader(headers[1]); !errors.Is(err, ErrPeerMisbehaving) {
+		t.Fatalf("expected checkpoint mismatch to be rejected, got %v", err)
+	}
+	ibd.Checkpoints[0].Hash = hashOfHeader(headers[1])
+	if err := ibd.addHeader(headers[1]); err != nil {
+		t.Fatalf("header matching checkpoint rejected: %v", err)
+	}
+	ibd.AssumeValid = block.Checkpoint{Height: 2, Hash: hashOfHeader(headers[1])}
+	if !ibd.AssumedValid(1) || !ibd.AssumedValid(2) || ibd.AssumedValid(3) {
+		t.Fatal("assume-valid should cover heights up to 2")
+	}
+	t.Logf("✓ Bad bits, disconnected headers and checkpoint conflicts rejected")
+}
+
+func TestInitialBlockDownloadCustomChain(t *testing.T) {
+	genesis := block.NewBlock(1, [32]byte{}, [32]byte{}, 1231006505-600, EASY_BITS, 0, nil)
+	for !genesis.CheckProofOfWork() {
+		genesis.Nonce++
+	}
+	params := block.NewChainParams("devnet", 0xfeedbeef, genesis)
+
+	local, remote := net.Pipe()
+	sn := newSimpleNodeWithConn(local, [16]byte{}, MAINNET_PORT, false, false, WithChainParams(params))
+	t.Cleanup(func() {
+		remote.Close()
+		sn.Close()
+	})
+	ibd, err := NewInitialBlockDownload(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ibd.BlockHashes()[0] != params.GenesisHash() {
+		t.Fatal("sync doesn't start from the custom genesis")
+	}
+
+	// the devnet's bits follow its own schedule, so no checks are skipped
+	headers, raw := mineTestChain(t, params.GenesisHash(), 5)
+	go serveChain(t, remote, headers, raw)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ibd.Run(ctx); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if ibd.HeaderHeight() != 5 || ibd.BlockHeight() != 5 {
+		t.Fatalf("expected headers and blocks at 5, got %d/%d", ibd.HeaderHeight(), ibd.BlockHeight())
+	}
+	t.Logf("✓ Synced %d blocks of a %s chain", ibd.BlockHeight(), params.Name)
+}
+
+func TestInitialBlockDownloadStall(t *testing.T) {
+	sn, remote := newPipeNode(t)
+	go func() {
+		// swallow requests without answering
+		for {
+			if _, err := ParseNetworkEnvelope(remote); err != nil {
+				return
+			}
+		}
+	}()
+	ibd, err := NewInitialBlockDownload(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ibd.StallTimeout = 50 * time.Millisecond
+
+	// with no PeerManager to rotate to, the stall is returned
+	if err := ibd.Run(context.Background()); !errors.Is(err, ErrPeerStalled) {
+		t.Fatalf("expected ErrPeerStalled, got %v", err)
+	}
+	t.Logf("✓ Stalled peer detected")
+}
+
+func TestBlockLocator(t *testing.T) {
+	ibd := &InitialBlockDownload{}
+	for i := range 100 {
+		ibd.hashes = append(ibd.hashes, [32]byte(encoding.Hash256([]byte{byte(i)})))
+	}
+	locator := ibd.blockLocator()
+
+	// 10 dense entries from the tip, then doubling steps, ending at genesis
+	want := []int{99, 98, 97, 96, 95, 94, 93, 92, 91, 90, 88, 84, 76, 60, 28, 0}
+	if len(locator) != len(want) {
+		t.Fatalf("expected %d locator entries, got %d", len(want), len(locator))
+	}
+	for i, h := range want {
+		if locator[i] != ibd.hashes[h] {
+			t.Fatalf("locator entry %d is not height %d", i, h)
+		}
+	}
+	t.Logf("✓ Locator has %d entries", len(locator))
+}
+
+// answerHeaders replies to every getheaders with the same headers
+func answerHeaders(t *testing.T, remote net.Conn, headers []block.Block) {
+	payload, _ := (&HeadersMessage{Blocks: headers}).Serialize()
+	for {
+		env, err := ParseNetworkEnvelope(remote)
+		if err != nil {
+			return
+		}
+		if env.Command == "getheaders" {
+			deliver(t, remote, "headers", payload)
+		}
+	}
+}
+
+func TestTipMonitor(t *testing.T) {
+	root := [32]byte(encoding.Hash256([]byte("root")))
+	main, _ := mineTestChain(t, root, 10)
+	chain := [][32]byte{root}
+	for _, h := range main[:5] {
+		hash, _ := h.Hash()
+		chain = append(chain, [32]byte(hash))
+	}
+	fork, _ := mineTestChain(t, chain[3], 4)
+
+	syncPeer, syncRemote := newPipeNode(t)
+	go answerHeaders(t, syncRemote, main[5:6]) // height 6, lagging
+	pm := NewPeerManager(false, false)
+	var ahead []*SimpleNode
+	for range 2 {
+		peer, remote := newPipeNode(t)
+		go answerHeaders(t, remote, main[5:]) // height 10
+		ahead = append(ahead, peer)
+	}
+	forked, forkedRemote := newPipeNode(t)
+	go answerHeaders(t, forkedRemote, fork) // conflicts with our chain from height 4
+	pm.peers = append(ahead, forked)
+
+	tm := NewTipMonitor(pm, syncPeer)
+	var events []TipEventKind
+	tm.OnEvent = func(ev TipEvent) {
+		events = append(events, ev.Kind)
+		if ev.Kind == TIP_PEER_FORKED && (ev.Peer != forked || ev.Tip.ForkHeight != 3 || ev.Tip.Height != 7) {
+			t.Errorf("unexpected forked tip: %+v", ev.Tip)
+		}
+	}
+
+	tips, err := tm.Check(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != 4 {
+		t.Fatalf("expected 4 tips, got %d", len(tips))
+	}
+	want := []TipEventKind{TIP_PEER_FORKED, TIP_SYNC_LAGGING, TIP_SYNC_SWITCHED}
+	if !slices.Equal(events, want) {
+		t.Fatalf("expected events %v, got %v", want, events)
+	}
+	if !slices.Contains(ahead, tm.SyncPeer()) {
+		t.Fatal("expected a peer at height 10 to become the sync peer")
+	}
+	t.Logf("✓ Events: %v", events)
+}
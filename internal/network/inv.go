@@ -0,0 +1,95 @@
+package network
+
+import (
+	"io"
+)
+
+// MAX_INV_SIZE is the protocol limit on entries in an inv or getdata message
+const MAX_INV_SIZE uint64 = 50000
+
+type InvMessage struct {
+	Inventory []InvVector
+}
+
+func NewInvMessage(items ...InvVector) InvMessage {
+	return InvMessage{
+		Inventory: items,
+	}
+}
+
+func (im *InvMessage) Serialize() ([]byte, error) {
+	return serializeInventory(im.Inventory)
+}
+
+func (im InvMessage) Command() string {
+	return "inv"
+}
+
+func ParseInvMessage(r io.Reader) (InvMessage, error) {
+	items, err := parseInventory(r)
+	if err != nil {
+		return InvMessage{}, err
+	}
+	return InvMessage{
+		Inventory: items,
+	}, nil
+}
+
+// ToGetData builds a getdata requesting every announced item. With witness set, tx and
+// block entries are requested in their witness form. MSG_WTX entries are requested as-is.
+func (im InvMessage) ToGetData(witness bool) GetDataMessage {
+	gd := NewGetDataMessage()
+	for _, item := range im.Inventory {
+		dt := item.Type
+		if witness {
+			dt = dt.WithWitness()
+		}
+		gd.AddData(dt, item.Identifier)
+	}
+	return gd
+}
+
+// Txs returns the transaction entries of the announcement
+func (im InvMessage) Txs() []InvVector {
+	var txs []InvVector
+	for _, item := range im.Inventory {
+		if item.Type.IsTx() {
+			txs = append(txs, item)
+		}
+	}
+	return txs
+}
+
+// Blocks returns the block entries of the announcement
+func (im InvMessage) Blocks() []InvVector {
+	var blocks []InvVector
+	for _, item := range im.Inventory {
+		if item.Type.IsBlock() {
+			blocks = append(blocks, item)
+		}
+	}
+	return blocks
+}
+
+// NotFoundMessage answers the getdata entries we could not serve
+type NotFoundMessage struct {
+	Inventory []InvVector
+}
+
+func (nf *NotFoundMessage) Serialize() ([]byte, error) {
+	return serializeInventory(nf.Inventory)
+}
+
+func (nf NotFoundMessage) Command() string {
+	return "notfound"
+}
+
+func ParseNotFoundMessage(r io.Reader) (NotFoundMessage, error) {
+	items, err := parseInventory(r)
+	if err != nil {
+		return NotFoundMessage{}, err
+	}
+	return NotFoundMessage{
+		Inventory: items,
+	}, nil
+}
@@ -0,0 +1,105 @@
+package network
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DEFAULT_INV_CACHE_SIZE matches the size of Bitcoin Core's rolling known-inventory filter
+const DEFAULT_INV_CACHE_SIZE int = 50000
+
+// InvCache is a rolling LRU of recently seen inventory hashes (txids and block hashes).
+// Share one cache across peers so an item announced by several of them is only fetched once.
+type InvCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // front = most recently seen
+	items    map[[32]byte]*list.Element
+}
+
+func NewInvCache(capacity int) *InvCache {
+	if capacity <= 0 {
+		capacity = DEFAULT_INV_CACHE_SIZE
+	}
+	return &InvCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[[32]byte]*list.Element),
+	}
+}
+
+// Seen reports whether the hash is in the cache without refreshing it
+func (c *InvCache) Seen(hash [32]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[hash]
+	return ok
+}
+
+// Add records the hash and returns true if it was not already known
+func (c *InvCache) Add(hash [32]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.add(hash)
+}
+
+func (c *InvCache) add(hash [32]byte) bool {
+	if el, ok := c.items[hash]; ok {
+		c.order.MoveToFront(el)
+		return false
+	}
+	c.items[hash] = c.order.PushFront(hash)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.([32]byte))
+	}
+	return true
+}
+
+// FilterNew records every item and returns only those not seen before
+func (c *InvCache) FilterNew(items []DataItem) []DataItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var fresh []DataItem
+	for _, item := range items {
+		if c.add(item.Identifier) {
+			fresh = append(fresh, item)
+		}
+	}
+	return fresh
+}
+
+// Len returns the number of hashes currently cached
+func (c *InvCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// WithInvCache shares an inventory cache with the node so RequestInventory skips
+// items already announced by this or any other peer using the same cache
+func WithInvCache(cache *InvCache) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.InvCache = cache
+	}
+}
+
+// RequestInventory sends getdata for the announced items we haven't seen yet and
+// returns how many were requested
+func (sn *SimpleNode) RequestInventory(items []DataItem) (int, error) {
+	if sn.InvCache != nil {
+		items = sn.InvCache.FilterNew(items)
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+	getData := NewGetDataMessage()
+	for _, item := range items {
+		getData.AddData(item.Type, item.Identifier)
+	}
+	if err := sn.Send(&getData); err != nil {
+		return 0, err
+	}
+	return len(items), nil
+}
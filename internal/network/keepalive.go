@@ -0,0 +1,111 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Keepalive defaults (Bitcoin Core pings every 2 minutes)
+const (
+	DEFAULT_PING_INTERVAL    time.Duration = 2 * time.Minute
+	DEFAULT_MAX_MISSED_PONGS int           = 3
+)
+
+// keepAlive tracks the outstanding keepalive ping on a connection
+type keepAlive struct {
+	mu      sync.Mutex
+	started bool
+	nonce   []byte // nonce of the unanswered ping, nil once answered
+	sentAt  time.Time
+	missed  int // consecutive intervals that ended with our ping unanswered
+	rtt     time.Duration
+}
+
+// WithKeepAlive sets how often the node pings the peer after the handshake and how many
+// consecutive pongs it may miss before we disconnect. An interval of 0 disables pinging.
+func WithKeepAlive(interval time.Duration, maxMissed int) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.PingInterval = interval
+		sn.MaxMissedPongs = maxMissed
+	}
+}
+
+// PingRTT returns the round trip time measured by the last answered keepalive ping
+func (sn *SimpleNode) PingRTT() time.Duration {
+	sn.keepAlive.mu.Lock()
+	defer sn.keepAlive.mu.Unlock()
+	return sn.keepAlive.rtt
+}
+
+// startKeepAlive begins pinging the peer every PingInterval (once per connection)
+func (sn *SimpleNode) startKeepAlive() {
+	if sn.PingInterval <= 0 {
+		return
+	}
+	sn.keepAlive.mu.Lock()
+	defer sn.keepAlive.mu.Unlock()
+	if sn.keepAlive.started {
+		return
+	}
+	sn.keepAlive.started = true
+	go sn.keepAliveLoop()
+}
+
+// keepAliveLoop runs outside the node's WaitGroup so it can Close the node itself
+func (sn *SimpleNode) keepAliveLoop() {
+	ticker := time.NewTicker(sn.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !sn.sendKeepAlivePing() {
+				if sn.Logging {
+					fmt.Printf("Peer missed %d pongs, disconnecting\n", sn.MaxMissedPongs)
+				}
+				sn.Close()
+				return
+			}
+		case <-sn.done:
+			return
+		}
+	}
+}
+
+// sendKeepAlivePing counts a miss if the previous ping is still unanswered, then sends a
+// fresh one. It returns false once the peer has missed MaxMissedPongs in a row.
+func (sn *SimpleNode) sendKeepAlivePing() bool {
+	ka := &sn.keepAlive
+	ka.mu.Lock()
+	if ka.nonce != nil {
+		ka.missed++
+		if ka.missed >= sn.MaxMissedPongs {
+			ka.mu.Unlock()
+			return false
+		}
+	}
+	nonce := binary.LittleEndian.AppendUint64(nil, rand.Uint64())
+	ka.nonce = nonce
+	ka.sentAt = time.Now()
+	ka.mu.Unlock()
+
+	sn.Send(&PingMessage{Nonce: nonce})
+	return true
+}
+
+// handlePong records the RTT of a pong answering our outstanding keepalive ping.
+// Pongs for other pings (e.g. SendAndWait) are ignored here.
+func (sn *SimpleNode) handlePong(env NetworkEnvelope) {
+	ka := &sn.keepAlive
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	if ka.nonce == nil || !bytes.Equal(env.Payload, ka.nonce) {
+		return
+	}
+	ka.rtt = time.Since(ka.sentAt)
+	ka.nonce = nil
+	ka.missed = 0
+}
@@ -3,8 +3,12 @@ package network
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"go-bitcoin/internal/block"
 	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/transactions"
 	"io"
+	"slices"
 )
 
 type MerkleBlock struct {
@@ -108,3 +112,185 @@ func (mb *MerkleBlock) IsValid() bool {
 
 	return bytes.Equal(mt.Root(), mb.MerkleRoot[:])
 }
+
+func (mb *MerkleBlock) Serialize() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf4 := make([]byte, 4)
+
+	binary.LittleEndian.PutUint32(buf4, mb.Version)
+	buf.Write(buf4)
+	buf.Write(mb.PrevBlock[:])
+	buf.Write(mb.MerkleRoot[:])
+	binary.LittleEndian.PutUint32(buf4, mb.TimeStamp)
+	buf.Write(buf4)
+	binary.LittleEndian.PutUint32(buf4, mb.Bits)
+	buf.Write(buf4)
+	binary.LittleEndian.PutUint32(buf4, mb.Nonce)
+	buf.Write(buf4)
+	binary.LittleEndian.PutUint32(buf4, mb.NumTransactions)
+	buf.Write(buf4)
+
+	numHashes, err := encoding.EncodeVarInt(uint64(len(mb.TxHashes)))
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(numHashes)
+	for _, h := range mb.TxHashes {
+		buf.Write(h[:])
+	}
+
+	// pad flag bits to a whole number of bytes
+	bits := slices.Clone(mb.FlagBits)
+	for len(bits)%8 != 0 {
+		bits = append(bits, 0)
+	}
+	flagBytes, err := encoding.BitFieldToBytes(bits)
+	if err != nil {
+		return nil, err
+	}
+	numFlags, err := encoding.EncodeVarInt(uint64(len(flagBytes)))
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(numFlags)
+	buf.Write(flagBytes)
+
+	return buf.Bytes(), nil
+}
+
+func (mb MerkleBlock) Command() string {
+	return "merkleblock"
+}
+
+// NewMerkleBlock builds the partial merkle tree for a block, keeping the paths to the
+// matched transactions. txids are in internal byte order, matches[i] marks txids[i].
+func NewMerkleBlock(header *block.Block, txids [][32]byte, matches []bool) (*MerkleBlock, error) {
+	if len(txids) == 0 {
+		return nil, errors.New("block has no transactions")
+	}
+	if len(txids) != len(matches) {
+		return nil, errors.New("txids and matches must be the same length")
+	}
+
+	n := len(txids)
+	width := func(height int) int {
+		return (n + (1 << height) - 1) >> height
+	}
+
+	var calcHash func(height, pos int) [32]byte
+	calcHash = func(height, pos int) [32]byte {
+		if height == 0 {
+			return txids[pos]
+		}
+		left := calcHash(height-1, pos*2)
+		right := left
+		if pos*2+1 < width(height-1) {
+			right = calcHash(height-1, pos*2+1)
+		}
+		return [32]byte(encoding.MerkleParent(slices.Clone(left[:]), right[:]))
+	}
+
+	var hashes [][32]byte
+	var flags []byte
+	var traverse func(height, pos int)
+	traverse = func(height, pos int) {
+		// does this node have a matched leaf beneath it?
+		parentOfMatch := false
+		for p := pos << height; p < (pos+1)<<height && p < n; p++ {
+			if matches[p] {
+				parentOfMatch = true
+				break
+			}
+		}
+		if parentOfMatch {
+			flags = append(flags, 1)
+		} else {
+			flags = append(flags, 0)
+		}
+
+		if height == 0 || !parentOfMatch {
+			hashes = append(hashes, calcHash(height, pos))
+			return
+		}
+		traverse(height-1, pos*2)
+		if pos*2+1 < width(height-1) {
+			traverse(height-1, pos*2+1)
+		}
+	}
+
+	height := 0
+	for width(height) > 1 {
+		height++
+	}
+	traverse(height, 0)
+
+	return &MerkleBlock{
+		Version:         header.Version,
+		PrevBlock:       header.PrevBlock,
+		MerkleRoot:      header.MerkleRoot,
+		TimeStamp:       header.TimeStamp,
+		Bits:            header.Bits,
+		Nonce:           header.Nonce,
+		NumTransactions: uint32(n),
+		NumHashes:       uint64(len(hashes)),
+		TxHashes:        hashes,
+		NumFlags:        uint64((len(flags) + 7) / 8),
+		FlagBits:        flags,
+	}, nil
+}
+
+// BuildMerkleBlock filters a block against a peer's bloom filter, returning the
+// merkleblock to send followed by the matched transactions (in block order).
+// Matching follows MatchTransaction, so flag may add outpoints to the filter.
+func BuildMerkleBlock(fb *block.FullBlock, filter *BloomFilter, flag byte) (*MerkleBlock, []*transactions.Transaction, error) {
+	txids := make([][32]byte, len(fb.Txs))
+	matches := make([]bool, len(fb.Txs))
+	var matched []*transactions.Transaction
+	for i, tx := range fb.Txs {
+		txid, err := tx.Hash()
+		if err != nil {
+			return nil, nil, err
+		}
+		slices.Reverse(txid[:])
+		txids[i] = txid
+		ok, err := filter.MatchTransaction(tx, flag)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			matches[i] = true
+			matched = append(matched, tx)
+		}
+	}
+
+	mb, err := NewMerkleBlock(fb.BlockHeader, txids, matches)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mb, matched, nil
+}
+
+// ServeFilteredBlock answers a MSG_FILTERED_BLOCK request using the filter the peer
+// loaded: a merkleblock followed by a tx message for each match
+func (sn *SimpleNode) ServeFilteredBlock(fb *block.FullBlock) error {
+	sn.filters.mu.Lock()
+	if sn.filters.remote == nil {
+		sn.filters.mu.Unlock()
+		return errors.New("peer has not loaded a filter")
+	}
+	// matching may insert outpoints, so it runs under the filter lock
+	mb, matched, err := BuildMerkleBlock(fb, sn.filters.remote, sn.filters.remoteFlag)
+	sn.filters.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := sn.Send(mb); err != nil {
+		return err
+	}
+	for _, tx := range matched {
+		if err := sn.Send(&TxMessage{Tx: tx}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -27,6 +27,15 @@ type NetworkEnvelope struct {
 }
 
 func NewNetworkEnvelope(command string, payload []byte, testNet bool) (NetworkEnvelope, error) {
+	magic := MAINNET_MAGIC
+	if testNet {
+		magic = TESTNET_MAGIC
+	}
+	return newNetworkEnvelope(command, payload, magic)
+}
+
+// newNetworkEnvelope wraps a payload for the network with the given message start
+func newNetworkEnvelope(command string, payload []byte, magic MagicNum) (NetworkEnvelope, error) {
 	if len(command) > 12 {
 		// length in bytes
 		return NetworkEnvelope{}, fmt.Errorf("command too long: %d bytes (max 12)", len(command))
@@ -35,11 +44,6 @@ func NewNetworkEnvelope(command string, payload []byte, testNet bool) (NetworkEn
 	hash := encoding.Hash256(payload)
 	checksum := binary.LittleEndian.Uint32(hash[:4])
 
-	magic := MAINNET_MAGIC
-	if testNet {
-		magic = TESTNET_MAGIC
-	}
-
 	return NetworkEnvelope{
 		Magic:           magic,
 		Command:         command, // stored unpadded
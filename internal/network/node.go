@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"go-bitcoin/internal/block"
+	"go-bitcoin/internal/mempool"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,19 +20,71 @@ type SimpleNode struct {
 	TestNet      bool
 	Logging      bool
 	PeerServices uint64
-
-	incoming chan NetworkEnvelope
-	outgoing chan Message
-	done     chan struct{}
-	wg       sync.WaitGroup
-
+	Params       *block.ChainParams // chain we speak for; see WithChainParams
+
+	// ProtocolVersion is advertised in our version message; NegotiatedVersion is
+	// min(ours, peer's) and is what feature gates check after the handshake
+	ProtocolVersion   int32
+	NegotiatedVersion int32
+	WtxidRelay        bool // both sides signalled BIP 339 wtxidrelay
+
+	// from the peer's version message
+	PeerVersion     int32
+	PeerUserAgent   string
+	PeerStartHeight int32 // peer's best height when it connected
+	PeerRelay       bool  // peer's fRelay flag: announce transactions without a filter
+
+	// what we advertise in our version message (see NodeOption)
+	Services    uint64
+	UserAgent   string
+	StartHeight int32
+	Relay       bool
+
+	// InvCache, if set, dedupes announcements across peers (see WithInvCache)
+	InvCache *InvCache
+
+	// Mempool, if set, answers the peer's getdata for transactions (see WithMempool)
+	Mempool *mempool.Mempool
+	// Blocks, if set, answers the peer's getdata for blocks (see WithBlockSource)
+	Blocks BlockSource
+	// FilterIndex, if set, answers the peer's BIP 157 filter requests (see WithFilterIndex)
+	FilterIndex *FilterIndex
+
+	peerCmpctVersion atomic.Uint64 // highest sendcmpct version the peer announced
+
+	// HandshakeTimeout bounds the version/verack exchange (see WithHandshakeTimeout)
+	HandshakeTimeout time.Duration
+
+	// keepalive pings sent after the handshake (see WithKeepAlive)
+	PingInterval   time.Duration
+	MaxMissedPongs int
+	keepAlive      keepAlive
+
+	incoming  chan NetworkEnvelope
+	outgoing  [numSendPriorities]chan Message // one queue per sendPriority
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	// mu guards handlers, channelsMap and subscribers so they can change while the loops run
+	mu       sync.RWMutex
 	handlers map[string]MessageHandler
 
 	// dedicated channels for messages we need to wait on
 	channelsMap map[string]chan NetworkEnvelope
+
+	// runtime subscribers, keyed by command then subscription id
+	subscribers map[string]map[uint64]chan NetworkEnvelope
+	unhandled   map[uint64]chan NetworkEnvelope // catch-all for commands nothing else consumes
+	nextSubID   uint64
+	closed      bool
+
+	stats   *trafficStats
+	filters *filterState
+	tap     *WireTap // raw envelope capture (see WithWireTap)
 }
 
-func NewSimpleNode(host string, port int, testNet, logging bool) (*SimpleNode, error) {
+func NewSimpleNode(host string, port int, testNet, logging bool, opts ...NodeOption) (*SimpleNode, error) {
 	ip := net.ParseIP(host)
 	if ip == nil {
 		return nil, fmt.Errorf("invalid ip address: %s", host)
@@ -41,26 +96,46 @@ func NewSimpleNode(host string, port int, testNet, logging bool) (*SimpleNode, e
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to %s:%d - %w", host, port, err)
 	}
+	return newSimpleNodeWithConn(conn, address, port, testNet, logging, opts...), nil
+}
+
+// newSimpleNodeWithConn wraps an established connection and starts the node's loops
+func newSimpleNodeWithConn(conn net.Conn, address [16]byte, port int, testNet, logging bool, opts ...NodeOption) *SimpleNode {
 	sn := &SimpleNode{
 		Addr: NetAddr{
 			Services: 0,
 			Address:  address,
 			Port:     uint16(port),
 		},
-		conn:     conn,
-		TestNet:  testNet,
-		Logging:  logging,
-		incoming: make(chan NetworkEnvelope, 10),
-		outgoing: make(chan Message, 10),
-		done:     make(chan struct{}),
-		handlers: make(map[string]MessageHandler),
+		conn:             conn,
+		TestNet:          testNet,
+		Logging:          logging,
+		Params:           block.Params(testNet),
+		ProtocolVersion:  PROTOCOL_VERSION,
+		Services:         NODE_WITNESS,
+		UserAgent:        DEFAULT_USER_AGENT,
+		HandshakeTimeout: DEFAULT_HANDSHAKE_TIMEOUT,
+		PingInterval:     DEFAULT_PING_INTERVAL,
+		MaxMissedPongs:   DEFAULT_MAX_MISSED_PONGS,
+		incoming:         make(chan NetworkEnvelope, 10),
+		outgoing:         newSendQueues(),
+		done:             make(chan struct{}),
+		handlers:         make(map[string]MessageHandler),
 
 		// dedicated channels for message types (buffered to prevent drops)
 		channelsMap: make(map[string]chan NetworkEnvelope),
+		subscribers: make(map[string]map[uint64]chan NetworkEnvelope),
+		unhandled:   make(map[uint64]chan NetworkEnvelope),
+		stats:       newTrafficStats(),
+		filters:     &filterState{},
+	}
+	for _, opt := range opts {
+		opt(sn)
 	}
 
 	sn.RegisterChannel("version", 1)
 	sn.RegisterChannel("verack", 1)
+	sn.RegisterChannel("wtxidrelay", 1)
 	sn.RegisterChannel("headers", 1)
 	sn.RegisterChannel("block", 1)
 	sn.RegisterChannel("merkleblock", 1)
@@ -70,6 +145,8 @@ func NewSimpleNode(host string, port int, testNet, logging bool) (*SimpleNode, e
 	sn.RegisterChannel("blocktxn", 1)
 	sn.RegisterChannel("sendcmpct", 1)
 	sn.RegisterChannel("cfilter", 1)
+	sn.RegisterChannel("cfheaders", 1)
+	sn.RegisterChannel("cfcheckpt", 1)
 	sn.wg.Add(3)
 
 	go sn.readLoop()
@@ -85,6 +162,8 @@ func NewSimpleNode(host string, port int, testNet, logging bool) (*SimpleNode, e
 		sn.Send(pong)
 	})
 
+	sn.OnMessage("pong", sn.handlePong)
+
 	// Log received verack (no response needed)
 	sn.OnMessage("verack", func(env NetworkEnvelope) {
 		if sn.Logging {
@@ -103,6 +182,11 @@ func NewSimpleNode(host string, port int, testNet, logging bool) (*SimpleNode, e
 		if sn.Logging {
 			fmt.Println("Peer requested compact blocks (BIP 152)")
 		}
+		if msg, err := ParseSendCompactMessage(bytes.NewReader(env.Payload)); err == nil {
+			if msg.Version > sn.peerCmpctVersion.Load() {
+				sn.peerCmpctVersion.Store(msg.Version)
+			}
+		}
 	})
 
 	sn.OnMessage("feefilter", func(env NetworkEnvelope) {
@@ -117,13 +201,90 @@ func NewSimpleNode(host string, port int, testNet, logging bool) (*SimpleNode, e
 		}
 	})
 
-	return sn, nil
+	// Serve requests for data we hold
+	sn.OnMessage("getdata", sn.handleGetData)
+	sn.OnMessage("getcfilters", sn.handleFilterRequest)
+	sn.OnMessage("getcfheaders", sn.handleFilterRequest)
+	sn.OnMessage("getcfcheckpt", sn.handleFilterRequest)
+
+	return sn
 }
 
 func (sn *SimpleNode) RegisterChannel(name string, bufSize int) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
 	sn.channelsMap[name] = make(chan NetworkEnvelope, bufSize)
 }
 
+// channel returns the dedicated channel for command, if one is registered
+func (sn *SimpleNode) channel(command string) (chan NetworkEnvelope, bool) {
+	sn.mu.RLock()
+	defer sn.mu.RUnlock()
+	ch, ok := sn.channelsMap[command]
+	return ch, ok
+}
+
+// Subscribe returns a channel receiving every message with the given command until cancel
+// is called or the connection closes. Safe to call at any time; multiple subscribers to the
+// same command each get their own copy. Messages are dropped if the subscriber falls behind.
+func (sn *SimpleNode) Subscribe(command string, buf int) (<-chan NetworkEnvelope, func()) {
+	ch := make(chan NetworkEnvelope, buf)
+
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	if sn.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	id := sn.nextSubID
+	sn.nextSubID++
+	if sn.subscribers[command] == nil {
+		sn.subscribers[command] = make(map[uint64]chan NetworkEnvelope)
+	}
+	sn.subscribers[command][id] = ch
+
+	cancel := func() {
+		sn.mu.Lock()
+		defer sn.mu.Unlock()
+		subs := sn.subscribers[command]
+		if sub, ok := subs[id]; ok {
+			delete(subs, id)
+			if len(subs) == 0 {
+				delete(sn.subscribers, command)
+			}
+			close(sub)
+		}
+	}
+	return ch, cancel
+}
+
+// SubscribeUnhandled returns a channel receiving every message that has no dedicated
+// channel, subscriber or handler, e.g. protocol messages this package doesn't model yet.
+// Per-command counts are kept in PeerStats.Unhandled either way.
+func (sn *SimpleNode) SubscribeUnhandled(buf int) (<-chan NetworkEnvelope, func()) {
+	ch := make(chan NetworkEnvelope, buf)
+
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	if sn.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	id := sn.nextSubID
+	sn.nextSubID++
+	sn.unhandled[id] = ch
+
+	cancel := func() {
+		sn.mu.Lock()
+		defer sn.mu.Unlock()
+		if sub, ok := sn.unhandled[id]; ok {
+			delete(sn.unhandled, id)
+			close(sub)
+		}
+	}
+	return ch, cancel
+}
+
 func (sn *SimpleNode) readLoop() {
 	defer sn.wg.Done()
 	defer close(sn.incoming) // reader is done
@@ -143,6 +304,8 @@ func (sn *SimpleNode) readLoop() {
 			if sn.Logging {
 				fmt.Printf("receiving: %s\n", env.Command)
 			}
+			sn.stats.recordReceive(env.Command, ENVELOPE_HEADER_SIZE+len(env.Payload))
+			sn.tapEnvelope(CAPTURE_IN, env)
 
 			select {
 			case sn.incoming <- env:
@@ -157,50 +320,52 @@ func (sn *SimpleNode) sendLoop() {
 	defer sn.wg.Done()
 
 	for {
-		select {
-		case msg := <-sn.outgoing:
-			// serialize and write to conn
-			payload, err := msg.Serialize()
-			if err != nil {
-				if sn.Logging {
-					fmt.Printf("serialization error: %v\n", err)
-				}
-				return
-			}
-			envelope, err := NewNetworkEnvelope(msg.Command(), payload, sn.TestNet)
-			if err != nil {
-				if sn.Logging {
-					fmt.Printf("network envelope error: %v\n", err)
-				}
-				return
+		msg, ok := sn.nextOutgoing()
+		if !ok {
+			return
+		}
+		// serialize and write to conn
+		payload, err := msg.Serialize()
+		if err != nil {
+			if sn.Logging {
+				fmt.Printf("serialization error: %v\n", err)
 			}
+			return
+		}
+		envelope, err := newNetworkEnvelope(msg.Command(), payload, sn.Params.Magic)
+		if err != nil {
 			if sn.Logging {
-				fmt.Printf("sending: %s\n", envelope)
+				fmt.Printf("network envelope error: %v\n", err)
 			}
-			data, err := envelope.Serialize()
-			if err != nil {
-				if sn.Logging {
-					fmt.Printf("serialization error: %v\n", err)
-				}
-				return
+			return
+		}
+		if sn.Logging {
+			fmt.Printf("sending: %s\n", envelope)
+		}
+		data, err := envelope.Serialize()
+		if err != nil {
+			if sn.Logging {
+				fmt.Printf("serialization error: %v\n", err)
 			}
-			_, err = sn.conn.Write(data)
-			if err != nil {
-				if sn.Logging {
-					fmt.Printf("write error: %v\n", err)
-				}
-				return
+			return
+		}
+		_, err = sn.conn.Write(data)
+		if err != nil {
+			if sn.Logging {
+				fmt.Printf("write error: %v\n", err)
 			}
-		case <-sn.done:
 			return
 		}
+		sn.stats.recordSend(envelope.Command, len(data))
+		sn.tapEnvelope(CAPTURE_OUT, envelope)
 	}
 }
 
+// Send queues a message for the peer. Control messages are written ahead of block traffic,
+// and both ahead of transaction relay (see sendqueue.go).
 func (sn *SimpleNode) Send(msg Message) error {
-	// send a message to the connected node
 	select {
-	case sn.outgoing <- msg:
+	case sn.outgoing[priorityOf(msg)] <- msg:
 		return nil
 	case <-sn.done:
 		return fmt.Errorf("connection closed")
@@ -210,11 +375,27 @@ func (sn *SimpleNode) Send(msg Message) error {
 func (sn *SimpleNode) messageLoop() {
 	defer func() {
 		sn.wg.Done()
+		sn.mu.Lock()
+		defer sn.mu.Unlock()
+		sn.closed = true
 		for _, ch := range sn.channelsMap {
 			close(ch)
 		}
+		for command, subs := range sn.subscribers {
+			for _, ch := range subs {
+				close(ch)
+			}
+			delete(sn.subscribers, command)
+		}
+		for id, ch := range sn.unhandled {
+			close(ch)
+			delete(sn.unhandled, id)
+		}
 	}()
 	for env := range sn.incoming {
+		sn.trackFilterState(env)
+
+		sn.mu.RLock()
 		// fan out to dedicated channels
 		if ch, ok := sn.channelsMap[env.Command]; ok {
 			// avoid blocking
@@ -229,60 +410,178 @@ func (sn *SimpleNode) messageLoop() {
 			}
 		}
 
+		// and to runtime subscribers
+		for _, ch := range sn.subscribers[env.Command] {
+			select {
+			case ch <- env:
+			default:
+				if sn.Logging {
+					fmt.Printf("Warning: subscriber full for %s, dropping message\n", env.Command)
+				}
+			}
+		}
+
 		// also run handlers
-		if handler, ok := sn.handlers[env.Command]; ok {
+		handler, ok := sn.handlers[env.Command]
+
+		// nothing consumed it: count it and pass it to the catch-all subscribers
+		if _, hasChannel := sn.channelsMap[env.Command]; !hasChannel && !ok && len(sn.subscribers[env.Command]) == 0 {
+			sn.stats.recordUnhandled(env.Command, ENVELOPE_HEADER_SIZE+len(env.Payload))
+			for _, ch := range sn.unhandled {
+				select {
+				case ch <- env:
+				default:
+					if sn.Logging {
+						fmt.Printf("Warning: unhandled subscriber full, dropping %s\n", env.Command)
+					}
+				}
+			}
+		}
+		sn.mu.RUnlock()
+		if ok {
 			go handler(env)
 		}
 	}
 }
 
 func (sn *SimpleNode) OnMessage(command string, handler MessageHandler) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
 	sn.handlers[command] = handler
 }
 
-func (sn *SimpleNode) Handshake() error {
-	msg := DefaultVersionMessage(net.IP(sn.Addr.Address[:]), sn.Addr.Port)
+// Handshake exchanges version/verack with the peer. Options given here override
+// those passed to NewSimpleNode. Failures are reported as *HandshakeError.
+func (sn *SimpleNode) Handshake(opts ...NodeOption) error {
+	for _, opt := range opts {
+		opt(sn)
+	}
+	var deadline <-chan time.Time
+	if sn.HandshakeTimeout > 0 {
+		timer := time.NewTimer(sn.HandshakeTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	msg := sn.versionMessage()
 	if sn.Logging {
 		fmt.Printf("📤 Sending version message with Services: %d\n", msg.Services)
 	}
-	err := sn.Send(&msg)
-	if err != nil {
-		return err
+	if err := sn.Send(&msg); err != nil {
+		return &HandshakeError{Stage: HANDSHAKE_STAGE_VERSION, Err: err}
 	}
 
 	// Receive peer's version message and parse it
-	versionEnv := <-sn.channelsMap["version"]
+	versionEnv, err := sn.awaitHandshakeMessage("version", deadline)
+	if err != nil {
+		return &HandshakeError{Stage: HANDSHAKE_STAGE_VERSION, Err: err}
+	}
 	peerVersion, err := ParseVersionMessage(bytes.NewReader(versionEnv.Payload))
 	if err != nil {
-		return fmt.Errorf("failed to parse peer version: %w", err)
+		return &HandshakeError{Stage: HANDSHAKE_STAGE_VERSION, Err: fmt.Errorf("failed to parse peer version: %w", err)}
+	}
+
+	if peerVersion.Version < MIN_PEER_PROTO_VERSION {
+		return &HandshakeError{
+			Stage: HANDSHAKE_STAGE_NEGOTIATION,
+			Peer:  peerVersion,
+			Err:   fmt.Errorf("peer protocol version %d is below minimum %d", peerVersion.Version, MIN_PEER_PROTO_VERSION),
+		}
 	}
 
-	// Store peer's services
+	// Store what the peer advertised
 	sn.PeerServices = peerVersion.Services
+	sn.PeerVersion = peerVersion.Version
+	sn.PeerUserAgent = peerVersion.UserAgent
+	sn.PeerStartHeight = peerVersion.LatestBlock
+	sn.PeerRelay = peerVersion.Relay
+	sn.NegotiatedVersion = min(sn.ProtocolVersion, peerVersion.Version)
 	if sn.Logging {
 		fmt.Printf("📥 Peer services: %d (binary: %064b)\n", sn.PeerServices, sn.PeerServices)
+		fmt.Printf("📥 Peer version: %d (%s), height %d, negotiated: %d\n",
+			peerVersion.Version, peerVersion.UserAgent, peerVersion.LatestBlock, sn.NegotiatedVersion)
+	}
+
+	// BIP 339: wtxidrelay goes between version and verack
+	if sn.NegotiatedVersion >= WTXID_RELAY_VERSION {
+		if err := sn.Send(&WtxidRelayMessage{}); err != nil {
+			return &HandshakeError{Stage: HANDSHAKE_STAGE_NEGOTIATION, Peer: peerVersion, Err: err}
+		}
 	}
 
-	<-sn.channelsMap["verack"]
+	if _, err := sn.awaitHandshakeMessage("verack", deadline); err != nil {
+		return &HandshakeError{Stage: HANDSHAKE_STAGE_VERACK, Peer: peerVersion, Err: err}
+	}
+
+	// the peer's wtxidrelay (if any) is processed before its verack
+	wtxidCh, _ := sn.channel("wtxidrelay")
+	select {
+	case <-wtxidCh:
+		sn.WtxidRelay = sn.NegotiatedVersion >= WTXID_RELAY_VERSION
+	default:
+	}
 
 	if err := sn.Send(&VerackMessage{}); err != nil {
-		return err
+		return &HandshakeError{Stage: HANDSHAKE_STAGE_VERACK, Peer: peerVersion, Err: err}
 	}
 
 	if sn.Logging {
 		fmt.Println("✓ Handshake complete!")
 	}
 
+	sn.startKeepAlive()
 	return nil
 }
 
+// SupportsSendHeaders reports whether the negotiated version allows sendheaders (BIP 130)
+func (sn *SimpleNode) SupportsSendHeaders() bool {
+	return sn.NegotiatedVersion >= SENDHEADERS_VERSION
+}
+
+// SupportsFeeFilter reports whether the negotiated version allows feefilter (BIP 133)
+func (sn *SimpleNode) SupportsFeeFilter() bool {
+	return sn.NegotiatedVersion >= FEEFILTER_VERSION
+}
+
+// CanServeBlock reports whether the peer should have the block at height. Peers that only
+// advertise NODE_NETWORK_LIMITED keep the last 288 blocks below the tip they announced.
+func (sn *SimpleNode) CanServeBlock(height int32) bool {
+	return canServeBlock(sn.PeerServices, sn.PeerStartHeight, height)
+}
+
+// SupportsCompactBlocks reports whether the peer can speak the given sendcmpct version.
+// Version 2 uses wtxids and also requires the peer to serve witness data.
+func (sn *SimpleNode) SupportsCompactBlocks(version uint64) bool {
+	if sn.NegotiatedVersion < SHORT_IDS_BLOCKS_VERSION {
+		return false
+	}
+	switch version {
+	case 1:
+		return true
+	case 2:
+		return HasServices(sn.PeerServices, NODE_WITNESS)
+	default:
+		return false
+	}
+}
+
+// SendCompact announces compact block support, refusing versions the peer can't use
+func (sn *SimpleNode) SendCompact(highBandwidth bool, version uint64) error {
+	if !sn.SupportsCompactBlocks(version) {
+		return fmt.Errorf("compact blocks version %d not supported by peer (negotiated protocol %d)", version, sn.NegotiatedVersion)
+	}
+	return sn.Send(&SendCompactMessage{
+		HighBandwidth: highBandwidth,
+		Version:       version,
+	})
+}
+
 // default timeout of 5 seconds for a receive
 func (sn *SimpleNode) Receive(command string) (NetworkEnvelope, error) {
 	timeout := time.NewTimer(5 * time.Second)
 	defer timeout.Stop()
-	var ch chan NetworkEnvelope
-	var ok bool
-	if ch, ok = sn.channelsMap[command]; !ok {
+	ch, ok := sn.channel(command)
+	if !ok {
 		return NetworkEnvelope{}, errors.New("unknown command")
 	}
 	select {
@@ -302,9 +601,8 @@ func (sn *SimpleNode) Receive(command string) (NetworkEnvelope, error) {
 func (sn *SimpleNode) ReceiveWithTimeout(command string, timeout time.Duration) (NetworkEnvelope, error) {
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
-	var ch chan NetworkEnvelope
-	var ok bool
-	if ch, ok = sn.channelsMap[command]; !ok {
+	ch, ok := sn.channel(command)
+	if !ok {
 		return NetworkEnvelope{}, errors.New("unknown command")
 	}
 	select {
@@ -330,13 +628,18 @@ func (sn *SimpleNode) RequestMerkleBlock(blockHash [32]byte) error {
 	return nil
 }
 
+// Close disconnects the peer. It is safe to call more than once (e.g. by both a
+// PeerManager and a sync that rotated away from the peer).
 func (sn *SimpleNode) Close() error {
-	close(sn.done)
-	err := sn.conn.Close()
-	sn.wg.Wait()
+	var err error
+	sn.closeOnce.Do(func() {
+		close(sn.done)
+		err = sn.conn.Close()
+		sn.wg.Wait()
 
-	if sn.Logging {
-		fmt.Printf("closing connection to %s...\n", sn.conn.RemoteAddr().String())
-	}
+		if sn.Logging {
+			fmt.Printf("closing connection to %s...\n", sn.conn.RemoteAddr().String())
+		}
+	})
 	return err
 }
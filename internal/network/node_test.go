@@ -0,0 +1,843 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-bitcoin/internal/block"
+	"go-bitcoin/internal/mempool"
+	"go-bitcoin/internal/transactions"
+	"net"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newPipeNode returns a node wired to an in-memory connection and the remote end of it
+func newPipeNode(t *testing.T) (*SimpleNode, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	sn := newSimpleNodeWithConn(local, [16]byte{}, MAINNET_PORT, false, false)
+	t.Cleanup(func() {
+		remote.Close()
+		sn.Close()
+	})
+	return sn, remote
+}
+
+// deliver writes a raw message to the node from the remote end (safe to call from a goroutine)
+func deliver(t *testing.T, remote net.Conn, command string, payload []byte) {
+	t.Helper()
+	env, err := NewNetworkEnvelope(command, payload, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := env.Serialize()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := remote.Write(data); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	sn, remote := newPipeNode(t)
+
+	subA, cancelA := sn.Subscribe("addr", 4)
+	subB, cancelB := sn.Subscribe("addr", 4)
+	defer cancelB()
+
+	deliver(t, remote, "addr", []byte{0x01})
+	for name, sub := range map[string]<-chan NetworkEnvelope{"A": subA, "B": subB} {
+		select {
+		case env := <-sub:
+			if env.Command != "addr" {
+				t.Fatalf("subscriber %s got %s", name, env.Command)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscriber %s got nothing", name)
+		}
+	}
+
+	// cancelled subscriber is closed and no longer receives
+	cancelA()
+	cancelA() // idempotent
+	if _, ok := <-subA; ok {
+		t.Fatal("expected cancelled subscription to be closed")
+	}
+	deliver(t, remote, "addr", []byte{0x02})
+	select {
+	case env := <-subB:
+		if env.Payload[0] != 0x02 {
+			t.Fatalf("unexpected payload %x", env.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("remaining subscriber got nothing")
+	}
+
+	// connection loss closes remaining subscriptions
+	remote.Close()
+	select {
+	case _, ok := <-subB:
+		if ok {
+			t.Fatal("expected subscription to close with connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription not closed after disconnect")
+	}
+	t.Logf("✓ Subscribers receive, cancel and close cleanly")
+}
+
+func TestReceiveTyped(t *testing.T) {
+	sn, remote := newPipeNode(t)
+
+	// registered channel
+	cf := &CFilterMessage{FType: BASIC, BlockHash: [32]byte{0xaa}, FilterBytes: []byte{0x01, 0x02}}
+	payload, err := cf.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, remote, "cfilter", payload)
+	msg, err := sn.ReceiveTyped("cfilter", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := msg.(*CFilterMessage)
+	if !ok {
+		t.Fatalf("expected *CFilterMessage, got %T", msg)
+	}
+	if got.BlockHash != cf.BlockHash || !bytes.Equal(got.FilterBytes, cf.FilterBytes) {
+		t.Fatalf("decoded cfilter mismatch: %+v", got)
+	}
+
+	// command without a dedicated channel goes through a temporary subscription
+	inv := &InvMessage{Inventory: []DataItem{{Type: DATA_TYPE_BLOCK, Identifier: [32]byte{0x01}}}}
+	payload, err = inv.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		deliver(t, remote, "inv", payload)
+	}()
+	msg, err = sn.ReceiveTyped("inv", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotInv := msg.(*InvMessage); len(gotInv.Inventory) != 1 || gotInv.Inventory[0] != inv.Inventory[0] {
+		t.Fatalf("decoded inv mismatch: %+v", gotInv)
+	}
+
+	if _, err := ParseMessage(NetworkEnvelope{Command: "nosuchcommand"}); err == nil {
+		t.Fatal("expected error for unregistered command")
+	}
+	t.Logf("✓ Typed receive decodes registered messages")
+}
+
+func TestSendAndWaitCorrelation(t *testing.T) {
+	sn, remote := newPipeNode(t)
+
+	// peer answers a stale ping first, then ours
+	go func() {
+		env, err := ParseNetworkEnvelope(remote)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		deliver(t, remote, "pong", []byte{0, 0, 0, 0, 0, 0, 0, 0x99})
+		deliver(t, remote, "pong", env.Payload)
+	}()
+
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	resp, err := sn.SendAndWait(&PingMessage{Nonce: nonce}, "pong", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pong := resp.(*PongMessage); !bytes.Equal(pong.Nonce, nonce) {
+		t.Fatalf("got pong nonce %x, want %x", pong.Nonce, nonce)
+	}
+
+	// uncorrelated responses alone time out
+	go func() {
+		if _, err := ParseNetworkEnvelope(remote); err != nil {
+			t.Error(err)
+			return
+		}
+		wrong := &CfHeadersMessage{FType: BASIC, StopHash: [32]byte{0xee}}
+		payload, _ := wrong.Serialize()
+		deliver(t, remote, "cfheaders", payload)
+	}()
+	req := &GetCfHeadersMessage{FType: BASIC, StopHash: [32]byte{0x01}}
+	if _, err := sn.SendAndWait(req, "cfheaders", 200*time.Millisecond); err == nil {
+		t.Fatal("expected timeout for uncorrelated cfheaders")
+	}
+
+	stats := sn.Stats()
+	if got := stats.Received["pong"]; got.Count != 2 || got.Bytes != 2*(ENVELOPE_HEADER_SIZE+8) {
+		t.Errorf("unexpected pong stats: %+v", got)
+	}
+	if got := stats.Sent["ping"]; got.Count != 1 || got.Bytes != ENVELOPE_HEADER_SIZE+8 {
+		t.Errorf("unexpected ping stats: %+v", got)
+	}
+	if stats.MessagesReceived != 3 || stats.MessagesSent != 2 {
+		t.Errorf("unexpected totals: received %d, sent %d", stats.MessagesReceived, stats.MessagesSent)
+	}
+	t.Logf("✓ SendAndWait ignores responses to other requests")
+}
+
+func TestNodeOptions(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	sn := newSimpleNodeWithConn(local, [16]byte{}, MAINNET_PORT, false, false,
+		WithServices(NODE_NONE),
+		WithUserAgent("/spv-wallet:1.0/"),
+		WithStartHeight(850000),
+	)
+	defer sn.Close()
+
+	msg := sn.versionMessage()
+	if msg.Services != NODE_NONE || msg.UserAgent != "/spv-wallet:1.0/" || msg.LatestBlock != 850000 || msg.Relay {
+		t.Fatalf("options not applied: %+v", msg)
+	}
+	if msg.Version != PROTOCOL_VERSION {
+		t.Fatalf("expected default protocol version %d, got %d", PROTOCOL_VERSION, msg.Version)
+	}
+
+	// handshake-time options override construction-time ones
+	WithRelay(true)(sn)
+	WithStartHeight(850001)(sn)
+	msg = sn.versionMessage()
+	if !msg.Relay || msg.LatestBlock != 850001 {
+		t.Fatalf("override not applied: %+v", msg)
+	}
+}
+
+func TestRelayPolicy(t *testing.T) {
+	sn, remote := newPipeNode(t)
+	tx := transactions.NewTransaction(1, nil, nil, 0, false, false)
+	txid, err := tx.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal := txid
+	slices.Reverse(internal[:])
+
+	announce, _ := (&InvMessage{Inventory: []DataItem{{Type: DATA_TYPE_TX, Identifier: internal}}}).Serialize()
+
+	// we advertised Relay=false: announcements before our filterload are dropped
+	deliver(t, remote, "inv", announce)
+	deliver(t, remote, "verack", nil) // flush: handled after the inv
+	if _, err := sn.ReceiveWithTimeout("verack", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := sn.AnnouncedTxs(); len(got) != 0 {
+		t.Fatalf("expected no queued announcements, got %d", len(got))
+	}
+
+	bf := NewBloomFilter(10, 5, 1)
+	go ParseNetworkEnvelope(remote) // consume our filterload
+	if err := sn.LoadFilter(&bf, 0); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, remote, "inv", announce)
+	deliver(t, remote, "verack", nil)
+	if _, err := sn.ReceiveWithTimeout("verack", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := sn.AnnouncedTxs(); len(got) != 1 || got[0] != internal {
+		t.Fatalf("expected queued announcement, got %x", got)
+	}
+
+	// peer sent relay=false and no filter: nothing is relayed to it
+	if ok, _ := sn.ShouldRelayTx(&tx); ok {
+		t.Fatal("expected no relay to peer without relay flag or filter")
+	}
+
+	// once the peer loads a filter, matching transactions are relayed
+	peerFilter := NewBloomFilter(10, 5, 7)
+	peerFilter.Add(internal[:])
+	load, _ := (&FilterLoadMessage{Filter: &peerFilter}).Serialize()
+	deliver(t, remote, "filterload", load)
+	deliver(t, remote, "verack", nil)
+	if _, err := sn.ReceiveWithTimeout("verack", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := sn.ShouldRelayTx(&tx); !ok {
+		t.Fatal("expected relay of transaction matching peer filter")
+	}
+	t.Logf("✓ Relay flag and filter state honored in both directions")
+}
+
+func TestFilterAddClear(t *testing.T) {
+	sn, remote := newPipeNode(t)
+	item := []byte("new address hash")
+
+	if err := sn.AddToFilter(item); err == nil {
+		t.Fatal("expected filteradd without a loaded filter to fail")
+	}
+
+	// the peer loads an empty filter, then adds to it incrementally
+	bf := NewBloomFilter(10, 5, 3)
+	load, _ := (&FilterLoadMessage{Filter: &bf}).Serialize()
+	add, _ := (&FilterAddMessage{Data: item}).Serialize()
+	parsed, err := ParseFilterAddMessage(bytes.NewReader(add))
+	if err != nil || !bytes.Equal(parsed.Data, item) {
+		t.Fatalf("filteradd round trip failed: %x, %v", parsed.Data, err)
+	}
+	deliver(t, remote, "filterload", load)
+	deliver(t, remote, "filteradd", add)
+	deliver(t, remote, "verack", nil)
+	if _, err := sn.ReceiveWithTimeout("verack", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	filter, _, ok := sn.PeerFilter()
+	if !ok || !filter.Contains(item) {
+		t.Fatal("expected peer filter to contain added item")
+	}
+
+	deliver(t, remote, "filterclear", nil)
+	deliver(t, remote, "verack", nil)
+	if _, err := sn.ReceiveWithTimeout("verack", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := sn.PeerFilter(); ok {
+		t.Fatal("expected filterclear to remove peer filter")
+	}
+
+	oversized := &FilterAddMessage{Data: make([]byte, MAX_FILTERADD_SIZE+1)}
+	if _, err := oversized.Serialize(); err == nil {
+		t.Fatal("expected oversized filteradd to be rejected")
+	}
+	t.Logf("✓ filteradd and filterclear update peer filter state")
+}
+
+func TestInvCacheDedup(t *testing.T) {
+	cache := NewInvCache(2)
+	a, b, c := [32]byte{0xa}, [32]byte{0xb}, [32]byte{0xc}
+	if !cache.Add(a) || !cache.Add(b) || cache.Add(a) {
+		t.Fatal("unexpected new/known result")
+	}
+	cache.Add(c) // evicts b, the least recently seen
+	if cache.Seen(b) || !cache.Seen(a) || !cache.Seen(c) || cache.Len() != 2 {
+		t.Fatal("LRU eviction order wrong")
+	}
+
+	// two peers sharing the cache only request the item once
+	shared := NewInvCache(0)
+	items := []DataItem{{Type: DATA_TYPE_BLOCK, Identifier: [32]byte{0x01}}}
+	for i, expected := range []int{1, 0} {
+		sn, remote := newPipeNode(t)
+		WithInvCache(shared)(sn)
+		if expected > 0 {
+			go ParseNetworkEnvelope(remote) // consume getdata
+		}
+		n, err := sn.RequestInventory(items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Fatalf("peer %d requested %d items, expected %d", i, n, expected)
+		}
+	}
+}
+
+func TestInventoryParsing(t *testing.T) {
+	inv := NewInvMessage(
+		InvVector{Type: DATA_TYPE_TX, Identifier: [32]byte{0x01}},
+		InvVector{Type: DATA_TYPE_BLOCK, Identifier: [32]byte{0x02}},
+		InvVector{Type: DATA_TYPE_WTX, Identifier: [32]byte{0x03}},
+	)
+	payload, err := inv.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseInvMessage(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(parsed.Inventory, inv.Inventory) {
+		t.Fatalf("inv round trip mismatch: %v", parsed.Inventory)
+	}
+	if len(parsed.Txs()) != 2 || len(parsed.Blocks()) != 1 {
+		t.Fatalf("expected 2 txs and 1 block, got %d and %d", len(parsed.Txs()), len(parsed.Blocks()))
+	}
+
+	gd := parsed.ToGetData(true)
+	want := []DataType{DATA_TYPE_WITNESS_TX, DATA_TYPE_WITNESS_BLOCK, DATA_TYPE_WTX}
+	for i, item := range gd.Data {
+		if item.Type != want[i] {
+			t.Errorf("item %d: got %s, want %s", i, item.Type, want[i])
+		}
+	}
+	if uint32(DATA_TYPE_WITNESS_TX) != 0x40000001 || uint32(DATA_TYPE_WITNESS_BLOCK) != 0x40000002 {
+		t.Fatal("witness inventory types have wrong values")
+	}
+
+	payload, err = gd.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedGd, err := ParseGetDataMessage(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back := parsedGd.ToInv(); !slices.Equal(back.Inventory, inv.Inventory) {
+		t.Fatalf("getdata -> inv mismatch: %v", back.Inventory)
+	}
+}
+
+func TestHandshakePeerInfo(t *testing.T) {
+	sn, remote := newPipeNode(t)
+
+	peer := DefaultVersionMessage(net.IPv4(127, 0, 0, 1), uint16(MAINNET_PORT))
+	peer.Version = 70016
+	peer.Services = NODE_NETWORK | NODE_WITNESS
+	peer.UserAgent = "/Satoshi:27.0.0/"
+	peer.LatestBlock = 840000
+	peer.Relay = true
+	peerPayload, err := peer.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan []string, 1)
+	go func() {
+		var commands []string
+		env, err := ParseNetworkEnvelope(remote)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		commands = append(commands, env.Command)
+		deliver(t, remote, "version", peerPayload)
+		deliver(t, remote, "wtxidrelay", nil)
+		deliver(t, remote, "verack", nil)
+		for range 2 { // our wtxidrelay and verack
+			env, err := ParseNetworkEnvelope(remote)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			commands = append(commands, env.Command)
+		}
+		sent <- commands
+	}()
+
+	if err := sn.Handshake(WithProtocolVersion(70016)); err != nil {
+		t.Fatal(err)
+	}
+	if commands := <-sent; !slices.Equal(commands, []string{"version", "wtxidrelay", "verack"}) {
+		t.Fatalf("unexpected handshake sequence: %v", commands)
+	}
+	if sn.PeerVersion != 70016 || sn.PeerUserAgent != "/Satoshi:27.0.0/" || sn.PeerStartHeight != 840000 || !sn.PeerRelay {
+		t.Fatalf("peer info not stored: version=%d ua=%q height=%d relay=%v",
+			sn.PeerVersion, sn.PeerUserAgent, sn.PeerStartHeight, sn.PeerRelay)
+	}
+	if sn.NegotiatedVersion != 70016 || !sn.WtxidRelay || !sn.SupportsCompactBlocks(2) {
+		t.Fatalf("expected wtxidrelay and compact v2 after negotiating 70016")
+	}
+	t.Logf("✓ Handshake with %s at height %d", sn.PeerUserAgent, sn.PeerStartHeight)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	peer := DefaultVersionMessage(net.IPv4(127, 0, 0, 1), uint16(MAINNET_PORT))
+	peer.Version = 70016
+	peer.UserAgent = "/Satoshi:27.0.0/"
+	peerPayload, err := peer.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		respond  func(remote net.Conn)
+		stage    string
+		peerInfo bool
+	}{
+		{"silent peer", ignoreAll, HANDSHAKE_STAGE_VERSION, false},
+		{"no verack", func(remote net.Conn) {
+			deliver(t, remote, "version", peerPayload)
+			ignoreAll(remote)
+		}, HANDSHAKE_STAGE_VERACK, true},
+	}
+	for _, tt := range tests {
+		sn, remote := newPipeNode(t)
+		go tt.respond(remote)
+
+		err := sn.Handshake(WithHandshakeTimeout(50 * time.Millisecond))
+		var hsErr *HandshakeError
+		if !errors.As(err, &hsErr) || !errors.Is(err, ErrHandshakeTimeout) {
+			t.Fatalf("%s: expected handshake timeout, got %v", tt.name, err)
+		}
+		if hsErr.Stage != tt.stage {
+			t.Errorf("%s: failed at stage %s, want %s", tt.name, hsErr.Stage, tt.stage)
+		}
+		if (hsErr.Peer != nil) != tt.peerInfo || (tt.peerInfo && hsErr.Peer.UserAgent != "/Satoshi:27.0.0/") {
+			t.Errorf("%s: unexpected peer version in error: %v", tt.name, hsErr.Peer)
+		}
+		t.Logf("✓ %s: %v", tt.name, err)
+	}
+}
+
+func TestServeMempoolTx(t *testing.T) {
+	pool := mempool.New()
+	local, remote := net.Pipe()
+	sn := newSimpleNodeWithConn(local, [16]byte{}, MAINNET_PORT, false, false, WithMempool(pool))
+	t.Cleanup(func() {
+		remote.Close()
+		sn.Close()
+	})
+
+	in := transactions.NewTxIn(bytes.Repeat([]byte{0x11}, 32), 0, 0xffffffff)
+	in.Witness = [][]byte{{0xaa, 0xbb}}
+	tx := transactions.NewTransaction(2, []transactions.TxIn{in}, nil, 0, false, true)
+	pool.Add(&tx)
+	txid, _ := tx.Hash()
+	wtxid, _ := tx.WitnessHash()
+	slices.Reverse(txid[:])
+	slices.Reverse(wtxid[:])
+	legacy, _ := tx.SerializeLegacy()
+	witness, _ := tx.SerializeSegwit()
+
+	tests := []struct {
+		name    string
+		item    InvVector
+		command string
+		payload []byte
+	}{
+		{"MSG_TX strips witness", InvVector{Type: DATA_TYPE_TX, Identifier: txid}, "tx", legacy},
+		{"MSG_WITNESS_TX", InvVector{Type: DATA_TYPE_WITNESS_TX, Identifier: txid}, "tx", witness},
+		{"MSG_WTX by wtxid", InvVector{Type: DATA_TYPE_WTX, Identifier: wtxid}, "tx", witness},
+		{"unknown txid", InvVector{Type: DATA_TYPE_TX, Identifier: [32]byte{0x01}}, "notfound", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := NewGetDataMessage()
+			req.AddData(tt.item.Type, tt.item.Identifier)
+			payload, _ := req.Serialize()
+			go deliver(t, remote, "getdata", payload)
+
+			env, err := ParseNetworkEnvelope(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Command != tt.command {
+				t.Fatalf("expected %s, got %s", tt.command, env.Command)
+			}
+			if tt.payload != nil && !bytes.Equal(env.Payload, tt.payload) {
+				t.Fatalf("unexpected %s payload %x", env.Command, env.Payload)
+			}
+			t.Logf("✓ %s answered with %s", tt.name, env.Command)
+		})
+	}
+}
+
+// testBlockSource serves blocks from memory
+type testBlockSource struct {
+	blocks map[[32]byte][]byte
+	tip    *block.Block
+}
+
+func (s *testBlockSource) RawBlock(hash [32]byte) ([]byte, int, bool) {
+	raw, ok := s.blocks[hash]
+	return raw, 100, ok
+}
+
+func (s *testBlockSource) Tip() (int, *block.Block) {
+	return 100, s.tip
+}
+
+func TestServeStoredBlocks(t *testing.T) {
+	data, err := os.ReadFile("testdata/bip158-vectors.json")
+	if err != nil {
+		t.Skip("Test vectors not found")
+	}
+	var vectors []BIP158TestVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	var raw []byte
+	for _, vec := range vectors {
+		if vec.Notes == "Includes witness data" {
+			raw, _ = hex.DecodeString(vec.Block)
+		}
+	}
+	fb, err := block.ParseFullBlock(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := fb.BlockHeader.Hash()
+	source := &testBlockSource{blocks: map[[32]byte][]byte{[32]byte(hash): raw}, tip: fb.BlockHeader}
+
+	local, remote := net.Pipe()
+	sn := newSimpleNodeWithConn(local, [16]byte{}, MAINNET_PORT, false, false, WithBlockSource(source))
+	t.Cleanup(func() {
+		remote.Close()
+		sn.Close()
+	})
+	request := func(dt DataType) NetworkEnvelope {
+		t.Helper()
+		req := NewGetDataMessage()
+		req.AddData(dt, [32]byte(hash))
+		payload, _ := req.Serialize()
+		go deliver(t, remote, "getdata", payload)
+		env, err := ParseNetworkEnvelope(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return env
+	}
+
+	if env := request(DATA_TYPE_WITNESS_BLOCK); env.Command != "block" || !bytes.Equal(env.Payload, raw) {
+		t.Fatalf("MSG_WITNESS_BLOCK: expected stored block, got %s", env.Command)
+	}
+
+	env := request(DATA_TYPE_BLOCK)
+	if env.Command != "block" || len(env.Payload) >= len(raw) {
+		t.Fatalf("MSG_BLOCK: expected witness-stripped block, got %s of %d bytes", env.Command, len(env.Payload))
+	}
+	stripped, err := block.ParseFullBlock(bytes.NewReader(env.Payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tx := range stripped.Txs {
+		want, _ := fb.Txs[i].Hash()
+		if got, _ := tx.Hash(); got != want || tx.IsSegwit {
+			t.Fatalf("MSG_BLOCK tx %d changed or kept witness", i)
+		}
+	}
+
+	// the vector block is years old: compact requests get the full block
+	if env := request(DATA_TYPE_CMPCT_BLOCK); env.Command != "block" {
+		t.Fatalf("stale MSG_CMPCT_BLOCK: expected block, got %s", env.Command)
+	}
+	freshTip := *fb.BlockHeader
+	freshTip.TimeStamp = uint32(time.Now().Unix())
+	source.tip = &freshTip
+	env = request(DATA_TYPE_CMPCT_BLOCK)
+	if env.Command != "cmpctblock" {
+		t.Fatalf("recent MSG_CMPCT_BLOCK: expected cmpctblock, got %s", env.Command)
+	}
+	cb, err := ParseCompactBlockMessage(bytes.NewReader(env.Payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cb.ShortIDs) != len(fb.Txs)-1 || len(cb.PrefilledTxns) != 1 {
+		t.Fatalf("unexpected compact block: %d short ids, %d prefilled", len(cb.ShortIDs), len(cb.PrefilledTxns))
+	}
+	t.Logf("✓ Served witness, stripped and compact forms of a %d-tx block", len(fb.Txs))
+}
+
+// prunedBlockSource serves blocks from memory at their own heights and reports itself pruned
+type prunedBlockSource struct {
+	testBlockSource
+	heights   map[[32]byte]int
+	tipHeight int
+}
+
+func (s *prunedBlockSource) RawBlock(hash [32]byte) ([]byte, int, bool) {
+	raw, ok := s.blocks[hash]
+	return raw, s.heights[hash], ok
+}
+
+func (s *prunedBlockSource) Tip() (int, *block.Block) {
+	return s.tipHeight, s.tip
+}
+
+func (s *prunedBlockSource) Pruned() bool {
+	return true
+}
+
+func TestServePrunedBlocks(t *testing.T) {
+	tipHeight := 1000
+	oldest := tipHeight - int(NODE_NETWORK_LIMITED_MIN_BLOCKS) // just outside the window
+	source := &prunedBlockSource{
+		testBlockSource: testBlockSource{blocks: make(map[[32]byte][]byte)},
+		heights:         make(map[[32]byte]int),
+		tipHeight:       tipHeight,
+	}
+	var hashes [][32]byte
+	for _, height := range []int{oldest, oldest + 1} {
+		header := block.NewBlock(1, [32]byte{}, [32]byte{}, uint32(height), 0x207fffff, 0, nil)
+		raw, _ := header.Serialize()
+		hash, _ := header.Hash()
+		source.blocks[[32]byte(hash)] = append(raw, 0x00)
+		source.heights[[32]byte(hash)] = height
+		source.tip = &header
+		hashes = append(hashes, [32]byte(hash))
+	}
+
+	local, remote := net.Pipe()
+	sn := newSimpleNodeWithConn(local, [16]byte{}, MAINNET_PORT, false, false,
+		WithServices(NODE_NETWORK|NODE_WITNESS), WithBlockSource(source))
+	t.Cleanup(func() {
+		remote.Close()
+		sn.Close()
+	})
+	if msg := sn.versionMessage(); msg.Services != NODE_NETWORK_LIMITED|NODE_WITNESS || msg.SenderAddr.Services != msg.Services {
+		t.Fatalf("expected NODE_NETWORK downgraded to NODE_NETWORK_LIMITED, got %b", msg.Services)
+	}
+
+	// only the second block is inside the window, so it is the first one sent back
+	req := NewGetDataMessage()
+	req.AddData(DATA_TYPE_WITNESS_BLOCK, hashes[0])
+	req.AddData(DATA_TYPE_WITNESS_BLOCK, hashes[1])
+	payload, _ := req.Serialize()
+	go deliver(t, remote, "getdata", payload)
+	env, err := ParseNetworkEnvelope(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Command != "block" || !bytes.Equal(env.Payload, source.blocks[hashes[1]]) {
+		t.Fatalf("expected only the recent block to be served, got %s", env.Command)
+	}
+	t.Logf("✓ Pruned node advertises %b and serves the last %d blocks", NODE_NETWORK_LIMITED|NODE_WITNESS, NODE_NETWORK_LIMITED_MIN_BLOCKS)
+}
+
+func TestKeepAlive(t *testing.T) {
+	local, remote := net.Pipe()
+	sn := newSimpleNodeWithConn(local, [16]byte{}, MAINNET_PORT, false, false, WithKeepAlive(20*time.Millisecond, 2))
+	t.Cleanup(func() {
+		remote.Close()
+		sn.Close()
+	})
+
+	// answer the first ping, then go silent
+	answered := make(chan struct{})
+	go func() {
+		for {
+			env, err := ParseNetworkEnvelope(remote)
+			if err != nil {
+				return
+			}
+			if env.Command != "ping" {
+				continue
+			}
+			select {
+			case <-answered:
+			default:
+				deliver(t, remote, "pong", env.Payload)
+				close(answered)
+			}
+		}
+	}()
+	sn.startKeepAlive()
+
+	select {
+	case <-answered:
+	case <-time.After(time.Second):
+		t.Fatal("no keepalive ping sent")
+	}
+	select {
+	case <-sn.done:
+	case <-time.After(time.Second):
+		t.Fatal("expected disconnect after missed pongs")
+	}
+	if sn.Stats().PingRTT <= 0 {
+		t.Fatal("expected RTT from the answered ping")
+	}
+	t.Logf("✓ RTT %v measured, peer dropped after missing pongs", sn.PingRTT())
+}
+
+func TestWireTap(t *testing.T) {
+	var buf bytes.Buffer
+	local, remote := net.Pipe()
+	sn := newSimpleNodeWithConn(local, [16]byte{}, MAINNET_PORT, false, false, WithWireTap(NewWireTap(&buf)))
+
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	go deliver(t, remote, "ping", nonce)
+	env, err := ParseNetworkEnvelope(remote)
+	if err != nil || env.Command != "pong" {
+		t.Fatalf("expected pong, got %v", err)
+	}
+	remote.Close()
+	sn.Close() // waits for the loops, so every record is written
+
+	var records []CaptureRecord
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec CaptureRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	want := []struct{ dir, command string }{{CAPTURE_IN, "ping"}, {CAPTURE_OUT, "pong"}}
+	for i, w := range want {
+		rec := records[i]
+		if rec.Direction != w.dir || rec.Command != w.command {
+			t.Errorf("record %d: got %s %s, want %s %s", i, rec.Direction, rec.Command, w.dir, w.command)
+		}
+		if rec.Payload != hex.EncodeToString(nonce) || rec.Size != ENVELOPE_HEADER_SIZE+len(nonce) {
+			t.Errorf("record %d: unexpected payload %s (size %d)", i, rec.Payload, rec.Size)
+		}
+	}
+	t.Logf("✓ Envelopes captured in both directions")
+}
+
+func TestSendPriority(t *testing.T) {
+	// no loops running: fill the queues by hand and drain them in order
+	sn := &SimpleNode{outgoing: newSendQueues(), done: make(chan struct{})}
+	txRelay := &InvMessage{Inventory: []InvVector{{Type: DATA_TYPE_TX}}}
+	blockAnnounce := &InvMessage{Inventory: []InvVector{{Type: DATA_TYPE_BLOCK}}}
+	pong := &PongMessage{Nonce: make([]byte, 8)}
+	for _, msg := range []Message{txRelay, txRelay, blockAnnounce, pong} {
+		if err := sn.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []Message{pong, blockAnnounce, txRelay, txRelay}
+	for i, w := range want {
+		got, ok := sn.nextOutgoing()
+		if !ok || got != w {
+			t.Fatalf("message %d: got %s, want %s", i, got.Command(), w.Command())
+		}
+	}
+	close(sn.done)
+	if _, ok := sn.nextOutgoing(); ok {
+		t.Fatal("expected no message after close")
+	}
+	t.Logf("✓ Control messages written before blocks and tx relay")
+}
+
+func TestUnhandledCommands(t *testing.T) {
+	sn, remote := newPipeNode(t)
+	unhandled, cancel := sn.SubscribeUnhandled(4)
+	defer cancel()
+
+	go deliver(t, remote, "sendtxrcncl", []byte{1, 0, 0, 0})
+	select {
+	case env := <-unhandled:
+		if env.Command != "sendtxrcncl" {
+			t.Fatalf("expected sendtxrcncl, got %s", env.Command)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unknown command not passed through")
+	}
+
+	// ping has a handler, so it is neither passed through nor counted
+	go deliver(t, remote, "ping", make([]byte, 8))
+	if env, err := ParseNetworkEnvelope(remote); err != nil || env.Command != "pong" {
+		t.Fatalf("expected pong, got %v", err)
+	}
+	select {
+	case env := <-unhandled:
+		t.Fatalf("handled command %s passed through", env.Command)
+	default:
+	}
+
+	stats := sn.Stats().Unhandled
+	if len(stats) != 1 || stats["sendtxrcncl"].Count != 1 || stats["sendtxrcncl"].Bytes != ENVELOPE_HEADER_SIZE+4 {
+		t.Fatalf("unexpected unhandled stats: %v", stats)
+	}
+	t.Logf("✓ Unknown commands counted and passed through")
+}
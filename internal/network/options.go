@@ -0,0 +1,93 @@
+package network
+
+import (
+	"go-bitcoin/internal/block"
+	"go-bitcoin/internal/mempool"
+)
+
+// DEFAULT_USER_AGENT is the BIP 14 user agent we advertise unless overridden
+const DEFAULT_USER_AGENT string = "/programmingbitcoin:0.1/"
+
+// NodeOption configures what a SimpleNode advertises in its version message
+type NodeOption func(*SimpleNode)
+
+// WithUserAgent sets the BIP 14 user agent string
+func WithUserAgent(ua string) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.UserAgent = ua
+	}
+}
+
+// WithServices sets the service bits we advertise (NODE_NONE for an SPV client)
+func WithServices(services uint64) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.Services = services
+	}
+}
+
+// WithStartHeight sets the best block height we advertise
+func WithStartHeight(height int32) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.StartHeight = height
+	}
+}
+
+// WithRelay sets the fRelay flag; false asks the peer not to announce transactions
+// until we load a bloom filter (BIP 37)
+func WithRelay(relay bool) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.Relay = relay
+	}
+}
+
+// WithProtocolVersion sets the protocol version we advertise
+func WithProtocolVersion(version int32) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.ProtocolVersion = version
+	}
+}
+
+// WithMempool serves the peer's getdata requests for transactions from pool
+func WithMempool(pool *mempool.Mempool) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.Mempool = pool
+	}
+}
+
+// WithBlockSource serves the peer's getdata requests for blocks from stored blocks. A
+// pruned source (see PrunedBlockSource) downgrades NODE_NETWORK to NODE_NETWORK_LIMITED.
+func WithBlockSource(blocks BlockSource) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.Blocks = blocks
+	}
+}
+
+// WithChainParams speaks for a chain other than the built-in mainnet or testnet (a
+// devnet or regtest): its magic frames our messages and its genesis block and proof of
+// work rules drive header sync
+func WithChainParams(params *block.ChainParams) NodeOption {
+	return func(sn *SimpleNode) {
+		sn.Params = params
+	}
+}
+
+// advertisedServices is Services, with NODE_NETWORK swapped for NODE_NETWORK_LIMITED
+// while the block source is pruned
+func (sn *SimpleNode) advertisedServices() uint64 {
+	if sn.pruned() && HasServices(sn.Services, NODE_NETWORK) {
+		return sn.Services&^NODE_NETWORK | NODE_NETWORK_LIMITED
+	}
+	return sn.Services
+}
+
+// versionMessage builds the version message from the node's configured options
+func (sn *SimpleNode) versionMessage() VersionMessage {
+	msg := DefaultVersionMessage(sn.Addr.Address[:], sn.Addr.Port)
+	msg.Version = sn.ProtocolVersion
+	msg.Services = sn.advertisedServices()
+	msg.SenderAddr.Services = msg.Services
+	msg.UserAgent = sn.UserAgent
+	msg.LatestBlock = sn.StartHeight
+	msg.Relay = sn.Relay
+	return msg
+}
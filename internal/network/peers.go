@@ -0,0 +1,213 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+)
+
+// HasServices reports whether a peer's advertised services include every required bit
+func HasServices(services, required uint64) bool {
+	return services&required == required
+}
+
+// NODE_NETWORK_LIMITED_MIN_BLOCKS is how many blocks below its tip a NODE_NETWORK_LIMITED
+// peer is guaranteed to serve (BIP 159)
+const NODE_NETWORK_LIMITED_MIN_BLOCKS int32 = 288
+
+// NoBlockPeerError is returned when a historical block or filter is needed but no connected
+// peer keeps it, e.g. when every peer is pruned (NODE_NETWORK_LIMITED)
+type NoBlockPeerError struct {
+	Height int32
+	Peers  int // peers that were considered
+}
+
+func (e *NoBlockPeerError) Error() string {
+	return fmt.Sprintf("none of %d peers serves block %d (need NODE_NETWORK)", e.Peers, e.Height)
+}
+
+// canServeBlock reports whether a peer with services and chain tip can serve the block at
+// height: full nodes serve every block, limited nodes only the last 288
+func canServeBlock(services uint64, tip, height int32) bool {
+	if HasServices(services, NODE_NETWORK) {
+		return true
+	}
+	return HasServices(services, NODE_NETWORK_LIMITED) && height > tip-NODE_NETWORK_LIMITED_MIN_BLOCKS
+}
+
+// SeedHostForServices returns the DNS seed hostname that only returns peers advertising
+// the required services. Seeds following the Bitcoin Core convention accept an
+// "x<hex services>." prefix (e.g. x49.seed.bitcoin.sipa.be for NETWORK|WITNESS|COMPACT_FILTERS).
+func SeedHostForServices(seed string, required uint64) string {
+	if required == 0 {
+		return seed
+	}
+	return fmt.Sprintf("x%x.%s", required, seed)
+}
+
+// PeerManager resolves candidate peers from DNS seeds and keeps connections to peers
+// that advertise the services the caller needs
+type PeerManager struct {
+	TestNet bool
+	Logging bool
+	Port    int
+	Seeds   []string
+	Options []NodeOption // applied to every connection
+
+	mu         sync.Mutex
+	candidates []string
+	tried      map[string]bool
+	peers      []*SimpleNode
+
+	lookup func(host string) ([]net.IP, error)
+}
+
+func NewPeerManager(testNet, logging bool) *PeerManager {
+	pm := &PeerManager{
+		TestNet: testNet,
+		Logging: logging,
+		Port:    ChainFor(testNet).Port(),
+		Seeds:   ChainFor(testNet).Seeds(),
+		tried:   make(map[string]bool),
+		lookup:  net.LookupIP,
+	}
+	return pm
+}
+
+// AddCandidates queues known peer addresses ahead of anything resolved from DNS
+func (pm *PeerManager) AddCandidates(addrs ...string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.candidates = append(append([]string{}, addrs...), pm.candidates...)
+}
+
+// ResolveSeeds looks up IPv4 candidates from every seed concurrently, asking for peers with
+// the required services first and falling back to the unfiltered seed if the filtered name
+// doesn't resolve
+func (pm *PeerManager) ResolveSeeds(required uint64) ([]string, error) {
+	return resolveSeeds(pm.lookup, pm.Seeds, required, pm.Logging)
+}
+
+// nextCandidate pops the next untried address, resolving seeds when the queue runs dry
+func (pm *PeerManager) nextCandidate(required uint64, resolved *bool) (string, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for {
+		for len(pm.candidates) > 0 {
+			addr := pm.candidates[0]
+			pm.candidates = pm.candidates[1:]
+			if !pm.tried[addr] {
+				pm.tried[addr] = true
+				return addr, nil
+			}
+		}
+		if *resolved {
+			return "", errors.New("no peers with required services available")
+		}
+		*resolved = true
+		pm.mu.Unlock()
+		addrs, err := pm.ResolveSeeds(required)
+		pm.mu.Lock()
+		if err != nil {
+			return "", err
+		}
+		pm.candidates = append(pm.candidates, addrs...)
+	}
+}
+
+// Connect dials candidates until one completes the handshake advertising all required
+// services. Peers that connect but lack the services are dropped and the next is dialed.
+func (pm *PeerManager) Connect(required uint64) (*SimpleNode, error) {
+	resolved := false
+	for {
+		addr, err := pm.nextCandidate(required, &resolved)
+		if err != nil {
+			return nil, err
+		}
+		if pm.Logging {
+			fmt.Printf("Trying %s:%d...\n", addr, pm.Port)
+		}
+		node, err := NewSimpleNode(addr, pm.Port, pm.TestNet, pm.Logging, pm.Options...)
+		if err != nil {
+			if pm.Logging {
+				fmt.Printf("  Failed: %v\n", err)
+			}
+			continue
+		}
+		if err := node.Handshake(); err != nil {
+			if pm.Logging {
+				fmt.Printf("  %v\n", err)
+			}
+			node.Close()
+			continue
+		}
+		if !HasServices(node.PeerServices, required) {
+			if pm.Logging {
+				fmt.Printf("  Peer lacks services %b (has %b), re-dialing\n", required, node.PeerServices)
+			}
+			node.Close()
+			continue
+		}
+
+		pm.mu.Lock()
+		pm.peers = append(pm.peers, node)
+		pm.mu.Unlock()
+		return node, nil
+	}
+}
+
+// ConnectN connects to n distinct peers that all advertise the required services
+func (pm *PeerManager) ConnectN(n int, required uint64) ([]*SimpleNode, error) {
+	nodes := make([]*SimpleNode, 0, n)
+	for len(nodes) < n {
+		node, err := pm.Connect(required)
+		if err != nil {
+			return nodes, fmt.Errorf("connected %d of %d peers: %w", len(nodes), n, err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// PeerForBlock returns the first connected peer that can serve the block (or filter) at
+// height, so historical requests aren't sent to pruned peers only to time out
+func (pm *PeerManager) PeerForBlock(height int32) (*SimpleNode, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, p := range pm.peers {
+		if p.CanServeBlock(height) {
+			return p, nil
+		}
+	}
+	return nil, &NoBlockPeerError{Height: height, Peers: len(pm.peers)}
+}
+
+// Peers returns the currently connected peers
+func (pm *PeerManager) Peers() []*SimpleNode {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return append([]*SimpleNode{}, pm.peers...)
+}
+
+// Remove stops tracking a peer without disconnecting it
+func (pm *PeerManager) Remove(node *SimpleNode) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.peers = slices.DeleteFunc(pm.peers, func(n *SimpleNode) bool { return n == node })
+}
+
+// Close disconnects every managed peer
+func (pm *PeerManager) Close() error {
+	pm.mu.Lock()
+	peers := pm.peers
+	pm.peers = nil
+	pm.mu.Unlock()
+
+	var errs []error
+	for _, p := range peers {
+		errs = append(errs, p.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,151 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestSeedHostForServices(t *testing.T) {
+	tests := []struct {
+		services uint64
+		want     string
+	}{
+		{0, "seed.bitcoin.sipa.be"},
+		{NODE_NETWORK | NODE_WITNESS, "x9.seed.bitcoin.sipa.be"},
+		{NODE_NETWORK | NODE_WITNESS | NODE_COMPACT_FILTERS, "x49.seed.bitcoin.sipa.be"},
+	}
+	for _, tt := range tests {
+		if got := SeedHostForServices(MAINNET_SEEDS, tt.services); got != tt.want {
+			t.Errorf("SeedHostForServices(%b) = %s, want %s", tt.services, got, tt.want)
+		}
+	}
+}
+
+func TestResolveSeedsServiceFilter(t *testing.T) {
+	pm := NewPeerManager(false, false)
+	pm.Seeds = []string{"filtering.seed", "plain.seed"}
+	pm.lookup = func(host string) ([]net.IP, error) {
+		switch host {
+		case "x48.filtering.seed":
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("::1")}, nil
+		case "plain.seed":
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	addrs, err := pm.ResolveSeeds(NODE_WITNESS | NODE_COMPACT_FILTERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IPv6 results are skipped, unfiltered seed is used as a fallback
+	if !slices.Equal(addrs, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("unexpected candidates: %v", addrs)
+	}
+
+	if !HasServices(NODE_NETWORK|NODE_WITNESS|NODE_COMPACT_FILTERS, NODE_WITNESS|NODE_COMPACT_FILTERS) {
+		t.Error("expected peer with all bits to satisfy requirement")
+	}
+	if HasServices(NODE_NETWORK|NODE_WITNESS, NODE_WITNESS|NODE_COMPACT_FILTERS) {
+		t.Error("expected peer missing NODE_COMPACT_FILTERS to be rejected")
+	}
+}
+
+func TestDiscoverPeers(t *testing.T) {
+	seeds := []string{"a.seed", "b.seed", "dead.seed"}
+	var mu sync.Mutex
+	queried := make(map[string]bool)
+	lookup := func(host string) ([]net.IP, error) {
+		mu.Lock()
+		queried[host] = true
+		mu.Unlock()
+		switch host {
+		case "a.seed":
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, nil
+		case "b.seed":
+			return []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	addrs, err := discoverPeers(lookup, seeds, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seed := range seeds {
+		if !queried[seed] {
+			t.Errorf("seed %s was not queried", seed)
+		}
+	}
+	slices.Sort(addrs)
+	if !slices.Equal(addrs, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}) {
+		t.Fatalf("expected deduplicated results, got %v", addrs)
+	}
+
+	if addrs, _ := discoverPeers(lookup, seeds, nil, 2, 0); len(addrs) != 2 {
+		t.Fatalf("expected want to cap results at 2, got %v", addrs)
+	}
+	if _, err := discoverPeers(lookup, []string{"dead.seed"}, nil, 0, 0); err == nil {
+		t.Fatal("expected error when no seed resolves")
+	}
+
+	// DNS down: fall back to the fixed seeds
+	fixed := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	addrs, err = discoverPeers(lookup, []string{"dead.seed"}, fixed, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || !slices.Contains(fixed, addrs[0]) || !slices.Contains(fixed, addrs[1]) {
+		t.Fatalf("expected 2 fixed seeds, got %v", addrs)
+	}
+	for _, ip := range CHAIN_MAINNET.FixedSeeds() {
+		if net.ParseIP(ip).To4() == nil {
+			t.Errorf("fixed seed %s is not IPv4", ip)
+		}
+	}
+	if len(CHAIN_TESTNET.Seeds()) < 2 || CHAIN_TESTNET.Port() != TESTNET_PORT {
+		t.Error("unexpected testnet chain parameters")
+	}
+	t.Logf("✓ All seeds queried, results deduplicated, fixed seeds as fallback")
+}
+
+func TestNetworkLimitedPeers(t *testing.T) {
+	tests := []struct {
+		name     string
+		services uint64
+		height   int32
+		want     bool
+	}{
+		{"full node, genesis", NODE_NETWORK, 0, true},
+		{"limited, at tip", NODE_NETWORK_LIMITED, 900000, true},
+		{"limited, 287 deep", NODE_NETWORK_LIMITED, 900000 - 287, true},
+		{"limited, 288 deep", NODE_NETWORK_LIMITED, 900000 - 288, false},
+		{"no block services", NODE_WITNESS, 900000, false},
+	}
+	for _, tt := range tests {
+		if got := canServeBlock(tt.services, 900000, tt.height); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	pm := NewPeerManager(false, false)
+	limited := &SimpleNode{PeerServices: NODE_NETWORK_LIMITED | NODE_WITNESS, PeerStartHeight: 900000}
+	pm.peers = []*SimpleNode{limited}
+	if got, err := pm.PeerForBlock(899990); err != nil || got != limited {
+		t.Fatalf("expected limited peer for a recent block, got %v", err)
+	}
+	var noPeer *NoBlockPeerError
+	if _, err := pm.PeerForBlock(100); !errors.As(err, &noPeer) || noPeer.Height != 100 {
+		t.Fatalf("expected NoBlockPeerError, got %v", err)
+	}
+
+	full := &SimpleNode{PeerServices: NODE_NETWORK | NODE_WITNESS, PeerStartHeight: 900000}
+	pm.peers = append(pm.peers, full)
+	if got, err := pm.PeerForBlock(100); err != nil || got != full {
+		t.Fatalf("expected full node for a historical block, got %v", err)
+	}
+	t.Logf("✓ Historical blocks routed to NODE_NETWORK peers only")
+}
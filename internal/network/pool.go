@@ -0,0 +1,299 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Connection pool defaults
+const (
+	DEFAULT_POOL_SIZE    int           = 8
+	POOL_PING_TIMEOUT    time.Duration = 10 * time.Second
+	POOL_HEALTH_INTERVAL time.Duration = 30 * time.Second
+	POOL_MAX_TIP_LAG     int32         = 6 // blocks a peer may trail the best known tip
+)
+
+var ErrPoolClosed = errors.New("peer pool closed")
+
+// PeerPool keeps Target healthy connections from a PeerManager and lends them out one
+// borrower at a time. Idle peers that miss a ping or fall more than MaxTipLag blocks behind
+// the best known tip are evicted and replaced.
+type PeerPool struct {
+	Manager     *PeerManager
+	Target      int
+	Required    uint64
+	PingTimeout time.Duration
+	MaxTipLag   int32
+
+	mu      sync.Mutex
+	idle    []*SimpleNode
+	busy    map[*SimpleNode]bool
+	heights map[*SimpleNode]int32 // best height each peer is known to have
+	bestTip int32
+	closed  bool
+	changed chan struct{} // closed and replaced whenever a peer is returned or evicted
+}
+
+func NewPeerPool(manager *PeerManager, target int, required uint64) *PeerPool {
+	return &PeerPool{
+		Manager:     manager,
+		Target:      target,
+		Required:    required,
+		PingTimeout: POOL_PING_TIMEOUT,
+		MaxTipLag:   POOL_MAX_TIP_LAG,
+		busy:        make(map[*SimpleNode]bool),
+		heights:     make(map[*SimpleNode]int32),
+		changed:     make(chan struct{}),
+	}
+}
+
+// broadcast wakes every Acquire waiting for a peer. Caller holds mu.
+func (p *PeerPool) broadcast() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Size returns the number of pooled connections, idle and borrowed
+func (p *PeerPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle) + len(p.busy)
+}
+
+// Add puts an already-connected peer into the pool as idle
+func (p *PeerPool) Add(node *SimpleNode) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+	p.idle = append(p.idle, node)
+	p.heights[node] = node.PeerStartHeight
+	p.bestTip = max(p.bestTip, node.PeerStartHeight)
+	p.broadcast()
+	return nil
+}
+
+// Fill connects peers from the manager until the pool reaches Target
+func (p *PeerPool) Fill() error {
+	for p.Size() < p.Target {
+		node, err := p.Manager.Connect(p.Required)
+		if err != nil {
+			return fmt.Errorf("pool has %d of %d peers: %w", p.Size(), p.Target, err)
+		}
+		if err := p.Add(node); err != nil {
+			p.Manager.Remove(node)
+			node.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Acquire borrows an idle peer, waiting until one is released or ctx is done.
+// The peer must be handed back with Release (or Evict if it misbehaved).
+func (p *PeerPool) Acquire(ctx context.Context) (*SimpleNode, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if len(p.idle) > 0 {
+			node := p.idle[0]
+			p.idle = p.idle[1:]
+			p.busy[node] = true
+			p.mu.Unlock()
+			return node, nil
+		}
+		wait := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// AcquireBlock borrows an idle peer that can serve the block at height, waiting for one to
+// be released. It fails with *NoBlockPeerError right away if no pooled peer, idle or
+// borrowed, keeps that block.
+func (p *PeerPool) AcquireBlock(ctx context.Context, height int32) (*SimpleNode, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if i := slices.IndexFunc(p.idle, func(n *SimpleNode) bool { return p.canServe(n, height) }); i >= 0 {
+			node := p.idle[i]
+			p.idle = slices.Delete(p.idle, i, i+1)
+			p.busy[node] = true
+			p.mu.Unlock()
+			return node, nil
+		}
+		capable := false
+		for node := range p.busy {
+			capable = capable || p.canServe(node, height)
+		}
+		if !capable {
+			err := &NoBlockPeerError{Height: height, Peers: len(p.idle) + len(p.busy)}
+			p.mu.Unlock()
+			return nil, err
+		}
+		wait := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// canServe uses the best height the pool has seen from the peer. Caller holds mu.
+func (p *PeerPool) canServe(node *SimpleNode, height int32) bool {
+	return canServeBlock(node.PeerServices, p.heights[node], height)
+}
+
+// Release returns a borrowed peer to the idle set
+func (p *PeerPool) Release(node *SimpleNode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.busy[node] {
+		return
+	}
+	delete(p.busy, node)
+	if p.closed {
+		return
+	}
+	p.idle = append(p.idle, node)
+	p.broadcast()
+}
+
+// Evict drops a peer from the pool and disconnects it
+func (p *PeerPool) Evict(node *SimpleNode) {
+	p.mu.Lock()
+	delete(p.busy, node)
+	delete(p.heights, node)
+	p.idle = slices.DeleteFunc(p.idle, func(n *SimpleNode) bool { return n == node })
+	p.broadcast()
+	p.mu.Unlock()
+
+	p.Manager.Remove(node)
+	node.Close()
+}
+
+// MarkTip records that a peer has shown us a chain at height (e.g. after it served
+// headers), raising the best known tip if needed
+func (p *PeerPool) MarkTip(node *SimpleNode, height int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.heights[node]; ok {
+		p.heights[node] = max(p.heights[node], height)
+	}
+	p.bestTip = max(p.bestTip, height)
+}
+
+// BestTip returns the highest chain height any pooled peer has reported
+func (p *PeerPool) BestTip() int32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bestTip
+}
+
+// CheckHealth pings every idle peer and evicts those that don't answer in PingTimeout
+// or trail the best known tip by more than MaxTipLag. It returns the number evicted.
+// Borrowed peers are left alone until they are released.
+func (p *PeerPool) CheckHealth() int {
+	p.mu.Lock()
+	checking := p.idle
+	p.idle = nil
+	for _, node := range checking {
+		p.busy[node] = true
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	healthy := make([]bool, len(checking))
+	for i, node := range checking {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			healthy[i] = p.ping(node) == nil
+		}()
+	}
+	wg.Wait()
+
+	evicted := 0
+	for i, node := range checking {
+		p.mu.Lock()
+		behind := p.heights[node]+p.MaxTipLag < p.bestTip
+		p.mu.Unlock()
+
+		if !healthy[i] || behind {
+			if p.Manager.Logging {
+				fmt.Printf("Evicting peer %s (responsive=%v, behind=%v)\n", node.conn.RemoteAddr(), healthy[i], behind)
+			}
+			p.Evict(node)
+			evicted++
+			continue
+		}
+		p.Release(node)
+	}
+	return evicted
+}
+
+// ping sends a ping and waits for the matching pong
+func (p *PeerPool) ping(node *SimpleNode) error {
+	nonce := binary.LittleEndian.AppendUint64(nil, rand.Uint64())
+	_, err := node.SendAndWait(&PingMessage{Nonce: nonce}, "pong", p.PingTimeout)
+	return err
+}
+
+// Maintain checks health and refills the pool every interval until ctx is done
+func (p *PeerPool) Maintain(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.CheckHealth()
+		if err := p.Fill(); err != nil && p.Manager.Logging {
+			fmt.Printf("Pool refill: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close disconnects every pooled peer, including borrowed ones, and fails pending Acquires
+func (p *PeerPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	nodes := p.idle
+	for node := range p.busy {
+		nodes = append(nodes, node)
+	}
+	p.idle = nil
+	p.busy = make(map[*SimpleNode]bool)
+	p.broadcast()
+	p.mu.Unlock()
+
+	var errs []error
+	for _, node := range nodes {
+		p.Manager.Remove(node)
+		errs = append(errs, node.Close())
+	}
+	return errors.Join(errs...)
+}
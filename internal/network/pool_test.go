@@ -0,0 +1,143 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// answerPings replies to every ping from the remote end until the pipe closes
+func answerPings(t *testing.T, remote net.Conn) {
+	for {
+		env, err := ParseNetworkEnvelope(remote)
+		if err != nil {
+			return
+		}
+		if env.Command == "ping" {
+			deliver(t, remote, "pong", env.Payload)
+		}
+	}
+}
+
+// ignoreAll drains the remote end without replying, like a stalled peer
+func ignoreAll(remote net.Conn) {
+	for {
+		if _, err := ParseNetworkEnvelope(remote); err != nil {
+			return
+		}
+	}
+}
+
+func TestPeerPoolAcquireRelease(t *testing.T) {
+	pool := NewPeerPool(NewPeerManager(false, false), 2, NODE_NETWORK)
+	defer pool.Close()
+	a, _ := newPipeNode(t)
+	b, _ := newPipeNode(t)
+	pool.Add(a)
+	pool.Add(b)
+
+	ctx := context.Background()
+	first, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.Acquire(ctx)
+	if err != nil || second == first {
+		t.Fatalf("expected a distinct second peer, got %v", err)
+	}
+
+	// both borrowed: Acquire waits until one is released
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Acquire(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Acquire to block, got %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.Release(first)
+	}()
+	got, err := pool.Acquire(ctx)
+	if err != nil || got != first {
+		t.Fatalf("expected released peer back, got %v", err)
+	}
+
+	pool.Close()
+	if _, err := pool.Acquire(ctx); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+	t.Logf("✓ Peers lent to one borrower at a time")
+}
+
+func TestPeerPoolHealth(t *testing.T) {
+	pool := NewPeerPool(NewPeerManager(false, false), 3, NODE_NETWORK)
+	defer pool.Close()
+	pool.PingTimeout = 50 * time.Millisecond
+
+	healthy, healthyRemote := newPipeNode(t)
+	stalled, stalledRemote := newPipeNode(t)
+	lagging, laggingRemote := newPipeNode(t)
+	go answerPings(t, healthyRemote)
+	go ignoreAll(stalledRemote)
+	go answerPings(t, laggingRemote)
+
+	healthy.PeerStartHeight = 900000
+	stalled.PeerStartHeight = 900000
+	lagging.PeerStartHeight = 899000
+	for _, n := range []*SimpleNode{healthy, stalled, lagging} {
+		pool.Add(n)
+	}
+
+	if evicted := pool.CheckHealth(); evicted != 2 {
+		t.Fatalf("expected 2 evictions, got %d", evicted)
+	}
+	if pool.Size() != 1 {
+		t.Fatalf("expected 1 peer left, got %d", pool.Size())
+	}
+	got, err := pool.Acquire(context.Background())
+	if err != nil || got != healthy {
+		t.Fatalf("expected the healthy peer to remain, got %v", err)
+	}
+
+	// a peer that later shows a higher tip raises the bar for the rest
+	pool.MarkTip(got, 900010)
+	if pool.BestTip() != 900010 {
+		t.Fatalf("expected best tip 900010, got %d", pool.BestTip())
+	}
+	t.Logf("✓ Stalled and lagging peers evicted")
+}
+
+func TestPeerPoolAcquireBlock(t *testing.T) {
+	pool := NewPeerPool(NewPeerManager(false, false), 2, 0)
+	defer pool.Close()
+	limited, _ := newPipeNode(t)
+	limited.PeerServices = NODE_NETWORK_LIMITED
+	limited.PeerStartHeight = 900000
+	pool.Add(limited)
+
+	ctx := context.Background()
+	var noPeer *NoBlockPeerError
+	if _, err := pool.AcquireBlock(ctx, 1000); !errors.As(err, &noPeer) {
+		t.Fatalf("expected NoBlockPeerError without waiting, got %v", err)
+	}
+
+	full, _ := newPipeNode(t)
+	full.PeerServices = NODE_NETWORK
+	pool.Add(full)
+	got, err := pool.AcquireBlock(ctx, 1000)
+	if err != nil || got != full {
+		t.Fatalf("expected the full node, got %v", err)
+	}
+	if got, err := pool.AcquireBlock(ctx, 899999); err != nil || got != limited {
+		t.Fatalf("expected the limited peer for a recent block, got %v", err)
+	}
+
+	// the only capable peer is borrowed: wait for it instead of failing
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.AcquireBlock(short, 1000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected AcquireBlock to wait, got %v", err)
+	}
+	t.Logf("✓ Pool routes historical blocks to full nodes")
+}
@@ -0,0 +1,121 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// MessageParser decodes a message payload into its typed struct
+type MessageParser func(io.Reader) (Message, error)
+
+// parserFor adapts a ParseXMessage function returning a value into a MessageParser
+// returning the pointer (which is what implements Message)
+func parserFor[T any, PT interface {
+	*T
+	Message
+}](parse func(io.Reader) (T, error)) MessageParser {
+	return func(r io.Reader) (Message, error) {
+		msg, err := parse(r)
+		if err != nil {
+			return nil, err
+		}
+		return PT(&msg), nil
+	}
+}
+
+var (
+	parsersMu sync.RWMutex
+	parsers   = map[string]MessageParser{
+		"version": func(r io.Reader) (Message, error) {
+			return ParseVersionMessage(r)
+		},
+		"verack": func(r io.Reader) (Message, error) {
+			return &VerackMessage{}, nil
+		},
+		"wtxidrelay": func(r io.Reader) (Message, error) {
+			return &WtxidRelayMessage{}, nil
+		},
+		"ping": func(r io.Reader) (Message, error) {
+			nonce, err := io.ReadAll(r)
+			return &PingMessage{Nonce: nonce}, err
+		},
+		"pong": func(r io.Reader) (Message, error) {
+			nonce, err := io.ReadAll(r)
+			return &PongMessage{Nonce: nonce}, err
+		},
+		"filterclear": func(r io.Reader) (Message, error) {
+			return &FilterClearMessage{}, nil
+		},
+		"inv":          parserFor(ParseInvMessage),
+		"notfound":     parserFor(ParseNotFoundMessage),
+		"filterload":   parserFor(ParseFilterLoadMessage),
+		"filteradd":    parserFor(ParseFilterAddMessage),
+		"getdata":      parserFor(ParseGetDataMessage),
+		"headers":      parserFor(ParseHeadersMessage),
+		"merkleblock":  parserFor(ParseMerkleBlock),
+		"tx":           parserFor(ParseTxMessage),
+		"cmpctblock":   parserFor(ParseCompactBlockMessage),
+		"getblocktxn":  parserFor(ParseGetBlockTransactionMessage),
+		"blocktxn":     parserFor(ParseBlockTransactionMessage),
+		"sendcmpct":    parserFor(ParseSendCompactMessage),
+		"getcfilters":  parserFor(ParseGetCFilterMessage),
+		"cfilter":      parserFor(ParseCFilterMessage),
+		"getcfheaders": parserFor(ParseGetCfHeadersMessage),
+		"cfheaders":    parserFor(ParseCfHeadersMessage),
+		"getcfcheckpt": parserFor(ParseGetCfCheckPointMessage),
+		"cfcheckpt":    parserFor(ParseCfCheckPointMessage),
+	}
+)
+
+// RegisterParser adds or replaces the parser used for a command
+func RegisterParser(command string, parser MessageParser) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+	parsers[command] = parser
+}
+
+// ParseMessage decodes an envelope's payload with the parser registered for its command
+func ParseMessage(env NetworkEnvelope) (Message, error) {
+	parsersMu.RLock()
+	parse, ok := parsers[env.Command]
+	parsersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no parser registered for %s", env.Command)
+	}
+	msg, err := parse(bytes.NewReader(env.Payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", env.Command, err)
+	}
+	return msg, nil
+}
+
+// ReceiveTyped waits for the next message with the given command and returns it decoded.
+// Commands without a dedicated channel are received through a temporary subscription.
+// Callers type-assert the result, e.g. msg.(*HeadersMessage).
+func (sn *SimpleNode) ReceiveTyped(command string, timeout time.Duration) (Message, error) {
+	if _, ok := sn.channel(command); ok {
+		env, err := sn.ReceiveWithTimeout(command, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return ParseMessage(env)
+	}
+
+	sub, cancel := sn.Subscribe(command, 1)
+	defer cancel()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case env, ok := <-sub:
+		if !ok {
+			return nil, errors.New("connection closed")
+		}
+		return ParseMessage(env)
+	case <-timer.C:
+		return nil, fmt.Errorf("timeout waiting for %s", command)
+	}
+}
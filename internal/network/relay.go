@@ -0,0 +1,188 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/transactions"
+	"slices"
+	"sync"
+)
+
+// MAX_ANNOUNCED_QUEUE bounds the tx announcements held until the application drains them
+const MAX_ANNOUNCED_QUEUE int = 5000
+
+// filterState tracks the BIP 37 filters in effect on each side of one connection
+type filterState struct {
+	mu         sync.Mutex
+	local      *BloomFilter // filter we loaded on the peer
+	remote     *BloomFilter // filter the peer loaded on us
+	remoteFlag byte
+	announced  [][32]byte // txids (or wtxids) announced to us, internal byte order
+}
+
+// LoadFilter sends a filterload to the peer. Until a filter is loaded, a node that
+// advertised Relay=false ignores transaction announcements.
+func (sn *SimpleNode) LoadFilter(filter *BloomFilter, flag byte) error {
+	if err := sn.Send(&FilterLoadMessage{Filter: filter, Flag: flag}); err != nil {
+		return err
+	}
+	sn.filters.mu.Lock()
+	defer sn.filters.mu.Unlock()
+	sn.filters.local = filter
+	return nil
+}
+
+// AddToFilter sends a filteradd so the peer starts matching data (a pubkey hash, script
+// or outpoint) without resending the whole filter. Our copy of the filter is updated too.
+func (sn *SimpleNode) AddToFilter(data []byte) error {
+	sn.filters.mu.Lock()
+	loaded := sn.filters.local != nil
+	sn.filters.mu.Unlock()
+	if !loaded {
+		return errors.New("no filter loaded on peer")
+	}
+	if err := sn.Send(&FilterAddMessage{Data: data}); err != nil {
+		return err
+	}
+	sn.filters.mu.Lock()
+	defer sn.filters.mu.Unlock()
+	if sn.filters.local != nil {
+		sn.filters.local.Add(data)
+	}
+	return nil
+}
+
+// ClearFilter sends a filterclear, removing the filter we loaded on the peer
+func (sn *SimpleNode) ClearFilter() error {
+	if err := sn.Send(&FilterClearMessage{}); err != nil {
+		return err
+	}
+	sn.filters.mu.Lock()
+	defer sn.filters.mu.Unlock()
+	sn.filters.local = nil
+	return nil
+}
+
+// FilterLoaded reports whether we have loaded a filter on the peer
+func (sn *SimpleNode) FilterLoaded() bool {
+	sn.filters.mu.Lock()
+	defer sn.filters.mu.Unlock()
+	return sn.filters.local != nil
+}
+
+// PeerFilter returns the filter the peer loaded on us, if any
+func (sn *SimpleNode) PeerFilter() (*BloomFilter, byte, bool) {
+	sn.filters.mu.Lock()
+	defer sn.filters.mu.Unlock()
+	return sn.filters.remote, sn.filters.remoteFlag, sn.filters.remote != nil
+}
+
+// AnnouncedTxs drains the queue of transaction ids the peer announced to us
+// (wtxids for MSG_WTX announcements)
+func (sn *SimpleNode) AnnouncedTxs() [][32]byte {
+	sn.filters.mu.Lock()
+	defer sn.filters.mu.Unlock()
+	txids := sn.filters.announced
+	sn.filters.announced = nil
+	return txids
+}
+
+// trackFilterState updates per-connection filter state from incoming messages.
+// It runs on the message loop so it sees messages in order, ahead of any handler.
+func (sn *SimpleNode) trackFilterState(env NetworkEnvelope) {
+	switch env.Command {
+	case "filterload":
+		msg, err := ParseFilterLoadMessage(bytes.NewReader(env.Payload))
+		if err != nil {
+			if sn.Logging {
+				fmt.Printf("Ignoring invalid filterload: %v\n", err)
+			}
+			return
+		}
+		sn.filters.mu.Lock()
+		sn.filters.remote = msg.Filter
+		sn.filters.remoteFlag = msg.Flag
+		sn.filters.mu.Unlock()
+
+	case "filteradd":
+		msg, err := ParseFilterAddMessage(bytes.NewReader(env.Payload))
+		if err != nil {
+			if sn.Logging {
+				fmt.Printf("Ignoring invalid filteradd: %v\n", err)
+			}
+			return
+		}
+		sn.filters.mu.Lock()
+		defer sn.filters.mu.Unlock()
+		if sn.filters.remote == nil {
+			if sn.Logging {
+				fmt.Printf("Ignoring filteradd with no filter loaded\n")
+			}
+			return
+		}
+		sn.filters.remote.Add(msg.Data)
+
+	case "filterclear":
+		sn.filters.mu.Lock()
+		sn.filters.remote = nil
+		sn.filters.remoteFlag = BLOOM_UPDATE_NONE
+		sn.filters.mu.Unlock()
+
+	case "inv":
+		msg, err := ParseInvMessage(bytes.NewReader(env.Payload))
+		if err != nil {
+			return
+		}
+		sn.filters.mu.Lock()
+		defer sn.filters.mu.Unlock()
+		// with Relay=false we only expect tx announcements once our filter is loaded
+		accept := sn.Relay || sn.filters.local != nil
+		for _, item := range msg.Inventory {
+			if !item.Type.IsTx() {
+				continue
+			}
+			if !accept {
+				if sn.Logging {
+					fmt.Printf("Dropping tx announcement %x: no filter loaded\n", item.Identifier)
+				}
+				continue
+			}
+			if len(sn.filters.announced) >= MAX_ANNOUNCED_QUEUE {
+				sn.filters.announced = sn.filters.announced[1:]
+			}
+			sn.filters.announced = append(sn.filters.announced, item.Identifier)
+		}
+	}
+}
+
+// ShouldRelayTx applies the BIP 37 relay policy for this peer: if it loaded a filter the
+// transaction must match it, otherwise we relay only if the peer asked for relay in its version
+func (sn *SimpleNode) ShouldRelayTx(tx *transactions.Transaction) (bool, error) {
+	sn.filters.mu.Lock()
+	defer sn.filters.mu.Unlock()
+	if sn.filters.remote == nil {
+		return sn.PeerRelay, nil
+	}
+	// matching may insert outpoints, so it runs under the filter lock
+	return sn.filters.remote.MatchTransaction(tx, sn.filters.remoteFlag)
+}
+
+// RelayTransaction announces tx to the peer if the relay policy allows it, otherwise
+// silently drops it. Returns whether the announcement was sent.
+func (sn *SimpleNode) RelayTransaction(tx *transactions.Transaction) (bool, error) {
+	ok, err := sn.ShouldRelayTx(tx)
+	if err != nil || !ok {
+		return false, err
+	}
+	txid, err := tx.Hash()
+	if err != nil {
+		return false, err
+	}
+	slices.Reverse(txid[:])
+	inv := &InvMessage{Inventory: []DataItem{{Type: DATA_TYPE_TX, Identifier: txid}}}
+	if err := sn.Send(inv); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,66 @@
+package network
+
+// sendPriority orders outgoing messages so protocol-critical ones aren't stuck behind a
+// burst of relays. Lower values are written first.
+type sendPriority int
+
+const (
+	PRIORITY_CONTROL sendPriority = iota // handshake, ping/pong, filters, getheaders...
+	PRIORITY_BLOCK                       // blocks, compact blocks and their reconstruction
+	PRIORITY_TX                          // transaction relay
+	numSendPriorities
+)
+
+// SEND_QUEUE_SIZE is the buffer of each priority class
+const SEND_QUEUE_SIZE int = 10
+
+// priorityOf classifies an outgoing message
+func priorityOf(msg Message) sendPriority {
+	switch msg.Command() {
+	case "block", "cmpctblock", "getblocktxn", "blocktxn", "merkleblock", "headers":
+		return PRIORITY_BLOCK
+	case "tx":
+		return PRIORITY_TX
+	case "inv":
+		// tx announcements are relay traffic, block announcements are not
+		if inv, ok := msg.(*InvMessage); ok {
+			for _, item := range inv.Inventory {
+				if item.Type.IsBlock() {
+					return PRIORITY_BLOCK
+				}
+			}
+			return PRIORITY_TX
+		}
+	}
+	return PRIORITY_CONTROL
+}
+
+func newSendQueues() [numSendPriorities]chan Message {
+	var queues [numSendPriorities]chan Message
+	for i := range queues {
+		queues[i] = make(chan Message, SEND_QUEUE_SIZE)
+	}
+	return queues
+}
+
+// nextOutgoing returns the highest priority queued message, blocking until one is queued.
+// It returns false once the node is closed.
+func (sn *SimpleNode) nextOutgoing() (Message, bool) {
+	for _, q := range sn.outgoing {
+		select {
+		case msg := <-q:
+			return msg, true
+		default:
+		}
+	}
+	select {
+	case msg := <-sn.outgoing[PRIORITY_CONTROL]:
+		return msg, true
+	case msg := <-sn.outgoing[PRIORITY_BLOCK]:
+		return msg, true
+	case msg := <-sn.outgoing[PRIORITY_TX]:
+		return msg, true
+	case <-sn.done:
+		return nil, false
+	}
+}
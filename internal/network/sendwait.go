@@ -0,0 +1,80 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// correlates reports whether resp answers req. Requests without an identifier in
+// their response (getheaders, getdata, ...) accept any response of the right command.
+func correlates(req, resp Message) bool {
+	switch rq := req.(type) {
+	case *PingMessage:
+		if rs, ok := resp.(*PongMessage); ok {
+			return bytes.Equal(rq.Nonce, rs.Nonce)
+		}
+	case *GetBlockTransactionMessage:
+		if rs, ok := resp.(*BlockTransactionMessage); ok {
+			return rq.BlockHash == rs.BlockHash
+		}
+	case *GetCFilterMessage:
+		if rs, ok := resp.(*CFilterMessage); ok {
+			return rq.FType == rs.FType && rq.StopHash == rs.BlockHash
+		}
+	case *GetCfHeadersMessage:
+		if rs, ok := resp.(*CfHeadersMessage); ok {
+			return rq.FType == rs.FType && rq.StopHash == rs.StopHash
+		}
+	case *GetCfCheckPointMessage:
+		if rs, ok := resp.(*CfCheckPointMessage); ok {
+			return rq.FType == rs.FType && rq.StopHash == rs.StopHash
+		}
+	}
+	return true
+}
+
+// SendAndWait sends msg and returns the first respCommand message that corresponds to it,
+// discarding unrelated responses (e.g. a pong for an earlier ping) until the timeout.
+// For getcfilters the response matched is the cfilter for the stop hash.
+func (sn *SimpleNode) SendAndWait(msg Message, respCommand string, timeout time.Duration) (Message, error) {
+	// listen before sending so a fast response can't slip past us
+	var ch <-chan NetworkEnvelope
+	if dedicated, ok := sn.channel(respCommand); ok {
+		ch = dedicated
+	} else {
+		sub, cancel := sn.Subscribe(respCommand, 10)
+		defer cancel()
+		ch = sub
+	}
+
+	if err := sn.Send(msg); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case env, ok := <-ch:
+			if !ok {
+				return nil, errors.New("connection closed")
+			}
+			resp, err := ParseMessage(env)
+			if err != nil {
+				return nil, err
+			}
+			if correlates(msg, resp) {
+				return resp, nil
+			}
+			if sn.Logging {
+				fmt.Printf("Discarding uncorrelated %s response to %s\n", respCommand, msg.Command())
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("timeout waiting for %s response to %s", respCommand, msg.Command())
+		case <-sn.done:
+			return nil, errors.New("connection closed")
+		}
+	}
+}
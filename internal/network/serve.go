@@ -0,0 +1,173 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/block"
+	"go-bitcoin/internal/transactions"
+	"slices"
+	"time"
+)
+
+// Compact block serving limits (BIP 152). Older blocks, or any block while our tip is
+// stale, are answered with the full block since the peer is unlikely to have the txs.
+const (
+	MAX_CMPCTBLOCK_DEPTH   int           = 5
+	MAX_CMPCTBLOCK_TIP_AGE time.Duration = 2 * time.Hour
+)
+
+// BlockSource provides stored blocks for answering getdata
+type BlockSource interface {
+	// RawBlock returns the block with hash (internal byte order) in witness serialization
+	RawBlock(hash [32]byte) (raw []byte, height int, ok bool)
+	// Tip returns the height and header of the best stored block
+	Tip() (int, *block.Block)
+}
+
+// PrunedBlockSource is a BlockSource that may have deleted old blocks. While Pruned
+// reports true the node advertises NODE_NETWORK_LIMITED instead of NODE_NETWORK and only
+// serves the last NODE_NETWORK_LIMITED_MIN_BLOCKS blocks (BIP 159).
+type PrunedBlockSource interface {
+	BlockSource
+	Pruned() bool
+}
+
+// pruned reports whether the node's block source has pruned, or may prune, old blocks
+func (sn *SimpleNode) pruned() bool {
+	source, ok := sn.Blocks.(PrunedBlockSource)
+	return ok && source.Pruned()
+}
+
+// BlockMessage carries a serialized block
+type BlockMessage struct {
+	Payload []byte
+}
+
+func (bm *BlockMessage) Serialize() ([]byte, error) {
+	return bm.Payload, nil
+}
+
+func (bm BlockMessage) Command() string {
+	return "block"
+}
+
+// handleGetData answers a peer's getdata from the data sources configured on the node.
+// Transactions we don't have are reported back in a single notfound message; unknown
+// blocks are ignored, as Bitcoin Core does.
+func (sn *SimpleNode) handleGetData(env NetworkEnvelope) {
+	req, err := ParseGetDataMessage(bytes.NewReader(env.Payload))
+	if err != nil {
+		if sn.Logging {
+			fmt.Printf("Ignoring invalid getdata: %v\n", err)
+		}
+		return
+	}
+
+	var notFound []InvVector
+	for _, item := range req.Data {
+		if item.Type.IsBlock() {
+			if err := sn.serveBlock(item); err != nil && sn.Logging {
+				fmt.Printf("Not serving %s %x: %v\n", item.Type, item.Identifier, err)
+			}
+			continue
+		}
+		if !item.Type.IsTx() {
+			continue
+		}
+		tx, ok := sn.lookupTx(item)
+		if !ok {
+			notFound = append(notFound, item)
+			continue
+		}
+		// MSG_TX asks for the legacy serialization, MSG_WITNESS_TX and MSG_WTX for witness data
+		msg := &TxMessage{Tx: tx, NoWitness: item.Type == DATA_TYPE_TX}
+		if err := sn.Send(msg); err != nil {
+			return
+		}
+	}
+	if len(notFound) > 0 {
+		sn.Send(&NotFoundMessage{Inventory: notFound})
+	}
+}
+
+// lookupTx finds a requested transaction in the mempool by txid or, for MSG_WTX, wtxid
+func (sn *SimpleNode) lookupTx(item InvVector) (*transactions.Transaction, bool) {
+	if sn.Mempool == nil {
+		return nil, false
+	}
+	// inventory hashes are in internal byte order, the mempool is keyed by display order
+	id := item.Identifier
+	slices.Reverse(id[:])
+	if item.Type == DATA_TYPE_WTX {
+		return sn.Mempool.GetByWitnessHash(id)
+	}
+	return sn.Mempool.Get(id)
+}
+
+// serveBlock answers one block request from the block source
+func (sn *SimpleNode) serveBlock(item InvVector) error {
+	if sn.Blocks == nil {
+		return errors.New("no block source")
+	}
+	raw, height, ok := sn.Blocks.RawBlock(item.Identifier)
+	if !ok {
+		return errors.New("block not found")
+	}
+	if sn.pruned() {
+		// a pruned node doesn't reveal how much history it still has
+		if tipHeight, _ := sn.Blocks.Tip(); height <= tipHeight-int(NODE_NETWORK_LIMITED_MIN_BLOCKS) {
+			return fmt.Errorf("block at height %d is below the pruned serving window", height)
+		}
+	}
+
+	switch item.Type {
+	case DATA_TYPE_WITNESS_BLOCK:
+		return sn.Send(&BlockMessage{Payload: raw})
+	case DATA_TYPE_BLOCK:
+		stripped, err := stripBlockWitness(raw)
+		if err != nil {
+			return err
+		}
+		return sn.Send(&BlockMessage{Payload: stripped})
+	case DATA_TYPE_CMPCT_BLOCK:
+		if !sn.servesCompact(height) {
+			return sn.Send(&BlockMessage{Payload: raw})
+		}
+		fb, err := block.ParseFullBlock(bytes.NewReader(raw))
+		if err != nil {
+			return err
+		}
+		cb, err := NewCompactBlockMessage(fb, nil, sn.peerCmpctVersion.Load())
+		if err != nil {
+			return err
+		}
+		return sn.Send(cb)
+	case DATA_TYPE_FILTERED_BLOCK, DATA_TYPE_WITNESS_FILTERED_BLOCK:
+		fb, err := block.ParseFullBlock(bytes.NewReader(raw))
+		if err != nil {
+			return err
+		}
+		return sn.ServeFilteredBlock(fb)
+	}
+	return fmt.Errorf("unsupported block request type %s", item.Type)
+}
+
+// servesCompact applies the BIP 152 rule for MSG_CMPCT_BLOCK: only blocks near our tip,
+// and only while our tip is recent, are sent compact
+func (sn *SimpleNode) servesCompact(height int) bool {
+	tipHeight, tip := sn.Blocks.Tip()
+	if tip == nil || height < tipHeight-MAX_CMPCTBLOCK_DEPTH {
+		return false
+	}
+	return time.Since(tip.Time()) < MAX_CMPCTBLOCK_TIP_AGE
+}
+
+// stripBlockWitness re-serializes a block with every transaction in legacy form (MSG_BLOCK)
+func stripBlockWitness(raw []byte) ([]byte, error) {
+	fb, err := block.ParseFullBlock(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return fb.SerializeNoWitness()
+}
@@ -39,10 +39,8 @@ func TestSPVFlowBIP37(t *testing.T) {
 
 	// debugging
 	node.OnMessage("inv", func(env NetworkEnvelope) {
-		// First byte is count
-		if len(env.Payload) > 0 {
-			count := env.Payload[0]
-			t.Logf("Inv with %d items: %x", count, env.Payload[:min(50, len(env.Payload))])
+		if inv, err := ParseInvMessage(bytes.NewReader(env.Payload)); err == nil {
+			t.Logf("Inv with %d items (%d txs, %d blocks)", len(inv.Inventory), len(inv.Txs()), len(inv.Blocks()))
 		}
 	})
 
@@ -225,31 +223,20 @@ func TestSPVFlowBIP158(t *testing.T) {
 		t.Errorf("failed to get script raw bytes: %v", err)
 	}
 
-	ip := "77.174.133.117"
-	port := 8333
-	t.Logf("Trying %s:%d...", ip, port)
-	node, err := NewSimpleNode(ip, port, false, false) // testNet: false
+	// try a known BIP157 peer first, then re-dial seed peers until one serves filters
+	pm := NewPeerManager(false, false) // testNet: false
+	pm.AddCandidates("77.174.133.117")
+	defer pm.Close()
+	node, err := pm.Connect(NODE_NETWORK | NODE_COMPACT_FILTERS)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer node.Close()
-	if err := node.Handshake(); err != nil {
-		t.Fatal(err)
-	}
-
-	// Check if peer supports compact filters
-	if node.PeerServices&NODE_COMPACT_FILTERS == 0 {
-		t.Skipf("Peer does not support BIP 157 compact filters. Services: %d (binary: %064b)",
-			node.PeerServices, node.PeerServices)
-	}
-	t.Logf("✓ Peer supports compact filters!")
+	t.Logf("✓ Peer supports compact filters! Services: %d", node.PeerServices)
 
 	// debugging
 	node.OnMessage("inv", func(env NetworkEnvelope) {
-		// First byte is count
-		if len(env.Payload) > 0 {
-			count := env.Payload[0]
-			t.Logf("Inv with %d items: %x", count, env.Payload[:min(50, len(env.Payload))])
+		if inv, err := ParseInvMessage(bytes.NewReader(env.Payload)); err == nil {
+			t.Logf("Inv with %d items (%d txs, %d blocks)", len(inv.Inventory), len(inv.Txs()), len(inv.Blocks()))
 		}
 	})
 
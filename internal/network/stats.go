@@ -0,0 +1,111 @@
+package network
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// ENVELOPE_HEADER_SIZE is the size of the magic/command/length/checksum header on every message
+const ENVELOPE_HEADER_SIZE = 24
+
+// CommandStats counts messages and bytes (including the envelope header) for one command
+type CommandStats struct {
+	Count uint64
+	Bytes uint64
+}
+
+// PeerStats is a point-in-time snapshot of traffic on a connection
+type PeerStats struct {
+	ConnectedAt      time.Time
+	LastSend         time.Time
+	LastReceive      time.Time
+	BytesSent        uint64
+	BytesReceived    uint64
+	MessagesSent     uint64
+	MessagesReceived uint64
+	Sent             map[string]CommandStats
+	Received         map[string]CommandStats
+	Unhandled        map[string]CommandStats // received but consumed by no channel, subscriber or handler
+	PingRTT          time.Duration           // last keepalive round trip, zero until one is answered
+}
+
+// trafficStats accumulates PeerStats under a lock; loops update it, Stats() copies it
+type trafficStats struct {
+	mu    sync.Mutex
+	stats PeerStats
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{
+		stats: PeerStats{
+			ConnectedAt: time.Now(),
+			Sent:        make(map[string]CommandStats),
+			Received:    make(map[string]CommandStats),
+			Unhandled:   make(map[string]CommandStats),
+		},
+	}
+}
+
+func (ts *trafficStats) recordSend(command string, size int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.stats.LastSend = time.Now()
+	ts.stats.BytesSent += uint64(size)
+	ts.stats.MessagesSent++
+	cs := ts.stats.Sent[command]
+	cs.Count++
+	cs.Bytes += uint64(size)
+	ts.stats.Sent[command] = cs
+}
+
+func (ts *trafficStats) recordReceive(command string, size int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.stats.LastReceive = time.Now()
+	ts.stats.BytesReceived += uint64(size)
+	ts.stats.MessagesReceived++
+	cs := ts.stats.Received[command]
+	cs.Count++
+	cs.Bytes += uint64(size)
+	ts.stats.Received[command] = cs
+}
+
+func (ts *trafficStats) recordUnhandled(command string, size int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	cs := ts.stats.Unhandled[command]
+	cs.Count++
+	cs.Bytes += uint64(size)
+	ts.stats.Unhandled[command] = cs
+}
+
+func (ts *trafficStats) snapshot() PeerStats {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	s := ts.stats
+	s.Sent = maps.Clone(ts.stats.Sent)
+	s.Received = maps.Clone(ts.stats.Received)
+	s.Unhandled = maps.Clone(ts.stats.Unhandled)
+	return s
+}
+
+// Stats returns a snapshot of bytes and message counts exchanged with the peer
+func (sn *SimpleNode) Stats() PeerStats {
+	s := sn.stats.snapshot()
+	s.PingRTT = sn.PingRTT()
+	return s
+}
+
+// ReceivedShare returns the fraction of received bytes that were the given commands,
+// e.g. to spot a peer whose traffic is mostly inv/addr spam rather than requested data
+func (ps PeerStats) ReceivedShare(commands ...string) float64 {
+	if ps.BytesReceived == 0 {
+		return 0
+	}
+	var total uint64
+	for _, c := range commands {
+		total += ps.Received[c].Bytes
+	}
+	return float64(total) / float64(ps.BytesReceived)
+}
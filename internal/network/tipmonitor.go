@@ -0,0 +1,250 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Tip monitoring defaults
+const (
+	TIP_CHECK_INTERVAL time.Duration = 10 * time.Minute
+	TIP_MAX_LAG        int           = 3 // blocks the sync peer may trail the best peer
+	TIP_PROBE_TIMEOUT  time.Duration = 30 * time.Second
+)
+
+// TipEventKind classifies what a TipMonitor check found
+type TipEventKind int
+
+const (
+	TIP_SYNC_LAGGING     TipEventKind = iota // sync peer trails the best peer by more than MaxLag, or didn't answer
+	TIP_SYNC_DIVERGED                        // sync peer is on a different branch than most peers
+	TIP_SYNC_SWITCHED                        // the sync peer was replaced by Peer
+	TIP_PEER_FORKED                          // a peer is on a different branch than most peers
+	TIP_POSSIBLE_ECLIPSE                     // no branch has a majority: we can't tell which chain is honest
+)
+
+func (k TipEventKind) String() string {
+	switch k {
+	case TIP_SYNC_LAGGING:
+		return "sync-lagging"
+	case TIP_SYNC_DIVERGED:
+		return "sync-diverged"
+	case TIP_SYNC_SWITCHED:
+		return "sync-switched"
+	case TIP_PEER_FORKED:
+		return "peer-forked"
+	case TIP_POSSIBLE_ECLIPSE:
+		return "possible-eclipse"
+	}
+	return fmt.Sprintf("TipEventKind(%d)", int(k))
+}
+
+// PeerTip is a peer's best header relative to our header chain
+type PeerTip struct {
+	Peer       *SimpleNode
+	Height     int
+	Hash       [32]byte // internal byte order
+	ForkHeight int      // highest height at which the peer's chain matches ours
+	Forked     bool     // the peer sent a header conflicting with our chain
+	branch     [32]byte // first conflicting header, zero while the peer agrees with us
+}
+
+// TipEvent is passed to TipMonitor.OnEvent
+type TipEvent struct {
+	Kind TipEventKind
+	Peer *SimpleNode
+	Tip  PeerTip
+	Best PeerTip // best tip on the branch most peers follow
+}
+
+// TipMonitor periodically asks every connected peer for headers past our chain and
+// compares their tips. If the sync peer lags or sits on a minority branch it is switched
+// to the best peer on the majority branch; forks and splits are reported via OnEvent.
+type TipMonitor struct {
+	Peers   *PeerManager
+	MaxLag  int
+	Timeout time.Duration
+	Logging bool
+	OnEvent func(TipEvent)
+
+	mu   sync.Mutex
+	sync *SimpleNode
+}
+
+func NewTipMonitor(peers *PeerManager, syncPeer *SimpleNode) *TipMonitor {
+	return &TipMonitor{
+		Peers:   peers,
+		MaxLag:  TIP_MAX_LAG,
+		Timeout: TIP_PROBE_TIMEOUT,
+		Logging: peers.Logging,
+		sync:    syncPeer,
+	}
+}
+
+// SyncPeer returns the current sync peer
+func (tm *TipMonitor) SyncPeer() *SimpleNode {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.sync
+}
+
+func (tm *TipMonitor) emit(ev TipEvent) {
+	if tm.Logging {
+		fmt.Printf("Tip monitor: %s (peer height %d, best %d)\n", ev.Kind, ev.Tip.Height, ev.Best.Height)
+	}
+	if tm.OnEvent != nil {
+		tm.OnEvent(ev)
+	}
+}
+
+// ProbeTip asks a peer for headers past our chain (block hashes by height, genesis
+// first) and works out where its best chain ends and whether it forks from ours
+func (tm *TipMonitor) ProbeTip(peer *SimpleNode, chain [][32]byte) (PeerTip, error) {
+	ourHeight := len(chain) - 1
+	req := NewGetHeadersMessage(PROTOCOL_VERSION, BlockLocator(chain), nil)
+	resp, err := peer.SendAndWait(&req, "headers", tm.Timeout)
+	if err != nil {
+		return PeerTip{}, err
+	}
+	headers := resp.(*HeadersMessage).Blocks
+
+	if len(headers) == 0 {
+		// the peer's tip is one of our locator entries; its version height is the best hint
+		height := min(ourHeight, max(int(peer.PeerStartHeight), 0))
+		return PeerTip{Peer: peer, Height: height, Hash: chain[height], ForkHeight: height}, nil
+	}
+
+	height := slices.Index(chain, headers[0].PrevBlock)
+	if height < 0 {
+		return PeerTip{}, fmt.Errorf("%w: headers don't connect to our chain", ErrPeerMisbehaving)
+	}
+	tip := PeerTip{Peer: peer, ForkHeight: height}
+	prev := chain[height]
+	for _, header := range headers {
+		if header.PrevBlock != prev {
+			return PeerTip{}, fmt.Errorf("%w: headers are not continuous", ErrPeerMisbehaving)
+		}
+		h, err := header.Hash()
+		if err != nil {
+			return PeerTip{}, err
+		}
+		height++
+		prev = [32]byte(h)
+		switch {
+		case tip.Forked:
+		case height <= ourHeight && chain[height] == prev:
+			tip.ForkHeight = height
+		case height <= ourHeight:
+			tip.Forked = true
+			tip.branch = prev
+		}
+	}
+	tip.Height, tip.Hash = height, prev
+	return tip, nil
+}
+
+// Check probes every connected peer and the sync peer against chain, reports what it
+// finds through OnEvent and switches the sync peer if needed. It returns the tips of the
+// peers that answered.
+func (tm *TipMonitor) Check(chain [][32]byte) ([]PeerTip, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("empty header chain")
+	}
+	syncPeer := tm.SyncPeer()
+	peers := tm.Peers.Peers()
+	if syncPeer != nil && !slices.Contains(peers, syncPeer) {
+		peers = append(peers, syncPeer)
+	}
+
+	results := make([]PeerTip, len(peers))
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = tm.ProbeTip(peer, chain)
+		}()
+	}
+	wg.Wait()
+
+	var tips []PeerTip
+	for i, tip := range results {
+		if errs[i] != nil {
+			if tm.Logging {
+				fmt.Printf("Tip probe failed: %v\n", errs[i])
+			}
+			continue
+		}
+		tips = append(tips, tip)
+	}
+	if len(tips) == 0 {
+		return nil, fmt.Errorf("no peer answered the tip probe")
+	}
+
+	// the majority branch is the one most peers follow, ties broken by height
+	counts := make(map[[32]byte]int)
+	for _, tip := range tips {
+		counts[tip.branch]++
+	}
+	var best PeerTip
+	for _, tip := range tips {
+		n, bestN := counts[tip.branch], counts[best.branch]
+		if best.Peer == nil || n > bestN || (n == bestN && tip.Height > best.Height) {
+			best = tip
+		}
+	}
+	if len(tips) > 1 && counts[best.branch]*2 <= len(tips) {
+		tm.emit(TipEvent{Kind: TIP_POSSIBLE_ECLIPSE, Best: best})
+	}
+
+	var syncTip *PeerTip
+	for i, tip := range tips {
+		if tip.Peer == syncPeer {
+			syncTip = &tips[i]
+			continue
+		}
+		if tip.branch != best.branch {
+			tm.emit(TipEvent{Kind: TIP_PEER_FORKED, Peer: tip.Peer, Tip: tip, Best: best})
+		}
+	}
+
+	switchSync := syncPeer != nil
+	switch {
+	case syncPeer == nil:
+	case syncTip == nil:
+		tm.emit(TipEvent{Kind: TIP_SYNC_LAGGING, Peer: syncPeer, Tip: PeerTip{Peer: syncPeer, Height: -1}, Best: best})
+	case syncTip.branch != best.branch:
+		tm.emit(TipEvent{Kind: TIP_SYNC_DIVERGED, Peer: syncPeer, Tip: *syncTip, Best: best})
+	case best.Height-syncTip.Height > tm.MaxLag:
+		tm.emit(TipEvent{Kind: TIP_SYNC_LAGGING, Peer: syncPeer, Tip: *syncTip, Best: best})
+	default:
+		switchSync = false
+	}
+	if switchSync && best.Peer != syncPeer {
+		tm.mu.Lock()
+		tm.sync = best.Peer
+		tm.mu.Unlock()
+		tm.emit(TipEvent{Kind: TIP_SYNC_SWITCHED, Peer: best.Peer, Tip: best, Best: best})
+	}
+	return tips, nil
+}
+
+// Monitor runs Check every interval against the chain returned by chain until ctx is done
+func (tm *TipMonitor) Monitor(ctx context.Context, interval time.Duration, chain func() [][32]byte) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := tm.Check(chain()); err != nil && tm.Logging {
+				fmt.Printf("Tip check: %v\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package network
+
+import (
+	"go-bitcoin/internal/transactions"
+	"io"
+)
+
+type TxMessage struct {
+	Tx        *transactions.Transaction
+	NoWitness bool // strip witness data, as required when answering MSG_TX
+}
+
+func (tm *TxMessage) Serialize() ([]byte, error) {
+	if tm.NoWitness {
+		return tm.Tx.SerializeLegacy()
+	}
+	return tm.Tx.Serialize()
+}
+
+func (tm TxMessage) Command() string {
+	return "tx"
+}
+
+func ParseTxMessage(r io.Reader) (TxMessage, error) {
+	tx, err := transactions.ParseTransaction(r)
+	if err != nil {
+		return TxMessage{}, err
+	}
+	return TxMessage{
+		Tx: &tx,
+	}, nil
+}
@@ -3,6 +3,7 @@ package network
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"go-bitcoin/internal/encoding"
 	"io"
 	"math/rand/v2"
@@ -10,6 +11,9 @@ import (
 	"time"
 )
 
+// MAX_SUBVERSION_LENGTH is the longest user agent we accept (BIP 14)
+const MAX_SUBVERSION_LENGTH uint64 = 256
+
 type NetAddr struct {
 	Services uint64
 	Address  [16]byte
@@ -38,7 +42,7 @@ func (na *NetAddr) Serialize() []byte {
 }
 
 type VersionMessage struct {
-	Version      int32 // default 70015
+	Version      int32 // default PROTOCOL_VERSION
 	Services     uint64
 	TimeStamp    int64 // 64 bit UNIX time
 	SenderAddr   NetAddr
@@ -54,8 +58,8 @@ func DefaultVersionMessage(remoteIP net.IP, port uint16) VersionMessage {
 	var addr [16]byte
 	copy(addr[:], ip16)
 	return VersionMessage{
-		Version:   70015,
-		Services:  8, // NODE_WITNESS (1<<3)
+		Version:   PROTOCOL_VERSION,
+		Services:  NODE_WITNESS,
 		TimeStamp: time.Now().Unix(),
 		SenderAddr: NetAddr{
 			Services: 0,
@@ -68,7 +72,7 @@ func DefaultVersionMessage(remoteIP net.IP, port uint16) VersionMessage {
 			Port:     port,
 		},
 		Nonce:       rand.Uint64(),
-		UserAgent:   "/programmingbitcoin:0.1/",
+		UserAgent:   DEFAULT_USER_AGENT,
 		LatestBlock: 0,
 		Relay:       false,
 	}
@@ -141,28 +145,84 @@ func (vm VersionMessage) Command() string {
 	return "version"
 }
 
+func parseNetAddr(r io.Reader) (NetAddr, error) {
+	buf := make([]byte, 26)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return NetAddr{}, err
+	}
+	var na NetAddr
+	na.Services = binary.LittleEndian.Uint64(buf[0:8])
+	copy(na.Address[:], buf[8:24])
+	na.Port = binary.BigEndian.Uint16(buf[24:26])
+	return na, nil
+}
+
 func ParseVersionMessage(r io.Reader) (*VersionMessage, error) {
 	buf4 := make([]byte, 4)
 	buf8 := make([]byte, 8)
+	vm := &VersionMessage{}
 
 	// Read version
 	if _, err := io.ReadFull(r, buf4); err != nil {
 		return nil, err
 	}
-	version := int32(binary.LittleEndian.Uint32(buf4))
+	vm.Version = int32(binary.LittleEndian.Uint32(buf4))
 
 	// Read services
 	if _, err := io.ReadFull(r, buf8); err != nil {
 		return nil, err
 	}
-	services := binary.LittleEndian.Uint64(buf8)
+	vm.Services = binary.LittleEndian.Uint64(buf8)
 
-	// ... parse rest of fields (timestamp, addresses, nonce, user agent, etc.)
-	// For now, just return what we need:
+	// Read timestamp
+	if _, err := io.ReadFull(r, buf8); err != nil {
+		return nil, err
+	}
+	vm.TimeStamp = int64(binary.LittleEndian.Uint64(buf8))
 
-	return &VersionMessage{
-		Version:  version,
-		Services: services,
-		// ... other fields
-	}, nil
+	// Read receiver and sender addresses
+	var err error
+	if vm.ReceiverAddr, err = parseNetAddr(r); err != nil {
+		return nil, err
+	}
+	if vm.SenderAddr, err = parseNetAddr(r); err != nil {
+		return nil, err
+	}
+
+	// Read nonce
+	if _, err := io.ReadFull(r, buf8); err != nil {
+		return nil, err
+	}
+	vm.Nonce = binary.LittleEndian.Uint64(buf8)
+
+	// Read user agent (varint length prepended)
+	uaLen, err := encoding.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if uaLen > MAX_SUBVERSION_LENGTH {
+		return nil, fmt.Errorf("user agent too long: %d bytes", uaLen)
+	}
+	ua := make([]byte, uaLen)
+	if _, err := io.ReadFull(r, ua); err != nil {
+		return nil, err
+	}
+	vm.UserAgent = string(ua)
+
+	// Read start height
+	if _, err := io.ReadFull(r, buf4); err != nil {
+		return nil, err
+	}
+	vm.LatestBlock = int32(binary.LittleEndian.Uint32(buf4))
+
+	// Relay flag is optional (BIP 37); absent means relay
+	vm.Relay = true
+	buf1 := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf1); err == nil {
+		vm.Relay = buf1[0] != 0x00
+	} else if err != io.EOF {
+		return nil, err
+	}
+
+	return vm, nil
 }
@@ -0,0 +1,14 @@
+package network
+
+// WtxidRelayMessage signals support for wtxid-based transaction relay (BIP 339).
+// It must be sent after version and before verack.
+type WtxidRelayMessage struct {
+}
+
+func (wm *WtxidRelayMessage) Serialize() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (wm WtxidRelayMessage) Command() string {
+	return "wtxidrelay"
+}
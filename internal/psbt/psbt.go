@@ -0,0 +1,476 @@
+// Package psbt implements BIP 174 partially signed bitcoin transactions: an unsigned
+// transaction plus per-input and per-output key/value maps that wallets fill in turn
+// (creator, updater, signer, combiner, finalizer, extractor) before the finished
+// transaction is pulled out.
+package psbt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/transactions"
+	"io"
+	"slices"
+)
+
+// PSBT_MAGIC starts every serialized PSBT: "psbt" followed by 0xff
+var PSBT_MAGIC = []byte{0x70, 0x73, 0x62, 0x74, 0xff}
+
+// Global key types
+const (
+	PSBT_GLOBAL_UNSIGNED_TX byte = 0x00
+)
+
+// Input key types
+const (
+	PSBT_IN_NON_WITNESS_UTXO    byte = 0x00
+	PSBT_IN_WITNESS_UTXO        byte = 0x01
+	PSBT_IN_PARTIAL_SIG         byte = 0x02
+	PSBT_IN_SIGHASH_TYPE        byte = 0x03
+	PSBT_IN_REDEEM_SCRIPT       byte = 0x04
+	PSBT_IN_WITNESS_SCRIPT      byte = 0x05
+	PSBT_IN_BIP32_DERIVATION    byte = 0x06
+	PSBT_IN_FINAL_SCRIPTSIG     byte = 0x07
+	PSBT_IN_FINAL_SCRIPTWITNESS byte = 0x08
+)
+
+// Output key types
+const (
+	PSBT_OUT_REDEEM_SCRIPT    byte = 0x00
+	PSBT_OUT_WITNESS_SCRIPT   byte = 0x01
+	PSBT_OUT_BIP32_DERIVATION byte = 0x02
+)
+
+// MAX_PSBT_FIELD caps a single key or value read from the wire
+const MAX_PSBT_FIELD uint64 = 4_000_000
+
+var (
+	ErrBadMagic       = errors.New("psbt: bad magic bytes")
+	ErrDuplicateKey   = errors.New("psbt: duplicate key")
+	ErrBadField       = errors.New("psbt: malformed field")
+	ErrNoUnsignedTx   = errors.New("psbt: missing unsigned transaction")
+	ErrTxNotUnsigned  = errors.New("psbt: transaction has scriptSigs or witnesses")
+	ErrMismatchedUtxo = errors.New("psbt: utxo does not match the input's outpoint")
+)
+
+// KeyValue is a map entry whose type this package doesn't interpret. Unknown entries are
+// kept and written back unchanged, as BIP 174 requires.
+type KeyValue struct {
+	Key   []byte // includes the type byte
+	Value []byte
+}
+
+// PartialSig is a signature, sighash byte included, by one public key
+type PartialSig struct {
+	PubKey    []byte // SEC encoded
+	Signature []byte
+}
+
+// Bip32Derivation records the master key fingerprint and path a public key derives from
+type Bip32Derivation struct {
+	PubKey      []byte
+	Fingerprint uint32
+	Path        []uint32
+}
+
+// Input holds what signers and the finalizer need to know about one input
+type Input struct {
+	NonWitnessUtxo     *transactions.Transaction // the whole transaction being spent
+	WitnessUtxo        *transactions.TxOut       // just the output, for segwit spends
+	PartialSigs        []PartialSig
+	SighashType        uint32 // 0 when unset, meaning SIGHASH_ALL
+	RedeemScript       []byte // raw, without length prefix
+	WitnessScript      []byte
+	Bip32Derivations   []Bip32Derivation
+	FinalScriptSig     []byte
+	FinalScriptWitness [][]byte
+	Unknowns           []KeyValue
+}
+
+// Output holds what a wallet needs to recognize one of its outputs
+type Output struct {
+	RedeemScript     []byte
+	WitnessScript    []byte
+	Bip32Derivations []Bip32Derivation
+	Unknowns         []KeyValue
+}
+
+// Packet is a PSBT: the unsigned transaction and one map per input and output
+type Packet struct {
+	UnsignedTx transactions.Transaction
+	Unknowns   []KeyValue
+	Inputs     []Input
+	Outputs    []Output
+}
+
+// IsFinalized reports whether the input has its final scriptSig or witness
+func (in *Input) IsFinalized() bool {
+	return in.FinalScriptSig != nil || in.FinalScriptWitness != nil
+}
+
+// Parse reads a binary PSBT
+func Parse(r io.Reader) (*Packet, error) {
+	magic := make([]byte, len(PSBT_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, PSBT_MAGIC) {
+		return nil, ErrBadMagic
+	}
+
+	p := &Packet{}
+	haveTx := false
+	err := readMap(r, func(key, value []byte) error {
+		switch key[0] {
+		case PSBT_GLOBAL_UNSIGNED_TX:
+			if len(key) != 1 {
+				return fmt.Errorf("%w: unsigned tx key has key data", ErrBadField)
+			}
+			tx, err := transactions.ParseTransaction(bytes.NewReader(value))
+			if err != nil {
+				return fmt.Errorf("%w: unsigned tx: %v", ErrBadField, err)
+			}
+			p.UnsignedTx = tx
+			haveTx = true
+		default:
+			p.Unknowns = append(p.Unknowns, KeyValue{Key: key, Value: value})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !haveTx {
+		return nil, ErrNoUnsignedTx
+	}
+	if err := checkUnsigned(&p.UnsignedTx); err != nil {
+		return nil, err
+	}
+
+	p.Inputs = make([]Input, len(p.UnsignedTx.Inputs))
+	for i := range p.Inputs {
+		if err := readMap(r, p.Inputs[i].parseField); err != nil {
+			return nil, fmt.Errorf("input %d: %w", i, err)
+		}
+		if err := p.checkUtxo(i); err != nil {
+			return nil, err
+		}
+	}
+	p.Outputs = make([]Output, len(p.UnsignedTx.Outputs))
+	for i := range p.Outputs {
+		if err := readMap(r, p.Outputs[i].parseField); err != nil {
+			return nil, fmt.Errorf("output %d: %w", i, err)
+		}
+	}
+	return p, nil
+}
+
+// ParseBase64 reads a PSBT in the base64 form wallets exchange
+func ParseBase64(s string) (*Packet, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("psbt: %w", err)
+	}
+	return Parse(bytes.NewReader(raw))
+}
+
+// Serialize returns the binary PSBT
+func (p *Packet) Serialize() ([]byte, error) {
+	if len(p.Inputs) != len(p.UnsignedTx.Inputs) || len(p.Outputs) != len(p.UnsignedTx.Outputs) {
+		return nil, fmt.Errorf("%w: %d input and %d output maps for a %d-in %d-out transaction",
+			ErrBadField, len(p.Inputs), len(p.Outputs), len(p.UnsignedTx.Inputs), len(p.UnsignedTx.Outputs))
+	}
+	var buf bytes.Buffer
+	buf.Write(PSBT_MAGIC)
+
+	tx, err := p.UnsignedTx.SerializeLegacy()
+	if err != nil {
+		return nil, err
+	}
+	writeField(&buf, []byte{PSBT_GLOBAL_UNSIGNED_TX}, tx)
+	writeUnknowns(&buf, p.Unknowns)
+	buf.WriteByte(0x00)
+
+	for i := range p.Inputs {
+		if err := p.Inputs[i].serialize(&buf); err != nil {
+			return nil, fmt.Errorf("input %d: %w", i, err)
+		}
+	}
+	for i := range p.Outputs {
+		p.Outputs[i].serialize(&buf)
+	}
+	return buf.Bytes(), nil
+}
+
+// B64Encode returns the PSBT in base64
+func (p *Packet) B64Encode() (string, error) {
+	raw, err := p.Serialize()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func (in *Input) parseField(key, value []byte) error {
+	keyData := key[1:]
+	switch key[0] {
+	case PSBT_IN_NON_WITNESS_UTXO:
+		if len(keyData) != 0 {
+			return fmt.Errorf("%w: non-witness utxo key has key data", ErrBadField)
+		}
+		tx, err := transactions.ParseTransaction(bytes.NewReader(value))
+		if err != nil {
+			return fmt.Errorf("%w: non-witness utxo: %v", ErrBadField, err)
+		}
+		in.NonWitnessUtxo = &tx
+	case PSBT_IN_WITNESS_UTXO:
+		if len(keyData) != 0 {
+			return fmt.Errorf("%w: witness utxo key has key data", ErrBadField)
+		}
+		out, err := transactions.ParseTxOut(bytes.NewReader(value))
+		if err != nil {
+			return fmt.Errorf("%w: witness utxo: %v", ErrBadField, err)
+		}
+		in.WitnessUtxo = &out
+	case PSBT_IN_PARTIAL_SIG:
+		if !validPubKey(keyData) {
+			return fmt.Errorf("%w: partial sig pubkey", ErrBadField)
+		}
+		in.PartialSigs = append(in.PartialSigs, PartialSig{PubKey: keyData, Signature: value})
+	case PSBT_IN_SIGHASH_TYPE:
+		if len(keyData) != 0 || len(value) != 4 {
+			return fmt.Errorf("%w: sighash type", ErrBadField)
+		}
+		in.SighashType = binary.LittleEndian.Uint32(value)
+	case PSBT_IN_REDEEM_SCRIPT:
+		in.RedeemScript = value
+	case PSBT_IN_WITNESS_SCRIPT:
+		in.WitnessScript = value
+	case PSBT_IN_BIP32_DERIVATION:
+		d, err := parseDerivation(keyData, value)
+		if err != nil {
+			return err
+		}
+		in.Bip32Derivations = append(in.Bip32Derivations, d)
+	case PSBT_IN_FINAL_SCRIPTSIG:
+		in.FinalScriptSig = value
+	case PSBT_IN_FINAL_SCRIPTWITNESS:
+		witness, err := parseWitness(value)
+		if err != nil {
+			return err
+		}
+		in.FinalScriptWitness = witness
+	default:
+		in.Unknowns = append(in.Unknowns, KeyValue{Key: key, Value: value})
+	}
+	return nil
+}
+
+func (in *Input) serialize(buf *bytes.Buffer) error {
+	if in.NonWitnessUtxo != nil {
+		tx, err := in.NonWitnessUtxo.Serialize()
+		if err != nil {
+			return err
+		}
+		writeField(buf, []byte{PSBT_IN_NON_WITNESS_UTXO}, tx)
+	}
+	if in.WitnessUtxo != nil {
+		out, err := in.WitnessUtxo.Serialize()
+		if err != nil {
+			return err
+		}
+		writeField(buf, []byte{PSBT_IN_WITNESS_UTXO}, out)
+	}
+	for _, ps := range in.PartialSigs {
+		writeField(buf, append([]byte{PSBT_IN_PARTIAL_SIG}, ps.PubKey...), ps.Signature)
+	}
+	if in.SighashType != 0 {
+		writeField(buf, []byte{PSBT_IN_SIGHASH_TYPE}, binary.LittleEndian.AppendUint32(nil, in.SighashType))
+	}
+	if in.RedeemScript != nil {
+		writeField(buf, []byte{PSBT_IN_REDEEM_SCRIPT}, in.RedeemScript)
+	}
+	if in.WitnessScript != nil {
+		writeField(buf, []byte{PSBT_IN_WITNESS_SCRIPT}, in.WitnessScript)
+	}
+	writeDerivations(buf, PSBT_IN_BIP32_DERIVATION, in.Bip32Derivations)
+	if in.FinalScriptSig != nil {
+		writeField(buf, []byte{PSBT_IN_FINAL_SCRIPTSIG}, in.FinalScriptSig)
+	}
+	if in.FinalScriptWitness != nil {
+		writeField(buf, []byte{PSBT_IN_FINAL_SCRIPTWITNESS}, serializeWitness(in.FinalScriptWitness))
+	}
+	writeUnknowns(buf, in.Unknowns)
+	buf.WriteByte(0x00)
+	return nil
+}
+
+func (out *Output) parseField(key, value []byte) error {
+	switch key[0] {
+	case PSBT_OUT_REDEEM_SCRIPT:
+		out.RedeemScript = value
+	case PSBT_OUT_WITNESS_SCRIPT:
+		out.WitnessScript = value
+	case PSBT_OUT_BIP32_DERIVATION:
+		d, err := parseDerivation(key[1:], value)
+		if err != nil {
+			return err
+		}
+		out.Bip32Derivations = append(out.Bip32Derivations, d)
+	default:
+		out.Unknowns = append(out.Unknowns, KeyValue{Key: key, Value: value})
+	}
+	return nil
+}
+
+func (out *Output) serialize(buf *bytes.Buffer) {
+	if out.RedeemScript != nil {
+		writeField(buf, []byte{PSBT_OUT_REDEEM_SCRIPT}, out.RedeemScript)
+	}
+	if out.WitnessScript != nil {
+		writeField(buf, []byte{PSBT_OUT_WITNESS_SCRIPT}, out.WitnessScript)
+	}
+	writeDerivations(buf, PSBT_OUT_BIP32_DERIVATION, out.Bip32Derivations)
+	writeUnknowns(buf, out.Unknowns)
+	buf.WriteByte(0x00)
+}
+
+// readMap reads key/value pairs up to the 0x00 separator, rejecting repeated keys
+func readMap(r io.Reader, field func(key, value []byte) error) error {
+	seen := make(map[string]bool)
+	for {
+		key, err := readVarBytes(r)
+		if err != nil {
+			return err
+		}
+		if len(key) == 0 {
+			return nil // separator
+		}
+		value, err := readVarBytes(r)
+		if err != nil {
+			return err
+		}
+		if seen[string(key)] {
+			return fmt.Errorf("%w: %x", ErrDuplicateKey, key)
+		}
+		seen[string(key)] = true
+		if err := field(key, value); err != nil {
+			return err
+		}
+	}
+}
+
+func readVarBytes(r io.Reader) ([]byte, error) {
+	n, err := encoding.ReadVarInt(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadField, err)
+	}
+	if n > MAX_PSBT_FIELD {
+		return nil, fmt.Errorf("%w: %d byte field", ErrBadField, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadField, err)
+	}
+	return b, nil
+}
+
+func writeVarBytes(buf *bytes.Buffer, b []byte) {
+	length, _ := encoding.EncodeVarInt(uint64(len(b)))
+	buf.Write(length)
+	buf.Write(b)
+}
+
+func writeField(buf *bytes.Buffer, key, value []byte) {
+	writeVarBytes(buf, key)
+	writeVarBytes(buf, value)
+}
+
+func writeUnknowns(buf *bytes.Buffer, unknowns []KeyValue) {
+	for _, kv := range unknowns {
+		writeField(buf, kv.Key, kv.Value)
+	}
+}
+
+func parseDerivation(pubKey, value []byte) (Bip32Derivation, error) {
+	if !validPubKey(pubKey) || len(value) < 4 || len(value)%4 != 0 {
+		return Bip32Derivation{}, fmt.Errorf("%w: bip32 derivation", ErrBadField)
+	}
+	d := Bip32Derivation{PubKey: pubKey, Fingerprint: binary.BigEndian.Uint32(value)}
+	for i := 4; i < len(value); i += 4 {
+		d.Path = append(d.Path, binary.LittleEndian.Uint32(value[i:]))
+	}
+	return d, nil
+}
+
+func writeDerivations(buf *bytes.Buffer, keyType byte, derivations []Bip32Derivation) {
+	for _, d := range derivations {
+		value := binary.BigEndian.AppendUint32(nil, d.Fingerprint)
+		for _, step := range d.Path {
+			value = binary.LittleEndian.AppendUint32(value, step)
+		}
+		writeField(buf, append([]byte{keyType}, d.PubKey...), value)
+	}
+}
+
+func parseWitness(value []byte) ([][]byte, error) {
+	r := bytes.NewReader(value)
+	count, err := encoding.ReadVarInt(r)
+	if err != nil || count > uint64(len(value)) {
+		return nil, fmt.Errorf("%w: final script witness", ErrBadField)
+	}
+	witness := make([][]byte, 0, count)
+	for range count {
+		item, err := readVarBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		witness = append(witness, item)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: trailing bytes after final script witness", ErrBadField)
+	}
+	return witness, nil
+}
+
+func serializeWitness(witness [][]byte) []byte {
+	var buf bytes.Buffer
+	count, _ := encoding.EncodeVarInt(uint64(len(witness)))
+	buf.Write(count)
+	for _, item := range witness {
+		writeVarBytes(&buf, item)
+	}
+	return buf.Bytes()
+}
+
+// validPubKey accepts SEC encodings: 33 bytes compressed or 65 uncompressed
+func validPubKey(b []byte) bool {
+	return (len(b) == 33 && (b[0] == 0x02 || b[0] == 0x03)) || (len(b) == 65 && b[0] == 0x04)
+}
+
+// checkUnsigned rejects a transaction that already carries signatures
+func checkUnsigned(tx *transactions.Transaction) error {
+	for i, in := range tx.Inputs {
+		if len(in.ScriptSig.CommandStack) != 0 || len(in.Witness) != 0 {
+			return fmt.Errorf("%w: input %d", ErrTxNotUnsigned, i)
+		}
+	}
+	return nil
+}
+
+// checkUtxo makes sure a non-witness utxo is the transaction the input spends
+func (p *Packet) checkUtxo(i int) error {
+	utxo := p.Inputs[i].NonWitnessUtxo
+	if utxo == nil {
+		return nil
+	}
+	txid, err := utxo.Hash()
+	if err != nil {
+		return err
+	}
+	txin := p.UnsignedTx.Inputs[i]
+	if !slices.Equal(txid[:], txin.PrevTx) || int(txin.PrevIdx) >= len(utxo.Outputs) {
+		return fmt.Errorf("%w: input %d", ErrMismatchedUtxo, i)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package psbt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/eccmath"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// multisig builds an m-of-n OP_CHECKMULTISIG script
+func multisig(m int, pubs ...[]byte) script.Script {
+	cmds := []script.ScriptCommand{{Opcode: script.OP_1 + byte(m-1)}}
+	for _, pub := range pubs {
+		cmds = append(cmds, script.ScriptCommand{IsData: true, Data: pub})
+	}
+	cmds = append(cmds,
+		script.ScriptCommand{Opcode: script.OP_1 + byte(len(pubs)-1)},
+		script.ScriptCommand{Opcode: script.OP_CHECKMULTISIG})
+	return script.NewScript(cmds)
+}
+
+func rawScript(t *testing.T, s script.Script) []byte {
+	t.Helper()
+	raw, err := s.RawBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// spendFixture funds one output of every supported kind and builds a PSBT spending them,
+// updated with the utxos and scripts signers need
+func spendFixture(t *testing.T, k1, k2, k3 *keys.PrivateKey) *Packet {
+	t.Helper()
+	pub := func(k *keys.PrivateKey) []byte { p := k.PublicKey(); return p.Serialize(true) }
+	p1, p2, p3 := pub(k1), pub(k2), pub(k3)
+
+	p2wpkh := script.P2wpkhScript(encoding.Hash160(p1))
+	ms23 := multisig(2, p1, p2, p3)
+	ms22 := multisig(2, p1, p2)
+	wsHash := sha256.Sum256(rawScript(t, ms23))
+	p2wsh := script.P2wshScript(wsHash[:])
+
+	locks := []script.Script{
+		script.P2pkhScript(encoding.Hash160(p1)),
+		p2wpkh,
+		script.P2shScript(encoding.Hash160(rawScript(t, p2wpkh))),
+		p2wsh,
+		script.P2shScript(encoding.Hash160(rawScript(t, ms22))),
+		script.P2shScript(encoding.Hash160(rawScript(t, p2wsh))),
+	}
+	outs := make([]transactions.TxOut, len(locks))
+	for i, lock := range locks {
+		outs[i] = transactions.TxOut{Amount: 100_000, ScriptPubKey: lock}
+	}
+	funding := transactions.NewTransaction(1,
+		[]transactions.TxIn{transactions.NewTxIn(bytes.Repeat([]byte{0xaa}, 32), 0, transactions.SEQUENCE_FINAL)},
+		outs, 0, false, false)
+	fundingId, err := funding.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ins := make([]transactions.TxIn, len(locks))
+	for i := range ins {
+		ins[i] = transactions.NewTxIn(fundingId[:], uint32(i), transactions.SEQUENCE_FINAL)
+	}
+	tx := transactions.NewTransaction(2, ins,
+		[]transactions.TxOut{{Amount: 590_000, ScriptPubKey: locks[0]}}, 0, false, false)
+
+	p, err := New(&tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range locks {
+		must(p.SetWitnessUtxo(i, outs[i]))
+	}
+	// legacy inputs carry the whole funding transaction instead
+	for _, i := range []int{0, 4} {
+		p.Inputs[i].WitnessUtxo = nil
+		must(p.SetNonWitnessUtxo(i, &funding))
+	}
+	must(p.SetRedeemScript(2, p2wpkh))
+	must(p.SetWitnessScript(3, ms23))
+	must(p.SetRedeemScript(4, ms22))
+	must(p.SetRedeemScript(5, p2wsh))
+	must(p.SetWitnessScript(5, ms23))
+	must(p.AddInputDerivation(0, Bip32Derivation{PubKey: p1, Fingerprint: 0xdeadbeef, Path: []uint32{0x8000002c, 0x80000000, 0x80000000, 0, 7}}))
+	must(p.AddOutputDerivation(0, Bip32Derivation{PubKey: p1, Fingerprint: 0xdeadbeef, Path: []uint32{0x8000002c, 0x80000000, 0x80000000, 1, 0}}))
+	return p
+}
+
+// signAll signs every input key can sign for
+func signAll(t *testing.T, p *Packet, key *keys.PrivateKey) {
+	t.Helper()
+	for i := range p.Inputs {
+		if err := p.Sign(i, *key, true); err != nil && !errors.Is(err, ErrKeyNotInScript) {
+			t.Fatalf("input %d: %v", i, err)
+		}
+	}
+}
+
+func TestPSBTRoundTrip(t *testing.T) {
+	k1, k2, k3 := keys.NewPrivateKey(big.NewInt(101)), keys.NewPrivateKey(big.NewInt(202)), keys.NewPrivateKey(big.NewInt(303))
+	p := spendFixture(t, k1, k2, k3)
+	signAll(t, p, k1)
+	p.Inputs[1].Unknowns = []KeyValue{{Key: []byte{0xfc, 0x01}, Value: []byte("proprietary")}}
+
+	b64, err := p.B64Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseBase64(b64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := parsed.B64Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != b64 {
+		t.Fatal("PSBT changed across a base64 round trip")
+	}
+	if len(parsed.Inputs[3].PartialSigs) != 1 || !bytes.Equal(parsed.Inputs[1].Unknowns[0].Value, []byte("proprietary")) {
+		t.Fatal("partial sigs or unknown fields lost in parsing")
+	}
+	if d := parsed.Outputs[0].Bip32Derivations; len(d) != 1 || d[0].Fingerprint != 0xdeadbeef || len(d[0].Path) != 5 {
+		t.Fatalf("output derivation = %+v", d)
+	}
+	t.Logf("✓ PSBT survives base64 encode and parse unchanged, unknown fields included")
+
+	t.Run("malformed", func(t *testing.T) {
+		raw, _ := p.Serialize()
+		if _, err := Parse(bytes.NewReader(raw[1:])); !errors.Is(err, ErrBadMagic) {
+			t.Errorf("bad magic: err = %v", err)
+		}
+		// repeat the unsigned tx key in the global map
+		txField := raw[len(PSBT_MAGIC):]
+		keyLen := int(txField[0])
+		txLen, _ := encoding.ReadVarInt(bytes.NewReader(txField[1+keyLen:]))
+		fieldLen := 1 + keyLen + 1 + int(txLen) // tx is under 0xfd bytes
+		dup := append(append(append([]byte{}, raw[:len(PSBT_MAGIC)+fieldLen]...), txField[:fieldLen]...), txField[fieldLen:]...)
+		if _, err := Parse(bytes.NewReader(dup)); !errors.Is(err, ErrDuplicateKey) {
+			t.Errorf("duplicate key: err = %v", err)
+		}
+		if _, err := Parse(bytes.NewReader(raw[:len(raw)-3])); err == nil {
+			t.Error("truncated PSBT parsed")
+		}
+		t.Logf("✓ Bad magic, duplicate keys and truncation are rejected")
+	})
+}
+
+func TestPSBTSignFinalizeExtract(t *testing.T) {
+	k1, k2, k3 := keys.NewPrivateKey(big.NewInt(101)), keys.NewPrivateKey(big.NewInt(202)), keys.NewPrivateKey(big.NewInt(303))
+	creator := spendFixture(t, k1, k2, k3)
+	b64, err := creator.B64Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two signers work on their own copies
+	alice, _ := ParseBase64(b64)
+	bob, _ := ParseBase64(b64)
+	signAll(t, alice, k1)
+	signAll(t, bob, k2)
+
+	// alice alone can only finalize the single key inputs
+	if err := alice.Finalize(3); !errors.Is(err, ErrMissingSigs) {
+		t.Fatalf("finalizing 2-of-3 with one signature: err = %v, want %v", err, ErrMissingSigs)
+	} else if p2 := k2.PublicKey(); !strings.Contains(err.Error(), fmt.Sprintf("%x", p2.Serialize(true))) {
+		t.Errorf("error doesn't name the keys still to sign: %v", err)
+	}
+	pub := func(k *keys.PrivateKey) []byte { p := k.PublicKey(); return p.Serialize(true) }
+	missing := []struct {
+		p        *Packet
+		input    int
+		need     int
+		unsigned [][]byte
+	}{
+		{creator, 3, 2, [][]byte{pub(k1), pub(k2), pub(k3)}},
+		{alice, 3, 1, [][]byte{pub(k2), pub(k3)}},
+		{bob, 4, 1, [][]byte{pub(k1)}},
+		{creator, 1, 1, nil},
+		{alice, 1, 0, nil},
+	}
+	for _, tt := range missing {
+		need, unsigned, err := tt.p.MissingSigners(tt.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if need != tt.need || fmt.Sprintf("%x", unsigned) != fmt.Sprintf("%x", tt.unsigned) {
+			t.Errorf("input %d: need %d from %x, want %d from %x", tt.input, need, unsigned, tt.need, tt.unsigned)
+		}
+	}
+	t.Logf("✓ Missing signers are reported by key, in script order")
+	if _, err := alice.Extract(); !errors.Is(err, ErrNotFinalized) {
+		t.Fatalf("extracting unfinalized PSBT: err = %v, want %v", err, ErrNotFinalized)
+	}
+
+	if err := alice.Combine(bob); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(alice.Inputs[3].PartialSigs); got != 2 {
+		t.Fatalf("combined input 3 has %d signatures, want 2", got)
+	}
+	if err := alice.FinalizeAll(); err != nil {
+		t.Fatal(err)
+	}
+	for i, in := range alice.Inputs {
+		if in.PartialSigs != nil || in.RedeemScript != nil || in.WitnessScript != nil || in.Bip32Derivations != nil {
+			t.Errorf("input %d kept signer fields after finalizing", i)
+		}
+	}
+	t.Logf("✓ Signatures from separate signers combine and finalize")
+
+	tx, err := alice.Extract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range tx.Inputs {
+		valid, err := tx.VerifyInput(i)
+		if err != nil {
+			t.Fatalf("input %d: %v", i, err)
+		}
+		if !valid {
+			t.Errorf("input %d does not verify", i)
+		}
+	}
+	if !tx.IsSegwit {
+		t.Error("extracted transaction with witnesses is not segwit")
+	}
+	t.Logf("✓ Extracted transaction verifies: P2PKH, P2WPKH, P2SH-P2WPKH, P2WSH, P2SH and P2SH-P2WSH")
+
+	t.Run("errors", func(t *testing.T) {
+		p, _ := ParseBase64(b64)
+		// a P2PKH output known only as a witness utxo
+		p.Inputs[0].WitnessUtxo = &p.Inputs[0].NonWitnessUtxo.Outputs[0]
+		p.Inputs[0].NonWitnessUtxo = nil
+		if err := p.Sign(0, *k1, true); !errors.Is(err, ErrMissingUtxo) {
+			t.Errorf("legacy input without non-witness utxo: err = %v, want %v", err, ErrMissingUtxo)
+		}
+		if err := p.Sign(1, *k3, true); !errors.Is(err, ErrKeyNotInScript) {
+			t.Errorf("foreign key: err = %v, want %v", err, ErrKeyNotInScript)
+		}
+		p.Inputs[4].RedeemScript = rawScript(t, multisig(1, []byte{0x02}))
+		if err := p.Sign(4, *k1, true); !errors.Is(err, ErrScriptMismatch) {
+			t.Errorf("wrong redeem script: err = %v, want %v", err, ErrScriptMismatch)
+		}
+
+		other := spendFixture(t, k1, k2, k3)
+		other.UnsignedTx.Locktime = 1
+		if err := p.Combine(other); !errors.Is(err, ErrMismatchedTx) {
+			t.Errorf("combining different transactions: err = %v, want %v", err, ErrMismatchedTx)
+		}
+
+		signed := transactions.NewTransaction(1, []transactions.TxIn{transactions.NewTxIn(bytes.Repeat([]byte{1}, 32), 0, 0)}, nil, 0, false, false)
+		signed.Inputs[0].Witness = [][]byte{{0x01}}
+		if _, err := New(&signed); !errors.Is(err, ErrTxNotUnsigned) {
+			t.Errorf("creating from a signed transaction: err = %v, want %v", err, ErrTxNotUnsigned)
+		}
+		t.Logf("✓ Missing utxos, foreign keys, bad scripts and mismatched packets are rejected")
+	})
+}
+
+// device is a hardware wallet stand-in holding a key per derivation path
+type device map[string]*keys.PrivateKey
+
+func (d device) PubKey(path []uint32) (keys.PublicKey, error) {
+	key, ok := d[fmt.Sprint(path)]
+	if !ok {
+		return keys.PublicKey{}, fmt.Errorf("no key at %v", path)
+	}
+	return key.PublicKey(), nil
+}
+
+func (d device) SignHash(path []uint32, hash []byte) (eccmath.Signature, error) {
+	return d[fmt.Sprint(path)].SignHash(hash)
+}
+
+func TestPSBTSignWithSigner(t *testing.T) {
+	k1, k2, k3 := keys.NewPrivateKey(big.NewInt(101)), keys.NewPrivateKey(big.NewInt(202)), keys.NewPrivateKey(big.NewInt(303))
+	p := spendFixture(t, k1, k2, k3)
+	pub := func(k *keys.PrivateKey) []byte { p := k.PublicKey(); return p.Serialize(true) }
+	path1 := []uint32{0x8000002c, 0x80000000, 0x80000000, 0, 7}
+	path2 := []uint32{0x8000002c, 0x80000000, 0x80000000, 0, 8}
+	hw := device{fmt.Sprint(path1): k1, fmt.Sprint(path2): k2}
+
+	// the 2-of-3 input lists two of the device's keys
+	for _, d := range []Bip32Derivation{{pub(k1), 0xdeadbeef, path1}, {pub(k2), 0xdeadbeef, path2}, {pub(k3), 0x0badf00d, path1}} {
+		if err := p.AddInputDerivation(3, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range []int{0, 3} {
+		if err := p.SignWithSigner(i, hw, 0xdeadbeef); err != nil {
+			t.Fatalf("input %d: %v", i, err)
+		}
+	}
+	if n := len(p.Inputs[3].PartialSigs); n != 2 {
+		t.Fatalf("2-of-3 input has %d signatures, want 2", n)
+	}
+	for _, i := range []int{0, 3} {
+		if err := p.Finalize(i); err != nil {
+			t.Fatalf("finalizing input %d: %v", i, err)
+		}
+	}
+	t.Logf("✓ A device signs every input derivation under its fingerprint")
+
+	p = spendFixture(t, k1, k2, k3)
+	if err := p.SignWithSigner(0, hw, 0x0badf00d); !errors.Is(err, ErrKeyNotInScript) {
+		t.Errorf("other fingerprint: err = %v, want %v", err, ErrKeyNotInScript)
+	}
+	if err := p.SignWithSigner(0, device{fmt.Sprint(path1): k2}, 0xdeadbeef); !errors.Is(err, ErrKeyNotInScript) {
+		t.Errorf("device key differs from the derivation's: err = %v, want %v", err, ErrKeyNotInScript)
+	}
+	if len(p.Inputs[0].PartialSigs) != 0 {
+		t.Error("signatures added by a failed signing")
+	}
+	t.Logf("✓ Foreign fingerprints and mismatched device keys are rejected")
+}
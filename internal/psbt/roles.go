@@ -0,0 +1,612 @@
+package psbt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/eccmath"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"go-bitcoin/internal/transactions"
+	"slices"
+)
+
+var (
+	ErrIndexOutOfRange   = errors.New("psbt: index out of range")
+	ErrMissingUtxo       = errors.New("psbt: input has no utxo")
+	ErrMissingScript     = errors.New("psbt: input is missing its redeem or witness script")
+	ErrScriptMismatch    = errors.New("psbt: script does not hash to the output being spent")
+	ErrKeyNotInScript    = errors.New("psbt: key cannot sign for this input")
+	ErrUnsupportedScript = errors.New("psbt: unsupported script type")
+	ErrFinalized         = errors.New("psbt: input is already finalized")
+	ErrNotFinalized      = errors.New("psbt: input is not finalized")
+	ErrMissingSigs       = errors.New("psbt: not enough signatures to finalize")
+	ErrMismatchedTx      = errors.New("psbt: packets are for different transactions")
+)
+
+// New is the creator: it wraps an unsigned transaction in a PSBT with empty maps
+func New(tx *transactions.Transaction) (*Packet, error) {
+	if err := checkUnsigned(tx); err != nil {
+		return nil, err
+	}
+	unsigned := *tx
+	unsigned.Inputs = slices.Clone(tx.Inputs)
+	unsigned.Outputs = slices.Clone(tx.Outputs)
+	unsigned.IsSegwit = false
+	return &Packet{
+		UnsignedTx: unsigned,
+		Inputs:     make([]Input, len(tx.Inputs)),
+		Outputs:    make([]Output, len(tx.Outputs)),
+	}, nil
+}
+
+func (p *Packet) input(i int) (*Input, error) {
+	if i < 0 || i >= len(p.Inputs) {
+		return nil, fmt.Errorf("%w: input %d", ErrIndexOutOfRange, i)
+	}
+	return &p.Inputs[i], nil
+}
+
+// SetNonWitnessUtxo records the transaction input i spends, which legacy inputs need to
+// be signed
+func (p *Packet) SetNonWitnessUtxo(i int, tx *transactions.Transaction) error {
+	in, err := p.input(i)
+	if err != nil {
+		return err
+	}
+	prev := in.NonWitnessUtxo
+	in.NonWitnessUtxo = tx
+	if err := p.checkUtxo(i); err != nil {
+		in.NonWitnessUtxo = prev
+		return err
+	}
+	return nil
+}
+
+// SetWitnessUtxo records the output a segwit input i spends
+func (p *Packet) SetWitnessUtxo(i int, out transactions.TxOut) error {
+	in, err := p.input(i)
+	if err != nil {
+		return err
+	}
+	in.WitnessUtxo = &out
+	return nil
+}
+
+// SetRedeemScript records the P2SH redeem script of input i
+func (p *Packet) SetRedeemScript(i int, s script.Script) error {
+	in, err := p.input(i)
+	if err != nil {
+		return err
+	}
+	raw, err := s.RawBytes()
+	if err != nil {
+		return err
+	}
+	in.RedeemScript = raw
+	return nil
+}
+
+// SetWitnessScript records the P2WSH witness script of input i
+func (p *Packet) SetWitnessScript(i int, s script.Script) error {
+	in, err := p.input(i)
+	if err != nil {
+		return err
+	}
+	raw, err := s.RawBytes()
+	if err != nil {
+		return err
+	}
+	in.WitnessScript = raw
+	return nil
+}
+
+// SetSighashType asks signers of input i to sign with hashType
+func (p *Packet) SetSighashType(i int, hashType uint32) error {
+	in, err := p.input(i)
+	if err != nil {
+		return err
+	}
+	in.SighashType = hashType
+	return nil
+}
+
+// AddInputDerivation records where a key that can sign input i comes from
+func (p *Packet) AddInputDerivation(i int, d Bip32Derivation) error {
+	in, err := p.input(i)
+	if err != nil {
+		return err
+	}
+	in.Bip32Derivations = mergeDerivations(in.Bip32Derivations, []Bip32Derivation{d})
+	return nil
+}
+
+// AddOutputDerivation records where a key of output i comes from, marking it as the
+// wallet's own
+func (p *Packet) AddOutputDerivation(i int, d Bip32Derivation) error {
+	if i < 0 || i >= len(p.Outputs) {
+		return fmt.Errorf("%w: output %d", ErrIndexOutOfRange, i)
+	}
+	p.Outputs[i].Bip32Derivations = mergeDerivations(p.Outputs[i].Bip32Derivations, []Bip32Derivation{d})
+	return nil
+}
+
+// prevOut returns the output input i spends, from whichever utxo is known
+func (p *Packet) prevOut(i int) (transactions.TxOut, error) {
+	in := &p.Inputs[i]
+	if in.WitnessUtxo != nil {
+		return *in.WitnessUtxo, nil
+	}
+	if in.NonWitnessUtxo != nil {
+		return in.NonWitnessUtxo.Outputs[p.UnsignedTx.Inputs[i].PrevIdx], nil
+	}
+	return transactions.TxOut{}, fmt.Errorf("%w: input %d", ErrMissingUtxo, i)
+}
+
+// signingTx copies the unsigned transaction with each input's previous output attached
+// where known, so the transactions package can compute its sighashes
+func (p *Packet) signingTx() transactions.Transaction {
+	tx := transactions.NewTransaction(p.UnsignedTx.Version, slices.Clone(p.UnsignedTx.Inputs),
+		p.UnsignedTx.Outputs, p.UnsignedTx.Locktime, p.UnsignedTx.IsTestnet, false)
+	for i := range tx.Inputs {
+		if out, err := p.prevOut(i); err == nil {
+			tx.Inputs[i].SetPrevOut(out)
+		}
+	}
+	return tx
+}
+
+// spendScripts classifies input i by the output it spends, checking any redeem and
+// witness scripts against it. signScript is the script the key has to appear in.
+type spendScripts struct {
+	redeem, witness *script.Script
+	segwit          bool
+	signScript      []byte
+	keyHash         bool // signScript is a P2PKH/P2WPKH key hash rather than a script
+}
+
+func (p *Packet) classify(i int) (spendScripts, error) {
+	in := &p.Inputs[i]
+	prev, err := p.prevOut(i)
+	if err != nil {
+		return spendScripts{}, err
+	}
+	spk := prev.ScriptPubKey
+	var ss spendScripts
+
+	if spk.IsP2shScriptPubKey() {
+		if in.RedeemScript == nil {
+			return ss, fmt.Errorf("%w: input %d", ErrMissingScript, i)
+		}
+		if !bytes.Equal(encoding.Hash160(in.RedeemScript), spk.CommandStack[1].Data) {
+			return ss, fmt.Errorf("%w: input %d redeem script", ErrScriptMismatch, i)
+		}
+		redeem, err := script.ParseRawScript(in.RedeemScript)
+		if err != nil {
+			return ss, err
+		}
+		ss.redeem = &redeem
+		spk = redeem
+	}
+
+	switch {
+	case spk.IsP2wpkhScriptPubKey():
+		ss.segwit = true
+		ss.signScript = spk.CommandStack[1].Data
+		ss.keyHash = true
+	case spk.IsP2wshScriptPubKey():
+		if in.WitnessScript == nil {
+			return ss, fmt.Errorf("%w: input %d", ErrMissingScript, i)
+		}
+		if h := sha256.Sum256(in.WitnessScript); !bytes.Equal(h[:], spk.CommandStack[1].Data) {
+			return ss, fmt.Errorf("%w: input %d witness script", ErrScriptMismatch, i)
+		}
+		witness, err := script.ParseRawScript(in.WitnessScript)
+		if err != nil {
+			return ss, err
+		}
+		ss.witness = &witness
+		ss.segwit = true
+		ss.signScript = in.WitnessScript
+	case spk.IsP2pkhScriptPubKey():
+		ss.signScript = spk.CommandStack[2].Data
+		ss.keyHash = true
+	case ss.redeem != nil:
+		ss.signScript = in.RedeemScript
+	default:
+		return ss, fmt.Errorf("%w: input %d", ErrUnsupportedScript, i)
+	}
+	return ss, nil
+}
+
+// Sign is the signer: it adds key's signature for input i, under the input's sighash type
+// or SIGHASH_ALL. Legacy inputs need their non-witness utxo, so the amount being spent
+// can't be misrepresented.
+func (p *Packet) Sign(i int, key keys.PrivateKey, compressed bool) error {
+	pub := key.PublicKey()
+	return p.sign(i, pub.Serialize(compressed), key.SignHash)
+}
+
+// SignWithSigner adds signatures for input i from an external signer such as a hardware
+// wallet, for each of the input's BIP32 derivations under the signer's master key
+// fingerprint. The signer must report the derivation's key at its path, and each
+// signature is checked before it's added.
+func (p *Packet) SignWithSigner(i int, signer transactions.Signer, fingerprint uint32) error {
+	in, err := p.input(i)
+	if err != nil {
+		return err
+	}
+	signed := 0
+	for _, d := range in.Bip32Derivations {
+		if d.Fingerprint != fingerprint {
+			continue
+		}
+		pub, err := signer.PubKey(d.Path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(pub.Serialize(true), d.PubKey) && !bytes.Equal(pub.Serialize(false), d.PubKey) {
+			return fmt.Errorf("%w: signer's key at input %d's derivation path is %x, not %x", ErrKeyNotInScript, i, pub.Serialize(true), d.PubKey)
+		}
+		sign := func(hash []byte) (eccmath.Signature, error) {
+			return transactions.SignHashChecked(signer, d.Path, pub, hash)
+		}
+		if err := p.sign(i, d.PubKey, sign); err != nil {
+			return err
+		}
+		signed++
+	}
+	if signed == 0 {
+		return fmt.Errorf("%w: input %d has no derivation for fingerprint %08x", ErrKeyNotInScript, i, fingerprint)
+	}
+	return nil
+}
+
+// sign adds the signature of the key serialized as sec, made by signHash, for input i
+func (p *Packet) sign(i int, sec []byte, signHash func(hash []byte) (eccmath.Signature, error)) error {
+	in, err := p.input(i)
+	if err != nil {
+		return err
+	}
+	if in.IsFinalized() {
+		return fmt.Errorf("%w: input %d", ErrFinalized, i)
+	}
+	ss, err := p.classify(i)
+	if err != nil {
+		return err
+	}
+	if !ss.segwit && in.NonWitnessUtxo == nil {
+		return fmt.Errorf("%w: legacy input %d needs its non-witness utxo", ErrMissingUtxo, i)
+	}
+
+	if ss.keyHash {
+		if !bytes.Equal(encoding.Hash160(sec), ss.signScript) {
+			return fmt.Errorf("%w: input %d", ErrKeyNotInScript, i)
+		}
+	} else if !bytes.Contains(ss.signScript, sec) {
+		return fmt.Errorf("%w: input %d", ErrKeyNotInScript, i)
+	}
+
+	hashType := in.SighashType
+	if hashType == 0 {
+		hashType = encoding.SIGHASH_ALL
+	}
+	tx := p.signingTx()
+	var z []byte
+	if ss.segwit {
+		z, err = tx.SigHashBIP143Type(i, ss.redeem, ss.witness, hashType)
+	} else {
+		if ss.redeem != nil {
+			// the legacy sighash reads a P2SH redeem script from the scriptSig
+			tx.Inputs[i].ScriptSig = script.NewScript([]script.ScriptCommand{{IsData: true, Data: in.RedeemScript}})
+		}
+		z, err = tx.SigHashType(i, hashType)
+	}
+	if err != nil {
+		return err
+	}
+	sig, err := signHash(z)
+	if err != nil {
+		return err
+	}
+
+	ps := PartialSig{PubKey: sec, Signature: append(sig.Serialize(), byte(hashType))}
+	in.PartialSigs = mergePartialSigs(in.PartialSigs, []PartialSig{ps})
+	return nil
+}
+
+// Combine is the combiner: it merges the maps of other PSBTs for the same transaction
+// into p. Where both carry a value for the same key, p's is kept.
+func (p *Packet) Combine(others ...*Packet) error {
+	txid, err := p.UnsignedTx.Hash()
+	if err != nil {
+		return err
+	}
+	for _, o := range others {
+		otherId, err := o.UnsignedTx.Hash()
+		if err != nil {
+			return err
+		}
+		if otherId != txid || len(o.Inputs) != len(p.Inputs) || len(o.Outputs) != len(p.Outputs) {
+			return ErrMismatchedTx
+		}
+	}
+
+	for _, o := range others {
+		p.Unknowns = mergeUnknowns(p.Unknowns, o.Unknowns)
+		for i := range p.Inputs {
+			in, oin := &p.Inputs[i], &o.Inputs[i]
+			if in.NonWitnessUtxo == nil {
+				in.NonWitnessUtxo = oin.NonWitnessUtxo
+			}
+			if in.WitnessUtxo == nil {
+				in.WitnessUtxo = oin.WitnessUtxo
+			}
+			if in.SighashType == 0 {
+				in.SighashType = oin.SighashType
+			}
+			if in.RedeemScript == nil {
+				in.RedeemScript = oin.RedeemScript
+			}
+			if in.WitnessScript == nil {
+				in.WitnessScript = oin.WitnessScript
+			}
+			if in.FinalScriptSig == nil {
+				in.FinalScriptSig = oin.FinalScriptSig
+			}
+			if in.FinalScriptWitness == nil {
+				in.FinalScriptWitness = oin.FinalScriptWitness
+			}
+			in.PartialSigs = mergePartialSigs(in.PartialSigs, oin.PartialSigs)
+			in.Bip32Derivations = mergeDerivations(in.Bip32Derivations, oin.Bip32Derivations)
+			in.Unknowns = mergeUnknowns(in.Unknowns, oin.Unknowns)
+		}
+		for i := range p.Outputs {
+			out, oout := &p.Outputs[i], &o.Outputs[i]
+			if out.RedeemScript == nil {
+				out.RedeemScript = oout.RedeemScript
+			}
+			if out.WitnessScript == nil {
+				out.WitnessScript = oout.WitnessScript
+			}
+			out.Bip32Derivations = mergeDerivations(out.Bip32Derivations, oout.Bip32Derivations)
+			out.Unknowns = mergeUnknowns(out.Unknowns, oout.Unknowns)
+		}
+	}
+	return nil
+}
+
+// Finalize is the finalizer: it builds input i's final scriptSig and witness from its
+// partial signatures and drops the fields only signers need. P2PKH, P2WPKH, multisig
+// P2SH and P2WSH, and both P2SH-wrapped segwit forms are supported.
+func (p *Packet) Finalize(i int) error {
+	in, err := p.input(i)
+	if err != nil {
+		return err
+	}
+	if in.IsFinalized() {
+		return nil
+	}
+	ss, err := p.classify(i)
+	if err != nil {
+		return err
+	}
+
+	// the stack that satisfies the inner script
+	var stack [][]byte
+	if ss.keyHash {
+		for _, ps := range in.PartialSigs {
+			if bytes.Equal(encoding.Hash160(ps.PubKey), ss.signScript) {
+				stack = [][]byte{ps.Signature, ps.PubKey}
+				break
+			}
+		}
+		if stack == nil {
+			return fmt.Errorf("%w: input %d", ErrMissingSigs, i)
+		}
+		if ss.redeem != nil && !ss.segwit {
+			stack = append(stack, in.RedeemScript) // P2PKH wrapped in P2SH
+		}
+	} else {
+		inner := ss.witness
+		if inner == nil {
+			inner = ss.redeem
+		}
+		if stack, err = multisigStack(inner, in.PartialSigs); err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		// redeem or witness script goes last
+		stack = append(stack, ss.signScript)
+	}
+
+	var scriptSig []byte
+	switch {
+	case !ss.segwit:
+		scriptSig, err = pushAll(stack)
+	case ss.redeem != nil:
+		// P2SH-wrapped segwit: the scriptSig only pushes the witness program
+		scriptSig, err = pushAll([][]byte{in.RedeemScript})
+	}
+	if err != nil {
+		return err
+	}
+	if scriptSig != nil {
+		in.FinalScriptSig = scriptSig
+	}
+	if ss.segwit {
+		in.FinalScriptWitness = stack
+	}
+
+	in.PartialSigs = nil
+	in.SighashType = 0
+	in.RedeemScript = nil
+	in.WitnessScript = nil
+	in.Bip32Derivations = nil
+	return nil
+}
+
+// FinalizeAll finalizes every input
+func (p *Packet) FinalizeAll() error {
+	for i := range p.Inputs {
+		if err := p.Finalize(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Extract is the extractor: it returns the signed transaction once every input is
+// finalized. Inputs carry their previous outputs where known, so the result can be
+// checked with VerifyInput without fetching them.
+func (p *Packet) Extract() (*transactions.Transaction, error) {
+	tx := p.signingTx()
+	for i := range tx.Inputs {
+		in := &p.Inputs[i]
+		if !in.IsFinalized() {
+			return nil, fmt.Errorf("%w: input %d", ErrNotFinalized, i)
+		}
+		scriptSig, err := script.ParseRawScript(in.FinalScriptSig)
+		if err != nil {
+			return nil, err
+		}
+		tx.Inputs[i].ScriptSig = scriptSig
+		tx.Inputs[i].Witness = in.FinalScriptWitness
+		if len(in.FinalScriptWitness) > 0 {
+			tx.IsSegwit = true
+		}
+	}
+	return &tx, nil
+}
+
+// parseMultisig splits an m-of-n OP_CHECKMULTISIG script into m and its public keys
+func parseMultisig(s *script.Script) (int, [][]byte, error) {
+	cmds := s.CommandStack
+	n := len(cmds) - 3
+	if n < 1 || cmds[0].IsData || cmds[len(cmds)-2].IsData ||
+		cmds[len(cmds)-1].IsData || cmds[len(cmds)-1].Opcode != script.OP_CHECKMULTISIG ||
+		int(cmds[len(cmds)-2].Opcode)-int(script.OP_1)+1 != n {
+		return 0, nil, ErrUnsupportedScript
+	}
+	m := int(cmds[0].Opcode) - int(script.OP_1) + 1
+	if m < 1 || m > n {
+		return 0, nil, ErrUnsupportedScript
+	}
+	pubKeys := make([][]byte, n)
+	for i, cmd := range cmds[1 : 1+n] {
+		if !cmd.IsData {
+			return 0, nil, ErrUnsupportedScript
+		}
+		pubKeys[i] = cmd.Data
+	}
+	return m, pubKeys, nil
+}
+
+// multisigStack orders the first m signatures by their keys' place in the script, as
+// OP_CHECKMULTISIG requires. Without m of them, the error names the keys yet to sign.
+func multisigStack(s *script.Script, sigs []PartialSig) ([][]byte, error) {
+	m, pubKeys, err := parseMultisig(s)
+	if err != nil {
+		return nil, err
+	}
+	stack := [][]byte{{}} // OP_CHECKMULTISIG pops one element too many
+	var unsigned [][]byte
+	for _, key := range pubKeys {
+		if sig := findSig(sigs, key); sig == nil {
+			unsigned = append(unsigned, key)
+		} else if len(stack) < m+1 {
+			stack = append(stack, sig)
+		}
+	}
+	if len(stack) != m+1 {
+		return nil, fmt.Errorf("%w: have %d of %d, waiting on %x", ErrMissingSigs, len(stack)-1, m, unsigned)
+	}
+	return stack, nil
+}
+
+func findSig(sigs []PartialSig, pubKey []byte) []byte {
+	for _, ps := range sigs {
+		if bytes.Equal(ps.PubKey, pubKey) {
+			return ps.Signature
+		}
+	}
+	return nil
+}
+
+// MissingSigners reports how many more signatures input i needs before it can be
+// finalized, and for multisig inputs which of the script's keys haven't signed, in
+// script order. Single key inputs need one signature and name no keys.
+func (p *Packet) MissingSigners(i int) (int, [][]byte, error) {
+	in, err := p.input(i)
+	if err != nil {
+		return 0, nil, err
+	}
+	if in.IsFinalized() {
+		return 0, nil, nil
+	}
+	ss, err := p.classify(i)
+	if err != nil {
+		return 0, nil, err
+	}
+	if ss.keyHash {
+		for _, ps := range in.PartialSigs {
+			if bytes.Equal(encoding.Hash160(ps.PubKey), ss.signScript) {
+				return 0, nil, nil
+			}
+		}
+		return 1, nil, nil
+	}
+	inner := ss.witness
+	if inner == nil {
+		inner = ss.redeem
+	}
+	m, pubKeys, err := parseMultisig(inner)
+	if err != nil {
+		return 0, nil, fmt.Errorf("input %d: %w", i, err)
+	}
+	var unsigned [][]byte
+	for _, key := range pubKeys {
+		if findSig(in.PartialSigs, key) == nil {
+			unsigned = append(unsigned, key)
+		}
+	}
+	return max(0, m-(len(pubKeys)-len(unsigned))), unsigned, nil
+}
+
+// pushAll returns a script pushing each item, empty items as OP_0
+func pushAll(items [][]byte) ([]byte, error) {
+	cmds := make([]script.ScriptCommand, len(items))
+	for i, item := range items {
+		cmds[i] = script.ScriptCommand{IsData: true, Data: item}
+	}
+	s := script.NewScript(cmds)
+	return s.RawBytes()
+}
+
+func mergePartialSigs(a, b []PartialSig) []PartialSig {
+	for _, ps := range b {
+		if !slices.ContainsFunc(a, func(x PartialSig) bool { return bytes.Equal(x.PubKey, ps.PubKey) }) {
+			a = append(a, ps)
+		}
+	}
+	return a
+}
+
+func mergeDerivations(a, b []Bip32Derivation) []Bip32Derivation {
+	for _, d := range b {
+		if !slices.ContainsFunc(a, func(x Bip32Derivation) bool { return bytes.Equal(x.PubKey, d.PubKey) }) {
+			a = append(a, d)
+		}
+	}
+	return a
+}
+
+func mergeUnknowns(a, b []KeyValue) []KeyValue {
+	for _, kv := range b {
+		if !slices.ContainsFunc(a, func(x KeyValue) bool { return bytes.Equal(x.Key, kv.Key) }) {
+			a = append(a, kv)
+		}
+	}
+	return a
+}
@@ -0,0 +1,165 @@
+package script
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidAsm = errors.New("invalid script asm")
+
+// opcodeNames are the names Bitcoin Core gives opcodes in ASM, apart from OP_0, OP_1NEGATE
+// and OP_1 to OP_16, which it writes as numbers
+var opcodeNames = map[byte]string{
+	OP_PUSHDATA1: "OP_PUSHDATA1", OP_PUSHDATA2: "OP_PUSHDATA2", OP_PUSHDATA4: "OP_PUSHDATA4",
+	OP_RESERVED: "OP_RESERVED",
+
+	OP_NOP: "OP_NOP", OP_VER: "OP_VER", OP_IF: "OP_IF", OP_NOTIF: "OP_NOTIF", OP_VERIF: "OP_VERIF",
+	OP_VERNOTIF: "OP_VERNOTIF", OP_ELSE: "OP_ELSE", OP_ENDIF: "OP_ENDIF", OP_VERIFY: "OP_VERIFY",
+	OP_RETURN: "OP_RETURN",
+
+	OP_TOALSTACK: "OP_TOALTSTACK", OP_FROMALTSTACK: "OP_FROMALTSTACK", OP_2DROP: "OP_2DROP",
+	OP_2DUP: "OP_2DUP", OP_3DUP: "OP_3DUP", OP_2OVER: "OP_2OVER", OP_2ROT: "OP_2ROT",
+	OP_2SWAP: "OP_2SWAP", OP_IFDUP: "OP_IFDUP", OP_DEPTH: "OP_DEPTH", OP_DROP: "OP_DROP",
+	OP_DUP: "OP_DUP", OP_NIP: "OP_NIP", OP_OVER: "OP_OVER", OP_PICK: "OP_PICK", OP_ROLL: "OP_ROLL",
+	OP_ROT: "OP_ROT", OP_SWAP: "OP_SWAP", OP_TUCK: "OP_TUCK",
+
+	OP_CAT: "OP_CAT", OP_SUBSTR: "OP_SUBSTR", OP_LEFT: "OP_LEFT", OP_RIGHT: "OP_RIGHT",
+	OP_SIZE: "OP_SIZE",
+
+	OP_INVERT: "OP_INVERT", OP_AND: "OP_AND", OP_OR: "OP_OR", OP_XOR: "OP_XOR",
+	OP_EQUAL: "OP_EQUAL", OP_EQUALVERIFY: "OP_EQUALVERIFY", OP_RESERVED1: "OP_RESERVED1",
+	OP_RESERVED2: "OP_RESERVED2",
+
+	OP_1ADD: "OP_1ADD", OP_1SUB: "OP_1SUB", OP_2MUL: "OP_2MUL", OP_2DIV: "OP_2DIV",
+	OP_NEGATE: "OP_NEGATE", OP_ABS: "OP_ABS", OP_NOT: "OP_NOT", OP_0NOTEQUAL: "OP_0NOTEQUAL",
+	OP_ADD: "OP_ADD", OP_SUB: "OP_SUB", OP_MUL: "OP_MUL", OP_DIV: "OP_DIV", OP_MOD: "OP_MOD",
+	OP_LSHIFT: "OP_LSHIFT", OP_RSHIFT: "OP_RSHIFT", OP_BOOLAND: "OP_BOOLAND",
+	OP_BOOLOR: "OP_BOOLOR", OP_NUMEQUAL: "OP_NUMEQUAL", OP_NUMEQUALVERIFY: "OP_NUMEQUALVERIFY",
+	OP_NUMNOTEQUAL: "OP_NUMNOTEQUAL", OP_LESSTHAN: "OP_LESSTHAN", OP_GREATERTHAN: "OP_GREATERTHAN",
+	OP_LESSTHANOREQUAL: "OP_LESSTHANOREQUAL", OP_GREATERTHANOREQUAL: "OP_GREATERTHANOREQUAL",
+	OP_MIN: "OP_MIN", OP_MAX: "OP_MAX", OP_WITHIN: "OP_WITHIN",
+
+	OP_RIPEMD160: "OP_RIPEMD160", OP_SHA1: "OP_SHA1", OP_SHA256: "OP_SHA256",
+	OP_HASH160: "OP_HASH160", OP_HASH256: "OP_HASH256", OP_CODESEPARATOR: "OP_CODESEPARATOR",
+	OP_CHECKSIG: "OP_CHECKSIG", OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG: "OP_CHECKMULTISIG", OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+
+	OP_NOP1: "OP_NOP1", OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY", OP_NOP4: "OP_NOP4", OP_NOP5: "OP_NOP5",
+	OP_NOP6: "OP_NOP6", OP_NOP7: "OP_NOP7", OP_NOP8: "OP_NOP8", OP_NOP9: "OP_NOP9",
+	OP_NOP10: "OP_NOP10",
+
+	OP_CHECKSIGADD: "OP_CHECKSIGADD", OP_INVALIDOPCODE: "OP_INVALIDOPCODE",
+}
+
+// opcodesByName are the opcodes ParseAsm reads, under their names and common aliases
+var opcodesByName = func() map[string]byte {
+	byName := map[string]byte{
+		"OP_0": OP_O, "OP_FALSE": OP_O, "OP_TRUE": OP_1, "OP_1NEGATE": OP_1NEGATE,
+		"OP_NOP2": OP_CHECKLOCKTIMEVERIFY, "OP_NOP3": OP_CHECKSEQUENCEVERIFY,
+	}
+	for op := OP_1; op <= OP_16; op++ {
+		byName[fmt.Sprintf("OP_%d", op-OP_1+1)] = op
+	}
+	for op, name := range opcodeNames {
+		byName[name] = op
+	}
+	return byName
+}()
+
+// String returns the command as Bitcoin Core writes it in ASM: pushes of up to 4 bytes as
+// the number they hold and longer ones in hex, opcodes by name, and OP_0, OP_1NEGATE and
+// OP_1 to OP_16 as numbers
+func (c ScriptCommand) String() string {
+	if c.IsData {
+		if len(c.Data) <= 4 {
+			return strconv.FormatInt(DecodeNum(c.Data), 10)
+		}
+		return hex.EncodeToString(c.Data)
+	}
+	switch {
+	case c.Opcode == OP_O:
+		return "0"
+	case c.Opcode == OP_1NEGATE:
+		return "-1"
+	case c.Opcode >= OP_1 && c.Opcode <= OP_16:
+		return strconv.Itoa(int(c.Opcode-OP_1) + 1)
+	}
+	if name, ok := opcodeNames[c.Opcode]; ok {
+		return name
+	}
+	return "OP_UNKNOWN"
+}
+
+// Disasm returns the script in Bitcoin Core's ASM format, its commands separated by
+// spaces. Short pushes are written as numbers, as Core does, so one that isn't a minimally
+// encoded number reads back from ParseAsm as a different push.
+func (s Script) Disasm() string {
+	words := make([]string, len(s.CommandStack))
+	for i, cmd := range s.CommandStack {
+		words[i] = cmd.String()
+	}
+	return strings.Join(words, " ")
+}
+
+// String returns the script's ASM, as Disasm does
+func (s Script) String() string {
+	return s.Disasm()
+}
+
+// ParseAsm reads a script from ASM, the inverse of Disasm, as in
+// "OP_DUP OP_HASH160 <hex> OP_EQUALVERIFY OP_CHECKSIG". Opcodes are named with their OP_
+// prefix. A decimal number that fits in 4 bytes is OP_1NEGATE, OP_0 to OP_16, or a
+// minimal push of the number, and any other token is hex data to push.
+func ParseAsm(asm string) (Script, error) {
+	fields := strings.Fields(asm)
+	cmds := make([]ScriptCommand, 0, len(fields))
+	for i, token := range fields {
+		if op, ok := opcodesByName[token]; ok {
+			cmds = append(cmds, ScriptCommand{Opcode: op})
+			continue
+		}
+		if n, ok := asmNumber(token); ok {
+			cmds = append(cmds, numberCommand(n))
+			continue
+		}
+		data, err := hex.DecodeString(token)
+		if err != nil {
+			return Script{}, fmt.Errorf("%w: token %d %q", ErrInvalidAsm, i, token)
+		}
+		cmds = append(cmds, ScriptCommand{Data: data, IsData: true})
+	}
+	return NewScript(cmds), nil
+}
+
+// asmNumber reads a token written as a decimal number, with no sign other than a leading
+// minus and no leading zeros, that a 4-byte script number can hold
+func asmNumber(token string) (int64, bool) {
+	digits := strings.TrimPrefix(token, "-")
+	if digits == "" || digits[0] < '1' && digits != "0" || digits[0] > '9' {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(token, 10, 64)
+	if err != nil || n > math.MaxInt32 || n < -math.MaxInt32 {
+		return 0, false
+	}
+	return n, true
+}
+
+// numberCommand is the shortest way to push n: an opcode from OP_1NEGATE to OP_16, or
+// its script number
+func numberCommand(n int64) ScriptCommand {
+	switch {
+	case n == 0:
+		return ScriptCommand{Opcode: OP_O}
+	case n == -1:
+		return ScriptCommand{Opcode: OP_1NEGATE}
+	case n >= 1 && n <= 16:
+		return ScriptCommand{Opcode: OP_1 + byte(n-1)}
+	}
+	return ScriptCommand{Data: EncodeNum(n), IsData: true}
+}
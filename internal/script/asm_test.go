@@ -0,0 +1,73 @@
+package script
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestAsm(t *testing.T) {
+	h160, _ := hex.DecodeString("751e76e8199196d454941c45d1b3a323f1433bd6")
+	pubkey := "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	pk, _ := hex.DecodeString(pubkey)
+
+	tests := []struct {
+		name   string
+		script Script
+		want   string
+	}{
+		{"P2PKH", P2pkhScript(h160), "OP_DUP OP_HASH160 751e76e8199196d454941c45d1b3a323f1433bd6 OP_EQUALVERIFY OP_CHECKSIG"},
+		{"P2WPKH", P2wpkhScript(h160), "0 751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"multisig", NewScript([]ScriptCommand{op(OP_1), {Data: pk, IsData: true}, op(OP_1), op(OP_CHECKMULTISIG)}),
+			"1 " + pubkey + " 1 OP_CHECKMULTISIG"},
+		{"numbers", NewScript([]ScriptCommand{num(144), op(OP_CHECKSEQUENCEVERIFY), op(OP_DROP), op(OP_1NEGATE), num(-500), op(OP_16), num(17)}),
+			"144 OP_CHECKSEQUENCEVERIFY OP_DROP -1 -500 16 17"},
+		{"OP_RETURN", NullDataScript([]byte("hello")), "OP_RETURN 68656c6c6f"},
+		{"altstack and tapscript", NewScript([]ScriptCommand{op(OP_TOALSTACK), op(OP_FROMALTSTACK), op(OP_CHECKSIGADD), op(OP_NOP10)}),
+			"OP_TOALTSTACK OP_FROMALTSTACK OP_CHECKSIGADD OP_NOP10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.script.String(); got != tt.want {
+				t.Fatalf("String() = %q, want %q", got, tt.want)
+			}
+			parsed, err := ParseAsm(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := tt.script.RawBytes()
+			if got, _ := parsed.RawBytes(); !bytes.Equal(got, want) {
+				t.Fatalf("ParseAsm = %x, want %x", got, want)
+			}
+			t.Logf("✓ %s", tt.want)
+		})
+	}
+
+	// Core writes short pushes as numbers and unknown opcodes as OP_UNKNOWN
+	short := NewScript([]ScriptCommand{{Data: []byte{0x05, 0x00}, IsData: true}, {Data: []byte{0x81}, IsData: true}, op(0xbb)})
+	if got := short.Disasm(); got != "5 -1 OP_UNKNOWN" {
+		t.Fatalf("Disasm() = %q", got)
+	}
+	t.Logf("✓ Short pushes shown as numbers: %s", short)
+
+	// aliases, hex with a leading zero, and the largest 4-byte number
+	parsed, err := ParseAsm("OP_TRUE OP_FALSE OP_0 OP_5 OP_NOP2 01 2147483647")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScriptCommand{op(OP_1), op(OP_O), op(OP_O), op(OP_5), op(OP_CHECKLOCKTIMEVERIFY), {Data: []byte{0x01}, IsData: true}, num(2147483647)}
+	for i, cmd := range parsed.CommandStack {
+		if cmd.Opcode != want[i].Opcode || cmd.IsData != want[i].IsData || !bytes.Equal(cmd.Data, want[i].Data) {
+			t.Fatalf("command %d = %s, want %s", i, cmd, want[i])
+		}
+	}
+	t.Logf("✓ Aliases and edge numbers: %s", parsed)
+
+	for _, bad := range []string{"OP_DUP OP_FOO", "OP_UNKNOWN", "abc", "21474836480", "0xab"} {
+		if _, err := ParseAsm(bad); !errors.Is(err, ErrInvalidAsm) {
+			t.Fatalf("ParseAsm(%q) = %v, want %v", bad, err, ErrInvalidAsm)
+		}
+	}
+	t.Logf("✓ Malformed ASM rejected")
+}
@@ -0,0 +1,212 @@
+package script
+
+import "fmt"
+
+// ScriptKind is the kind of output a scriptPubKey is, as Bitcoin Core's solver sorts them
+type ScriptKind int
+
+const (
+	NONSTANDARD     ScriptKind = iota
+	P2PK                       // <pubkey> OP_CHECKSIG
+	P2PKH                      // OP_DUP OP_HASH160 <20 bytes> OP_EQUALVERIFY OP_CHECKSIG
+	P2SH                       // OP_HASH160 <20 bytes> OP_EQUAL
+	P2WPKH                     // OP_0 <20 bytes>
+	P2WSH                      // OP_0 <32 bytes>
+	P2TR                       // OP_1 <32 bytes>
+	MULTISIG                   // OP_m <pubkey>... OP_n OP_CHECKMULTISIG, bare
+	NULL_DATA                  // OP_RETURN followed only by pushes
+	WITNESS_UNKNOWN            // a witness program of a version or size with no rules yet
+)
+
+func (k ScriptKind) String() string {
+	switch k {
+	case P2PK:
+		return "P2PK"
+	case P2PKH:
+		return "P2PKH"
+	case P2SH:
+		return "P2SH"
+	case P2WPKH:
+		return "P2WPKH"
+	case P2WSH:
+		return "P2WSH"
+	case P2TR:
+		return "P2TR"
+	case MULTISIG:
+		return "multisig"
+	case NULL_DATA:
+		return "OP_RETURN"
+	case WITNESS_UNKNOWN:
+		return "witness program"
+	}
+	return "nonstandard"
+}
+
+// ScriptType is what Type makes of a script: its kind and what that kind carries
+type ScriptType struct {
+	Kind ScriptKind
+	// Program is the hash160 of a P2PKH or P2SH output, or the program of a witness
+	// output, whatever its version
+	Program        []byte
+	WitnessVersion int
+	// PubKeys are the keys of a P2PK or multisig output in script order, with a multisig
+	// output needing M signatures from its N keys
+	PubKeys [][]byte
+	M, N    int
+	// Data are the pushes after a NULL_DATA output's OP_RETURN
+	Data [][]byte
+}
+
+// IsWitness reports whether the script is a witness program, of any version
+func (t ScriptType) IsWitness() bool {
+	switch t.Kind {
+	case P2WPKH, P2WSH, P2TR, WITNESS_UNKNOWN:
+		return true
+	}
+	return false
+}
+
+// String names the kind, with a multisig output's M and N and an unknown witness
+// program's version
+func (t ScriptType) String() string {
+	switch t.Kind {
+	case MULTISIG:
+		return fmt.Sprintf("%d-of-%d multisig", t.M, t.N)
+	case WITNESS_UNKNOWN:
+		return fmt.Sprintf("witness v%d program", t.WitnessVersion)
+	}
+	return t.Kind.String()
+}
+
+// Type classifies the script as an output, the way Bitcoin Core's solver does, and
+// extracts the hash, program, keys or data of its kind. Templates must be pushed
+// directly, so a P2SH hash behind OP_PUSHDATA1 is NONSTANDARD, as it is to consensus.
+func (s *Script) Type() ScriptType {
+	cmds := s.CommandStack
+	switch {
+	case len(cmds) == 5 && isOp(cmds[0], OP_DUP) && isOp(cmds[1], OP_HASH160) && isDirectPush(cmds[2], 20) &&
+		isOp(cmds[3], OP_EQUALVERIFY) && isOp(cmds[4], OP_CHECKSIG):
+		return ScriptType{Kind: P2PKH, Program: cmds[2].Data}
+	case len(cmds) == 3 && isOp(cmds[0], OP_HASH160) && isDirectPush(cmds[1], 20) && isOp(cmds[2], OP_EQUAL):
+		return ScriptType{Kind: P2SH, Program: cmds[1].Data}
+	case len(cmds) == 2 && isOp(cmds[1], OP_CHECKSIG) && cmds[0].IsData && isPubKeySize(cmds[0].Data):
+		return ScriptType{Kind: P2PK, PubKeys: [][]byte{cmds[0].Data}}
+	}
+	if version, program, ok := witnessProgram(cmds); ok {
+		t := ScriptType{Kind: WITNESS_UNKNOWN, Program: program, WitnessVersion: version}
+		switch {
+		case version == 0 && len(program) == 20:
+			t.Kind = P2WPKH
+		case version == 0 && len(program) == 32:
+			t.Kind = P2WSH
+		case version == 0:
+			return ScriptType{} // version 0 programs come in only two sizes
+		case version == 1 && len(program) == 32:
+			t.Kind = P2TR
+		}
+		return t
+	}
+	if len(cmds) > 0 && isOp(cmds[0], OP_RETURN) {
+		t := ScriptType{Kind: NULL_DATA}
+		for _, cmd := range cmds[1:] {
+			n, small := smallInt(cmd)
+			switch {
+			case cmd.IsData:
+				t.Data = append(t.Data, cmd.Data)
+			case small:
+				t.Data = append(t.Data, EncodeNum(int64(n)))
+			case isOp(cmd, OP_1NEGATE):
+				t.Data = append(t.Data, EncodeNum(-1))
+			default:
+				return ScriptType{}
+			}
+		}
+		return t
+	}
+	if t, ok := multisig(cmds); ok {
+		return t
+	}
+	return ScriptType{}
+}
+
+// witnessProgram matches BIP 141's witness program: a version opcode, OP_0 to OP_16,
+// then a direct push of 2 to 40 bytes
+func witnessProgram(cmds []ScriptCommand) (int, []byte, bool) {
+	if len(cmds) != 2 {
+		return 0, nil, false
+	}
+	version, ok := smallInt(cmds[0])
+	if !ok {
+		return 0, nil, false
+	}
+	program := cmds[1]
+	if !program.IsData || len(program.Data) < 2 || len(program.Data) > 40 || !isDirectPush(program, len(program.Data)) {
+		return 0, nil, false
+	}
+	return version, program.Data, true
+}
+
+// IsWitnessProgram reports whether the script is a witness program of any version and
+// length, standard or not, as Bitcoin Core's IsWitnessProgram does
+func (s *Script) IsWitnessProgram() bool {
+	_, _, ok := witnessProgram(s.CommandStack)
+	return ok
+}
+
+func multisig(cmds []ScriptCommand) (ScriptType, bool) {
+	if len(cmds) < 4 || !isOp(cmds[len(cmds)-1], OP_CHECKMULTISIG) {
+		return ScriptType{}, false
+	}
+	m, okM := smallInt(cmds[0])
+	n, okN := smallInt(cmds[len(cmds)-2])
+	keys := cmds[1 : len(cmds)-2]
+	if !okM || !okN || m < 1 || n != len(keys) || m > n {
+		return ScriptType{}, false
+	}
+	t := ScriptType{Kind: MULTISIG, M: m, N: n}
+	for _, key := range keys {
+		if !key.IsData || !isPubKeySize(key.Data) {
+			return ScriptType{}, false
+		}
+		t.PubKeys = append(t.PubKeys, key.Data)
+	}
+	return t, true
+}
+
+func isOp(cmd ScriptCommand, opcode byte) bool {
+	return !cmd.IsData && cmd.Opcode == opcode
+}
+
+// isDirectPush reports whether cmd pushes n bytes with the opcode that is their length
+func isDirectPush(cmd ScriptCommand, n int) bool {
+	return cmd.IsData && len(cmd.Data) == n && n <= 75 && (cmd.pushOp == 0 || cmd.pushOp == byte(n))
+}
+
+// smallInt reads OP_0 and OP_1 to OP_16, counting an empty push as OP_0, which is how
+// it's serialized
+func smallInt(cmd ScriptCommand) (int, bool) {
+	switch {
+	case cmd.IsData:
+		return 0, len(cmd.Data) == 0
+	case cmd.Opcode == OP_O:
+		return 0, true
+	case cmd.Opcode >= OP_1 && cmd.Opcode <= OP_16:
+		return int(cmd.Opcode-OP_1) + 1, true
+	}
+	return 0, false
+}
+
+// isPubKeySize reports whether key has the length its prefix calls for: 33 bytes
+// compressed, 65 uncompressed or hybrid
+func isPubKeySize(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	switch key[0] {
+	case 0x02, 0x03:
+		return len(key) == 33
+	case 0x04, 0x06, 0x07:
+		return len(key) == 65
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package script
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestScriptType(t *testing.T) {
+	h20 := bytes.Repeat([]byte{0x11}, 20)
+	h32 := bytes.Repeat([]byte{0x22}, 32)
+	compressed := append([]byte{0x02}, bytes.Repeat([]byte{0x33}, 32)...)
+	uncompressed := append([]byte{0x04}, bytes.Repeat([]byte{0x44}, 64)...)
+	push := func(data []byte) ScriptCommand { return ScriptCommand{Data: data, IsData: true} }
+	mustAsm := func(asm string) Script {
+		s, err := ParseAsm(asm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		script  Script
+		want    ScriptKind
+		program []byte
+		str     string
+	}{
+		{"P2PKH", P2pkhScript(h20), P2PKH, h20, "P2PKH"},
+		{"P2SH", P2shScript(h20), P2SH, h20, "P2SH"},
+		{"P2WPKH", P2wpkhScript(h20), P2WPKH, h20, "P2WPKH"},
+		{"P2WSH", P2wshScript(h32), P2WSH, h32, "P2WSH"},
+		{"P2TR", P2trScript(h32), P2TR, h32, "P2TR"},
+		{"P2PK", NewScript([]ScriptCommand{push(uncompressed), op(OP_CHECKSIG)}), P2PK, nil, "P2PK"},
+		{"OP_RETURN", NullDataScript([]byte("hi")), NULL_DATA, nil, "OP_RETURN"},
+		{"bare OP_RETURN", NewScript([]ScriptCommand{op(OP_RETURN)}), NULL_DATA, nil, "OP_RETURN"},
+		{"witness v2", NewScript([]ScriptCommand{op(OP_2), push(h32)}), WITNESS_UNKNOWN, h32, "witness v2 program"},
+		{"witness v1, 20 bytes", NewScript([]ScriptCommand{op(OP_1), push(h20)}), WITNESS_UNKNOWN, h20, "witness v1 program"},
+		{"witness v0, 25 bytes", NewScript([]ScriptCommand{op(OP_O), push(make([]byte, 25))}), NONSTANDARD, nil, "nonstandard"},
+		{"witness program over 40 bytes", NewScript([]ScriptCommand{op(OP_1), push(make([]byte, 41))}), NONSTANDARD, nil, "nonstandard"},
+		{"P2SH hash behind PUSHDATA1", NewScript([]ScriptCommand{op(OP_HASH160), {Data: h20, IsData: true, pushOp: OP_PUSHDATA1}, op(OP_EQUAL)}), NONSTANDARD, nil, "nonstandard"},
+		{"P2PK with a bad key", NewScript([]ScriptCommand{push(uncompressed[:33]), op(OP_CHECKSIG)}), NONSTANDARD, nil, "nonstandard"},
+		{"OP_RETURN then an opcode", NewScript([]ScriptCommand{op(OP_RETURN), op(OP_DUP)}), NONSTANDARD, nil, "nonstandard"},
+		{"1-of-2 multisig", mustAsm("1 " + hex.EncodeToString(compressed) + " " + hex.EncodeToString(uncompressed) + " 2 OP_CHECKMULTISIG"), MULTISIG, nil, "1-of-2 multisig"},
+		{"3-of-2 multisig", mustAsm("3 " + hex.EncodeToString(compressed) + " " + hex.EncodeToString(compressed) + " 2 OP_CHECKMULTISIG"), NONSTANDARD, nil, "nonstandard"},
+		{"0-of-1 multisig", mustAsm("0 " + hex.EncodeToString(compressed) + " 1 OP_CHECKMULTISIG"), NONSTANDARD, nil, "nonstandard"},
+		{"multisig miscounted", mustAsm("1 " + hex.EncodeToString(compressed) + " 2 OP_CHECKMULTISIG"), NONSTANDARD, nil, "nonstandard"},
+		{"empty", NewScript(nil), NONSTANDARD, nil, "nonstandard"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ := tt.script.Type()
+			if typ.Kind != tt.want || !bytes.Equal(typ.Program, tt.program) || typ.String() != tt.str {
+				t.Fatalf("Type() = %s %x, want %s %x", typ, typ.Program, tt.str, tt.program)
+			}
+			t.Logf("✓ %s: %s", tt.script, typ)
+		})
+	}
+
+	// the parameters of each kind come out with it
+	multi := mustAsm("2 " + hex.EncodeToString(compressed) + " " + hex.EncodeToString(uncompressed) + " " + hex.EncodeToString(compressed) + " 3 OP_CHECKMULTISIG")
+	typ := multi.Type()
+	if typ.M != 2 || typ.N != 3 || len(typ.PubKeys) != 3 || !bytes.Equal(typ.PubKeys[1], uncompressed) {
+		t.Fatalf("multisig: %s with keys %x", typ, typ.PubKeys)
+	}
+	p2pk := NewScript([]ScriptCommand{push(compressed), op(OP_CHECKSIG)})
+	if typ := p2pk.Type(); len(typ.PubKeys) != 1 || !bytes.Equal(typ.PubKeys[0], compressed) {
+		t.Fatalf("P2PK keys %x", typ.PubKeys)
+	}
+	nullData := mustAsm("OP_RETURN 68656c6c6f 7 -1")
+	if typ := nullData.Type(); len(typ.Data) != 3 || string(typ.Data[0]) != "hello" || DecodeNum(typ.Data[1]) != 7 || DecodeNum(typ.Data[2]) != -1 {
+		t.Fatalf("null data %x", typ.Data)
+	}
+	p2tr := P2trScript(h32)
+	if typ := p2tr.Type(); typ.WitnessVersion != 1 || !typ.IsWitness() {
+		t.Fatalf("P2TR: version %d", typ.WitnessVersion)
+	}
+	t.Logf("✓ Keys, M and N, data pushes and witness versions extracted")
+}
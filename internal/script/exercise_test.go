@@ -24,12 +24,16 @@ func TestSimpleArithmeticScript(t *testing.T) {
 		t.Fatalf("Error parsing scriptPubKey: %v", err)
 	}
 
-	// Combine and evaluate
+	// Combine and evaluate, with OP_MUL turned back on as the book has it
 	combined := scriptSig.Combine(scriptPubKey)
-	result := combined.Evaluate([]byte{})
+	if result, _ := combined.Evaluate([]byte{}); result {
+		t.Errorf("Simple arithmetic script passed with OP_MUL disabled")
+	}
+	engine := NewScriptEngine(combined)
+	result, err := engine.WithFlags(CONSENSUS_SCRIPT_VERIFY_FLAGS | SCRIPT_ENABLE_OP_MUL).Execute([]byte{})
 
 	if !result {
-		t.Errorf("Simple arithmetic script failed, expected true")
+		t.Errorf("Simple arithmetic script failed, expected true: %v", err)
 	}
 }
 
@@ -53,7 +57,7 @@ func TestSHA1CollisionScriptWithIdenticalValues(t *testing.T) {
 	}
 
 	combined := scriptSig.Combine(scriptPubKey)
-	result := combined.Evaluate([]byte{})
+	result, _ := combined.Evaluate([]byte{})
 
 	if result {
 		t.Errorf("SHA-1 collision script with identical values should fail (x != y required)")
@@ -80,7 +84,7 @@ func TestSHA1CollisionScriptWithDifferentValues(t *testing.T) {
 	}
 
 	combined := scriptSig.Combine(scriptPubKey)
-	result := combined.Evaluate([]byte{})
+	result, _ := combined.Evaluate([]byte{})
 
 	if result {
 		t.Errorf("SHA-1 collision script with different values/hashes should fail (need actual collision)")
@@ -179,7 +183,7 @@ func TestSHA1CollisionScriptWithActualCollision(t *testing.T) {
 	}
 
 	combined := scriptSig.Combine(scriptPubKey)
-	result := combined.Evaluate([]byte{})
+	result, _ := combined.Evaluate([]byte{})
 
 	if !result {
 		t.Errorf("SHA-1 collision script with actual collision should pass!")
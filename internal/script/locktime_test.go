@@ -80,7 +80,7 @@ func TestOpCheckLocktimeVerify(t *testing.T) {
 			})
 
 			engine := NewScriptEngine(script)
-			result := engine.
+			result, _ := engine.
 				WithLocktime(tt.txLocktime).
 				WithSequence(tt.sequence).
 				Execute([]byte{})
@@ -107,7 +107,7 @@ func TestOpCheckLocktimeVerifyPreservesStack(t *testing.T) {
 	})
 
 	engine := NewScriptEngine(script)
-	result := engine.
+	result, _ := engine.
 		WithLocktime(150).
 		WithSequence(0xfffffffe).
 		Execute([]byte{})
@@ -207,7 +207,7 @@ func TestOpCheckSequenceVerify(t *testing.T) {
 			})
 
 			engine := NewScriptEngine(script)
-			result := engine.
+			result, _ := engine.
 				WithSequence(tt.sequence).
 				Execute([]byte{})
 
@@ -231,7 +231,7 @@ func TestOpCheckSequenceVerifyPreservesStack(t *testing.T) {
 	})
 
 	engine := NewScriptEngine(script)
-	result := engine.
+	result, _ := engine.
 		WithSequence(150).
 		Execute([]byte{})
 
@@ -258,7 +258,7 @@ func TestOpCheckSequenceVerifyPaymentChannel(t *testing.T) {
 
 	// Input with sequence >= 100 should succeed
 	engine := NewScriptEngine(script)
-	result := engine.
+	result, _ := engine.
 		WithSequence(150). // 150 blocks have passed
 		Execute([]byte{})
 
@@ -268,7 +268,7 @@ func TestOpCheckSequenceVerifyPaymentChannel(t *testing.T) {
 
 	// Input with sequence < 100 should fail
 	engine2 := NewScriptEngine(script)
-	result2 := engine2.
+	result2, _ := engine2.
 		WithSequence(50). // Only 50 blocks have passed
 		Execute([]byte{})
 
@@ -296,7 +296,7 @@ func TestOpCheckLocktimeVerifyInP2SH(t *testing.T) {
 
 	// Transaction with locktime >= 500000 should succeed
 	engine := NewScriptEngine(script)
-	result := engine.
+	result, _ := engine.
 		WithLocktime(600000).
 		WithSequence(0xfffffffe).
 		Execute([]byte{})
@@ -307,7 +307,7 @@ func TestOpCheckLocktimeVerifyInP2SH(t *testing.T) {
 
 	// Transaction with locktime < 500000 should fail
 	engine2 := NewScriptEngine(script)
-	result2 := engine2.
+	result2, _ := engine2.
 		WithLocktime(400000).
 		WithSequence(0xfffffffe).
 		Execute([]byte{})
@@ -3,6 +3,7 @@ package script
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"go-bitcoin/internal/address"
 	"go-bitcoin/internal/encoding"
@@ -13,6 +14,47 @@ type ScriptCommand struct {
 	Opcode byte
 	Data   []byte
 	IsData bool // true if data is set, false if it's an Opcode
+	pushOp byte // the opcode a parsed data element was pushed with, 0 if built in code
+}
+
+var ErrNonMinimalPush = errors.New("non-minimal push")
+
+// minimalPushOp is the opcode the shortest push of n bytes of data starts with
+func minimalPushOp(n int) byte {
+	switch {
+	case n <= 75:
+		return byte(n)
+	case n <= 0xff:
+		return OP_PUSHDATA1
+	case n <= 0xffff:
+		return OP_PUSHDATA2
+	}
+	return OP_PUSHDATA4
+}
+
+// IsMinimalPush reports whether a data element was pushed the shortest way, as
+// SCRIPT_VERIFY_MINIMALDATA requires: no OP_PUSHDATA where a shorter push fits, and
+// OP_0, OP_1 to OP_16 or OP_1NEGATE rather than a push of the number they stand for.
+// Opcodes are always minimal.
+func (c ScriptCommand) IsMinimalPush() bool {
+	if !c.IsData {
+		return true
+	}
+	if len(c.Data) == 1 && (c.Data[0] >= 1 && c.Data[0] <= 16 || c.Data[0] == 0x81) {
+		return false
+	}
+	// elements built in code are written minimally by RawBytes
+	return c.pushOp == 0 || c.pushOp == minimalPushOp(len(c.Data))
+}
+
+// pushOpcode is the opcode the element is written with: the one it was parsed with if
+// that can hold it, so a script serializes as it was read, the shortest otherwise
+func (c ScriptCommand) pushOpcode() byte {
+	switch n := len(c.Data); {
+	case c.pushOp == OP_PUSHDATA1 && n <= 0xff, c.pushOp == OP_PUSHDATA2 && n <= 0xffff, c.pushOp == OP_PUSHDATA4:
+		return c.pushOp
+	}
+	return minimalPushOp(len(c.Data))
 }
 
 type Script struct {
@@ -57,6 +99,7 @@ func ParseScript(r io.Reader) (Script, error) {
 			s.CommandStack = append(s.CommandStack, ScriptCommand{
 				Data:   buf,
 				IsData: true,
+				pushOp: currentByte,
 			})
 			count += uint64(n)
 		} else {
@@ -79,6 +122,7 @@ func ParseScript(r io.Reader) (Script, error) {
 				s.CommandStack = append(s.CommandStack, ScriptCommand{
 					Data:   buf,
 					IsData: true,
+					pushOp: OP_PUSHDATA1,
 				})
 				count += uint64(n + 1)
 			case OP_PUSHDATA2:
@@ -99,6 +143,7 @@ func ParseScript(r io.Reader) (Script, error) {
 				s.CommandStack = append(s.CommandStack, ScriptCommand{
 					Data:   buf,
 					IsData: true,
+					pushOp: OP_PUSHDATA2,
 				})
 				count += uint64(n + 2)
 			case OP_PUSHDATA4:
@@ -119,6 +164,7 @@ func ParseScript(r io.Reader) (Script, error) {
 				s.CommandStack = append(s.CommandStack, ScriptCommand{
 					Data:   buf,
 					IsData: true,
+					pushOp: OP_PUSHDATA4,
 				})
 				count += uint64(n + 4)
 			default:
@@ -136,6 +182,31 @@ func ParseScript(r io.Reader) (Script, error) {
 	return s, nil
 }
 
+// ParseRawScript parses script bytes that carry no length prefix, as found in a
+// scriptSig push, a witness or a PSBT field
+func ParseRawScript(raw []byte) (Script, error) {
+	length, err := encoding.EncodeVarInt(uint64(len(raw)))
+	if err != nil {
+		return Script{}, err
+	}
+	return ParseScript(bytes.NewReader(append(length, raw...)))
+}
+
+// ParseScriptStrict parses a script as ParseScript does, but fails with
+// ErrNonMinimalPush on any data element not pushed the shortest way
+func ParseScriptStrict(r io.Reader) (Script, error) {
+	s, err := ParseScript(r)
+	if err != nil {
+		return Script{}, err
+	}
+	for i, cmd := range s.CommandStack {
+		if !cmd.IsMinimalPush() {
+			return Script{}, fmt.Errorf("%w: element %d (%d bytes)", ErrNonMinimalPush, i, len(cmd.Data))
+		}
+	}
+	return s, nil
+}
+
 // ReadScriptBytes reads raw script bytes without parsing into commands
 // Used for BIP 158 filters when script may be malformed but we still need the bytes
 func ReadScriptBytes(r io.Reader) ([]byte, error) {
@@ -179,14 +250,14 @@ func (s *Script) RawBytes() ([]byte, error) {
 		if cmd.IsData {
 			dataLen := len(cmd.Data)
 
-			if dataLen <= 75 {
+			if op := cmd.pushOpcode(); op <= 75 {
 				if err := result.WriteByte(byte(dataLen)); err != nil {
 					return nil, err
 				}
 				if _, err := result.Write(cmd.Data); err != nil {
 					return nil, err
 				}
-			} else if dataLen <= 0xff {
+			} else if op == OP_PUSHDATA1 {
 				if err := result.WriteByte(OP_PUSHDATA1); err != nil {
 					return nil, err
 				}
@@ -196,7 +267,7 @@ func (s *Script) RawBytes() ([]byte, error) {
 				if _, err := result.Write(cmd.Data); err != nil {
 					return nil, err
 				}
-			} else if dataLen <= 0xffff {
+			} else if op == OP_PUSHDATA2 {
 				if err := result.WriteByte(OP_PUSHDATA2); err != nil {
 					return nil, err
 				}
@@ -243,13 +314,31 @@ func (s Script) Combine(scriptPubKey Script) Script {
 	}
 }
 
-func (s *Script) Evaluate(sighash []byte) bool {
+// FindAndDelete returns the script without the pushes of data written the shortest way,
+// which is how a legacy scriptCode loses the signatures checked against it. A push of
+// the same data written another way is kept, as Bitcoin Core matches bytes.
+func (s Script) FindAndDelete(data []byte) Script {
+	if len(data) == 0 {
+		return s
+	}
+	kept := make([]ScriptCommand, 0, len(s.CommandStack))
+	for _, cmd := range s.CommandStack {
+		if cmd.IsData && bytes.Equal(cmd.Data, data) && (cmd.pushOp == 0 || cmd.pushOp == minimalPushOp(len(data))) {
+			continue
+		}
+		kept = append(kept, cmd)
+	}
+	return NewScript(kept)
+}
+
+// Evaluate runs the script against sighash, returning why it failed as a *ScriptError
+func (s *Script) Evaluate(sighash []byte) (bool, error) {
 	engine := NewScriptEngine(*s)
 	return engine.Execute(sighash)
 }
 
 // EvaluateWithContext evaluates the script with full transaction context for BIP 65/112
-func (s *Script) EvaluateWithContext(sighash []byte, witness [][]byte, locktime, sequence uint32) bool {
+func (s *Script) EvaluateWithContext(sighash []byte, witness [][]byte, locktime, sequence uint32) (bool, error) {
 	engine := NewScriptEngine(*s)
 	return engine.
 		WithWitness(witness).
@@ -390,6 +479,29 @@ func P2wshScript(h256 []byte) Script {
 	return NewScript(cmds)
 }
 
+func P2trScript(outputKey []byte) Script {
+	// take a 32 byte x-only taproot output key and returns the p2tr ScriptPubKey
+	c1 := ScriptCommand{
+		Opcode: OP_1,
+		IsData: false,
+	}
+	c2 := ScriptCommand{
+		IsData: true,
+		Data:   outputKey,
+	}
+	cmds := []ScriptCommand{c1, c2}
+	return NewScript(cmds)
+}
+
+func NullDataScript(data []byte) Script {
+	// take arbitrary data and returns an unspendable OP_RETURN ScriptPubKey carrying it
+	cmds := []ScriptCommand{{Opcode: OP_RETURN}}
+	if len(data) > 0 {
+		cmds = append(cmds, ScriptCommand{IsData: true, Data: data})
+	}
+	return NewScript(cmds)
+}
+
 func P2pkhAddress(h160 []byte, testNet bool) string {
 	network := address.MAINNET
 	if testNet {
@@ -409,61 +521,58 @@ func P2shAddress(h160 []byte, testNet bool) string {
 }
 
 func (s *Script) AddressV2(network address.Network) (*address.Address, error) {
-	// check P2PKH pattern (add helper)
-	if s.IsP2pkhScriptPubKey() {
-		hash160 := s.CommandStack[2].Data
-		return address.FromHash160(hash160, address.P2PKH, network)
-	}
-
-	// check for p2sh pattern
-	if s.IsP2shScriptPubKey() {
-		hash160 := s.CommandStack[1].Data
-		return address.FromHash160(hash160, address.P2SH, network)
-	}
-
-	// check for p2wpkh pattern
-	if s.IsP2wpkhScriptPubKey() {
-		witnessProgram := s.CommandStack[1].Data
-		return address.FromWitnessProgram(0, witnessProgram, network)
-	}
-
-	// check for p2wsh pattern
-	if s.IsP2wshScriptPubKey() {
-		witnessProgram := s.CommandStack[1].Data
-		return address.FromWitnessProgram(0, witnessProgram, network)
-	}
+	t := s.Type()
+	switch t.Kind {
+	case P2PKH:
+		return address.FromHash160(t.Program, address.P2PKH, network)
+	case P2SH:
+		return address.FromHash160(t.Program, address.P2SH, network)
+	case P2WPKH, P2WSH, P2TR:
+		return address.FromWitnessProgram(byte(t.WitnessVersion), t.Program, network)
+	}
+	return nil, fmt.Errorf("unknown or unsupported script type: %s", t)
+}
 
-	return nil, fmt.Errorf("unknown or unsupported script type")
+// AddressScript returns the ScriptPubKey that pays to an address
+func AddressScript(a *address.Address) (Script, error) {
+	switch a.Type {
+	case address.P2PKH:
+		return P2pkhScript(a.Program), nil
+	case address.P2SH:
+		return P2shScript(a.Program), nil
+	case address.P2WPKH:
+		return P2wpkhScript(a.Program), nil
+	case address.P2WSH:
+		return P2wshScript(a.Program), nil
+	case address.P2TR:
+		return P2trScript(a.Program), nil
+	}
+	return Script{}, fmt.Errorf("unknown or unsupported address type: %d", a.Type)
 }
 
+// IsP2wpkhScriptPubKey and the checks below are shorthand for comparing Type's Kind
 func (s *Script) IsP2wpkhScriptPubKey() bool {
-	return len(s.CommandStack) == 2 &&
-		s.CommandStack[0].Opcode == OP_O &&
-		s.CommandStack[1].IsData &&
-		len(s.CommandStack[1].Data) == 20
+	return s.Type().Kind == P2WPKH
 }
 
 func (s *Script) IsP2wshScriptPubKey() bool {
-	return len(s.CommandStack) == 2 &&
-		s.CommandStack[0].Opcode == OP_O &&
-		s.CommandStack[1].IsData &&
-		len(s.CommandStack[1].Data) == 32
+	return s.Type().Kind == P2WSH
+}
+
+func (s *Script) IsP2trScriptPubKey() bool {
+	return s.Type().Kind == P2TR
+}
+
+// IsNullDataScriptPubKey reports whether the script is an OP_RETURN data carrier: OP_RETURN
+// followed only by pushes
+func (s *Script) IsNullDataScriptPubKey() bool {
+	return s.Type().Kind == NULL_DATA
 }
 
 func (s *Script) IsP2shScriptPubKey() bool {
-	return len(s.CommandStack) == 3 &&
-		s.CommandStack[0].Opcode == OP_HASH160 &&
-		s.CommandStack[1].IsData &&
-		len(s.CommandStack[1].Data) == 20 &&
-		s.CommandStack[2].Opcode == OP_EQUAL
+	return s.Type().Kind == P2SH
 }
 
 func (s *Script) IsP2pkhScriptPubKey() bool {
-	return len(s.CommandStack) == 5 &&
-		s.CommandStack[0].Opcode == OP_DUP &&
-		s.CommandStack[1].Opcode == OP_HASH160 &&
-		s.CommandStack[2].IsData &&
-		len(s.CommandStack[2].Data) == 20 &&
-		s.CommandStack[3].Opcode == OP_EQUALVERIFY &&
-		s.CommandStack[4].Opcode == OP_CHECKSIG
+	return s.Type().Kind == P2PKH
 }
@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"go-bitcoin/internal/eccmath"
 	"go-bitcoin/internal/encoding"
 	"go-bitcoin/internal/keys"
 	"math/big"
+	"slices"
+
+	"golang.org/x/crypto/ripemd160"
 )
 
 // Script Op Codes
@@ -17,6 +22,7 @@ const (
 	OP_PUSHDATA2 byte = 0x4d
 	OP_PUSHDATA4 byte = 0x4e
 	OP_1NEGATE   byte = 0x4f
+	OP_RESERVED  byte = 0x50
 	OP_1         byte = 0x51
 	OP_2         byte = 0x52
 	OP_3         byte = 0x53
@@ -35,50 +41,236 @@ const (
 	OP_16        byte = 0x60
 
 	// flow control
-	OP_IF     byte = 0x63
-	OP_NOTIF  byte = 0x64
-	OP_ELSE   byte = 0x67
-	OP_ENDIF  byte = 0x68
-	OP_VERIFY byte = 0x69
-	OP_RETURN byte = 0x6a
+	OP_NOP      byte = 0x61
+	OP_VER      byte = 0x62
+	OP_IF       byte = 0x63
+	OP_NOTIF    byte = 0x64
+	OP_VERIF    byte = 0x65
+	OP_VERNOTIF byte = 0x66
+	OP_ELSE     byte = 0x67
+	OP_ENDIF    byte = 0x68
+	OP_VERIFY   byte = 0x69
+	OP_RETURN   byte = 0x6a
 
 	// stack operations
 	OP_DUP          byte = 0x76
 	OP_DROP         byte = 0x75
 	OP_2DROP        byte = 0x6d
 	OP_2DUP         byte = 0x6e
+	OP_3DUP         byte = 0x6f
+	OP_2OVER        byte = 0x70
+	OP_2ROT         byte = 0x71
+	OP_2SWAP        byte = 0x72
+	OP_IFDUP        byte = 0x73
+	OP_DEPTH        byte = 0x74
+	OP_NIP          byte = 0x77
+	OP_OVER         byte = 0x78
+	OP_PICK         byte = 0x79
+	OP_ROLL         byte = 0x7a
+	OP_ROT          byte = 0x7b
 	OP_SWAP         byte = 0x7c
+	OP_TUCK         byte = 0x7d
 	OP_TOALSTACK    byte = 0x6b
 	OP_FROMALTSTACK byte = 0x6c
 
+	// splice
+	OP_CAT    byte = 0x7e // disabled
+	OP_SUBSTR byte = 0x7f // disabled
+	OP_LEFT   byte = 0x80 // disabled
+	OP_RIGHT  byte = 0x81 // disabled
+	OP_SIZE   byte = 0x82
+
+	// bitwise logic
+	OP_INVERT byte = 0x83 // disabled
+	OP_AND    byte = 0x84 // disabled
+	OP_OR     byte = 0x85 // disabled
+	OP_XOR    byte = 0x86 // disabled
+
 	// comparison
 	OP_EQUAL       byte = 0x87
 	OP_EQUALVERIFY byte = 0x88
+	OP_RESERVED1   byte = 0x89
+	OP_RESERVED2   byte = 0x8a
 
 	// logical
 	OP_NOT byte = 0x91
 
 	// arithmetic
-	OP_ADD byte = 0x93
-	OP_SUB byte = 0x94
-	OP_MUL byte = 0x95 // disabled
-	OP_DIV byte = 0x96 // disabled
+	OP_1ADD               byte = 0x8b
+	OP_1SUB               byte = 0x8c
+	OP_2MUL               byte = 0x8d // disabled
+	OP_2DIV               byte = 0x8e // disabled
+	OP_NEGATE             byte = 0x8f
+	OP_ABS                byte = 0x90
+	OP_0NOTEQUAL          byte = 0x92
+	OP_ADD                byte = 0x93
+	OP_SUB                byte = 0x94
+	OP_MUL                byte = 0x95 // disabled
+	OP_DIV                byte = 0x96 // disabled
+	OP_MOD                byte = 0x97 // disabled
+	OP_LSHIFT             byte = 0x98 // disabled
+	OP_RSHIFT             byte = 0x99 // disabled
+	OP_BOOLAND            byte = 0x9a
+	OP_BOOLOR             byte = 0x9b
+	OP_NUMEQUAL           byte = 0x9c
+	OP_NUMEQUALVERIFY     byte = 0x9d
+	OP_NUMNOTEQUAL        byte = 0x9e
+	OP_LESSTHAN           byte = 0x9f
+	OP_GREATERTHAN        byte = 0xa0
+	OP_LESSTHANOREQUAL    byte = 0xa1
+	OP_GREATERTHANOREQUAL byte = 0xa2
+	OP_MIN                byte = 0xa3
+	OP_MAX                byte = 0xa4
+	OP_WITHIN             byte = 0xa5
 
 	// crypto
-	OP_RIPEMD160      byte = 0xa6
-	OP_SHA1           byte = 0xa7
-	OP_SHA256         byte = 0xa8
-	OP_HASH160        byte = 0xa9
-	OP_HASH256        byte = 0xaa
-	OP_CHECKSIG       byte = 0xac
-	OP_CHECKSIGVERIFY byte = 0xad
-	OP_CHECKMULTISIG  byte = 0xae
+	OP_RIPEMD160           byte = 0xa6
+	OP_SHA1                byte = 0xa7
+	OP_SHA256              byte = 0xa8
+	OP_HASH160             byte = 0xa9
+	OP_HASH256             byte = 0xaa
+	OP_CODESEPARATOR       byte = 0xab
+	OP_CHECKSIG            byte = 0xac
+	OP_CHECKSIGVERIFY      byte = 0xad
+	OP_CHECKMULTISIG       byte = 0xae
+	OP_CHECKMULTISIGVERIFY byte = 0xaf
 
 	// locktime
 	OP_CHECKLOCKTIMEVERIFY byte = 0xb1
 	OP_CHECKSEQUENCEVERIFY byte = 0xb2
+
+	// expansion
+	OP_NOP1  byte = 0xb0
+	OP_NOP4  byte = 0xb3
+	OP_NOP5  byte = 0xb4
+	OP_NOP6  byte = 0xb5
+	OP_NOP7  byte = 0xb6
+	OP_NOP8  byte = 0xb7
+	OP_NOP9  byte = 0xb8
+	OP_NOP10 byte = 0xb9
+
+	// tapscript
+	OP_CHECKSIGADD byte = 0xba
+
+	OP_INVALIDOPCODE byte = 0xff
 )
 
+// VerifyFlags turn on script rules beyond the original ones, as Bitcoin Core's
+// SCRIPT_VERIFY_* flags do: the soft forks, so transactions can be checked under the
+// rules of the height they were mined at, and the stricter checks of relay policy
+type VerifyFlags uint32
+
+const (
+	SCRIPT_VERIFY_NULLDUMMY           VerifyFlags = 1 << iota // BIP 147: OP_CHECKMULTISIG's extra item must be empty
+	SCRIPT_VERIFY_MINIMALDATA                                 // pushes and numeric operands must be minimally encoded
+	SCRIPT_VERIFY_P2SH                                        // BIP 16: evaluate P2SH redeem scripts
+	SCRIPT_VERIFY_DERSIG                                      // BIP 66: signatures must be strict DER
+	SCRIPT_VERIFY_LOW_S                                       // BIP 146: signature S values must be in the lower half
+	SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY                         // BIP 65: OP_CHECKLOCKTIMEVERIFY, otherwise OP_NOP2
+	SCRIPT_VERIFY_CHECKSEQUENCEVERIFY                         // BIP 112: OP_CHECKSEQUENCEVERIFY, otherwise OP_NOP3
+	SCRIPT_VERIFY_WITNESS                                     // BIP 141: evaluate witness programs
+	SCRIPT_VERIFY_MINIMALIF                                   // OP_IF and OP_NOTIF take only an empty item or 0x01
+	SCRIPT_VERIFY_CLEANSTACK                                  // evaluation must leave exactly one item
+	SCRIPT_VERIFY_TAPROOT                                     // BIP 341: check taproot key path spends
+	SCRIPT_ENABLE_OP_MUL                                      // not consensus: run the disabled OP_MUL, for the book's exercises
+)
+
+const (
+	SCRIPT_VERIFY_NONE VerifyFlags = 0
+
+	// CONSENSUS_SCRIPT_VERIFY_FLAGS are the rules in force since taproot activated
+	CONSENSUS_SCRIPT_VERIFY_FLAGS = SCRIPT_VERIFY_P2SH | SCRIPT_VERIFY_DERSIG | SCRIPT_VERIFY_NULLDUMMY |
+		SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY | SCRIPT_VERIFY_CHECKSEQUENCEVERIFY | SCRIPT_VERIFY_WITNESS |
+		SCRIPT_VERIFY_TAPROOT
+
+	// STANDARD_SCRIPT_VERIFY_FLAGS add the checks Bitcoin Core's policy applies before
+	// relaying a transaction
+	STANDARD_SCRIPT_VERIFY_FLAGS = CONSENSUS_SCRIPT_VERIFY_FLAGS | SCRIPT_VERIFY_MINIMALDATA |
+		SCRIPT_VERIFY_LOW_S | SCRIPT_VERIFY_MINIMALIF | SCRIPT_VERIFY_CLEANSTACK
+)
+
+// Script execution limits
+const (
+	MAX_OPS_PER_SCRIPT       int = 201 // opcodes above OP_16, plus the keys of each multisig
+	MAX_PUBKEYS_PER_MULTISIG int = 20
+	MAX_STACK_SIZE           int = 1000 // items on the stack and altstack together
+	MAX_SCRIPT_ELEMENT_SIZE  int = 520  // bytes in a data push
+	MAX_SCRIPT_SIZE          int = 10_000
+)
+
+// Why a script failed, wrapped in a *ScriptError by Execute
+var (
+	ErrEvalFalse                 = errors.New("script evaluated to false")
+	ErrStackUnderflow            = errors.New("stack underflow")
+	ErrVerify                    = errors.New("verify failed")
+	ErrBadOpcode                 = errors.New("unknown or disabled opcode")
+	ErrOpReturn                  = errors.New("OP_RETURN executed")
+	ErrUnbalancedConditional     = errors.New("unbalanced conditional")
+	ErrOpCount                   = errors.New("too many opcodes")
+	ErrPubkeyCount               = errors.New("multisig public key count out of range")
+	ErrSigCount                  = errors.New("multisig signature count out of range")
+	ErrNumberOverflow            = errors.New("script number too long")
+	ErrNonMinimalNumber          = errors.New("non-minimally encoded script number")
+	ErrInvalidSignatureEncoding  = errors.New("invalid signature encoding")
+	ErrSigHighS                  = errors.New("signature S value not low")
+	ErrSigNullDummy              = errors.New("OP_CHECKMULTISIG dummy not empty")
+	ErrMinimalIf                 = errors.New("OP_IF condition not empty or 0x01")
+	ErrCleanStack                = errors.New("stack not clean after evaluation")
+	ErrUnsatisfiedLocktime       = errors.New("locktime requirement not satisfied")
+	ErrMalformedScript           = errors.New("malformed script")
+	ErrSigPushOnly               = errors.New("P2SH scriptSig not push only")
+	ErrWitnessProgramMismatch    = errors.New("witness program mismatch")
+	ErrWitnessProgramWrongLength = errors.New("witness v0 program of the wrong length")
+	ErrWitnessMalleated          = errors.New("scriptSig malleates a witness spend")
+	ErrWitnessUnexpected         = errors.New("witness given for a spend that isn't segwit")
+	ErrStackSize                 = errors.New("stack size limit exceeded")
+	ErrPushSize                  = errors.New("push over MAX_SCRIPT_ELEMENT_SIZE bytes")
+	ErrScriptSize                = errors.New("script over MAX_SCRIPT_SIZE bytes")
+	ErrPubkeyType                = errors.New("unsupported public key type")
+	ErrSchnorrSigSize            = errors.New("invalid schnorr signature size")
+	ErrSchnorrSigHashType        = errors.New("invalid schnorr signature hash type")
+	ErrSchnorrSig                = errors.New("invalid schnorr signature")
+	ErrTapscriptCheckMultiSig    = errors.New("OP_CHECKMULTISIG is disabled in tapscript")
+	ErrTapscriptValidationWeight = errors.New("tapscript sigops exceed the witness's validation weight")
+)
+
+// ScriptError is a failed evaluation: the error, and the index of the command it
+// failed at among those run, which grow as P2SH and witness scripts are added. Checks on
+// the final state fail at the index past the last command.
+type ScriptError struct {
+	PC  int
+	Err error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("script failed at command %d: %v", e.PC, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// EngineState is a snapshot of a running engine for tracing and stepping through
+// scripts: the index of the next command, and the stacks with their bottom item first
+type EngineState struct {
+	PC        int
+	Stack     [][]byte
+	AltStack  [][]byte
+	Executing bool // false inside an OP_IF branch that's being skipped
+}
+
+// TraceFunc is called after each command the engine runs, with the command and the
+// state it left the engine in
+type TraceFunc func(cmd ScriptCommand, state EngineState)
+
+// MAX_SCRIPT_NUM_SIZE is the longest number, in bytes, numeric opcodes accept as input.
+// Their results can be longer, but then can't be used as numbers again.
+const MAX_SCRIPT_NUM_SIZE int = 4
+
+// MAX_LOCKTIME_NUM_SIZE is the longest operand OP_CHECKLOCKTIMEVERIFY and
+// OP_CHECKSEQUENCEVERIFY accept, so it can hold any uint32 locktime or sequence
+const MAX_LOCKTIME_NUM_SIZE int = 5
+
 type ScriptEngine struct {
 	stack    []ScriptCommand
 	altstack []ScriptCommand
@@ -86,19 +278,87 @@ type ScriptEngine struct {
 	pc       int
 	z        []byte
 	witness  [][]byte
+	// sigHasher, if set, computes the hash each signature commits to, and witnessSigHasher
+	// if set, the hash for signatures in a version 0 witness script
+	sigHasher        SigHasher
+	witnessSigHasher SigHasher
+	// scripts are run in turn, each from where it begins in commands: the scriptSig, the
+	// scriptPubKey, and the redeem and witness scripts as they're added. script is the
+	// index of the one running.
+	scripts []engineScript
+	script  int
+	// scriptSigStack is the stack the scriptSig left, which a P2SH redeem script runs on
+	scriptSigStack []ScriptCommand
+	// codeSep is the command after the last OP_CODESEPARATOR executed
+	codeSep int
+	// hadWitness is set once a witness program is spent, and witnessV0 once a version 0
+	// witness script runs, whose scriptCode keeps any signatures it holds
+	hadWitness bool
+	witnessV0  bool
 	// BIP 65/112 context
 	locktime uint32
 	sequence uint32
+	flags    VerifyFlags
+	// cond holds whether each open OP_IF branch runs
+	cond    []bool
+	opCount int
+	// err is why the last operation failed
+	err   error
+	trace TraceFunc
+	// done is set once the script has finished, with result its outcome
+	done   bool
+	result error
+	// tapscript is set for a BIP 342 script, whose signatures commit to the hashes
+	// tapSigHasher gives, with budget the validation weight left for its sigops
+	tapscript    bool
+	tapSigHasher TapSigHasher
+	budget       int
+	codeSepPos   uint32
 }
 
+// scriptKind is the part a script plays in spending an output
+type scriptKind int
+
+const (
+	kindScriptSig scriptKind = iota
+	kindScriptPubKey
+	kindRedeemScript
+	kindWitnessScript
+)
+
+// engineScript is one of the scripts an engine runs: what it is, and the index of its
+// first command in commands
+type engineScript struct {
+	kind  scriptKind
+	start int
+}
+
+// SigHasher computes the hash a signature commits to from its sighash type and the
+// scriptCode: the script being run from just after its last OP_CODESEPARATOR, without
+// the signatures being checked if it's a legacy script
+type SigHasher func(hashType uint32, scriptCode Script) ([]byte, error)
+
+// NewScriptEngine returns an engine for script under CONSENSUS_SCRIPT_VERIFY_FLAGS
 func NewScriptEngine(script Script) ScriptEngine {
 	return ScriptEngine{
 		stack:    []ScriptCommand{},
 		commands: script.CommandStack,
 		pc:       0,
+		flags:    CONSENSUS_SCRIPT_VERIFY_FLAGS,
+		scripts:  []engineScript{{kind: kindScriptPubKey}},
 	}
 }
 
+// WithScriptSig runs scriptSig ahead of the script as a script of its own, as validation
+// does: only its stack carries over, and a signature in either commits to a scriptCode
+// that ends at the boundary between them. Under SCRIPT_VERIFY_P2SH a P2SH script then
+// runs the redeem script scriptSig pushes last on the rest of the stack it left.
+func (se *ScriptEngine) WithScriptSig(scriptSig Script) *ScriptEngine {
+	se.commands = append(slices.Clone(scriptSig.CommandStack), se.commands...)
+	se.scripts = []engineScript{{kind: kindScriptSig}, {kind: kindScriptPubKey, start: len(scriptSig.CommandStack)}}
+	return se
+}
+
 // WithLocktime sets the transaction locktime for OP_CHECKLOCKTIMEVERIFY (BIP 65)
 func (se *ScriptEngine) WithLocktime(locktime uint32) *ScriptEngine {
 	se.locktime = locktime
@@ -117,8 +377,61 @@ func (se *ScriptEngine) WithWitness(witness [][]byte) *ScriptEngine {
 	return se
 }
 
+// WithSigHasher sets the function OP_CHECKSIG and OP_CHECKMULTISIG use to hash the
+// transaction for each signature's sighash type and scriptCode, instead of the fixed
+// sighash passed to Execute
+func (se *ScriptEngine) WithSigHasher(sigHasher SigHasher) *ScriptEngine {
+	se.sigHasher = sigHasher
+	return se
+}
+
+// WithWitnessSigHasher sets the function used in place of the sigHasher for signatures
+// in a version 0 witness script, which BIP 143 hashes differently
+func (se *ScriptEngine) WithWitnessSigHasher(sigHasher SigHasher) *ScriptEngine {
+	se.witnessSigHasher = sigHasher
+	return se
+}
+
+// WithTrace sets a function called after every command runs, data pushes and the
+// command that fails included
+func (se *ScriptEngine) WithTrace(trace TraceFunc) *ScriptEngine {
+	se.trace = trace
+	return se
+}
+
+// WithSighash sets the sighash signatures are checked against when no sigHasher is set,
+// as Execute's z does, for stepping through a script with Step
+func (se *ScriptEngine) WithSighash(z []byte) *ScriptEngine {
+	se.z = z
+	return se
+}
+
+// WithFlags replaces the rules the script is held to
+func (se *ScriptEngine) WithFlags(flags VerifyFlags) *ScriptEngine {
+	se.flags = flags
+	return se
+}
+
+// fail records err as the reason the running operation failed, unless one is already
+// recorded, and returns false
+func (se *ScriptEngine) fail(err error) bool {
+	if se.err == nil {
+		se.err = err
+	}
+	return false
+}
+
+// need reports whether the stack holds at least n items, failing with ErrStackUnderflow
+// if not
+func (se *ScriptEngine) need(n int) bool {
+	if len(se.stack) < n {
+		return se.fail(ErrStackUnderflow)
+	}
+	return true
+}
+
 func (se *ScriptEngine) pop() (ScriptCommand, bool) {
-	if len(se.stack) < 1 {
+	if !se.need(1) {
 		return ScriptCommand{}, false
 	}
 	top := se.stack[len(se.stack)-1]
@@ -127,7 +440,7 @@ func (se *ScriptEngine) pop() (ScriptCommand, bool) {
 }
 
 func (se *ScriptEngine) peek() (ScriptCommand, bool) {
-	if len(se.stack) < 1 {
+	if !se.need(1) {
 		return ScriptCommand{}, false
 	}
 	top := se.stack[len(se.stack)-1]
@@ -156,40 +469,122 @@ func IsP2wsh(pair []ScriptCommand) bool {
 		len(pair[1].Data) == 32
 }
 
-func (se *ScriptEngine) P2sh(redeemScript, hash ScriptCommand) bool {
-	// we know first command is OP_HASH160
-	ok := se.OpHash160()
-	if !ok {
-		return false
+// addScript appends a script for the engine to run once those before it finish
+func (se *ScriptEngine) addScript(kind scriptKind, script Script) {
+	se.scripts = append(se.scripts, engineScript{kind: kind, start: len(se.commands)})
+	se.commands = append(se.commands, script.CommandStack...)
+}
+
+// scriptEnd is the index in commands just past the running script
+func (se *ScriptEngine) scriptEnd() int {
+	if se.script+1 < len(se.scripts) {
+		return se.scripts[se.script+1].start
 	}
+	return len(se.commands)
+}
 
-	se.push(hash) // hash from the cmd stack
+// endScript finishes the running script. The stack a scriptSig leaves is saved, a P2SH
+// scriptPubKey that succeeded is followed by its redeem script, and a witness program,
+// as the scriptPubKey or the redeem script, by the witness.
+func (se *ScriptEngine) endScript() bool {
+	if len(se.cond) != 0 {
+		return se.fail(ErrUnbalancedConditional)
+	}
+	running := se.scripts[se.script]
+	code := NewScript(se.commands[running.start:se.pc])
+	switch running.kind {
+	case kindScriptSig:
+		se.scriptSigStack = slices.Clone(se.stack)
+	case kindScriptPubKey:
+		if se.flags&SCRIPT_VERIFY_P2SH != 0 && !se.tapscript && code.IsP2shScriptPubKey() {
+			return se.p2sh()
+		}
+		if version, program, ok := witnessProgram(code.CommandStack); ok && se.flags&SCRIPT_VERIFY_WITNESS != 0 && !se.tapscript {
+			// a native witness spend leaves the scriptSig empty
+			if len(se.scriptSig().CommandStack) != 0 {
+				return se.fail(ErrWitnessMalleated)
+			}
+			return se.spendWitnessProgram(version, program)
+		}
+	case kindRedeemScript:
+		if version, program, ok := witnessProgram(code.CommandStack); ok && se.flags&SCRIPT_VERIFY_WITNESS != 0 {
+			// a wrapped one has the scriptSig push the redeem script and nothing else
+			if cmds := se.scriptSig().CommandStack; len(cmds) != 1 || !cmds[0].IsMinimalPush() {
+				return se.fail(ErrWitnessMalleated)
+			}
+			return se.spendWitnessProgram(version, program)
+		}
+	}
+	return true
+}
 
-	// the next command will be OP_EQUAL -- I used OP_EQUALVERIFY to knock out the final check of 0/1
-	ok = se.OpEqualVerify()
-	if !ok {
+// scriptSig is the scriptSig the engine runs, empty if there isn't one
+func (se *ScriptEngine) scriptSig() Script {
+	if se.scripts[0].kind != kindScriptSig {
+		return Script{}
+	}
+	return NewScript(se.commands[:se.scripts[1].start])
+}
+
+// succeeded reports whether the script that just ran left true on top of the stack,
+// failing with ErrEvalFalse if not
+func (se *ScriptEngine) succeeded() bool {
+	if len(se.stack) == 0 || isAllZeros(se.stack[len(se.stack)-1].Data) {
+		return se.fail(ErrEvalFalse)
+	}
+	return true
+}
+
+// p2sh runs a P2SH redeem script as BIP 16 has it: once the scriptPubKey has checked its
+// hash, the scriptSig, which may only push data, is taken to have pushed the serialized
+// redeem script last, and the script runs on the stack the scriptSig left beneath it
+func (se *ScriptEngine) p2sh() bool {
+	if !se.succeeded() {
 		return false
 	}
-	// Prepend varint length before parsing
-	redeemScriptData := redeemScript.Data
-	length, err := encoding.EncodeVarInt(uint64(len(redeemScriptData)))
-	if err != nil {
+	if scriptSig := se.scriptSig(); !scriptSig.IsPushOnly() {
+		return se.fail(ErrSigPushOnly)
+	}
+	se.stack = se.scriptSigStack
+	serialized, ok := se.pop()
+	if !ok {
 		return false
 	}
-	scriptWithLength := append(length, redeemScriptData...)
-	parsedRs, err := ParseScript(bytes.NewBuffer(scriptWithLength)) // do I need to prepend the length?
+	redeemScript, err := ParseRawScript(serialized.Data)
 	if err != nil {
-		return false
+		return se.fail(fmt.Errorf("%w: redeem script: %v", ErrMalformedScript, err))
 	}
-
-	se.commands = append(se.commands, parsedRs.CommandStack...)
-
+	se.addScript(kindRedeemScript, redeemScript)
 	return true
 }
 
+// spendWitnessProgram spends the witness program the script that just ran succeeded
+// with, as BIP 141 has it: a version 0 program runs the witness as P2WPKH or P2WSH on a
+// stack of the witness alone. Later versions are left to soft forks, and succeed here;
+// taproot is verified outside the engine, by the transaction.
+func (se *ScriptEngine) spendWitnessProgram(version int, program []byte) bool {
+	if !se.succeeded() {
+		return false
+	}
+	se.hadWitness = true
+	if version != 0 {
+		// the version is kept as the single true item, so the stack is clean
+		se.stack = se.stack[:1]
+		return true
+	}
+	se.stack = nil
+	switch len(program) {
+	case 20:
+		return se.P2wpkh(ScriptCommand{Data: program, IsData: true})
+	case 32:
+		return se.P2wsh(ScriptCommand{Data: program, IsData: true})
+	}
+	return se.fail(ErrWitnessProgramWrongLength)
+}
+
 func (se *ScriptEngine) P2wsh(hash256 ScriptCommand) bool {
 	if len(se.witness) == 0 {
-		return false
+		return se.fail(ErrWitnessProgramMismatch)
 	}
 
 	// Last witness item is the witnessScript
@@ -198,8 +593,14 @@ func (se *ScriptEngine) P2wsh(hash256 ScriptCommand) bool {
 	// Validate: SHA256(witnessScript) == hash256
 	actualHash := sha256.Sum256(witnessScript)
 	if !bytes.Equal(actualHash[:], hash256.Data) {
+		return se.fail(ErrWitnessProgramMismatch)
+	}
+	if !se.checkWitnessItems(se.witness[:len(se.witness)-1]) {
 		return false
 	}
+	if len(witnessScript) > MAX_SCRIPT_SIZE {
+		return se.fail(fmt.Errorf("%w: witness script of %d", ErrScriptSize, len(witnessScript)))
+	}
 
 	// Push all witness items except last onto stack
 	for i := 0; i < len(se.witness)-1; i++ {
@@ -209,22 +610,26 @@ func (se *ScriptEngine) P2wsh(hash256 ScriptCommand) bool {
 	// Parse witnessScript and inject commands
 	length, err := encoding.EncodeVarInt(uint64(len(witnessScript)))
 	if err != nil {
-		return false
+		return se.fail(ErrMalformedScript)
 	}
 	scriptBytes := append(length, witnessScript...)
 	parsedWitnessScript, err := ParseScript(bytes.NewReader(scriptBytes))
 	if err != nil {
-		return false
+		return se.fail(fmt.Errorf("%w: witness script: %v", ErrMalformedScript, err))
 	}
 
 	// Inject witnessScript commands into execution
-	se.commands = append(se.commands, parsedWitnessScript.CommandStack...)
+	se.addScript(kindWitnessScript, parsedWitnessScript)
+	se.witnessV0 = true
 
 	return true
 }
 
 func (se *ScriptEngine) P2wpkh(hash160 ScriptCommand) bool {
 	if len(se.witness) != 2 {
+		return se.fail(ErrWitnessProgramMismatch)
+	}
+	if !se.checkWitnessItems(se.witness) {
 		return false
 	}
 
@@ -233,76 +638,208 @@ func (se *ScriptEngine) P2wpkh(hash160 ScriptCommand) bool {
 	se.pushData(se.witness[1]) // pubkey
 
 	// Create and inject P2PKH script commands
-	p2pkhScript := P2pkhScript(hash160.Data)
-	se.commands = append(se.commands, p2pkhScript.CommandStack...)
+	se.addScript(kindWitnessScript, P2pkhScript(hash160.Data))
+	se.witnessV0 = true
 
 	return true
 }
 
-// execute the entire script
-func (se *ScriptEngine) Execute(z []byte) bool {
-	se.z = z
+// checkWitnessItems fails a version 0 witness stack holding an item over
+// MAX_SCRIPT_ELEMENT_SIZE bytes, as BIP 141 does
+func (se *ScriptEngine) checkWitnessItems(items [][]byte) bool {
+	for i, item := range items {
+		if len(item) > MAX_SCRIPT_ELEMENT_SIZE {
+			return se.fail(fmt.Errorf("%w: witness item %d of %d", ErrPushSize, i, len(item)))
+		}
+	}
+	return true
+}
 
-	for se.pc < len(se.commands) {
-		cmd := se.commands[se.pc]
-		se.pc++
+// Execute runs the script, with z the sighash signatures are checked against when no
+// sigHasher is set. A failure is returned as a *ScriptError wrapping one of the Err
+// values above.
+func (se *ScriptEngine) Execute(z []byte) (bool, error) {
+	se.z = z
+	for {
+		if done, err := se.Step(); done {
+			return err == nil, err
+		}
+	}
+}
 
-		if se.pc+2 <= len(se.commands) && IsP2sh(se.commands[se.pc-1:se.pc+2]) {
-			// look for BIP0016 sequence of commands
-			redeemScript, ok := se.peek() // copy the redeemScript for later use
-			if !ok {
-				return false
-			}
-			hash := se.commands[se.pc]
-			if !se.P2sh(redeemScript, hash) {
-				return false
-			}
-			se.pc += 2 // already advanced it 1 earlier
-			continue
+// Step runs the next command, or once every command has run, the final checks on the
+// stack. It returns done when the script has finished, with a nil error if it succeeded
+// and a *ScriptError if not; Step then keeps returning that result. P2SH and witness
+// scripts are stepped through as they're added.
+func (se *ScriptEngine) Step() (done bool, err error) {
+	if se.done {
+		return true, se.result
+	}
+	if se.pc == 0 && se.script == 0 && !se.checkScriptSize() {
+		return se.finish(se.failure(se.pc))
+	}
+	for se.pc == se.scriptEnd() {
+		if !se.endScript() {
+			return se.finish(se.failure(se.pc))
 		}
-		if cmd.IsData {
-			// data elements just get pushed
-			se.push(cmd)
-		} else {
-			// OpCodes get executed
-			if !se.ExecuteCommand(cmd) {
-				return false // opcode failed
+		if se.script == len(se.scripts)-1 {
+			// script succeeds if top of stack is non-zero
+			if !se.verifyFinalStack() {
+				return se.finish(se.failure(se.pc))
 			}
+			return se.finish(nil)
+		}
+		// each script has its own altstack and opcode limit
+		se.script++
+		se.altstack = nil
+		se.opCount = 0
+		if !se.checkScriptSize() {
+			return se.finish(se.failure(se.pc))
 		}
+	}
 
-		// after execution, check stack for witness programs
-		if len(se.stack) == 2 &&
-			len(se.stack[0].Data) == 0 && // OP_O pushes empty bytes
-			len(se.stack[1].Data) == 20 { // P2WPKH
-			hash160, _ := se.pop()
-			se.pop() // remove OP_O
-			if !se.P2wpkh(hash160) {
-				return false
-			}
-			continue
+	cmd := se.commands[se.pc]
+	se.pc++
+	ok := se.step(cmd)
+	if se.trace != nil {
+		se.trace(cmd, se.State())
+	}
+	if !ok {
+		return se.finish(se.failure(se.pc - 1))
+	}
+	return false, nil
+}
+
+// checkScriptSize fails a script about to run that is over MAX_SCRIPT_SIZE bytes
+// serialized, as every script but a tapscript must be
+func (se *ScriptEngine) checkScriptSize() bool {
+	if se.tapscript {
+		return true
+	}
+	code := NewScript(se.commands[se.scripts[se.script].start:se.scriptEnd()])
+	raw, err := code.RawBytes()
+	if err != nil {
+		return se.fail(fmt.Errorf("%w: %v", ErrMalformedScript, err))
+	}
+	if len(raw) > MAX_SCRIPT_SIZE {
+		return se.fail(fmt.Errorf("%w: %d", ErrScriptSize, len(raw)))
+	}
+	return true
+}
+
+func (se *ScriptEngine) finish(result error) (bool, error) {
+	se.done, se.result = true, result
+	return true, result
+}
+
+// State returns a copy of the engine's current state
+func (se *ScriptEngine) State() EngineState {
+	items := func(stack []ScriptCommand) [][]byte {
+		out := make([][]byte, len(stack))
+		for i, item := range stack {
+			out[i] = bytes.Clone(item.Data)
 		}
-		if len(se.stack) == 2 &&
-			len(se.stack[0].Data) == 0 &&
-			len(se.stack[1].Data) == 32 { // P2WSH
-			hash256, _ := se.pop() // add error handling
-			se.pop()               // remove OP_O
-			if !se.P2wsh(hash256) {
-				return false
-			}
-			continue
+		return out
+	}
+	return EngineState{
+		PC:        se.pc,
+		Stack:     items(se.stack),
+		AltStack:  items(se.altstack),
+		Executing: se.executing(),
+	}
+}
+
+// failure wraps the recorded reason for a failure at pc in a *ScriptError
+func (se *ScriptEngine) failure(pc int) error {
+	err := se.err
+	if err == nil {
+		err = ErrBadOpcode
+	}
+	return &ScriptError{PC: pc, Err: err}
+}
+
+// step runs a command: data is pushed and opcodes executed. Inside a branch that isn't
+// running, as in Bitcoin Core's interpreter, pushes over MAX_SCRIPT_ELEMENT_SIZE still
+// fail, opcodes still count toward the limit and disabled ones still fail, but only the
+// conditionals run.
+func (se *ScriptEngine) step(cmd ScriptCommand) bool {
+	if cmd.IsData && len(cmd.Data) > MAX_SCRIPT_ELEMENT_SIZE {
+		return se.fail(fmt.Errorf("%w: %d", ErrPushSize, len(cmd.Data)))
+	}
+	if !cmd.IsData && cmd.Opcode > OP_16 && !se.tapscript {
+		if se.opCount++; se.opCount > MAX_OPS_PER_SCRIPT {
+			return se.fail(ErrOpCount)
+		}
+	}
+	if !se.executing() {
+		switch {
+		case cmd.IsData:
+			return true
+		case se.disabled(cmd.Opcode):
+			return se.fail(ErrBadOpcode)
+		case !isConditional(cmd.Opcode):
+			return true
 		}
 	}
 
-	// script succeeds if top of stack is non-zero
-	return se.verifyFinalStack()
+	if cmd.IsData {
+		// data elements just get pushed
+		if se.flags&SCRIPT_VERIFY_MINIMALDATA != 0 && !cmd.IsMinimalPush() {
+			return se.fail(ErrNonMinimalPush)
+		}
+		se.push(cmd)
+	} else if !se.ExecuteCommand(cmd) {
+		return false // opcode failed
+	}
+	if len(se.stack)+len(se.altstack) > MAX_STACK_SIZE {
+		return se.fail(ErrStackSize)
+	}
+	return true
 }
 
+// executing reports whether every open OP_IF branch runs
+func (se *ScriptEngine) executing() bool {
+	return !slices.Contains(se.cond, false)
+}
+
+// isConditional reports whether opcode is one of those from OP_IF to OP_ENDIF, which run
+// even in a branch that's being skipped. OP_VERIF and OP_VERNOTIF are among them, so
+// they fail wherever they appear.
+func isConditional(opcode byte) bool {
+	return opcode >= OP_IF && opcode <= OP_ENDIF
+}
+
+// disabled reports whether opcode is one disabled since 2010, which fail a script even
+// in a branch that's being skipped. OP_MUL runs only under SCRIPT_ENABLE_OP_MUL, which no
+// consensus or policy flag set includes.
+func (se *ScriptEngine) disabled(opcode byte) bool {
+	switch opcode {
+	case OP_MUL:
+		return se.flags&SCRIPT_ENABLE_OP_MUL == 0
+	case OP_CAT, OP_SUBSTR, OP_LEFT, OP_RIGHT, OP_INVERT, OP_AND, OP_OR, OP_XOR,
+		OP_2MUL, OP_2DIV, OP_DIV, OP_MOD, OP_LSHIFT, OP_RSHIFT:
+		return true
+	}
+	return false
+}
+
+// verifyFinalStack checks the stack a finished script leaves, without changing it, and
+// that any witness was spent by a witness program
 func (se *ScriptEngine) verifyFinalStack() bool {
-	top, ok := se.pop()
-	if !ok {
-		return false
+	if se.flags&SCRIPT_VERIFY_WITNESS != 0 && !se.tapscript && !se.hadWitness && len(se.witness) != 0 {
+		return se.fail(ErrWitnessUnexpected)
+	}
+	if len(se.stack) == 0 {
+		return se.fail(ErrEvalFalse)
+	}
+	// a witness script must leave exactly one item, whatever the flags
+	if (se.flags&SCRIPT_VERIFY_CLEANSTACK != 0 || se.tapscript || se.witnessV0) && len(se.stack) != 1 {
+		return se.fail(ErrCleanStack)
 	}
-	return !isAllZeros(top.Data)
+	if isAllZeros(se.stack[len(se.stack)-1].Data) {
+		return se.fail(ErrEvalFalse)
+	}
+	return true
 }
 
 func isAllZeros(data []byte) bool {
@@ -324,18 +861,62 @@ func (se *ScriptEngine) ExecuteCommand(cmd ScriptCommand) bool {
 		return se.OpDup()
 	case OP_2DUP:
 		return se.Op2Dup()
+	case OP_1NEGATE:
+		se.pushData(EncodeNum(-1))
+		return true
 	case OP_1, OP_2, OP_3, OP_4, OP_5, OP_6, OP_7, OP_8, OP_9, OP_10, OP_11, OP_12, OP_13, OP_14, OP_15, OP_16:
 		num := int64(cmd.Opcode - 0x50)
 		se.pushData(EncodeNum(num))
 		return true
+	case OP_3DUP:
+		return se.Op3Dup()
+	case OP_2OVER:
+		return se.Op2Over()
+	case OP_2ROT:
+		return se.Op2Rot()
+	case OP_2SWAP:
+		return se.Op2Swap()
+	case OP_IFDUP:
+		return se.OpIfDup()
+	case OP_DEPTH:
+		se.pushData(EncodeNum(int64(len(se.stack))))
+		return true
+	case OP_NIP:
+		return se.OpNip()
+	case OP_OVER:
+		return se.OpOver()
+	case OP_PICK:
+		return se.OpPick()
+	case OP_ROLL:
+		return se.OpRoll()
+	case OP_ROT:
+		return se.OpRot()
+	case OP_TUCK:
+		return se.OpTuck()
+	case OP_SIZE:
+		return se.OpSize()
+	case OP_1ADD, OP_1SUB, OP_NEGATE, OP_ABS, OP_0NOTEQUAL:
+		return se.opUnaryNum(cmd.Opcode)
+	case OP_BOOLAND, OP_BOOLOR, OP_NUMEQUAL, OP_NUMEQUALVERIFY, OP_NUMNOTEQUAL, OP_LESSTHAN,
+		OP_GREATERTHAN, OP_LESSTHANOREQUAL, OP_GREATERTHANOREQUAL, OP_MIN, OP_MAX:
+		return se.opBinaryNum(cmd.Opcode)
+	case OP_WITHIN:
+		return se.OpWithin()
 	case OP_ADD:
 		return se.OpAdd()
 	case OP_SUB:
 		return se.OpSub()
 	case OP_MUL:
+		if se.disabled(OP_MUL) {
+			return se.fail(ErrBadOpcode)
+		}
 		return se.OpMul()
+	case OP_RIPEMD160:
+		return se.OpRipemd160()
 	case OP_SHA1:
 		return se.OpSha1()
+	case OP_SHA256:
+		return se.OpSha256()
 	case OP_HASH256:
 		return se.OpHash256()
 	case OP_HASH160:
@@ -352,12 +933,20 @@ func (se *ScriptEngine) ExecuteCommand(cmd ScriptCommand) bool {
 		return se.OpIf()
 	case OP_NOTIF:
 		return se.OpNotIf()
+	case OP_ELSE:
+		return se.OpElse()
+	case OP_ENDIF:
+		return se.OpEndIf()
+	case OP_RETURN:
+		return se.fail(ErrOpReturn)
 	case OP_CHECKSIG:
 		return se.OpCheckSig()
 	case OP_CHECKMULTISIG:
 		return se.OpCheckMultiSig()
 	case OP_CHECKSIGVERIFY:
 		return se.OpCheckSigVerify()
+	case OP_CHECKMULTISIGVERIFY:
+		return se.OpCheckMultiSigVerify()
 	case OP_NOT:
 		return se.OpNot()
 	case OP_EQUAL:
@@ -369,11 +958,30 @@ func (se *ScriptEngine) ExecuteCommand(cmd ScriptCommand) bool {
 	case OP_SWAP:
 		return se.OpSwap()
 	case OP_CHECKLOCKTIMEVERIFY:
+		if se.flags&SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY == 0 {
+			return true // OP_NOP2 before BIP 65
+		}
 		return se.OpCheckLocktimeVerify()
 	case OP_CHECKSEQUENCEVERIFY:
+		if se.flags&SCRIPT_VERIFY_CHECKSEQUENCEVERIFY == 0 {
+			return true // OP_NOP3 before BIP 112
+		}
 		return se.OpCheckSequenceVerify()
+	case OP_NOP, OP_NOP1, OP_NOP4, OP_NOP5, OP_NOP6, OP_NOP7, OP_NOP8, OP_NOP9, OP_NOP10:
+		return true
+	case OP_CHECKSIGADD:
+		if !se.tapscript {
+			return se.fail(ErrBadOpcode)
+		}
+		return se.OpCheckSigAdd()
+	case OP_CODESEPARATOR:
+		if se.tapscript {
+			se.codeSepPos = uint32(se.pc - 1)
+		}
+		se.codeSep = se.pc
+		return true
 	default:
-		return false
+		return se.fail(ErrBadOpcode)
 	}
 }
 
@@ -387,7 +995,7 @@ func (se *ScriptEngine) OpDup() bool {
 }
 
 func (se *ScriptEngine) Op2Dup() bool {
-	if len(se.stack) < 2 {
+	if !se.need(2) {
 		return false
 	}
 
@@ -400,6 +1008,147 @@ func (se *ScriptEngine) Op2Dup() bool {
 	return true
 }
 
+func (se *ScriptEngine) Op3Dup() bool {
+	if !se.need(3) {
+		return false
+	}
+	se.stack = append(se.stack, se.stack[len(se.stack)-3:]...)
+	return true
+}
+
+// Op2Over copies the third and fourth items to the top: x1 x2 x3 x4 -> x1 x2 x3 x4 x1 x2
+func (se *ScriptEngine) Op2Over() bool {
+	if !se.need(4) {
+		return false
+	}
+	n := len(se.stack)
+	se.stack = append(se.stack, se.stack[n-4:n-2]...)
+	return true
+}
+
+// Op2Rot moves the fifth and sixth items to the top: x1 x2 x3 x4 x5 x6 -> x3 x4 x5 x6 x1 x2
+func (se *ScriptEngine) Op2Rot() bool {
+	if !se.need(6) {
+		return false
+	}
+	n := len(se.stack)
+	x1, x2 := se.stack[n-6], se.stack[n-5]
+	se.stack = append(se.stack[:n-6], se.stack[n-4:]...)
+	se.push(x1)
+	se.push(x2)
+	return true
+}
+
+// Op2Swap swaps the top two pairs: x1 x2 x3 x4 -> x3 x4 x1 x2
+func (se *ScriptEngine) Op2Swap() bool {
+	if !se.need(4) {
+		return false
+	}
+	n := len(se.stack)
+	se.stack[n-4], se.stack[n-2] = se.stack[n-2], se.stack[n-4]
+	se.stack[n-3], se.stack[n-1] = se.stack[n-1], se.stack[n-3]
+	return true
+}
+
+// OpIfDup duplicates the top item if it's true
+func (se *ScriptEngine) OpIfDup() bool {
+	top, ok := se.peek()
+	if !ok {
+		return false
+	}
+	if !isAllZeros(top.Data) {
+		se.push(top)
+	}
+	return true
+}
+
+// OpNip removes the second item: x1 x2 -> x2
+func (se *ScriptEngine) OpNip() bool {
+	if !se.need(2) {
+		return false
+	}
+	n := len(se.stack)
+	se.stack = append(se.stack[:n-2], se.stack[n-1])
+	return true
+}
+
+// OpOver copies the second item to the top: x1 x2 -> x1 x2 x1
+func (se *ScriptEngine) OpOver() bool {
+	if !se.need(2) {
+		return false
+	}
+	se.push(se.stack[len(se.stack)-2])
+	return true
+}
+
+// OpPick pops n and copies the item n back to the top
+func (se *ScriptEngine) OpPick() bool {
+	i, ok := se.popStackIndex()
+	if !ok {
+		return false
+	}
+	se.push(se.stack[i])
+	return true
+}
+
+// OpRoll pops n and moves the item n back to the top
+func (se *ScriptEngine) OpRoll() bool {
+	i, ok := se.popStackIndex()
+	if !ok {
+		return false
+	}
+	item := se.stack[i]
+	se.stack = append(se.stack[:i], se.stack[i+1:]...)
+	se.push(item)
+	return true
+}
+
+// popStackIndex pops the n of OP_PICK and OP_ROLL and returns the index of the item n
+// below the new top, failing with ErrStackUnderflow if there's no such item
+func (se *ScriptEngine) popStackIndex() (int, bool) {
+	n, ok := se.popNum()
+	if !ok {
+		return 0, false
+	}
+	if n < 0 || n >= int64(len(se.stack)) {
+		return 0, se.fail(ErrStackUnderflow)
+	}
+	return len(se.stack) - 1 - int(n), true
+}
+
+// OpRot moves the third item to the top: x1 x2 x3 -> x2 x3 x1
+func (se *ScriptEngine) OpRot() bool {
+	if !se.need(3) {
+		return false
+	}
+	n := len(se.stack)
+	x1 := se.stack[n-3]
+	se.stack = append(se.stack[:n-3], se.stack[n-2:]...)
+	se.push(x1)
+	return true
+}
+
+// OpTuck copies the top item below the second: x1 x2 -> x2 x1 x2
+func (se *ScriptEngine) OpTuck() bool {
+	if !se.need(2) {
+		return false
+	}
+	n := len(se.stack)
+	x1, x2 := se.stack[n-2], se.stack[n-1]
+	se.stack = append(se.stack[:n-2], x2, x1, x2)
+	return true
+}
+
+// OpSize pushes the length of the top item, leaving the item in place
+func (se *ScriptEngine) OpSize() bool {
+	top, ok := se.peek()
+	if !ok {
+		return false
+	}
+	se.pushData(EncodeNum(int64(len(top.Data))))
+	return true
+}
+
 func (se *ScriptEngine) OpHash256() bool {
 	element, ok := se.pop()
 	if !ok {
@@ -431,7 +1180,7 @@ func (se *ScriptEngine) OpToAltStack() bool {
 
 func (se *ScriptEngine) OpFromAltStack() bool {
 	if len(se.altstack) == 0 {
-		return false
+		return se.fail(ErrStackUnderflow)
 	}
 	item := se.altstack[len(se.altstack)-1]
 	se.altstack = se.altstack[:len(se.altstack)-1]
@@ -448,57 +1197,104 @@ func (se *ScriptEngine) Op2Drop() bool {
 	return se.OpDrop() && se.OpDrop()
 }
 
+// OpIf pops a condition and runs the commands up to OP_ELSE or OP_ENDIF if it's true
 func (se *ScriptEngine) OpIf() bool {
-	condition, ok := se.pop()
-	if !ok {
-		return false
-	}
+	return se.opIf(true)
+}
 
-	// check if condition is true
-	isTrue := !isAllZeros(condition.Data)
+// OpNotIf pops a condition and runs the commands up to OP_ELSE or OP_ENDIF if it's false
+func (se *ScriptEngine) OpNotIf() bool {
+	return se.opIf(false)
+}
 
-	if !isTrue {
-		// skip to OP_ELSE or OP_ENDIF
-		se.skipToElseOrEndif()
+// opIf opens a branch that runs when the popped condition is want. Inside a branch that
+// isn't running nothing is popped, and the new branch doesn't run either.
+func (se *ScriptEngine) opIf(want bool) bool {
+	run := false
+	if se.executing() {
+		condition, ok := se.pop()
+		if !ok || !se.minimalIf(condition.Data) {
+			return false
+		}
+		run = !isAllZeros(condition.Data) == want
 	}
-	// if true, continue executing
+	se.cond = append(se.cond, run)
 	return true
 }
 
-func (se *ScriptEngine) skipToElseOrEndif() {
-	depth := 1 // track nested IF/ENDIF blocks
+// OpElse switches the innermost branch between running and not
+func (se *ScriptEngine) OpElse() bool {
+	if len(se.cond) == 0 {
+		return se.fail(ErrUnbalancedConditional)
+	}
+	se.cond[len(se.cond)-1] = !se.cond[len(se.cond)-1]
+	return true
+}
 
-	for se.pc < len(se.commands) {
-		cmd := se.commands[se.pc]
-		se.pc++
+// OpEndIf closes the innermost branch
+func (se *ScriptEngine) OpEndIf() bool {
+	if len(se.cond) == 0 {
+		return se.fail(ErrUnbalancedConditional)
+	}
+	se.cond = se.cond[:len(se.cond)-1]
+	return true
+}
 
-		if cmd.Opcode == OP_IF || cmd.Opcode == OP_NOTIF {
-			depth++ // nested if
-		} else if cmd.Opcode == OP_ENDIF {
-			depth--
-			if depth == 0 {
-				return // found matching ENDIF
-			}
-		} else if cmd.Opcode == OP_ELSE && depth == 1 {
-			return // found match ELSE at same level
+// minimalIf reports whether an OP_IF or OP_NOTIF condition is acceptable under the
+// engine's flags: with SCRIPT_VERIFY_MINIMALIF, and always in tapscript, only an empty
+// item or 0x01
+func (se *ScriptEngine) minimalIf(condition []byte) bool {
+	if se.flags&SCRIPT_VERIFY_MINIMALIF == 0 && !se.tapscript || len(condition) == 0 || len(condition) == 1 && condition[0] == 0x01 {
+		return true
+	}
+	return se.fail(ErrMinimalIf)
+}
+
+// checkSignatureEncoding reports whether a signature, sighash type byte included, is
+// encoded as the engine's flags require. An empty signature passes: it just fails to
+// verify.
+func (se *ScriptEngine) checkSignatureEncoding(sig []byte) bool {
+	if len(sig) == 0 {
+		return true
+	}
+	if se.flags&(SCRIPT_VERIFY_DERSIG|SCRIPT_VERIFY_LOW_S) != 0 && !isStrictDER(sig) {
+		return se.fail(ErrInvalidSignatureEncoding)
+	}
+	if se.flags&SCRIPT_VERIFY_LOW_S != 0 {
+		parsed, err := eccmath.ParseSignature(bytes.NewReader(sig[:len(sig)-1]))
+		if err != nil {
+			return se.fail(ErrInvalidSignatureEncoding)
+		}
+		if !parsed.IsLowS() {
+			return se.fail(ErrSigHighS)
 		}
 	}
+	return true
 }
 
-func (se *ScriptEngine) OpNotIf() bool {
-	condition, ok := se.pop()
-	if !ok {
+// isStrictDER reports whether sig, sighash type byte included, is a strict DER
+// signature as BIP 66 defines it: minimal lengths, and positive R and S without
+// unneeded zero padding
+func isStrictDER(sig []byte) bool {
+	if len(sig) < 9 || len(sig) > 73 || sig[0] != 0x30 || int(sig[1]) != len(sig)-3 {
 		return false
 	}
-
-	// check if condition is false
-	isFalse := isAllZeros(condition.Data)
-
-	if !isFalse {
-		// skip to OP_ELSE or OP_ENDIF
-		se.skipToElseOrEndif()
+	lenR := int(sig[3])
+	if 5+lenR >= len(sig) {
+		return false
+	}
+	lenS := int(sig[5+lenR])
+	if lenR+lenS+7 != len(sig) {
+		return false
+	}
+	// R: an INTEGER, not empty, not negative, no padding
+	if sig[2] != 0x02 || lenR == 0 || sig[4]&0x80 != 0 || lenR > 1 && sig[4] == 0 && sig[5]&0x80 == 0 {
+		return false
+	}
+	// S likewise
+	if sig[lenR+4] != 0x02 || lenS == 0 || sig[lenR+6]&0x80 != 0 || lenS > 1 && sig[lenR+6] == 0 && sig[lenR+7]&0x80 == 0 {
+		return false
 	}
-	// if false, continue executing
 	return true
 }
 
@@ -521,7 +1317,48 @@ func checkSigHelper(pubkeyCmd, sigCmd ScriptCommand, z *big.Int) bool {
 	return pubkey.Verify(z, sig)
 }
 
+// scriptCode is the part of the running script signatures commit to: its commands from
+// just after the last OP_CODESEPARATOR executed in it. A legacy script has every push of
+// sigs deleted from it, as a signature can't sign itself, and every OP_CODESEPARATOR
+// left in it too, as Bitcoin Core's SignatureHash drops them; BIP 143 keeps them.
+func (se *ScriptEngine) scriptCode(sigs ...[]byte) Script {
+	begin := se.scripts[se.script].start
+	code := NewScript(slices.Clone(se.commands[max(begin, se.codeSep):se.scriptEnd()]))
+	if !se.witnessV0 {
+		code.CommandStack = slices.DeleteFunc(code.CommandStack, func(cmd ScriptCommand) bool {
+			return !cmd.IsData && cmd.Opcode == OP_CODESEPARATOR
+		})
+		for _, sig := range sigs {
+			code = code.FindAndDelete(sig)
+		}
+	}
+	return code
+}
+
+// sigHashFor returns the hash a signature commits to: the one for the sighash type in its
+// final byte and scriptCode when a sigHasher is set, the fixed sighash otherwise
+func (se *ScriptEngine) sigHashFor(sigCmd ScriptCommand, scriptCode Script) (*big.Int, bool) {
+	sigHasher := se.sigHasher
+	if se.witnessV0 && se.witnessSigHasher != nil {
+		sigHasher = se.witnessSigHasher
+	}
+	if sigHasher == nil {
+		return new(big.Int).SetBytes(se.z), true
+	}
+	if len(sigCmd.Data) == 0 {
+		return nil, false
+	}
+	z, err := sigHasher(uint32(sigCmd.Data[len(sigCmd.Data)-1]), scriptCode)
+	if err != nil {
+		return nil, false
+	}
+	return new(big.Int).SetBytes(z), true
+}
+
 func (se *ScriptEngine) OpCheckSig() bool {
+	if se.tapscript {
+		return se.opCheckSigTapscript()
+	}
 	// pop public key
 	pubkeyCmd, ok := se.pop()
 	if !ok {
@@ -530,14 +1367,14 @@ func (se *ScriptEngine) OpCheckSig() bool {
 
 	// pop signature (includes sighash type byte at the end)
 	sigCmd, ok := se.pop()
-	if !ok {
+	if !ok || !se.checkSignatureEncoding(sigCmd.Data) {
 		return false
 	}
 
 	// convert sighash to big.Int
-	z := new(big.Int).SetBytes(se.z)
+	z, ok := se.sigHashFor(sigCmd, se.scriptCode(sigCmd.Data))
 
-	if checkSigHelper(pubkeyCmd, sigCmd, z) {
+	if ok && checkSigHelper(pubkeyCmd, sigCmd, z) {
 		se.pushData([]byte{0x01}) // verified! -> push true
 	} else {
 		se.pushData([]byte{}) // verification failed -> push false
@@ -551,19 +1388,27 @@ func (se *ScriptEngine) OpCheckSigVerify() bool {
 }
 
 func (se *ScriptEngine) OpCheckMultiSig() bool {
-	top, ok := se.pop()
+	if se.tapscript {
+		return se.fail(ErrTapscriptCheckMultiSig)
+	}
+	// get n public keys off the stack
+	num, ok := se.popNum()
 	if !ok {
 		return false
 	}
-
-	// get n public keys off the stack
-	n := int(DecodeNum(top.Data))
-	if len(se.stack) < n+1 {
+	n := int(num)
+	if n < 0 || n > MAX_PUBKEYS_PER_MULTISIG {
+		return se.fail(ErrPubkeyCount)
+	}
+	if se.opCount += n; se.opCount > MAX_OPS_PER_SCRIPT {
+		return se.fail(ErrOpCount)
+	}
+	if !se.need(n + 1) {
 		return false
 	}
 	secPubkeys := make([]ScriptCommand, 0, n)
 	for i := 0; i < n; i++ {
-		top, ok = se.pop()
+		top, ok := se.pop()
 		if !ok {
 			return false // should never happen
 		}
@@ -571,36 +1416,53 @@ func (se *ScriptEngine) OpCheckMultiSig() bool {
 	}
 
 	// get m signatures off the stack
-	top, ok = se.pop()
+	num, ok = se.popNum()
 	if !ok {
 		return false
 	}
-	m := int(DecodeNum(top.Data))
-	if len(se.stack) < m+1 {
+	m := int(num)
+	if m < 0 || m > n {
+		return se.fail(ErrSigCount)
+	}
+	if !se.need(m + 1) {
 		return false
 	}
 	derSignatures := make([]ScriptCommand, 0, m)
 	for i := 0; i < m; i++ {
-		top, ok = se.pop()
+		top, ok := se.pop()
 		if !ok {
 			return false
 		}
 		derSignatures = append(derSignatures, top)
 	}
-	// off by one filler element
-	top, ok = se.pop()
+	// off by one filler element, which must be empty under NULLDUMMY
+	dummy, ok := se.pop()
 	if !ok {
 		return false
 	}
+	if se.flags&SCRIPT_VERIFY_NULLDUMMY != 0 && len(dummy.Data) != 0 {
+		return se.fail(ErrSigNullDummy)
+	}
 
-	// TODO: do the verifications
-	z := new(big.Int).SetBytes(se.z)
+	// every signature is deleted from the scriptCode before any is checked
+	sigs := make([][]byte, m)
+	for i, sig := range derSignatures {
+		sigs[i] = sig.Data
+	}
+	scriptCode := se.scriptCode(sigs...)
 
 	sigIndex := 0
 	pubkeyIndex := 0
 
 	// try to match all m signatures
 	for sigIndex < m && pubkeyIndex < n {
+		if !se.checkSignatureEncoding(derSignatures[sigIndex].Data) {
+			return false
+		}
+		z, ok := se.sigHashFor(derSignatures[sigIndex], scriptCode)
+		if !ok {
+			break
+		}
 		if checkSigHelper(secPubkeys[pubkeyIndex], derSignatures[sigIndex], z) {
 			// signature matched this pubkey - move to next signature
 			sigIndex++
@@ -619,6 +1481,10 @@ func (se *ScriptEngine) OpCheckMultiSig() bool {
 	return true
 }
 
+func (se *ScriptEngine) OpCheckMultiSigVerify() bool {
+	return se.OpCheckMultiSig() && se.OpVerify()
+}
+
 func (se *ScriptEngine) OpEqual() bool {
 	item1, ok := se.pop()
 	if !ok {
@@ -646,7 +1512,10 @@ func (se *ScriptEngine) OpVerify() bool {
 		return false
 	}
 	// fail if all zeros (false), succeed if non-zero (true)
-	return !isAllZeros(item.Data)
+	if isAllZeros(item.Data) {
+		return se.fail(ErrVerify)
+	}
+	return true
 }
 
 func (se *ScriptEngine) OpSwap() bool {
@@ -664,73 +1533,197 @@ func (se *ScriptEngine) OpSwap() bool {
 	return true
 }
 
+// OpAdd pops b and a, and pushes a + b
 func (se *ScriptEngine) OpAdd() bool {
-	a, ok := se.pop()
+	return se.opArith(func(a, b int64) int64 { return a + b })
+}
+
+// OpSub pops b and a, and pushes a - b
+func (se *ScriptEngine) OpSub() bool {
+	return se.opArith(func(a, b int64) int64 { return a - b })
+}
+
+// OpMul pops b and a, and pushes a * b
+func (se *ScriptEngine) OpMul() bool {
+	return se.opArith(func(a, b int64) int64 { return a * b })
+}
+
+// opArith pops b and then a, both limited to MAX_SCRIPT_NUM_SIZE bytes, and pushes f(a, b)
+func (se *ScriptEngine) opArith(f func(a, b int64) int64) bool {
+	b, ok := se.popNum()
 	if !ok {
 		return false
 	}
-	b, ok := se.pop()
+	a, ok := se.popNum()
 	if !ok {
 		return false
 	}
-
-	numA := DecodeNum(a.Data)
-	numB := DecodeNum(b.Data)
-	result := EncodeNum(numA + numB)
-
-	se.pushData(result)
+	se.pushData(EncodeNum(f(a, b)))
 	return true
 }
 
-func (se *ScriptEngine) OpSub() bool {
-	a, ok := se.pop()
+func (se *ScriptEngine) OpNot() bool {
+	num, ok := se.popNum()
 	if !ok {
 		return false
 	}
-	b, ok := se.pop()
+	se.pushData(boolNum(num == 0))
+	return true
+}
+
+// popNum pops a number no longer than MAX_SCRIPT_NUM_SIZE bytes
+func (se *ScriptEngine) popNum() (int64, bool) {
+	item, ok := se.pop()
 	if !ok {
-		return false
+		return 0, false
 	}
+	return se.scriptNum(item.Data, MAX_SCRIPT_NUM_SIZE)
+}
 
-	numA := DecodeNum(a.Data)
-	numB := DecodeNum(b.Data)
-	result := EncodeNum(numA - numB)
+// scriptNum decodes a numeric operand no longer than maxSize bytes, and minimally
+// encoded if the engine's flags require it
+func (se *ScriptEngine) scriptNum(data []byte, maxSize int) (int64, bool) {
+	if len(data) > maxSize {
+		return 0, se.fail(ErrNumberOverflow)
+	}
+	if !se.minimalNum(data) {
+		return 0, false
+	}
+	return DecodeNum(data), true
+}
 
-	se.pushData(result)
+// minimalNum reports whether a numeric operand is acceptable under the engine's flags:
+// with SCRIPT_VERIFY_MINIMALDATA it must carry no extra zero byte, so 0x0100 for 1 or
+// 0x80 for negative zero fail
+func (se *ScriptEngine) minimalNum(num []byte) bool {
+	if se.flags&SCRIPT_VERIFY_MINIMALDATA == 0 || len(num) == 0 {
+		return true
+	}
+	// the last byte may only be 0x00 or 0x80 when it's needed to hold the sign bit
+	last := len(num) - 1
+	if num[last]&0x7f == 0 && (last == 0 || num[last-1]&0x80 == 0) {
+		return se.fail(ErrNonMinimalNumber)
+	}
 	return true
 }
 
-func (se *ScriptEngine) OpMul() bool {
-	a, ok := se.pop()
+func boolNum(b bool) []byte {
+	if b {
+		return EncodeNum(1)
+	}
+	return EncodeNum(0)
+}
+
+// opUnaryNum runs the numeric opcodes taking one number: OP_1ADD, OP_1SUB, OP_NEGATE,
+// OP_ABS and OP_0NOTEQUAL
+func (se *ScriptEngine) opUnaryNum(op byte) bool {
+	a, ok := se.popNum()
 	if !ok {
 		return false
 	}
-	b, ok := se.pop()
+	switch op {
+	case OP_1ADD:
+		a++
+	case OP_1SUB:
+		a--
+	case OP_NEGATE:
+		a = -a
+	case OP_ABS:
+		if a < 0 {
+			a = -a
+		}
+	case OP_0NOTEQUAL:
+		se.pushData(boolNum(a != 0))
+		return true
+	default:
+		return se.fail(ErrBadOpcode)
+	}
+	se.pushData(EncodeNum(a))
+	return true
+}
+
+// opBinaryNum runs the numeric opcodes taking two numbers, a below b on the stack: the
+// boolean operators, comparisons, OP_MIN and OP_MAX
+func (se *ScriptEngine) opBinaryNum(op byte) bool {
+	b, ok := se.popNum()
 	if !ok {
 		return false
 	}
-
-	numA := DecodeNum(a.Data)
-	numB := DecodeNum(b.Data)
-	result := EncodeNum(numA * numB)
-
+	a, ok := se.popNum()
+	if !ok {
+		return false
+	}
+	var result []byte
+	switch op {
+	case OP_BOOLAND:
+		result = boolNum(a != 0 && b != 0)
+	case OP_BOOLOR:
+		result = boolNum(a != 0 || b != 0)
+	case OP_NUMEQUAL, OP_NUMEQUALVERIFY:
+		result = boolNum(a == b)
+	case OP_NUMNOTEQUAL:
+		result = boolNum(a != b)
+	case OP_LESSTHAN:
+		result = boolNum(a < b)
+	case OP_GREATERTHAN:
+		result = boolNum(a > b)
+	case OP_LESSTHANOREQUAL:
+		result = boolNum(a <= b)
+	case OP_GREATERTHANOREQUAL:
+		result = boolNum(a >= b)
+	case OP_MIN:
+		result = EncodeNum(min(a, b))
+	case OP_MAX:
+		result = EncodeNum(max(a, b))
+	default:
+		return se.fail(ErrBadOpcode)
+	}
+	if op == OP_NUMEQUALVERIFY {
+		if a != b {
+			return se.fail(ErrVerify)
+		}
+		return true
+	}
 	se.pushData(result)
 	return true
 }
 
-func (se *ScriptEngine) OpNot() bool {
-	item, ok := se.pop()
+// OpWithin pops max, min and x, and pushes whether min <= x < max
+func (se *ScriptEngine) OpWithin() bool {
+	hi, ok := se.popNum()
+	if !ok {
+		return false
+	}
+	lo, ok := se.popNum()
 	if !ok {
 		return false
 	}
+	x, ok := se.popNum()
+	if !ok {
+		return false
+	}
+	se.pushData(boolNum(lo <= x && x < hi))
+	return true
+}
 
-	num := DecodeNum(item.Data)
+func (se *ScriptEngine) OpRipemd160() bool {
+	element, ok := se.pop()
+	if !ok {
+		return false
+	}
+	hasher := ripemd160.New()
+	hasher.Write(element.Data)
+	se.pushData(hasher.Sum(nil))
+	return true
+}
 
-	if num == 0 {
-		se.pushData(EncodeNum(1))
-	} else {
-		se.pushData(EncodeNum(0))
+func (se *ScriptEngine) OpSha256() bool {
+	element, ok := se.pop()
+	if !ok {
+		return false
 	}
+	hash := sha256.Sum256(element.Data)
+	se.pushData(hash[:])
 	return true
 }
 
@@ -753,7 +1746,7 @@ func (se *ScriptEngine) OpSha1() bool {
 func (se *ScriptEngine) OpCheckLocktimeVerify() bool {
 	// BIP 65: OP_CHECKLOCKTIMEVERIFY
 
-	if len(se.stack) < 1 {
+	if !se.need(1) {
 		return false
 	}
 
@@ -763,18 +1756,21 @@ func (se *ScriptEngine) OpCheckLocktimeVerify() bool {
 		return false
 	}
 
-	// Decode the locktime threshold from stack
-	stackLocktime := DecodeNum(element.Data)
+	// Decode the locktime threshold from stack, allowing 5 bytes for times past 2038
+	stackLocktime, ok := se.scriptNum(element.Data, MAX_LOCKTIME_NUM_SIZE)
+	if !ok {
+		return false
+	}
 
 	// 1. Check if the stack value is negative (BIP 65 rule)
 	if stackLocktime < 0 {
-		return false
+		return se.fail(ErrUnsatisfiedLocktime)
 	}
 
 	// 2. Check if input sequence is final (0xffffffff means locktime is disabled)
 	// BIP 65: nSequence must be < 0xffffffff
 	if se.sequence == 0xffffffff {
-		return false
+		return se.fail(ErrUnsatisfiedLocktime)
 	}
 
 	// 3. Check that stack locktime and tx locktime are the same type
@@ -786,13 +1782,13 @@ func (se *ScriptEngine) OpCheckLocktimeVerify() bool {
 
 	// They must both be block heights or both be timestamps
 	if stackIsTimestamp != txIsTimestamp {
-		return false
+		return se.fail(ErrUnsatisfiedLocktime)
 	}
 
 	// 4. Check that transaction locktime >= stack locktime
 	// This means the transaction is locked until at least the stack value
 	if int64(se.locktime) < stackLocktime {
-		return false
+		return se.fail(ErrUnsatisfiedLocktime)
 	}
 
 	// Success - CLTV is a "verify" operation, so it doesn't modify the stack
@@ -804,7 +1800,7 @@ func (se *ScriptEngine) OpCheckLocktimeVerify() bool {
 func (se *ScriptEngine) OpCheckSequenceVerify() bool {
 	// BIP 112: OP_CHECKSEQUENCEVERIFY
 
-	if len(se.stack) < 1 {
+	if !se.need(1) {
 		return false
 	}
 
@@ -814,12 +1810,15 @@ func (se *ScriptEngine) OpCheckSequenceVerify() bool {
 		return false
 	}
 
-	// Decode the sequence value from stack
-	stackSequence := DecodeNum(element.Data)
+	// Decode the sequence value from stack, allowing 5 bytes to hold bit 31
+	stackSequence, ok := se.scriptNum(element.Data, MAX_LOCKTIME_NUM_SIZE)
+	if !ok {
+		return false
+	}
 
 	// 1. Check if the stack value is negative (BIP 112 rule)
 	if stackSequence < 0 {
-		return false
+		return se.fail(ErrUnsatisfiedLocktime)
 	}
 
 	// BIP 112: If bit 31 of stack value is set, CSV succeeds immediately
@@ -832,7 +1831,7 @@ func (se *ScriptEngine) OpCheckSequenceVerify() bool {
 	// 2. Check if tx input sequence has disable flag set (bit 31)
 	// If bit 31 of nSequence is set, BIP 68 is disabled, so CSV fails
 	if se.sequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
-		return false
+		return se.fail(ErrUnsatisfiedLocktime)
 	}
 
 	// 3. Check that stack and sequence have same lock-time type (bit 22)
@@ -843,7 +1842,7 @@ func (se *ScriptEngine) OpCheckSequenceVerify() bool {
 	sequenceType := se.sequence & SEQUENCE_LOCKTIME_TYPE_FLAG
 
 	if stackType != sequenceType {
-		return false
+		return se.fail(ErrUnsatisfiedLocktime)
 	}
 
 	// 4. Compare the masked values (lower 16 bits)
@@ -855,7 +1854,7 @@ func (se *ScriptEngine) OpCheckSequenceVerify() bool {
 
 	// Sequence must be >= stack value (input must have aged enough)
 	if sequenceValue < stackValue {
-		return false
+		return se.fail(ErrUnsatisfiedLocktime)
 	}
 
 	// Success - CSV is a "verify" operation, so it doesn't modify the stack
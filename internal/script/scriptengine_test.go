@@ -0,0 +1,753 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/eccmath"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// num pushes n as a script number
+func num(n int64) ScriptCommand {
+	return ScriptCommand{Data: EncodeNum(n), IsData: true}
+}
+
+func op(opcode byte) ScriptCommand {
+	return ScriptCommand{Opcode: opcode}
+}
+
+// runOps executes cmds one at a time and returns the stack as numbers, bottom first
+func runOps(cmds ...ScriptCommand) ([]int64, bool) {
+	engine := NewScriptEngine(NewScript(cmds))
+	for _, cmd := range cmds {
+		if cmd.IsData {
+			engine.push(cmd)
+		} else if !engine.ExecuteCommand(cmd) {
+			return nil, false
+		}
+	}
+	stack := make([]int64, len(engine.stack))
+	for i, item := range engine.stack {
+		stack[i] = DecodeNum(item.Data)
+	}
+	return stack, true
+}
+
+func TestNumericOpcodes(t *testing.T) {
+	tests := []struct {
+		name string
+		cmds []ScriptCommand
+		want []int64 // nil: the script fails
+	}{
+		{"1NEGATE", []ScriptCommand{op(OP_1NEGATE)}, []int64{-1}},
+		{"1ADD", []ScriptCommand{num(41), op(OP_1ADD)}, []int64{42}},
+		{"1SUB", []ScriptCommand{num(0), op(OP_1SUB)}, []int64{-1}},
+		{"NEGATE", []ScriptCommand{num(7), op(OP_NEGATE)}, []int64{-7}},
+		{"ABS", []ScriptCommand{num(-7), op(OP_ABS)}, []int64{7}},
+		{"0NOTEQUAL zero", []ScriptCommand{num(0), op(OP_0NOTEQUAL)}, []int64{0}},
+		{"0NOTEQUAL nonzero", []ScriptCommand{num(-3), op(OP_0NOTEQUAL)}, []int64{1}},
+		{"BOOLAND", []ScriptCommand{num(2), num(0), op(OP_BOOLAND)}, []int64{0}},
+		{"BOOLOR", []ScriptCommand{num(2), num(0), op(OP_BOOLOR)}, []int64{1}},
+		{"NUMEQUAL", []ScriptCommand{num(5), num(5), op(OP_NUMEQUAL)}, []int64{1}},
+		{"NUMEQUALVERIFY", []ScriptCommand{num(1), num(5), num(5), op(OP_NUMEQUALVERIFY)}, []int64{1}},
+		{"NUMEQUALVERIFY fails", []ScriptCommand{num(5), num(6), op(OP_NUMEQUALVERIFY)}, nil},
+		{"NUMNOTEQUAL", []ScriptCommand{num(5), num(6), op(OP_NUMNOTEQUAL)}, []int64{1}},
+		{"LESSTHAN", []ScriptCommand{num(3), num(4), op(OP_LESSTHAN)}, []int64{1}},
+		{"GREATERTHAN", []ScriptCommand{num(3), num(4), op(OP_GREATERTHAN)}, []int64{0}},
+		{"LESSTHANOREQUAL", []ScriptCommand{num(4), num(4), op(OP_LESSTHANOREQUAL)}, []int64{1}},
+		{"GREATERTHANOREQUAL", []ScriptCommand{num(-5), num(4), op(OP_GREATERTHANOREQUAL)}, []int64{0}},
+		{"MIN", []ScriptCommand{num(-5), num(4), op(OP_MIN)}, []int64{-5}},
+		{"MAX", []ScriptCommand{num(-5), num(4), op(OP_MAX)}, []int64{4}},
+		{"ADD", []ScriptCommand{num(5), num(-3), op(OP_ADD)}, []int64{2}},
+		{"SUB takes the top from the one below", []ScriptCommand{num(5), num(3), op(OP_SUB)}, []int64{2}},
+		{"NOT", []ScriptCommand{num(0), op(OP_NOT)}, []int64{1}},
+		{"WITHIN low bound", []ScriptCommand{num(2), num(2), num(5), op(OP_WITHIN)}, []int64{1}},
+		{"WITHIN high bound", []ScriptCommand{num(5), num(2), num(5), op(OP_WITHIN)}, []int64{0}},
+		{"operand over 4 bytes", []ScriptCommand{num(1 << 32), op(OP_1ADD)}, nil},
+		{"result over 4 bytes is kept", []ScriptCommand{num(0x7fffffff), op(OP_1ADD)}, []int64{0x80000000}},
+		{"missing operand", []ScriptCommand{num(1), op(OP_LESSTHAN)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stack, ok := runOps(tt.cmds...)
+			if ok != (tt.want != nil) || fmt.Sprint(stack) != fmt.Sprint(tt.want) {
+				t.Fatalf("got %v, %v, want %v", stack, ok, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.name, stack)
+		})
+	}
+}
+
+func TestStackOpcodes(t *testing.T) {
+	tests := []struct {
+		name string
+		cmds []ScriptCommand
+		want []int64 // nil: the script fails
+	}{
+		{"3DUP", []ScriptCommand{num(1), num(2), num(3), op(OP_3DUP)}, []int64{1, 2, 3, 1, 2, 3}},
+		{"2OVER", []ScriptCommand{num(1), num(2), num(3), num(4), op(OP_2OVER)}, []int64{1, 2, 3, 4, 1, 2}},
+		{"2ROT", []ScriptCommand{num(1), num(2), num(3), num(4), num(5), num(6), op(OP_2ROT)}, []int64{3, 4, 5, 6, 1, 2}},
+		{"2SWAP", []ScriptCommand{num(1), num(2), num(3), num(4), op(OP_2SWAP)}, []int64{3, 4, 1, 2}},
+		{"IFDUP true", []ScriptCommand{num(7), op(OP_IFDUP)}, []int64{7, 7}},
+		{"IFDUP false", []ScriptCommand{num(0), op(OP_IFDUP)}, []int64{0}},
+		{"DEPTH", []ScriptCommand{num(9), num(9), op(OP_DEPTH)}, []int64{9, 9, 2}},
+		{"DEPTH empty", []ScriptCommand{op(OP_DEPTH)}, []int64{0}},
+		{"NIP", []ScriptCommand{num(1), num(2), op(OP_NIP)}, []int64{2}},
+		{"OVER", []ScriptCommand{num(1), num(2), op(OP_OVER)}, []int64{1, 2, 1}},
+		{"PICK", []ScriptCommand{num(1), num(2), num(3), num(2), op(OP_PICK)}, []int64{1, 2, 3, 1}},
+		{"PICK 0", []ScriptCommand{num(1), num(2), num(0), op(OP_PICK)}, []int64{1, 2, 2}},
+		{"PICK past the bottom", []ScriptCommand{num(1), num(1), op(OP_PICK)}, nil},
+		{"PICK negative", []ScriptCommand{num(1), num(-1), op(OP_PICK)}, nil},
+		{"ROLL", []ScriptCommand{num(1), num(2), num(3), num(2), op(OP_ROLL)}, []int64{2, 3, 1}},
+		{"ROT", []ScriptCommand{num(1), num(2), num(3), op(OP_ROT)}, []int64{2, 3, 1}},
+		{"TUCK", []ScriptCommand{num(1), num(2), op(OP_TUCK)}, []int64{2, 1, 2}},
+		{"SIZE", []ScriptCommand{{Data: []byte("hello"), IsData: true}, op(OP_SIZE), op(OP_NIP)}, []int64{5}},
+		{"ROT short stack", []ScriptCommand{num(1), num(2), op(OP_ROT)}, nil},
+		{"2ROT short stack", []ScriptCommand{num(1), num(2), num(3), num(4), num(5), op(OP_2ROT)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stack, ok := runOps(tt.cmds...)
+			if ok != (tt.want != nil) || fmt.Sprint(stack) != fmt.Sprint(tt.want) {
+				t.Fatalf("got %v, %v, want %v", stack, ok, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.name, stack)
+		})
+	}
+
+	// a hash puzzle that checks the preimage's length before hashing it, as HTLCs do:
+	// OP_SIZE 32 OP_EQUALVERIFY OP_HASH256 <hash> OP_EQUAL
+	preimage := bytes.Repeat([]byte{0xab}, 32)
+	scriptSig := NewScript([]ScriptCommand{{Data: preimage, IsData: true}})
+	for _, size := range []int64{32, 31} {
+		lock := NewScript([]ScriptCommand{op(OP_SIZE), num(size), op(OP_EQUALVERIFY), op(OP_HASH256), {Data: encoding.Hash256(preimage), IsData: true}, op(OP_EQUAL)})
+		combined := scriptSig.Combine(lock)
+		if got, _ := combined.Evaluate(nil); got != (size == 32) {
+			t.Fatalf("size %d: evaluate = %v", size, got)
+		}
+	}
+	t.Logf("✓ OP_SIZE guards a hash preimage")
+}
+
+func TestCryptoOpcodes(t *testing.T) {
+	hexHash := func(opcode byte, data string) string {
+		engine := NewScriptEngine(Script{})
+		engine.pushData([]byte(data))
+		if !engine.ExecuteCommand(op(opcode)) {
+			t.Fatalf("opcode %#x failed", opcode)
+		}
+		top, _ := engine.pop()
+		return hex.EncodeToString(top.Data)
+	}
+	tests := []struct {
+		name   string
+		opcode byte
+		data   string
+		want   string
+	}{
+		{"RIPEMD160 empty", OP_RIPEMD160, "", "9c1185a5c5e9fc54612808977ee8f548b2258d31"},
+		{"RIPEMD160 abc", OP_RIPEMD160, "abc", "8eb208f7e05d987a9b044a8e98c6b087f15a0bfc"},
+		{"SHA256 empty", OP_SHA256, "", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"SHA256 abc", OP_SHA256, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	for _, tt := range tests {
+		if got := hexHash(tt.opcode, tt.data); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	t.Logf("✓ RIPEMD160 and SHA256 match their test vectors")
+
+	// 2-of-3 OP_CHECKMULTISIGVERIFY, then a SHA256 preimage
+	z := encoding.Hash256([]byte("2376"))
+	privs := []*keys.PrivateKey{keys.NewPrivateKey(big.NewInt(11)), keys.NewPrivateKey(big.NewInt(12)), keys.NewPrivateKey(big.NewInt(13))}
+	var sigs, pubs []ScriptCommand
+	for _, k := range privs {
+		sig, err := k.SignHash(z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := k.PublicKey()
+		sigs = append(sigs, ScriptCommand{Data: append(sig.Serialize(), byte(encoding.SIGHASH_ALL)), IsData: true})
+		pubs = append(pubs, ScriptCommand{Data: pub.Serialize(true), IsData: true})
+	}
+	preimage := []byte("open sesame")
+	digest := sha256.Sum256(preimage)
+	lock := append(append([]ScriptCommand{op(OP_2)}, pubs...),
+		op(OP_3), op(OP_CHECKMULTISIGVERIFY), op(OP_SHA256), ScriptCommand{Data: digest[:], IsData: true}, op(OP_EQUAL))
+
+	run := func(dummy []byte, sigs []ScriptCommand, secret []byte, flags VerifyFlags) bool {
+		cmds := []ScriptCommand{{Data: secret, IsData: true}, {Data: dummy, IsData: true}}
+		cmds = append(append(cmds, sigs...), lock...)
+		engine := NewScriptEngine(NewScript(cmds))
+		ok, _ := engine.WithFlags(flags).Execute(z)
+		return ok
+	}
+	cases := []struct {
+		name   string
+		dummy  []byte
+		sigs   []ScriptCommand
+		secret []byte
+		flags  VerifyFlags
+		want   bool
+	}{
+		{"valid", nil, []ScriptCommand{sigs[0], sigs[2]}, preimage, SCRIPT_VERIFY_NULLDUMMY, true},
+		{"signatures out of order", nil, []ScriptCommand{sigs[2], sigs[0]}, preimage, 0, false},
+		{"wrong preimage", nil, []ScriptCommand{sigs[0], sigs[1]}, []byte("open barley"), 0, false},
+		{"non-empty dummy", []byte{0x01}, []ScriptCommand{sigs[0], sigs[1]}, preimage, 0, true},
+		{"non-empty dummy under NULLDUMMY", []byte{0x01}, []ScriptCommand{sigs[0], sigs[1]}, preimage, SCRIPT_VERIFY_NULLDUMMY, false},
+	}
+	for _, tt := range cases {
+		if got := run(tt.dummy, tt.sigs, tt.secret, tt.flags); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	t.Logf("✓ OP_CHECKMULTISIGVERIFY and OP_SHA256 evaluate, NULLDUMMY enforced when asked")
+}
+
+func TestMinimalData(t *testing.T) {
+	parse := func(rawHex string, strict bool) (Script, error) {
+		raw, err := hex.DecodeString(rawHex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, _ := encoding.EncodeVarInt(uint64(len(raw)))
+		r := bytes.NewReader(append(length, raw...))
+		if strict {
+			return ParseScriptStrict(r)
+		}
+		return ParseScript(r)
+	}
+	pushes := []struct {
+		name    string
+		script  string
+		minimal bool
+	}{
+		{"direct push", "02abcd", true},
+		{"push of a zero byte", "0100", true},
+		{"PUSHDATA1 of 76 bytes", "4c4c" + strings.Repeat("ab", 76), true},
+		{"PUSHDATA2 of 256 bytes", "4d0001" + strings.Repeat("ab", 256), true},
+		{"PUSHDATA1 of 2 bytes", "4c02abcd", false},
+		{"PUSHDATA1 of nothing", "4c00" + "51", false},
+		{"PUSHDATA2 of 200 bytes", "4dc800" + strings.Repeat("ab", 200), false},
+		{"PUSHDATA4 of 3 bytes", "4e03000000abcdef", false},
+		{"push of 5 for OP_5", "0105", false},
+		{"push of -1 for OP_1NEGATE", "0181", false},
+	}
+	for _, tt := range pushes {
+		if _, err := parse(tt.script, false); err != nil {
+			t.Fatalf("%s: ParseScript: %v", tt.name, err)
+		}
+		_, err := parse(tt.script, true)
+		if tt.minimal && err != nil || !tt.minimal && !errors.Is(err, ErrNonMinimalPush) {
+			t.Errorf("%s: ParseScriptStrict err = %v", tt.name, err)
+		}
+	}
+	t.Logf("✓ Strict parsing rejects non-minimal pushes")
+
+	scripts := []struct {
+		name    string
+		script  string
+		minimal bool
+	}{
+		{"PUSHDATA1 7 OP_7 OP_EQUAL", "4c0107" + "57" + "87", false},
+		{"push of 7 OP_7 OP_EQUAL", "0107" + "57" + "87", false},
+		{"0x0500 OP_5 OP_NUMEQUAL", "020500" + "55" + "9c", false},
+		{"negative zero OP_0 OP_NUMEQUAL", "0180" + "00" + "9c", false},
+		{"0x0500 OP_5 OP_ADD OP_10 OP_EQUAL", "020500" + "55" + "93" + "5a" + "87", false},
+		{"128 OP_1ADD 129 OP_NUMEQUAL", "028000" + "8b" + "028100" + "9c", true},
+		{"OP_7 OP_7 OP_EQUAL", "57" + "57" + "87", true},
+	}
+	for _, tt := range scripts {
+		s, err := parse(tt.script, false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		plain, strict := NewScriptEngine(s), NewScriptEngine(s)
+		if ok, err := plain.Execute(nil); !ok {
+			t.Errorf("%s: fails without MINIMALDATA: %v", tt.name, err)
+		}
+		if got, _ := strict.WithFlags(SCRIPT_VERIFY_MINIMALDATA).Execute(nil); got != tt.minimal {
+			t.Errorf("%s: under MINIMALDATA got %v, want %v", tt.name, got, tt.minimal)
+		}
+	}
+	t.Logf("✓ MINIMALDATA rejects non-minimal pushes and numeric operands at execution")
+}
+
+func TestVerifyFlags(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2379))
+	pub := key.PublicKey()
+	z := encoding.Hash256([]byte("verify flags"))
+	sig, err := key.Sign(new(big.Int).SetBytes(z))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := sig.Serialize()
+	r, s := der[4:4+der[3]], der[6+der[3]:]
+
+	// derSig encodes a signature with the ALL hash type, optionally padding R with a
+	// needless zero byte
+	integer := func(b []byte) []byte {
+		b = bytes.TrimLeft(b, "\x00")
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0x00}, b...)
+		}
+		return b
+	}
+	derSig := func(r, s []byte, padR bool) ScriptCommand {
+		r = integer(r)
+		if padR {
+			r = append([]byte{0x00}, r...)
+		}
+		s = integer(s)
+		body := append(append([]byte{0x02, byte(len(r))}, r...), append([]byte{0x02, byte(len(s))}, s...)...)
+		return ScriptCommand{Data: append(append([]byte{0x30, byte(len(body))}, body...), 0x01), IsData: true}
+	}
+	highS := new(big.Int).Sub(eccmath.NewBitcoin().N, new(big.Int).SetBytes(s)).Bytes()
+	checkSig := func(sig ScriptCommand) []ScriptCommand {
+		return []ScriptCommand{sig, {Data: pub.Serialize(true), IsData: true}, op(OP_CHECKSIG)}
+	}
+
+	tests := []struct {
+		name string
+		flag VerifyFlags
+		cmds []ScriptCommand
+	}{
+		{"witness program needs a witness", SCRIPT_VERIFY_WITNESS,
+			[]ScriptCommand{op(OP_O), {Data: bytes.Repeat([]byte{0x01}, 20), IsData: true}}},
+		{"padded R", SCRIPT_VERIFY_DERSIG, checkSig(derSig(r, s, true))},
+		{"high S", SCRIPT_VERIFY_LOW_S, checkSig(derSig(r, highS, false))},
+		{"CHECKLOCKTIMEVERIFY", SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY,
+			[]ScriptCommand{num(500), op(OP_CHECKLOCKTIMEVERIFY), op(OP_DROP), op(OP_1)}},
+		{"CHECKSEQUENCEVERIFY", SCRIPT_VERIFY_CHECKSEQUENCEVERIFY,
+			[]ScriptCommand{num(10), op(OP_CHECKSEQUENCEVERIFY), op(OP_DROP), op(OP_1)}},
+		{"OP_NOTIF on 2", SCRIPT_VERIFY_MINIMALIF,
+			[]ScriptCommand{op(OP_1), op(OP_2), op(OP_NOTIF), op(OP_O), op(OP_ENDIF)}},
+		{"two items left", SCRIPT_VERIFY_CLEANSTACK, []ScriptCommand{op(OP_1), op(OP_1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, after := NewScriptEngine(NewScript(tt.cmds)), NewScriptEngine(NewScript(tt.cmds))
+			if ok, err := before.WithFlags(SCRIPT_VERIFY_NONE).Execute(z); !ok {
+				t.Fatalf("fails without the flag: %v", err)
+			}
+			if ok, _ := after.WithFlags(tt.flag).Execute(z); ok {
+				t.Fatal("passes with the flag")
+			}
+			t.Logf("✓ %s: rejected only under flag %#x", tt.name, tt.flag)
+		})
+	}
+
+	// the signature as signed passes everything
+	strict := NewScriptEngine(NewScript(checkSig(derSig(r, s, false))))
+	if ok, err := strict.WithFlags(STANDARD_SCRIPT_VERIFY_FLAGS).Execute(z); !ok {
+		t.Fatalf("low-S strict DER signature failed under standard flags: %v", err)
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	dups := []ScriptCommand{op(OP_1)}
+	for range MAX_OPS_PER_SCRIPT + 1 {
+		dups = append(dups, op(OP_DUP))
+	}
+	ones := slices.Repeat([]ScriptCommand{op(OP_1)}, MAX_STACK_SIZE+1)
+	tests := []struct {
+		name  string
+		cmds  []ScriptCommand
+		flags VerifyFlags
+		want  error
+		pc    int
+	}{
+		{"empty script", nil, 0, ErrEvalFalse, 0},
+		{"false result", []ScriptCommand{op(OP_O)}, 0, ErrEvalFalse, 1},
+		{"stack underflow", []ScriptCommand{op(OP_1), op(OP_ADD)}, 0, ErrStackUnderflow, 1},
+		{"EQUALVERIFY", []ScriptCommand{op(OP_1), op(OP_2), op(OP_EQUALVERIFY), op(OP_1)}, 0, ErrVerify, 2},
+		{"NUMEQUALVERIFY", []ScriptCommand{op(OP_1), op(OP_2), op(OP_NUMEQUALVERIFY), op(OP_1)}, 0, ErrVerify, 2},
+		{"OP_RETURN", []ScriptCommand{op(OP_1), op(OP_RETURN)}, 0, ErrOpReturn, 1},
+		{"unknown opcode", []ScriptCommand{op(OP_1), op(0xba)}, 0, ErrBadOpcode, 1},
+		{"OP_ENDIF without OP_IF", []ScriptCommand{op(OP_1), op(OP_ENDIF)}, 0, ErrUnbalancedConditional, 1},
+		{"OP_IF without OP_ENDIF", []ScriptCommand{op(OP_1), op(OP_IF), op(OP_1)}, 0, ErrUnbalancedConditional, 3},
+		{"too many opcodes", dups, 0, ErrOpCount, MAX_OPS_PER_SCRIPT + 1},
+		{"opcodes count in a skipped branch", slices.Concat([]ScriptCommand{op(OP_O), op(OP_IF)}, dups, []ScriptCommand{op(OP_ENDIF), op(OP_1)}),
+			0, ErrOpCount, MAX_OPS_PER_SCRIPT + 2},
+		{"OP_VERIF in a skipped branch", []ScriptCommand{op(OP_O), op(OP_IF), op(OP_VERIF), op(OP_ENDIF), op(OP_1)}, 0, ErrBadOpcode, 2},
+		{"disabled opcode in a skipped branch", []ScriptCommand{op(OP_O), op(OP_IF), op(OP_CAT), op(OP_ENDIF), op(OP_1)}, 0, ErrBadOpcode, 2},
+		{"OP_MUL", []ScriptCommand{op(OP_2), op(OP_3), op(OP_MUL)}, 0, ErrBadOpcode, 2},
+		{"OP_MUL in a skipped branch", []ScriptCommand{op(OP_O), op(OP_IF), op(OP_MUL), op(OP_ENDIF), op(OP_1)}, 0, ErrBadOpcode, 2},
+		{"stack over 1000 items", ones, 0, ErrStackSize, MAX_STACK_SIZE},
+		{"push over 520 bytes", []ScriptCommand{{Data: make([]byte, MAX_SCRIPT_ELEMENT_SIZE+1), IsData: true}}, 0, ErrPushSize, 0},
+		{"push over 520 bytes in a skipped branch", []ScriptCommand{op(OP_O), op(OP_IF), {Data: make([]byte, MAX_SCRIPT_ELEMENT_SIZE+1), IsData: true}, op(OP_ENDIF), op(OP_1)},
+			0, ErrPushSize, 2},
+		{"script over 10,000 bytes", slices.Repeat([]ScriptCommand{op(OP_1)}, MAX_SCRIPT_SIZE+1), 0, ErrScriptSize, 0},
+		{"21 key multisig", []ScriptCommand{op(OP_O), num(21), op(OP_CHECKMULTISIG)}, 0, ErrPubkeyCount, 2},
+		{"more signatures than keys", []ScriptCommand{op(OP_O), op(OP_2), op(OP_O), op(OP_1), op(OP_CHECKMULTISIG)}, 0, ErrSigCount, 4},
+		{"9 byte key count", []ScriptCommand{op(OP_O), {Data: []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0}, IsData: true}, op(OP_CHECKMULTISIG)}, 0, ErrNumberOverflow, 2},
+		{"non-minimal key count", []ScriptCommand{op(OP_O), {Data: []byte{0x01, 0x00}, IsData: true}, op(OP_CHECKMULTISIG)}, SCRIPT_VERIFY_MINIMALDATA, ErrNonMinimalNumber, 2},
+		{"9 byte signature count", []ScriptCommand{op(OP_O), {Data: []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0}, IsData: true}, op(OP_O), op(OP_CHECKMULTISIG)}, 0, ErrNumberOverflow, 3},
+		{"non-minimal signature count", []ScriptCommand{op(OP_O), {Data: []byte{0x00, 0x00}, IsData: true}, op(OP_O), op(OP_CHECKMULTISIG)}, SCRIPT_VERIFY_MINIMALDATA, ErrNonMinimalNumber, 3},
+		{"5 byte number", []ScriptCommand{{Data: make([]byte, 5), IsData: true}, op(OP_1ADD)}, 0, ErrNumberOverflow, 1},
+		{"PICK past the bottom", []ScriptCommand{op(OP_1), op(OP_1), op(OP_PICK)}, 0, ErrStackUnderflow, 2},
+		{"PICK negative", []ScriptCommand{op(OP_1), op(OP_1NEGATE), op(OP_PICK)}, 0, ErrStackUnderflow, 2},
+		{"ROLL past the bottom", []ScriptCommand{op(OP_1), op(OP_2), op(OP_ROLL)}, 0, ErrStackUnderflow, 2},
+		{"ROLL negative", []ScriptCommand{op(OP_1), op(OP_1NEGATE), op(OP_ROLL)}, 0, ErrStackUnderflow, 2},
+		{"5 byte OP_ADD operand", []ScriptCommand{{Data: make([]byte, 5), IsData: true}, op(OP_1), op(OP_ADD)}, 0, ErrNumberOverflow, 2},
+		{"5 byte OP_SUB operand", []ScriptCommand{op(OP_1), {Data: make([]byte, 5), IsData: true}, op(OP_SUB)}, 0, ErrNumberOverflow, 2},
+		{"5 byte OP_NOT operand", []ScriptCommand{{Data: make([]byte, 5), IsData: true}, op(OP_NOT)}, 0, ErrNumberOverflow, 1},
+		{"non-minimal number", []ScriptCommand{{Data: []byte{0x01, 0x00}, IsData: true}, op(OP_1ADD)}, SCRIPT_VERIFY_MINIMALDATA, ErrNonMinimalNumber, 1},
+		{"non-minimal push", []ScriptCommand{{Data: []byte{0x01}, IsData: true}}, SCRIPT_VERIFY_MINIMALDATA, ErrNonMinimalPush, 0},
+		{"non-empty dummy", []ScriptCommand{op(OP_1), op(OP_O), op(OP_O), op(OP_CHECKMULTISIG)}, SCRIPT_VERIFY_NULLDUMMY, ErrSigNullDummy, 3},
+		{"bad signature encoding", []ScriptCommand{{Data: []byte{0x30, 0x01}, IsData: true}, op(OP_1), op(OP_CHECKSIG)}, SCRIPT_VERIFY_DERSIG, ErrInvalidSignatureEncoding, 2},
+		{"OP_IF on 2", []ScriptCommand{op(OP_2), op(OP_IF), op(OP_1), op(OP_ENDIF)}, SCRIPT_VERIFY_MINIMALIF, ErrMinimalIf, 1},
+		{"unclean stack", []ScriptCommand{op(OP_1), op(OP_1)}, SCRIPT_VERIFY_CLEANSTACK, ErrCleanStack, 2},
+		{"CHECKLOCKTIMEVERIFY", []ScriptCommand{num(500), op(OP_CHECKLOCKTIMEVERIFY)}, SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY, ErrUnsatisfiedLocktime, 1},
+		{"CHECKLOCKTIMEVERIFY 5 byte operand", []ScriptCommand{num(1 << 32), op(OP_CHECKLOCKTIMEVERIFY)}, SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY, ErrUnsatisfiedLocktime, 1},
+		{"CHECKLOCKTIMEVERIFY 6 byte operand", []ScriptCommand{{Data: make([]byte, 6), IsData: true}, op(OP_CHECKLOCKTIMEVERIFY)}, SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY, ErrNumberOverflow, 1},
+		{"CHECKLOCKTIMEVERIFY non-minimal operand", []ScriptCommand{{Data: []byte{0x01, 0x00}, IsData: true}, op(OP_CHECKLOCKTIMEVERIFY)},
+			SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY | SCRIPT_VERIFY_MINIMALDATA, ErrNonMinimalNumber, 1},
+		{"CHECKSEQUENCEVERIFY 6 byte operand", []ScriptCommand{{Data: make([]byte, 6), IsData: true}, op(OP_CHECKSEQUENCEVERIFY)}, SCRIPT_VERIFY_CHECKSEQUENCEVERIFY, ErrNumberOverflow, 1},
+		{"CHECKSEQUENCEVERIFY non-minimal operand", []ScriptCommand{{Data: []byte{0x01, 0x00}, IsData: true}, op(OP_CHECKSEQUENCEVERIFY)},
+			SCRIPT_VERIFY_CHECKSEQUENCEVERIFY | SCRIPT_VERIFY_MINIMALDATA, ErrNonMinimalNumber, 1},
+		{"witness program without witness", []ScriptCommand{op(OP_O), {Data: bytes.Repeat([]byte{0x01}, 20), IsData: true}}, SCRIPT_VERIFY_WITNESS, ErrWitnessProgramMismatch, 2},
+		{"witness v0 program of 25 bytes", []ScriptCommand{op(OP_O), {Data: bytes.Repeat([]byte{0x01}, 25), IsData: true}}, SCRIPT_VERIFY_WITNESS, ErrWitnessProgramWrongLength, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := NewScriptEngine(NewScript(tt.cmds))
+			ok, err := engine.WithFlags(tt.flags).Execute(nil)
+			var se *ScriptError
+			if ok || !errors.As(err, &se) || !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, %v, want %v", ok, err, tt.want)
+			}
+			if se.PC != tt.pc {
+				t.Fatalf("failed at command %d, want %d", se.PC, tt.pc)
+			}
+			t.Logf("✓ %v", err)
+		})
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []struct {
+		name string
+		cmds []ScriptCommand
+		want bool
+	}{
+		{"IF taken", []ScriptCommand{op(OP_1), op(OP_IF), op(OP_1), op(OP_ELSE), op(OP_O), op(OP_ENDIF)}, true},
+		{"ELSE taken", []ScriptCommand{op(OP_O), op(OP_IF), op(OP_O), op(OP_ELSE), op(OP_1), op(OP_ENDIF)}, true},
+		{"NOTIF", []ScriptCommand{op(OP_O), op(OP_NOTIF), op(OP_1), op(OP_ENDIF)}, true},
+		{"nested inside a skipped branch", []ScriptCommand{
+			op(OP_O), op(OP_IF), op(OP_1), op(OP_IF), op(OP_RETURN), op(OP_ENDIF), op(OP_ELSE), op(OP_1), op(OP_ENDIF),
+		}, true},
+		{"nested, both taken", []ScriptCommand{
+			op(OP_1), op(OP_1), op(OP_IF), op(OP_IF), op(OP_O), op(OP_ENDIF), op(OP_ENDIF),
+		}, false},
+		{"second OP_ELSE switches back", []ScriptCommand{
+			op(OP_1), op(OP_IF), op(OP_O), op(OP_ELSE), op(OP_RETURN), op(OP_ELSE), op(OP_1), op(OP_ENDIF),
+		}, true},
+		{"OP_ELSE inside a skipped branch stays skipped", []ScriptCommand{
+			op(OP_O), op(OP_IF), op(OP_1), op(OP_IF), op(OP_1), op(OP_ELSE), op(OP_RETURN), op(OP_ENDIF), op(OP_ENDIF), op(OP_1),
+		}, true},
+		{"OP_ELSE three times", []ScriptCommand{
+			op(OP_O), op(OP_IF), op(OP_RETURN), op(OP_ELSE), op(OP_1), op(OP_ELSE), op(OP_RETURN), op(OP_ELSE), op(OP_ENDIF),
+		}, true},
+		{"OP_NOTIF nested in an OP_ELSE", []ScriptCommand{
+			op(OP_1), op(OP_O), op(OP_IF), op(OP_RETURN), op(OP_ELSE), op(OP_NOTIF), op(OP_RETURN), op(OP_ELSE), op(OP_1), op(OP_ENDIF), op(OP_ENDIF),
+		}, true},
+	}
+	for _, tt := range tests {
+		engine := NewScriptEngine(NewScript(tt.cmds))
+		if got, err := engine.Execute(nil); got != tt.want {
+			t.Errorf("%s: got %v (%v), want %v", tt.name, got, err, tt.want)
+		}
+	}
+	t.Logf("✓ OP_IF, OP_NOTIF, OP_ELSE and OP_ENDIF select branches")
+}
+
+func TestStep(t *testing.T) {
+	// 2 3 ADD, park the sum on the altstack and bring it back to compare with 5
+	cmds := []ScriptCommand{op(OP_2), op(OP_3), op(OP_ADD), op(OP_TOALSTACK), op(OP_FROMALTSTACK), op(OP_5), op(OP_EQUAL)}
+	var traced []EngineState
+	trace := func(cmd ScriptCommand, state EngineState) {
+		traced = append(traced, state)
+	}
+	engine := NewScriptEngine(NewScript(cmds))
+	engine.WithTrace(trace)
+
+	n := 0
+	for {
+		done, err := engine.Step()
+		if done {
+			if err != nil {
+				t.Fatalf("script failed: %v", err)
+			}
+			break
+		}
+		n++
+		if state := engine.State(); state.PC != n {
+			t.Fatalf("after step %d pc is %d", n, state.PC)
+		}
+	}
+	if n != len(cmds) || len(traced) != len(cmds) {
+		t.Fatalf("stepped %d times and traced %d, want %d", n, len(traced), len(cmds))
+	}
+	after := func(i int) EngineState { return traced[i-1] }
+	if s := after(2).Stack; len(s) != 2 || !bytes.Equal(s[0], EncodeNum(2)) || !bytes.Equal(s[1], EncodeNum(3)) {
+		t.Fatalf("stack after 2 3: %x", s)
+	}
+	if s := after(4); len(s.Stack) != 0 || len(s.AltStack) != 1 || !bytes.Equal(s.AltStack[0], EncodeNum(5)) {
+		t.Fatalf("after OP_TOALTSTACK: %x, altstack %x", s.Stack, s.AltStack)
+	}
+	if s := after(7).Stack; len(s) != 1 || !bytes.Equal(s[0], []byte{1}) {
+		t.Fatalf("final stack %x", s)
+	}
+	if done, err := engine.Step(); !done || err != nil {
+		t.Fatalf("stepping a finished script: %v, %v", done, err)
+	}
+	t.Logf("✓ Stepped through %d commands, stack and altstack traced", n)
+
+	// a skipped branch is traced as not executing, and the failing command is traced too
+	traced = nil
+	cmds = []ScriptCommand{op(OP_O), op(OP_IF), op(OP_1), op(OP_ENDIF), op(OP_1), op(OP_VERIFY), op(OP_RETURN)}
+	engine = NewScriptEngine(NewScript(cmds))
+	engine.WithTrace(trace)
+	ok, err := engine.Execute(nil)
+	var se *ScriptError
+	if ok || !errors.As(err, &se) || se.PC != 6 {
+		t.Fatalf("got %v, %v, want a failure at command 6", ok, err)
+	}
+	if len(traced) != len(cmds) || traced[2].Executing || !traced[4].Executing {
+		t.Fatalf("traced %+v", traced)
+	}
+	if done, again := engine.Step(); !done || !errors.Is(again, ErrOpReturn) {
+		t.Fatalf("stepping a failed script: %v, %v", done, again)
+	}
+	t.Logf("✓ Traced skipped branch and failure: %v", err)
+}
+
+func TestFindAndDelete(t *testing.T) {
+	sig := bytes.Repeat([]byte{0xab}, 3)
+	parsed, err := ParseScript(bytes.NewReader([]byte{10, 0x03, 0xab, 0xab, 0xab, 0x4c, 0x03, 0xab, 0xab, 0xab, 0x75}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	built := NewScript([]ScriptCommand{{Data: sig, IsData: true}, op(OP_DROP), {Data: sig[:2], IsData: true}})
+	tests := []struct {
+		name   string
+		script Script
+		data   []byte
+		want   []ScriptCommand
+	}{
+		{"built in code", built, sig, built.CommandStack[1:]},
+		{"only the minimal push", parsed, sig, parsed.CommandStack[1:]},
+		{"no match", built, []byte{0xab}, built.CommandStack},
+		{"empty data", built, nil, built.CommandStack},
+	}
+	for _, tt := range tests {
+		got := tt.script.FindAndDelete(tt.data)
+		if !slices.EqualFunc(got.CommandStack, tt.want, func(a, b ScriptCommand) bool {
+			return a.Opcode == b.Opcode && bytes.Equal(a.Data, b.Data) && a.pushOp == b.pushOp
+		}) {
+			t.Errorf("%s: got %v, want %v", tt.name, got.CommandStack, tt.want)
+		}
+	}
+	raw, err := parsed.RawBytes()
+	if err != nil || !bytes.Equal(raw, []byte{0x03, 0xab, 0xab, 0xab, 0x4c, 0x03, 0xab, 0xab, 0xab, 0x75}) {
+		t.Fatalf("parsed script reserializes as %x, %v", raw, err)
+	}
+	t.Logf("✓ FindAndDelete removes minimal pushes only, and non-minimal pushes reserialize as read")
+}
+
+func TestCodeSeparator(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2387))
+	pub := key.PublicKey()
+	pubCmd := ScriptCommand{Data: pub.Serialize(true), IsData: true}
+	// the hash each signature commits to covers the raw scriptCode it's given
+	hasher := func(hashType uint32, scriptCode Script) ([]byte, error) {
+		raw, err := scriptCode.RawBytes()
+		return encoding.Hash256(append(raw, byte(hashType))), err
+	}
+	sign := func(scriptCode ...ScriptCommand) ScriptCommand {
+		code := NewScript(scriptCode)
+		z, _ := hasher(encoding.SIGHASH_ALL, code)
+		sig, err := key.SignHash(z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ScriptCommand{Data: append(sig.Serialize(), byte(encoding.SIGHASH_ALL)), IsData: true}
+	}
+	run := func(scriptSig []ScriptCommand, lock ...ScriptCommand) (bool, error) {
+		engine := NewScriptEngine(NewScript(lock))
+		return engine.WithScriptSig(NewScript(scriptSig)).WithSigHasher(hasher).Execute(nil)
+	}
+
+	// the first signature covers the whole script but for the separator, which legacy
+	// scriptCode drops, the second only what follows the separator
+	whole := []ScriptCommand{pubCmd, op(OP_CHECKSIGVERIFY), op(OP_CODESEPARATOR), pubCmd, op(OP_CHECKSIG)}
+	first, second := sign(pubCmd, op(OP_CHECKSIGVERIFY), pubCmd, op(OP_CHECKSIG)), sign(pubCmd, op(OP_CHECKSIG))
+	if ok, err := run([]ScriptCommand{second, first}, whole...); !ok {
+		t.Fatalf("signatures either side of OP_CODESEPARATOR: %v", err)
+	}
+	if ok, _ := run([]ScriptCommand{first, first}, whole...); ok {
+		t.Fatal("signature over the whole script accepted after OP_CODESEPARATOR")
+	}
+	t.Logf("✓ Signatures after OP_CODESEPARATOR commit to the rest of the script")
+
+	// an OP_CODESEPARATOR in a branch that's skipped doesn't move the scriptCode, but is
+	// still dropped from it
+	skipped := []ScriptCommand{op(OP_O), op(OP_IF), op(OP_CODESEPARATOR), op(OP_ENDIF), pubCmd, op(OP_CHECKSIG)}
+	unseparated := sign(op(OP_O), op(OP_IF), op(OP_ENDIF), pubCmd, op(OP_CHECKSIG))
+	if ok, err := run([]ScriptCommand{unseparated}, skipped...); !ok {
+		t.Fatalf("OP_CODESEPARATOR in a skipped branch: %v", err)
+	}
+	t.Logf("✓ Unexecuted OP_CODESEPARATOR ignored")
+
+	// a script holding the signature signs itself without it, the scriptSig not at all
+	sig := sign(op(OP_DROP), pubCmd, op(OP_CHECKSIG))
+	if ok, err := run([]ScriptCommand{sig}, sig, op(OP_DROP), pubCmd, op(OP_CHECKSIG)); !ok {
+		t.Fatalf("signature inside the scriptCode: %v", err)
+	}
+	t.Logf("✓ FindAndDelete strips the signature from a legacy scriptCode")
+}
+
+func TestP2SH(t *testing.T) {
+	push := func(data []byte) ScriptCommand {
+		return ScriptCommand{Data: data, IsData: true}
+	}
+	// the redeem script adds the two numbers the scriptSig pushes beneath it
+	redeem := []byte{OP_ADD, OP_5, OP_EQUAL}
+	spk := P2shScript(encoding.Hash160(redeem))
+	run := func(flags VerifyFlags, scriptSig ...ScriptCommand) (bool, error) {
+		engine := NewScriptEngine(spk)
+		return engine.WithScriptSig(NewScript(scriptSig)).WithFlags(flags).Execute(nil)
+	}
+
+	if ok, err := run(CONSENSUS_SCRIPT_VERIFY_FLAGS, num(2), num(3), push(redeem)); !ok {
+		t.Fatalf("redeem script on the scriptSig's stack: %v", err)
+	}
+	if ok, err := run(CONSENSUS_SCRIPT_VERIFY_FLAGS, num(2), num(2), push(redeem)); ok || !errors.Is(err, ErrEvalFalse) {
+		t.Fatalf("redeem script evaluating false = %v, %v", ok, err)
+	}
+	// before BIP 16 only the hash is checked
+	if ok, err := run(SCRIPT_VERIFY_NONE, num(2), num(2), push(redeem)); !ok {
+		t.Fatalf("without SCRIPT_VERIFY_P2SH: %v", err)
+	}
+	t.Logf("✓ Redeem script runs on the stack the scriptSig left")
+
+	// the scriptSig may only push, even where its opcodes leave the same stack
+	if ok, err := run(CONSENSUS_SCRIPT_VERIFY_FLAGS, num(2), num(3), op(OP_NOP), push(redeem)); ok || !errors.Is(err, ErrSigPushOnly) {
+		t.Fatalf("scriptSig with OP_NOP = %v, %v", ok, err)
+	}
+	t.Logf("✓ P2SH scriptSig must be push only")
+
+	// the scriptSig pushes the redeem script, so it can be at most 520 bytes
+	big := slices.Concat([]byte{OP_1, OP_PUSHDATA2, 0x03, 0x02}, make([]byte, 515), []byte{OP_DROP})
+	for _, size := range []int{MAX_SCRIPT_ELEMENT_SIZE, MAX_SCRIPT_ELEMENT_SIZE + 1} {
+		redeem := slices.Concat(make([]byte, size-len(big)), big) // OP_0s ahead of it
+		engine := NewScriptEngine(P2shScript(encoding.Hash160(redeem)))
+		ok, err := engine.WithScriptSig(NewScript([]ScriptCommand{push(redeem)})).Execute(nil)
+		if size <= MAX_SCRIPT_ELEMENT_SIZE && !ok || size > MAX_SCRIPT_ELEMENT_SIZE && !errors.Is(err, ErrPushSize) {
+			t.Fatalf("%d byte redeem script = %v, %v", size, ok, err)
+		}
+	}
+	t.Logf("✓ Redeem scripts are limited to %d bytes", MAX_SCRIPT_ELEMENT_SIZE)
+
+	// as is each script to 10,000, checked before it runs
+	pushes := slices.Repeat([]ScriptCommand{push(make([]byte, 500))}, 20)
+	if ok, err := run(CONSENSUS_SCRIPT_VERIFY_FLAGS, append(pushes, num(2), num(3), push(redeem))...); ok || !errors.Is(err, ErrScriptSize) {
+		t.Fatalf("scriptSig over 10,000 bytes = %v, %v", ok, err)
+	}
+	var se *ScriptError
+	engine := NewScriptEngine(NewScript(slices.Repeat([]ScriptCommand{op(OP_1)}, MAX_SCRIPT_SIZE+1)))
+	if ok, err := engine.WithScriptSig(NewScript([]ScriptCommand{num(2)})).Execute(nil); ok || !errors.As(err, &se) || !errors.Is(err, ErrScriptSize) || se.PC != 1 {
+		t.Fatalf("scriptPubKey over 10,000 bytes = %v, %v", ok, err)
+	}
+	t.Logf("✓ Scripts are limited to %d bytes", MAX_SCRIPT_SIZE)
+
+	// the redeem script runs on the stack as the scriptSig left it, not as the
+	// scriptPubKey did, and has an altstack and opcode limit of its own
+	if ok, err := run(CONSENSUS_SCRIPT_VERIFY_FLAGS, num(2), num(3), push(redeem), push(redeem)); ok || !errors.Is(err, ErrEvalFalse) {
+		t.Fatalf("extra push left for the redeem script = %v, %v", ok, err)
+	}
+	depth := []byte{OP_DEPTH, OP_2, OP_EQUAL}
+	engine = NewScriptEngine(P2shScript(encoding.Hash160(depth)))
+	if ok, err := engine.WithScriptSig(NewScript([]ScriptCommand{num(7), num(7), push(depth)})).Execute(nil); !ok {
+		t.Fatalf("redeem script sees the scriptSig's stack: %v", err)
+	}
+	t.Logf("✓ Redeem script gets a copy of the scriptSig's stack")
+
+	// the P2SH pattern inside a larger script is just opcodes
+	embedded := NewScript([]ScriptCommand{op(OP_HASH160), push(encoding.Hash160([]byte{OP_O})), op(OP_EQUAL), op(OP_NOP)})
+	engine = NewScriptEngine(embedded)
+	if ok, err := engine.WithScriptSig(NewScript([]ScriptCommand{push([]byte{OP_O})})).Execute(nil); !ok {
+		t.Fatalf("hash check outside a P2SH scriptPubKey: %v", err)
+	}
+	t.Logf("✓ Only a P2SH scriptPubKey runs a redeem script")
+
+	// a combined script is a single script, whatever it holds
+	engine = NewScriptEngine(NewScript(append([]ScriptCommand{push(redeem)}, spk.CommandStack...)))
+	if ok, err := engine.Execute(nil); !ok {
+		t.Fatalf("P2SH scriptPubKey without a scriptSig: %v", err)
+	}
+	t.Logf("✓ P2SH needs the scriptSig run as a script of its own")
+}
+
+func TestWitnessProgram(t *testing.T) {
+	push := func(data []byte) ScriptCommand {
+		return ScriptCommand{Data: data, IsData: true}
+	}
+	// the witness script adds the two numbers the witness holds below it
+	witnessScript := []byte{OP_ADD, OP_3, OP_EQUAL}
+	h := sha256.Sum256(witnessScript)
+	p2wsh := P2wshScript(h[:])
+	rawP2wsh, err := p2wsh.RawBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := P2shScript(encoding.Hash160(rawP2wsh))
+	witness := [][]byte{EncodeNum(1), EncodeNum(2), witnessScript}
+	// a witness script over 10,000 bytes, padded with OP_NOPs
+	bigScript := append(bytes.Repeat([]byte{OP_NOP}, MAX_SCRIPT_SIZE+1-len(witnessScript)), witnessScript...)
+	bigHash := sha256.Sum256(bigScript)
+	run := func(spk Script, scriptSig []ScriptCommand, witness [][]byte) (bool, error) {
+		engine := NewScriptEngine(spk)
+		return engine.WithScriptSig(NewScript(scriptSig)).WithWitness(witness).Execute(nil)
+	}
+
+	tests := []struct {
+		name      string
+		spk       Script
+		scriptSig []ScriptCommand
+		witness   [][]byte
+		want      error
+	}{
+		{"P2WSH", p2wsh, nil, witness, nil},
+		{"P2SH-P2WSH", wrapped, []ScriptCommand{push(rawP2wsh)}, witness, nil},
+		{"P2WSH with a scriptSig", p2wsh, []ScriptCommand{op(OP_1)}, witness, ErrWitnessMalleated},
+		{"P2SH-P2WSH with an extra push", wrapped, []ScriptCommand{op(OP_1), push(rawP2wsh)}, witness, ErrWitnessMalleated},
+		{"witness script leaving two items", p2wsh, nil, [][]byte{EncodeNum(7), EncodeNum(1), EncodeNum(2), witnessScript}, ErrCleanStack},
+		{"witness item over 520 bytes", p2wsh, nil, [][]byte{make([]byte, MAX_SCRIPT_ELEMENT_SIZE+1), EncodeNum(1), EncodeNum(2), witnessScript}, ErrPushSize},
+		{"P2WPKH witness item over 520 bytes", P2wpkhScript(bytes.Repeat([]byte{0x01}, 20)), nil, [][]byte{make([]byte, MAX_SCRIPT_ELEMENT_SIZE+1), make([]byte, 33)}, ErrPushSize},
+		{"witness script over 10,000 bytes", P2wshScript(bigHash[:]), nil, [][]byte{EncodeNum(1), EncodeNum(2), bigScript}, ErrScriptSize},
+		{"witness for a legacy spend", NewScript([]ScriptCommand{op(OP_1)}), nil, witness, ErrWitnessUnexpected},
+		{"future witness version", NewScript([]ScriptCommand{op(OP_2), push(h[:])}), nil, witness, nil},
+		// a script that passes through the shape of a witness program isn't one
+		{"empty push below 20 bytes", NewScript([]ScriptCommand{op(OP_O), push(bytes.Repeat([]byte{0x01}, 20)), op(OP_2DROP), op(OP_1)}), nil, nil, nil},
+		{"scriptSig pushing a program", NewScript([]ScriptCommand{op(OP_2DROP), op(OP_1)}), []ScriptCommand{op(OP_O), push(h[:])}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := run(tt.spk, tt.scriptSig, tt.witness)
+			if ok != (tt.want == nil) || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, %v, want %v", ok, err, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.name, err)
+		})
+	}
+}
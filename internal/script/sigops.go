@@ -0,0 +1,90 @@
+package script
+
+// SigOpCount counts the signature operations in the script. Legacy counting, with
+// accurate false, charges MAX_PUBKEYS_PER_MULTISIG for every OP_CHECKMULTISIG; accurate
+// counting, used for P2SH redeem scripts and witness scripts, charges the key count an
+// OP_1 to OP_16 right before it pushes.
+func (s *Script) SigOpCount(accurate bool) int {
+	n := 0
+	var last ScriptCommand
+	for _, cmd := range s.CommandStack {
+		if !cmd.IsData {
+			switch cmd.Opcode {
+			case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+				n++
+			case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+				if keys, ok := smallInt(last); accurate && ok && keys > 0 && !last.IsData {
+					n += keys
+				} else {
+					n += MAX_PUBKEYS_PER_MULTISIG
+				}
+			}
+		}
+		last = cmd
+	}
+	return n
+}
+
+// IsPushOnly reports whether the script only pushes data, as BIP 16 requires of a
+// scriptSig spending P2SH. OP_1NEGATE and OP_1 to OP_16 count as pushes.
+func (s *Script) IsPushOnly() bool {
+	for _, cmd := range s.CommandStack {
+		if !cmd.IsData && cmd.Opcode > OP_16 {
+			return false
+		}
+	}
+	return true
+}
+
+// redeemScript parses the redeem script a scriptSig spending P2SH reveals: its last push,
+// which must follow only other pushes
+func redeemScript(scriptSig Script) (Script, bool) {
+	cmds := scriptSig.CommandStack
+	if len(cmds) == 0 || !cmds[len(cmds)-1].IsData || !scriptSig.IsPushOnly() {
+		return Script{}, false
+	}
+	redeem, err := ParseRawScript(cmds[len(cmds)-1].Data)
+	return redeem, err == nil
+}
+
+// P2shSigOpCount counts the signature operations of the redeem script scriptSig reveals
+// spending s, accurately. It's 0 if s isn't P2SH or scriptSig isn't push only.
+func (s *Script) P2shSigOpCount(scriptSig Script) int {
+	if !s.IsP2shScriptPubKey() {
+		return 0
+	}
+	redeem, ok := redeemScript(scriptSig)
+	if !ok {
+		return 0
+	}
+	return redeem.SigOpCount(true)
+}
+
+// WitnessSigOpCount counts the signature operations of a witness program spend, native
+// or wrapped in P2SH, which unlike the others aren't weighted by the witness scale
+// factor: 1 for P2WPKH, and the witness script's accurate count for P2WSH. Witness
+// versions with no sigop rules, taproot included, count none.
+func WitnessSigOpCount(scriptPubKey, scriptSig Script, witness [][]byte) int {
+	program := scriptPubKey
+	if scriptPubKey.IsP2shScriptPubKey() {
+		redeem, ok := redeemScript(scriptSig)
+		if !ok {
+			return 0
+		}
+		program = redeem
+	}
+	switch program.Type().Kind {
+	case P2WPKH:
+		return 1
+	case P2WSH:
+		if len(witness) == 0 {
+			return 0
+		}
+		witnessScript, err := ParseRawScript(witness[len(witness)-1])
+		if err != nil {
+			return 0
+		}
+		return witnessScript.SigOpCount(true)
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package script
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSigOpCount(t *testing.T) {
+	key := ScriptCommand{Data: make([]byte, 33), IsData: true}
+	tests := []struct {
+		name             string
+		cmds             []ScriptCommand
+		legacy, accurate int
+	}{
+		{"P2PKH", P2pkhScript(make([]byte, 20)).CommandStack, 1, 1},
+		{"2-of-3 multisig", []ScriptCommand{op(OP_2), key, key, key, op(OP_3), op(OP_CHECKMULTISIG)}, 20, 3},
+		{"CHECKSIGVERIFY and CHECKMULTISIGVERIFY", []ScriptCommand{
+			key, op(OP_CHECKSIGVERIFY), op(OP_1), key, op(OP_1), op(OP_CHECKMULTISIGVERIFY),
+		}, 21, 2},
+		{"key count pushed as data", []ScriptCommand{num(3), op(OP_CHECKMULTISIG)}, 20, 20},
+		{"key count of zero", []ScriptCommand{op(OP_O), op(OP_CHECKMULTISIG)}, 20, 20},
+		{"no signature checks", []ScriptCommand{op(OP_1)}, 0, 0},
+	}
+	for _, tt := range tests {
+		s := NewScript(tt.cmds)
+		if got := s.SigOpCount(false); got != tt.legacy {
+			t.Errorf("%s: legacy count %d, want %d", tt.name, got, tt.legacy)
+		}
+		if got := s.SigOpCount(true); got != tt.accurate {
+			t.Errorf("%s: accurate count %d, want %d", tt.name, got, tt.accurate)
+		}
+	}
+	t.Logf("✓ Legacy and accurate sigop counts")
+}
+
+func TestP2shAndWitnessSigOpCount(t *testing.T) {
+	multisig := []byte{OP_2}
+	for range 3 {
+		multisig = append(multisig, 33)
+		multisig = append(multisig, make([]byte, 33)...)
+	}
+	multisig = append(multisig, OP_3, OP_CHECKMULTISIG)
+	push := func(cmds ...ScriptCommand) Script { return NewScript(cmds) }
+	data := func(b []byte) ScriptCommand { return ScriptCommand{Data: b, IsData: true} }
+	h160, h256 := make([]byte, 20), make([]byte, 32)
+	wpkh, wsh := P2wpkhScript(h160), P2wshScript(h256)
+	rawWpkh, _ := wpkh.RawBytes()
+	rawWsh, _ := wsh.RawBytes()
+	p2sh := P2shScript(h160)
+
+	tests := []struct {
+		name         string
+		spk          Script
+		scriptSig    Script
+		witness      [][]byte
+		p2sh, witSig int
+	}{
+		{"P2SH multisig", p2sh, push(op(OP_O), data(multisig)), nil, 3, 0},
+		{"P2SH scriptSig not push only", p2sh, push(op(OP_NOP), data(multisig)), nil, 0, 0},
+		{"P2SH ending in an opcode", p2sh, push(data(multisig), op(OP_1)), nil, 0, 0},
+		{"P2WPKH", wpkh, push(), [][]byte{{}, {}}, 0, 1},
+		{"P2WSH multisig", wsh, push(), [][]byte{{}, multisig}, 0, 3},
+		{"P2WSH without a witness", wsh, push(), nil, 0, 0},
+		{"P2SH-P2WPKH", p2sh, push(data(rawWpkh)), [][]byte{{}, {}}, 0, 1},
+		{"P2SH-P2WSH", p2sh, push(data(rawWsh)), [][]byte{{}, multisig}, 0, 3},
+		{"taproot", P2trScript(h256), push(), [][]byte{bytes.Repeat([]byte{OP_CHECKSIG}, 3)}, 0, 0},
+		{"not P2SH", P2pkhScript(h160), push(data(multisig)), nil, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.spk.P2shSigOpCount(tt.scriptSig); got != tt.p2sh {
+			t.Errorf("%s: P2shSigOpCount = %d, want %d", tt.name, got, tt.p2sh)
+		}
+		if got := WitnessSigOpCount(tt.spk, tt.scriptSig, tt.witness); got != tt.witSig {
+			t.Errorf("%s: WitnessSigOpCount = %d, want %d", tt.name, got, tt.witSig)
+		}
+	}
+	t.Logf("✓ Redeem script and witness script sigops counted")
+}
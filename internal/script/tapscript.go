@@ -0,0 +1,262 @@
+package script
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/eccmath"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+)
+
+// BIP 341 and 342 constants
+const (
+	TAPROOT_LEAF_TAPSCRIPT         byte   = 0xc0 // leaf version of BIP 342 tapscript
+	TAPROOT_LEAF_MASK              byte   = 0xfe // the leaf version bits of a control block's first byte
+	TAPROOT_CONTROL_BASE_SIZE      int    = 33   // leaf version and parity byte, then the internal key
+	TAPROOT_CONTROL_NODE_SIZE      int    = 32
+	TAPROOT_CONTROL_MAX_NODE_COUNT int    = 128
+	TAPROOT_TAG_LEAF               string = "TapLeaf"
+	TAPROOT_TAG_BRANCH             string = "TapBranch"
+	TAPROOT_NO_CODESEP             uint32 = 0xffffffff // codesep_pos when no OP_CODESEPARATOR executed
+
+	VALIDATION_WEIGHT_OFFSET           int = 50 // budget on top of the witness size
+	VALIDATION_WEIGHT_PER_SIGOP_PASSED int = 50 // spent by each non-empty signature
+)
+
+var ErrTaprootControlBlock = errors.New("invalid taproot control block size")
+
+// TapSigHasher computes the BIP 341 hash a tapscript signature commits to, from its
+// sighash type and the position of the last OP_CODESEPARATOR executed
+type TapSigHasher func(hashType uint32, codeSepPos uint32) ([]byte, error)
+
+// TapLeafHash is the hash a script tree commits to for a leaf script, raw with no length
+// prefix
+func TapLeafHash(leafVersion byte, raw []byte) []byte {
+	length, _ := encoding.EncodeVarInt(uint64(len(raw)))
+	return encoding.TaggedHash(TAPROOT_TAG_LEAF, []byte{leafVersion}, length, raw)
+}
+
+// TapBranchHash joins two nodes of a script tree, hashed in lexicographic order so a
+// path needn't say which side each node is on
+func TapBranchHash(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	return encoding.TaggedHash(TAPROOT_TAG_BRANCH, a, b)
+}
+
+// VerifyTaprootScriptPath checks a P2TR script path spend of the x-only outputKey. stack is
+// the witness without its annex: the script's inputs, then the leaf script, then the
+// control block, which must prove outputKey commits to the script. A BIP 342 tapscript
+// then runs on the inputs with a sigop budget set by witnessSize, the serialized size of
+// the whole witness; leaf versions with no rules yet are spendable by anyone. sigHasher
+// computes a signature's hash given the leaf hash. Failures are returned as a
+// *ScriptError.
+func VerifyTaprootScriptPath(outputKey []byte, stack [][]byte, witnessSize int, sigHasher func(leafHash []byte, hashType, codeSepPos uint32) ([]byte, error)) (bool, error) {
+	if len(stack) < 2 {
+		return false, &ScriptError{Err: ErrWitnessProgramMismatch}
+	}
+	raw, control := stack[len(stack)-2], stack[len(stack)-1]
+	inputs := stack[:len(stack)-2]
+	nodes := len(control) - TAPROOT_CONTROL_BASE_SIZE
+	if nodes < 0 || nodes%TAPROOT_CONTROL_NODE_SIZE != 0 || nodes > TAPROOT_CONTROL_NODE_SIZE*TAPROOT_CONTROL_MAX_NODE_COUNT {
+		return false, &ScriptError{Err: fmt.Errorf("%w: %d bytes", ErrTaprootControlBlock, len(control))}
+	}
+	leafVersion := control[0] & TAPROOT_LEAF_MASK
+	leafHash := TapLeafHash(leafVersion, raw)
+	if !verifyTaprootCommitment(control, outputKey, leafHash) {
+		return false, &ScriptError{Err: ErrWitnessProgramMismatch}
+	}
+	if leafVersion != TAPROOT_LEAF_TAPSCRIPT {
+		return true, nil // reserved for future soft forks
+	}
+	tapscript, err := ParseRawScript(raw)
+	if err != nil {
+		// an OP_SUCCESSx ahead of the bad push still decides the outcome
+		if success, _ := hasOpSuccess(raw); success {
+			return true, nil
+		}
+		return false, &ScriptError{Err: fmt.Errorf("%w: tapscript: %v", ErrMalformedScript, err)}
+	}
+	hasher := func(hashType, codeSepPos uint32) ([]byte, error) {
+		return sigHasher(leafHash, hashType, codeSepPos)
+	}
+	engine := NewTapscriptEngine(tapscript, inputs, hasher, witnessSize+VALIDATION_WEIGHT_OFFSET)
+	return engine.Execute(nil)
+}
+
+// verifyTaprootCommitment reports whether outputKey is the control block's internal key
+// tweaked by the merkle root its path leads to from leafHash, with the y parity it claims
+func verifyTaprootCommitment(control, outputKey, leafHash []byte) bool {
+	internal := control[1:TAPROOT_CONTROL_BASE_SIZE]
+	k := leafHash
+	for i := TAPROOT_CONTROL_BASE_SIZE; i < len(control); i += TAPROOT_CONTROL_NODE_SIZE {
+		k = TapBranchHash(k, control[i:i+TAPROOT_CONTROL_NODE_SIZE])
+	}
+	Q, err := keys.TweakPublicKey(internal, k)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(Q.SerializeXOnly(), outputKey) && Q.HasEvenY() == (control[0]&1 == 0)
+}
+
+// NewTapscriptEngine returns an engine for a BIP 342 tapscript run on stack, the witness
+// items below the script: signatures are Schnorr, over the hashes sigHasher gives, and cost
+// VALIDATION_WEIGHT_PER_SIGOP_PASSED of budget each; OP_CHECKSIGADD replaces the
+// multisig opcodes; there's no opcode limit; and MINIMALIF and CLEANSTACK always apply.
+// A script holding an OP_SUCCESSx succeeds without running, and a stack of over
+// MAX_STACK_SIZE items fails.
+func NewTapscriptEngine(tapscript Script, stack [][]byte, sigHasher TapSigHasher, budget int) ScriptEngine {
+	se := NewScriptEngine(tapscript)
+	for _, item := range stack {
+		se.pushData(item)
+	}
+	se.tapscript = true
+	se.tapSigHasher = sigHasher
+	se.budget = budget
+	se.codeSepPos = TAPROOT_NO_CODESEP
+	for _, cmd := range tapscript.CommandStack {
+		if !cmd.IsData && isOpSuccess(cmd.Opcode) {
+			se.finish(nil)
+			return se
+		}
+	}
+	if len(stack) > MAX_STACK_SIZE {
+		se.fail(ErrStackSize)
+		se.finish(se.failure(0))
+	}
+	return se
+}
+
+func (se *ScriptEngine) opCheckSigTapscript() bool {
+	if !se.need(2) {
+		return false
+	}
+	pubkey, _ := se.pop()
+	sig, _ := se.pop()
+	valid, ok := se.checkSchnorrSig(sig.Data, pubkey.Data)
+	if !ok {
+		return false
+	}
+	if valid {
+		se.pushData([]byte{0x01})
+	} else {
+		se.pushData([]byte{})
+	}
+	return true
+}
+
+// OpCheckSigAdd pops a public key, a number and a signature, and pushes the number plus
+// one if the signature is valid or unchanged if it's empty, so tapscript can count
+// signatures without OP_CHECKMULTISIG
+func (se *ScriptEngine) OpCheckSigAdd() bool {
+	if !se.need(3) {
+		return false
+	}
+	pubkey, _ := se.pop()
+	n, ok := se.popNum()
+	if !ok {
+		return false
+	}
+	sig, _ := se.pop()
+	valid, ok := se.checkSchnorrSig(sig.Data, pubkey.Data)
+	if !ok {
+		return false
+	}
+	if valid {
+		n++
+	}
+	se.pushData(EncodeNum(n))
+	return true
+}
+
+// checkSchnorrSig checks a tapscript signature, reporting whether it counts as valid. An
+// empty signature is simply false, but any other that doesn't verify fails the script, as
+// does running over the sigop budget. Keys that aren't 32 bytes are reserved for future
+// soft forks and accept any signature.
+func (se *ScriptEngine) checkSchnorrSig(sig, pubkey []byte) (valid bool, ok bool) {
+	if len(sig) > 0 {
+		if se.budget -= VALIDATION_WEIGHT_PER_SIGOP_PASSED; se.budget < 0 {
+			return false, se.fail(ErrTapscriptValidationWeight)
+		}
+	}
+	switch {
+	case len(pubkey) == 0:
+		return false, se.fail(ErrPubkeyType)
+	case len(sig) == 0:
+		return false, true
+	case len(pubkey) != eccmath.XONLY_PUBKEY_SIZE:
+		return true, true
+	}
+
+	hashType := encoding.SIGHASH_DEFAULT
+	switch len(sig) {
+	case eccmath.SCHNORR_SIG_SIZE:
+	case eccmath.SCHNORR_SIG_SIZE + 1:
+		hashType = uint32(sig[eccmath.SCHNORR_SIG_SIZE])
+		if hashType == encoding.SIGHASH_DEFAULT {
+			return false, se.fail(ErrSchnorrSigHashType) // DEFAULT is only ever implied
+		}
+		sig = sig[:eccmath.SCHNORR_SIG_SIZE]
+	default:
+		return false, se.fail(ErrSchnorrSigSize)
+	}
+	if se.tapSigHasher == nil {
+		return false, se.fail(ErrSchnorrSig)
+	}
+	z, err := se.tapSigHasher(hashType, se.codeSepPos)
+	if err != nil {
+		return false, se.fail(fmt.Errorf("%w: %v", ErrSchnorrSigHashType, err))
+	}
+	P, err := eccmath.NewBitcoin().LiftX(pubkey)
+	if err != nil || !P.VerifySchnorr(z, sig) {
+		return false, se.fail(ErrSchnorrSig)
+	}
+	return true, true
+}
+
+// isOpSuccess reports whether opcode is one of BIP 342's OP_SUCCESSx, which make a
+// tapscript succeed unconditionally so soft forks can give them meaning
+func isOpSuccess(opcode byte) bool {
+	switch {
+	case opcode == 0x50, opcode == 0x62, opcode >= 0x7e && opcode <= 0x81, opcode >= 0x83 && opcode <= 0x86,
+		opcode >= 0x89 && opcode <= 0x8a, opcode >= 0x8d && opcode <= 0x8e, opcode >= 0x95 && opcode <= 0x99,
+		opcode >= 0xbb && opcode <= 0xfe:
+		return true
+	}
+	return false
+}
+
+// hasOpSuccess scans raw script for an OP_SUCCESSx, failing on a push that runs past the
+// end before one is found
+func hasOpSuccess(raw []byte) (bool, error) {
+	for i := 0; i < len(raw); {
+		opcode := raw[i]
+		i++
+		var n int
+		switch {
+		case opcode >= 0x01 && opcode <= 0x4b:
+			n = int(opcode)
+		case opcode == OP_PUSHDATA1 && i+1 <= len(raw):
+			n = int(raw[i])
+			i++
+		case opcode == OP_PUSHDATA2 && i+2 <= len(raw):
+			n = int(binary.LittleEndian.Uint16(raw[i:]))
+			i += 2
+		case opcode == OP_PUSHDATA4 && i+4 <= len(raw):
+			n = int(binary.LittleEndian.Uint32(raw[i:]))
+			i += 4
+		case opcode >= OP_PUSHDATA1 && opcode <= OP_PUSHDATA4:
+			return false, ErrMalformedScript
+		case isOpSuccess(opcode):
+			return true, nil
+		}
+		if n > len(raw)-i {
+			return false, ErrMalformedScript
+		}
+		i += n
+	}
+	return false, nil
+}
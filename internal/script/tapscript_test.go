@@ -0,0 +1,154 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// tapHash stands in for the BIP 341 hash in tests, committing to the same things: the
+// leaf, the sighash type and the OP_CODESEPARATOR position
+func tapHash(leafHash []byte, hashType, codeSepPos uint32) []byte {
+	msg := binary.LittleEndian.AppendUint32(append([]byte{}, leafHash...), hashType)
+	h := sha256.Sum256(binary.LittleEndian.AppendUint32(msg, codeSepPos))
+	return h[:]
+}
+
+func tapSig(t *testing.T, key *keys.PrivateKey, leafHash []byte, hashType, codeSepPos uint32) []byte {
+	t.Helper()
+	sig, err := key.SignSchnorr(tapHash(leafHash, hashType, codeSepPos), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashType != encoding.SIGHASH_DEFAULT {
+		sig = append(sig, byte(hashType))
+	}
+	return sig
+}
+
+func TestTapscript(t *testing.T) {
+	keyA := keys.NewPrivateKey(big.NewInt(2384))
+	keyB := keys.NewPrivateKey(big.NewInt(4832))
+	pubA, pubB := keyA.PublicKey(), keyB.PublicKey()
+	xA, xB := hex.EncodeToString(pubA.SerializeXOnly()), hex.EncodeToString(pubB.SerializeXOnly())
+	sigA := tapSig(t, keyA, nil, encoding.SIGHASH_DEFAULT, TAPROOT_NO_CODESEP)
+	sigB := tapSig(t, keyB, nil, encoding.SIGHASH_DEFAULT, TAPROOT_NO_CODESEP)
+	hasher := func(hashType, codeSepPos uint32) ([]byte, error) {
+		return tapHash(nil, hashType, codeSepPos), nil
+	}
+
+	tests := []struct {
+		name   string
+		asm    string
+		stack  [][]byte
+		budget int
+		want   error
+	}{
+		{"CHECKSIG", xA + " OP_CHECKSIG", [][]byte{sigA}, 1000, nil},
+		{"SIGHASH_ALL", xA + " OP_CHECKSIG", [][]byte{tapSig(t, keyA, nil, encoding.SIGHASH_ALL, TAPROOT_NO_CODESEP)}, 1000, nil},
+		{"2-of-2 CHECKSIGADD", xA + " OP_CHECKSIG " + xB + " OP_CHECKSIGADD 2 OP_NUMEQUAL", [][]byte{sigB, sigA}, 1000, nil},
+		{"1-of-2 CHECKSIGADD", xA + " OP_CHECKSIG " + xB + " OP_CHECKSIGADD 1 OP_NUMEQUAL", [][]byte{sigB, {}}, 1000, nil},
+		{"empty signature is false", xA + " OP_CHECKSIG OP_NOT", [][]byte{{}}, 1000, nil},
+		{"wrong signature fails the script", xA + " OP_CHECKSIG OP_NOT", [][]byte{sigB}, 1000, ErrSchnorrSig},
+		{"explicit DEFAULT byte", xA + " OP_CHECKSIG", [][]byte{append(bytes.Clone(sigA), 0x00)}, 1000, ErrSchnorrSigHashType},
+		{"short signature", xA + " OP_CHECKSIG", [][]byte{sigA[:63]}, 1000, ErrSchnorrSigSize},
+		{"empty key", "0 OP_CHECKSIG", [][]byte{sigA}, 1000, ErrPubkeyType},
+		{"unknown key type", "02" + xA + " OP_CHECKSIG", [][]byte{{0x01}}, 1000, nil},
+		{"OP_CODESEPARATOR", "OP_CODESEPARATOR " + xA + " OP_CHECKSIG", [][]byte{tapSig(t, keyA, nil, encoding.SIGHASH_DEFAULT, 0)}, 1000, nil},
+		{"signed before OP_CODESEPARATOR", "OP_CODESEPARATOR " + xA + " OP_CHECKSIG", [][]byte{sigA}, 1000, ErrSchnorrSig},
+		{"OP_CHECKMULTISIG", "1 " + xA + " 1 OP_CHECKMULTISIG", [][]byte{{}, sigA}, 1000, ErrTapscriptCheckMultiSig},
+		{"OP_SUCCESSx", "OP_RETURN OP_CAT", nil, 0, nil},
+		{"MINIMALIF", "OP_IF 1 OP_ENDIF", [][]byte{{0x02}}, 1000, ErrMinimalIf},
+		{"CLEANSTACK", "1", [][]byte{{0x01}}, 1000, ErrCleanStack},
+		{"no opcode limit", strings.Repeat("OP_NOP ", MAX_OPS_PER_SCRIPT+1) + "1", nil, 0, nil},
+		{"stack over 1000 items", "1", make([][]byte, MAX_STACK_SIZE+1), 0, ErrStackSize},
+		{"sigops within budget", strings.Repeat("OP_DUP "+xA+" OP_CHECKSIGVERIFY ", 19) + xA + " OP_CHECKSIG", [][]byte{sigA}, 1000, nil},
+		{"sigops over budget", strings.Repeat("OP_DUP "+xA+" OP_CHECKSIGVERIFY ", 20) + xA + " OP_CHECKSIG", [][]byte{sigA}, 1000, ErrTapscriptValidationWeight},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tapscript, err := ParseAsm(tt.asm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			engine := NewTapscriptEngine(tapscript, tt.stack, hasher, tt.budget)
+			ok, err := engine.Execute(nil)
+			if tt.want == nil && (!ok || err != nil) || tt.want != nil && (ok || !errors.Is(err, tt.want)) {
+				t.Fatalf("got %v, %v, want %v", ok, err, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.name, err)
+		})
+	}
+
+	// OP_CHECKSIGADD is tapscript only
+	legacy := NewScriptEngine(NewScript([]ScriptCommand{{Data: sigA, IsData: true}, op(OP_O), {Data: pubA.SerializeXOnly(), IsData: true}, op(OP_CHECKSIGADD)}))
+	if ok, err := legacy.Execute(nil); ok || !errors.Is(err, ErrBadOpcode) {
+		t.Fatalf("OP_CHECKSIGADD outside tapscript: %v, %v", ok, err)
+	}
+	t.Logf("✓ OP_CHECKSIGADD is an unknown opcode outside tapscript")
+}
+
+func TestTaprootScriptPath(t *testing.T) {
+	internal := keys.NewPrivateKey(big.NewInt(341))
+	internalPub := internal.PublicKey()
+	internalKey := internalPub.SerializeXOnly()
+	key := keys.NewPrivateKey(big.NewInt(342))
+	pub := key.PublicKey()
+
+	// a two leaf tree: a signature check, and an unknown leaf version anyone can spend
+	checkSig, _ := ParseAsm(hex.EncodeToString(pub.SerializeXOnly()) + " OP_CHECKSIG")
+	rawCheckSig, _ := checkSig.RawBytes()
+	const futureVersion byte = 0xc2
+	rawFuture := []byte{OP_RETURN}
+	leaf := TapLeafHash(TAPROOT_LEAF_TAPSCRIPT, rawCheckSig)
+	future := TapLeafHash(futureVersion, rawFuture)
+	outputKey, err := keys.TweakPublicKey(internalKey, TapBranchHash(leaf, future))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parity := byte(0)
+	if !outputKey.HasEvenY() {
+		parity = 1
+	}
+	control := func(version byte, sibling []byte) []byte {
+		return append(append([]byte{version | parity}, internalKey...), sibling...)
+	}
+	sigHasher := func(leafHash []byte, hashType, codeSepPos uint32) ([]byte, error) {
+		return tapHash(leafHash, hashType, codeSepPos), nil
+	}
+	sig := tapSig(t, key, leaf, encoding.SIGHASH_DEFAULT, TAPROOT_NO_CODESEP)
+
+	flipped := control(TAPROOT_LEAF_TAPSCRIPT, future)
+	flipped[0] ^= 1
+	tests := []struct {
+		name  string
+		stack [][]byte
+		want  error
+	}{
+		{"tapscript leaf", [][]byte{sig, rawCheckSig, control(TAPROOT_LEAF_TAPSCRIPT, future)}, nil},
+		{"future leaf version", [][]byte{rawFuture, control(futureVersion, leaf)}, nil},
+		{"signature for another leaf", [][]byte{tapSig(t, key, future, encoding.SIGHASH_DEFAULT, TAPROOT_NO_CODESEP), rawCheckSig, control(TAPROOT_LEAF_TAPSCRIPT, future)}, ErrSchnorrSig},
+		{"wrong parity", [][]byte{sig, rawCheckSig, flipped}, ErrWitnessProgramMismatch},
+		{"wrong sibling", [][]byte{sig, rawCheckSig, control(TAPROOT_LEAF_TAPSCRIPT, leaf)}, ErrWitnessProgramMismatch},
+		{"script not in the tree", [][]byte{sig, append(bytes.Clone(rawCheckSig), OP_NOP), control(TAPROOT_LEAF_TAPSCRIPT, future)}, ErrWitnessProgramMismatch},
+		{"wrong leaf version", [][]byte{sig, rawCheckSig, control(futureVersion, future)}, ErrWitnessProgramMismatch},
+		{"control block size", [][]byte{sig, rawCheckSig, control(TAPROOT_LEAF_TAPSCRIPT, future[:31])}, ErrTaprootControlBlock},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := VerifyTaprootScriptPath(outputKey.SerializeXOnly(), tt.stack, 200, sigHasher)
+			var se *ScriptError
+			if tt.want == nil && (!ok || err != nil) || tt.want != nil && (ok || !errors.As(err, &se) || !errors.Is(err, tt.want)) {
+				t.Fatalf("got %v, %v, want %v", ok, err, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.name, err)
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package transactions
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+)
+
+// SortBIP69 orders the inputs by previous txid and then index, and the outputs by amount
+// and then scriptPubKey bytes, as BIP 69 describes, so the order leaks nothing about which
+// output is change. Txids compare in display byte order. Sorting changes what signatures
+// commit to, so sort before signing.
+func (t *Transaction) SortBIP69() error {
+	slices.SortStableFunc(t.Inputs, func(a, b TxIn) int {
+		if c := bytes.Compare(a.PrevTx, b.PrevTx); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.PrevIdx, b.PrevIdx)
+	})
+
+	type keyed struct {
+		out    TxOut
+		script []byte
+	}
+	outs := make([]keyed, len(t.Outputs))
+	for i := range t.Outputs {
+		raw, err := t.Outputs[i].RawScriptBytes()
+		if err != nil {
+			return err
+		}
+		outs[i] = keyed{t.Outputs[i], raw}
+	}
+	slices.SortStableFunc(outs, func(a, b keyed) int {
+		if c := cmp.Compare(a.out.Amount, b.out.Amount); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.script, b.script)
+	})
+	for i, o := range outs {
+		t.Outputs[i] = o.out
+	}
+
+	t.ClearCache()
+	return nil
+}
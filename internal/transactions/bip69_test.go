@@ -0,0 +1,67 @@
+package transactions
+
+import (
+	"bytes"
+	"go-bitcoin/internal/address"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"testing"
+)
+
+func TestSortBIP69(t *testing.T) {
+	txid := func(first, last byte) []byte {
+		id := bytes.Repeat([]byte{0x55}, 32)
+		id[0], id[31] = first, last
+		return id
+	}
+	// display order decides: 0x01... sorts before 0x02... whatever the last byte
+	tx := NewTransaction(1, []TxIn{
+		NewTxIn(txid(0x02, 0x00), 0, SEQUENCE_FINAL),
+		NewTxIn(txid(0x01, 0xff), 1, SEQUENCE_FINAL),
+		NewTxIn(txid(0x01, 0xff), 0, SEQUENCE_FINAL),
+	}, []TxOut{
+		{Amount: 2_000, ScriptPubKey: script.P2pkhScript(make([]byte, 20))},
+		{Amount: 1_000, ScriptPubKey: script.P2wpkhScript(bytes.Repeat([]byte{0x02}, 20))},
+		{Amount: 1_000, ScriptPubKey: script.P2wpkhScript(bytes.Repeat([]byte{0x01}, 20))},
+	}, 0, false, false)
+	if err := tx.SortBIP69(); err != nil {
+		t.Fatal(err)
+	}
+
+	wantIns := []struct {
+		first byte
+		index uint32
+	}{{0x01, 0}, {0x01, 1}, {0x02, 0}}
+	for i, in := range tx.Inputs {
+		if in.PrevTx[0] != wantIns[i].first || in.PrevIdx != wantIns[i].index {
+			t.Errorf("input %d = %s, want %02x...:%d", i, in, wantIns[i].first, wantIns[i].index)
+		}
+	}
+	if tx.Outputs[0].Amount != 1_000 || tx.Outputs[0].ScriptPubKey.CommandStack[1].Data[0] != 0x01 ||
+		tx.Outputs[1].ScriptPubKey.CommandStack[1].Data[0] != 0x02 || tx.Outputs[2].Amount != 2_000 {
+		t.Errorf("outputs not sorted by amount then script: %v", tx.Outputs)
+	}
+	t.Logf("✓ Inputs sort by txid then index, outputs by amount then script")
+
+	key := keys.NewPrivateKey(big.NewInt(69))
+	pub := key.PublicKey()
+	wpkh := script.P2wpkhScript(encoding.Hash160(pub.Serialize(true)))
+	change := wpkhAddress(t, key, address.MAINNET)
+	dest := wpkhAddress(t, keys.NewPrivateKey(big.NewInt(1)), address.MAINNET)
+	built, err := NewBuilder().
+		AddInput(utxo(9, 30_000, wpkh)).
+		AddInput(utxo(3, 30_000, wpkh)).
+		PayToAddress(dest, 50_000).
+		SetChangeAddress(change).
+		SortBIP69().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if built.Inputs[0].PrevTx[0] != 3 || built.Outputs[0].Amount >= built.Outputs[1].Amount {
+		t.Errorf("builder didn't sort: inputs %v, outputs %v", built.Inputs, built.Outputs)
+	}
+	t.Logf("✓ Builder applies BIP 69 ordering when asked, change included")
+}
@@ -0,0 +1,354 @@
+package transactions
+
+import (
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/address"
+	"go-bitcoin/internal/script"
+	"math"
+)
+
+// Builder size and policy constants
+const (
+	DUST_RELAY_FEE_RATE uint64  = 3   // sat/vB, Bitcoin Core's default dust relay fee
+	DEFAULT_FEE_RATE    float64 = 1.0 // sat/vB, the minimum relay fee
+	MAX_NULL_DATA_SIZE  int     = 80  // bytes of OP_RETURN data relayed by default
+
+	// estimated signature sizes, assuming 72 byte DER signatures and compressed keys
+	P2PKH_SCRIPTSIG_SIZE  int = 1 + 72 + 1 + 33 // push sig, push pubkey
+	P2SH_P2WPKH_SIG_SIZE  int = 1 + 22          // push of the 22 byte redeem script
+	P2WPKH_WITNESS_SIZE   int = 1 + 1 + 72 + 1 + 33
+	P2TR_KEY_WITNESS_SIZE int = 1 + 1 + 64 // SIGHASH_DEFAULT signature
+
+	// size of an input spending an output, as Bitcoin Core's dust policy counts it
+	DUST_SPEND_SIZE         int = 32 + 4 + 1 + 107 + 4
+	DUST_WITNESS_SPEND_SIZE int = 32 + 4 + 1 + 107/WITNESS_SCALE_FACTOR + 4
+)
+
+var (
+	ErrNoInputs          = errors.New("transaction has no inputs")
+	ErrNoOutputs         = errors.New("transaction has no outputs")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrDustOutput        = errors.New("output amount below dust threshold")
+	ErrNoChangeAddress   = errors.New("change needed but no change address set")
+	ErrUnknownInputType  = errors.New("can't estimate the size of input")
+	ErrNetworkMismatch   = errors.New("address is for a different network")
+	ErrFeeRate           = errors.New("invalid fee rate")
+	ErrDataOutput        = errors.New("non-standard data output")
+)
+
+// Utxo is an unspent output the builder can spend: where it is and what it holds
+type Utxo struct {
+	OutPoint OutPoint
+	Output   TxOut
+}
+
+// Builder assembles an unsigned transaction paying to addresses at a target fee rate,
+// adding change when what's left over is worth keeping. The first error is kept and
+// returned by Build, so calls chain:
+//
+//	tx, err := NewBuilder().AddInput(utxo).PayToAddress(addr, 50_000).SetChangeAddress(change).Build()
+type Builder struct {
+	inputs  []Utxo
+	outputs []TxOut
+	feeRate float64
+	change  *address.Address
+	network *address.Network
+	bip69   bool
+	err     error
+}
+
+func NewBuilder() *Builder {
+	return &Builder{feeRate: DEFAULT_FEE_RATE}
+}
+
+// AddInput spends utxo
+func (b *Builder) AddInput(utxo Utxo) *Builder {
+	b.inputs = append(b.inputs, utxo)
+	return b
+}
+
+// PayToAddress adds an output paying amount satoshis to addr
+func (b *Builder) PayToAddress(addr string, amount uint64) *Builder {
+	if b.err != nil {
+		return b
+	}
+	a, err := b.parseAddress(addr)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	lock, err := script.AddressScript(a)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	out := TxOut{Amount: amount, ScriptPubKey: lock}
+	dust, err := DustThreshold(out)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	if amount < dust {
+		b.err = fmt.Errorf("%w: %d < %d paying %s", ErrDustOutput, amount, dust, addr)
+		return b
+	}
+	b.outputs = append(b.outputs, out)
+	return b
+}
+
+// AddDataOutput adds a zero value OP_RETURN output carrying data. Standard relay allows
+// one per transaction, with at most MAX_NULL_DATA_SIZE bytes.
+func (b *Builder) AddDataOutput(data []byte) *Builder {
+	if b.err != nil {
+		return b
+	}
+	if len(data) > MAX_NULL_DATA_SIZE {
+		b.err = fmt.Errorf("%w: %d bytes, limit %d", ErrDataOutput, len(data), MAX_NULL_DATA_SIZE)
+		return b
+	}
+	for _, out := range b.outputs {
+		if out.ScriptPubKey.IsNullDataScriptPubKey() {
+			b.err = fmt.Errorf("%w: more than one OP_RETURN output", ErrDataOutput)
+			return b
+		}
+	}
+	b.outputs = append(b.outputs, TxOut{Amount: 0, ScriptPubKey: script.NullDataScript(data)})
+	return b
+}
+
+// SetFeeRate sets the fee rate to target, in satoshis per virtual byte
+func (b *Builder) SetFeeRate(satPerVb float64) *Builder {
+	if b.err != nil {
+		return b
+	}
+	if satPerVb <= 0 || math.IsNaN(satPerVb) || math.IsInf(satPerVb, 0) {
+		b.err = fmt.Errorf("%w: %v sat/vB", ErrFeeRate, satPerVb)
+		return b
+	}
+	b.feeRate = satPerVb
+	return b
+}
+
+// SortBIP69 has Build order the inputs and outputs as BIP 69 describes, so the change
+// output can't be picked out by its position
+func (b *Builder) SortBIP69() *Builder {
+	b.bip69 = true
+	return b
+}
+
+// SetChangeAddress sets where any non-dust leftover is sent
+func (b *Builder) SetChangeAddress(addr string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	a, err := b.parseAddress(addr)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	b.change = a
+	return b
+}
+
+// parseAddress parses addr and checks it's on the same network as earlier addresses
+func (b *Builder) parseAddress(addr string) (*address.Address, error) {
+	a, err := address.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if b.network == nil {
+		b.network = &a.Network
+	} else if *b.network != a.Network {
+		return nil, fmt.Errorf("%w: %s", ErrNetworkMismatch, addr)
+	}
+	return a, nil
+}
+
+// Build returns the unsigned transaction. The fee is the estimated vsize times the fee
+// rate; a change output is added only if what's left after that fee isn't dust, and
+// otherwise the leftover goes to the fee. Inputs carry their previous outputs so they
+// can be signed without fetching them.
+func (b *Builder) Build() (Transaction, error) {
+	if b.err != nil {
+		return Transaction{}, b.err
+	}
+	if len(b.inputs) == 0 {
+		return Transaction{}, ErrNoInputs
+	}
+	if len(b.outputs) == 0 {
+		return Transaction{}, ErrNoOutputs
+	}
+
+	var totalIn, totalOut uint64
+	ins := make([]TxIn, len(b.inputs))
+	for i, utxo := range b.inputs {
+		ins[i] = NewTxIn(utxo.OutPoint.TxID[:], utxo.OutPoint.Index, SEQUENCE_FINAL)
+		ins[i].SetPrevOut(utxo.Output)
+		totalIn += utxo.Output.Amount
+	}
+	for _, out := range b.outputs {
+		totalOut += out.Amount
+	}
+	testnet := b.network != nil && *b.network == address.TESTNET
+	tx := NewTransaction(2, ins, append([]TxOut{}, b.outputs...), 0, testnet, false)
+
+	fee, err := b.estimateFee(&tx)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if totalIn < totalOut+fee {
+		return Transaction{}, fmt.Errorf("%w: have %d, need %d plus %d fee", ErrInsufficientFunds, totalIn, totalOut, fee)
+	}
+
+	// the leftover is worth a change output if it still clears dust once that output is paid for
+	leftover := totalIn - totalOut - fee
+	if leftover == 0 {
+		return b.finish(tx)
+	}
+	var changeOut TxOut
+	if b.change != nil {
+		lock, err := script.AddressScript(b.change)
+		if err != nil {
+			return Transaction{}, err
+		}
+		changeOut = TxOut{ScriptPubKey: lock}
+	} else {
+		// size the check as a P2WPKH change output
+		changeOut = TxOut{ScriptPubKey: script.P2wpkhScript(make([]byte, 20))}
+	}
+	withChange := tx
+	withChange.Outputs = append(append([]TxOut{}, tx.Outputs...), changeOut)
+	changeFee, err := b.estimateFee(&withChange)
+	if err != nil {
+		return Transaction{}, err
+	}
+	dust, err := DustThreshold(changeOut)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if totalIn < totalOut+changeFee+dust {
+		return b.finish(tx) // change would be dust: leave it to the fee
+	}
+	if b.change == nil {
+		return Transaction{}, fmt.Errorf("%w: %d sats left over", ErrNoChangeAddress, leftover)
+	}
+	withChange.Outputs[len(withChange.Outputs)-1].Amount = totalIn - totalOut - changeFee
+	return b.finish(withChange)
+}
+
+// finish checks a built transaction will be under the standard weight once signed, and
+// applies BIP 69 ordering if it was asked for
+func (b *Builder) finish(tx Transaction) (Transaction, error) {
+	weight, err := estimateWeight(&tx)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if weight > MAX_STANDARD_TX_WEIGHT {
+		return Transaction{}, fmt.Errorf("%w: about %d WU with %d inputs, limit %d", ErrTxTooHeavy, weight, len(tx.Inputs), MAX_STANDARD_TX_WEIGHT)
+	}
+	if b.bip69 {
+		if err := tx.SortBIP69(); err != nil {
+			return Transaction{}, err
+		}
+	}
+	return tx, nil
+}
+
+// estimateFee returns the fee for tx at the builder's rate, once its inputs are signed
+func (b *Builder) estimateFee(tx *Transaction) (uint64, error) {
+	vsize, err := EstimateVSize(tx)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(math.Ceil(float64(vsize) * b.feeRate)), nil
+}
+
+// EstimateVSize estimates the virtual size of an unsigned transaction once it's signed,
+// from the types of the outputs its inputs spend. P2SH inputs are assumed to be nested
+// P2WPKH; other scripts whose unlocking size can't be known, like P2WSH, are an error.
+func EstimateVSize(tx *Transaction) (int, error) {
+	weight, err := estimateWeight(tx)
+	if err != nil {
+		return 0, err
+	}
+	return vsizeFromWeight(weight), nil
+}
+
+func estimateWeight(tx *Transaction) (int, error) {
+	base, err := tx.SerializeLegacy()
+	if err != nil {
+		return 0, err
+	}
+	baseSize := len(base)
+	witnessSize := 0
+	for i, txin := range tx.Inputs {
+		if !txin.HasPrevOut() {
+			return 0, fmt.Errorf("%w %d: previous output not known", ErrUnknownInputType, i)
+		}
+		switch txin.PrevScriptPubKey.Type().Kind {
+		case script.P2PKH:
+			baseSize += P2PKH_SCRIPTSIG_SIZE
+		case script.P2WPKH:
+			witnessSize += P2WPKH_WITNESS_SIZE
+		case script.P2SH:
+			baseSize += P2SH_P2WPKH_SIG_SIZE
+			witnessSize += P2WPKH_WITNESS_SIZE
+		case script.P2TR:
+			witnessSize += P2TR_KEY_WITNESS_SIZE
+		default:
+			return 0, fmt.Errorf("%w %d: unsupported script type", ErrUnknownInputType, i)
+		}
+	}
+	if witnessSize > 0 {
+		witnessSize += 2 // marker and flag
+		// inputs without a witness still serialize an empty stack
+		for _, txin := range tx.Inputs {
+			if txin.PrevScriptPubKey.IsP2pkhScriptPubKey() {
+				witnessSize++
+			}
+		}
+	}
+	return baseSize*WITNESS_SCALE_FACTOR + witnessSize, nil
+}
+
+// DustThreshold returns the smallest amount out can carry without being dust under
+// Bitcoin Core's default policy: less than the cost of spending it at the dust relay fee
+func DustThreshold(out TxOut) (uint64, error) {
+	return dustThreshold(&out, float64(DUST_RELAY_FEE_RATE))
+}
+
+// IsDust reports whether the output is worth less than it would cost to spend at feeRate
+// sat/vB, as Bitcoin Core's -dustrelayfee counts it: 546 sats for P2PKH and 294 for
+// P2WPKH at the default DUST_RELAY_FEE_RATE. Every witness program is priced as a witness
+// spend. Unspendable outputs, starting with OP_RETURN or over MAX_SCRIPT_SIZE bytes, are
+// never dust, and a feeRate of 0 turns the check off.
+func (t *TxOut) IsDust(feeRate float64) (bool, error) {
+	dust, err := dustThreshold(t, feeRate)
+	if err != nil {
+		return false, err
+	}
+	return t.Amount < dust, nil
+}
+
+func dustThreshold(out *TxOut, feeRate float64) (uint64, error) {
+	if feeRate < 0 || math.IsNaN(feeRate) || math.IsInf(feeRate, 0) {
+		return 0, fmt.Errorf("%w: %v sat/vB", ErrFeeRate, feeRate)
+	}
+	raw, err := out.ScriptPubKey.RawBytes()
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) > 0 && raw[0] == script.OP_RETURN || len(raw) > script.MAX_SCRIPT_SIZE {
+		return 0, nil // unspendable, so there's no spend to price
+	}
+	ser, err := out.Serialize()
+	if err != nil {
+		return 0, err
+	}
+	spendSize := DUST_SPEND_SIZE
+	if out.ScriptPubKey.IsWitnessProgram() {
+		spendSize = DUST_WITNESS_SPEND_SIZE
+	}
+	return uint64(math.Ceil(float64(len(ser)+spendSize) * feeRate)), nil
+}
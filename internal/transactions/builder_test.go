@@ -0,0 +1,263 @@
+package transactions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/address"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"testing"
+)
+
+func wpkhAddress(t *testing.T, key *keys.PrivateKey, net address.Network) string {
+	t.Helper()
+	pub := key.PublicKey()
+	a, err := address.FromWitnessProgram(0, encoding.Hash160(pub.Serialize(true)), net)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.String
+}
+
+func utxo(n byte, amount uint64, lock script.Script) Utxo {
+	var op OutPoint
+	copy(op.TxID[:], bytes.Repeat([]byte{n}, 32))
+	return Utxo{OutPoint: op, Output: TxOut{Amount: amount, ScriptPubKey: lock}}
+}
+
+func TestBuilder(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(4242))
+	pub := key.PublicKey()
+	wpkh := script.P2wpkhScript(encoding.Hash160(pub.Serialize(true)))
+	dest := wpkhAddress(t, keys.NewPrivateKey(big.NewInt(1)), address.MAINNET)
+	change := wpkhAddress(t, key, address.MAINNET)
+
+	// 1 P2WPKH input, 2 P2WPKH outputs: 141 vB
+	tx, err := NewBuilder().
+		AddInput(utxo(1, 100_000, wpkh)).
+		PayToAddress(dest, 50_000).
+		SetFeeRate(2).
+		SetChangeAddress(change).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vsize, err := EstimateVSize(&tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vsize != 141 {
+		t.Errorf("vsize = %d, want 141", vsize)
+	}
+	if len(tx.Outputs) != 2 || tx.Outputs[1].Amount != 100_000-50_000-282 {
+		t.Fatalf("outputs = %v, want change of %d", tx.Outputs, 100_000-50_000-282)
+	}
+	if fee, _ := tx.Fee(false); fee != 282 {
+		t.Errorf("fee = %d, want 282", fee)
+	}
+	if !tx.Outputs[1].ScriptPubKey.IsP2wpkhScriptPubKey() || tx.IsTestnet {
+		t.Error("change output or network wrong")
+	}
+	t.Logf("✓ Fee is the estimated vsize times the fee rate, with the rest returned as change")
+
+	// 1 input, 1 output is 110 vB; 100 sats over that can't pay for a change output
+	tx, err = NewBuilder().
+		AddInput(utxo(1, 50_000+220+100, wpkh)).
+		PayToAddress(dest, 50_000).
+		SetFeeRate(2).
+		SetChangeAddress(change).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Outputs) != 1 {
+		t.Fatalf("dust change was kept: %v", tx.Outputs)
+	}
+	if fee, _ := tx.Fee(false); fee != 320 {
+		t.Errorf("fee = %d, want the 320 sats left over", fee)
+	}
+	// without a change address, that dust is still fine to drop
+	if _, err := NewBuilder().AddInput(utxo(1, 50_000+220+100, wpkh)).PayToAddress(dest, 50_000).SetFeeRate(2).Build(); err != nil {
+		t.Errorf("dust leftover without a change address: %v", err)
+	}
+	t.Logf("✓ Change below dust is dropped and goes to the fee")
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name string
+			b    *Builder
+			want error
+		}{
+			{"no inputs", NewBuilder().PayToAddress(dest, 50_000), ErrNoInputs},
+			{"no outputs", NewBuilder().AddInput(utxo(1, 100_000, wpkh)), ErrNoOutputs},
+			{"insufficient", NewBuilder().AddInput(utxo(1, 50_100, wpkh)).PayToAddress(dest, 50_000), ErrInsufficientFunds},
+			{"dust output", NewBuilder().AddInput(utxo(1, 100_000, wpkh)).PayToAddress(dest, 293), ErrDustOutput},
+			{"no change address", NewBuilder().AddInput(utxo(1, 100_000, wpkh)).PayToAddress(dest, 50_000), ErrNoChangeAddress},
+			{"fee rate", NewBuilder().SetFeeRate(0), ErrFeeRate},
+			{"unknown input", NewBuilder().AddInput(utxo(1, 100_000, script.P2wshScript(make([]byte, 32)))).PayToAddress(dest, 50_000), ErrUnknownInputType},
+			{"network", NewBuilder().PayToAddress(dest, 50_000).SetChangeAddress(wpkhAddress(t, key, address.TESTNET)), ErrNetworkMismatch},
+		}
+		for _, tt := range tests {
+			if _, err := tt.b.Build(); !errors.Is(err, tt.want) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+			}
+		}
+		if _, err := NewBuilder().PayToAddress("bc1qnotanaddress", 50_000).Build(); err == nil {
+			t.Error("invalid address accepted")
+		}
+		t.Logf("✓ Missing inputs or outputs, short funds, dust and mismatched networks are rejected")
+	})
+
+	t.Run("sign", func(t *testing.T) {
+		h160 := encoding.Hash160(pub.Serialize(true))
+		outputKey, err := keys.TweakPublicKey(pub.SerializeXOnly(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err := address.FromWitnessProgram(1, outputKey.SerializeXOnly(), address.TESTNET)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err := NewBuilder().
+			AddInput(utxo(1, 30_000, script.P2pkhScript(h160))).
+			AddInput(utxo(2, 40_000, script.P2trScript(outputKey.SerializeXOnly()))).
+			PayToAddress(script.P2pkhAddress(h160, true), 25_000).
+			SetFeeRate(5).
+			SetChangeAddress(tr.String).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tx.IsTestnet || len(tx.Outputs) != 2 {
+			t.Fatalf("testnet = %v, outputs = %v", tx.IsTestnet, tx.Outputs)
+		}
+		estimate, err := EstimateVSize(&tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.SignInput(0, *key, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.SignInputTaproot(1, *key, nil, encoding.SIGHASH_DEFAULT); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := tx.Verify(); err != nil || !ok {
+			t.Fatalf("signed transaction doesn't verify: %v", err)
+		}
+
+		actual, err := tx.VSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual > estimate || estimate-actual > 2 {
+			t.Errorf("signed vsize = %d, estimated %d", actual, estimate)
+		}
+		t.Logf("✓ Built transaction signs and verifies, at %d vB against %d estimated", actual, estimate)
+	})
+}
+
+func TestBuilderDataOutput(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(4243))
+	pub := key.PublicKey()
+	wpkh := script.P2wpkhScript(encoding.Hash160(pub.Serialize(true)))
+	change := wpkhAddress(t, key, address.MAINNET)
+
+	data := bytes.Repeat([]byte{0xd7}, MAX_NULL_DATA_SIZE)
+	tx, err := NewBuilder().
+		AddInput(utxo(1, 10_000, wpkh)).
+		AddDataOutput(data).
+		SetChangeAddress(change).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := tx.Outputs[0]
+	if !out.ScriptPubKey.IsNullDataScriptPubKey() || out.Amount != 0 || len(tx.Outputs) != 2 {
+		t.Fatalf("outputs = %v, want a zero value data output and change", tx.Outputs)
+	}
+	raw, err := out.RawScriptBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// OP_RETURN OP_PUSHDATA1 80 <data>
+	if want := append([]byte{script.OP_RETURN, script.OP_PUSHDATA1, 80}, data...); !bytes.Equal(raw, want) {
+		t.Errorf("script = %x, want %x", raw, want)
+	}
+	t.Logf("✓ Data outputs carry up to 80 bytes at zero value, with the inputs returned as change")
+
+	if _, err := NewBuilder().AddInput(utxo(1, 10_000, wpkh)).AddDataOutput(append(data, 0)).Build(); !errors.Is(err, ErrDataOutput) {
+		t.Errorf("81 bytes: err = %v, want %v", err, ErrDataOutput)
+	}
+	if _, err := NewBuilder().AddInput(utxo(1, 10_000, wpkh)).AddDataOutput([]byte("a")).AddDataOutput([]byte("b")).Build(); !errors.Is(err, ErrDataOutput) {
+		t.Errorf("two data outputs: err = %v, want %v", err, ErrDataOutput)
+	}
+	t.Logf("✓ Oversized and repeated data outputs are rejected")
+}
+
+func TestIsDust(t *testing.T) {
+	witnessProgram := func(version int, program []byte) script.Script {
+		opcode := script.OP_O
+		if version > 0 {
+			opcode = script.OP_1 + byte(version-1)
+		}
+		return script.NewScript([]script.ScriptCommand{{Opcode: opcode}, {Data: program, IsData: true}})
+	}
+	h160 := bytes.Repeat([]byte{0x11}, 20)
+	h256 := bytes.Repeat([]byte{0x22}, 32)
+	rate := float64(DUST_RELAY_FEE_RATE)
+
+	type dustCase struct {
+		name    string
+		lock    script.Script
+		feeRate float64
+		dust    uint64 // smallest amount that isn't dust
+	}
+	tests := []dustCase{
+		{"P2PKH", script.P2pkhScript(h160), rate, 546},
+		{"P2SH", script.P2shScript(h160), rate, 540},
+		{"P2WPKH", script.P2wpkhScript(h160), rate, 294},
+		{"P2WSH", script.P2wshScript(h256), rate, 330},
+		{"P2TR", script.P2trScript(h256), rate, 330},
+		{"P2WPKH at 1 sat/vB", script.P2wpkhScript(h160), 1, 98},
+		{"P2WPKH at 2.5 sat/vB", script.P2wpkhScript(h160), 2.5, 245},
+		{"dust check off", script.P2pkhScript(h160), 0, 0},
+		{"OP_RETURN", script.NullDataScript([]byte("hello")), rate, 0},
+		{"OP_RETURN, nonstandard", script.NewScript([]script.ScriptCommand{{Opcode: script.OP_RETURN}, {Opcode: script.OP_CHECKSIG}}), rate, 0},
+		{"over 10,000 bytes", script.NewScript([]script.ScriptCommand{{Data: make([]byte, script.MAX_SCRIPT_SIZE), IsData: true}}), rate, 0},
+		{"witness v0 of 25 bytes", witnessProgram(0, make([]byte, 25)), rate, 309},
+	}
+	// every version from 2 to 16 is priced as a witness spend, as taproot is
+	for version := 2; version <= 16; version++ {
+		tests = append(tests,
+			dustCase{fmt.Sprintf("witness v%d", version), witnessProgram(version, h256), rate, 330},
+			dustCase{fmt.Sprintf("witness v%d of 2 bytes", version), witnessProgram(version, h256[:2]), rate, 240})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := TxOut{ScriptPubKey: tt.lock}
+			if tt.dust > 0 {
+				out.Amount = tt.dust - 1
+				if dust, err := out.IsDust(tt.feeRate); err != nil || !dust {
+					t.Fatalf("%d sats: dust = %v, %v", out.Amount, dust, err)
+				}
+			}
+			out.Amount = tt.dust
+			if dust, err := out.IsDust(tt.feeRate); err != nil || dust {
+				t.Fatalf("%d sats: dust = %v, %v", out.Amount, dust, err)
+			}
+			t.Logf("✓ %s: dust below %d sats", tt.name, tt.dust)
+		})
+	}
+
+	out := TxOut{Amount: 1000, ScriptPubKey: script.P2wpkhScript(h160)}
+	if _, err := out.IsDust(-1); !errors.Is(err, ErrFeeRate) {
+		t.Fatalf("negative fee rate: %v", err)
+	}
+	if threshold, _ := DustThreshold(out); threshold != 294 {
+		t.Fatalf("DustThreshold = %d, want 294", threshold)
+	}
+}
@@ -0,0 +1,119 @@
+package transactions
+
+import (
+	"fmt"
+	"go-bitcoin/internal/address"
+	"go-bitcoin/internal/script"
+	"math"
+)
+
+// packageProvider resolves outputs created inside a package before falling back to a
+// transaction's own provider
+type packageProvider struct {
+	outputs  PrevOutMap
+	fallback PrevOutProvider
+}
+
+func (p packageProvider) GetOutput(txid [32]byte, vout uint32) (uint64, script.Script, error) {
+	if out, ok := p.outputs[OutPoint{TxID: txid, Index: vout}]; ok {
+		return out.Amount, out.ScriptPubKey, nil
+	}
+	return p.fallback.GetOutput(txid, vout)
+}
+
+// PackageFeeRate returns the combined fee rate in sat/vB of a package of unconfirmed
+// transactions, such as a child and its parents: total fees over total vsize, which is
+// how miners weigh a child's ancestors. Inputs spending outputs of another transaction
+// in the package are resolved from it; the rest need known or fetchable previous outputs.
+func PackageFeeRate(pkg ...*Transaction) (float64, error) {
+	outputs := make(PrevOutMap)
+	for _, tx := range pkg {
+		txid, err := tx.Txid()
+		if err != nil {
+			return 0, err
+		}
+		for i, out := range tx.Outputs {
+			outputs[OutPoint{TxID: txid, Index: uint32(i)}] = out
+		}
+	}
+	var fees uint64
+	var vsize int
+	for _, tx := range pkg {
+		withPkg := *tx
+		withPkg.PrevOuts = packageProvider{outputs: outputs, fallback: tx.prevOutProvider(tx.IsTestnet)}
+		fee, err := withPkg.Fee(tx.IsTestnet)
+		if err != nil {
+			return 0, err
+		}
+		size, err := tx.VSize()
+		if err != nil {
+			return 0, err
+		}
+		fees += fee
+		vsize += size
+	}
+	if vsize == 0 {
+		return 0, ErrNoInputs
+	}
+	return float64(fees) / float64(vsize), nil
+}
+
+// BuildCPFP builds an unsigned child spending output vout of parent to addr, paying
+// enough that parent and child together reach feeRate sat/vB. The child pays at least
+// feeRate on its own size even when the parent needs no help. parent must be signed so
+// its size is known, and its inputs' values must be known or fetchable.
+func BuildCPFP(parent *Transaction, vout uint32, feeRate float64, addr string) (Transaction, error) {
+	if feeRate <= 0 || math.IsNaN(feeRate) || math.IsInf(feeRate, 0) {
+		return Transaction{}, fmt.Errorf("%w: %v sat/vB", ErrFeeRate, feeRate)
+	}
+	if int(vout) >= len(parent.Outputs) {
+		return Transaction{}, fmt.Errorf("output %d out of range", vout)
+	}
+	a, err := address.Parse(addr)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if (a.Network == address.TESTNET) != parent.IsTestnet {
+		return Transaction{}, fmt.Errorf("%w: %s", ErrNetworkMismatch, addr)
+	}
+	lock, err := script.AddressScript(a)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	parentFee, err := parent.Fee(parent.IsTestnet)
+	if err != nil {
+		return Transaction{}, err
+	}
+	parentVSize, err := parent.VSize()
+	if err != nil {
+		return Transaction{}, err
+	}
+	txid, err := parent.Txid()
+	if err != nil {
+		return Transaction{}, err
+	}
+	spent := parent.Outputs[vout]
+	txin := NewTxIn(txid[:], vout, SEQUENCE_FINAL)
+	txin.SetPrevOut(spent)
+	out := TxOut{ScriptPubKey: lock}
+	child := NewTransaction(2, []TxIn{txin}, []TxOut{out}, 0, parent.IsTestnet, false)
+
+	childVSize, err := EstimateVSize(&child)
+	if err != nil {
+		return Transaction{}, err
+	}
+	fee := uint64(math.Ceil(feeRate * float64(childVSize)))
+	if packageFee := uint64(math.Ceil(feeRate * float64(parentVSize+childVSize))); packageFee > parentFee+fee {
+		fee = packageFee - parentFee
+	}
+	dust, err := DustThreshold(out)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if spent.Amount < fee+dust {
+		return Transaction{}, fmt.Errorf("%w: output holds %d, child needs %d fee plus %d dust", ErrInsufficientFunds, spent.Amount, fee, dust)
+	}
+	child.Outputs[0].Amount = spent.Amount - fee
+	return child, nil
+}
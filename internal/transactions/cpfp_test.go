@@ -0,0 +1,88 @@
+package transactions
+
+import (
+	"errors"
+	"go-bitcoin/internal/address"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"testing"
+)
+
+func TestCPFP(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2362))
+	pub := key.PublicKey()
+	wpkh := script.P2wpkhScript(encoding.Hash160(pub.Serialize(true)))
+	addr := wpkhAddress(t, key, address.MAINNET)
+
+	// a parent stuck at 1 sat/vB
+	parent, err := NewBuilder().
+		AddInput(utxo(1, 100_000, wpkh)).
+		PayToAddress(wpkhAddress(t, keys.NewPrivateKey(big.NewInt(1)), address.MAINNET), 40_000).
+		SetChangeAddress(addr).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+
+	child, err := BuildCPFP(&parent, 1, 10, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := child.Verify(); err != nil || !ok {
+		t.Fatalf("child doesn't verify: %v", err)
+	}
+	rate, err := PackageFeeRate(&parent, &child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate < 10 || rate > 10.1 {
+		t.Errorf("package fee rate = %.3f, want 10", rate)
+	}
+	if own, _ := child.FeeRate([]TxOut{parent.Outputs[1]}); own < 19 {
+		t.Errorf("child pays %.2f sat/vB, should carry its parent", own)
+	}
+	t.Logf("✓ Child lifts the package to %.3f sat/vB", rate)
+
+	// the package resolves the parent's outputs for a child with no other source
+	txid, _ := parent.Txid()
+	bare := child
+	bare.Inputs = []TxIn{NewTxIn(txid[:], 1, SEQUENCE_FINAL)}
+	bare.Inputs[0].ScriptSig = child.Inputs[0].ScriptSig
+	bare.Inputs[0].Witness = child.Inputs[0].Witness
+	bare.PrevOuts = PrevOutMap{}
+	if _, err := PackageFeeRate(&bare); !errors.Is(err, ErrPrevOutNotFound) {
+		t.Errorf("child alone: err = %v, want %v", err, ErrPrevOutNotFound)
+	}
+	if got, err := PackageFeeRate(&parent, &bare); err != nil || got != rate {
+		t.Errorf("package rate from package outputs = %v, %v; want %v", got, err, rate)
+	}
+	t.Logf("✓ Inputs spending the package's own outputs are resolved within it")
+
+	// a parent already above the target still has the child pay its own way
+	child, err = BuildCPFP(&parent, 1, 0.5, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee, _ := child.Fee(false); fee != 55 {
+		t.Errorf("child fee = %d, want 55 for its own 110 vB", fee)
+	}
+
+	if _, err := BuildCPFP(&parent, 1, 10_000, addr); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("unaffordable rate: err = %v, want %v", err, ErrInsufficientFunds)
+	}
+	if _, err := BuildCPFP(&parent, 1, 10, wpkhAddress(t, key, address.TESTNET)); !errors.Is(err, ErrNetworkMismatch) {
+		t.Errorf("testnet address: err = %v, want %v", err, ErrNetworkMismatch)
+	}
+	if _, err := BuildCPFP(&parent, 1, 0, addr); !errors.Is(err, ErrFeeRate) {
+		t.Errorf("zero fee rate: err = %v, want %v", err, ErrFeeRate)
+	}
+	t.Logf("✓ Unaffordable rates, wrong networks and bad fee rates are rejected")
+}
@@ -0,0 +1,246 @@
+package transactions
+
+import (
+	"fmt"
+	"go-bitcoin/internal/address"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/script"
+	"strings"
+	"time"
+)
+
+// DescribeTransaction returns a breakdown of tx for people to read: its ids and size, the
+// locktime, and each input's script type, signature hash types and what its sequence
+// enables, then each output's type and address. Input types come from the spent outputs
+// where the inputs carry them and are otherwise guessed from the scriptSig and witness;
+// the fee and fee rate are shown only when every spent output is known. Nothing is
+// fetched.
+func DescribeTransaction(tx *Transaction) (string, error) {
+	txid, err := tx.Txid()
+	if err != nil {
+		return "", err
+	}
+	raw, err := tx.Serialize()
+	if err != nil {
+		return "", err
+	}
+	weight, err := tx.Weight()
+	if err != nil {
+		return "", err
+	}
+	net := address.MAINNET
+	if tx.IsTestnet {
+		net = address.TESTNET
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "txid:     %x\n", txid)
+	if tx.IsSegwit {
+		wtxid, err := tx.Wtxid()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "wtxid:    %x\n", wtxid)
+	}
+	fmt.Fprintf(&b, "version:  %d\n", tx.Version)
+	fmt.Fprintf(&b, "size:     %d B, %d vB, %d WU\n", len(raw), vsizeFromWeight(weight), weight)
+	fmt.Fprintf(&b, "locktime: %s\n", describeLocktime(tx))
+	if tx.SignalsRBF() {
+		fmt.Fprintf(&b, "replaceable (BIP 125)\n")
+	}
+
+	known := true
+	var totalIn uint64
+	fmt.Fprintf(&b, "inputs:   %d\n", len(tx.Inputs))
+	for i := range tx.Inputs {
+		txin := &tx.Inputs[i]
+		fmt.Fprintf(&b, "  #%d %x:%d\n", i, txin.PrevTx, txin.PrevIdx)
+		fmt.Fprintf(&b, "     type:     %s\n", inputType(txin))
+		if txin.HasPrevOut() {
+			totalIn += txin.PrevAmount
+			fmt.Fprintf(&b, "     spends:   %d sats\n", txin.PrevAmount)
+		} else {
+			known = false
+		}
+		if flags := sigHashFlags(txin); len(flags) > 0 {
+			fmt.Fprintf(&b, "     sighash:  %s\n", strings.Join(flags, ", "))
+		}
+		fmt.Fprintf(&b, "     sequence: 0x%08x, %s\n", txin.Sequence, describeSequence(txin.Sequence, tx.Version))
+	}
+
+	var totalOut uint64
+	fmt.Fprintf(&b, "outputs:  %d\n", len(tx.Outputs))
+	for i := range tx.Outputs {
+		out := &tx.Outputs[i]
+		totalOut += out.Amount
+		fmt.Fprintf(&b, "  #%d %d sats, %s", i, out.Amount, out.ScriptPubKey.Type())
+		if a, err := out.ScriptPubKey.AddressV2(net); err == nil {
+			fmt.Fprintf(&b, " %s", a.String)
+		}
+		b.WriteString("\n")
+	}
+
+	if known && !tx.IsCoinbase() && totalIn >= totalOut {
+		fee := totalIn - totalOut
+		fmt.Fprintf(&b, "fee:      %d sats, %.2f sat/vB\n", fee, float64(fee)/float64(vsizeFromWeight(weight)))
+	}
+	return b.String(), nil
+}
+
+func describeLocktime(tx *Transaction) string {
+	var lock string
+	switch {
+	case tx.Locktime == 0:
+		return "none"
+	case tx.Locktime < LOCKTIME_THRESHOLD:
+		lock = fmt.Sprintf("block %d", tx.Locktime)
+	default:
+		lock = time.Unix(int64(tx.Locktime), 0).UTC().Format(time.RFC3339)
+	}
+	for _, txin := range tx.Inputs {
+		if txin.Sequence != SEQUENCE_FINAL {
+			return lock
+		}
+	}
+	return lock + " (ignored, every input is final)"
+}
+
+// describeSequence says what a sequence enables: BIP 125 replacement, the locktime, and
+// for version 2 transactions a BIP 68 relative lock
+func describeSequence(sequence uint32, version uint32) string {
+	switch {
+	case sequence == SEQUENCE_FINAL:
+		return "final"
+	case sequence == MAX_SEQUENCE_NONFINAL:
+		return "locktime enabled"
+	}
+	meaning := "RBF"
+	if version < 2 || sequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+		return meaning
+	}
+	n := sequence & SEQUENCE_LOCKTIME_MASK
+	if sequence&SEQUENCE_LOCKTIME_TYPE_FLAG != 0 {
+		return fmt.Sprintf("%s, relative lock %d seconds", meaning, n<<SEQUENCE_LOCKTIME_GRANULARITY)
+	}
+	if n == 0 {
+		return meaning
+	}
+	return fmt.Sprintf("%s, relative lock %d blocks", meaning, n)
+}
+
+// inputType names the kind of output an input spends, from the output itself when it's
+// known, and otherwise from the shape of the scriptSig and witness
+func inputType(txin *TxIn) string {
+	if txin.isCoinbase() {
+		return "coinbase"
+	}
+	cmds := txin.ScriptSig.CommandStack
+	var redeem []byte
+	if len(cmds) > 0 && cmds[len(cmds)-1].IsData {
+		redeem = cmds[len(cmds)-1].Data
+	}
+	nested := func() string {
+		switch {
+		case len(redeem) == 22 && redeem[0] == 0x00 && redeem[1] == 0x14:
+			return "P2SH-P2WPKH"
+		case len(redeem) == 34 && redeem[0] == 0x00 && redeem[1] == 0x20:
+			return "P2SH-P2WSH"
+		}
+		return "P2SH"
+	}
+
+	if txin.HasPrevOut() {
+		typ := txin.PrevScriptPubKey.Type()
+		switch typ.Kind {
+		case script.P2SH:
+			return nested()
+		case script.P2TR:
+			return typ.String() + taprootPath(txin.Witness)
+		}
+		return typ.String()
+	}
+
+	w := txin.Witness
+	switch {
+	case len(cmds) == 1 && redeem != nil && len(w) > 0:
+		return nested() + " (guessed)"
+	case len(cmds) == 0 && len(w) == 2 && len(w[1]) == 33:
+		return "P2WPKH (guessed)"
+	case len(cmds) == 0 && len(w) > 0:
+		// a lone signature is a taproot key path; anything else is a script
+		if stack, _ := taprootWitness(w); len(stack) == 1 && (len(stack[0]) == 64 || len(stack[0]) == 65) {
+			return "P2TR key path (guessed)"
+		}
+		return "P2WSH or P2TR script path (guessed)"
+	case len(w) == 0 && len(cmds) == 2 && cmds[1].IsData && (len(cmds[1].Data) == 33 || len(cmds[1].Data) == 65):
+		return "P2PKH (guessed)"
+	}
+	return "unknown"
+}
+
+func taprootPath(witness [][]byte) string {
+	if stack, _ := taprootWitness(witness); len(stack) > 1 {
+		return " script path"
+	}
+	return " key path"
+}
+
+// sigHashFlags returns the signature hash types of the signatures an input carries,
+// recognized as DER-encoded items in the scriptSig or witness, or a taproot key path
+// signature
+func sigHashFlags(txin *TxIn) []string {
+	var items [][]byte
+	for _, cmd := range txin.ScriptSig.CommandStack {
+		if cmd.IsData {
+			items = append(items, cmd.Data)
+		}
+	}
+	items = append(items, txin.Witness...)
+
+	var flags []string
+	for _, item := range items {
+		if isDERSignature(item) {
+			flags = append(flags, sigHashName(uint32(item[len(item)-1])))
+		}
+	}
+	if stack, _ := taprootWitness(txin.Witness); len(flags) == 0 && len(stack) == 1 && len(txin.ScriptSig.CommandStack) == 0 {
+		switch len(stack[0]) {
+		case 64:
+			flags = append(flags, sigHashName(encoding.SIGHASH_DEFAULT))
+		case 65:
+			flags = append(flags, sigHashName(uint32(stack[0][64])))
+		}
+	}
+	return flags
+}
+
+// isDERSignature reports whether sig is shaped like a DER signature with a hash type
+// byte appended: a sequence holding two integers, with lengths that add up
+func isDERSignature(sig []byte) bool {
+	if len(sig) < 9 || len(sig) > 73 || sig[0] != 0x30 || int(sig[1]) != len(sig)-3 || sig[2] != 0x02 {
+		return false
+	}
+	rLen := int(sig[3])
+	return 5+rLen < len(sig) && sig[4+rLen] == 0x02 && 6+rLen+int(sig[5+rLen]) == len(sig)-1
+}
+
+func sigHashName(hashType uint32) string {
+	if hashType == encoding.SIGHASH_DEFAULT {
+		return "DEFAULT"
+	}
+	var name string
+	switch hashType &^ encoding.SIGHASH_ANYONECANPAY {
+	case encoding.SIGHASH_ALL:
+		name = "ALL"
+	case encoding.SIGHASH_NONE:
+		name = "NONE"
+	case encoding.SIGHASH_SINGLE:
+		name = "SINGLE"
+	default:
+		return fmt.Sprintf("%#02x", hashType)
+	}
+	if hashType&encoding.SIGHASH_ANYONECANPAY != 0 {
+		name += "|ANYONECANPAY"
+	}
+	return name
+}
@@ -0,0 +1,110 @@
+package transactions
+
+import (
+	"bytes"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestDescribeTransaction(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2373))
+	pub := key.PublicKey()
+	h160 := encoding.Hash160(pub.Serialize(true))
+	outputKey, err := keys.TweakPublicKey(pub.SerializeXOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := []script.Script{
+		script.P2pkhScript(h160),
+		script.P2wpkhScript(h160),
+		nestedP2wpkh(t, h160),
+		script.P2trScript(outputKey.SerializeXOnly()),
+	}
+
+	inputs := make([]TxIn, len(locks))
+	for i, lock := range locks {
+		inputs[i] = NewTxIn(bytes.Repeat([]byte{byte(i + 1)}, 32), uint32(i), SEQUENCE_FINAL)
+		inputs[i].SetPrevOut(TxOut{Amount: 25_000, ScriptPubKey: lock})
+	}
+	inputs[1].SetRelativeBlocks(144)
+	if err := inputs[2].SetRelativeTime(1024); err != nil {
+		t.Fatal(err)
+	}
+	inputs[3].Sequence = MAX_SEQUENCE_NONFINAL
+	outputs := []TxOut{
+		{Amount: 90_000, ScriptPubKey: script.P2wpkhScript(h160)},
+		{Amount: 0, ScriptPubKey: script.NullDataScript([]byte("hello"))},
+	}
+	tx := NewTransaction(2, inputs, outputs, 840_000, false, false)
+
+	hashTypes := []uint32{
+		encoding.SIGHASH_ALL | encoding.SIGHASH_ANYONECANPAY,
+		encoding.SIGHASH_SINGLE,
+		encoding.SIGHASH_NONE,
+	}
+	for i, hashType := range hashTypes {
+		if err := tx.SignInputWithType(i, *key, true, hashType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.SignInputTaproot(3, *key, nil, encoding.SIGHASH_DEFAULT); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := DescribeTransaction(&tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"locktime: block 840000\n",
+		"replaceable (BIP 125)",
+		"type:     P2PKH\n",
+		"sighash:  ALL|ANYONECANPAY\n",
+		"sequence: 0xffffffff, final\n",
+		"type:     P2WPKH\n",
+		"sighash:  SINGLE\n",
+		"sequence: 0x00000090, RBF, relative lock 144 blocks\n",
+		"type:     P2SH-P2WPKH\n",
+		"sighash:  NONE\n",
+		"RBF, relative lock 1024 seconds\n",
+		"type:     P2TR key path\n",
+		"sighash:  DEFAULT\n",
+		"sequence: 0xfffffffe, locktime enabled\n",
+		"#0 90000 sats, P2WPKH bc1q",
+		"#1 0 sats, OP_RETURN\n",
+		"fee:      10000 sats",
+	}
+	for _, w := range want {
+		if !strings.Contains(desc, w) {
+			t.Errorf("description is missing %q:\n%s", w, desc)
+		}
+	}
+	t.Logf("✓ Signed transaction:\n%s", desc)
+
+	// parsed from the wire the spent outputs are unknown: types are guessed, no fee shown
+	rawHex, err := tx.Hex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := FromHex(rawHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err = DescribeTransaction(&parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{"P2PKH (guessed)", "P2WPKH (guessed)", "P2SH-P2WPKH (guessed)", "P2TR key path (guessed)"} {
+		if !strings.Contains(desc, w) {
+			t.Errorf("description is missing %q:\n%s", w, desc)
+		}
+	}
+	if strings.Contains(desc, "fee:") {
+		t.Errorf("fee shown without spent outputs:\n%s", desc)
+	}
+	t.Logf("✓ Parsed transaction:\n%s", desc)
+}
@@ -1,61 +1,133 @@
 package transactions
 
 import (
-	"bytes"
 	"context"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"go-bitcoin/internal/script"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Esplora-compatible API roots
+const (
+	BLOCKSTREAM_API           string = "https://blockstream.info/api"
+	BLOCKSTREAM_TESTNET_API   string = "https://blockstream.info/testnet/api"
+	MEMPOOL_SPACE_API         string = "https://mempool.space/api"
+	MEMPOOL_SPACE_TESTNET_API string = "https://mempool.space/testnet/api"
+)
+
+// Fetcher defaults
+const (
+	DEFAULT_FETCH_TIMEOUT     time.Duration = 30 * time.Second
+	DEFAULT_FETCH_RETRIES     int           = 3
+	DEFAULT_FETCH_BACKOFF     time.Duration = 500 * time.Millisecond
+	DEFAULT_FETCH_CONCURRENCY int           = 4
+)
+
+var ErrFetchStatus = errors.New("unexpected HTTP status")
+
+// Broadcaster submits a signed transaction to the network and returns its txid (display
+// byte order)
+type Broadcaster interface {
+	Broadcast(tx *Transaction) ([32]byte, error)
+}
+
+// defaultClient is shared by fetchers that don't bring their own
+var defaultClient = &http.Client{Timeout: DEFAULT_FETCH_TIMEOUT}
+
 type TxFetcher struct {
-	Cache map[string]*Transaction
+	Cache   map[string]*Transaction
+	TestNet bool // network GetOutput looks up
+
+	// BaseURL is the root of an Esplora-compatible API, like MEMPOOL_SPACE_API, used for
+	// both networks. Empty picks blockstream.info for the network asked for.
+	BaseURL     string
+	Client      *http.Client  // nil uses a shared client with DEFAULT_FETCH_TIMEOUT
+	Retries     int           // further attempts after a network error or 429/5xx status
+	Backoff     time.Duration // wait before the first retry, doubling after each
+	Concurrency int           // requests FetchMany has in flight at once
+
+	mu sync.Mutex // guards Cache
 }
 
 func NewTxFetcher() TxFetcher {
 	return TxFetcher{
-		Cache: make(map[string]*Transaction, 1),
+		Cache:       make(map[string]*Transaction, 1),
+		Retries:     DEFAULT_FETCH_RETRIES,
+		Backoff:     DEFAULT_FETCH_BACKOFF,
+		Concurrency: DEFAULT_FETCH_CONCURRENCY,
 	}
 }
 
 func (tf *TxFetcher) GetUrl(testNet bool) string {
-	baseURL := "https://blockstream.info/api"
+	if tf.BaseURL != "" {
+		return strings.TrimSuffix(tf.BaseURL, "/")
+	}
+	baseURL := BLOCKSTREAM_API
 	if testNet {
-		baseURL = "https://blockstream.info/testnet/api"
+		baseURL = BLOCKSTREAM_TESTNET_API
 	}
 	return baseURL
 }
 
+// get requests url, retrying network errors and 429 or 5xx responses with exponential
+// backoff, and returns the body of a 200 response
+func (tf *TxFetcher) get(url string) ([]byte, error) {
+	client := tf.Client
+	if client == nil {
+		client = defaultClient
+	}
+	backoff := tf.Backoff
+	var lastErr error
+	for attempt := 0; attempt <= tf.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return body, nil
+		}
+		lastErr = fmt.Errorf("%w %d from %s", ErrFetchStatus, resp.StatusCode, url)
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
 func (tf *TxFetcher) Fetch(txId string, testNet, fresh bool) (*Transaction, error) {
 	if !fresh {
-		if tx, exists := tf.Cache[txId]; exists {
+		tf.mu.Lock()
+		tx, exists := tf.Cache[txId]
+		tf.mu.Unlock()
+		if exists {
 			return tx, nil
 		}
 	}
 
 	url := fmt.Sprintf("%s/tx/%s/hex", tf.GetUrl(testNet), txId)
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	hexData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	// decode hex string to raw bytes
-	rawBytes, err := hex.DecodeString(string(hexData))
+	hexData, err := tf.get(url)
 	if err != nil {
 		return nil, err
 	}
 
-	r := bytes.NewBuffer(rawBytes)
-	tx, err := ParseTransaction(r)
+	tx, err := FromHex(string(hexData))
 	if err != nil {
 		return nil, err
 	}
@@ -71,11 +143,81 @@ func (tf *TxFetcher) Fetch(txId string, testNet, fresh bool) (*Transaction, erro
 
 	// cache the transaction for future use
 	tx.IsTestnet = testNet
+	tf.mu.Lock()
+	if tf.Cache == nil {
+		tf.Cache = make(map[string]*Transaction)
+	}
 	tf.Cache[txId] = &tx
+	tf.mu.Unlock()
 
 	return &tx, nil
 }
 
+// FetchMany fetches the transactions txIds, in order, with at most Concurrency requests
+// in flight. It fails with the first error, naming the txid.
+func (tf *TxFetcher) FetchMany(txIds []string, testNet bool) ([]*Transaction, error) {
+	txs := make([]*Transaction, len(txIds))
+	errs := make([]error, len(txIds))
+	sem := make(chan struct{}, max(1, tf.Concurrency))
+	var wg sync.WaitGroup
+	for i, id := range txIds {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			txs[i], errs[i] = tf.Fetch(id, testNet, false)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %w", txIds[i], err)
+		}
+	}
+	return txs, nil
+}
+
+// GetOutput fetches the transaction txid and returns its output vout, making the block
+// explorer a PrevOutProvider
+func (tf *TxFetcher) GetOutput(txid [32]byte, vout uint32) (uint64, script.Script, error) {
+	tx, err := tf.Fetch(fmt.Sprintf("%x", txid), tf.TestNet, false)
+	if err != nil {
+		return 0, script.Script{}, err
+	}
+	if int(vout) >= len(tx.Outputs) {
+		return 0, script.Script{}, fmt.Errorf("%w: %x:%d", ErrPrevOutNotFound, txid, vout)
+	}
+	out := tx.Outputs[vout]
+	return out.Amount, out.ScriptPubKey, nil
+}
+
+// Broadcast posts tx to the API's /tx endpoint, on the network the transaction is for
+func (tf *TxFetcher) Broadcast(tx *Transaction) ([32]byte, error) {
+	rawHex, err := tx.Hex()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	client := tf.Client
+	if client == nil {
+		client = defaultClient
+	}
+	url := fmt.Sprintf("%s/tx", tf.GetUrl(tx.IsTestnet))
+	resp, err := client.Post(url, "text/plain", strings.NewReader(rawHex))
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return [32]byte{}, fmt.Errorf("%w %d from %s: %s", ErrFetchStatus, resp.StatusCode, url, strings.TrimSpace(string(body)))
+	}
+	return parseTxid(string(body))
+}
+
 // FetchRecentTxIds fetches up to maxCount recent transaction IDs from the blockchain
 // with a timeout. Checks multiple recent blocks (excluding coinbase transactions).
 func (tf *TxFetcher) FetchRecentTxIds(testNet bool, maxCount int, maxCheckPerBlock int, maxBlocks int, timeout time.Duration) ([]string, error) {
@@ -86,18 +228,12 @@ func (tf *TxFetcher) FetchRecentTxIds(testNet bool, maxCount int, maxCheckPerBlo
 
 	// Get the latest block hash
 	url := fmt.Sprintf("%s/blocks/tip/hash", tf.GetUrl(testNet))
-	resp, err := http.Get(url)
+	blockHash, err := tf.get(url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch latest block hash: %w", err)
 	}
-	defer resp.Body.Close()
 
-	blockHash, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read block hash: %w", err)
-	}
-
-	currentBlockHash := string(blockHash)
+	currentBlockHash := strings.TrimSpace(string(blockHash))
 
 	// Check multiple recent blocks
 	for blockNum := 0; blockNum < maxBlocks && len(txIds) < maxCount; blockNum++ {
@@ -110,17 +246,15 @@ func (tf *TxFetcher) FetchRecentTxIds(testNet bool, maxCount int, maxCheckPerBlo
 
 		// Get transaction IDs from this block
 		url = fmt.Sprintf("%s/block/%s/txids", tf.GetUrl(testNet), currentBlockHash)
-		resp, err = http.Get(url)
+		body, err := tf.get(url)
 		if err != nil {
 			break
 		}
 
 		var blockTxIds []string
-		if err := json.NewDecoder(resp.Body).Decode(&blockTxIds); err != nil {
-			resp.Body.Close()
+		if err := json.Unmarshal(body, &blockTxIds); err != nil {
 			break
 		}
-		resp.Body.Close()
 
 		// Skip coinbase (index 0) and check up to maxCheckPerBlock transactions
 		maxToCheck := maxCheckPerBlock
@@ -142,7 +276,7 @@ func (tf *TxFetcher) FetchRecentTxIds(testNet bool, maxCount int, maxCheckPerBlo
 
 		// Get previous block hash for next iteration
 		url = fmt.Sprintf("%s/block/%s", tf.GetUrl(testNet), currentBlockHash)
-		resp, err = http.Get(url)
+		body, err = tf.get(url)
 		if err != nil {
 			break
 		}
@@ -150,11 +284,9 @@ func (tf *TxFetcher) FetchRecentTxIds(testNet bool, maxCount int, maxCheckPerBlo
 		var blockInfo struct {
 			PreviousBlockHash string `json:"previousblockhash"`
 		}
-		if err := json.NewDecoder(resp.Body).Decode(&blockInfo); err != nil {
-			resp.Body.Close()
+		if err := json.Unmarshal(body, &blockInfo); err != nil {
 			break
 		}
-		resp.Body.Close()
 
 		if blockInfo.PreviousBlockHash == "" {
 			// Reached genesis block
@@ -170,22 +302,17 @@ func (tf *TxFetcher) FetchRecentTxIds(testNet bool, maxCount int, maxCheckPerBlo
 // FetchAddressTransactions fetches all transaction IDs for a given address
 func (tf *TxFetcher) FetchAddressTransactions(address string, testNet bool) ([]string, error) {
 	url := fmt.Sprintf("%s/address/%s/txs", tf.GetUrl(testNet), address)
-	resp, err := http.Get(url)
+	body, err := tf.get(url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch transactions for address: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("API returned status %d", resp.StatusCode)
-	}
 
 	// The API returns an array of transaction objects
 	var txs []struct {
 		TxID string `json:"txid"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&txs); err != nil {
+	if err := json.Unmarshal(body, &txs); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
@@ -0,0 +1,125 @@
+package transactions
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// esplora serves GET /tx/{id}/hex for txs, failing the first flaky requests with a 503
+func esplora(t *testing.T, txs []Transaction, flaky int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	byId := make(map[string]string, len(txs))
+	for _, tx := range txs {
+		rawHex, err := tx.Hex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := tx.Id()
+		byId[id] = rawHex
+	}
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= flaky {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/tx/"), "/hex")
+		body, ok := byId[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestTxFetcher(t *testing.T) {
+	txs := make([]Transaction, 6)
+	ids := make([]string, len(txs))
+	for i := range txs {
+		txs[i] = NewTransaction(1, []TxIn{NewTxIn(make([]byte, 32), uint32(i), SEQUENCE_FINAL)},
+			[]TxOut{{Amount: uint64(1000 * i)}}, 0, false, false)
+		ids[i], _ = txs[i].Id()
+	}
+
+	srv, requests := esplora(t, txs, 0)
+	tf := NewTxFetcher()
+	tf.BaseURL = srv.URL + "/api/"
+	got, err := tf.FetchMany(ids, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tx := range got {
+		if id, _ := tx.Id(); id != ids[i] {
+			t.Errorf("tx %d = %s, want %s", i, id, ids[i])
+		}
+	}
+	if _, err := tf.FetchMany(ids[:2], false); err != nil || requests.Load() != int32(len(ids)) {
+		t.Errorf("cached transactions fetched again: %d requests", requests.Load())
+	}
+	t.Logf("✓ FetchMany returns transactions in order from a configured endpoint, caching them")
+
+	srv, requests = esplora(t, txs, 2)
+	tf = NewTxFetcher()
+	tf.BaseURL = srv.URL + "/api"
+	tf.Backoff = time.Millisecond
+	if _, err := tf.Fetch(ids[0], false, false); err != nil {
+		t.Fatalf("fetch after two 503s: %v", err)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("%d requests, want 3", requests.Load())
+	}
+
+	srv, requests = esplora(t, txs, 0)
+	tf.BaseURL = srv.URL + "/api"
+	missing := strings.Repeat("00", 32)
+	if _, err := tf.FetchMany([]string{ids[1], missing}, false); !errors.Is(err, ErrFetchStatus) || !strings.Contains(err.Error(), missing) {
+		t.Errorf("missing tx: err = %v", err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("404 was retried: %d requests", requests.Load())
+	}
+	t.Logf("✓ Server errors are retried with backoff, not found is not")
+}
+
+func TestTxFetcherBroadcast(t *testing.T) {
+	tx := NewTransaction(1, []TxIn{NewTxIn(make([]byte, 32), 0, SEQUENCE_FINAL)},
+		[]TxOut{{Amount: 1000}}, 0, false, false)
+	rawHex, _ := tx.Hex()
+	id, _ := tx.Id()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.URL.Path != "/api/tx" {
+			http.NotFound(w, r)
+			return
+		}
+		if string(body) != rawHex {
+			http.Error(w, "sendrawtransaction RPC error: bad-txns-inputs-missingorspent", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, id)
+	}))
+	defer srv.Close()
+
+	tf := NewTxFetcher()
+	tf.BaseURL = srv.URL + "/api"
+	txid, err := tf.Broadcast(&tx)
+	if err != nil || fmt.Sprintf("%x", txid) != id {
+		t.Fatalf("broadcast = %x, %v; want %s", txid, err, id)
+	}
+	tx.Outputs[0].Amount++
+	if _, err := tf.Broadcast(&tx); !errors.Is(err, ErrFetchStatus) || !strings.Contains(err.Error(), "missingorspent") {
+		t.Errorf("rejected broadcast: err = %v", err)
+	}
+	t.Logf("✓ Broadcast posts the raw transaction and surfaces the explorer's rejection")
+}
@@ -0,0 +1,76 @@
+package transactions
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// BIP 65 absolute and BIP 68 relative lock-time constants
+const (
+	LOCKTIME_THRESHOLD    uint32 = 500_000_000 // locktimes below are block heights, at or above unix times
+	MAX_SEQUENCE_NONFINAL uint32 = 0xfffffffe  // highest sequence that still enforces the locktime
+
+	SEQUENCE_LOCKTIME_DISABLE_FLAG uint32 = 1 << 31 // set: the sequence is not a relative lock
+	SEQUENCE_LOCKTIME_TYPE_FLAG    uint32 = 1 << 22 // set: the lock counts time, not blocks
+	SEQUENCE_LOCKTIME_MASK         uint32 = 0x0000ffff
+	SEQUENCE_LOCKTIME_GRANULARITY         = 9 // relative time locks count units of 512 seconds
+)
+
+var ErrLocktime = errors.New("invalid lock time")
+
+// SetLocktimeHeight locks the transaction until the block at height can include it.
+// Inputs with a final sequence are set to MAX_SEQUENCE_NONFINAL, since a locktime is
+// ignored when every input is final.
+func (t *Transaction) SetLocktimeHeight(height uint32) error {
+	if height >= LOCKTIME_THRESHOLD {
+		return fmt.Errorf("%w: height %d is not below %d", ErrLocktime, height, LOCKTIME_THRESHOLD)
+	}
+	t.setLocktime(height)
+	return nil
+}
+
+// SetLocktimeTime locks the transaction until the median time past of the chain reaches
+// at, to the second. Inputs with a final sequence are set to MAX_SEQUENCE_NONFINAL.
+func (t *Transaction) SetLocktimeTime(at time.Time) error {
+	unix := at.Unix()
+	if unix < int64(LOCKTIME_THRESHOLD) || unix > math.MaxUint32 {
+		return fmt.Errorf("%w: %s is outside the locktime range", ErrLocktime, at.UTC().Format(time.RFC3339))
+	}
+	t.setLocktime(uint32(unix))
+	return nil
+}
+
+func (t *Transaction) setLocktime(locktime uint32) {
+	t.Locktime = locktime
+	for i := range t.Inputs {
+		if t.Inputs[i].Sequence == SEQUENCE_FINAL {
+			t.Inputs[i].Sequence = MAX_SEQUENCE_NONFINAL
+		}
+	}
+	t.ClearCache()
+}
+
+// SetRelativeBlocks sets the input's sequence so it can't be mined until its previous
+// output has n confirmations. Relative locks apply only to version 2 transactions, and
+// as a sequence this low also signals BIP 125 replaceability. On an input of a
+// transaction that may already have been hashed, call ClearCache afterwards.
+func (t *TxIn) SetRelativeBlocks(n uint16) {
+	t.Sequence = uint32(n)
+}
+
+// SetRelativeTime sets the input's sequence so it can't be mined until seconds have
+// passed since its previous output confirmed, by median time past. The lock counts
+// units of 512 seconds, so seconds is rounded up to the next multiple of 512; the
+// longest lock is 0xffff units, a little over 388 days. The caveats of
+// SetRelativeBlocks apply.
+func (t *TxIn) SetRelativeTime(seconds uint32) error {
+	units := (uint64(seconds) + 1<<SEQUENCE_LOCKTIME_GRANULARITY - 1) >> SEQUENCE_LOCKTIME_GRANULARITY
+	if units > uint64(SEQUENCE_LOCKTIME_MASK) {
+		return fmt.Errorf("%w: %d seconds is over the %d second limit", ErrLocktime, seconds,
+			SEQUENCE_LOCKTIME_MASK<<SEQUENCE_LOCKTIME_GRANULARITY)
+	}
+	t.Sequence = SEQUENCE_LOCKTIME_TYPE_FLAG | uint32(units)
+	return nil
+}
@@ -0,0 +1,95 @@
+package transactions
+
+import (
+	"errors"
+	"go-bitcoin/internal/script"
+	"testing"
+	"time"
+)
+
+// satisfies runs <lock> <op> 1 against the input's sequence and the transaction's locktime
+func satisfies(tx *Transaction, i int, op byte, lock int64) bool {
+	s := script.NewScript([]script.ScriptCommand{
+		{Data: script.EncodeNum(lock), IsData: true},
+		{Opcode: op},
+		{Data: script.EncodeNum(1), IsData: true},
+	})
+	engine := script.NewScriptEngine(s)
+	ok, _ := engine.
+		WithLocktime(tx.Locktime).
+		WithSequence(tx.Inputs[i].Sequence).
+		Execute([]byte{})
+	return ok
+}
+
+func TestLocktime(t *testing.T) {
+	tx := twoInputTx(script.P2wpkhScript(make([]byte, 20)))
+	tx.Inputs[1].Sequence = SEQUENCE_FINAL
+	if err := tx.SetLocktimeHeight(850_000); err != nil {
+		t.Fatal(err)
+	}
+	if tx.Locktime != 850_000 || tx.Inputs[1].Sequence != MAX_SEQUENCE_NONFINAL {
+		t.Errorf("locktime = %d, sequence = %#x", tx.Locktime, tx.Inputs[1].Sequence)
+	}
+	if !satisfies(&tx, 1, script.OP_CHECKLOCKTIMEVERIFY, 850_000) || satisfies(&tx, 1, script.OP_CHECKLOCKTIMEVERIFY, 850_001) {
+		t.Error("height locktime doesn't satisfy CLTV at exactly its height")
+	}
+	t.Logf("✓ Height locktimes satisfy CLTV and make final inputs non-final")
+
+	at := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := tx.SetLocktimeTime(at); err != nil {
+		t.Fatal(err)
+	}
+	if tx.Locktime != uint32(at.Unix()) || !satisfies(&tx, 0, script.OP_CHECKLOCKTIMEVERIFY, at.Unix()) {
+		t.Errorf("locktime = %d, want %d", tx.Locktime, at.Unix())
+	}
+	if satisfies(&tx, 0, script.OP_CHECKLOCKTIMEVERIFY, 850_000) {
+		t.Error("time locktime satisfied a height CLTV")
+	}
+	t.Logf("✓ Time locktimes satisfy CLTV for times, never heights")
+
+	for name, err := range map[string]error{
+		"height at threshold": tx.SetLocktimeHeight(LOCKTIME_THRESHOLD),
+		"time before 1985":    tx.SetLocktimeTime(time.Unix(int64(LOCKTIME_THRESHOLD)-1, 0)),
+		"time after 2106":     tx.SetLocktimeTime(time.Unix(1<<32, 0)),
+	} {
+		if !errors.Is(err, ErrLocktime) {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrLocktime)
+		}
+	}
+	t.Logf("✓ Heights and times on the wrong side of the threshold are rejected")
+}
+
+func TestRelativeLock(t *testing.T) {
+	tx := twoInputTx(script.P2wpkhScript(make([]byte, 20)))
+	tx.Inputs[0].SetRelativeBlocks(144)
+	if tx.Inputs[0].Sequence != 144 || !satisfies(&tx, 0, script.OP_CHECKSEQUENCEVERIFY, 144) ||
+		satisfies(&tx, 0, script.OP_CHECKSEQUENCEVERIFY, 145) {
+		t.Errorf("144 blocks: sequence = %#x", tx.Inputs[0].Sequence)
+	}
+
+	tests := []struct {
+		seconds uint32
+		want    uint32
+	}{
+		{0, 0x00400000},
+		{512, 0x00400001},
+		{513, 0x00400002},
+		{30 * 24 * 60 * 60, 0x00400000 | 5063},
+		{0xffff << 9, 0x0040ffff},
+	}
+	for _, tt := range tests {
+		if err := tx.Inputs[1].SetRelativeTime(tt.seconds); err != nil || tx.Inputs[1].Sequence != tt.want {
+			t.Errorf("%d seconds: sequence = %#x, %v; want %#x", tt.seconds, tx.Inputs[1].Sequence, err, tt.want)
+		}
+	}
+	tx.Inputs[1].SetRelativeTime(3600)
+	if !satisfies(&tx, 1, script.OP_CHECKSEQUENCEVERIFY, int64(SEQUENCE_LOCKTIME_TYPE_FLAG|7)) ||
+		satisfies(&tx, 1, script.OP_CHECKSEQUENCEVERIFY, 7) {
+		t.Error("an hour doesn't satisfy CSV for 7 time units, or satisfies it for 7 blocks")
+	}
+	if err := tx.Inputs[1].SetRelativeTime(0xffff<<9 + 1); !errors.Is(err, ErrLocktime) {
+		t.Errorf("too long: err = %v, want %v", err, ErrLocktime)
+	}
+	t.Logf("✓ Relative locks encode blocks and 512 second units that CSV accepts")
+}
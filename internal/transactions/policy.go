@@ -0,0 +1,131 @@
+package transactions
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Bitcoin Core's standardness limits on transaction and input size. Nodes don't relay or
+// mine transactions over them, though blocks may contain such transactions.
+const (
+	MAX_STANDARD_TX_WEIGHT                 int = 400_000
+	MAX_STANDARD_SCRIPTSIG_SIZE            int = 1650 // fits a 15-of-15 P2SH multisig
+	MAX_STANDARD_P2WSH_SCRIPT_SIZE         int = 3600
+	MAX_STANDARD_P2WSH_STACK_ITEMS         int = 100 // not counting the witness script
+	MAX_STANDARD_P2WSH_STACK_ITEM_SIZE     int = 80
+	MAX_STANDARD_TAPSCRIPT_STACK_ITEM_SIZE int = 80
+	MAX_STANDARD_TX_SIGOPS_COST            int = 16_000 // a fifth of a block's sigop cost limit
+	MAX_P2SH_SIGOPS                        int = 15     // in a P2SH redeem script
+)
+
+var (
+	ErrTxTooHeavy        = errors.New("transaction over the standard weight limit")
+	ErrScriptSigTooLarge = errors.New("scriptSig over the standard size limit")
+	ErrWitnessTooLarge   = errors.New("witness over the standard size limits")
+	ErrTooManySigOps     = errors.New("transaction over the standard sigop limits")
+)
+
+// CheckStandardSize checks the transaction against Bitcoin Core's size policy: its weight,
+// and the scriptSig and witness of every input. Witness limits depend on the type of
+// output spent, so they're only checked for inputs whose previous output is already known.
+func (t *Transaction) CheckStandardSize() error {
+	weight, err := t.Weight()
+	if err != nil {
+		return err
+	}
+	if weight > MAX_STANDARD_TX_WEIGHT {
+		return fmt.Errorf("%w: %d WU with %d inputs, limit %d", ErrTxTooHeavy, weight, len(t.Inputs), MAX_STANDARD_TX_WEIGHT)
+	}
+	for i := range t.Inputs {
+		if err := t.Inputs[i].checkStandardSize(); err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// CheckStandardSigOps checks the transaction against Bitcoin Core's sigop policy: its
+// sigop cost, and the sigops of each P2SH redeem script it reveals. Previous outputs are
+// fetched if they aren't known.
+func (t *Transaction) CheckStandardSigOps() error {
+	cost, err := t.SigOpCost()
+	if err != nil {
+		return err
+	}
+	if cost > MAX_STANDARD_TX_SIGOPS_COST {
+		return fmt.Errorf("%w: cost %d, limit %d", ErrTooManySigOps, cost, MAX_STANDARD_TX_SIGOPS_COST)
+	}
+	if t.IsCoinbase() {
+		return nil
+	}
+	for i := range t.Inputs {
+		prevOut, err := t.spentOutput(i)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		if n := prevOut.ScriptPubKey.P2shSigOpCount(t.Inputs[i].ScriptSig); n > MAX_P2SH_SIGOPS {
+			return fmt.Errorf("%w: input %d redeem script has %d, limit %d", ErrTooManySigOps, i, n, MAX_P2SH_SIGOPS)
+		}
+	}
+	return nil
+}
+
+func (t *TxIn) checkStandardSize() error {
+	scriptSig, err := t.ScriptSigBytes()
+	if err != nil {
+		return err
+	}
+	if len(scriptSig) > MAX_STANDARD_SCRIPTSIG_SIZE {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrScriptSigTooLarge, len(scriptSig), MAX_STANDARD_SCRIPTSIG_SIZE)
+	}
+	if !t.HasPrevOut() || len(t.Witness) == 0 {
+		return nil
+	}
+
+	spk := t.PrevScriptPubKey
+	switch {
+	case spk.IsP2wshScriptPubKey() || spk.IsP2shScriptPubKey() && t.isNestedP2wsh():
+		return checkWitnessItems(t.Witness)
+	case spk.IsP2trScriptPubKey():
+		stack, _ := taprootWitness(t.Witness)
+		if len(stack) < 2 {
+			return nil // key path: a lone signature
+		}
+		// script path: the stack, then the script and its control block
+		for _, item := range stack[:len(stack)-2] {
+			if len(item) > MAX_STANDARD_TAPSCRIPT_STACK_ITEM_SIZE {
+				return fmt.Errorf("%w: tapscript stack item of %d bytes, limit %d", ErrWitnessTooLarge, len(item), MAX_STANDARD_TAPSCRIPT_STACK_ITEM_SIZE)
+			}
+		}
+	}
+	return nil
+}
+
+// isNestedP2wsh reports whether the scriptSig pushes a P2WSH redeem script
+func (t *TxIn) isNestedP2wsh() bool {
+	cmds := t.ScriptSig.CommandStack
+	if len(cmds) == 0 || !cmds[len(cmds)-1].IsData {
+		return false
+	}
+	redeem := cmds[len(cmds)-1].Data
+	return len(redeem) == 34 && redeem[0] == 0x00 && redeem[1] == 0x20
+}
+
+// checkWitnessItems applies the P2WSH limits to a witness: the witness script last, the
+// items it's given before it
+func checkWitnessItems(witness [][]byte) error {
+	witnessScript := witness[len(witness)-1]
+	if len(witnessScript) > MAX_STANDARD_P2WSH_SCRIPT_SIZE {
+		return fmt.Errorf("%w: witness script of %d bytes, limit %d", ErrWitnessTooLarge, len(witnessScript), MAX_STANDARD_P2WSH_SCRIPT_SIZE)
+	}
+	items := witness[:len(witness)-1]
+	if len(items) > MAX_STANDARD_P2WSH_STACK_ITEMS {
+		return fmt.Errorf("%w: %d stack items, limit %d", ErrWitnessTooLarge, len(items), MAX_STANDARD_P2WSH_STACK_ITEMS)
+	}
+	for _, item := range items {
+		if len(item) > MAX_STANDARD_P2WSH_STACK_ITEM_SIZE {
+			return fmt.Errorf("%w: stack item of %d bytes, limit %d", ErrWitnessTooLarge, len(item), MAX_STANDARD_P2WSH_STACK_ITEM_SIZE)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package transactions
+
+import (
+	"bytes"
+	"errors"
+	"go-bitcoin/internal/address"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"testing"
+)
+
+func TestCheckStandardSize(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2372))
+	pub := key.PublicKey()
+	h160 := encoding.Hash160(pub.Serialize(true))
+	wsh := script.P2wshScript(make([]byte, 32))
+	tr := script.P2trScript(make([]byte, 32))
+	items := func(n, size int) [][]byte {
+		stack := make([][]byte, n)
+		for i := range stack {
+			stack[i] = make([]byte, size)
+		}
+		return stack
+	}
+
+	signed := twoInputTx(script.P2wpkhScript(h160))
+	for i := range signed.Inputs {
+		if err := signed.SignInput(i, *key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := signed.CheckStandardSize(); err != nil {
+		t.Fatalf("signed P2WPKH: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		lock    script.Script
+		sig     []script.ScriptCommand
+		witness [][]byte
+		want    error
+	}{
+		{"scriptSig at limit", script.P2pkhScript(h160), []script.ScriptCommand{
+			{IsData: true, Data: make([]byte, 520)}, {IsData: true, Data: make([]byte, 520)},
+			{IsData: true, Data: make([]byte, 520)}, {IsData: true, Data: make([]byte, 79)},
+		}, nil, nil},
+		{"scriptSig over limit", script.P2pkhScript(h160), []script.ScriptCommand{
+			{IsData: true, Data: make([]byte, 520)}, {IsData: true, Data: make([]byte, 520)},
+			{IsData: true, Data: make([]byte, 520)}, {IsData: true, Data: make([]byte, 80)},
+		}, nil, ErrScriptSigTooLarge},
+		{"P2WSH at limits", wsh, nil, append(items(100, 80), make([]byte, 3600)), nil},
+		{"P2WSH script too large", wsh, nil, append(items(1, 80), make([]byte, 3601)), ErrWitnessTooLarge},
+		{"P2WSH too many items", wsh, nil, append(items(101, 1), []byte{0x51}), ErrWitnessTooLarge},
+		{"P2WSH item too large", wsh, nil, append(items(1, 81), []byte{0x51}), ErrWitnessTooLarge},
+		{"P2SH-P2WSH item too large", script.P2shScript(make([]byte, 20)),
+			[]script.ScriptCommand{{IsData: true, Data: append([]byte{0x00, 0x20}, make([]byte, 32)...)}},
+			append(items(1, 81), []byte{0x51}), ErrWitnessTooLarge},
+		{"P2SH-P2WPKH isn't held to P2WSH limits", script.P2shScript(h160),
+			[]script.ScriptCommand{{IsData: true, Data: append([]byte{0x00, 0x14}, h160...)}},
+			items(2, 100), nil},
+		{"taproot key path", tr, nil, items(1, 65), nil},
+		{"tapscript item too large", tr, nil, [][]byte{make([]byte, 81), {0x51}, make([]byte, 33)}, ErrWitnessTooLarge},
+		{"tapscript at limit", tr, nil, [][]byte{make([]byte, 80), {0x51}, make([]byte, 33)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := twoInputTx(tt.lock)
+			tx.Inputs[1].ScriptSig = script.NewScript(tt.sig)
+			tx.Inputs[1].Witness = tt.witness
+			err := tx.CheckStandardSize()
+			if !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			t.Logf("✓ %s: %v", tt.name, err)
+		})
+	}
+
+	// without its previous output an input's witness type isn't known
+	tx := twoInputTx(wsh)
+	tx.Inputs[1] = NewTxIn(tx.Inputs[1].PrevTx, 0, SEQUENCE_FINAL)
+	tx.Inputs[1].Witness = append(items(1, 81), []byte{0x51})
+	if err := tx.CheckStandardSize(); err != nil {
+		t.Fatalf("unknown previous output: %v", err)
+	}
+
+	heavy := NewTransaction(1, nil, []TxOut{{Amount: 1000, ScriptPubKey: script.NullDataScript(make([]byte, 100_000))}}, 0, false, false)
+	if err := heavy.CheckStandardSize(); !errors.Is(err, ErrTxTooHeavy) {
+		t.Fatalf("heavy transaction: %v", err)
+	}
+	t.Logf("✓ %v", heavy.CheckStandardSize())
+}
+
+func TestBuilderWeightLimit(t *testing.T) {
+	lock := script.P2pkhScript(make([]byte, 20))
+	dest := wpkhAddress(t, keys.NewPrivateKey(big.NewInt(1)), address.MAINNET)
+	build := func(n int) error {
+		b := NewBuilder().PayToAddress(dest, 10_000).SetChangeAddress(dest)
+		for i := range n {
+			op := OutPoint{Index: uint32(i)}
+			copy(op.TxID[:], bytes.Repeat([]byte{0xab}, 32))
+			b.AddInput(Utxo{OutPoint: op, Output: TxOut{Amount: 1000, ScriptPubKey: lock}})
+		}
+		_, err := b.Build()
+		return err
+	}
+
+	// a P2PKH input weighs 592 WU once signed
+	if err := build(670); err != nil {
+		t.Fatalf("670 inputs: %v", err)
+	}
+	err := build(680)
+	if !errors.Is(err, ErrTxTooHeavy) {
+		t.Fatalf("680 inputs: %v", err)
+	}
+	t.Logf("✓ Builder refuses transactions over the standard weight: %v", err)
+}
+
+func TestCheckStandardSigOps(t *testing.T) {
+	checksigs := func(n int) []byte { return bytes.Repeat([]byte{script.OP_CHECKSIG}, n) }
+	p2sh := func(redeem []byte) script.Script { return script.P2shScript(encoding.Hash160(redeem)) }
+	tests := []struct {
+		name   string
+		redeem []byte
+		want   error
+	}{
+		{"redeem script at limit", checksigs(MAX_P2SH_SIGOPS), nil},
+		{"redeem script over limit", checksigs(MAX_P2SH_SIGOPS + 1), ErrTooManySigOps},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := twoInputTx(p2sh(tt.redeem))
+			for i := range tx.Inputs {
+				tx.Inputs[i].ScriptSig = script.NewScript([]script.ScriptCommand{{IsData: true, Data: tt.redeem}})
+			}
+			if err := tx.CheckStandardSigOps(); !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			t.Logf("✓ %s", tt.name)
+		})
+	}
+
+	// bare CHECKSIGs in the outputs count four each toward the transaction's cost
+	tx := twoInputTx(script.P2pkhScript(make([]byte, 20)))
+	lock := script.NewScript([]script.ScriptCommand{{Opcode: script.OP_CHECKSIG}})
+	tx.Outputs = nil
+	for range MAX_STANDARD_TX_SIGOPS_COST / WITNESS_SCALE_FACTOR {
+		tx.Outputs = append(tx.Outputs, TxOut{ScriptPubKey: lock})
+	}
+	tx.ClearCache()
+	if cost, err := tx.SigOpCost(); err != nil || cost != MAX_STANDARD_TX_SIGOPS_COST {
+		t.Fatalf("SigOpCost = %d, %v, want %d", cost, err, MAX_STANDARD_TX_SIGOPS_COST)
+	}
+	if err := tx.CheckStandardSigOps(); err != nil {
+		t.Fatalf("at limit: %v", err)
+	}
+	tx.Outputs = append(tx.Outputs, TxOut{ScriptPubKey: lock})
+	tx.ClearCache()
+	if err := tx.CheckStandardSigOps(); !errors.Is(err, ErrTooManySigOps) {
+		t.Fatalf("over limit: got %v, want %v", err, ErrTooManySigOps)
+	}
+	t.Logf("✓ Transaction sigop cost limited to %d", MAX_STANDARD_TX_SIGOPS_COST)
+}
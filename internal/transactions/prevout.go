@@ -0,0 +1,44 @@
+package transactions
+
+import (
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/script"
+)
+
+var ErrPrevOutNotFound = errors.New("spent output not found")
+
+// PrevOutProvider looks up the output an input spends, by txid (display byte order) and
+// output index. Signature hashes, fees and verification all need the amounts and scripts
+// of spent outputs, which a transaction doesn't carry.
+type PrevOutProvider interface {
+	GetOutput(txid [32]byte, vout uint32) (amount uint64, scriptPubKey script.Script, err error)
+}
+
+// PrevOutMap is a PrevOutProvider over a fixed set of outputs
+type PrevOutMap map[OutPoint]TxOut
+
+func (m PrevOutMap) GetOutput(txid [32]byte, vout uint32) (uint64, script.Script, error) {
+	op := OutPoint{TxID: txid, Index: vout}
+	out, ok := m[op]
+	if !ok {
+		return 0, script.Script{}, fmt.Errorf("%w: %s", ErrPrevOutNotFound, op)
+	}
+	return out.Amount, out.ScriptPubKey, nil
+}
+
+// prevOutProvider returns the transaction's provider, falling back to the block explorer
+// on the given network when it has none
+func (t *Transaction) prevOutProvider(testNet bool) PrevOutProvider {
+	if t.PrevOuts != nil {
+		return t.PrevOuts
+	}
+	fetcher := NewTxFetcher()
+	fetcher.TestNet = testNet
+	return &fetcher
+}
+
+// spentOutput returns the output input i spends, which the input keeps once looked up
+func (t *Transaction) spentOutput(i int) (TxOut, error) {
+	return t.Inputs[i].PrevOutput(t.prevOutProvider(t.IsTestnet))
+}
@@ -0,0 +1,118 @@
+package transactions
+
+import (
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"slices"
+	"testing"
+)
+
+// countingProvider counts lookups on top of a PrevOutMap
+type countingProvider struct {
+	PrevOutMap
+	calls int
+}
+
+func (c *countingProvider) GetOutput(txid [32]byte, vout uint32) (uint64, script.Script, error) {
+	c.calls++
+	return c.PrevOutMap.GetOutput(txid, vout)
+}
+
+func TestPrevOutProvider(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2349))
+	pub := key.PublicKey()
+	lock := script.P2pkhScript(encoding.Hash160(pub.Serialize(true)))
+	spent := utxo(7, 20_000, lock)
+
+	tx := NewTransaction(1, []TxIn{NewTxIn(spent.OutPoint.TxID[:], spent.OutPoint.Index, SEQUENCE_FINAL)},
+		[]TxOut{{Amount: 19_000, ScriptPubKey: lock}}, 0, false, false)
+	provider := &countingProvider{PrevOutMap: PrevOutMap{spent.OutPoint: spent.Output}}
+	tx.PrevOuts = provider
+	if err := tx.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := tx.Verify(); err != nil || !ok {
+		t.Fatalf("verify = %v, %v", ok, err)
+	}
+	if fee, err := tx.Fee(false); err != nil || fee != 1_000 {
+		t.Errorf("fee = %d, %v", fee, err)
+	}
+	if provider.calls != 1 {
+		t.Errorf("provider asked %d times, want once", provider.calls)
+	}
+	if !tx.Inputs[0].HasPrevOut() || tx.Inputs[0].PrevAmount != 20_000 {
+		t.Errorf("input kept %d, %v", tx.Inputs[0].PrevAmount, tx.Inputs[0].PrevScriptPubKey)
+	}
+	t.Logf("✓ Signing, fees and verification look each spent output up once, through the provider")
+
+	other := TxOut{Amount: 20_001, ScriptPubKey: lock}
+	tx.Inputs[0].SetPrevOut(other)
+	if fee, _ := tx.Fee(false); fee != 1_001 || provider.calls != 1 {
+		t.Errorf("fee = %d with the prevout supplied, %d lookups", fee, provider.calls)
+	}
+	t.Logf("✓ Outputs given to SetPrevOut take precedence")
+
+	tx = NewTransaction(1, []TxIn{NewTxIn(make([]byte, 32), 0, SEQUENCE_FINAL)}, nil, 0, false, false)
+	tx.PrevOuts = PrevOutMap{}
+	if _, err := tx.Fee(false); !errors.Is(err, ErrPrevOutNotFound) {
+		t.Errorf("missing output: err = %v, want %v", err, ErrPrevOutNotFound)
+	}
+	t.Logf("✓ Outputs the provider doesn't know are an error, not a fetch")
+}
+
+func TestVerifyWithPrevOuts(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2350))
+	pub := key.PublicKey()
+	p2pkh := utxo(1, 30_000, script.P2pkhScript(encoding.Hash160(pub.Serialize(true))))
+	outputKey, err := keys.TweakPublicKey(pub.SerializeXOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2tr := utxo(2, 40_000, script.P2trScript(outputKey.SerializeXOnly()))
+	prevouts := map[OutPoint]TxOut{p2pkh.OutPoint: p2pkh.Output, p2tr.OutPoint: p2tr.Output}
+
+	// sign with the prevouts supplied, then verify a copy that has none
+	signed := NewTransaction(2, nil, []TxOut{{Amount: 69_000, ScriptPubKey: p2pkh.Output.ScriptPubKey}}, 0, false, false)
+	signed.PrevOuts = PrevOutMap(prevouts)
+	for _, u := range []Utxo{p2pkh, p2tr} {
+		signed.Inputs = append(signed.Inputs, NewTxIn(u.OutPoint.TxID[:], u.OutPoint.Index, SEQUENCE_FINAL))
+	}
+	if err := signed.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := signed.SignInputTaproot(1, *key, nil, encoding.SIGHASH_DEFAULT); err != nil {
+		t.Fatal(err)
+	}
+	inputs := slices.Clone(signed.Inputs)
+	for i := range inputs {
+		inputs[i].PrevScriptPubKey = nil // forget what signing looked up
+	}
+	tx := NewTransaction(signed.Version, inputs, signed.Outputs, signed.Locktime, false, signed.IsSegwit)
+
+	if ok, err := tx.VerifyWithPrevOuts(prevouts); err != nil || !ok {
+		t.Fatalf("verify = %v, %v", ok, err)
+	}
+	if tx.PrevOuts != nil || tx.Inputs[0].HasPrevOut() {
+		t.Error("VerifyWithPrevOuts modified the transaction")
+	}
+	t.Logf("✓ Signed legacy and taproot inputs verify offline against supplied prevouts")
+
+	// taproot signatures commit to every spent amount
+	wrong := map[OutPoint]TxOut{p2pkh.OutPoint: {Amount: 31_000, ScriptPubKey: p2pkh.Output.ScriptPubKey}, p2tr.OutPoint: p2tr.Output}
+	if ok, _ := tx.VerifyWithPrevOuts(wrong); ok {
+		t.Error("verified against a wrong prevout amount")
+	}
+	// outputs worth more than the prevouts
+	short := map[OutPoint]TxOut{p2pkh.OutPoint: {Amount: 1_000, ScriptPubKey: p2pkh.Output.ScriptPubKey}, p2tr.OutPoint: p2tr.Output}
+	if _, err := tx.VerifyWithPrevOuts(short); err == nil {
+		t.Error("outputs over inputs verified")
+	}
+	delete(prevouts, p2tr.OutPoint)
+	if _, err := tx.VerifyWithPrevOuts(prevouts); !errors.Is(err, ErrPrevOutNotFound) {
+		t.Errorf("missing prevout: err = %v, want %v", err, ErrPrevOutNotFound)
+	}
+	t.Logf("✓ Wrong, short and missing prevouts fail without touching the network")
+}
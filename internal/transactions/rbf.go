@@ -0,0 +1,111 @@
+package transactions
+
+import (
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/script"
+	"math"
+)
+
+// BIP 125 replace-by-fee constants
+const (
+	MAX_BIP125_RBF_SEQUENCE uint32  = 0xfffffffd // highest sequence that signals replaceability
+	INCREMENTAL_RELAY_FEE   float64 = 1.0        // sat/vB a replacement must add on top of the fee it replaces
+)
+
+var (
+	ErrNotReplaceable = errors.New("transaction does not signal BIP 125 replaceability")
+	ErrFeeRateTooLow  = errors.New("replacement fee rate not above the original")
+)
+
+// SignalsRBF reports whether the transaction opts in to replacement under BIP 125: any
+// input with a sequence below 0xfffffffe. Replaceability inherited from unconfirmed
+// ancestors isn't visible from the transaction alone.
+func (t *Transaction) SignalsRBF() bool {
+	for _, txin := range t.Inputs {
+		if txin.Sequence <= MAX_BIP125_RBF_SEQUENCE {
+			return true
+		}
+	}
+	return false
+}
+
+// FeeBump is a replacement for a transaction, paying a higher fee out of its change
+type FeeBump struct {
+	Tx  Transaction // unsigned replacement
+	Fee uint64      // fee the replacement pays once Shortfall is covered
+
+	// Shortfall is how much more the change output can't cover. When it's non-zero Tx
+	// still carries the original change and needs new inputs worth Shortfall, plus the
+	// fee for their own size, before it can be signed.
+	Shortfall uint64
+}
+
+// BumpFee builds a replacement for tx paying newFeeRate sat/vB, taking the extra fee out
+// of the output at changeIndex, or -1 if there is none. The replacement keeps tx's inputs,
+// sequences and other outputs, and pays at least INCREMENTAL_RELAY_FEE per vbyte more than
+// tx did as BIP 125 requires. Change left below dust is dropped to the fee unless it's the
+// only output. tx must be signed so its size is known, and its inputs' values must be
+// known or fetchable.
+func BumpFee(tx *Transaction, newFeeRate float64, changeIndex int) (*FeeBump, error) {
+	if !tx.SignalsRBF() {
+		return nil, ErrNotReplaceable
+	}
+	if changeIndex < -1 || changeIndex >= len(tx.Outputs) {
+		return nil, fmt.Errorf("change index %d out of range", changeIndex)
+	}
+	oldFee, err := tx.Fee(tx.IsTestnet)
+	if err != nil {
+		return nil, err
+	}
+	vsize, err := tx.VSize()
+	if err != nil {
+		return nil, err
+	}
+	if newFeeRate <= float64(oldFee)/float64(vsize) {
+		return nil, fmt.Errorf("%w: %v <= %v sat/vB", ErrFeeRateTooLow, newFeeRate, float64(oldFee)/float64(vsize))
+	}
+
+	newFee := uint64(math.Ceil(newFeeRate * float64(vsize)))
+	minFee := oldFee + uint64(math.Ceil(INCREMENTAL_RELAY_FEE*float64(vsize)))
+	newFee = max(newFee, minFee)
+	extra := newFee - oldFee
+
+	replacement := *tx
+	replacement.Inputs = make([]TxIn, len(tx.Inputs))
+	for i, txin := range tx.Inputs {
+		txin.ScriptSig = script.NewScript([]script.ScriptCommand{})
+		txin.Witness = nil
+		replacement.Inputs[i] = txin
+	}
+	replacement.Outputs = append([]TxOut{}, tx.Outputs...)
+	replacement.IsSegwit = false
+	replacement.ClearCache()
+
+	bump := &FeeBump{Tx: replacement, Fee: newFee}
+	if changeIndex == -1 {
+		bump.Shortfall = extra
+		return bump, nil
+	}
+	change := replacement.Outputs[changeIndex]
+	if change.Amount < extra {
+		bump.Shortfall = extra - change.Amount
+		return bump, nil
+	}
+	dust, err := DustThreshold(change)
+	if err != nil {
+		return nil, err
+	}
+	if change.Amount-extra < dust {
+		if len(replacement.Outputs) == 1 {
+			// the change is all there is, so it has to stay above dust
+			bump.Shortfall = dust - (change.Amount - extra)
+			return bump, nil
+		}
+		bump.Tx.Outputs = append(replacement.Outputs[:changeIndex], replacement.Outputs[changeIndex+1:]...)
+		bump.Fee = oldFee + change.Amount
+		return bump, nil
+	}
+	bump.Tx.Outputs[changeIndex].Amount -= extra
+	return bump, nil
+}
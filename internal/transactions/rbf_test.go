@@ -0,0 +1,117 @@
+package transactions
+
+import (
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"testing"
+)
+
+func TestBumpFee(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(125))
+	pub := key.PublicKey()
+	h160 := encoding.Hash160(pub.Serialize(true))
+	lock := script.P2pkhScript(h160)
+
+	// pays 30_000 out of 100_000 at 2 sat/vB, with the rest as change at index 1
+	signed := func(t *testing.T, amount uint64, rbf bool) Transaction {
+		t.Helper()
+		tx, err := NewBuilder().
+			AddInput(utxo(1, amount, lock)).
+			PayToAddress(script.P2pkhAddress(encoding.Hash160([]byte("dest")), false), 30_000).
+			SetFeeRate(2).
+			SetChangeAddress(script.P2pkhAddress(h160, false)).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rbf {
+			tx.Inputs[0].Sequence = MAX_BIP125_RBF_SEQUENCE
+		}
+		if err := tx.SignInput(0, *key, true); err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	tx := signed(t, 100_000, true)
+	if !tx.SignalsRBF() {
+		t.Fatal("sequence 0xfffffffd does not signal RBF")
+	}
+	vsize, _ := tx.VSize()
+	oldFee, _ := tx.Fee(false)
+
+	bump, err := BumpFee(&tx, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bump.Shortfall != 0 || bump.Fee != uint64(10*vsize) {
+		t.Fatalf("fee = %d, shortfall = %d, want %d and 0", bump.Fee, bump.Shortfall, 10*vsize)
+	}
+	if got := bump.Tx.Outputs[1].Amount; got != tx.Outputs[1].Amount-(bump.Fee-oldFee) {
+		t.Errorf("change = %d, want %d", got, tx.Outputs[1].Amount-(bump.Fee-oldFee))
+	}
+	if bump.Tx.Inputs[0].Sequence != MAX_BIP125_RBF_SEQUENCE || len(bump.Tx.Inputs[0].ScriptSig.CommandStack) != 0 {
+		t.Error("replacement should keep sequences and drop signatures")
+	}
+	if len(tx.Inputs[0].ScriptSig.CommandStack) == 0 || tx.Outputs[1].Amount == bump.Tx.Outputs[1].Amount {
+		t.Error("original transaction was modified")
+	}
+	if err := bump.Tx.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := bump.Tx.Verify(); err != nil || !ok {
+		t.Fatalf("replacement doesn't verify: %v", err)
+	}
+	t.Logf("✓ Replacement pays the new fee rate out of change and re-signs")
+
+	// a rate barely above the original still pays the incremental relay fee
+	bump, err = BumpFee(&tx, float64(oldFee)/float64(vsize)+0.01, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bump.Fee != oldFee+uint64(vsize) {
+		t.Errorf("fee = %d, want original %d plus %d incremental", bump.Fee, oldFee, vsize)
+	}
+	t.Logf("✓ Replacement fee covers the original plus the incremental relay fee")
+
+	// change that can't cover the bump and stay above dust
+	small := signed(t, 30_000+450+600, true)
+	if len(small.Outputs) != 2 {
+		t.Fatalf("fixture has %d outputs, want change", len(small.Outputs))
+	}
+	smallFee, _ := small.Fee(false)
+	bump, err = BumpFee(&small, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bump.Tx.Outputs) != 1 || bump.Shortfall != 0 || bump.Fee != 1050 {
+		t.Errorf("outputs = %d, fee = %d, shortfall = %d, want change dropped to the fee", len(bump.Tx.Outputs), bump.Fee, bump.Shortfall)
+	}
+	bump, err = BumpFee(&small, 20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bump.Fee - smallFee - bump.Tx.Outputs[1].Amount; bump.Shortfall != want || len(bump.Tx.Outputs) != 2 {
+		t.Errorf("shortfall = %d, want %d with change kept", bump.Shortfall, want)
+	}
+	bump, err = BumpFee(&small, 20, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bump.Shortfall != bump.Fee-smallFee {
+		t.Errorf("shortfall without change = %d, want %d", bump.Shortfall, bump.Fee-smallFee)
+	}
+	t.Logf("✓ Dust change is dropped and a bump change can't cover is flagged for more inputs")
+
+	final := signed(t, 100_000, false)
+	if _, err := BumpFee(&final, 10, 1); !errors.Is(err, ErrNotReplaceable) {
+		t.Errorf("non-signalling tx: err = %v, want %v", err, ErrNotReplaceable)
+	}
+	if _, err := BumpFee(&tx, 1, 1); !errors.Is(err, ErrFeeRateTooLow) {
+		t.Errorf("lower fee rate: err = %v, want %v", err, ErrFeeRateTooLow)
+	}
+	t.Logf("✓ Non-signalling transactions and lower fee rates are rejected")
+}
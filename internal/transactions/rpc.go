@@ -0,0 +1,200 @@
+package transactions
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/script"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// SATS_PER_BTC converts the BTC amounts Bitcoin Core's RPC reports
+const SATS_PER_BTC uint64 = 100_000_000
+
+var ErrRPC = errors.New("bitcoind RPC error")
+
+// RPCClient talks JSON-RPC to a Bitcoin Core node: a PrevOutProvider and Broadcaster for
+// users with their own node. Looking up spent outputs needs the node's -txindex.
+type RPCClient struct {
+	URL      string // e.g. http://127.0.0.1:8332
+	User     string
+	Password string
+	Client   *http.Client // nil uses the fetchers' shared client
+
+	id atomic.Uint64
+}
+
+func NewRPCClient(url, user, password string) *RPCClient {
+	return &RPCClient{URL: url, User: user, Password: password}
+}
+
+// NewRPCClientCookie authenticates with the node's .cookie file, as written to its
+// data directory when no rpcpassword is set
+func NewRPCClientCookie(url, cookiePath string) (*RPCClient, error) {
+	cookie, err := os.ReadFile(cookiePath)
+	if err != nil {
+		return nil, err
+	}
+	user, password, ok := strings.Cut(strings.TrimSpace(string(cookie)), ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed cookie file %s", cookiePath)
+	}
+	return NewRPCClient(url, user, password), nil
+}
+
+// call makes a JSON-RPC request and decodes its result into result. A null result
+// leaves result untouched and reports false.
+func (c *RPCClient) call(method string, params []any, result any) (bool, error) {
+	body, err := json.Marshal(map[string]any{
+		"jsonrpc": "1.0",
+		"id":      c.id.Add(1),
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.User, c.Password)
+	client := c.Client
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// Bitcoin Core answers RPC errors with a 500 or 404 and a JSON body
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return false, fmt.Errorf("%s: %w %d", method, ErrFetchStatus, resp.StatusCode)
+	}
+	if reply.Error != nil {
+		return false, fmt.Errorf("%w: %s: %d %s", ErrRPC, method, reply.Error.Code, reply.Error.Message)
+	}
+	if len(reply.Result) == 0 || string(reply.Result) == "null" {
+		return false, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(reply.Result))
+	d.UseNumber()
+	return true, d.Decode(result)
+}
+
+// Fetch returns the transaction txid (display byte order hex), from the mempool, the
+// wallet or -txindex
+func (c *RPCClient) Fetch(txid string) (*Transaction, error) {
+	var rawHex string
+	if ok, err := c.call("getrawtransaction", []any{txid, false}, &rawHex); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrPrevOutNotFound, txid)
+	}
+	tx, err := FromHex(rawHex)
+	if err != nil {
+		return nil, err
+	}
+	if id, _ := tx.Id(); id != txid {
+		return nil, fmt.Errorf("Transaction IDs don't match. Got: %s, expected: %s", id, txid)
+	}
+	return &tx, nil
+}
+
+// GetOutput looks an output up in the node's UTXO set, mempool included, and falls back
+// to fetching the whole transaction for outputs already spent
+func (c *RPCClient) GetOutput(txid [32]byte, vout uint32) (uint64, script.Script, error) {
+	var utxo struct {
+		Value        json.Number `json:"value"`
+		ScriptPubKey struct {
+			Hex string `json:"hex"`
+		} `json:"scriptPubKey"`
+	}
+	ok, err := c.call("gettxout", []any{fmt.Sprintf("%x", txid), vout, true}, &utxo)
+	if err != nil {
+		return 0, script.Script{}, err
+	}
+	if !ok {
+		tx, err := c.Fetch(fmt.Sprintf("%x", txid))
+		if err != nil {
+			return 0, script.Script{}, err
+		}
+		if int(vout) >= len(tx.Outputs) {
+			return 0, script.Script{}, fmt.Errorf("%w: %x:%d", ErrPrevOutNotFound, txid, vout)
+		}
+		return tx.Outputs[vout].Amount, tx.Outputs[vout].ScriptPubKey, nil
+	}
+
+	amount, err := parseBTC(utxo.Value)
+	if err != nil {
+		return 0, script.Script{}, err
+	}
+	raw, err := hex.DecodeString(utxo.ScriptPubKey.Hex)
+	if err != nil {
+		return 0, script.Script{}, err
+	}
+	spk, err := script.ParseRawScript(raw)
+	if err != nil {
+		return 0, script.Script{}, err
+	}
+	return amount, spk, nil
+}
+
+// Broadcast submits tx with sendrawtransaction and returns its txid
+func (c *RPCClient) Broadcast(tx *Transaction) ([32]byte, error) {
+	rawHex, err := tx.Hex()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var txid string
+	if _, err := c.call("sendrawtransaction", []any{rawHex}, &txid); err != nil {
+		return [32]byte{}, err
+	}
+	return parseTxid(txid)
+}
+
+// parseBTC converts a decimal BTC amount to satoshis without going through a float
+func parseBTC(n json.Number) (uint64, error) {
+	whole, frac, _ := strings.Cut(n.String(), ".")
+	if len(frac) > 8 {
+		return 0, fmt.Errorf("amount %s has more than 8 decimals", n)
+	}
+	btc, err := strconv.ParseUint(whole, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("amount %s: %w", n, err)
+	}
+	sats := uint64(0)
+	if frac != "" {
+		if sats, err = strconv.ParseUint(frac+strings.Repeat("0", 8-len(frac)), 10, 64); err != nil {
+			return 0, fmt.Errorf("amount %s: %w", n, err)
+		}
+	}
+	return btc*SATS_PER_BTC + sats, nil
+}
+
+// parseTxid decodes a txid in display byte order hex
+func parseTxid(s string) ([32]byte, error) {
+	var txid [32]byte
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != 32 {
+		return txid, fmt.Errorf("invalid txid %q", s)
+	}
+	copy(txid[:], raw)
+	return txid, nil
+}
@@ -0,0 +1,138 @@
+package transactions
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRPCClient(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2360))
+	pub := key.PublicKey()
+	lock := script.P2pkhScript(encoding.Hash160(pub.Serialize(true)))
+	rawLock, _ := lock.RawBytes()
+
+	// a spent funding transaction, whose output 1 is still unspent
+	funding := NewTransaction(1, []TxIn{NewTxIn(make([]byte, 32), 0, SEQUENCE_FINAL)},
+		[]TxOut{{Amount: 20_000, ScriptPubKey: lock}, {Amount: 123_456_789, ScriptPubKey: lock}}, 0, false, false)
+	fundingId, _ := funding.Id()
+	fundingHex, _ := funding.Hex()
+
+	var sent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "alice" || pass != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Method string `json:"method"`
+			Params []any  `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		reply := map[string]any{"result": nil, "error": nil}
+		switch req.Method {
+		case "gettxout":
+			if req.Params[0] == fundingId && req.Params[1] == float64(1) {
+				reply["result"] = map[string]any{
+					"value":        json.Number("1.23456789"),
+					"scriptPubKey": map[string]any{"hex": hex.EncodeToString(rawLock)},
+				}
+			}
+		case "getrawtransaction":
+			if req.Params[0] == fundingId {
+				reply["result"] = fundingHex
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+				reply["error"] = map[string]any{"code": -5, "message": "No such mempool or blockchain transaction"}
+			}
+		case "sendrawtransaction":
+			sent = req.Params[0].(string)
+			reply["result"] = "ff" + sent[2:64] // any 32 bytes will do
+		}
+		json.NewEncoder(w).Encode(reply)
+	}))
+	defer srv.Close()
+
+	cookie := filepath.Join(t.TempDir(), ".cookie")
+	if err := os.WriteFile(cookie, []byte("alice:hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rpc, err := NewRPCClientCookie(srv.URL, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fundingTxid [32]byte
+	copy(fundingTxid[:], mustHex(t, fundingId))
+	amount, spk, err := rpc.GetOutput(fundingTxid, 1)
+	if err != nil || amount != 123_456_789 || !spk.IsP2pkhScriptPubKey() {
+		t.Fatalf("unspent output = %d, %v, %v", amount, spk, err)
+	}
+	// output 0 is spent, so comes from the whole transaction
+	if amount, _, err := rpc.GetOutput(fundingTxid, 0); err != nil || amount != 20_000 {
+		t.Fatalf("spent output = %d, %v", amount, err)
+	}
+	if _, _, err := rpc.GetOutput([32]byte{1}, 0); !errors.Is(err, ErrRPC) {
+		t.Errorf("unknown tx: err = %v, want %v", err, ErrRPC)
+	}
+	t.Logf("✓ GetOutput reads the UTXO set and falls back to the raw transaction")
+
+	// sign and verify with the node as the only source of prevouts, then broadcast
+	tx := NewTransaction(1, []TxIn{NewTxIn(fundingTxid[:], 0, SEQUENCE_FINAL), NewTxIn(fundingTxid[:], 1, SEQUENCE_FINAL)},
+		[]TxOut{{Amount: 123_000_000, ScriptPubKey: lock}}, 0, false, false)
+	tx.PrevOuts = rpc
+	for i := range tx.Inputs {
+		if err := tx.SignInput(i, *key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := tx.Verify(); err != nil || !ok {
+		t.Fatalf("verify = %v, %v", ok, err)
+	}
+	var b Broadcaster = rpc
+	if _, err := b.Broadcast(&tx); err != nil {
+		t.Fatal(err)
+	}
+	if rawHex, _ := tx.Hex(); sent != rawHex {
+		t.Error("sendrawtransaction got a different transaction")
+	}
+	t.Logf("✓ A transaction signs, verifies and broadcasts through the node alone")
+
+	if _, _, err := NewRPCClient(srv.URL, "alice", "wrong").GetOutput(fundingTxid, 1); err == nil {
+		t.Error("bad credentials accepted")
+	}
+}
+
+func TestParseBTC(t *testing.T) {
+	tests := map[string]uint64{"0": 0, "1": SATS_PER_BTC, "0.00000001": 1, "20999999.9769": 2_099_999_997_690_000, "0.5": 50_000_000}
+	for in, want := range tests {
+		if got, err := parseBTC(json.Number(in)); err != nil || got != want {
+			t.Errorf("parseBTC(%s) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"0.000000001", "-1", "1e8"} {
+		if _, err := parseBTC(json.Number(bad)); err == nil {
+			t.Errorf("parseBTC(%s) succeeded", bad)
+		}
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
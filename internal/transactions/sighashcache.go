@@ -0,0 +1,172 @@
+package transactions
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// sigHashCache holds the hashes over every input and output that all of a transaction's
+// BIP143 and BIP341 signature hashes share, so signing n inputs hashes the transaction
+// once rather than n times. BIP341 commits to single SHA256s of the same data BIP143
+// double hashes, so each BIP143 hash is one more SHA256 of the cached midstate.
+//
+// Each hash is dropped by the methods that change what it covers; the input and output
+// counts it was computed at also catch direct appends. Other direct changes to inputs or
+// outputs need ClearCache.
+type sigHashCache struct {
+	inputs, outputs int // lengths of Inputs and Outputs when the hashes were taken
+
+	prevOuts      []byte // outpoints
+	sequences     []byte
+	outputsHash   []byte // serialized outputs
+	amounts       []byte // spent amounts, BIP341 only
+	scriptPubKeys []byte // spent scriptPubKeys, BIP341 only
+}
+
+// sigHashes returns the cache, emptied first if inputs or outputs have been added or
+// removed since it was filled
+func (t *Transaction) sigHashes() *sigHashCache {
+	c := &t.sigHashCache
+	if c.inputs != len(t.Inputs) || c.outputs != len(t.Outputs) {
+		*c = sigHashCache{inputs: len(t.Inputs), outputs: len(t.Outputs)}
+	}
+	return c
+}
+
+// invalidateInputs drops the hashes over the inputs
+func (t *Transaction) invalidateInputs() {
+	c := &t.sigHashCache
+	c.prevOuts, c.sequences, c.amounts, c.scriptPubKeys = nil, nil, nil, nil
+	t.clearIds()
+}
+
+// invalidateOutputs drops the hash over the outputs
+func (t *Transaction) invalidateOutputs() {
+	t.sigHashCache.outputsHash = nil
+	t.clearIds()
+}
+
+// shaPrevOuts is BIP341's sha_prevouts: the SHA256 of every input's outpoint
+func (t *Transaction) shaPrevOuts() []byte {
+	c := t.sigHashes()
+	if c.prevOuts == nil {
+		h := sha256.New()
+		for _, txin := range t.Inputs {
+			h.Write(taprootOutPoint(txin))
+		}
+		c.prevOuts = h.Sum(nil)
+	}
+	return c.prevOuts
+}
+
+// shaSequences is BIP341's sha_sequences: the SHA256 of every input's sequence
+func (t *Transaction) shaSequences() []byte {
+	c := t.sigHashes()
+	if c.sequences == nil {
+		h := sha256.New()
+		buf4 := make([]byte, 4)
+		for _, txin := range t.Inputs {
+			binary.LittleEndian.PutUint32(buf4, txin.Sequence)
+			h.Write(buf4)
+		}
+		c.sequences = h.Sum(nil)
+	}
+	return c.sequences
+}
+
+// shaOutputs is BIP341's sha_outputs: the SHA256 of every serialized output
+func (t *Transaction) shaOutputs() ([]byte, error) {
+	c := t.sigHashes()
+	if c.outputsHash == nil {
+		h := sha256.New()
+		for _, txout := range t.Outputs {
+			ser, err := txout.Serialize()
+			if err != nil {
+				return nil, err
+			}
+			h.Write(ser)
+		}
+		c.outputsHash = h.Sum(nil)
+	}
+	return c.outputsHash, nil
+}
+
+// shaSpentOutputs returns BIP341's sha_amounts and sha_scriptpubkeys, over the outputs
+// every input spends
+func (t *Transaction) shaSpentOutputs() (amounts, scriptPubKeys []byte, err error) {
+	c := t.sigHashes()
+	if c.amounts == nil || c.scriptPubKeys == nil {
+		amountHash, scriptHash := sha256.New(), sha256.New()
+		buf8 := make([]byte, 8)
+		for i := range t.Inputs {
+			prevOut, err := t.spentOutput(i)
+			if err != nil {
+				return nil, nil, err
+			}
+			binary.LittleEndian.PutUint64(buf8, prevOut.Amount)
+			amountHash.Write(buf8)
+			ser, err := prevOut.ScriptPubKey.Serialize()
+			if err != nil {
+				return nil, nil, err
+			}
+			scriptHash.Write(ser)
+		}
+		c.amounts, c.scriptPubKeys = amountHash.Sum(nil), scriptHash.Sum(nil)
+	}
+	return c.amounts, c.scriptPubKeys, nil
+}
+
+// hashPrevOuts is BIP143's hashPrevouts, the double SHA256 of every outpoint
+func (t *Transaction) hashPrevOuts() []byte {
+	return sha256Sum(t.shaPrevOuts())
+}
+
+// hashSequence is BIP143's hashSequence
+func (t *Transaction) hashSequence() []byte {
+	return sha256Sum(t.shaSequences())
+}
+
+// hashOutputs is BIP143's hashOutputs
+func (t *Transaction) hashOutputs() ([]byte, error) {
+	sha, err := t.shaOutputs()
+	if err != nil {
+		return nil, err
+	}
+	return sha256Sum(sha), nil
+}
+
+func sha256Sum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+// AddInput appends txin, dropping the cached hashes it invalidates
+func (t *Transaction) AddInput(txin TxIn) {
+	t.Inputs = append(t.Inputs, txin)
+	t.invalidateInputs()
+}
+
+// AddOutput appends out, dropping the cached hashes it invalidates
+func (t *Transaction) AddOutput(out TxOut) {
+	t.Outputs = append(t.Outputs, out)
+	t.invalidateOutputs()
+}
+
+// SetInput replaces input i, dropping the cached hashes it invalidates
+func (t *Transaction) SetInput(i int, txin TxIn) {
+	t.Inputs[i] = txin
+	t.invalidateInputs()
+}
+
+// SetSequence sets input i's sequence, dropping the cached hashes it invalidates
+func (t *Transaction) SetSequence(i int, sequence uint32) {
+	t.Inputs[i].Sequence = sequence
+	t.sigHashCache.sequences = nil
+	t.clearIds()
+}
+
+// SetOutput replaces output i, dropping the cached hashes it invalidates
+func (t *Transaction) SetOutput(i int, out TxOut) {
+	t.Outputs[i] = out
+	t.invalidateOutputs()
+}
@@ -0,0 +1,98 @@
+package transactions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"testing"
+)
+
+func TestSigHashCache(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2366))
+	pub := key.PublicKey()
+	lock := script.P2wpkhScript(encoding.Hash160(pub.Serialize(true)))
+
+	// sigHashes returns both kinds of hash for every input, uncached
+	sigHashes := func(t *testing.T, tx Transaction) [][]byte {
+		t.Helper()
+		tx.ClearCache()
+		var hashes [][]byte
+		for i := range tx.Inputs {
+			z, err := tx.SigHashBIP143(i, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zt, err := tx.SigHashTaproot(i, encoding.SIGHASH_DEFAULT, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashes = append(hashes, z, zt)
+		}
+		return hashes
+	}
+	// check compares tx's cached hashes with a fresh computation
+	check := func(t *testing.T, name string, tx *Transaction) {
+		t.Helper()
+		want := sigHashes(t, *tx)
+		for i := range tx.Inputs {
+			z, _ := tx.SigHashBIP143(i, nil, nil)
+			zt, _ := tx.SigHashTaproot(i, encoding.SIGHASH_DEFAULT, nil, nil)
+			if !bytes.Equal(z, want[2*i]) || !bytes.Equal(zt, want[2*i+1]) {
+				t.Errorf("%s: input %d hashed from a stale cache", name, i)
+			}
+		}
+	}
+
+	tx := twoInputTx(lock)
+	check(t, "fresh", &tx)
+	if want := sha256.Sum256(tx.shaPrevOuts()); !bytes.Equal(tx.hashPrevOuts(), want[:]) ||
+		!bytes.Equal(tx.hashPrevOuts(), encoding.Hash256(append(taprootOutPoint(tx.Inputs[0]), taprootOutPoint(tx.Inputs[1])...))) {
+		t.Error("BIP143 hashPrevouts isn't the hash of BIP341's sha_prevouts")
+	}
+	t.Logf("✓ BIP143 and BIP341 hashes share one set of midstates")
+
+	spent := TxOut{Amount: 20_000, ScriptPubKey: lock}
+	extra := NewTxIn(bytes.Repeat([]byte{3}, 32), 2, 0xfffffffe)
+	extra.SetPrevOut(spent)
+	mutations := []struct {
+		name  string
+		apply func(tx *Transaction)
+	}{
+		{"SetSequence", func(tx *Transaction) { tx.SetSequence(0, 5) }},
+		{"SetOutput", func(tx *Transaction) { tx.SetOutput(0, TxOut{Amount: 89_000, ScriptPubKey: lock}) }},
+		{"SetInput", func(tx *Transaction) { tx.SetInput(1, extra) }},
+		{"AddInput", func(tx *Transaction) { tx.AddInput(extra) }},
+		{"AddOutput", func(tx *Transaction) { tx.AddOutput(spent) }},
+		{"direct append", func(tx *Transaction) { tx.Outputs = append(tx.Outputs, spent) }},
+		{"SetLocktimeHeight", func(tx *Transaction) { tx.Inputs[0].Sequence = SEQUENCE_FINAL; tx.SetLocktimeHeight(1) }},
+	}
+	for _, m := range mutations {
+		tx := twoInputTx(lock)
+		tx.SigHashBIP143(0, nil, nil)
+		tx.SigHashTaproot(0, encoding.SIGHASH_DEFAULT, nil, nil)
+		m.apply(&tx)
+		check(t, m.name, &tx)
+	}
+	t.Logf("✓ Mutating methods and added inputs or outputs drop the hashes they invalidate")
+
+	// signing inputs one at a time, with an output added in between
+	tx = twoInputTx(lock)
+	if err := tx.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+	tx.AddOutput(spent)
+	tx.SetOutput(0, TxOut{Amount: 60_000, ScriptPubKey: lock})
+	if err := tx.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.SignInput(1, *key, true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := tx.Verify(); err != nil || !ok {
+		t.Fatalf("re-signed transaction doesn't verify: %v", err)
+	}
+	t.Logf("✓ Inputs re-signed after a change verify against the changed transaction")
+}
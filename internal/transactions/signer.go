@@ -0,0 +1,60 @@
+package transactions
+
+import (
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/eccmath"
+	"go-bitcoin/internal/keys"
+	"math/big"
+)
+
+var ErrBadSignature = errors.New("signer returned a signature that doesn't verify")
+
+// Signer signs with keys it holds, named by BIP32 derivation path, so a hardware wallet
+// or remote HSM can sign inputs without its private keys reaching this package. Paths
+// use the hardened bit 0x80000000 as in BIP32.
+type Signer interface {
+	PubKey(path []uint32) (keys.PublicKey, error)
+	SignHash(path []uint32, hash []byte) (eccmath.Signature, error)
+}
+
+// KeySigner is a Signer over a single private key, which signs for every path
+type KeySigner struct {
+	Key *keys.PrivateKey
+}
+
+func (ks KeySigner) PubKey(path []uint32) (keys.PublicKey, error) {
+	return ks.Key.PublicKey(), nil
+}
+
+func (ks KeySigner) SignHash(path []uint32, hash []byte) (eccmath.Signature, error) {
+	return ks.Key.SignHash(hash)
+}
+
+// SignInputWithSigner signs a P2PKH, P2WPKH or P2SH-wrapped P2WPKH input under hashType
+// like SignInputWithType, with the key signer holds at path. The key is serialized
+// compressed. Signatures are checked against the key before they're used, since a
+// device could sign with a key other than the one it reported.
+func (t *Transaction) SignInputWithSigner(inputIndex int, signer Signer, path []uint32, hashType uint32) error {
+	pub, err := signer.PubKey(path)
+	if err != nil {
+		return err
+	}
+	sign := func(hash []byte) (eccmath.Signature, error) {
+		return SignHashChecked(signer, path, pub, hash)
+	}
+	return t.signInput(inputIndex, pub, true, sign, hashType)
+}
+
+// SignHashChecked has signer sign hash with its key at path, and checks the signature
+// against pub, the key the signer reported there
+func SignHashChecked(signer Signer, path []uint32, pub keys.PublicKey, hash []byte) (eccmath.Signature, error) {
+	sig, err := signer.SignHash(path, hash)
+	if err != nil {
+		return eccmath.Signature{}, err
+	}
+	if !pub.Verify(new(big.Int).SetBytes(hash), sig) {
+		return eccmath.Signature{}, fmt.Errorf("%w: key %x", ErrBadSignature, pub.Serialize(true))
+	}
+	return sig, nil
+}
@@ -0,0 +1,96 @@
+package transactions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/eccmath"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"testing"
+)
+
+// deviceSigner stands in for a hardware wallet, holding a key per path. It signs with
+// signWith when set, to act as a faulty device.
+type deviceSigner struct {
+	keys     map[string]*keys.PrivateKey
+	signWith *keys.PrivateKey
+}
+
+func (d deviceSigner) key(path []uint32) (*keys.PrivateKey, error) {
+	key, ok := d.keys[fmt.Sprint(path)]
+	if !ok {
+		return nil, fmt.Errorf("no key at %v", path)
+	}
+	return key, nil
+}
+
+func (d deviceSigner) PubKey(path []uint32) (keys.PublicKey, error) {
+	key, err := d.key(path)
+	if err != nil {
+		return keys.PublicKey{}, err
+	}
+	return key.PublicKey(), nil
+}
+
+func (d deviceSigner) SignHash(path []uint32, hash []byte) (eccmath.Signature, error) {
+	key, err := d.key(path)
+	if err != nil {
+		return eccmath.Signature{}, err
+	}
+	if d.signWith != nil {
+		key = d.signWith
+	}
+	return key.SignHash(hash)
+}
+
+func TestSignInputWithSigner(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2369))
+	pub := key.PublicKey()
+	h160 := encoding.Hash160(pub.Serialize(true))
+	path := []uint32{0x80000054, 0x80000000, 0x80000000, 0, 3}
+	device := deviceSigner{keys: map[string]*keys.PrivateKey{fmt.Sprint(path): key}}
+
+	locks := map[string]script.Script{
+		"P2PKH":       script.P2pkhScript(h160),
+		"P2WPKH":      script.P2wpkhScript(h160),
+		"P2SH-P2WPKH": nestedP2wpkh(t, h160),
+	}
+	for name, lock := range locks {
+		tx := twoInputTx(lock)
+		if err := tx.SignInputWithSigner(0, device, path, encoding.SIGHASH_ALL); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if ok, err := tx.VerifyInput(0); err != nil || !ok {
+			t.Errorf("%s: verify = %v, %v", name, ok, err)
+		}
+		// the key goes last in the scriptSig or witness, compressed
+		last := tx.Inputs[0].Witness
+		if name == "P2PKH" {
+			last = [][]byte{tx.Inputs[0].ScriptSig.CommandStack[1].Data}
+		}
+		if !bytes.Equal(last[len(last)-1], pub.Serialize(true)) {
+			t.Errorf("%s: signed with key %x", name, last[len(last)-1])
+		}
+	}
+	t.Logf("✓ A Signer signs legacy, native and nested segwit inputs")
+
+	tx := twoInputTx(locks["P2WPKH"])
+	if err := tx.SignInputWithSigner(0, KeySigner{Key: key}, nil, encoding.SIGHASH_ALL); err != nil {
+		t.Errorf("KeySigner: %v", err)
+	}
+	tx = twoInputTx(locks["P2WPKH"])
+	if err := tx.SignInputWithSigner(0, device, path[:4], encoding.SIGHASH_ALL); err == nil {
+		t.Error("signed with a path the device doesn't have")
+	}
+	device.signWith = keys.NewPrivateKey(big.NewInt(1))
+	if err := tx.SignInputWithSigner(0, device, path, encoding.SIGHASH_ALL); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("signature by the wrong key: err = %v, want %v", err, ErrBadSignature)
+	}
+	if tx.Inputs[0].Witness != nil {
+		t.Error("bad signature was kept")
+	}
+	t.Logf("✓ Unknown paths and signatures by the wrong key are rejected")
+}
@@ -0,0 +1,272 @@
+package transactions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/eccmath"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"slices"
+)
+
+// BIP 341 constants
+const (
+	TAPROOT_TAG_SIGHASH   string = "TapSighash"
+	TAPROOT_ANNEX_TAG     byte   = 0x50                      // first byte of an annex, the optional last witness item
+	TAPROOT_KEY_VERSION   byte   = 0x00                      // key_version of BIP 342 tapscript signatures
+	TAPROOT_NO_CODESEP    uint32 = script.TAPROOT_NO_CODESEP // codesep_pos when no OP_CODESEPARATOR executed
+	TAPROOT_SIGHASH_EPOCH byte   = 0x00
+)
+
+var ErrTaprootHashType = errors.New("invalid taproot sighash type")
+
+// taprootWitness splits an annex off a taproot witness. BIP 341 treats the last of two
+// or more items as an annex when it starts with 0x50.
+func taprootWitness(witness [][]byte) (stack [][]byte, annex []byte) {
+	if len(witness) >= 2 {
+		last := witness[len(witness)-1]
+		if len(last) > 0 && last[0] == TAPROOT_ANNEX_TAG {
+			return witness[:len(witness)-1], last
+		}
+	}
+	return witness, nil
+}
+
+// SigHashTaproot returns the BIP 341 signature hash of a taproot input under hashType,
+// committing to annex if the witness carries one. A nil leafHash gives the key path
+// hash (ext_flag 0); a tapleaf hash gives the BIP 342 script path hash (ext_flag 1), for
+// a script with no OP_CODESEPARATOR ahead of the signature. Every input's previous output
+// must be known, since the hash commits to all their amounts and scripts.
+func (t *Transaction) SigHashTaproot(inputIndex int, hashType uint32, annex []byte, leafHash []byte) ([]byte, error) {
+	return t.sigHashTaproot(inputIndex, hashType, annex, leafHash, TAPROOT_NO_CODESEP)
+}
+
+// sigHashTaproot is SigHashTaproot with codeSepPos the position of the last
+// OP_CODESEPARATOR a script path signature follows
+func (t *Transaction) sigHashTaproot(inputIndex int, hashType uint32, annex []byte, leafHash []byte, codeSepPos uint32) ([]byte, error) {
+	if inputIndex < 0 || inputIndex >= len(t.Inputs) {
+		return nil, errors.New("inputIndex out of range")
+	}
+	switch hashType {
+	case encoding.SIGHASH_DEFAULT, encoding.SIGHASH_ALL, encoding.SIGHASH_NONE, encoding.SIGHASH_SINGLE,
+		encoding.SIGHASH_ALL | encoding.SIGHASH_ANYONECANPAY,
+		encoding.SIGHASH_NONE | encoding.SIGHASH_ANYONECANPAY,
+		encoding.SIGHASH_SINGLE | encoding.SIGHASH_ANYONECANPAY:
+	default:
+		return nil, fmt.Errorf("%w: %#x", ErrTaprootHashType, hashType)
+	}
+	anyoneCanPay := hashType&encoding.SIGHASH_ANYONECANPAY != 0
+	outputType := hashType & 0x03 // DEFAULT signs like ALL
+	if outputType == encoding.SIGHASH_DEFAULT {
+		outputType = encoding.SIGHASH_ALL
+	}
+	if outputType == encoding.SIGHASH_SINGLE && inputIndex >= len(t.Outputs) {
+		return nil, fmt.Errorf("%w: SINGLE on input %d with no matching output", ErrTaprootHashType, inputIndex)
+	}
+
+	buf4 := make([]byte, 4)
+	buf8 := make([]byte, 8)
+	var msg bytes.Buffer
+	msg.WriteByte(TAPROOT_SIGHASH_EPOCH)
+	msg.WriteByte(byte(hashType))
+	binary.LittleEndian.PutUint32(buf4, t.Version)
+	msg.Write(buf4)
+	binary.LittleEndian.PutUint32(buf4, t.Locktime)
+	msg.Write(buf4)
+
+	if !anyoneCanPay {
+		amounts, scriptPubKeys, err := t.shaSpentOutputs()
+		if err != nil {
+			return nil, err
+		}
+		msg.Write(t.shaPrevOuts())
+		msg.Write(amounts)
+		msg.Write(scriptPubKeys)
+		msg.Write(t.shaSequences())
+	}
+	if outputType == encoding.SIGHASH_ALL {
+		outputs, err := t.shaOutputs()
+		if err != nil {
+			return nil, err
+		}
+		msg.Write(outputs)
+	}
+
+	// spend_type = ext_flag * 2 + annex_present
+	var spendType byte
+	if leafHash != nil {
+		spendType = 2
+	}
+	if annex != nil {
+		spendType |= 1
+	}
+	msg.WriteByte(spendType)
+
+	txin := t.Inputs[inputIndex]
+	if anyoneCanPay {
+		msg.Write(taprootOutPoint(txin))
+		prevOut, err := t.spentOutput(inputIndex)
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(buf8, prevOut.Amount)
+		msg.Write(buf8)
+		ser, err := prevOut.ScriptPubKey.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		msg.Write(ser)
+		binary.LittleEndian.PutUint32(buf4, txin.Sequence)
+		msg.Write(buf4)
+	} else {
+		binary.LittleEndian.PutUint32(buf4, uint32(inputIndex))
+		msg.Write(buf4)
+	}
+	if annex != nil {
+		length, err := encoding.EncodeVarInt(uint64(len(annex)))
+		if err != nil {
+			return nil, err
+		}
+		annexHash := sha256.Sum256(append(length, annex...))
+		msg.Write(annexHash[:])
+	}
+	if outputType == encoding.SIGHASH_SINGLE {
+		ser, err := t.Outputs[inputIndex].Serialize()
+		if err != nil {
+			return nil, err
+		}
+		outputHash := sha256.Sum256(ser)
+		msg.Write(outputHash[:])
+	}
+	if leafHash != nil {
+		msg.Write(leafHash)
+		msg.WriteByte(TAPROOT_KEY_VERSION)
+		binary.LittleEndian.PutUint32(buf4, codeSepPos)
+		msg.Write(buf4)
+	}
+
+	return encoding.TaggedHash(TAPROOT_TAG_SIGHASH, msg.Bytes()), nil
+}
+
+// taprootOutPoint serializes an input's outpoint: txid in internal byte order, then index
+func taprootOutPoint(txin TxIn) []byte {
+	prevout := make([]byte, len(txin.PrevTx), len(txin.PrevTx)+4)
+	copy(prevout, txin.PrevTx)
+	slices.Reverse(prevout)
+	return binary.LittleEndian.AppendUint32(prevout, txin.PrevIdx)
+}
+
+// verifyTaproot checks a P2TR spend. The key path is a single Schnorr signature by the
+// output key, 64 bytes for SIGHASH_DEFAULT or 65 with the sighash type appended; with
+// more witness items it's a script path spend, checked by verifyTaprootScriptPath.
+func (t *Transaction) verifyTaproot(inputIndex int, outputKey []byte) (bool, error) {
+	input := t.Inputs[inputIndex]
+	if len(input.ScriptSig.CommandStack) != 0 {
+		return false, nil // native segwit spends carry an empty scriptSig
+	}
+	stack, annex := taprootWitness(input.Witness)
+	if len(stack) == 0 {
+		return false, nil
+	}
+	if len(stack) > 1 {
+		return t.verifyTaprootScriptPath(inputIndex, outputKey, stack, annex)
+	}
+
+	sig := stack[0]
+	hashType := encoding.SIGHASH_DEFAULT
+	switch len(sig) {
+	case eccmath.SCHNORR_SIG_SIZE:
+	case eccmath.SCHNORR_SIG_SIZE + 1:
+		hashType = uint32(sig[eccmath.SCHNORR_SIG_SIZE])
+		if hashType == encoding.SIGHASH_DEFAULT {
+			return false, nil // DEFAULT is only ever implied by a 64 byte signature
+		}
+		sig = sig[:eccmath.SCHNORR_SIG_SIZE]
+	default:
+		return false, nil
+	}
+
+	z, err := t.SigHashTaproot(inputIndex, hashType, annex, nil)
+	if err != nil {
+		if errors.Is(err, ErrTaprootHashType) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error generating taproot sighash for index %d: %w", inputIndex, err)
+	}
+	Q, err := eccmath.NewBitcoin().LiftX(outputKey)
+	if err != nil {
+		return false, nil
+	}
+	return Q.VerifySchnorr(z, sig), nil
+}
+
+// verifyTaprootScriptPath checks the leaf script a P2TR witness reveals against the
+// output key, then runs it as BIP 342 tapscript
+func (t *Transaction) verifyTaprootScriptPath(inputIndex int, outputKey []byte, stack [][]byte, annex []byte) (bool, error) {
+	// every signature commits to the spent outputs, so they must all be known
+	if _, _, err := t.shaSpentOutputs(); err != nil {
+		return false, fmt.Errorf("error generating taproot sighash for index %d: %w", inputIndex, err)
+	}
+	witnessSize, err := serializedWitnessSize(t.Inputs[inputIndex].Witness)
+	if err != nil {
+		return false, err
+	}
+	sigHasher := func(leafHash []byte, hashType, codeSepPos uint32) ([]byte, error) {
+		return t.sigHashTaproot(inputIndex, hashType, annex, leafHash, codeSepPos)
+	}
+	valid, err := script.VerifyTaprootScriptPath(outputKey, stack, witnessSize, sigHasher)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrScriptFailed, err)
+	}
+	return valid, nil
+}
+
+// serializedWitnessSize is the size of a witness on the wire: its item count, then each
+// item with its length
+func serializedWitnessSize(witness [][]byte) (int, error) {
+	count, err := encoding.EncodeVarInt(uint64(len(witness)))
+	if err != nil {
+		return 0, err
+	}
+	size := len(count)
+	for _, item := range witness {
+		length, err := encoding.EncodeVarInt(uint64(len(item)))
+		if err != nil {
+			return 0, err
+		}
+		size += len(length) + len(item)
+	}
+	return size, nil
+}
+
+// SignInputTaproot signs a P2TR input by its key path with privKey, the internal key,
+// tweaked by merkleRoot (nil for an output with no script tree). SIGHASH_DEFAULT gives a
+// 64 byte signature; any other hashType is appended to it.
+func (t *Transaction) SignInputTaproot(inputIndex int, privKey keys.PrivateKey, merkleRoot []byte, hashType uint32) error {
+	if inputIndex < 0 || inputIndex >= len(t.Inputs) {
+		return errors.New("inputIndex out of range")
+	}
+	tweaked, err := privKey.TweakTaproot(merkleRoot)
+	if err != nil {
+		return err
+	}
+	z, err := t.SigHashTaproot(inputIndex, hashType, nil, nil)
+	if err != nil {
+		return err
+	}
+	sig, err := tweaked.SignSchnorr(z, nil)
+	if err != nil {
+		return err
+	}
+	if hashType != encoding.SIGHASH_DEFAULT {
+		sig = append(sig, byte(hashType))
+	}
+	t.Inputs[inputIndex].Witness = [][]byte{sig}
+	t.IsSegwit = true
+	t.clearIds()
+	return nil
+}
@@ -0,0 +1,249 @@
+package transactions
+
+import (
+	"bytes"
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"testing"
+)
+
+func TestTaprootKeyPath(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(8675309))
+	pub := key.PublicKey()
+	outputKey, err := keys.TweakPublicKey(pub.SerializeXOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := script.P2trScript(outputKey.SerializeXOnly())
+	if !lock.IsP2trScriptPubKey() {
+		t.Fatal("P2trScript is not recognized as P2TR")
+	}
+
+	// unlike the legacy and BIP143 hashes, NONE and SINGLE still commit to every sequence
+	// unless combined with ANYONECANPAY
+	cases := []sigHashCase{{"DEFAULT", encoding.SIGHASH_DEFAULT, false, false, false}}
+	for _, c := range sigHashCases {
+		c.sequences = c.inputs
+		cases = append(cases, c)
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, m := range tt.mutations() {
+				tx := twoInputTx(lock)
+				if err := tx.SignInputTaproot(0, *key, nil, tt.hashType); err != nil {
+					t.Fatal(err)
+				}
+				wantLen := 64
+				if tt.hashType != encoding.SIGHASH_DEFAULT {
+					wantLen = 65
+				}
+				if got := len(tx.Inputs[0].Witness[0]); got != wantLen {
+					t.Fatalf("signature is %d bytes, want %d", got, wantLen)
+				}
+				m.apply(&tx)
+				valid, err := tx.VerifyInput(0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if valid != m.allowed {
+					t.Errorf("after changing %s: valid = %v, want %v", m.name, valid, m.allowed)
+				}
+			}
+		})
+	}
+	t.Logf("✓ Key path signatures commit to exactly the parts of the transaction each type covers")
+
+	t.Run("rejections", func(t *testing.T) {
+		signed := func(t *testing.T) Transaction {
+			t.Helper()
+			tx := twoInputTx(lock)
+			if err := tx.SignInputTaproot(0, *key, nil, encoding.SIGHASH_ALL); err != nil {
+				t.Fatal(err)
+			}
+			return tx
+		}
+
+		// an explicit 0x00 sighash byte is not DEFAULT
+		tx := twoInputTx(lock)
+		if err := tx.SignInputTaproot(0, *key, nil, encoding.SIGHASH_DEFAULT); err != nil {
+			t.Fatal(err)
+		}
+		tx.Inputs[0].Witness[0] = append(tx.Inputs[0].Witness[0], 0x00)
+		if valid, _ := tx.VerifyInput(0); valid {
+			t.Error("65 byte signature with sighash byte 0x00 verified")
+		}
+
+		// an annex added after signing changes the hash
+		tx = signed(t)
+		tx.Inputs[0].Witness = append(tx.Inputs[0].Witness, []byte{TAPROOT_ANNEX_TAG, 0x01})
+		if valid, _ := tx.VerifyInput(0); valid {
+			t.Error("signature survived an annex added after signing")
+		}
+
+		// a key tweaked with a script tree doesn't sign for the key path only output
+		tx = twoInputTx(lock)
+		if err := tx.SignInputTaproot(0, *key, make([]byte, 32), encoding.SIGHASH_ALL); err != nil {
+			t.Fatal(err)
+		}
+		if valid, _ := tx.VerifyInput(0); valid {
+			t.Error("signature by a differently tweaked key verified")
+		}
+
+		// SINGLE needs an output at the input's index
+		tx = twoInputTx(lock)
+		if err := tx.SignInputTaproot(1, *key, nil, encoding.SIGHASH_SINGLE); !errors.Is(err, ErrTaprootHashType) {
+			t.Errorf("SINGLE without matching output: err = %v, want %v", err, ErrTaprootHashType)
+		}
+
+		t.Logf("✓ Malformed and mismatched key path spends are rejected")
+
+		// before BIP 341 a taproot output is spendable by anyone
+		tx = signed(t)
+		tx.Inputs[0].Witness = [][]byte{make([]byte, 64)}
+		if valid, err := tx.VerifyInputWithFlags(0, script.CONSENSUS_SCRIPT_VERIFY_FLAGS&^script.SCRIPT_VERIFY_TAPROOT); err != nil || !valid {
+			t.Errorf("pre-taproot spend: VerifyInputWithFlags = %v, %v", valid, err)
+		}
+		if valid, _ := tx.VerifyInput(0); valid {
+			t.Error("zero signature verified under taproot rules")
+		}
+	})
+}
+
+func TestTaprootScriptPath(t *testing.T) {
+	internal := keys.NewPrivateKey(big.NewInt(8675309))
+	internalPub := internal.PublicKey()
+	key := keys.NewPrivateKey(big.NewInt(2384))
+	pub := key.PublicKey()
+
+	// a single leaf tree, so the leaf hash is the merkle root
+	leafScript := script.NewScript([]script.ScriptCommand{{Data: pub.SerializeXOnly(), IsData: true}, {Opcode: script.OP_CHECKSIG}})
+	rawLeaf, err := leafScript.RawBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafHash := script.TapLeafHash(script.TAPROOT_LEAF_TAPSCRIPT, rawLeaf)
+	outputKey, err := keys.TweakPublicKey(internalPub.SerializeXOnly(), leafHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	control := append([]byte{script.TAPROOT_LEAF_TAPSCRIPT}, internalPub.SerializeXOnly()...)
+	if !outputKey.HasEvenY() {
+		control[0] |= 1
+	}
+	lock := script.P2trScript(outputKey.SerializeXOnly())
+
+	spend := func(t *testing.T, hashType uint32) Transaction {
+		t.Helper()
+		tx := twoInputTx(lock)
+		z, err := tx.SigHashTaproot(0, hashType, nil, leafHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := key.SignSchnorr(z, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashType != encoding.SIGHASH_DEFAULT {
+			sig = append(sig, byte(hashType))
+		}
+		tx.Inputs[0].Witness = [][]byte{sig, rawLeaf, control}
+		return tx
+	}
+	for _, hashType := range []uint32{encoding.SIGHASH_DEFAULT, encoding.SIGHASH_SINGLE | encoding.SIGHASH_ANYONECANPAY} {
+		tx := spend(t, hashType)
+		if valid, err := tx.VerifyInput(0); err != nil || !valid {
+			t.Fatalf("script path spend, sighash %#x: %v, %v", hashType, valid, err)
+		}
+	}
+	t.Logf("✓ Script path spend verified")
+
+	// the output key still signs for the key path
+	tx := twoInputTx(lock)
+	if err := tx.SignInputTaproot(0, *internal, leafHash, encoding.SIGHASH_DEFAULT); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := tx.VerifyInput(0); err != nil || !valid {
+		t.Fatalf("key path spend: %v, %v", valid, err)
+	}
+	t.Logf("✓ Key path spend of an output with a script tree verified")
+
+	// the signature commits to the outputs and the annex
+	tx = spend(t, encoding.SIGHASH_DEFAULT)
+	out := tx.Outputs[0]
+	out.Amount--
+	tx.SetOutput(0, out)
+	if valid, err := tx.VerifyInput(0); valid || !errors.Is(err, ErrScriptFailed) || !errors.Is(err, script.ErrSchnorrSig) {
+		t.Errorf("changed output: %v, %v", valid, err)
+	}
+	tx = spend(t, encoding.SIGHASH_DEFAULT)
+	tx.Inputs[0].Witness = append(tx.Inputs[0].Witness, []byte{TAPROOT_ANNEX_TAG})
+	if valid, err := tx.VerifyInput(0); valid || !errors.Is(err, script.ErrSchnorrSig) {
+		t.Errorf("annex added after signing: %v, %v", valid, err)
+	}
+
+	// a script the output key doesn't commit to
+	tx = spend(t, encoding.SIGHASH_DEFAULT)
+	tx.Inputs[0].Witness[1] = append(bytes.Clone(rawLeaf), script.OP_NOP)
+	if valid, err := tx.VerifyInput(0); valid || !errors.Is(err, script.ErrWitnessProgramMismatch) {
+		t.Errorf("uncommitted script: %v, %v", valid, err)
+	}
+
+	// spent outputs must be known for the sighash
+	tx = spend(t, encoding.SIGHASH_DEFAULT)
+	tx.Inputs[1].PrevScriptPubKey = nil
+	tx.ClearCache()
+	if _, err := tx.VerifyInput(0); err == nil || errors.Is(err, ErrScriptFailed) {
+		t.Errorf("unknown spent output: %v", err)
+	}
+	t.Logf("✓ Tampered script path spends rejected")
+}
+
+func TestFutureWitnessVersions(t *testing.T) {
+	program := bytes.Repeat([]byte{0x42}, 32)
+	v2 := script.NewScript([]script.ScriptCommand{{Opcode: script.OP_2}, {Data: program, IsData: true}})
+	v1Short := script.NewScript([]script.ScriptCommand{{Opcode: script.OP_1}, {Data: program[:20], IsData: true}})
+	wrapped := script.P2trScript(program)
+	rawWrapped, err := wrapped.RawBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2sh := script.P2shScript(encoding.Hash160(rawWrapped))
+	wrongRedeem := bytes.Clone(rawWrapped)
+	wrongRedeem[len(wrongRedeem)-1] ^= 0xff
+	push := func(items ...[]byte) script.Script {
+		cmds := make([]script.ScriptCommand, len(items))
+		for i, item := range items {
+			cmds[i] = script.ScriptCommand{Data: item, IsData: true}
+		}
+		return script.NewScript(cmds)
+	}
+
+	tests := []struct {
+		name      string
+		lock      script.Script
+		scriptSig script.Script
+		want      error
+	}{
+		{"native v2", v2, script.Script{}, nil},
+		{"native v1 of 20 bytes", v1Short, script.Script{}, nil},
+		{"native v2 with a scriptSig", v2, push([]byte{0xab, 0xcd}), script.ErrWitnessMalleated},
+		{"P2SH-wrapped P2TR", p2sh, push(rawWrapped), nil},
+		{"P2SH-wrapped P2TR with extra push", p2sh, push([]byte{0xab, 0xcd}, rawWrapped), script.ErrWitnessMalleated},
+		{"P2SH with the wrong redeemScript", p2sh, push(wrongRedeem), script.ErrEvalFalse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := twoInputTx(tt.lock)
+			tx.Inputs[0].ScriptSig = tt.scriptSig
+			tx.Inputs[0].Witness = [][]byte{{0x01}}
+			valid, err := tx.VerifyInputStandard(0)
+			if valid != (tt.want == nil) || !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, %v, want %v", valid, err, tt.want)
+			}
+			t.Logf("✓ %s: valid = %v", tt.name, valid)
+		})
+	}
+}
@@ -2,20 +2,26 @@ package transactions
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"go-bitcoin/internal/eccmath"
 	"go-bitcoin/internal/encoding"
 	"go-bitcoin/internal/keys"
 	"go-bitcoin/internal/script"
 	"io"
+	"math"
 	"slices"
+	"strings"
 )
 
 // SegWit (BIP 141) constants
 const (
-	SEGWIT_MARKER byte = 0x00 // SegWit marker byte
-	SEGWIT_FLAG   byte = 0x01 // SegWit flag byte
+	SEGWIT_MARKER        byte = 0x00 // SegWit marker byte
+	SEGWIT_FLAG          byte = 0x01 // SegWit flag byte
+	WITNESS_SCALE_FACTOR int  = 4    // weight units per non-witness byte
 )
 
 // Input sequence constants
@@ -24,6 +30,12 @@ const (
 	COINBASE_PREVOUT uint32 = 0xffffffff // Coinbase previous output index
 )
 
+var (
+	ErrScriptMismatch = errors.New("script does not hash to the output being spent")
+	ErrKeyNotInScript = errors.New("key does not appear in the script")
+	ErrMissingSigs    = errors.New("not enough keys to satisfy the script")
+)
+
 type Transaction struct {
 	Version   uint32
 	Inputs    []TxIn
@@ -32,10 +44,14 @@ type Transaction struct {
 	IsTestnet bool
 	IsSegwit  bool
 
+	// PrevOuts looks up spent outputs the inputs don't already know, each once. When
+	// nil they are fetched from the block explorer.
+	PrevOuts PrevOutProvider
+
 	// private cached values
-	cachedHashPrevOuts []byte
-	cachedHashSequence []byte
-	cachedHashOutputs  []byte
+	sigHashCache sigHashCache
+	cachedTxid   *[32]byte
+	cachedWtxid  *[32]byte
 }
 
 func NewTransaction(version uint32, inputs []TxIn, outputs []TxOut, locktime uint32, isTestNet, isSegwit bool) Transaction {
@@ -64,6 +80,50 @@ func (t *Transaction) Id() (string, error) {
 	return fmt.Sprintf("%x", hash), nil
 }
 
+// Txid returns the transaction id in display byte order, the reverse of the internal
+// order outpoints use on the wire; it's Hash, cached. The cache is cleared by this
+// package's methods that change the transaction, but not by direct changes to its
+// fields: call ClearCache after those.
+func (t *Transaction) Txid() ([32]byte, error) {
+	if t.cachedTxid == nil {
+		hash, err := t.Hash()
+		if err != nil {
+			return [32]byte{}, err
+		}
+		t.cachedTxid = &hash
+	}
+	return *t.cachedTxid, nil
+}
+
+// Wtxid returns the BIP 141 witness transaction id in display byte order; it's
+// WitnessHash, cached like Txid. It equals the txid when there are no witnesses.
+func (t *Transaction) Wtxid() ([32]byte, error) {
+	if t.cachedWtxid == nil {
+		hash, err := t.WitnessHash()
+		if err != nil {
+			return [32]byte{}, err
+		}
+		t.cachedWtxid = &hash
+	}
+	return *t.cachedWtxid, nil
+}
+
+// ClearCache drops the cached ids and signature hashes, for after the transaction's
+// fields have been changed directly
+func (t *Transaction) ClearCache() {
+	t.sigHashCache = sigHashCache{}
+	t.clearIds()
+}
+
+// clearIds drops the cached ids after a change that leaves the signature hashes valid,
+// like adding a signature
+func (t *Transaction) clearIds() {
+	t.cachedTxid = nil
+	t.cachedWtxid = nil
+}
+
+// Hash returns the txid in display byte order, hashing the legacy serialization on every
+// call
 func (t *Transaction) Hash() ([32]byte, error) {
 	// Binary hash of the legacy serialization
 	serialized, err := t.SerializeLegacy()
@@ -77,6 +137,8 @@ func (t *Transaction) Hash() ([32]byte, error) {
 	return hash, nil
 }
 
+// WitnessHash returns the wtxid in display byte order, hashing the full serialization on
+// every call
 func (t *Transaction) WitnessHash() ([32]byte, error) {
 	serialized, err := t.Serialize() // Uses SerializeSegwit for witness txs
 	if err != nil {
@@ -89,6 +151,16 @@ func (t *Transaction) WitnessHash() ([32]byte, error) {
 	return hash, nil
 }
 
+// Hex returns the serialized transaction as hex, as block explorers and Bitcoin Core's
+// RPC exchange it
+func (t *Transaction) Hex() (string, error) {
+	raw, err := t.Serialize()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
 func (t *Transaction) Serialize() ([]byte, error) {
 	// returns the byte serialization of the transaction
 	if t.IsSegwit {
@@ -259,6 +331,24 @@ func (t *Transaction) SerializeSegwit() ([]byte, error) {
 	return result.Bytes(), nil
 }
 
+// FromHex parses a hex serialized transaction, ignoring surrounding whitespace. Bytes
+// left over after the transaction are an error.
+func FromHex(s string) (Transaction, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return Transaction{}, err
+	}
+	r := bytes.NewReader(raw)
+	tx, err := ParseTransaction(r)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if r.Len() > 0 {
+		return Transaction{}, fmt.Errorf("%d bytes left over after transaction", r.Len())
+	}
+	return tx, nil
+}
+
 func ParseTransaction(r io.Reader) (Transaction, error) {
 	// version
 	buf := make([]byte, 5)
@@ -400,12 +490,26 @@ func ParseSegwitTransaction(r io.Reader, version uint32) (Transaction, error) {
 	}, nil
 }
 
+// SigHash returns the legacy SIGHASH_ALL signature hash of an input
 func (t *Transaction) SigHash(inputIndex int) ([]byte, error) {
+	return t.SigHashType(inputIndex, encoding.SIGHASH_ALL)
+}
+
+// SigHashType returns the legacy signature hash of an input under hashType. NONE drops
+// the outputs and SINGLE keeps only the one at inputIndex, both letting the other inputs'
+// sequences change; ANYONECANPAY commits to the signed input alone. SINGLE on an input
+// with no matching output signs the hash 1, as the original client did.
+func (t *Transaction) SigHashType(inputIndex int, hashType uint32) ([]byte, error) {
+	if inputIndex < 0 || inputIndex >= len(t.Inputs) {
+		return nil, errors.New("inputIndex out of range")
+	}
+
 	// get the scriptpubkey from the input
-	prevScriptPubKey, err := t.Inputs[inputIndex].ScriptPubKey(t.IsTestnet)
+	prevOut, err := t.spentOutput(inputIndex)
 	if err != nil {
 		return nil, err
 	}
+	prevScriptPubKey := prevOut.ScriptPubKey
 
 	// check if this is P2SH - use redeemScript if so
 	if script.IsP2sh(prevScriptPubKey.CommandStack) {
@@ -432,33 +536,74 @@ func (t *Transaction) SigHash(inputIndex int) ([]byte, error) {
 		}
 		prevScriptPubKey = redeemScript
 	}
+	return t.SigHashScriptCode(inputIndex, prevScriptPubKey, hashType)
+}
+
+// SigHashScriptCode returns the legacy signature hash of an input under hashType, signing
+// scriptCode in place of its scriptSig. The script engine passes the script being run,
+// from its last OP_CODESEPARATOR and without the signatures being checked or any other
+// OP_CODESEPARATOR; SigHashType
+// signs the whole scriptPubKey or redeemScript.
+func (t *Transaction) SigHashScriptCode(inputIndex int, scriptCode script.Script, hashType uint32) ([]byte, error) {
+	if inputIndex < 0 || inputIndex >= len(t.Inputs) {
+		return nil, errors.New("inputIndex out of range")
+	}
+	baseType := hashType &^ encoding.SIGHASH_ANYONECANPAY
+	if baseType == encoding.SIGHASH_SINGLE && inputIndex >= len(t.Outputs) {
+		one := make([]byte, 32)
+		one[0] = 0x01
+		return one, nil
+	}
+
 	// create a modified transaction for signing
-	// 1. for the input at inputIndex, replace ScriptSig with prevScriptPubKey
+	// 1. for the input at inputIndex, replace ScriptSig with scriptCode
 	// 2. for all other inputs, set ScriptSig to empty
 
 	// make a copy of inputs with modifications
-	modifiedInputs := make([]TxIn, len(t.Inputs))
+	modifiedInputs := make([]TxIn, 0, len(t.Inputs))
 	for i, input := range t.Inputs {
-		modifiedInputs[i] = TxIn{
+		if hashType&encoding.SIGHASH_ANYONECANPAY != 0 && i != inputIndex {
+			// only the input we're signing is committed to
+			continue
+		}
+		modified := TxIn{
 			PrevTx:   input.PrevTx,
 			PrevIdx:  input.PrevIdx,
 			Sequence: input.Sequence,
 		}
 
 		if i == inputIndex {
-			// this is the input we're signing - use prevScriptPubKey
-			modifiedInputs[i].ScriptSig = prevScriptPubKey
+			// this is the input we're signing - use scriptCode
+			modified.ScriptSig = scriptCode
 		} else {
 			// all other inputs get empty script
-			modifiedInputs[i].ScriptSig = script.NewScript([]script.ScriptCommand{})
+			modified.ScriptSig = script.NewScript([]script.ScriptCommand{})
+			if baseType == encoding.SIGHASH_NONE || baseType == encoding.SIGHASH_SINGLE {
+				// other inputs may be replaced, so their sequences aren't signed
+				modified.Sequence = 0
+			}
 		}
+		modifiedInputs = append(modifiedInputs, modified)
+	}
+
+	outputs := t.Outputs
+	switch baseType {
+	case encoding.SIGHASH_NONE:
+		outputs = nil
+	case encoding.SIGHASH_SINGLE:
+		// outputs before ours are blanked to amount -1 with an empty script
+		outputs = make([]TxOut, inputIndex+1)
+		for i := range inputIndex {
+			outputs[i] = TxOut{Amount: math.MaxUint64, ScriptPubKey: script.NewScript([]script.ScriptCommand{})}
+		}
+		outputs[inputIndex] = t.Outputs[inputIndex]
 	}
 
 	// create modified transaction
 	modifiedTx := Transaction{
 		Version:   t.Version,
 		Inputs:    modifiedInputs,
-		Outputs:   t.Outputs,
+		Outputs:   outputs,
 		Locktime:  t.Locktime,
 		IsTestnet: t.IsTestnet,
 	}
@@ -469,9 +614,9 @@ func (t *Transaction) SigHash(inputIndex int) ([]byte, error) {
 		return nil, err
 	}
 
-	// append sighash type (SIGHASH_ALL  = 0x01000000)
+	// append sighash type as 4 bytes little endian (SIGHASH_ALL = 0x01000000)
 	sighashType := make([]byte, 4)
-	binary.LittleEndian.PutUint32(sighashType, encoding.SIGHASH_ALL)
+	binary.LittleEndian.PutUint32(sighashType, hashType)
 	serialized = append(serialized, sighashType...)
 
 	// double SHA256
@@ -484,13 +629,14 @@ func (t *Transaction) Fee(testNet bool) (uint64, error) {
 	// returns the fee of this transaction in satoshi
 
 	// sum all input values
+	provider := t.prevOutProvider(testNet)
 	inputSum := uint64(0)
-	for _, tx := range t.Inputs {
-		val, err := tx.Value(testNet)
+	for i := range t.Inputs {
+		prevOut, err := t.Inputs[i].PrevOutput(provider)
 		if err != nil {
 			return 0, err
 		}
-		inputSum += val
+		inputSum += prevOut.Amount
 	}
 
 	// sum all output values
@@ -506,103 +652,155 @@ func (t *Transaction) Fee(testNet bool) (uint64, error) {
 	return inputSum - outputSum, nil
 }
 
+// Weight returns the BIP 141 weight: the legacy serialization counts WITNESS_SCALE_FACTOR
+// units per byte, witness data one. A legacy transaction weighs four times its size.
+func (t *Transaction) Weight() (int, error) {
+	base, err := t.SerializeLegacy()
+	if err != nil {
+		return 0, err
+	}
+	total, err := t.Serialize()
+	if err != nil {
+		return 0, err
+	}
+	return len(base)*(WITNESS_SCALE_FACTOR-1) + len(total), nil
+}
+
+// LegacySigOps counts the signature operations in the transaction's scriptSigs and
+// scriptPubKeys the original way, charging MAX_PUBKEYS_PER_MULTISIG for each
+// OP_CHECKMULTISIG
+func (t *Transaction) LegacySigOps() int {
+	n := 0
+	for i := range t.Inputs {
+		n += t.Inputs[i].ScriptSig.SigOpCount(false)
+	}
+	for i := range t.Outputs {
+		n += t.Outputs[i].ScriptPubKey.SigOpCount(false)
+	}
+	return n
+}
+
+// SigOpCost returns the transaction's BIP 141 sigop cost: its legacy sigops weighted by
+// WITNESS_SCALE_FACTOR, plus each input's SigOpCost. Previous outputs that aren't known
+// yet are fetched, except for a coinbase, which spends none.
+func (t *Transaction) SigOpCost() (int, error) {
+	cost := t.LegacySigOps() * WITNESS_SCALE_FACTOR
+	if t.IsCoinbase() {
+		return cost, nil
+	}
+	for i := range t.Inputs {
+		prevOut, err := t.spentOutput(i)
+		if err != nil {
+			return 0, fmt.Errorf("input %d: %w", i, err)
+		}
+		cost += t.Inputs[i].SigOpCost(prevOut)
+	}
+	return cost, nil
+}
+
+// SigOpCost returns the sigop cost an input adds on top of the legacy count of its
+// scriptSig when it spends prevOut: a P2SH redeem script's sigops weighted by
+// WITNESS_SCALE_FACTOR, plus the unweighted sigops of a version 0 witness program,
+// native or wrapped in P2SH. A P2WPKH spend costs 1; a P2WSH spend costs the sigops of
+// its witness script.
+func (t *TxIn) SigOpCost(prevOut TxOut) int {
+	spk := prevOut.ScriptPubKey
+	return spk.P2shSigOpCount(t.ScriptSig)*WITNESS_SCALE_FACTOR + script.WitnessSigOpCount(spk, t.ScriptSig, t.Witness)
+}
+
+// VSize returns the virtual size in vbytes, the weight divided by four and rounded up
+func (t *Transaction) VSize() (int, error) {
+	weight, err := t.Weight()
+	if err != nil {
+		return 0, err
+	}
+	return vsizeFromWeight(weight), nil
+}
+
+func vsizeFromWeight(weight int) int {
+	return (weight + WITNESS_SCALE_FACTOR - 1) / WITNESS_SCALE_FACTOR
+}
+
+// FeeRate returns the fee rate in sat/vB, given the outputs spent by each input in order
+func (t *Transaction) FeeRate(prevouts []TxOut) (float64, error) {
+	if len(prevouts) != len(t.Inputs) {
+		return 0, fmt.Errorf("got %d prevouts for %d inputs", len(prevouts), len(t.Inputs))
+	}
+	inputSum := uint64(0)
+	for _, prevout := range prevouts {
+		inputSum += prevout.Amount
+	}
+	outputSum := uint64(0)
+	for _, output := range t.Outputs {
+		outputSum += output.Amount
+	}
+	if outputSum > inputSum {
+		return 0, fmt.Errorf("invalid transaction: outputs (%d) > inputs (%d)", outputSum, inputSum)
+	}
+	vsize, err := t.VSize()
+	if err != nil {
+		return 0, err
+	}
+	return float64(inputSum-outputSum) / float64(vsize), nil
+}
+
+// VerifyInput checks an input's scripts under the current consensus rules. When a script
+// fails the error wraps ErrScriptFailed and the *script.ScriptError saying why.
 func (t *Transaction) VerifyInput(inputIndex int) (bool, error) {
+	return t.VerifyInputWithFlags(inputIndex, script.CONSENSUS_SCRIPT_VERIFY_FLAGS)
+}
+
+// VerifyInputStandard checks an input's scripts under the rules nodes apply before
+// relaying it, STANDARD_SCRIPT_VERIFY_FLAGS
+func (t *Transaction) VerifyInputStandard(inputIndex int) (bool, error) {
+	return t.VerifyInputWithFlags(inputIndex, script.STANDARD_SCRIPT_VERIFY_FLAGS)
+}
+
+// VerifyInputWithFlags checks an input's scripts under the rules flags turn on, such as
+// those in force at the height of the block that confirmed it. Without
+// SCRIPT_VERIFY_TAPROOT a taproot output is spendable by anyone, as it was before BIP 341.
+func (t *Transaction) VerifyInputWithFlags(inputIndex int, flags script.VerifyFlags) (bool, error) {
 	if inputIndex >= len(t.Inputs) {
 		return false, errors.New("inputIndex out of range")
 	}
 	input := t.Inputs[inputIndex]
 
 	// get the ScriptPubKey from the output being spent
-	scriptPubKey, err := input.ScriptPubKey(t.IsTestnet)
+	prevOut, err := t.spentOutput(inputIndex)
 	if err != nil {
 		return false, fmt.Errorf("error fetching ScriptPubKey for index %d: %w", inputIndex, err)
 	}
+	scriptPubKey := prevOut.ScriptPubKey
 
-	var z []byte
-	var witness [][]byte
-
-	if scriptPubKey.IsP2wpkhScriptPubKey() {
-		// native p2wpkh
-		// scriptsig empty, witness contains signature data
-		z, err = t.SigHashBIP143(inputIndex, nil, nil)
-		if err != nil {
-			return false, fmt.Errorf("error generating BIP143 sighash: %w", err)
-		}
-		witness = input.Witness
-	} else if scriptPubKey.IsP2shScriptPubKey() {
-		// Could be nested SegWit (P2SH-wrapped P2WPKH)
-		// Extract redeemScript from ScriptSig (last element)
-		if len(input.ScriptSig.CommandStack) == 0 {
-			return false, errors.New("empty ScriptSig for P2SH input")
-		}
-		command := input.ScriptSig.CommandStack[len(input.ScriptSig.CommandStack)-1]
-		rawRedeemLen := len(command.Data)
-		redeemLenBytes, err := encoding.EncodeVarInt(uint64(rawRedeemLen))
-		if err != nil {
-			return false, err
-		}
-		rawRedeem := append(redeemLenBytes, command.Data...)
-		redeemScript, err := script.ParseScript(bytes.NewReader(rawRedeem))
-		if err != nil {
-			return false, err
-		}
-		if redeemScript.IsP2wpkhScriptPubKey() {
-			z, err = t.SigHashBIP143(inputIndex, &redeemScript, nil)
-			if err != nil {
-				return false, fmt.Errorf("error generating sighash for index %d: %w", inputIndex, err)
-			}
-			witness = input.Witness
-		} else if redeemScript.IsP2wshScriptPubKey() {
-			command := input.Witness[len(input.Witness)-1]
-			witLenBytes, err := encoding.EncodeVarInt(uint64(len(command)))
-			if err != nil {
-				return false, err
-			}
-			rawWitness := append(witLenBytes, command...)
-			witnessScript, err := script.ParseScript(bytes.NewReader(rawWitness))
-			if err != nil {
-				return false, err
-			}
-			z, err = t.SigHashBIP143(inputIndex, nil, &witnessScript)
-			if err != nil {
-				return false, err
-			}
-			witness = input.Witness
-		} else {
-			z, err = t.SigHashBIP143(inputIndex, &redeemScript, nil)
-			if err != nil {
-				return false, fmt.Errorf("error generating sighash for index %d: %w", inputIndex, err)
-			}
-		}
-	} else if scriptPubKey.IsP2wshScriptPubKey() {
-		command := input.Witness[len(input.Witness)-1]
-		witLenBytes, err := encoding.EncodeVarInt(uint64(len(command)))
-		if err != nil {
-			return false, err
-		}
-		rawWitness := append(witLenBytes, command...)
-		witnessScript, err := script.ParseScript(bytes.NewReader(rawWitness))
-		if err != nil {
-			return false, err
-		}
-		z, err = t.SigHashBIP143(inputIndex, nil, &witnessScript)
-		if err != nil {
-			return false, err
-		}
-		witness = input.Witness
-	} else {
-		// legacy P2PKH or other...
-		z, err = t.SigHash(inputIndex)
-		if err != nil {
-			return false, fmt.Errorf("error generating sighash for index %d: %w", inputIndex, err)
-		}
+	if typ := scriptPubKey.Type(); typ.Kind == script.P2TR && flags&script.SCRIPT_VERIFY_TAPROOT != 0 {
+		// witness v1, a key path signature or a script path, checked outside the legacy engine
+		return t.verifyTaproot(inputIndex, typ.Program)
 	}
 
-	// combine ScriptSig + ScriptPubKey
-	combinedScript := input.ScriptSig.Combine(scriptPubKey)
+	// the engine finds any witness program, in the scriptPubKey or a P2SH redeem script,
+	// and passes these the scriptCode a signature commits to: legacy scripts sign the
+	// pre-segwit way, version 0 witness scripts as BIP 143 has it
+	sigHasher := func(hashType uint32, scriptCode script.Script) ([]byte, error) {
+		return t.SigHashScriptCode(inputIndex, scriptCode, hashType)
+	}
+	witnessSigHasher := func(hashType uint32, scriptCode script.Script) ([]byte, error) {
+		return t.SigHashBIP143Type(inputIndex, nil, &scriptCode, hashType)
+	}
 
-	// evaluate
-	return combinedScript.EvaluateWithContext(z, witness, 0, 0), nil
+	// evaluate ScriptSig then ScriptPubKey; each signature commits to the sighash type in
+	// its final byte
+	engine := script.NewScriptEngine(scriptPubKey)
+	valid, err := engine.
+		WithScriptSig(input.ScriptSig).
+		WithWitness(input.Witness).
+		WithSigHasher(sigHasher).
+		WithWitnessSigHasher(witnessSigHasher).
+		WithFlags(flags).
+		Execute(nil)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrScriptFailed, err)
+	}
+	return valid, nil
 }
 
 func (t *Transaction) Verify() (bool, error) {
@@ -625,25 +823,93 @@ func (t *Transaction) Verify() (bool, error) {
 	return true, nil
 }
 
+// VerifyWithPrevOuts verifies the transaction against the spent outputs in prevouts,
+// without any network access. Every input's outpoint must be in prevouts, which takes
+// precedence over outputs given to SetPrevOut. The transaction itself is unchanged.
+func (t *Transaction) VerifyWithPrevOuts(prevouts map[OutPoint]TxOut) (bool, error) {
+	offline := *t
+	offline.Inputs = slices.Clone(t.Inputs)
+	offline.PrevOuts = PrevOutMap(prevouts)
+	for i := range offline.Inputs {
+		op := offline.Inputs[i].OutPoint()
+		out, ok := prevouts[op]
+		if !ok {
+			return false, fmt.Errorf("%w: input %d spends %s", ErrPrevOutNotFound, i, op)
+		}
+		offline.Inputs[i].SetPrevOut(out)
+	}
+	return offline.Verify()
+}
+
 func (t *Transaction) SignInput(inputIndex int, privKey keys.PrivateKey, compressed bool) error {
-	// sign the transaction
-	z, err := t.SigHash(inputIndex)
+	return t.SignInputWithType(inputIndex, privKey, compressed, encoding.SIGHASH_ALL)
+}
+
+// SignInputWithType signs a P2PKH, P2WPKH or P2SH-wrapped P2WPKH input under hashType,
+// which is appended to the DER signature as its final byte. Segwit inputs sign the
+// BIP143 hash and carry the signature and key in the witness; the scriptSig is empty,
+// or for nested P2WPKH pushes only the redeemScript.
+func (t *Transaction) SignInputWithType(inputIndex int, privKey keys.PrivateKey, compressed bool, hashType uint32) error {
+	return t.signInput(inputIndex, privKey.PublicKey(), compressed, privKey.SignHash, hashType)
+}
+
+// signInput is SignInputWithType for the key publicKey, whose signatures come from sign
+func (t *Transaction) signInput(inputIndex int, publicKey keys.PublicKey, compressed bool, sign hashSigner, hashType uint32) error {
+	if inputIndex < 0 || inputIndex >= len(t.Inputs) {
+		return errors.New("inputIndex out of range")
+	}
+	prevOut, err := t.spentOutput(inputIndex)
 	if err != nil {
 		return err
 	}
+	secPubKey := publicKey.Serialize(compressed)
 
-	sig, err := privKey.SignHash(z)
-	if err != nil {
-		return err
+	// a P2SH output is nested P2WPKH if it hashes the key's witness program
+	var redeemScript *script.Script
+	if prevOut.ScriptPubKey.IsP2shScriptPubKey() {
+		redeem := script.P2wpkhScript(encoding.Hash160(secPubKey))
+		raw, err := redeem.RawBytes()
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(encoding.Hash160(raw), prevOut.ScriptPubKey.CommandStack[1].Data) {
+			redeemScript = &redeem
+		}
 	}
 
-	derSig := sig.Serialize()
-	sighashType := make([]byte, 4)
-	binary.LittleEndian.PutUint32(sighashType, encoding.SIGHASH_ALL)
-	derSigWithHashType := append(derSig, sighashType...)
+	if prevOut.ScriptPubKey.IsP2wpkhScriptPubKey() || redeemScript != nil {
+		z, err := t.SigHashBIP143Type(inputIndex, redeemScript, nil, hashType)
+		if err != nil {
+			return err
+		}
+		sig, err := signDER(sign, z, hashType)
+		if err != nil {
+			return err
+		}
+		scriptSig := script.NewScript([]script.ScriptCommand{})
+		if redeemScript != nil {
+			raw, err := redeemScript.RawBytes()
+			if err != nil {
+				return err
+			}
+			scriptSig = script.NewScript([]script.ScriptCommand{{IsData: true, Data: raw}})
+		}
+		t.Inputs[inputIndex].ScriptSig = scriptSig
+		t.Inputs[inputIndex].Witness = [][]byte{sig, secPubKey}
+		t.IsSegwit = true
+		t.clearIds()
+		return nil
+	}
 
-	publicKey := privKey.PublicKey()
-	secPubKey := publicKey.Serialize(compressed)
+	// sign the transaction
+	z, err := t.SigHashType(inputIndex, hashType)
+	if err != nil {
+		return err
+	}
+	derSigWithHashType, err := signDER(sign, z, hashType)
+	if err != nil {
+		return err
+	}
 
 	scriptSig := script.NewScript([]script.ScriptCommand{
 		{IsData: true, Data: derSigWithHashType},
@@ -651,9 +917,91 @@ func (t *Transaction) SignInput(inputIndex int, privKey keys.PrivateKey, compres
 	})
 
 	t.Inputs[inputIndex].ScriptSig = scriptSig
+	t.clearIds()
+	return nil
+}
+
+// SignInputP2wsh signs a P2WSH input whose witness program is the SHA256 of
+// witnessScript, with each of privKeys under hashType, and sets its witness to the
+// signatures in the order their keys appear in the script, then witnessScript. A
+// multisig script gets the dummy element OP_CHECKMULTISIG consumes, and signatures from
+// at most m of the keys. Keys are serialized compressed, as segwit requires.
+func (t *Transaction) SignInputP2wsh(inputIndex int, witnessScript script.Script, privKeys []keys.PrivateKey, hashType uint32) error {
+	if inputIndex < 0 || inputIndex >= len(t.Inputs) {
+		return errors.New("inputIndex out of range")
+	}
+	prevOut, err := t.spentOutput(inputIndex)
+	if err != nil {
+		return err
+	}
+	rawScript, err := witnessScript.RawBytes()
+	if err != nil {
+		return err
+	}
+	program := sha256.Sum256(rawScript)
+	if !prevOut.ScriptPubKey.IsP2wshScriptPubKey() || !bytes.Equal(program[:], prevOut.ScriptPubKey.CommandStack[1].Data) {
+		return fmt.Errorf("%w: input %d witness script", ErrScriptMismatch, inputIndex)
+	}
+
+	z, err := t.SigHashBIP143Type(inputIndex, nil, &witnessScript, hashType)
+	if err != nil {
+		return err
+	}
+	sigs := make(map[string][]byte, len(privKeys))
+	for _, key := range privKeys {
+		pub := key.PublicKey()
+		sec := pub.Serialize(true)
+		if !slices.ContainsFunc(witnessScript.CommandStack, func(c script.ScriptCommand) bool {
+			return c.IsData && bytes.Equal(c.Data, sec)
+		}) {
+			return fmt.Errorf("%w: %x", ErrKeyNotInScript, sec)
+		}
+		sig, err := signDER(key.SignHash, z, hashType)
+		if err != nil {
+			return err
+		}
+		sigs[string(sec)] = sig
+	}
+
+	cmds := witnessScript.CommandStack
+	multisig := len(cmds) > 2 && !cmds[len(cmds)-1].IsData && cmds[len(cmds)-1].Opcode == script.OP_CHECKMULTISIG &&
+		!cmds[0].IsData && cmds[0].Opcode >= script.OP_1 && cmds[0].Opcode <= script.OP_16
+	needed := len(sigs)
+	var witness [][]byte
+	if multisig {
+		needed = int(cmds[0].Opcode) - int(script.OP_1) + 1
+		witness = append(witness, []byte{}) // OP_CHECKMULTISIG pops one element too many
+	}
+	signed := 0
+	for _, cmd := range cmds {
+		if sig, ok := sigs[string(cmd.Data)]; ok && cmd.IsData && signed < needed {
+			witness = append(witness, sig)
+			signed++
+		}
+	}
+	if signed < needed {
+		return fmt.Errorf("%w: %d of %d signatures", ErrMissingSigs, signed, needed)
+	}
+
+	t.Inputs[inputIndex].ScriptSig = script.NewScript([]script.ScriptCommand{})
+	t.Inputs[inputIndex].Witness = append(witness, rawScript)
+	t.IsSegwit = true
+	t.clearIds()
 	return nil
 }
 
+// hashSigner makes an ECDSA signature of a 32 byte hash
+type hashSigner func(hash []byte) (eccmath.Signature, error)
+
+// signDER signs z and returns the DER signature with hashType appended
+func signDER(sign hashSigner, z []byte, hashType uint32) ([]byte, error) {
+	sig, err := sign(z)
+	if err != nil {
+		return nil, err
+	}
+	return append(sig.Serialize(), byte(hashType)), nil
+}
+
 func (t *Transaction) SignInputs(privKey keys.PrivateKey, compressed bool) error {
 	for i, txin := range t.Inputs {
 		err := t.SignInput(i, privKey, compressed)
@@ -664,7 +1012,9 @@ func (t *Transaction) SignInputs(privKey keys.PrivateKey, compressed bool) error
 	return nil
 }
 
-func (t *Transaction) isCoinbase() bool {
+// IsCoinbase reports whether the transaction is a coinbase: a single input spending the
+// null outpoint
+func (t *Transaction) IsCoinbase() bool {
 	// coinbase transactions must have exactly one input
 	if len(t.Inputs) != 1 {
 		return false
@@ -680,16 +1030,44 @@ func (t *Transaction) isCoinbase() bool {
 	return true
 }
 
-func (t *Transaction) coinbaseHeight() int64 {
-	if !t.isCoinbase() {
-		return -1
-	}
-	element := t.Inputs[0].ScriptSig.CommandStack[0]
-	return script.DecodeNum(element.Data)
+// CoinbaseHeight decodes the block height a BIP 34 coinbase starts its scriptSig with:
+// OP_0, OP_1 to OP_16, or a push of up to 8 bytes holding a script number
+func (t *Transaction) CoinbaseHeight() (int64, bool) {
+	if !t.IsCoinbase() {
+		return -1, false
+	}
+	raw, err := t.Inputs[0].ScriptSigBytes()
+	if err != nil || len(raw) == 0 {
+		return -1, false
+	}
+	switch op := raw[0]; {
+	case op == script.OP_O:
+		return 0, true
+	case op >= script.OP_1 && op <= script.OP_16:
+		return int64(op-script.OP_1) + 1, true
+	case op >= 1 && op <= 8 && len(raw) > int(op):
+		return script.DecodeNum(raw[1 : 1+op]), true
+	}
+	return -1, false
 }
 
+// SigHashBIP143 returns the BIP143 SIGHASH_ALL signature hash of a segwit v0 input
 func (t *Transaction) SigHashBIP143(inputIndex int, redeemScript *script.Script, witnessScript *script.Script) ([]byte, error) {
+	return t.SigHashBIP143Type(inputIndex, redeemScript, witnessScript, encoding.SIGHASH_ALL)
+}
+
+// SigHashBIP143Type returns the BIP143 signature hash of a segwit v0 input under hashType.
+// ANYONECANPAY zeroes hashPrevouts, NONE and SINGLE also zero hashSequence, and
+// hashOutputs covers every output for ALL, only the input's own output for SINGLE and
+// nothing otherwise.
+func (t *Transaction) SigHashBIP143Type(inputIndex int, redeemScript *script.Script, witnessScript *script.Script, hashType uint32) ([]byte, error) {
+	if inputIndex < 0 || inputIndex >= len(t.Inputs) {
+		return nil, errors.New("inputIndex out of range")
+	}
 	txin := t.Inputs[inputIndex]
+	anyoneCanPay := hashType&encoding.SIGHASH_ANYONECANPAY != 0
+	baseType := hashType &^ encoding.SIGHASH_ANYONECANPAY
+	zero := make([]byte, 32)
 
 	// per BIP143 spec
 	s := bytes.NewBuffer(nil)
@@ -705,10 +1083,17 @@ func (t *Transaction) SigHashBIP143(inputIndex int, redeemScript *script.Script,
 		return nil, err
 	}
 
-	if _, err := s.Write(t.hashPrevOuts()); err != nil {
+	hashPrevOuts, hashSequence := zero, zero
+	if !anyoneCanPay {
+		hashPrevOuts = t.hashPrevOuts()
+		if baseType != encoding.SIGHASH_SINGLE && baseType != encoding.SIGHASH_NONE {
+			hashSequence = t.hashSequence()
+		}
+	}
+	if _, err := s.Write(hashPrevOuts); err != nil {
 		return nil, err
 	}
-	if _, err := s.Write(t.hashSequence()); err != nil {
+	if _, err := s.Write(hashSequence); err != nil {
 		return nil, err
 	}
 	prevout := make([]byte, len(txin.PrevTx))
@@ -733,11 +1118,11 @@ func (t *Transaction) SigHashBIP143(inputIndex int, redeemScript *script.Script,
 			return nil, err
 		}
 	} else {
-		pk, err := txin.ScriptPubKey(t.IsTestnet)
+		prevOut, err := t.spentOutput(inputIndex)
 		if err != nil {
 			return nil, err
 		}
-		scr := script.P2pkhScript(pk.CommandStack[1].Data)
+		scr := script.P2pkhScript(prevOut.ScriptPubKey.CommandStack[1].Data)
 		scriptCode, err = scr.Serialize()
 		if err != nil {
 			return nil, err
@@ -747,11 +1132,11 @@ func (t *Transaction) SigHashBIP143(inputIndex int, redeemScript *script.Script,
 		return nil, err
 	}
 
-	val, err := txin.Value(t.IsTestnet)
+	prevOut, err := t.spentOutput(inputIndex)
 	if err != nil {
 		return nil, err
 	}
-	binary.LittleEndian.PutUint64(buf8, val)
+	binary.LittleEndian.PutUint64(buf8, prevOut.Amount)
 	if _, err := s.Write(buf8); err != nil {
 		return nil, err
 	}
@@ -761,9 +1146,19 @@ func (t *Transaction) SigHashBIP143(inputIndex int, redeemScript *script.Script,
 		return nil, err
 	}
 
-	outHash, err := t.hashOutputs()
-	if err != nil {
-		return nil, err
+	outHash := zero
+	switch {
+	case baseType != encoding.SIGHASH_SINGLE && baseType != encoding.SIGHASH_NONE:
+		outHash, err = t.hashOutputs()
+		if err != nil {
+			return nil, err
+		}
+	case baseType == encoding.SIGHASH_SINGLE && inputIndex < len(t.Outputs):
+		ser, err := t.Outputs[inputIndex].Serialize()
+		if err != nil {
+			return nil, err
+		}
+		outHash = encoding.Hash256(ser)
 	}
 	if _, err := s.Write(outHash); err != nil {
 		return nil, err
@@ -774,53 +1169,10 @@ func (t *Transaction) SigHashBIP143(inputIndex int, redeemScript *script.Script,
 		return nil, err
 	}
 
-	binary.LittleEndian.PutUint32(buf4, encoding.SIGHASH_ALL)
+	binary.LittleEndian.PutUint32(buf4, hashType)
 	if _, err := s.Write(buf4); err != nil {
 		return nil, err
 	}
 
 	return encoding.Hash256(s.Bytes()), nil
 }
-
-func (t *Transaction) hashPrevOuts() []byte {
-	if t.cachedHashPrevOuts == nil {
-		allPrevOuts := []byte{}
-		allSequence := []byte{}
-		buf4 := make([]byte, 4)
-		for _, txin := range t.Inputs {
-			prevout := make([]byte, len(txin.PrevTx))
-			copy(prevout, txin.PrevTx)
-			slices.Reverse(prevout)
-			allPrevOuts = append(allPrevOuts, prevout...)
-			binary.LittleEndian.PutUint32(buf4, txin.PrevIdx)
-			allPrevOuts = append(allPrevOuts, buf4...)
-			binary.LittleEndian.PutUint32(buf4, txin.Sequence)
-			allSequence = append(allSequence, buf4...)
-		}
-		t.cachedHashPrevOuts = encoding.Hash256(allPrevOuts)
-		t.cachedHashSequence = encoding.Hash256(allSequence)
-	}
-	return t.cachedHashPrevOuts
-}
-
-func (t *Transaction) hashSequence() []byte {
-	if t.cachedHashSequence == nil {
-		_ = t.hashPrevOuts() // this should populate it
-	}
-	return t.cachedHashSequence
-}
-
-func (t *Transaction) hashOutputs() ([]byte, error) {
-	if t.cachedHashOutputs == nil {
-		allOutputs := []byte{}
-		for _, txout := range t.Outputs {
-			ser, err := txout.Serialize()
-			if err != nil {
-				return nil, err
-			}
-			allOutputs = append(allOutputs, ser...)
-		}
-		t.cachedHashOutputs = encoding.Hash256(allOutputs)
-	}
-	return t.cachedHashOutputs, nil
-}
@@ -0,0 +1,579 @@
+package transactions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"slices"
+	"testing"
+)
+
+// sigHashCases lists each sighash type with the changes to the rest of a two input, one
+// output transaction that a signature on input 0 survives
+var sigHashCases = []sigHashCase{
+	{"ALL", encoding.SIGHASH_ALL, false, false, false},
+	{"NONE", encoding.SIGHASH_NONE, true, true, false},
+	{"SINGLE", encoding.SIGHASH_SINGLE, false, true, false},
+	{"ALL|ANYONECANPAY", encoding.SIGHASH_ALL | encoding.SIGHASH_ANYONECANPAY, false, true, true},
+	{"NONE|ANYONECANPAY", encoding.SIGHASH_NONE | encoding.SIGHASH_ANYONECANPAY, true, true, true},
+	{"SINGLE|ANYONECANPAY", encoding.SIGHASH_SINGLE | encoding.SIGHASH_ANYONECANPAY, false, true, true},
+}
+
+type sigHashCase struct {
+	name                       string
+	hashType                   uint32
+	outputs, sequences, inputs bool
+}
+
+type sigHashMutation struct {
+	name    string
+	allowed bool
+	apply   func(tx *Transaction)
+}
+
+func (c sigHashCase) mutations() []sigHashMutation {
+	return []sigHashMutation{
+		{"none", true, func(tx *Transaction) {}},
+		{"output amount", c.outputs, func(tx *Transaction) {
+			out := tx.Outputs[0]
+			out.Amount--
+			tx.SetOutput(0, out)
+		}},
+		{"other sequence", c.sequences, func(tx *Transaction) { tx.SetSequence(1, 7) }},
+		{"other outpoint", c.inputs, func(tx *Transaction) {
+			txin := tx.Inputs[1]
+			txin.PrevIdx = 1
+			tx.SetInput(1, txin)
+		}},
+	}
+}
+
+// twoInputTx spends two outputs locked to lock into one output, so input 1 has no SINGLE
+// counterpart
+func twoInputTx(lock script.Script) Transaction {
+	inputs := make([]TxIn, 2)
+	for i := range inputs {
+		inputs[i] = NewTxIn(bytes.Repeat([]byte{byte(i + 1)}, 32), 0, 0xfffffffe)
+		inputs[i].SetPrevOut(TxOut{Amount: 50_000, ScriptPubKey: lock})
+	}
+	return NewTransaction(1, inputs, []TxOut{{Amount: 90_000, ScriptPubKey: lock}}, 0, false, false)
+}
+
+func TestSigHashTypes(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(8675309))
+	pub := key.PublicKey()
+	lock := script.P2pkhScript(encoding.Hash160(pub.Serialize(true)))
+
+	for _, tt := range sigHashCases {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, m := range tt.mutations() {
+				tx := twoInputTx(lock)
+				if err := tx.SignInputWithType(0, *key, true, tt.hashType); err != nil {
+					t.Fatal(err)
+				}
+				sig := tx.Inputs[0].ScriptSig.CommandStack[0].Data
+				if got := uint32(sig[len(sig)-1]); got != tt.hashType {
+					t.Fatalf("signature ends in sighash type %#x, want %#x", got, tt.hashType)
+				}
+				m.apply(&tx)
+				valid, err := tx.VerifyInput(0)
+				if err != nil && !errors.Is(err, script.ErrEvalFalse) {
+					t.Fatal(err)
+				}
+				if valid != m.allowed {
+					t.Errorf("after changing %s: valid = %v, want %v", m.name, valid, m.allowed)
+				}
+			}
+		})
+	}
+	t.Logf("✓ Each sighash type commits to exactly the parts of the transaction it covers")
+
+	t.Run("SINGLE without matching output", func(t *testing.T) {
+		tx := twoInputTx(lock)
+		z, err := tx.SigHashType(1, encoding.SIGHASH_SINGLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		one := make([]byte, 32)
+		one[0] = 0x01
+		if !bytes.Equal(z, one) {
+			t.Fatalf("sighash = %x, want %x", z, one)
+		}
+		if err := tx.SignInputWithType(1, *key, true, encoding.SIGHASH_SINGLE); err != nil {
+			t.Fatal(err)
+		}
+		// the hash 1 commits to nothing, so the signature survives any change
+		tx.Outputs[0].Amount = 1
+		if valid, err := tx.VerifyInput(1); err != nil || !valid {
+			t.Fatalf("VerifyInput = %v, %v; want valid", valid, err)
+		}
+		t.Logf("✓ SINGLE on an input past the last output signs the hash 1")
+	})
+}
+
+func TestSigHashBIP143Types(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(8675309))
+	pub := key.PublicKey()
+	lock := script.P2wpkhScript(encoding.Hash160(pub.Serialize(true)))
+
+	// signP2wpkh signs input idx of tx under hashType and sets its witness
+	signP2wpkh := func(t *testing.T, tx *Transaction, idx int, hashType uint32) {
+		t.Helper()
+		if err := tx.SignInputWithType(idx, *key, true, hashType); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range sigHashCases {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, m := range tt.mutations() {
+				tx := twoInputTx(lock)
+				signP2wpkh(t, &tx, 0, tt.hashType)
+				m.apply(&tx)
+				valid, err := tx.VerifyInput(0)
+				if err != nil && !errors.Is(err, script.ErrEvalFalse) {
+					t.Fatal(err)
+				}
+				if valid != m.allowed {
+					t.Errorf("after changing %s: valid = %v, want %v", m.name, valid, m.allowed)
+				}
+			}
+		})
+	}
+	t.Logf("✓ BIP143 hashes commit to exactly the parts of the transaction each type covers")
+
+	t.Run("SINGLE without matching output", func(t *testing.T) {
+		tx := twoInputTx(lock)
+		signP2wpkh(t, &tx, 1, encoding.SIGHASH_SINGLE)
+		// BIP143 zeroes hashOutputs rather than signing the hash 1, so the outputs are free
+		// but the signed input still isn't
+		tx.SetOutput(0, TxOut{Amount: 1, ScriptPubKey: lock})
+		if valid, err := tx.VerifyInput(1); err != nil || !valid {
+			t.Fatalf("VerifyInput = %v, %v; want valid", valid, err)
+		}
+		tx.SetSequence(1, 7)
+		if valid, _ := tx.VerifyInput(1); valid {
+			t.Fatal("signature survived a change to its own input")
+		}
+		t.Logf("✓ SINGLE past the last output signs a zero hashOutputs")
+	})
+}
+
+// nestedP2wpkh returns the P2SH output wrapping a P2WPKH program
+func nestedP2wpkh(t *testing.T, h160 []byte) script.Script {
+	t.Helper()
+	redeem := script.P2wpkhScript(h160)
+	raw, err := redeem.RawBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script.P2shScript(encoding.Hash160(raw))
+}
+
+func TestSignInputSegwit(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2355))
+	pub := key.PublicKey()
+	h160 := encoding.Hash160(pub.Serialize(true))
+
+	tests := []struct {
+		name         string
+		lock         script.Script
+		scriptSigLen int // items in the scriptSig
+		witnessLen   int
+	}{
+		{"P2WPKH", script.P2wpkhScript(h160), 0, 2},
+		{"P2SH-P2WPKH", nestedP2wpkh(t, h160), 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := twoInputTx(tt.lock)
+			if err := tx.SignInput(0, *key, true); err != nil {
+				t.Fatal(err)
+			}
+			in := tx.Inputs[0]
+			if len(in.ScriptSig.CommandStack) != tt.scriptSigLen || len(in.Witness) != tt.witnessLen || !tx.IsSegwit {
+				t.Fatalf("scriptSig has %d items and witness %d, want %d and %d", len(in.ScriptSig.CommandStack), len(in.Witness), tt.scriptSigLen, tt.witnessLen)
+			}
+			if valid, err := tx.VerifyInput(0); err != nil || !valid {
+				t.Fatalf("VerifyInput = %v, %v", valid, err)
+			}
+
+			// BIP143 signatures commit to the amount being spent
+			tx = NewTransaction(tx.Version, tx.Inputs, tx.Outputs, tx.Locktime, false, true)
+			tx.Inputs[0].SetPrevOut(TxOut{Amount: 50_001, ScriptPubKey: tt.lock})
+			if valid, _ := tx.VerifyInput(0); valid {
+				t.Error("signature survived a change to the spent amount")
+			}
+		})
+	}
+	t.Logf("✓ SignInput produces valid segwit spends that commit to the spent amount")
+}
+
+func TestSignInputP2wsh(t *testing.T) {
+	k1, k2, k3 := keys.NewPrivateKey(big.NewInt(1)), keys.NewPrivateKey(big.NewInt(2)), keys.NewPrivateKey(big.NewInt(3))
+	sec := func(k *keys.PrivateKey) []byte { p := k.PublicKey(); return p.Serialize(true) }
+	p2wsh := func(t *testing.T, s script.Script) script.Script {
+		t.Helper()
+		raw, err := s.RawBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.Sum256(raw)
+		return script.P2wshScript(h[:])
+	}
+	multisig := script.NewScript([]script.ScriptCommand{
+		{Opcode: script.OP_2},
+		{IsData: true, Data: sec(k1)}, {IsData: true, Data: sec(k2)}, {IsData: true, Data: sec(k3)},
+		{Opcode: script.OP_3}, {Opcode: script.OP_CHECKMULTISIG},
+	})
+	single := script.NewScript([]script.ScriptCommand{{IsData: true, Data: sec(k2)}, {Opcode: script.OP_CHECKSIG}})
+
+	tests := []struct {
+		name       string
+		script     script.Script
+		keys       []keys.PrivateKey
+		witnessLen int
+	}{
+		{"2-of-3, keys out of order", multisig, []keys.PrivateKey{*k3, *k1}, 4},
+		{"2-of-3, all keys", multisig, []keys.PrivateKey{*k2, *k3, *k1}, 4},
+		{"single key", single, []keys.PrivateKey{*k2}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := twoInputTx(p2wsh(t, tt.script))
+			if err := tx.SignInputP2wsh(0, tt.script, tt.keys, encoding.SIGHASH_ALL); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(tx.Inputs[0].Witness); got != tt.witnessLen {
+				t.Fatalf("witness has %d items, want %d", got, tt.witnessLen)
+			}
+			if valid, err := tx.VerifyInput(0); err != nil || !valid {
+				t.Fatalf("VerifyInput = %v, %v", valid, err)
+			}
+		})
+	}
+	t.Logf("✓ P2WSH inputs sign with signatures in script key order")
+
+	// BIP 147: a non-empty OP_CHECKMULTISIG dummy fails a witness script
+	tx := twoInputTx(p2wsh(t, multisig))
+	if err := tx.SignInputP2wsh(0, multisig, []keys.PrivateKey{*k1, *k2}, encoding.SIGHASH_ALL); err != nil {
+		t.Fatal(err)
+	}
+	tx.Inputs[0].Witness[0] = []byte{0x01}
+	if valid, err := tx.VerifyInput(0); valid || !errors.Is(err, ErrScriptFailed) || !errors.Is(err, script.ErrSigNullDummy) {
+		t.Fatalf("non-empty multisig dummy: VerifyInput = %v, %v", valid, err)
+	}
+	t.Logf("✓ Non-empty multisig dummy rejected")
+
+	// policy holds witness scripts to minimal pushes: a push of 1 where OP_1 would do
+	padded := script.NewScript([]script.ScriptCommand{
+		{IsData: true, Data: []byte{0x01}}, {Opcode: script.OP_DROP},
+		{IsData: true, Data: sec(k2)}, {Opcode: script.OP_CHECKSIG},
+	})
+	tx = twoInputTx(p2wsh(t, padded))
+	if err := tx.SignInputP2wsh(0, padded, []keys.PrivateKey{*k2}, encoding.SIGHASH_ALL); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := tx.VerifyInput(0); err != nil || !valid {
+		t.Fatalf("VerifyInput = %v, %v", valid, err)
+	}
+	if valid, _ := tx.VerifyInputStandard(0); valid {
+		t.Fatal("non-minimal push accepted by policy")
+	}
+	t.Logf("✓ Non-minimal push in a witness script is non-standard")
+
+	tx = twoInputTx(p2wsh(t, multisig))
+	if err := tx.SignInputP2wsh(0, single, []keys.PrivateKey{*k2}, encoding.SIGHASH_ALL); !errors.Is(err, ErrScriptMismatch) {
+		t.Errorf("wrong witness script: err = %v, want %v", err, ErrScriptMismatch)
+	}
+	if err := tx.SignInputP2wsh(0, multisig, []keys.PrivateKey{*k1, *keys.NewPrivateKey(big.NewInt(4))}, encoding.SIGHASH_ALL); !errors.Is(err, ErrKeyNotInScript) {
+		t.Errorf("foreign key: err = %v, want %v", err, ErrKeyNotInScript)
+	}
+	if err := tx.SignInputP2wsh(0, multisig, []keys.PrivateKey{*k1}, encoding.SIGHASH_ALL); !errors.Is(err, ErrMissingSigs) {
+		t.Errorf("one key for 2-of-3: err = %v, want %v", err, ErrMissingSigs)
+	}
+	t.Logf("✓ Mismatched scripts, foreign keys and too few keys are rejected")
+}
+
+func TestEmptyWitness(t *testing.T) {
+	// a P2WSH program, and the same wrapped in P2SH, spent with no witness at all
+	program := script.P2wshScript(bytes.Repeat([]byte{0x42}, 32))
+	rawProgram, err := program.RawBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		lock      script.Script
+		scriptSig script.Script
+	}{
+		{"P2WSH", program, script.Script{}},
+		{"P2SH-P2WSH", script.P2shScript(encoding.Hash160(rawProgram)), script.NewScript([]script.ScriptCommand{{IsData: true, Data: rawProgram}})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := twoInputTx(tt.lock)
+			txin := tx.Inputs[0]
+			txin.ScriptSig = tt.scriptSig
+			tx.SetInput(0, txin)
+			valid, err := tx.VerifyInput(0)
+			if valid || !errors.Is(err, ErrScriptFailed) || !errors.Is(err, script.ErrWitnessProgramMismatch) {
+				t.Fatalf("VerifyInput = %v, %v, want %v", valid, err, script.ErrWitnessProgramMismatch)
+			}
+			t.Logf("✓ %s with an empty witness rejected: %v", tt.name, err)
+		})
+	}
+}
+
+func TestCodeSeparator(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2387))
+	pub := key.PublicKey()
+	pubCmd := script.ScriptCommand{IsData: true, Data: pub.Serialize(true)}
+	// the second signature covers only what follows OP_CODESEPARATOR
+	lock := script.NewScript([]script.ScriptCommand{
+		pubCmd, {Opcode: script.OP_CHECKSIGVERIFY}, {Opcode: script.OP_CODESEPARATOR}, pubCmd, {Opcode: script.OP_CHECKSIG},
+	})
+	tail := script.NewScript(lock.CommandStack[3:])
+	// a legacy scriptCode drops the separator, a BIP 143 one keeps it
+	unseparated := script.NewScript(slices.Concat(lock.CommandStack[:2], tail.CommandStack))
+	raw, err := lock.RawBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(raw)
+
+	tests := []struct {
+		name    string
+		lock    script.Script
+		whole   script.Script
+		sigHash func(tx *Transaction, scriptCode script.Script) ([]byte, error)
+		spend   func(tx *Transaction, first, second []byte)
+	}{
+		{"legacy", lock, unseparated, func(tx *Transaction, scriptCode script.Script) ([]byte, error) {
+			return tx.SigHashScriptCode(0, scriptCode, encoding.SIGHASH_ALL)
+		}, func(tx *Transaction, first, second []byte) {
+			txin := tx.Inputs[0]
+			txin.ScriptSig = script.NewScript([]script.ScriptCommand{{IsData: true, Data: second}, {IsData: true, Data: first}})
+			tx.SetInput(0, txin)
+		}},
+		{"P2WSH", script.P2wshScript(h[:]), lock, func(tx *Transaction, scriptCode script.Script) ([]byte, error) {
+			return tx.SigHashBIP143Type(0, nil, &scriptCode, encoding.SIGHASH_ALL)
+		}, func(tx *Transaction, first, second []byte) {
+			tx.Inputs[0].Witness = [][]byte{second, first, raw}
+			tx.IsSegwit = true
+			tx.ClearCache()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sign := func(tx *Transaction, scriptCode script.Script) []byte {
+				z, err := tt.sigHash(tx, scriptCode)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sig, err := signDER(key.SignHash, z, encoding.SIGHASH_ALL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return sig
+			}
+			tx := twoInputTx(tt.lock)
+			first := sign(&tx, tt.whole)
+			tt.spend(&tx, first, sign(&tx, tail))
+			if valid, err := tx.VerifyInput(0); err != nil || !valid {
+				t.Fatalf("VerifyInput = %v, %v", valid, err)
+			}
+
+			// signing the whole script for both no longer verifies
+			tt.spend(&tx, first, first)
+			if valid, _ := tx.VerifyInput(0); valid {
+				t.Fatal("second signature over the whole script accepted")
+			}
+			t.Logf("✓ %s signature after OP_CODESEPARATOR commits to the rest of the script", tt.name)
+		})
+	}
+}
+
+func TestLegacyCodeSeparatorSigHash(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2387))
+	pub := key.PublicKey()
+	pubCmd := script.ScriptCommand{IsData: true, Data: pub.Serialize(true)}
+	// the signature is checked after the first OP_CODESEPARATOR and before the second
+	lock := script.NewScript([]script.ScriptCommand{
+		{Opcode: script.OP_CODESEPARATOR}, pubCmd, {Opcode: script.OP_CHECKSIGVERIFY}, {Opcode: script.OP_CODESEPARATOR}, {Opcode: script.OP_1},
+	})
+	lockRaw, err := lock.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bitcoin Core's SignatureHash serializes the scriptCode with every OP_CODESEPARATOR
+	// removed: <pubkey> OP_CHECKSIGVERIFY OP_1
+	scriptCode := append([]byte{0x24, 0x21}, append(pubCmd.Data, script.OP_CHECKSIGVERIFY, script.OP_1)...)
+	preimage := slices.Concat(
+		[]byte{0x01, 0x00, 0x00, 0x00, 0x02},
+		bytes.Repeat([]byte{0x01}, 32), []byte{0x00, 0x00, 0x00, 0x00}, scriptCode, []byte{0xfe, 0xff, 0xff, 0xff},
+		bytes.Repeat([]byte{0x02}, 32), []byte{0x00, 0x00, 0x00, 0x00, 0x00}, []byte{0xfe, 0xff, 0xff, 0xff},
+		[]byte{0x01, 0x90, 0x5f, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}, lockRaw,
+		[]byte{0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00},
+	)
+	z := encoding.Hash256(preimage)
+
+	tx := twoInputTx(lock)
+	sig, err := signDER(key.SignHash, z, encoding.SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txin := tx.Inputs[0]
+	txin.ScriptSig = script.NewScript([]script.ScriptCommand{{IsData: true, Data: sig}})
+	tx.SetInput(0, txin)
+	if valid, err := tx.VerifyInput(0); err != nil || !valid {
+		t.Fatalf("VerifyInput = %v, %v", valid, err)
+	}
+
+	// a signature over the scriptCode with the later OP_CODESEPARATOR kept is rejected
+	kept := script.NewScript(lock.CommandStack[1:])
+	zKept, err := tx.SigHashScriptCode(0, kept, encoding.SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(zKept, z) {
+		t.Fatal("OP_CODESEPARATOR made no difference to the sighash")
+	}
+	sig, err = signDER(key.SignHash, zKept, encoding.SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txin.ScriptSig = script.NewScript([]script.ScriptCommand{{IsData: true, Data: sig}})
+	tx.SetInput(0, txin)
+	if valid, _ := tx.VerifyInput(0); valid {
+		t.Fatal("signature over a scriptCode holding OP_CODESEPARATOR accepted")
+	}
+	t.Logf("✓ Legacy scriptCode drops the OP_CODESEPARATOR after the executed one")
+}
+
+func TestTxidCache(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2358))
+	pub := key.PublicKey()
+	tx := twoInputTx(script.P2wpkhScript(encoding.Hash160(pub.Serialize(true))))
+
+	txid, err := tx.Txid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := tx.SerializeLegacy()
+	internal := encoding.Hash256(raw)
+	slices.Reverse(internal)
+	if !bytes.Equal(txid[:], internal) {
+		t.Fatalf("txid = %x, want the reversed hash %x", txid, internal)
+	}
+	if wtxid, _ := tx.Wtxid(); wtxid != txid {
+		t.Error("wtxid differs from txid without witnesses")
+	}
+	t.Logf("✓ Txid is the legacy serialization's hash in display byte order")
+
+	// signing a segwit input changes the wtxid but not the txid
+	if err := tx.SignInput(0, *key, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := tx.Txid(); got != txid {
+		t.Error("witness changed the txid")
+	}
+	wtxid, _ := tx.Wtxid()
+	if want, _ := tx.WitnessHash(); wtxid != want || wtxid == txid {
+		t.Errorf("wtxid = %x after signing, want %x", wtxid, want)
+	}
+
+	// direct changes need ClearCache
+	tx.Locktime = 1
+	if got, _ := tx.Txid(); got != txid {
+		t.Error("txid recomputed without ClearCache")
+	}
+	tx.ClearCache()
+	if got, _ := tx.Txid(); got == txid {
+		t.Error("txid unchanged after ClearCache")
+	}
+	t.Logf("✓ Cached ids follow signing, and direct changes after ClearCache")
+}
+
+func TestHex(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2364))
+	pub := key.PublicKey()
+	tx := twoInputTx(script.P2wpkhScript(encoding.Hash160(pub.Serialize(true))))
+	for i := range tx.Inputs {
+		if err := tx.SignInput(i, *key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, segwit := range []bool{false, true} {
+		tx.IsSegwit = segwit
+		s, err := tx.Hex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := FromHex("  " + s + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := parsed.Hex(); again != s || parsed.IsSegwit != segwit {
+			t.Errorf("segwit %v: round trip = %s, want %s", segwit, again, s)
+		}
+	}
+	t.Logf("✓ Legacy and segwit transactions round trip through hex")
+
+	s, _ := tx.Hex()
+	for name, bad := range map[string]string{"trailing byte": s + "00", "odd length": s[1:], "truncated": s[:len(s)-8]} {
+		if _, err := FromHex(bad); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+	t.Logf("✓ Malformed and trailing hex is rejected")
+}
+
+func TestWeightAndFeeRate(t *testing.T) {
+	lock := script.P2wpkhScript(make([]byte, 20))
+	tx := NewTransaction(2,
+		[]TxIn{NewTxIn(make([]byte, 32), 0, SEQUENCE_FINAL)},
+		[]TxOut{{Amount: 9_000, ScriptPubKey: lock}}, 0, false, false)
+
+	// version 4, 1 input of 41, 1 output of 31, locktime 4, plus 2 counts: 82 bytes
+	weight, err := tx.Weight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weight != 82*WITNESS_SCALE_FACTOR {
+		t.Errorf("legacy weight = %d, want %d", weight, 82*WITNESS_SCALE_FACTOR)
+	}
+
+	// marker, flag, item count, and items of 1+71 and 1+33 bytes add 109 witness bytes
+	tx.Inputs[0].Witness = [][]byte{make([]byte, 71), make([]byte, 33)}
+	tx.IsSegwit = true
+	weight, _ = tx.Weight()
+	vsize, err := tx.VSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weight != 82*4+109 || vsize != 110 {
+		t.Errorf("segwit weight = %d, vsize = %d, want %d and 110", weight, vsize, 82*4+109)
+	}
+	t.Logf("✓ Witness bytes weigh a quarter of base bytes, and vsize rounds up")
+
+	rate, err := tx.FeeRate([]TxOut{{Amount: 10_100, ScriptPubKey: lock}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 10 {
+		t.Errorf("fee rate = %v, want 10 sat/vB", rate)
+	}
+	if _, err := tx.FeeRate(nil); err == nil {
+		t.Error("fee rate without prevouts succeeded")
+	}
+	if _, err := tx.FeeRate([]TxOut{{Amount: 8_000}}); err == nil {
+		t.Error("fee rate with outputs over inputs succeeded")
+	}
+	t.Logf("✓ Fee rate is the fee over vsize")
+}
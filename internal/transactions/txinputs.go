@@ -10,12 +10,28 @@ import (
 	"slices"
 )
 
+// OutPoint names a transaction output. TxID is in display byte order, like TxIn.PrevTx.
+type OutPoint struct {
+	TxID  [32]byte
+	Index uint32
+}
+
+func (o OutPoint) String() string {
+	return fmt.Sprintf("%x:%d", o.TxID, o.Index)
+}
+
 type TxIn struct {
 	PrevTx    []byte
 	PrevIdx   uint32
 	ScriptSig script.Script
 	Sequence  uint32
 	Witness   [][]byte
+
+	// PrevAmount and PrevScriptPubKey describe the output this input spends, once known:
+	// given by SetPrevOut, the builder, PSBTs or UTXO lookups, or remembered from the
+	// first fetch. PrevScriptPubKey is nil while they aren't. Neither is serialized.
+	PrevAmount       uint64
+	PrevScriptPubKey *script.Script
 }
 
 func NewTxIn(prevTx []byte, prevIdx, sequence uint32) TxIn {
@@ -26,6 +42,14 @@ func NewTxIn(prevTx []byte, prevIdx, sequence uint32) TxIn {
 	}
 }
 
+// OutPoint returns the output this input spends
+func (t *TxIn) OutPoint() OutPoint {
+	var op OutPoint
+	copy(op.TxID[:], t.PrevTx)
+	op.Index = t.PrevIdx
+	return op
+}
+
 func (t TxIn) String() string {
 	return fmt.Sprintf("%x:%d", t.PrevTx, t.PrevIdx)
 }
@@ -126,7 +150,7 @@ func (t *TxIn) Serialize() ([]byte, error) {
 	}
 
 	// ScriptSig
-	scriptBytes, err := t.ScriptSig.Serialize()
+	scriptBytes, err := t.serializeScriptSig()
 	if err != nil {
 		return nil, err
 	}
@@ -143,31 +167,91 @@ func (t *TxIn) Serialize() ([]byte, error) {
 	return result.Bytes(), nil
 }
 
-func (t *TxIn) fetchTx(testNet bool) (*Transaction, error) {
-	fetcher := NewTxFetcher()
-	// PrevTx is stored in display order (big-endian)
-	// Can use directly for API call
-	hex := fmt.Sprintf("%x", t.PrevTx)
-	return fetcher.Fetch(hex, testNet, false)
+// isCoinbase reports whether the input spends the null outpoint
+func (t *TxIn) isCoinbase() bool {
+	if t.PrevIdx != COINBASE_PREVOUT || len(t.PrevTx) != 32 {
+		return false
+	}
+	for _, b := range t.PrevTx {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// serializeScriptSig writes the varint-prefixed scriptSig
+func (t *TxIn) serializeScriptSig() ([]byte, error) {
+	raw, err := t.ScriptSigBytes()
+	if err != nil {
+		return nil, err
+	}
+	length, err := encoding.EncodeVarInt(uint64(len(raw)))
+	if err != nil {
+		return nil, err
+	}
+	return append(length, raw...), nil
+}
+
+// ScriptSigBytes returns the scriptSig as it appears on the wire. A coinbase scriptSig is
+// kept by ParseTxIn as one data command holding the raw bytes, so it is returned as-is
+// rather than re-encoded as a push.
+func (t *TxIn) ScriptSigBytes() ([]byte, error) {
+	cmds := t.ScriptSig.CommandStack
+	if t.isCoinbase() && len(cmds) == 1 && cmds[0].IsData {
+		return cmds[0].Data, nil
+	}
+	return t.ScriptSig.RawBytes()
+}
+
+// SetPrevOut supplies the output this input spends so Value and ScriptPubKey don't need
+// to fetch it
+func (t *TxIn) SetPrevOut(out TxOut) {
+	t.PrevAmount = out.Amount
+	t.PrevScriptPubKey = &out.ScriptPubKey
+}
+
+// HasPrevOut reports whether the output this input spends is known without a lookup
+func (t *TxIn) HasPrevOut() bool {
+	return t.PrevScriptPubKey != nil
+}
+
+// PrevOutput returns the output this input spends: the one already known, or else the
+// one provider looks up, which the input then keeps
+func (t *TxIn) PrevOutput(provider PrevOutProvider) (TxOut, error) {
+	if t.HasPrevOut() {
+		return TxOut{Amount: t.PrevAmount, ScriptPubKey: *t.PrevScriptPubKey}, nil
+	}
+	amount, scriptPubKey, err := provider.GetOutput(t.OutPoint().TxID, t.PrevIdx)
+	if err != nil {
+		return TxOut{}, err
+	}
+	out := TxOut{Amount: amount, ScriptPubKey: scriptPubKey}
+	t.SetPrevOut(out)
+	return out, nil
 }
 
 func (t *TxIn) Value(testNet bool) (uint64, error) {
 	// get the output value by looking up the tx hash.
 	// returns amount in Satoshi
-	tx, err := t.fetchTx(testNet)
+	fetcher := NewTxFetcher()
+	fetcher.TestNet = testNet
+	out, err := t.PrevOutput(&fetcher)
 	if err != nil {
 		return 0, err
 	}
-	return tx.Outputs[t.PrevIdx].Amount, nil
+	return out.Amount, nil
 }
 
 func (t *TxIn) ScriptPubKey(testNet bool) (script.Script, error) {
 	// get the ScriptPubKey by looking up the tx hash. Returns a Script object.
-	tx, err := t.fetchTx(testNet)
+	fetcher := NewTxFetcher()
+	fetcher.TestNet = testNet
+	out, err := t.PrevOutput(&fetcher)
 	if err != nil {
 		return script.Script{}, err
 	}
-	return tx.Outputs[t.PrevIdx].ScriptPubKey, nil
+	return out.ScriptPubKey, nil
 }
 
 type TxOut struct {
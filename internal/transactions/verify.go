@@ -0,0 +1,153 @@
+package transactions
+
+import (
+	"errors"
+	"fmt"
+	"go-bitcoin/internal/script"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrScriptFailed = errors.New("input script verification failed")
+
+// InputRef names an input of a transaction
+type InputRef struct {
+	Tx    *Transaction
+	Index int
+}
+
+// InputError is the first input that failed a concurrent verification: its script
+// failed (ErrScriptFailed), or it couldn't be checked
+type InputError struct {
+	InputRef
+	Err error
+}
+
+func (e *InputError) Error() string {
+	return fmt.Sprintf("input %d: %v", e.Index, e.Err)
+}
+
+func (e *InputError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyConcurrent verifies the transaction like Verify, with up to workers goroutines
+// fetching spent outputs and checking input scripts; workers <= 0 means one per CPU.
+// Unlike Verify, an input whose script fails is returned as an *InputError wrapping
+// ErrScriptFailed, so the caller learns which one. When several fail it's the lowest.
+func (t *Transaction) VerifyConcurrent(workers int) (bool, error) {
+	provider := t.prevOutProvider(t.IsTestnet)
+	err := forEachInput(len(t.Inputs), workers, func(i int) error {
+		_, err := t.Inputs[i].PrevOutput(provider)
+		return err
+	})
+	if err != nil {
+		var ie *InputError
+		if errors.As(err, &ie) {
+			ie.Tx = t
+		}
+		return false, err
+	}
+	if _, err := t.Fee(t.IsTestnet); err != nil {
+		return false, fmt.Errorf("error fetching fee: %w", err)
+	}
+
+	refs := make([]InputRef, len(t.Inputs))
+	for i := range refs {
+		refs[i] = InputRef{Tx: t, Index: i}
+	}
+	if err := VerifyInputs(refs, script.CONSENSUS_SCRIPT_VERIFY_FLAGS, workers); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// VerifyInputs checks the scripts of inputs, which may come from many transactions, under
+// the rules flags turn on, with up to workers goroutines; workers <= 0 means one per CPU.
+// The outputs the inputs spend are looked up first, one transaction at a time, along
+// with the signature hash midstates the workers share. It returns the failure earliest
+// in inputs as an *InputError, or nil when every script passes.
+func VerifyInputs(inputs []InputRef, flags script.VerifyFlags, workers int) error {
+	prepared := make(map[*Transaction]bool)
+	for _, ref := range inputs {
+		if prepared[ref.Tx] {
+			continue
+		}
+		if err := ref.Tx.prepareVerify(); err != nil {
+			return err
+		}
+		prepared[ref.Tx] = true
+	}
+	return forEachInput(len(inputs), workers, func(i int) error {
+		ref := inputs[i]
+		valid, err := ref.Tx.VerifyInputWithFlags(ref.Index, flags)
+		if err == nil && !valid {
+			err = ErrScriptFailed
+		}
+		if err != nil {
+			return &InputError{InputRef: ref, Err: err}
+		}
+		return nil
+	})
+}
+
+// prepareVerify looks up every spent output and fills the signature hash cache, so
+// inputs can then be verified concurrently without writing to the transaction
+func (t *Transaction) prepareVerify() error {
+	for i := range t.Inputs {
+		if _, err := t.spentOutput(i); err != nil {
+			return &InputError{InputRef: InputRef{Tx: t, Index: i}, Err: err}
+		}
+	}
+	t.shaPrevOuts()
+	t.shaSequences()
+	if _, err := t.shaOutputs(); err != nil {
+		return err
+	}
+	_, _, err := t.shaSpentOutputs()
+	return err
+}
+
+// forEachInput calls check for 0 to n-1 on up to workers goroutines, handing out indexes
+// in order. Once a check fails no new ones start, so every index below a failure has
+// been checked and the lowest failure is returned. An error without an input is wrapped
+// as an *InputError for its index.
+func forEachInput(n, workers int, check func(i int) error) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, n)
+	errs := make([]error, n)
+	var next atomic.Int64
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !failed.Load() {
+				i := int(next.Add(1) - 1)
+				if i >= n {
+					return
+				}
+				if err := check(i); err != nil {
+					errs[i] = err
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		var ie *InputError
+		if !errors.As(err, &ie) {
+			err = &InputError{InputRef: InputRef{Index: i}, Err: err}
+		}
+		return err
+	}
+	return nil
+}
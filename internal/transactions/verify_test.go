@@ -0,0 +1,84 @@
+package transactions
+
+import (
+	"bytes"
+	"errors"
+	"go-bitcoin/internal/encoding"
+	"go-bitcoin/internal/keys"
+	"go-bitcoin/internal/script"
+	"math/big"
+	"testing"
+)
+
+// manyInputTx is twoInputTx with n inputs, each spending 10_000 and signed by key
+func manyInputTx(t *testing.T, key *keys.PrivateKey, lock script.Script, n int) Transaction {
+	t.Helper()
+	inputs := make([]TxIn, n)
+	for i := range inputs {
+		inputs[i] = NewTxIn(bytes.Repeat([]byte{byte(i + 1)}, 32), 0, 0xfffffffe)
+		inputs[i].SetPrevOut(TxOut{Amount: 10_000, ScriptPubKey: lock})
+	}
+	tx := NewTransaction(1, inputs, []TxOut{{Amount: uint64(n) * 9_000, ScriptPubKey: lock}}, 0, false, false)
+	for i := range inputs {
+		if err := tx.SignInput(i, *key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tx
+}
+
+func TestVerifyConcurrent(t *testing.T) {
+	key := keys.NewPrivateKey(big.NewInt(2370))
+	pub := key.PublicKey()
+	h160 := encoding.Hash160(pub.Serialize(true))
+
+	locks := map[string]script.Script{
+		"P2PKH":  script.P2pkhScript(h160),
+		"P2WPKH": script.P2wpkhScript(h160),
+	}
+	for name, lock := range locks {
+		for _, workers := range []int{0, 1, 3, 16} {
+			tx := manyInputTx(t, key, lock, 8)
+			if ok, err := tx.VerifyConcurrent(workers); err != nil || !ok {
+				t.Fatalf("%s, %d workers: verify = %v, %v", name, workers, ok, err)
+			}
+		}
+	}
+	t.Logf("✓ Valid transactions verify with any number of workers")
+
+	// swap signatures between inputs 5 and 2: both fail, and the lower is reported
+	for _, workers := range []int{1, 4} {
+		tx := manyInputTx(t, key, locks["P2WPKH"], 8)
+		tx.Inputs[2].Witness, tx.Inputs[5].Witness = tx.Inputs[5].Witness, tx.Inputs[2].Witness
+		ok, err := tx.VerifyConcurrent(workers)
+		var ie *InputError
+		if ok || !errors.As(err, &ie) || !errors.Is(err, ErrScriptFailed) {
+			t.Fatalf("%d workers: verify = %v, %v", workers, ok, err)
+		}
+		if ie.Index != 2 || ie.Tx != &tx {
+			t.Fatalf("%d workers: failure at input %d of %p, want input 2 of %p", workers, ie.Index, ie.Tx, &tx)
+		}
+		if serial, _ := tx.Verify(); serial {
+			t.Fatal("Verify accepted the swapped signatures")
+		}
+	}
+	t.Logf("✓ The lowest failing input is reported")
+
+	// inputs from several transactions are checked together
+	a := manyInputTx(t, key, locks["P2PKH"], 3)
+	b := manyInputTx(t, key, locks["P2WPKH"], 3)
+	b.Inputs[1].Witness[0][10] ^= 0x01
+	refs := []InputRef{{&a, 0}, {&b, 0}, {&a, 1}, {&b, 1}, {&a, 2}, {&b, 2}}
+	if err := VerifyInputs(refs[:1], script.CONSENSUS_SCRIPT_VERIFY_FLAGS, 2); err != nil {
+		t.Fatalf("valid input: %v", err)
+	}
+	err := VerifyInputs(refs, script.CONSENSUS_SCRIPT_VERIFY_FLAGS, 2)
+	var ie *InputError
+	if !errors.As(err, &ie) || ie.Tx != &b || ie.Index != 1 {
+		t.Fatalf("got %v, want a failure at input 1 of the second transaction", err)
+	}
+	if err := VerifyInputs(nil, script.CONSENSUS_SCRIPT_VERIFY_FLAGS, 0); err != nil {
+		t.Fatalf("no inputs: %v", err)
+	}
+	t.Logf("✓ Inputs across transactions verify in one pool: %v", err)
+}
@@ -6,29 +6,24 @@ import (
 	"go-bitcoin/internal/block"
 	"go-bitcoin/internal/network"
 	"log"
-	"net"
 	"time"
 )
 
 func main() {
-	dns := network.MAINNET_SEEDS
-	port := network.MAINNET_PORT
+	chain := network.CHAIN_MAINNET
+	port := chain.Port()
 	genBlockReader := bytes.NewReader(block.MAINNET_GENESIS_BLOCK)
 
-	ips, err := net.LookupIP(dns)
+	ips, err := network.DiscoverPeers(chain, 16, network.NODE_NETWORK)
 	if err != nil {
 		log.Fatal(err)
 	}
 	var node *network.SimpleNode
 
 	for _, ip := range ips {
-		if ip.To4() == nil {
-			continue
-		}
-
-		addr := fmt.Sprintf("%s:%d", ip.String(), port)
+		addr := fmt.Sprintf("%s:%d", ip, port)
 		fmt.Printf("Trying %s...\n", addr)
-		node, err = network.NewSimpleNode(ip.String(), port, false, true)
+		node, err = network.NewSimpleNode(ip, port, false, true)
 		if err != nil {
 			fmt.Printf("  Failed: %v\n", err)
 			continue
@@ -48,10 +43,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	first := previous
-
-	count := 1
-	expectedBits := block.LOWEST_BITS
+	verifier := block.NewHeaderVerifier(previous, 0, block.LOWEST_BITS)
 
 	err = node.Handshake()
 	if err != nil {
@@ -73,28 +65,13 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		for _, header := range headers.Blocks {
-			if !header.CheckProofOfWork() {
-				fmt.Printf("bad PoW at block %d\n", count)
-			}
-			if header.PrevBlock != [32]byte(prevHash) {
-				fmt.Printf("discontinous block at %d\n", count)
-			}
-
-			// Calculate new difficulty at boundary blocks
-			if count%2016 == 0 {
-				expectedBits = header.CalcNewBits(first, previous)
-				fmt.Printf("Block %d: Adjusting difficulty\n", count)
-				fmt.Printf("   %x\n", expectedBits)
-				first = header
-			}
-			if header.Bits != expectedBits {
-				fmt.Printf("bad bits at block %d\n", count)
-			}
-			previous = header
-			prevHash, _ = previous.Hash()
-			count += 1
+		if err := verifier.Verify(headers.Blocks); err != nil {
+			fmt.Printf("bad header chain: %v\n", err)
+			break
 		}
+		tip, height := verifier.Tip()
+		prevHash, _ = tip.Hash()
+		fmt.Printf("Verified headers up to block %d\n", height)
 		// fmt.Printf("Received %d headers!\n", len(headers.Blocks))
 		// for i, b := range headers.Blocks[:min(5, len(headers.Blocks))] {
 		// 	fmt.Printf("Block %d: %s\n", i, b.ID())